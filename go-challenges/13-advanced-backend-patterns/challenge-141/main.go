@@ -1,19 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // Domain Models
@@ -45,6 +65,29 @@ type Author struct {
 	Bio  *string `json:"bio,omitempty"`
 }
 
+// Review is a user's star rating of a book. A book's Rating is the average
+// of its reviews' stars once it has any.
+type Review struct {
+	ID        string    `json:"id"`
+	BookID    string    `json:"bookId"`
+	UserID    string    `json:"userId"`
+	Stars     int       `json:"stars"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuthorDeletePolicy decides what happens to an author's books on delete
+type AuthorDeletePolicy string
+
+const (
+	// DeleteRestrict rejects the delete while the author still has books
+	DeleteRestrict AuthorDeletePolicy = "RESTRICT"
+	// DeleteCascade deletes the author's books along with the author
+	DeleteCascade AuthorDeletePolicy = "CASCADE"
+	// DeleteOrphan keeps the books and clears their author reference
+	DeleteOrphan AuthorDeletePolicy = "ORPHAN"
+)
+
 type BookFilter struct {
 	Genre     *Genre
 	MinRating *float64
@@ -59,6 +102,27 @@ type PaginationInput struct {
 	Before *string
 }
 
+type BookSortField string
+
+const (
+	SortByTitle         BookSortField = "TITLE"
+	SortByPublishedYear BookSortField = "PUBLISHED_YEAR"
+	SortByRating        BookSortField = "RATING"
+	SortByCreatedAt     BookSortField = "CREATED_AT"
+)
+
+type SortDirection string
+
+const (
+	SortAsc  SortDirection = "ASC"
+	SortDesc SortDirection = "DESC"
+)
+
+type BookOrder struct {
+	Field     BookSortField
+	Direction SortDirection
+}
+
 type BookEdge struct {
 	Node   *Book  `json:"node"`
 	Cursor string `json:"cursor"`
@@ -76,703 +140,4783 @@ type BookConnection struct {
 	PageInfo *PageInfo   `json:"pageInfo"`
 }
 
-// Storage Layer
-type Store struct {
-	mu         sync.RWMutex
-	books      map[string]*Book
-	authors    map[string]*Author
-	nextBookID int
-	nextAuthorID int
+type ReviewEdge struct {
+	Node   *Review `json:"node"`
+	Cursor string  `json:"cursor"`
 }
 
-func NewStore() *Store {
-	return &Store{
-		books:   make(map[string]*Book),
-		authors: make(map[string]*Author),
-		nextBookID: 1,
-		nextAuthorID: 1,
+type ReviewConnection struct {
+	Edges    []*ReviewEdge `json:"edges"`
+	PageInfo *PageInfo     `json:"pageInfo"`
+}
+
+// Book events
+type BookEventType string
+
+const (
+	BookAdded   BookEventType = "BOOK_ADDED"
+	BookUpdated BookEventType = "BOOK_UPDATED"
+)
+
+// BookPubSub fans out book changes to subscribers
+type BookPubSub struct {
+	mu          sync.RWMutex
+	subscribers map[BookEventType]map[int]chan *Book
+	nextID      int
+}
+
+func NewBookPubSub() *BookPubSub {
+	return &BookPubSub{
+		subscribers: make(map[BookEventType]map[int]chan *Book),
 	}
 }
 
-func (s *Store) CreateBook(title, isbn string, publishedYear int, authorID string, genre Genre, rating *float64) (*Book, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Subscribe registers a listener for an event type and returns the event
+// channel together with a function that removes the subscription
+func (ps *BookPubSub) Subscribe(event BookEventType) (<-chan *Book, func()) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
 
-	// Validate author exists
-	if _, exists := s.authors[authorID]; !exists {
-		return nil, errors.New("author not found")
+	id := ps.nextID
+	ps.nextID++
+
+	ch := make(chan *Book, 16)
+	if ps.subscribers[event] == nil {
+		ps.subscribers[event] = make(map[int]chan *Book)
 	}
+	ps.subscribers[event][id] = ch
 
-	// Validate input
-	if title == "" {
-		return nil, errors.New("title is required")
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			ps.mu.Lock()
+			defer ps.mu.Unlock()
+			delete(ps.subscribers[event], id)
+			close(ch)
+		})
 	}
-	if isbn == "" {
-		return nil, errors.New("ISBN is required")
+
+	return ch, unsubscribe
+}
+
+// Publish delivers a snapshot of the book to every subscriber of the event.
+// Slow subscribers whose buffer is full miss the event instead of blocking writers.
+func (ps *BookPubSub) Publish(event BookEventType, book *Book) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for _, ch := range ps.subscribers[event] {
+		snapshot := *book
+		select {
+		case ch <- &snapshot:
+		default:
+		}
 	}
-	if publishedYear < 1000 || publishedYear > time.Now().Year()+1 {
-		return nil, errors.New("invalid published year")
+}
+
+// SubscriberCount returns the number of active subscribers for an event
+func (ps *BookPubSub) SubscriberCount(event BookEventType) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.subscribers[event])
+}
+
+// Domain errors
+const (
+	CodeBadUserInput = "BAD_USER_INPUT"
+	CodeNotFound     = "NOT_FOUND"
+	CodeConflict     = "CONFLICT"
+)
+
+// DomainError is a failure clients can program against. Its code, and the
+// input field and hint when known, are surfaced as GraphQL error extensions.
+type DomainError struct {
+	Code    string
+	Message string
+	Field   string
+	Hint    string
+}
+
+func (e *DomainError) Error() string {
+	return e.Message
+}
+
+func (e *DomainError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.Code}
+	if e.Field != "" {
+		ext["field"] = e.Field
 	}
-	if rating != nil && (*rating < 0 || *rating > 5) {
-		return nil, errors.New("rating must be between 0 and 5")
+	if e.Hint != "" {
+		ext["hint"] = e.Hint
 	}
+	return ext
+}
 
-	book := &Book{
-		ID:            fmt.Sprintf("%d", s.nextBookID),
-		Title:         title,
-		ISBN:          isbn,
-		PublishedYear: publishedYear,
-		AuthorID:      authorID,
-		Genre:         genre,
-		Rating:        rating,
-		CreatedAt:     time.Now(),
-	}
-	s.books[book.ID] = book
-	s.nextBookID++
-	return book, nil
+// Is matches on code and message so copies made by WithField still satisfy
+// errors.Is against the sentinel they came from
+func (e *DomainError) Is(target error) bool {
+	t, ok := target.(*DomainError)
+	return ok && t.Code == e.Code && t.Message == e.Message
 }
 
-func (s *Store) GetBook(id string) (*Book, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// WithField returns a copy of the error attributed to an input field
+func (e *DomainError) WithField(field string) *DomainError {
+	c := *e
+	c.Field = field
+	return &c
+}
 
-	book, exists := s.books[id]
-	if !exists {
-		return nil, errors.New("book not found")
+func invalidInput(field, message, hint string) *DomainError {
+	return &DomainError{Code: CodeBadUserInput, Message: message, Field: field, Hint: hint}
+}
+
+func invalidDeletePolicy(policy AuthorDeletePolicy) *DomainError {
+	return invalidInput("onDelete", fmt.Sprintf("invalid delete policy %q", policy), "use RESTRICT, CASCADE or ORPHAN")
+}
+
+func invalidPublishedYear() *DomainError {
+	return invalidInput("publishedYear", "invalid published year", fmt.Sprintf("use a year between 1000 and %d", time.Now().Year()+1))
+}
+
+func invalidRating() *DomainError {
+	return invalidInput("rating", "rating must be between 0 and 5", "")
+}
+
+func invalidCursor(field string, err error) *DomainError {
+	return invalidInput(field, fmt.Sprintf("invalid %s cursor: %v", field, err), "pass a cursor returned by a previous page")
+}
+
+// Repositories
+var (
+	ErrBookNotFound   = &DomainError{Code: CodeNotFound, Message: "book not found"}
+	ErrAuthorNotFound = &DomainError{Code: CodeNotFound, Message: "author not found"}
+)
+
+// BookRepository persists books. Implementations assign IDs on create and
+// return copies, so callers can modify results without touching storage.
+type BookRepository interface {
+	// CreateBook inserts the book, failing with ErrAuthorNotFound when its
+	// author does not exist; the check and insert happen atomically
+	CreateBook(book *Book) error
+	GetBook(id string) (*Book, error)
+	ListBooks() ([]*Book, error)
+	ListBooksByAuthor(authorID string) ([]*Book, error)
+	UpdateBook(book *Book) error
+	DeleteBook(id string) error
+}
+
+// AuthorRepository persists authors
+type AuthorRepository interface {
+	CreateAuthor(author *Author) error
+	GetAuthor(id string) (*Author, error)
+	GetAuthorsByIDs(ids []string) (map[string]*Author, error)
+	ListAuthors() ([]*Author, error)
+	UpdateAuthor(author *Author) error
+	// DeleteAuthor applies the policy to the author's books in the same
+	// atomic step as removing the author
+	DeleteAuthor(id string, policy AuthorDeletePolicy) error
+}
+
+// ReviewRepository persists reviews
+type ReviewRepository interface {
+	// CreateReview inserts the review, failing with ErrBookNotFound when its
+	// book does not exist, and sets the book's rating to the average of its
+	// reviews in the same atomic step
+	CreateReview(review *Review) error
+	ListReviewsByBook(bookID string) ([]*Review, error)
+}
+
+// Repository is the full persistence backend used by Store
+type Repository interface {
+	BookRepository
+	AuthorRepository
+	ReviewRepository
+}
+
+func authorHasBooksError(count int) error {
+	return &DomainError{
+		Code:    CodeConflict,
+		Message: fmt.Sprintf("author has %d books; delete them first or use CASCADE or ORPHAN", count),
+		Field:   "onDelete",
+		Hint:    "pass onDelete: CASCADE to delete the books or ORPHAN to keep them without an author",
 	}
-	return book, nil
 }
 
-func (s *Store) GetBooks(filter *BookFilter, pagination *PaginationInput) (*BookConnection, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// MemoryRepository is the default map-backed Repository
+type MemoryRepository struct {
+	mu           sync.RWMutex
+	books        map[string]*Book
+	authors      map[string]*Author
+	reviews      map[string][]*Review // keyed by book ID, in insertion order
+	nextBookID   int
+	nextAuthorID int
+	nextReviewID int
+}
 
-	// Collect all books
-	var allBooks []*Book
-	for _, book := range s.books {
-		allBooks = append(allBooks, book)
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		books:        make(map[string]*Book),
+		authors:      make(map[string]*Author),
+		reviews:      make(map[string][]*Review),
+		nextBookID:   1,
+		nextAuthorID: 1,
+		nextReviewID: 1,
 	}
+}
 
-	// Apply filters
-	var filtered []*Book
-	for _, book := range allBooks {
-		if filter != nil {
-			if filter.Genre != nil && book.Genre != *filter.Genre {
-				continue
-			}
-			if filter.MinRating != nil && (book.Rating == nil || *book.Rating < *filter.MinRating) {
-				continue
-			}
-			if filter.Title != nil && !strings.Contains(strings.ToLower(book.Title), strings.ToLower(*filter.Title)) {
-				continue
-			}
-			if filter.AuthorID != nil && book.AuthorID != *filter.AuthorID {
-				continue
-			}
-		}
-		filtered = append(filtered, book)
+func copyBook(book *Book) *Book {
+	c := *book
+	if book.Rating != nil {
+		rating := *book.Rating
+		c.Rating = &rating
 	}
+	return &c
+}
 
-	// Apply pagination
-	return s.paginateBooks(filtered, pagination)
+func copyAuthor(author *Author) *Author {
+	c := *author
+	if author.Bio != nil {
+		bio := *author.Bio
+		c.Bio = &bio
+	}
+	return &c
 }
 
-func (s *Store) paginateBooks(books []*Book, pagination *PaginationInput) (*BookConnection, error) {
-	if len(books) == 0 {
-		return &BookConnection{
-			Edges:    []*BookEdge{},
-			PageInfo: &PageInfo{HasNextPage: false, HasPreviousPage: false},
-		}, nil
+func (r *MemoryRepository) CreateBook(book *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.authors[book.AuthorID]; !exists {
+		return ErrAuthorNotFound
 	}
 
-	// Default pagination
-	first := 10
-	if pagination != nil && pagination.First != nil {
-		first = *pagination.First
-	}
-
-	startIdx := 0
-	if pagination != nil && pagination.After != nil {
-		// Decode cursor
-		afterID, err := decodeCursor(*pagination.After)
-		if err == nil {
-			for i, book := range books {
-				if book.ID == afterID {
-					startIdx = i + 1
-					break
-				}
-			}
-		}
+	book.ID = strconv.Itoa(r.nextBookID)
+	r.nextBookID++
+	r.books[book.ID] = copyBook(book)
+	return nil
+}
+
+func (r *MemoryRepository) GetBook(id string) (*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	book, exists := r.books[id]
+	if !exists {
+		return nil, ErrBookNotFound
 	}
+	return copyBook(book), nil
+}
 
-	endIdx := startIdx + first
-	if endIdx > len(books) {
-		endIdx = len(books)
+func (r *MemoryRepository) ListBooks() ([]*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	books := make([]*Book, 0, len(r.books))
+	for _, book := range r.books {
+		books = append(books, copyBook(book))
 	}
+	return books, nil
+}
 
-	// Create edges
-	var edges []*BookEdge
-	for i := startIdx; i < endIdx; i++ {
-		edges = append(edges, &BookEdge{
-			Node:   books[i],
-			Cursor: encodeCursor(books[i].ID),
-		})
+func (r *MemoryRepository) ListBooksByAuthor(authorID string) ([]*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var books []*Book
+	for _, book := range r.books {
+		if book.AuthorID == authorID {
+			books = append(books, copyBook(book))
+		}
 	}
+	sort.Slice(books, func(i, j int) bool {
+		return compareBookIDs(books[i].ID, books[j].ID) < 0
+	})
+	return books, nil
+}
+
+func (r *MemoryRepository) UpdateBook(book *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// Page info
-	pageInfo := &PageInfo{
-		HasNextPage:     endIdx < len(books),
-		HasPreviousPage: startIdx > 0,
+	if _, exists := r.books[book.ID]; !exists {
+		return ErrBookNotFound
 	}
+	r.books[book.ID] = copyBook(book)
+	return nil
+}
 
-	if len(edges) > 0 {
-		startCursor := edges[0].Cursor
-		endCursor := edges[len(edges)-1].Cursor
-		pageInfo.StartCursor = &startCursor
-		pageInfo.EndCursor = &endCursor
+func (r *MemoryRepository) DeleteBook(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.books[id]; !exists {
+		return ErrBookNotFound
 	}
+	delete(r.books, id)
+	delete(r.reviews, id)
+	return nil
+}
 
-	return &BookConnection{
-		Edges:    edges,
-		PageInfo: pageInfo,
-	}, nil
+func (r *MemoryRepository) CreateAuthor(author *Author) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	author.ID = strconv.Itoa(r.nextAuthorID)
+	r.nextAuthorID++
+	r.authors[author.ID] = copyAuthor(author)
+	return nil
 }
 
-func (s *Store) UpdateBook(id, title, isbn string, publishedYear *int, rating *float64) (*Book, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (r *MemoryRepository) GetAuthor(id string) (*Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	book, exists := s.books[id]
+	author, exists := r.authors[id]
 	if !exists {
-		return nil, errors.New("book not found")
+		return nil, ErrAuthorNotFound
 	}
+	return copyAuthor(author), nil
+}
 
-	if title != "" {
-		book.Title = title
+func (r *MemoryRepository) GetAuthorsByIDs(ids []string) (map[string]*Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	authors := make(map[string]*Author, len(ids))
+	for _, id := range ids {
+		if author, exists := r.authors[id]; exists {
+			authors[id] = copyAuthor(author)
+		}
 	}
-	if isbn != "" {
-		book.ISBN = isbn
+	return authors, nil
+}
+
+func (r *MemoryRepository) ListAuthors() ([]*Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	authors := make([]*Author, 0, len(r.authors))
+	for _, author := range r.authors {
+		authors = append(authors, copyAuthor(author))
 	}
-	if publishedYear != nil {
-		if *publishedYear < 1000 || *publishedYear > time.Now().Year()+1 {
-			return nil, errors.New("invalid published year")
+	sort.Slice(authors, func(i, j int) bool {
+		return compareBookIDs(authors[i].ID, authors[j].ID) < 0
+	})
+	return authors, nil
+}
+
+func (r *MemoryRepository) UpdateAuthor(author *Author) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.authors[author.ID]; !exists {
+		return ErrAuthorNotFound
+	}
+	r.authors[author.ID] = copyAuthor(author)
+	return nil
+}
+
+func (r *MemoryRepository) DeleteAuthor(id string, policy AuthorDeletePolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.authors[id]; !exists {
+		return ErrAuthorNotFound
+	}
+
+	var books []*Book
+	for _, book := range r.books {
+		if book.AuthorID == id {
+			books = append(books, book)
 		}
-		book.PublishedYear = *publishedYear
 	}
-	if rating != nil {
-		if *rating < 0 || *rating > 5 {
-			return nil, errors.New("rating must be between 0 and 5")
+
+	switch policy {
+	case DeleteRestrict:
+		if len(books) > 0 {
+			return authorHasBooksError(len(books))
 		}
-		book.Rating = rating
+	case DeleteCascade:
+		for _, book := range books {
+			delete(r.books, book.ID)
+			delete(r.reviews, book.ID)
+		}
+	case DeleteOrphan:
+		for _, book := range books {
+			book.AuthorID = ""
+		}
+	default:
+		return invalidDeletePolicy(policy)
 	}
 
-	return book, nil
+	delete(r.authors, id)
+	return nil
 }
 
-func (s *Store) DeleteBook(id string) (bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (r *MemoryRepository) CreateReview(review *Review) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if _, exists := s.books[id]; !exists {
-		return false, errors.New("book not found")
+	book, exists := r.books[review.BookID]
+	if !exists {
+		return ErrBookNotFound
 	}
 
-	delete(s.books, id)
-	return true, nil
+	review.ID = strconv.Itoa(r.nextReviewID)
+	r.nextReviewID++
+	stored := *review
+	r.reviews[review.BookID] = append(r.reviews[review.BookID], &stored)
+
+	average := averageStars(r.reviews[review.BookID])
+	book.Rating = &average
+	return nil
 }
 
-func (s *Store) CreateAuthor(name string, bio *string) (*Author, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (r *MemoryRepository) ListReviewsByBook(bookID string) ([]*Review, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	if name == "" {
-		return nil, errors.New("name is required")
+	reviews := make([]*Review, 0, len(r.reviews[bookID]))
+	for _, review := range r.reviews[bookID] {
+		c := *review
+		reviews = append(reviews, &c)
 	}
+	return reviews, nil
+}
 
-	author := &Author{
-		ID:   fmt.Sprintf("%d", s.nextAuthorID),
-		Name: name,
-		Bio:  bio,
+func averageStars(reviews []*Review) float64 {
+	if len(reviews) == 0 {
+		return 0
 	}
-	s.authors[author.ID] = author
-	s.nextAuthorID++
-	return author, nil
+	total := 0
+	for _, review := range reviews {
+		total += review.Stars
+	}
+	return float64(total) / float64(len(reviews))
 }
 
-func (s *Store) GetAuthor(id string) (*Author, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// sqliteMigrations are applied in order; each entry's index+1 is its version
+var sqliteMigrations = []string{
+	`CREATE TABLE authors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		bio TEXT
+	);
+	CREATE TABLE books (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		isbn TEXT NOT NULL,
+		published_year INTEGER NOT NULL,
+		author_id INTEGER REFERENCES authors(id),
+		genre TEXT NOT NULL,
+		rating REAL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_books_author_id ON books(author_id);`,
+	`CREATE TABLE reviews (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL,
+		stars INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_reviews_book_id ON reviews(book_id);`,
+}
 
-	author, exists := s.authors[id]
-	if !exists {
-		return nil, errors.New("author not found")
-	}
-	return author, nil
+// SQLiteRepository is a Repository backed by a SQLite database
+type SQLiteRepository struct {
+	db *sql.DB
 }
 
-func (s *Store) GetAuthors(limit *int) ([]*Author, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// NewSQLiteRepository opens the database at dsn and applies any pending migrations
+func NewSQLiteRepository(dsn string) (*SQLiteRepository, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
 
-	var authors []*Author
-	for _, author := range s.authors {
-		authors = append(authors, author)
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being split across connections
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	if limit != nil && *limit > 0 && *limit < len(authors) {
-		authors = authors[:*limit]
+	repo := &SQLiteRepository{db: db}
+	if err := repo.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
 	}
+	return repo, nil
+}
 
-	return authors, nil
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
 }
 
-func (s *Store) GetBooksByAuthor(authorID string) ([]*Book, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (r *SQLiteRepository) migrate() error {
+	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
 
-	var books []*Book
-	for _, book := range s.books {
-		if book.AuthorID == authorID {
-			books = append(books, book)
+	var current int
+	if err := r.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(sqliteMigrations); i++ {
+		err := r.withTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", i+1, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("version %d: %w", i+1, err)
 		}
 	}
-	return books, nil
+	return nil
 }
 
-// Cursor encoding/decoding
-func encodeCursor(id string) string {
-	return base64.StdEncoding.EncodeToString([]byte(id))
+// withTx runs fn in a transaction, rolling back if it returns an error
+func (r *SQLiteRepository) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func decodeCursor(cursor string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(cursor)
-	if err != nil {
-		return "", err
+// parseRowID converts a GraphQL ID to a SQLite rowid; IDs that aren't
+// numeric can never match a row
+func parseRowID(id string) (int64, bool) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	return n, err == nil
+}
+
+func nullableAuthorID(authorID string) sql.NullInt64 {
+	n, ok := parseRowID(authorID)
+	return sql.NullInt64{Int64: n, Valid: ok}
+}
+
+func nullableRating(rating *float64) sql.NullFloat64 {
+	if rating == nil {
+		return sql.NullFloat64{}
 	}
-	return string(data), nil
+	return sql.NullFloat64{Float64: *rating, Valid: true}
 }
 
-// GraphQL Schema
-func buildSchema(store *Store) (graphql.Schema, error) {
-	// Enum types
-	genreEnum := graphql.NewEnum(graphql.EnumConfig{
-		Name: "Genre",
-		Values: graphql.EnumValueConfigMap{
-			"FICTION":    &graphql.EnumValueConfig{Value: GenreFiction},
-			"NONFICTION": &graphql.EnumValueConfig{Value: GenreNonfiction},
-			"SCIFI":      &graphql.EnumValueConfig{Value: GenreSciFi},
-			"FANTASY":    &graphql.EnumValueConfig{Value: GenreFantasy},
-			"MYSTERY":    &graphql.EnumValueConfig{Value: GenreMystery},
-			"ROMANCE":    &graphql.EnumValueConfig{Value: GenreRomance},
-		},
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const sqliteBookColumns = "id, title, isbn, published_year, author_id, genre, rating, created_at"
+
+func scanBook(row rowScanner) (*Book, error) {
+	var (
+		book      Book
+		id        int64
+		authorID  sql.NullInt64
+		genre     string
+		rating    sql.NullFloat64
+		createdAt int64
+	)
+	err := row.Scan(&id, &book.Title, &book.ISBN, &book.PublishedYear, &authorID, &genre, &rating, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	book.ID = strconv.FormatInt(id, 10)
+	if authorID.Valid {
+		book.AuthorID = strconv.FormatInt(authorID.Int64, 10)
+	}
+	book.Genre = Genre(genre)
+	if rating.Valid {
+		value := rating.Float64
+		book.Rating = &value
+	}
+	book.CreatedAt = time.Unix(0, createdAt)
+	return &book, nil
+}
+
+func scanAuthor(row rowScanner) (*Author, error) {
+	var (
+		author Author
+		id     int64
+		bio    sql.NullString
+	)
+	if err := row.Scan(&id, &author.Name, &bio); err != nil {
+		return nil, err
+	}
+
+	author.ID = strconv.FormatInt(id, 10)
+	if bio.Valid {
+		value := bio.String
+		author.Bio = &value
+	}
+	return &author, nil
+}
+
+func (r *SQLiteRepository) queryBooks(query string, args ...interface{}) ([]*Book, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []*Book
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+func (r *SQLiteRepository) CreateBook(book *Book) error {
+	return r.withTx(func(tx *sql.Tx) error {
+		authorID, ok := parseRowID(book.AuthorID)
+		if !ok {
+			return ErrAuthorNotFound
+		}
+
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM authors WHERE id = ?", authorID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAuthorNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO books (title, isbn, published_year, author_id, genre, rating, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			book.Title, book.ISBN, book.PublishedYear, authorID, string(book.Genre), nullableRating(book.Rating), book.CreatedAt.UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		book.ID = strconv.FormatInt(id, 10)
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) GetBook(id string) (*Book, error) {
+	rowID, ok := parseRowID(id)
+	if !ok {
+		return nil, ErrBookNotFound
+	}
+
+	book, err := scanBook(r.db.QueryRow("SELECT "+sqliteBookColumns+" FROM books WHERE id = ?", rowID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBookNotFound
+	}
+	return book, err
+}
+
+func (r *SQLiteRepository) ListBooks() ([]*Book, error) {
+	return r.queryBooks("SELECT " + sqliteBookColumns + " FROM books ORDER BY id")
+}
+
+func (r *SQLiteRepository) ListBooksByAuthor(authorID string) ([]*Book, error) {
+	rowID, ok := parseRowID(authorID)
+	if !ok {
+		return nil, nil
+	}
+	return r.queryBooks("SELECT "+sqliteBookColumns+" FROM books WHERE author_id = ? ORDER BY id", rowID)
+}
+
+func (r *SQLiteRepository) UpdateBook(book *Book) error {
+	rowID, ok := parseRowID(book.ID)
+	if !ok {
+		return ErrBookNotFound
+	}
+
+	result, err := r.db.Exec(
+		"UPDATE books SET title = ?, isbn = ?, published_year = ?, author_id = ?, genre = ?, rating = ? WHERE id = ?",
+		book.Title, book.ISBN, book.PublishedYear, nullableAuthorID(book.AuthorID), string(book.Genre), nullableRating(book.Rating), rowID,
+	)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, ErrBookNotFound)
+}
+
+func (r *SQLiteRepository) DeleteBook(id string) error {
+	rowID, ok := parseRowID(id)
+	if !ok {
+		return ErrBookNotFound
+	}
+
+	result, err := r.db.Exec("DELETE FROM books WHERE id = ?", rowID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, ErrBookNotFound)
+}
+
+// requireAffected returns notFound when a statement matched no rows
+func requireAffected(result sql.Result, notFound error) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) CreateAuthor(author *Author) error {
+	var bio sql.NullString
+	if author.Bio != nil {
+		bio = sql.NullString{String: *author.Bio, Valid: true}
+	}
+
+	result, err := r.db.Exec("INSERT INTO authors (name, bio) VALUES (?, ?)", author.Name, bio)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	author.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (r *SQLiteRepository) GetAuthor(id string) (*Author, error) {
+	rowID, ok := parseRowID(id)
+	if !ok {
+		return nil, ErrAuthorNotFound
+	}
+
+	author, err := scanAuthor(r.db.QueryRow("SELECT id, name, bio FROM authors WHERE id = ?", rowID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAuthorNotFound
+	}
+	return author, err
+}
+
+func (r *SQLiteRepository) GetAuthorsByIDs(ids []string) (map[string]*Author, error) {
+	authors := make(map[string]*Author, len(ids))
+
+	var args []interface{}
+	for _, id := range ids {
+		if rowID, ok := parseRowID(id); ok {
+			args = append(args, rowID)
+		}
+	}
+	if len(args) == 0 {
+		return authors, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	rows, err := r.db.Query("SELECT id, name, bio FROM authors WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		author, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors[author.ID] = author
+	}
+	return authors, rows.Err()
+}
+
+func (r *SQLiteRepository) ListAuthors() ([]*Author, error) {
+	rows, err := r.db.Query("SELECT id, name, bio FROM authors ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var authors []*Author
+	for rows.Next() {
+		author, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+func (r *SQLiteRepository) UpdateAuthor(author *Author) error {
+	rowID, ok := parseRowID(author.ID)
+	if !ok {
+		return ErrAuthorNotFound
+	}
+
+	var bio sql.NullString
+	if author.Bio != nil {
+		bio = sql.NullString{String: *author.Bio, Valid: true}
+	}
+
+	result, err := r.db.Exec("UPDATE authors SET name = ?, bio = ? WHERE id = ?", author.Name, bio, rowID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, ErrAuthorNotFound)
+}
+
+func (r *SQLiteRepository) DeleteAuthor(id string, policy AuthorDeletePolicy) error {
+	rowID, ok := parseRowID(id)
+	if !ok {
+		return ErrAuthorNotFound
+	}
+
+	return r.withTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM authors WHERE id = ?", rowID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAuthorNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM books WHERE author_id = ?", rowID).Scan(&count); err != nil {
+			return err
+		}
+
+		switch policy {
+		case DeleteRestrict:
+			if count > 0 {
+				return authorHasBooksError(count)
+			}
+		case DeleteCascade:
+			if _, err := tx.Exec("DELETE FROM books WHERE author_id = ?", rowID); err != nil {
+				return err
+			}
+		case DeleteOrphan:
+			if _, err := tx.Exec("UPDATE books SET author_id = NULL WHERE author_id = ?", rowID); err != nil {
+				return err
+			}
+		default:
+			return invalidDeletePolicy(policy)
+		}
+
+		_, err = tx.Exec("DELETE FROM authors WHERE id = ?", rowID)
+		return err
+	})
+}
+
+func (r *SQLiteRepository) CreateReview(review *Review) error {
+	bookID, ok := parseRowID(review.BookID)
+	if !ok {
+		return ErrBookNotFound
+	}
+
+	return r.withTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM books WHERE id = ?", bookID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO reviews (book_id, user_id, stars, text, created_at) VALUES (?, ?, ?, ?, ?)",
+			bookID, review.UserID, review.Stars, review.Text, review.CreatedAt.UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE books SET rating = (SELECT AVG(stars) FROM reviews WHERE book_id = ?) WHERE id = ?", bookID, bookID)
+		if err != nil {
+			return err
+		}
+
+		review.ID = strconv.FormatInt(id, 10)
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) ListReviewsByBook(bookID string) ([]*Review, error) {
+	rowID, ok := parseRowID(bookID)
+	if !ok {
+		return nil, nil
+	}
+
+	rows, err := r.db.Query("SELECT id, user_id, stars, text, created_at FROM reviews WHERE book_id = ? ORDER BY id", rowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []*Review
+	for rows.Next() {
+		var (
+			id        int64
+			createdAt int64
+		)
+		review := &Review{BookID: bookID}
+		if err := rows.Scan(&id, &review.UserID, &review.Stars, &review.Text, &createdAt); err != nil {
+			return nil, err
+		}
+		review.ID = strconv.FormatInt(id, 10)
+		review.CreatedAt = time.Unix(0, createdAt)
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+// Search index
+
+// searchField records which book fields a term appeared in
+type searchField uint8
+
+const (
+	searchTitle searchField = 1 << iota
+	searchAuthor
+	searchISBN
+
+	searchAll = searchTitle | searchAuthor | searchISBN
+)
+
+// Title matches rank above author matches, which rank above ISBN matches
+var searchFieldWeights = map[searchField]float64{
+	searchTitle:  3,
+	searchAuthor: 2,
+	searchISBN:   1,
+}
+
+func (f searchField) weight() float64 {
+	total := 0.0
+	for field, weight := range searchFieldWeights {
+		if f&field != 0 {
+			total += weight
+		}
+	}
+	return total
+}
+
+// searchIndex is an inverted index from terms to the books containing them.
+// The vocabulary is kept sorted so prefix lookups are a binary search.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]searchField // term -> book ID -> fields
+	docTerms map[string][]string               // book ID -> terms, for removal
+	terms    []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]searchField),
+		docTerms: make(map[string][]string),
+	}
+}
+
+// tokenize lowercases text and splits it on anything but letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
 	})
+}
+
+// isbnTerm strips separators from something that looks like an ISBN, so
+// "978-0134" and "9780134" both prefix-match the same book
+func isbnTerm(text string) (string, bool) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case r >= '0' && r <= '9', r == 'x':
+			b.WriteRune(r)
+		case r == '-' || r == ' ':
+		default:
+			return "", false
+		}
+	}
+	if b.Len() < 3 {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// Index adds or replaces a book's entry
+func (ix *searchIndex) Index(book *Book, authorName string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(book.ID)
+
+	fields := make(map[string]searchField)
+	for _, term := range tokenize(book.Title) {
+		fields[term] |= searchTitle
+	}
+	for _, term := range tokenize(authorName) {
+		fields[term] |= searchAuthor
+	}
+	for _, term := range tokenize(book.ISBN) {
+		fields[term] |= searchISBN
+	}
+	if term, ok := isbnTerm(book.ISBN); ok {
+		fields[term] |= searchISBN
+	}
+
+	terms := make([]string, 0, len(fields))
+	for term, field := range fields {
+		docs, exists := ix.postings[term]
+		if !exists {
+			docs = make(map[string]searchField)
+			ix.postings[term] = docs
+			i := sort.SearchStrings(ix.terms, term)
+			ix.terms = append(ix.terms, "")
+			copy(ix.terms[i+1:], ix.terms[i:])
+			ix.terms[i] = term
+		}
+		docs[book.ID] = field
+		terms = append(terms, term)
+	}
+	ix.docTerms[book.ID] = terms
+}
+
+// Remove drops a book from the index
+func (ix *searchIndex) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *searchIndex) remove(id string) {
+	for _, term := range ix.docTerms[id] {
+		docs := ix.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(ix.postings, term)
+			i := sort.SearchStrings(ix.terms, term)
+			if i < len(ix.terms) && ix.terms[i] == term {
+				ix.terms = append(ix.terms[:i], ix.terms[i+1:]...)
+			}
+		}
+	}
+	delete(ix.docTerms, id)
+}
+
+// Search scores the books in which every query term prefix-matches a term
+// from one of the given fields. Exact term matches score double.
+func (ix *searchIndex) Search(query string, fields searchField) map[string]float64 {
+	queryTerms := tokenize(query)
+	if term, ok := isbnTerm(query); ok && fields&searchISBN != 0 && len(queryTerms) > 1 {
+		queryTerms = []string{term}
+	}
+	if len(queryTerms) == 0 {
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var scores map[string]float64
+	for i, queryTerm := range queryTerms {
+		matches := make(map[string]float64)
+		for j := sort.SearchStrings(ix.terms, queryTerm); j < len(ix.terms) && strings.HasPrefix(ix.terms[j], queryTerm); j++ {
+			term := ix.terms[j]
+			for id, field := range ix.postings[term] {
+				score := (field & fields).weight()
+				if score == 0 {
+					continue
+				}
+				if term == queryTerm {
+					score *= 2
+				}
+				if score > matches[id] {
+					matches[id] = score
+				}
+			}
+		}
+
+		if i == 0 {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if score, ok := matches[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// Storage Layer
+
+// Store validates input, shapes query results, keeps the search index and
+// publishes events on top of a pluggable Repository
+type Store struct {
+	mu     sync.Mutex
+	repo   Repository
+	events *BookPubSub
+	index  *searchIndex
+}
+
+func NewStore() *Store {
+	return NewStoreWithRepository(NewMemoryRepository())
+}
+
+func NewStoreWithRepository(repo Repository) *Store {
+	s := &Store{
+		repo:   repo,
+		events: NewBookPubSub(),
+		index:  newSearchIndex(),
+	}
+
+	// Persistent repositories may already hold books
+	books, err := repo.ListBooks()
+	if err != nil {
+		log.Printf("search index: %v", err)
+	}
+	for _, book := range books {
+		s.indexBook(book)
+	}
+	return s
+}
+
+func (s *Store) indexBook(book *Book) {
+	authorName := ""
+	if author, err := s.repo.GetAuthor(book.AuthorID); err == nil {
+		authorName = author.Name
+	}
+	s.index.Index(book, authorName)
+}
+
+// Subscribe listens for book events emitted by CreateBook and UpdateBook
+func (s *Store) Subscribe(event BookEventType) (<-chan *Book, func()) {
+	return s.events.Subscribe(event)
+}
+
+func (s *Store) CreateBook(title, isbn string, publishedYear int, authorID string, genre Genre, rating *float64) (*Book, error) {
+	// Validate input
+	if title == "" {
+		return nil, invalidInput("title", "title is required", "provide a non-empty title")
+	}
+	if isbn == "" {
+		return nil, invalidInput("isbn", "ISBN is required", "provide the book's ISBN")
+	}
+	if publishedYear < 1000 || publishedYear > time.Now().Year()+1 {
+		return nil, invalidPublishedYear()
+	}
+	if rating != nil && (*rating < 0 || *rating > 5) {
+		return nil, invalidRating()
+	}
+
+	book := &Book{
+		Title:         title,
+		ISBN:          isbn,
+		PublishedYear: publishedYear,
+		AuthorID:      authorID,
+		Genre:         genre,
+		Rating:        rating,
+		CreatedAt:     time.Now(),
+	}
+
+	// The repository checks the author exists in the same step as the insert
+	if err := s.repo.CreateBook(book); err != nil {
+		if errors.Is(err, ErrAuthorNotFound) {
+			return nil, ErrAuthorNotFound.WithField("authorId")
+		}
+		return nil, err
+	}
+
+	s.indexBook(book)
+	s.events.Publish(BookAdded, book)
+	return book, nil
+}
+
+func (s *Store) GetBook(id string) (*Book, error) {
+	return s.repo.GetBook(id)
+}
+
+func (s *Store) GetBooks(filter *BookFilter, pagination *PaginationInput) (*BookConnection, error) {
+	return s.GetBooksOrdered(filter, nil, pagination)
+}
+
+// GetBooksOrdered returns a page of books sorted by orderBy. A nil order
+// sorts by creation order, ascending.
+func (s *Store) GetBooksOrdered(filter *BookFilter, orderBy *BookOrder, pagination *PaginationInput) (*BookConnection, error) {
+	order, err := normalizeBookOrder(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, err := s.filterBooks(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply pagination
+	return s.paginateBooks(filtered, order, pagination)
+}
+
+// FindBooks returns every book matching filter, sorted by orderBy
+func (s *Store) FindBooks(filter *BookFilter, orderBy *BookOrder) ([]*Book, error) {
+	order, err := normalizeBookOrder(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	books, err := s.filterBooks(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return compareBooks(books[i], books[j], order) < 0
+	})
+	return books, nil
+}
+
+func (s *Store) filterBooks(filter *BookFilter) ([]*Book, error) {
+	// Collect all books
+	allBooks, err := s.repo.ListBooks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Title matching goes through the search index: every word of the
+	// filter must prefix a word of the title
+	var titleMatches map[string]float64
+	if filter != nil && filter.Title != nil && len(tokenize(*filter.Title)) > 0 {
+		titleMatches = s.index.Search(*filter.Title, searchTitle)
+	}
+
+	// Apply filters
+	var filtered []*Book
+	for _, book := range allBooks {
+		if filter != nil {
+			if filter.Genre != nil && book.Genre != *filter.Genre {
+				continue
+			}
+			if filter.MinRating != nil && (book.Rating == nil || *book.Rating < *filter.MinRating) {
+				continue
+			}
+			if titleMatches != nil {
+				if _, ok := titleMatches[book.ID]; !ok {
+					continue
+				}
+			}
+			if filter.AuthorID != nil && book.AuthorID != *filter.AuthorID {
+				continue
+			}
+		}
+		filtered = append(filtered, book)
+	}
+	return filtered, nil
+}
+
+func (s *Store) paginateBooks(books []*Book, order BookOrder, pagination *PaginationInput) (*BookConnection, error) {
+	// Cursors point at a position in the ordering rather than an index, so
+	// they stay valid when the referenced book is deleted mid-iteration
+	sort.Slice(books, func(i, j int) bool {
+		return compareBooks(books[i], books[j], order) < 0
+	})
+
+	start, end, pageInfo, err := paginate(len(books), pagination,
+		func(cursor string) (func(i int) int, error) {
+			book, err := decodeBookCursor(cursor, order)
+			if err != nil {
+				return nil, err
+			}
+			return func(i int) int { return compareBooks(books[i], book, order) }, nil
+		},
+		func(i int) string { return encodeBookCursor(books[i], order) },
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	edges := make([]*BookEdge, 0, end-start)
+	for i := start; i < end; i++ {
+		edges = append(edges, &BookEdge{
+			Node:   books[i],
+			Cursor: encodeBookCursor(books[i], order),
+		})
+	}
+
+	return &BookConnection{
+		Edges:    edges,
+		PageInfo: pageInfo,
+	}, nil
+}
+
+func normalizeBookOrder(orderBy *BookOrder) (BookOrder, error) {
+	order := BookOrder{Field: SortByCreatedAt, Direction: SortAsc}
+	if orderBy == nil {
+		return order, nil
+	}
+
+	switch orderBy.Field {
+	case "":
+	case SortByTitle, SortByPublishedYear, SortByRating, SortByCreatedAt:
+		order.Field = orderBy.Field
+	default:
+		return order, invalidInput("orderBy.field", fmt.Sprintf("invalid orderBy field %q", orderBy.Field), "use TITLE, PUBLISHED_YEAR, RATING or CREATED_AT")
+	}
+
+	switch orderBy.Direction {
+	case "":
+	case SortAsc, SortDesc:
+		order.Direction = orderBy.Direction
+	default:
+		return order, invalidInput("orderBy.direction", fmt.Sprintf("invalid orderBy direction %q", orderBy.Direction), "use ASC or DESC")
+	}
+
+	return order, nil
+}
+
+// compareBooks orders books by the sort field, breaking ties by ID so the
+// ordering is total. Creation order is the ID sequence.
+func compareBooks(a, b *Book, order BookOrder) int {
+	c := 0
+	switch order.Field {
+	case SortByTitle:
+		c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		if c == 0 {
+			c = strings.Compare(a.Title, b.Title)
+		}
+	case SortByPublishedYear:
+		c = a.PublishedYear - b.PublishedYear
+	case SortByRating:
+		c = compareRatings(a.Rating, b.Rating)
+	}
+
+	if c == 0 {
+		c = compareBookIDs(a.ID, b.ID)
+	}
+	if order.Direction == SortDesc {
+		c = -c
+	}
+	return c
+}
+
+// compareRatings sorts unrated books before rated ones
+func compareRatings(a, b *float64) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case *a < *b:
+		return -1
+	case *a > *b:
+		return 1
+	}
+	return 0
+}
+
+// compareBookIDs orders numeric IDs numerically and falls back to string order
+func compareBookIDs(a, b string) int {
+	ai, errA := strconv.Atoi(a)
+	bi, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func (s *Store) UpdateBook(id, title, isbn string, publishedYear *int, rating *float64) (*Book, error) {
+	// Serialize read-modify-write cycles so concurrent updates don't interleave
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	book, err := s.repo.GetBook(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if title != "" {
+		book.Title = title
+	}
+	if isbn != "" {
+		book.ISBN = isbn
+	}
+	if publishedYear != nil {
+		if *publishedYear < 1000 || *publishedYear > time.Now().Year()+1 {
+			return nil, invalidPublishedYear()
+		}
+		book.PublishedYear = *publishedYear
+	}
+	if rating != nil {
+		if *rating < 0 || *rating > 5 {
+			return nil, invalidRating()
+		}
+		reviews, err := s.repo.ListReviewsByBook(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(reviews) > 0 {
+			return nil, &DomainError{
+				Code:    CodeConflict,
+				Message: "rating is computed from reviews and cannot be set directly",
+				Field:   "rating",
+				Hint:    "use addReview; the rating is the average of the book's reviews",
+			}
+		}
+		book.Rating = rating
+	}
+
+	if err := s.repo.UpdateBook(book); err != nil {
+		return nil, err
+	}
+
+	s.indexBook(book)
+	s.events.Publish(BookUpdated, book)
+	return book, nil
+}
+
+func (s *Store) DeleteBook(id string) (bool, error) {
+	if err := s.repo.DeleteBook(id); err != nil {
+		return false, err
+	}
+	s.index.Remove(id)
+	return true, nil
+}
+
+func (s *Store) CreateAuthor(name string, bio *string) (*Author, error) {
+	if name == "" {
+		return nil, invalidInput("name", "name is required", "provide the author's name")
+	}
+
+	author := &Author{
+		Name: name,
+		Bio:  bio,
+	}
+	if err := s.repo.CreateAuthor(author); err != nil {
+		return nil, err
+	}
+	return author, nil
+}
+
+func (s *Store) GetAuthor(id string) (*Author, error) {
+	return s.repo.GetAuthor(id)
+}
+
+func (s *Store) UpdateAuthor(id string, name, bio *string) (*Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	author, err := s.repo.GetAuthor(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != nil {
+		if strings.TrimSpace(*name) == "" {
+			return nil, invalidInput("name", "name cannot be empty", "omit name to keep the current one")
+		}
+		author.Name = *name
+	}
+	if bio != nil {
+		author.Bio = bio
+	}
+
+	if err := s.repo.UpdateAuthor(author); err != nil {
+		return nil, err
+	}
+
+	// Author names are searchable through their books
+	books, err := s.repo.ListBooksByAuthor(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, book := range books {
+		s.index.Index(book, author.Name)
+	}
+	return author, nil
+}
+
+// DeleteAuthor removes an author, handling their books according to policy
+func (s *Store) DeleteAuthor(id string, policy AuthorDeletePolicy) (bool, error) {
+	if policy == "" {
+		policy = DeleteRestrict
+	}
+
+	switch policy {
+	case DeleteRestrict, DeleteCascade, DeleteOrphan:
+	default:
+		return false, invalidDeletePolicy(policy)
+	}
+
+	books, err := s.repo.ListBooksByAuthor(id)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.repo.DeleteAuthor(id, policy); err != nil {
+		return false, err
+	}
+
+	for _, book := range books {
+		if policy == DeleteCascade {
+			s.index.Remove(book.ID)
+		} else {
+			s.index.Index(book, "")
+		}
+	}
+	return true, nil
+}
+
+// GetAuthorsByIDs fetches many authors in a single call. Missing IDs are
+// simply absent from the returned map.
+func (s *Store) GetAuthorsByIDs(ids []string) (map[string]*Author, error) {
+	return s.repo.GetAuthorsByIDs(ids)
+}
+
+func (s *Store) GetAuthors(limit *int) ([]*Author, error) {
+	authors, err := s.repo.ListAuthors()
+	if err != nil {
+		return nil, err
+	}
+
+	if limit != nil && *limit > 0 && *limit < len(authors) {
+		authors = authors[:*limit]
+	}
+
+	return authors, nil
+}
+
+func (s *Store) GetBooksByAuthor(authorID string) ([]*Book, error) {
+	return s.repo.ListBooksByAuthor(authorID)
+}
+
+// SearchBooks finds books whose title, author name or ISBN match every word
+// of query by prefix, most relevant first
+func (s *Store) SearchBooks(query string, limit int) ([]*Book, error) {
+	if len(tokenize(query)) == 0 {
+		return nil, invalidInput("query", "search query must contain a letter or digit", "")
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+
+	scores := s.index.Search(query, searchAll)
+	books := make([]*Book, 0, len(scores))
+	for id := range scores {
+		book, err := s.repo.GetBook(id)
+		if errors.Is(err, ErrBookNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		if a, b := scores[books[i].ID], scores[books[j].ID]; a != b {
+			return a > b
+		}
+		if books[i].Title != books[j].Title {
+			return books[i].Title < books[j].Title
+		}
+		return compareBookIDs(books[i].ID, books[j].ID) < 0
+	})
+
+	if len(books) > limit {
+		books = books[:limit]
+	}
+	return books, nil
+}
+
+// AddReview records a review and recomputes the book's average rating
+func (s *Store) AddReview(bookID, userID string, stars int, text string) (*Review, error) {
+	if userID == "" {
+		return nil, invalidInput("userId", "user is required", "")
+	}
+	if stars < 1 || stars > 5 {
+		return nil, invalidInput("stars", "stars must be between 1 and 5", "use a whole number from 1 to 5")
+	}
+	if len(text) > 2000 {
+		return nil, invalidInput("text", "review text must be at most 2000 characters", "")
+	}
+
+	// Hold the update lock so a concurrent UpdateBook can't overwrite the
+	// recomputed rating with a stale copy
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	review := &Review{
+		BookID:    bookID,
+		UserID:    userID,
+		Stars:     stars,
+		Text:      text,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateReview(review); err != nil {
+		if errors.Is(err, ErrBookNotFound) {
+			return nil, ErrBookNotFound.WithField("bookId")
+		}
+		return nil, err
+	}
+
+	if book, err := s.repo.GetBook(bookID); err == nil {
+		s.events.Publish(BookUpdated, book)
+	}
+	return review, nil
+}
+
+// GetReviews returns a book's reviews, oldest first
+func (s *Store) GetReviews(bookID string, pagination *PaginationInput) (*ReviewConnection, error) {
+	reviews, err := s.repo.ListReviewsByBook(bookID)
+	if err != nil {
+		return nil, err
+	}
+	return paginateReviews(reviews, pagination)
+}
+
+func (s *Store) CountReviews(bookID string) (int, error) {
+	reviews, err := s.repo.ListReviewsByBook(bookID)
+	return len(reviews), err
+}
+
+func paginateReviews(reviews []*Review, pagination *PaginationInput) (*ReviewConnection, error) {
+	sort.Slice(reviews, func(i, j int) bool {
+		return compareBookIDs(reviews[i].ID, reviews[j].ID) < 0
+	})
+
+	start, end, pageInfo, err := paginate(len(reviews), pagination,
+		func(cursor string) (func(i int) int, error) {
+			id, err := decodeCursor(cursor)
+			if err != nil {
+				return nil, err
+			}
+			return func(i int) int { return compareBookIDs(reviews[i].ID, id) }, nil
+		},
+		func(i int) string { return encodeCursor(reviews[i].ID) },
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	edges := make([]*ReviewEdge, 0, end-start)
+	for i := start; i < end; i++ {
+		edges = append(edges, &ReviewEdge{
+			Node:   reviews[i],
+			Cursor: encodeCursor(reviews[i].ID),
+		})
+	}
+
+	return &ReviewConnection{
+		Edges:    edges,
+		PageInfo: pageInfo,
+	}, nil
+}
+
+// DataLoader
+type authorResult struct {
+	author *Author
+	err    error
+}
+
+// AuthorLoader batches and caches author lookups for a single request.
+// Load only queues the key; the first thunk to be evaluated fetches every
+// queued key with one GetAuthorsByIDs call.
+type AuthorLoader struct {
+	store   *Store
+	mu      sync.Mutex
+	cache   map[string]*authorResult
+	pending []string
+	queued  map[string]bool
+	batches int
+}
+
+func NewAuthorLoader(store *Store) *AuthorLoader {
+	return &AuthorLoader{
+		store:  store,
+		cache:  make(map[string]*authorResult),
+		queued: make(map[string]bool),
+	}
+}
+
+// Load queues an author ID and returns a thunk that resolves it
+func (l *AuthorLoader) Load(id string) func() (*Author, error) {
+	l.mu.Lock()
+	if _, cached := l.cache[id]; !cached && !l.queued[id] {
+		l.pending = append(l.pending, id)
+		l.queued[id] = true
+	}
+	l.mu.Unlock()
+
+	return func() (*Author, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if _, cached := l.cache[id]; !cached {
+			l.dispatch()
+		}
+		result := l.cache[id]
+		return result.author, result.err
+	}
+}
+
+// dispatch fetches all pending keys; callers must hold l.mu
+func (l *AuthorLoader) dispatch() {
+	keys := l.pending
+	l.pending = nil
+	l.queued = make(map[string]bool)
+	l.batches++
+
+	authors, err := l.store.GetAuthorsByIDs(keys)
+	for _, key := range keys {
+		switch {
+		case err != nil:
+			l.cache[key] = &authorResult{err: err}
+		case authors[key] == nil:
+			l.cache[key] = &authorResult{err: errors.New("author not found")}
+		default:
+			l.cache[key] = &authorResult{author: authors[key]}
+		}
+	}
+}
+
+// BatchCount returns how many batched store calls the loader issued
+func (l *AuthorLoader) BatchCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.batches
+}
+
+// Loaders groups the per-request data loaders
+type Loaders struct {
+	Author *AuthorLoader
+}
+
+type contextKey string
+
+const loadersKey contextKey = "loaders"
+
+// WithLoaders attaches a fresh set of loaders to the context
+func WithLoaders(ctx context.Context, store *Store) context.Context {
+	return context.WithValue(ctx, loadersKey, &Loaders{Author: NewAuthorLoader(store)})
+}
+
+// LoadersFromContext returns the loaders for the request, if any
+func LoadersFromContext(ctx context.Context) (*Loaders, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	loaders, ok := ctx.Value(loadersKey).(*Loaders)
+	return loaders, ok
+}
+
+// resolveAuthor resolves an author through the request loader when present,
+// falling back to a direct store lookup otherwise
+func resolveAuthor(ctx context.Context, store *Store, authorID string) (interface{}, error) {
+	// Orphaned books have no author
+	if authorID == "" {
+		return nil, nil
+	}
+
+	loaders, ok := LoadersFromContext(ctx)
+	if !ok {
+		return store.GetAuthor(authorID)
+	}
+
+	thunk := loaders.Author.Load(authorID)
+	return func() (interface{}, error) {
+		return thunk()
+	}, nil
+}
+
+// dataLoaderMiddleware gives every request its own loaders so caching never
+// leaks between requests
+func dataLoaderMiddleware(store *Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithLoaders(r.Context(), store)))
+	})
+}
+
+// Authentication
+const RoleEditor = "editor"
+
+// AuthUser is the caller identified by a validated JWT
+type AuthUser struct {
+	ID       string
+	Username string
+	Roles    []string
+}
+
+func (u *AuthUser) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthError is returned by resolver guards
+type AuthError struct {
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+func (e *AuthError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.Code}
+}
+
+var (
+	ErrUnauthenticated = &AuthError{Code: "UNAUTHENTICATED", Message: "authentication required"}
+	ErrForbidden       = &AuthError{Code: "FORBIDDEN", Message: "insufficient permissions"}
+)
+
+const userKey contextKey = "user"
+
+// WithUser stores the authenticated user in the context
+func WithUser(ctx context.Context, user *AuthUser) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the authenticated user, if any
+func UserFromContext(ctx context.Context) (*AuthUser, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	user, ok := ctx.Value(userKey).(*AuthUser)
+	return user, ok && user != nil
+}
+
+// IssueToken signs an HS256 token carrying the user's ID, name and roles
+func IssueToken(secret []byte, user *AuthUser, ttl time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      user.ID,
+		"username": user.Username,
+		"roles":    user.Roles,
+		"exp":      time.Now().Add(ttl).Unix(),
+	})
+	return token.SignedString(secret)
+}
+
+// ParseToken validates an HS256 token and extracts the user from its claims
+func ParseToken(secret []byte, tokenString string) (*AuthUser, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return secret, nil
+	}, jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	user := &AuthUser{ID: subject}
+	if username, ok := claims["username"].(string); ok {
+		user.Username = username
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if r, ok := role.(string); ok {
+				user.Roles = append(user.Roles, r)
+			}
+		}
+	}
+	return user, nil
+}
+
+// authMiddleware validates a Bearer token when one is sent and puts the user
+// in the request context. Anonymous requests pass through so public queries
+// keep working; protected resolvers enforce authentication themselves.
+func authMiddleware(secret []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		if tokenString == authHeader {
+			http.Error(w, "invalid authorization header format", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := ParseToken(secret, tokenString)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// requireAuthentication wraps a resolver so it only runs for signed-in users
+func requireAuthentication(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if _, ok := UserFromContext(p.Context); !ok {
+			return nil, ErrUnauthenticated
+		}
+		return resolve(p)
+	}
+}
+
+// requireRole guards a resolver like a @hasRole directive would
+func requireRole(role string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		user, ok := UserFromContext(p.Context)
+		if !ok {
+			return nil, ErrUnauthenticated
+		}
+		if !user.HasRole(role) {
+			return nil, ErrForbidden
+		}
+		return resolve(p)
+	}
+}
+
+// parseBookFilterArg converts a BookFilter argument into its Go form
+func parseBookFilterArg(arg interface{}) *BookFilter {
+	f, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	filter := &BookFilter{}
+	if genre, ok := f["genre"].(Genre); ok {
+		filter.Genre = &genre
+	}
+	if minRating, ok := f["minRating"].(float64); ok {
+		filter.MinRating = &minRating
+	}
+	if title, ok := f["title"].(string); ok {
+		filter.Title = &title
+	}
+	if authorID, ok := f["authorId"].(string); ok {
+		filter.AuthorID = &authorID
+	}
+	return filter
+}
+
+// parsePaginationArg converts a PaginationInput argument into its Go form
+func parsePaginationArg(arg interface{}) *PaginationInput {
+	pg, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	pagination := &PaginationInput{}
+	if first, ok := pg["first"].(int); ok {
+		pagination.First = &first
+	}
+	if after, ok := pg["after"].(string); ok {
+		pagination.After = &after
+	}
+	if last, ok := pg["last"].(int); ok {
+		pagination.Last = &last
+	}
+	if before, ok := pg["before"].(string); ok {
+		pagination.Before = &before
+	}
+	return pagination
+}
+
+// paginate applies Relay first/after/last/before arguments to n items
+// sorted in cursor order and returns the page as the index range
+// [start, end). compareTo decodes a cursor into a function reporting
+// whether item i sorts before (<0), at (0) or after (>0) the position the
+// cursor marks; cursorAt encodes item i's cursor. Every connection pages
+// through here so they agree on windows and page info.
+func paginate(n int, pagination *PaginationInput, compareTo func(cursor string) (func(i int) int, error), cursorAt func(i int) string) (start, end int, pageInfo *PageInfo, err error) {
+	var first, last *int
+	var after, before *string
+	if pagination != nil {
+		first, last = pagination.First, pagination.Last
+		after, before = pagination.After, pagination.Before
+	}
+
+	if first != nil && *first < 0 {
+		return 0, 0, nil, invalidInput("first", "first must be a non-negative integer", "")
+	}
+	if last != nil && *last < 0 {
+		return 0, 0, nil, invalidInput("last", "last must be a non-negative integer", "")
+	}
+
+	// Default pagination
+	if first == nil && last == nil {
+		defaultFirst := 10
+		first = &defaultFirst
+	}
+
+	start, end = 0, n
+
+	if after != nil {
+		compare, err := compareTo(*after)
+		if err != nil {
+			return 0, 0, nil, invalidCursor("after", err)
+		}
+		start = sort.Search(n, func(i int) bool { return compare(i) > 0 })
+	}
+
+	if before != nil {
+		compare, err := compareTo(*before)
+		if err != nil {
+			return 0, 0, nil, invalidCursor("before", err)
+		}
+		end = sort.Search(n, func(i int) bool { return compare(i) >= 0 })
+	}
+
+	if end < start {
+		end = start
+	}
+
+	// Page info: items outside the after/before window count as previous/next pages
+	pageInfo = &PageInfo{
+		HasNextPage:     end < n,
+		HasPreviousPage: start > 0,
+	}
+
+	if first != nil && end-start > *first {
+		end = start + *first
+		pageInfo.HasNextPage = true
+	}
+
+	if last != nil && end-start > *last {
+		start = end - *last
+		pageInfo.HasPreviousPage = true
+	}
+
+	if end > start {
+		startCursor := cursorAt(start)
+		endCursor := cursorAt(end - 1)
+		pageInfo.StartCursor = &startCursor
+		pageInfo.EndCursor = &endCursor
+	}
+
+	return start, end, pageInfo, nil
+}
+
+// Cursor encoding/decoding
+func encodeCursor(id string) string {
+	return base64.StdEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// bookCursor carries the sort key alongside the ID so a cursor can be
+// positioned even after its book is gone
+type bookCursor struct {
+	ID    string        `json:"id"`
+	Field BookSortField `json:"field"`
+	Key   string        `json:"key"`
+}
+
+// encodeBookCursor keeps plain ID cursors for creation order and embeds the
+// sort key for every other ordering
+func encodeBookCursor(book *Book, order BookOrder) string {
+	if order.Field == SortByCreatedAt {
+		return encodeCursor(book.ID)
+	}
+
+	data, _ := json.Marshal(bookCursor{
+		ID:    book.ID,
+		Field: order.Field,
+		Key:   bookSortKey(book, order.Field),
+	})
+	return encodeCursor(string(data))
+}
+
+// decodeBookCursor rebuilds the sort-relevant fields of the cursor's book
+func decodeBookCursor(cursor string, order BookOrder) (*Book, error) {
+	raw, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(raw, "{") {
+		if order.Field != SortByCreatedAt {
+			return nil, errors.New("cursor does not match orderBy")
+		}
+		return &Book{ID: raw}, nil
+	}
+
+	var c bookCursor
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		return nil, err
+	}
+	if c.Field != order.Field {
+		return nil, errors.New("cursor does not match orderBy")
+	}
+
+	book := &Book{ID: c.ID}
+	switch c.Field {
+	case SortByTitle:
+		book.Title = c.Key
+	case SortByPublishedYear:
+		year, err := strconv.Atoi(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		book.PublishedYear = year
+	case SortByRating:
+		if c.Key != "" {
+			rating, err := strconv.ParseFloat(c.Key, 64)
+			if err != nil {
+				return nil, err
+			}
+			book.Rating = &rating
+		}
+	}
+	return book, nil
+}
+
+func bookSortKey(book *Book, field BookSortField) string {
+	switch field {
+	case SortByTitle:
+		return book.Title
+	case SortByPublishedYear:
+		return strconv.Itoa(book.PublishedYear)
+	case SortByRating:
+		if book.Rating == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*book.Rating, 'g', -1, 64)
+	}
+	return ""
+}
+
+// GraphQL Schema
+// SchemaOption enables optional parts of the schema
+type SchemaOption func(*schemaOptions)
+
+type schemaOptions struct {
+	exporter *BookExporter
+	sdl      string
+}
+
+// WithBookExporter enables the exportBooks query
+func WithBookExporter(exporter *BookExporter) SchemaOption {
+	return func(o *schemaOptions) {
+		o.exporter = exporter
+	}
+}
+
+// WithSDL builds the schema's shape from SDL instead of the Go definitions,
+// keeping the Go resolvers for every type and field the SDL declares
+func WithSDL(sdl string) SchemaOption {
+	return func(o *schemaOptions) {
+		o.sdl = sdl
+	}
+}
+
+func buildSchema(store *Store, opts ...SchemaOption) (graphql.Schema, error) {
+	var options schemaOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// Enum types
+	genreEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name: "Genre",
+		Values: graphql.EnumValueConfigMap{
+			"FICTION":    &graphql.EnumValueConfig{Value: GenreFiction},
+			"NONFICTION": &graphql.EnumValueConfig{Value: GenreNonfiction},
+			"SCIFI":      &graphql.EnumValueConfig{Value: GenreSciFi},
+			"FANTASY":    &graphql.EnumValueConfig{Value: GenreFantasy},
+			"MYSTERY":    &graphql.EnumValueConfig{Value: GenreMystery},
+			"ROMANCE":    &graphql.EnumValueConfig{Value: GenreRomance},
+		},
+	})
+
+	// Object types (declared first for forward references)
+	var bookType *graphql.Object
+	var authorType *graphql.Object
+
+	// Author type
+	authorType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Author",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+			},
+			"name": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"bio": &graphql.Field{
+				Type: graphql.String,
+			},
+			"books": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+					Name: "BookRef",
+					Fields: graphql.Fields{
+						"id":            &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+						"title":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+						"isbn":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+						"publishedYear": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+						"genre":         &graphql.Field{Type: graphql.NewNonNull(genreEnum)},
+						"rating":        &graphql.Field{Type: graphql.Float},
+						"createdAt":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+					},
+				})))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if author, ok := p.Source.(*Author); ok {
+						return store.GetBooksByAuthor(author.ID)
+					}
+					return nil, errors.New("invalid source type")
+				},
+			},
+		},
+	})
+
+	// Book type
+	bookType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Book",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+			},
+			"title": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"isbn": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"publishedYear": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+			},
+			"genre": &graphql.Field{
+				Type: graphql.NewNonNull(genreEnum),
+			},
+			"rating": &graphql.Field{
+				Type: graphql.Float,
+			},
+			"createdAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if book, ok := p.Source.(*Book); ok {
+						return book.CreatedAt.Format(time.RFC3339), nil
+					}
+					return nil, nil
+				},
+			},
+			"author": &graphql.Field{
+				Type: authorType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if book, ok := p.Source.(*Book); ok {
+						return resolveAuthor(p.Context, store, book.AuthorID)
+					}
+					return nil, errors.New("invalid source type")
+				},
+			},
+		},
+	})
+
+	// PageInfo type
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+			},
+			"hasPreviousPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+			},
+			"startCursor": &graphql.Field{
+				Type: graphql.String,
+			},
+			"endCursor": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+
+	// BookEdge type
+	bookEdgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BookEdge",
+		Fields: graphql.Fields{
+			"node": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+			},
+			"cursor": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+	})
+
+	// BookConnection type
+	bookConnectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BookConnection",
+		Fields: graphql.Fields{
+			"edges": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookEdgeType))),
+			},
+			"pageInfo": &graphql.Field{
+				Type: graphql.NewNonNull(pageInfoType),
+			},
+		},
+	})
+
+	// Input types
+	bookFilterInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "BookFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"genre":     &graphql.InputObjectFieldConfig{Type: genreEnum},
+			"minRating": &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"title":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"authorId":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	bookSortFieldEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name: "BookSortField",
+		Values: graphql.EnumValueConfigMap{
+			"TITLE":          &graphql.EnumValueConfig{Value: SortByTitle},
+			"PUBLISHED_YEAR": &graphql.EnumValueConfig{Value: SortByPublishedYear},
+			"RATING":         &graphql.EnumValueConfig{Value: SortByRating},
+			"CREATED_AT":     &graphql.EnumValueConfig{Value: SortByCreatedAt},
+		},
+	})
+
+	sortDirectionEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name: "SortDirection",
+		Values: graphql.EnumValueConfigMap{
+			"ASC":  &graphql.EnumValueConfig{Value: SortAsc},
+			"DESC": &graphql.EnumValueConfig{Value: SortDesc},
+		},
+	})
+
+	bookOrderInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "BookOrder",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"field":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(bookSortFieldEnum)},
+			"direction": &graphql.InputObjectFieldConfig{Type: sortDirectionEnum, DefaultValue: SortAsc},
+		},
+	})
+
+	paginationInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PaginationInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"first":  &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"after":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"last":   &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"before": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	// Review types; attached to Book afterwards since Review links back to it
+	reviewType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Review",
+		Fields: graphql.Fields{
+			"id":     &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"userId": &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"stars":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"text":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"createdAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if review, ok := p.Source.(*Review); ok {
+						return review.CreatedAt.Format(time.RFC3339), nil
+					}
+					return nil, nil
+				},
+			},
+			"book": &graphql.Field{
+				Type: bookType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if review, ok := p.Source.(*Review); ok {
+						return store.GetBook(review.BookID)
+					}
+					return nil, errors.New("invalid source type")
+				},
+			},
+		},
+	})
+
+	reviewEdgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ReviewEdge",
+		Fields: graphql.Fields{
+			"node":   &graphql.Field{Type: graphql.NewNonNull(reviewType)},
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	reviewConnectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ReviewConnection",
+		Fields: graphql.Fields{
+			"edges": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(reviewEdgeType))),
+			},
+			"pageInfo": &graphql.Field{
+				Type: graphql.NewNonNull(pageInfoType),
+			},
+		},
+	})
+
+	bookType.AddFieldConfig("reviews", &graphql.Field{
+		Type: graphql.NewNonNull(reviewConnectionType),
+		Args: graphql.FieldConfigArgument{
+			"pagination": &graphql.ArgumentConfig{Type: paginationInput},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if book, ok := p.Source.(*Book); ok {
+				return store.GetReviews(book.ID, parsePaginationArg(p.Args["pagination"]))
+			}
+			return nil, errors.New("invalid source type")
+		},
+	})
+	bookType.AddFieldConfig("reviewCount", &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Int),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if book, ok := p.Source.(*Book); ok {
+				return store.CountReviews(book.ID)
+			}
+			return nil, errors.New("invalid source type")
+		},
+	})
+
+	addReviewInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AddReviewInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"stars": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"text":  &graphql.InputObjectFieldConfig{Type: graphql.String, DefaultValue: ""},
+		},
+	})
+
+	createBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateBookInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"isbn":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"publishedYear": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"authorId":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"genre":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(genreEnum)},
+			"rating":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		},
+	})
+
+	updateBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateBookInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"isbn":          &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"publishedYear": &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"rating":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		},
+	})
+
+	updateAuthorInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateAuthorInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"bio":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	authorDeletePolicyEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name: "AuthorDeletePolicy",
+		Values: graphql.EnumValueConfigMap{
+			"RESTRICT": &graphql.EnumValueConfig{Value: DeleteRestrict},
+			"CASCADE":  &graphql.EnumValueConfig{Value: DeleteCascade},
+			"ORPHAN":   &graphql.EnumValueConfig{Value: DeleteOrphan},
+		},
+	})
+
+	createAuthorInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateAuthorInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"bio":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	exportFormatEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name: "ExportFormat",
+		Values: graphql.EnumValueConfigMap{
+			"CSV":    &graphql.EnumValueConfig{Value: ExportCSV},
+			"NDJSON": &graphql.EnumValueConfig{Value: ExportNDJSON},
+		},
+	})
+
+	bookExportType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BookExport",
+		Fields: graphql.Fields{
+			"url":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"format": &graphql.Field{Type: graphql.NewNonNull(exportFormatEnum)},
+			"expiresAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if export, ok := p.Source.(*BookExport); ok {
+						return export.ExpiresAt.Format(time.RFC3339), nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	// Query type
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"books": &graphql.Field{
+				Type: graphql.NewNonNull(bookConnectionType),
+				Args: graphql.FieldConfigArgument{
+					"filter":     &graphql.ArgumentConfig{Type: bookFilterInput},
+					"pagination": &graphql.ArgumentConfig{Type: paginationInput},
+					"orderBy":    &graphql.ArgumentConfig{Type: bookOrderInput},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filter := parseBookFilterArg(p.Args["filter"])
+					pagination := parsePaginationArg(p.Args["pagination"])
+
+					var orderBy *BookOrder
+					if o, ok := p.Args["orderBy"].(map[string]interface{}); ok {
+						orderBy = &BookOrder{}
+						if field, ok := o["field"].(BookSortField); ok {
+							orderBy.Field = field
+						}
+						if direction, ok := o["direction"].(SortDirection); ok {
+							orderBy.Direction = direction
+						}
+					}
+
+					return store.GetBooksOrdered(filter, orderBy, pagination)
+				},
+			},
+			"book": &graphql.Field{
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, _ := p.Args["id"].(string)
+					return store.GetBook(id)
+				},
+			},
+			"authors": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(authorType))),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var limit *int
+					if l, ok := p.Args["limit"].(int); ok {
+						limit = &l
+					}
+					return store.GetAuthors(limit)
+				},
+			},
+			"author": &graphql.Field{
+				Type: authorType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, _ := p.Args["id"].(string)
+					return store.GetAuthor(id)
+				},
+			},
+			"searchBooks": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookType))),
+				Args: graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					query, _ := p.Args["query"].(string)
+					limit, _ := p.Args["limit"].(int)
+					return store.SearchBooks(query, limit)
+				},
+			},
+			"exportBooks": &graphql.Field{
+				Type: graphql.NewNonNull(bookExportType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: bookFilterInput},
+					"format": &graphql.ArgumentConfig{Type: exportFormatEnum, DefaultValue: ExportCSV},
+				},
+				Resolve: requireAuthentication(func(p graphql.ResolveParams) (interface{}, error) {
+					if options.exporter == nil {
+						return nil, errors.New("book exports are not enabled")
+					}
+					format, _ := p.Args["format"].(ExportFormat)
+					return options.exporter.Export(parseBookFilterArg(p.Args["filter"]), format)
+				}),
+			},
+		},
+	})
+
+	// Mutation type
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createBook": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createBookInput)},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					input := p.Args["input"].(map[string]interface{})
+					title := input["title"].(string)
+					isbn := input["isbn"].(string)
+					publishedYear := input["publishedYear"].(int)
+					authorID := input["authorId"].(string)
+					genre := input["genre"].(Genre)
+
+					var rating *float64
+					if r, ok := input["rating"].(float64); ok {
+						rating = &r
+					}
+
+					return store.CreateBook(title, isbn, publishedYear, authorID, genre, rating)
+				}),
+			},
+			"updateBook": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateBookInput)},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					input := p.Args["input"].(map[string]interface{})
+
+					title := ""
+					if t, ok := input["title"].(string); ok {
+						title = t
+					}
+
+					isbn := ""
+					if i, ok := input["isbn"].(string); ok {
+						isbn = i
+					}
+
+					var publishedYear *int
+					if py, ok := input["publishedYear"].(int); ok {
+						publishedYear = &py
+					}
+
+					var rating *float64
+					if r, ok := input["rating"].(float64); ok {
+						rating = &r
+					}
+
+					return store.UpdateBook(id, title, isbn, publishedYear, rating)
+				}),
+			},
+			"deleteBook": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					return store.DeleteBook(id)
+				}),
+			},
+			"createAuthor": &graphql.Field{
+				Type: graphql.NewNonNull(authorType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createAuthorInput)},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					input := p.Args["input"].(map[string]interface{})
+					name := input["name"].(string)
+
+					var bio *string
+					if b, ok := input["bio"].(string); ok {
+						bio = &b
+					}
+
+					return store.CreateAuthor(name, bio)
+				}),
+			},
+			"updateAuthor": &graphql.Field{
+				Type: graphql.NewNonNull(authorType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateAuthorInput)},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					input := p.Args["input"].(map[string]interface{})
+
+					var name *string
+					if n, ok := input["name"].(string); ok {
+						name = &n
+					}
+
+					var bio *string
+					if b, ok := input["bio"].(string); ok {
+						bio = &b
+					}
+
+					return store.UpdateAuthor(id, name, bio)
+				}),
+			},
+			"deleteAuthor": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"onDelete": &graphql.ArgumentConfig{Type: authorDeletePolicyEnum, DefaultValue: DeleteRestrict},
+				},
+				Resolve: requireRole(RoleEditor, func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					policy, _ := p.Args["onDelete"].(AuthorDeletePolicy)
+					return store.DeleteAuthor(id, policy)
+				}),
+			},
+			"addReview": &graphql.Field{
+				Type: graphql.NewNonNull(reviewType),
+				Args: graphql.FieldConfigArgument{
+					"bookId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(addReviewInput)},
+				},
+				Resolve: requireAuthentication(func(p graphql.ResolveParams) (interface{}, error) {
+					user, _ := UserFromContext(p.Context)
+					bookID := p.Args["bookId"].(string)
+					input := p.Args["input"].(map[string]interface{})
+					stars := input["stars"].(int)
+					text, _ := input["text"].(string)
+					return store.AddReview(bookID, user.ID, stars, text)
+				}),
+			},
+		},
+	})
+
+	// Subscription type
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"bookAdded": &graphql.Field{
+				Type:      graphql.NewNonNull(bookType),
+				Subscribe: subscribeBookEvents(store, BookAdded),
+				Resolve:   resolveBookEvent,
+			},
+			"bookUpdated": &graphql.Field{
+				Type:      graphql.NewNonNull(bookType),
+				Subscribe: subscribeBookEvents(store, BookUpdated),
+				Resolve:   resolveBookEvent,
+			},
+		},
+	})
+
+	// Create schema
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:        queryType,
+		Mutation:     mutationType,
+		Subscription: subscriptionType,
+	})
+	if err != nil || options.sdl == "" {
+		return schema, err
+	}
+	return buildSchemaFromSDL(options.sdl, schema)
+}
+
+// Schema SDL
+
+var builtinScalars = map[string]*graphql.Scalar{
+	"Int":     graphql.Int,
+	"Float":   graphql.Float,
+	"String":  graphql.String,
+	"Boolean": graphql.Boolean,
+	"ID":      graphql.ID,
+}
+
+// printSchemaSDL renders the schema in GraphQL schema definition language.
+// Types, fields and enum values are sorted so the output is stable.
+func printSchemaSDL(schema graphql.Schema) string {
+	var blocks []string
+
+	query, mutation, subscription := schema.QueryType(), schema.MutationType(), schema.SubscriptionType()
+	if (query != nil && query.Name() != "Query") ||
+		(mutation != nil && mutation.Name() != "Mutation") ||
+		(subscription != nil && subscription.Name() != "Subscription") {
+		var b strings.Builder
+		b.WriteString("schema {\n")
+		if query != nil {
+			fmt.Fprintf(&b, "  query: %s\n", query.Name())
+		}
+		if mutation != nil {
+			fmt.Fprintf(&b, "  mutation: %s\n", mutation.Name())
+		}
+		if subscription != nil {
+			fmt.Fprintf(&b, "  subscription: %s\n", subscription.Name())
+		}
+		b.WriteString("}")
+		blocks = append(blocks, b.String())
+	}
+
+	typeMap := schema.TypeMap()
+	names := make([]string, 0, len(typeMap))
+	for name := range typeMap {
+		if strings.HasPrefix(name, "__") || builtinScalars[name] != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if block := printTypeSDL(typeMap[name]); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+
+	return strings.Join(blocks, "\n\n") + "\n"
+}
+
+func printTypeSDL(typ graphql.Type) string {
+	var b strings.Builder
+
+	switch t := typ.(type) {
+	case *graphql.Scalar:
+		fmt.Fprintf(&b, "scalar %s", t.Name())
+	case *graphql.Object:
+		fmt.Fprintf(&b, "type %s", t.Name())
+		if interfaces := t.Interfaces(); len(interfaces) > 0 {
+			names := make([]string, len(interfaces))
+			for i, iface := range interfaces {
+				names[i] = iface.Name()
+			}
+			fmt.Fprintf(&b, " implements %s", strings.Join(names, " & "))
+		}
+		b.WriteString(" {\n")
+		printFieldsSDL(&b, t.Fields())
+		b.WriteString("}")
+	case *graphql.Interface:
+		fmt.Fprintf(&b, "interface %s {\n", t.Name())
+		printFieldsSDL(&b, t.Fields())
+		b.WriteString("}")
+	case *graphql.Union:
+		names := make([]string, 0, len(t.Types()))
+		for _, member := range t.Types() {
+			names = append(names, member.Name())
+		}
+		fmt.Fprintf(&b, "union %s = %s", t.Name(), strings.Join(names, " | "))
+	case *graphql.Enum:
+		fmt.Fprintf(&b, "enum %s {\n", t.Name())
+		values := t.Values()
+		names := make([]string, 0, len(values))
+		deprecations := make(map[string]string, len(values))
+		for _, value := range values {
+			names = append(names, value.Name)
+			deprecations[value.Name] = value.DeprecationReason
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "  %s%s\n", name, printDeprecatedSDL(deprecations[name]))
+		}
+		b.WriteString("}")
+	case *graphql.InputObject:
+		fmt.Fprintf(&b, "input %s {\n", t.Name())
+		fields := t.Fields()
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := fields[name]
+			fmt.Fprintf(&b, "  %s: %s%s\n", name, field.Type.String(), printDefaultSDL(field.DefaultValue, field.Type))
+		}
+		b.WriteString("}")
+	default:
+		return ""
+	}
+
+	return b.String()
+}
+
+func printFieldsSDL(b *strings.Builder, fields graphql.FieldDefinitionMap) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := fields[name]
+		b.WriteString("  " + name)
+		if len(field.Args) > 0 {
+			args := make([]string, len(field.Args))
+			for i, arg := range field.Args {
+				args[i] = arg.Name() + ": " + arg.Type.String() + printDefaultSDL(arg.DefaultValue, arg.Type)
+			}
+			sort.Strings(args)
+			b.WriteString("(" + strings.Join(args, ", ") + ")")
+		}
+		fmt.Fprintf(b, ": %s%s\n", field.Type.String(), printDeprecatedSDL(field.DeprecationReason))
+	}
+}
+
+func printDeprecatedSDL(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " @deprecated(reason: " + strconv.Quote(reason) + ")"
+}
+
+func printDefaultSDL(value interface{}, typ graphql.Type) string {
+	if value == nil {
+		return ""
+	}
+	return " = " + printValueSDL(value, typ)
+}
+
+// printValueSDL formats a Go default value as a GraphQL literal of typ
+func printValueSDL(value interface{}, typ graphql.Type) string {
+	if nonNull, ok := typ.(*graphql.NonNull); ok {
+		typ = nonNull.OfType
+	}
+
+	switch t := typ.(type) {
+	case *graphql.Enum:
+		for _, v := range t.Values() {
+			if v.Value == value {
+				return v.Name
+			}
+		}
+	case *graphql.List:
+		if items, ok := value.([]interface{}); ok {
+			parts := make([]string, len(items))
+			for i, item := range items {
+				parts[i] = printValueSDL(item, t.OfType)
+			}
+			return "[" + strings.Join(parts, ", ") + "]"
+		}
+	case *graphql.InputObject:
+		if fields, ok := value.(map[string]interface{}); ok {
+			defs := t.Fields()
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			parts := make([]string, 0, len(names))
+			for _, name := range names {
+				var fieldType graphql.Type = graphql.String
+				if def, ok := defs[name]; ok {
+					fieldType = def.Type
+				}
+				parts = append(parts, name+": "+printValueSDL(fields[name], fieldType))
+			}
+			return "{" + strings.Join(parts, ", ") + "}"
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// sdlSchemaBuilder turns SDL type definitions into a graphql.Schema.
+// Resolvers, subscriptions, enum values and custom scalars are borrowed
+// from a programmatic base schema by type and field name, so the SDL only
+// decides the shape of the API.
+type sdlSchemaBuilder struct {
+	base  graphql.Schema
+	defs  map[string]ast.Node
+	types map[string]graphql.Type
+}
+
+// buildSchemaFromSDL builds a schema from sdl, wiring it to base's resolvers
+func buildSchemaFromSDL(sdl string, base graphql.Schema) (graphql.Schema, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: sdl})
+	if err != nil {
+		return graphql.Schema{}, fmt.Errorf("parse schema: %w", err)
+	}
+
+	b := &sdlSchemaBuilder{
+		base:  base,
+		defs:  make(map[string]ast.Node),
+		types: make(map[string]graphql.Type),
+	}
+	for name, scalar := range builtinScalars {
+		b.types[name] = scalar
+	}
+
+	roots := map[string]string{
+		ast.OperationTypeQuery:        "Query",
+		ast.OperationTypeMutation:     "Mutation",
+		ast.OperationTypeSubscription: "Subscription",
+	}
+
+	var names []string
+	for _, def := range doc.Definitions {
+		var name string
+		switch d := def.(type) {
+		case *ast.SchemaDefinition:
+			roots = make(map[string]string)
+			for _, op := range d.OperationTypes {
+				roots[op.Operation] = op.Type.Name.Value
+			}
+			continue
+		case *ast.ObjectDefinition:
+			if len(d.Interfaces) > 0 {
+				return graphql.Schema{}, fmt.Errorf("type %s: interfaces are not supported", d.Name.Value)
+			}
+			name = d.Name.Value
+		case *ast.InputObjectDefinition:
+			name = d.Name.Value
+		case *ast.EnumDefinition:
+			name = d.Name.Value
+		case *ast.ScalarDefinition:
+			name = d.Name.Value
+		default:
+			return graphql.Schema{}, fmt.Errorf("unsupported definition %s", def.GetKind())
+		}
+
+		if _, exists := b.defs[name]; exists || builtinScalars[name] != nil {
+			return graphql.Schema{}, fmt.Errorf("type %s is defined more than once", name)
+		}
+		b.defs[name] = def
+		names = append(names, name)
+	}
+
+	if err := b.validate(); err != nil {
+		return graphql.Schema{}, err
+	}
+
+	config := graphql.SchemaConfig{}
+	for _, name := range names {
+		typ, err := b.define(name)
+		if err != nil {
+			return graphql.Schema{}, err
+		}
+		config.Types = append(config.Types, typ)
+	}
+
+	rootObject := func(operation string) (*graphql.Object, error) {
+		name, ok := roots[operation]
+		if !ok {
+			return nil, nil
+		}
+		if _, defined := b.defs[name]; !defined {
+			return nil, nil
+		}
+		obj, ok := b.types[name].(*graphql.Object)
+		if !ok {
+			return nil, fmt.Errorf("%s root %s must be an object type", operation, name)
+		}
+		return obj, nil
+	}
+
+	if config.Query, err = rootObject(ast.OperationTypeQuery); err != nil {
+		return graphql.Schema{}, err
+	}
+	if config.Query == nil {
+		return graphql.Schema{}, errors.New("schema must define a query type")
+	}
+	if config.Mutation, err = rootObject(ast.OperationTypeMutation); err != nil {
+		return graphql.Schema{}, err
+	}
+	if config.Subscription, err = rootObject(ast.OperationTypeSubscription); err != nil {
+		return graphql.Schema{}, err
+	}
+
+	return graphql.NewSchema(config)
+}
+
+// validate checks every type reference up front; the field thunks run
+// later inside graphql.NewSchema and have no way to report errors
+func (b *sdlSchemaBuilder) validate() error {
+	check := func(owner string, typ ast.Type, input bool) error {
+		name := namedTypeAST(typ)
+		def, defined := b.defs[name]
+		if !defined {
+			if builtinScalars[name] != nil {
+				return nil
+			}
+			return fmt.Errorf("%s: unknown type %s", owner, name)
+		}
+
+		switch def.(type) {
+		case *ast.ObjectDefinition:
+			if input {
+				return fmt.Errorf("%s: object type %s cannot be used as an input", owner, name)
+			}
+		case *ast.InputObjectDefinition:
+			if !input {
+				return fmt.Errorf("%s: input type %s cannot be used as an output", owner, name)
+			}
+		}
+		return nil
+	}
+
+	for name, def := range b.defs {
+		switch d := def.(type) {
+		case *ast.ObjectDefinition:
+			for _, field := range d.Fields {
+				owner := name + "." + field.Name.Value
+				if err := check(owner, field.Type, false); err != nil {
+					return err
+				}
+				for _, arg := range field.Arguments {
+					if err := check(owner+"("+arg.Name.Value+")", arg.Type, true); err != nil {
+						return err
+					}
+				}
+			}
+		case *ast.InputObjectDefinition:
+			for _, field := range d.Fields {
+				if err := check(name+"."+field.Name.Value, field.Type, true); err != nil {
+					return err
+				}
+			}
+		case *ast.ScalarDefinition:
+			if _, ok := b.base.Type(name).(*graphql.Scalar); !ok {
+				return fmt.Errorf("scalar %s has no Go implementation", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *sdlSchemaBuilder) define(name string) (graphql.Type, error) {
+	var typ graphql.Type
+
+	switch d := b.defs[name].(type) {
+	case *ast.ObjectDefinition:
+		typ = graphql.NewObject(graphql.ObjectConfig{
+			Name: name,
+			Fields: graphql.FieldsThunk(func() graphql.Fields {
+				return b.objectFields(d)
+			}),
+		})
+	case *ast.InputObjectDefinition:
+		typ = graphql.NewInputObject(graphql.InputObjectConfig{
+			Name: name,
+			Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+				return b.inputFields(d)
+			}),
+		})
+	case *ast.EnumDefinition:
+		baseValues := make(map[string]interface{})
+		if enum, ok := b.base.Type(name).(*graphql.Enum); ok {
+			for _, value := range enum.Values() {
+				baseValues[value.Name] = value.Value
+			}
+		}
+
+		values := graphql.EnumValueConfigMap{}
+		for _, value := range d.Values {
+			config := &graphql.EnumValueConfig{Value: value.Name.Value}
+			if v, ok := baseValues[value.Name.Value]; ok {
+				config.Value = v
+			}
+			values[value.Name.Value] = config
+		}
+		typ = graphql.NewEnum(graphql.EnumConfig{Name: name, Values: values})
+	case *ast.ScalarDefinition:
+		typ = b.base.Type(name)
+	default:
+		return nil, fmt.Errorf("unknown type %s", name)
+	}
+
+	b.types[name] = typ
+	return typ, nil
+}
+
+func (b *sdlSchemaBuilder) objectFields(def *ast.ObjectDefinition) graphql.Fields {
+	var baseFields graphql.FieldDefinitionMap
+	if obj, ok := b.base.Type(def.Name.Value).(*graphql.Object); ok {
+		baseFields = obj.Fields()
+	}
+
+	fields := graphql.Fields{}
+	for _, f := range def.Fields {
+		field := &graphql.Field{
+			Type: b.typeFromAST(f.Type),
+			Args: graphql.FieldConfigArgument{},
+		}
+		for _, arg := range f.Arguments {
+			argType := b.typeFromAST(arg.Type)
+			field.Args[arg.Name.Value] = &graphql.ArgumentConfig{
+				Type:         argType,
+				DefaultValue: b.valueFromAST(arg.DefaultValue, argType),
+			}
+		}
+		if baseField, ok := baseFields[f.Name.Value]; ok {
+			field.Resolve = baseField.Resolve
+			field.Subscribe = baseField.Subscribe
+		}
+		fields[f.Name.Value] = field
+	}
+	return fields
+}
+
+func (b *sdlSchemaBuilder) inputFields(def *ast.InputObjectDefinition) graphql.InputObjectConfigFieldMap {
+	fields := graphql.InputObjectConfigFieldMap{}
+	for _, f := range def.Fields {
+		fieldType := b.typeFromAST(f.Type)
+		fields[f.Name.Value] = &graphql.InputObjectFieldConfig{
+			Type:         fieldType,
+			DefaultValue: b.valueFromAST(f.DefaultValue, fieldType),
+		}
+	}
+	return fields
+}
+
+func (b *sdlSchemaBuilder) typeFromAST(typ ast.Type) graphql.Type {
+	switch t := typ.(type) {
+	case *ast.NonNull:
+		return graphql.NewNonNull(b.typeFromAST(t.Type))
+	case *ast.List:
+		return graphql.NewList(b.typeFromAST(t.Type))
+	case *ast.Named:
+		return b.types[t.Name.Value]
+	}
+	return nil
+}
+
+// valueFromAST converts a default value literal into the Go value
+// resolvers would receive for typ
+func (b *sdlSchemaBuilder) valueFromAST(value ast.Value, typ graphql.Type) interface{} {
+	if value == nil {
+		return nil
+	}
+	if nonNull, ok := typ.(*graphql.NonNull); ok {
+		typ = nonNull.OfType
+	}
+
+	switch v := value.(type) {
+	case *ast.EnumValue:
+		if enum, ok := typ.(*graphql.Enum); ok {
+			for _, ev := range enum.Values() {
+				if ev.Name == v.Value {
+					return ev.Value
+				}
+			}
+		}
+		return v.Value
+	case *ast.ListValue:
+		var itemType graphql.Type
+		if list, ok := typ.(*graphql.List); ok {
+			itemType = list.OfType
+		}
+		items := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			items[i] = b.valueFromAST(item, itemType)
+		}
+		return items
+	case *ast.ObjectValue:
+		var fieldDefs graphql.InputObjectFieldMap
+		if input, ok := typ.(*graphql.InputObject); ok {
+			fieldDefs = input.Fields()
+		}
+		fields := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			var fieldType graphql.Type
+			if def, ok := fieldDefs[field.Name.Value]; ok {
+				fieldType = def.Type
+			}
+			fields[field.Name.Value] = b.valueFromAST(field.Value, fieldType)
+		}
+		return fields
+	case *ast.IntValue:
+		n, _ := strconv.Atoi(v.Value)
+		if typ == graphql.Float {
+			return float64(n)
+		}
+		return n
+	case *ast.FloatValue:
+		f, _ := strconv.ParseFloat(v.Value, 64)
+		return f
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	}
+	return nil
+}
+
+func namedTypeAST(typ ast.Type) string {
+	for {
+		switch t := typ.(type) {
+		case *ast.NonNull:
+			typ = t.Type
+		case *ast.List:
+			typ = t.Type
+		case *ast.Named:
+			return t.Name.Value
+		default:
+			return ""
+		}
+	}
+}
+
+// schemaSDLHandler serves the schema as SDL for schema-first tooling
+func schemaSDLHandler(schema graphql.Schema) http.HandlerFunc {
+	sdl := printSchemaSDL(schema)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, sdl)
+	}
+}
+
+// subscribeBookEvents bridges store events into the channel graphql.Subscribe
+// consumes. The subscription ends when the request context is cancelled.
+func subscribeBookEvents(store *Store, event BookEventType) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		events, unsubscribe := store.Subscribe(event)
+		out := make(chan interface{})
+
+		go func() {
+			defer close(out)
+			defer unsubscribe()
+
+			for {
+				select {
+				case <-p.Context.Done():
+					return
+				case book, ok := <-events:
+					if !ok {
+						return
+					}
+					select {
+					case out <- book:
+					case <-p.Context.Done():
+						return
+					}
+				}
+			}
+		}()
+
+		return out, nil
+	}
+}
+
+// resolveBookEvent returns the event payload as the subscription field value
+func resolveBookEvent(p graphql.ResolveParams) (interface{}, error) {
+	if book, ok := p.Source.(*Book); ok {
+		return book, nil
+	}
+	return nil, errors.New("invalid event payload")
+}
+
+// Query Complexity
+
+// ComplexityLimits bounds how expensive a single operation may be
+type ComplexityLimits struct {
+	MaxCost         int
+	MaxDepth        int
+	DefaultPageSize int
+}
+
+func DefaultComplexityLimits() ComplexityLimits {
+	return ComplexityLimits{
+		MaxCost:         1000,
+		MaxDepth:        10,
+		DefaultPageSize: 10,
+	}
+}
+
+// ComplexityError is returned when an operation exceeds the configured limits
+type ComplexityError struct {
+	Cost     int
+	MaxCost  int
+	Depth    int
+	MaxDepth int
+}
+
+func (e *ComplexityError) Error() string {
+	if e.MaxDepth > 0 && e.Depth > e.MaxDepth {
+		return fmt.Sprintf("query depth %d exceeds maximum depth %d", e.Depth, e.MaxDepth)
+	}
+	return fmt.Sprintf("query cost %d exceeds maximum cost %d", e.Cost, e.MaxCost)
+}
+
+func (e *ComplexityError) Extensions() map[string]interface{} {
+	return map[string]interface{}{
+		"code":     "QUERY_TOO_COMPLEX",
+		"cost":     e.Cost,
+		"maxCost":  e.MaxCost,
+		"depth":    e.Depth,
+		"maxDepth": e.MaxDepth,
+	}
+}
+
+var paginationArgs = []string{"first", "last", "limit", "pagination"}
+
+type complexityAnalyzer struct {
+	schema    graphql.Schema
+	limits    ComplexityLimits
+	variables map[string]interface{}
+	fragments map[string]*ast.FragmentDefinition
+}
+
+// AnalyzeComplexity computes the cost and depth of an operation without
+// executing it. Every field costs 1; the cost of a field's selection is
+// multiplied by its page size (first/last/limit, or DefaultPageSize when
+// omitted), and list fields outside a paginated connection count as a
+// DefaultPageSize-sized page.
+func AnalyzeComplexity(schema graphql.Schema, query, operationName string, variables map[string]interface{}, limits ComplexityLimits) (cost, depth int, err error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	a := &complexityAnalyzer{
+		schema:    schema,
+		limits:    limits,
+		variables: variables,
+		fragments: make(map[string]*ast.FragmentDefinition),
+	}
+
+	var operations []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			operations = append(operations, def)
+		case *ast.FragmentDefinition:
+			a.fragments[def.Name.Value] = def
+		}
+	}
+
+	for _, op := range operations {
+		if operationName != "" && (op.Name == nil || op.Name.Value != operationName) {
+			continue
+		}
+
+		var root *graphql.Object
+		switch op.Operation {
+		case ast.OperationTypeMutation:
+			root = schema.MutationType()
+		case ast.OperationTypeSubscription:
+			root = schema.SubscriptionType()
+		default:
+			root = schema.QueryType()
+		}
+
+		opCost, opDepth := a.selectionSetCost(op.SelectionSet, root, false, 1, map[string]bool{})
+		if opCost > cost {
+			cost = opCost
+		}
+		if opDepth > depth {
+			depth = opDepth
+		}
+	}
+
+	return cost, depth, nil
+}
+
+// CheckComplexity rejects operations whose cost or depth exceeds the limits
+func CheckComplexity(schema graphql.Schema, query, operationName string, variables map[string]interface{}, limits ComplexityLimits) error {
+	cost, depth, err := AnalyzeComplexity(schema, query, operationName, variables, limits)
+	if err != nil {
+		// Let the executor report syntax errors in the usual format
+		return nil
+	}
+
+	if (limits.MaxCost > 0 && (cost < 0 || cost > limits.MaxCost)) || (limits.MaxDepth > 0 && depth > limits.MaxDepth) {
+		return &ComplexityError{Cost: cost, MaxCost: limits.MaxCost, Depth: depth, MaxDepth: limits.MaxDepth}
+	}
+	return nil
+}
+
+func (a *complexityAnalyzer) selectionSetCost(set *ast.SelectionSet, parent *graphql.Object, inPage bool, level int, visiting map[string]bool) (int, int) {
+	if set == nil {
+		return 0, level - 1
+	}
+
+	cost, depth := 0, level
+	for _, selection := range set.Selections {
+		var c, d int
+
+		switch sel := selection.(type) {
+		case *ast.Field:
+			c, d = a.fieldCost(sel, parent, inPage, level, visiting)
+		case *ast.InlineFragment:
+			target := parent
+			if sel.TypeCondition != nil {
+				if obj, ok := a.schema.Type(sel.TypeCondition.Name.Value).(*graphql.Object); ok {
+					target = obj
+				}
+			}
+			c, d = a.selectionSetCost(sel.SelectionSet, target, inPage, level, visiting)
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			fragment, ok := a.fragments[name]
+			if !ok || visiting[name] {
+				continue
+			}
+			target := parent
+			if fragment.TypeCondition != nil {
+				if obj, ok := a.schema.Type(fragment.TypeCondition.Name.Value).(*graphql.Object); ok {
+					target = obj
+				}
+			}
+			visiting[name] = true
+			c, d = a.selectionSetCost(fragment.SelectionSet, target, inPage, level, visiting)
+			delete(visiting, name)
+		}
+
+		cost = saturatingAdd(cost, c)
+		if d > depth {
+			depth = d
+		}
+	}
+
+	return cost, depth
+}
+
+func (a *complexityAnalyzer) fieldCost(field *ast.Field, parent *graphql.Object, inPage bool, level int, visiting map[string]bool) (int, int) {
+	if field.SelectionSet == nil {
+		return 1, level
+	}
+
+	var def *graphql.FieldDefinition
+	if parent != nil {
+		def = parent.Fields()[field.Name.Value]
+	}
+
+	multiplier := 1
+	childInPage := false
+	var child *graphql.Object
+
+	if def != nil {
+		child, _ = unwrapType(def.Type).(*graphql.Object)
+
+		switch {
+		case acceptsPagination(def):
+			multiplier = a.pageSize(field)
+			// Lists directly inside a paginated connection (edges) are the page itself
+			childInPage = !isListType(def.Type)
+		case isListType(def.Type) && !inPage:
+			multiplier = a.limits.DefaultPageSize
+		}
+	}
+
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	childCost, depth := a.selectionSetCost(field.SelectionSet, child, childInPage, level+1, visiting)
+	return saturatingAdd(1, saturatingMul(multiplier, childCost)), depth
+}
+
+// saturatingAdd and saturatingMul clamp at math.MaxInt instead of wrapping,
+// so huge page sizes can't overflow into a cost that passes MaxCost. Costs
+// are never negative.
+func saturatingAdd(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if a != 0 && b > math.MaxInt/a {
+		return math.MaxInt
+	}
+	return a * b
+}
+
+// pageSize reads the requested page size from literal or variable arguments
+func (a *complexityAnalyzer) pageSize(field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		switch arg.Name.Value {
+		case "first", "last", "limit":
+			if n, ok := a.intValue(arg.Value); ok {
+				return n
+			}
+		case "pagination":
+			for _, key := range []string{"first", "last"} {
+				if n, ok := a.objectIntField(arg.Value, key); ok {
+					return n
+				}
+			}
+		}
+	}
+	return a.limits.DefaultPageSize
+}
+
+func (a *complexityAnalyzer) intValue(value ast.Value) (int, bool) {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(v.Value)
+		return n, err == nil
+	case *ast.Variable:
+		return toInt(a.variables[v.Name.Value])
+	}
+	return 0, false
+}
+
+func (a *complexityAnalyzer) objectIntField(value ast.Value, key string) (int, bool) {
+	switch v := value.(type) {
+	case *ast.ObjectValue:
+		for _, f := range v.Fields {
+			if f.Name.Value == key {
+				return a.intValue(f.Value)
+			}
+		}
+	case *ast.Variable:
+		if m, ok := a.variables[v.Name.Value].(map[string]interface{}); ok {
+			return toInt(m[key])
+		}
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	}
+	return 0, false
+}
+
+func acceptsPagination(def *graphql.FieldDefinition) bool {
+	for _, arg := range def.Args {
+		for _, name := range paginationArgs {
+			if arg.Name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unwrapType(t graphql.Type) graphql.Type {
+	for {
+		switch wrapped := t.(type) {
+		case *graphql.NonNull:
+			t = wrapped.OfType
+		case *graphql.List:
+			t = wrapped.OfType
+		default:
+			return t
+		}
+	}
+}
+
+func isListType(t graphql.Type) bool {
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType
+	}
+	_, ok := t.(*graphql.List)
+	return ok
+}
+
+// errorResult wraps an error in a GraphQL response, keeping any extensions
+func errorResult(err error) *graphql.Result {
+	formatted := gqlerrors.FormatError(err)
+	if ext, ok := err.(interface{ Extensions() map[string]interface{} }); ok {
+		formatted.Extensions = ext.Extensions()
+	}
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{formatted}}
+}
+
+// Persisted Queries
+
+// PersistedQueryStore maps sha256 hashes to query documents for
+// automatic persisted queries (APQ)
+type PersistedQueryStore interface {
+	Get(hash string) (string, bool)
+	Put(hash, query string) error
+}
+
+// InMemoryPersistedQueryStore keeps persisted queries in a map
+type InMemoryPersistedQueryStore struct {
+	mu      sync.RWMutex
+	queries map[string]string
+}
+
+func NewInMemoryPersistedQueryStore() *InMemoryPersistedQueryStore {
+	return &InMemoryPersistedQueryStore{
+		queries: make(map[string]string),
+	}
+}
+
+func (s *InMemoryPersistedQueryStore) Get(hash string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	query, ok := s.queries[hash]
+	return query, ok
+}
+
+func (s *InMemoryPersistedQueryStore) Put(hash, query string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[hash] = query
+	return nil
+}
+
+// hashQuery returns the hex sha256 hash APQ clients send for a query
+func hashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// PersistedQueryError carries the APQ error codes clients react to
+type PersistedQueryError struct {
+	Code    string
+	Message string
+}
+
+func (e *PersistedQueryError) Error() string {
+	return e.Message
+}
+
+func (e *PersistedQueryError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.Code}
+}
+
+var (
+	ErrPersistedQueryNotFound     = &PersistedQueryError{Code: "PERSISTED_QUERY_NOT_FOUND", Message: "PersistedQueryNotFound"}
+	ErrPersistedQueryNotSupported = &PersistedQueryError{Code: "PERSISTED_QUERY_NOT_SUPPORTED", Message: "PersistedQueryNotSupported"}
+	ErrPersistedQueryHashMismatch = &PersistedQueryError{Code: "PERSISTED_QUERY_HASH_MISMATCH", Message: "provided sha256Hash does not match query"}
+)
+
+type persistedQueryExtension struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+type requestExtensions struct {
+	PersistedQuery *persistedQueryExtension `json:"persistedQuery,omitempty"`
+}
+
+// graphqlRequest is a single operation as sent over HTTP
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    *requestExtensions     `json:"extensions,omitempty"`
+}
+
+// resolvePersistedQuery fills in the query text for hash-only requests and
+// registers new queries that arrive together with their hash
+func resolvePersistedQuery(req *graphqlRequest, store PersistedQueryStore) error {
+	if req.Extensions == nil || req.Extensions.PersistedQuery == nil {
+		return nil
+	}
+	if store == nil {
+		return ErrPersistedQueryNotSupported
+	}
+
+	pq := req.Extensions.PersistedQuery
+	if pq.Version != 1 {
+		return &PersistedQueryError{Code: "PERSISTED_QUERY_NOT_SUPPORTED", Message: fmt.Sprintf("unsupported persisted query version %d", pq.Version)}
+	}
+
+	hash := strings.ToLower(pq.Sha256Hash)
+	if req.Query == "" {
+		query, ok := store.Get(hash)
+		if !ok {
+			return ErrPersistedQueryNotFound
+		}
+		req.Query = query
+		return nil
+	}
+
+	if hashQuery(req.Query) != hash {
+		return ErrPersistedQueryHashMismatch
+	}
+	return store.Put(hash, req.Query)
+}
+
+// Export
+type ExportFormat string
+
+const (
+	ExportCSV    ExportFormat = "CSV"
+	ExportNDJSON ExportFormat = "NDJSON"
+)
+
+// BookExport is a signed, expiring link to a bulk download of books
+type BookExport struct {
+	URL       string       `json:"url"`
+	Format    ExportFormat `json:"format"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+// BookExporter hands out signed export URLs and serves them. The filter
+// and format travel in the URL and are covered by an HMAC, so the download
+// handler needs no server-side state.
+type BookExporter struct {
+	store  *Store
+	secret []byte
+	path   string
+	ttl    time.Duration
+}
+
+// NewBookExporter creates an exporter whose handler is mounted at path
+func NewBookExporter(store *Store, secret []byte, path string) *BookExporter {
+	return &BookExporter{
+		store:  store,
+		secret: secret,
+		path:   path,
+		ttl:    15 * time.Minute,
+	}
+}
+
+func (e *BookExporter) sign(format, filter, expires string) string {
+	mac := hmac.New(sha256.New, e.secret)
+	mac.Write([]byte(format + "\n" + filter + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Export returns a signed URL for downloading the books matching filter
+func (e *BookExporter) Export(filter *BookFilter, format ExportFormat) (*BookExport, error) {
+	switch format {
+	case ExportCSV, ExportNDJSON:
+	default:
+		return nil, invalidInput("format", fmt.Sprintf("unsupported export format %q", format), "use CSV or NDJSON")
+	}
+
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	encodedFilter := base64.RawURLEncoding.EncodeToString(data)
+
+	expiresAt := time.Now().Add(e.ttl).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("format", string(format))
+	query.Set("filter", encodedFilter)
+	query.Set("expires", expires)
+	query.Set("signature", e.sign(string(format), encodedFilter, expires))
+
+	return &BookExport{
+		URL:       e.path + "?" + query.Encode(),
+		Format:    format,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (e *BookExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	encodedFilter := query.Get("filter")
+	expires := query.Get("expires")
+
+	expected := e.sign(format, encodedFilter, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		http.Error(w, "invalid export signature", http.StatusForbidden)
+		return
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		http.Error(w, "export link expired", http.StatusGone)
+		return
+	}
+
+	var filter *BookFilter
+	data, err := base64.RawURLEncoding.DecodeString(encodedFilter)
+	if err == nil {
+		err = json.Unmarshal(data, &filter)
+	}
+	if err != nil {
+		http.Error(w, "invalid export filter", http.StatusBadRequest)
+		return
+	}
+
+	books, err := e.store.FindBooks(filter, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch ExportFormat(format) {
+	case ExportCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+		if err := writeBooksCSV(w, books); err != nil {
+			log.Printf("export books: %v", err)
+		}
+	case ExportNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.ndjson"`)
+		if err := writeBooksNDJSON(w, books); err != nil {
+			log.Printf("export books: %v", err)
+		}
+	default:
+		http.Error(w, "unsupported export format", http.StatusBadRequest)
+	}
+}
+
+// exportFlushEvery controls how many rows are buffered before flushing to
+// the client
+const exportFlushEvery = 100
+
+func flushResponse(w io.Writer) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func writeBooksCSV(w io.Writer, books []*Book) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "title", "isbn", "publishedYear", "authorId", "genre", "rating", "createdAt"}); err != nil {
+		return err
+	}
+
+	for i, book := range books {
+		rating := ""
+		if book.Rating != nil {
+			rating = strconv.FormatFloat(*book.Rating, 'f', -1, 64)
+		}
+		record := []string{
+			book.ID,
+			book.Title,
+			book.ISBN,
+			strconv.Itoa(book.PublishedYear),
+			book.AuthorID,
+			string(book.Genre),
+			rating,
+			book.CreatedAt.Format(time.RFC3339),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			cw.Flush()
+			flushResponse(w)
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
 
-	// Object types (declared first for forward references)
-	var bookType *graphql.Object
-	var authorType *graphql.Object
+func writeBooksNDJSON(w io.Writer, books []*Book) error {
+	enc := json.NewEncoder(w)
+	for i, book := range books {
+		if err := enc.Encode(book); err != nil {
+			return err
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			flushResponse(w)
+		}
+	}
+	return nil
+}
 
-	// Author type
-	authorType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "Author",
-		Fields: graphql.Fields{
-			"id": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.ID),
-			},
-			"name": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.String),
-			},
-			"bio": &graphql.Field{
-				Type: graphql.String,
-			},
-			"books": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
-					Name: "BookRef",
-					Fields: graphql.Fields{
-						"id":            &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
-						"title":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-						"isbn":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-						"publishedYear": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
-						"genre":         &graphql.Field{Type: graphql.NewNonNull(genreEnum)},
-						"rating":        &graphql.Field{Type: graphql.Float},
-						"createdAt":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-					},
-				})))),
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					if author, ok := p.Source.(*Author); ok {
-						return store.GetBooksByAuthor(author.ID)
-					}
-					return nil, errors.New("invalid source type")
-				},
-			},
-		},
+// HandlerConfig configures the /graphql HTTP handler
+type HandlerConfig struct {
+	Complexity ComplexityLimits
+	// PersistedQueries enables APQ when set
+	PersistedQueries PersistedQueryStore
+	// CacheMaxAge is the max-age sent with successful GET queries; zero
+	// still sends an ETag but asks caches to revalidate every time
+	CacheMaxAge time.Duration
+	// MaxBatchSize caps the operations in one batched POST; zero disables batching
+	MaxBatchSize int
+	// BatchConcurrency is how many operations of a batch run at once
+	BatchConcurrency int
+}
+
+func DefaultHandlerConfig() HandlerConfig {
+	return HandlerConfig{
+		Complexity:       DefaultComplexityLimits(),
+		PersistedQueries: NewInMemoryPersistedQueryStore(),
+		CacheMaxAge:      time.Minute,
+		MaxBatchSize:     20,
+		BatchConcurrency: 4,
+	}
+}
+
+// executeRequest runs one operation through persisted query lookup,
+// complexity checks and execution
+func executeRequest(ctx context.Context, schema graphql.Schema, config HandlerConfig, req *graphqlRequest) *graphql.Result {
+	if err := resolvePersistedQuery(req, config.PersistedQueries); err != nil {
+		return errorResult(err)
+	}
+
+	if err := CheckComplexity(schema, req.Query, req.OperationName, req.Variables, config.Complexity); err != nil {
+		return errorResult(err)
+	}
+
+	return graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
 	})
+}
 
-	// Book type
-	bookType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "Book",
-		Fields: graphql.Fields{
-			"id": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.ID),
-			},
-			"title": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.String),
-			},
-			"isbn": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.String),
-			},
-			"publishedYear": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.Int),
-			},
-			"genre": &graphql.Field{
-				Type: graphql.NewNonNull(genreEnum),
-			},
-			"rating": &graphql.Field{
-				Type: graphql.Float,
-			},
-			"createdAt": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.String),
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					if book, ok := p.Source.(*Book); ok {
-						return book.CreatedAt.Format(time.RFC3339), nil
-					}
-					return nil, nil
-				},
-			},
-			"author": &graphql.Field{
-				Type: graphql.NewNonNull(authorType),
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					if book, ok := p.Source.(*Book); ok {
-						return store.GetAuthor(book.AuthorID)
+// executeBatch runs operations on a bounded worker pool and returns their
+// results in request order. Operations share the request context, so the
+// DataLoader batches lookups across the whole batch.
+func executeBatch(ctx context.Context, schema graphql.Schema, config HandlerConfig, reqs []*graphqlRequest) []*graphql.Result {
+	results := make([]*graphql.Result, len(reqs))
+
+	workers := config.BatchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(reqs) {
+		workers = len(reqs)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = executeRequest(ctx, schema, config, reqs[i])
+			}
+		}()
+	}
+
+	for i := range reqs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// parseGETRequest reads an operation from query parameters, where
+// variables and extensions are JSON-encoded strings
+func parseGETRequest(r *http.Request) (*graphqlRequest, error) {
+	query := r.URL.Query()
+	req := &graphqlRequest{
+		Query:         query.Get("query"),
+		OperationName: query.Get("operationName"),
+	}
+
+	if variables := query.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+			return nil, fmt.Errorf("invalid variables: %v", err)
+		}
+	}
+	if extensions := query.Get("extensions"); extensions != "" {
+		if err := json.Unmarshal([]byte(extensions), &req.Extensions); err != nil {
+			return nil, fmt.Errorf("invalid extensions: %v", err)
+		}
+	}
+	return req, nil
+}
+
+// operationType reports whether the selected operation is a query, mutation
+// or subscription. Unparseable documents are left for execution to report.
+func operationType(query, operationName string) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return ""
+	}
+
+	var operations []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			operations = append(operations, op)
+		}
+	}
+
+	for _, op := range operations {
+		if operationName == "" && len(operations) == 1 {
+			return op.Operation
+		}
+		if op.Name != nil && op.Name.Value == operationName {
+			return op.Operation
+		}
+	}
+	return ""
+}
+
+// etagMatches reports whether an If-None-Match header covers etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCacheableResult sends a GET query result with caching headers.
+// Results with errors are never cached; responses for signed-in users may
+// only be cached by the browser.
+func writeCacheableResult(w http.ResponseWriter, r *http.Request, config HandlerConfig, result *graphql.Result) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Authorization")
+
+	if result.HasErrors() {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+		return
+	}
+
+	scope := "public"
+	if _, ok := UserFromContext(r.Context()); ok || r.Header.Get("Authorization") != "" {
+		scope = "private"
+	}
+	if config.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(config.CacheMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", scope+", no-cache")
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// HTTP Handler
+func graphqlHandler(schema graphql.Schema, config HandlerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			params, err := parseGETRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// Resolve persisted queries first so hash-only GETs can be
+			// checked for mutations too
+			if err := resolvePersistedQuery(params, config.PersistedQueries); err != nil {
+				writeCacheableResult(w, r, config, errorResult(err))
+				return
+			}
+			params.Extensions = nil
+
+			switch operationType(params.Query, params.OperationName) {
+			case ast.OperationTypeMutation:
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "mutations must use POST", http.StatusMethodNotAllowed)
+				return
+			case ast.OperationTypeSubscription:
+				http.Error(w, "subscriptions must use the WebSocket endpoint", http.StatusBadRequest)
+				return
+			}
+
+			writeCacheableResult(w, r, config, executeRequest(r.Context(), schema, config, params))
+		case http.MethodPost:
+			var body json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// A JSON array is a batch of operations, answered with an array
+			if len(body) > 0 && body[0] == '[' {
+				var batch []*graphqlRequest
+				if err := json.Unmarshal(body, &batch); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				switch {
+				case config.MaxBatchSize <= 0:
+					http.Error(w, "batched operations are not enabled", http.StatusBadRequest)
+					return
+				case len(batch) == 0:
+					http.Error(w, "batch must contain at least one operation", http.StatusBadRequest)
+					return
+				case len(batch) > config.MaxBatchSize:
+					http.Error(w, fmt.Sprintf("batch of %d operations exceeds the limit of %d", len(batch), config.MaxBatchSize), http.StatusBadRequest)
+					return
+				}
+				for _, req := range batch {
+					if req == nil {
+						http.Error(w, "batch contains a null operation", http.StatusBadRequest)
+						return
 					}
-					return nil, errors.New("invalid source type")
-				},
-			},
-		},
-	})
+				}
 
-	// PageInfo type
-	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
-		Name: "PageInfo",
-		Fields: graphql.Fields{
-			"hasNextPage": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.Boolean),
-			},
-			"hasPreviousPage": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.Boolean),
-			},
-			"startCursor": &graphql.Field{
-				Type: graphql.String,
-			},
-			"endCursor": &graphql.Field{
-				Type: graphql.String,
-			},
-		},
-	})
+				results := executeBatch(r.Context(), schema, config, batch)
 
-	// BookEdge type
-	bookEdgeType := graphql.NewObject(graphql.ObjectConfig{
-		Name: "BookEdge",
-		Fields: graphql.Fields{
-			"node": &graphql.Field{
-				Type: graphql.NewNonNull(bookType),
-			},
-			"cursor": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.String),
-			},
-		},
-	})
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(results)
+				return
+			}
 
-	// BookConnection type
-	bookConnectionType := graphql.NewObject(graphql.ObjectConfig{
-		Name: "BookConnection",
-		Fields: graphql.Fields{
-			"edges": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookEdgeType))),
-			},
-			"pageInfo": &graphql.Field{
-				Type: graphql.NewNonNull(pageInfoType),
-			},
-		},
-	})
+			var params graphqlRequest
+			if err := json.Unmarshal(body, &params); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-	// Input types
-	bookFilterInput := graphql.NewInputObject(graphql.InputObjectConfig{
-		Name: "BookFilter",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"genre":     &graphql.InputObjectFieldConfig{Type: genreEnum},
-			"minRating": &graphql.InputObjectFieldConfig{Type: graphql.Float},
-			"title":     &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"authorId":  &graphql.InputObjectFieldConfig{Type: graphql.String},
-		},
-	})
+			result := executeRequest(r.Context(), schema, config, &params)
 
-	paginationInput := graphql.NewInputObject(graphql.InputObjectConfig{
-		Name: "PaginationInput",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"first":  &graphql.InputObjectFieldConfig{Type: graphql.Int},
-			"after":  &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"last":   &graphql.InputObjectFieldConfig{Type: graphql.Int},
-			"before": &graphql.InputObjectFieldConfig{Type: graphql.String},
-		},
-	})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
 
-	createBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
-		Name: "CreateBookInput",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"title":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"isbn":          &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"publishedYear": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
-			"authorId":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"genre":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(genreEnum)},
-			"rating":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
-		},
-	})
+// WebSocket transport (RFC 6455), just enough for graphql-ws
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxMessageSize = 1 << 20
+)
+
+type wsConn struct {
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex
+}
+
+// upgradeWebSocket performs the server side of the WebSocket handshake
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, protocol string) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		return nil, errors.New("websocket upgrade requires GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	if !headerContainsToken(r.Header, "Sec-WebSocket-Protocol", protocol) {
+		return nil, fmt.Errorf("client must request the %s subprotocol", protocol)
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	updateBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
-		Name: "UpdateBookInput",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"title":         &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"isbn":          &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"publishedYear": &graphql.InputObjectFieldConfig{Type: graphql.Int},
-			"rating":        &graphql.InputObjectFieldConfig{Type: graphql.Float},
-		},
-	})
+// ReadMessage returns the next complete data message, answering pings and
+// reassembling fragmented frames along the way
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
 
-	createAuthorInput := graphql.NewInputObject(graphql.InputObjectConfig{
-		Name: "CreateAuthorInput",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"name": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
-			"bio":  &graphql.InputObjectFieldConfig{Type: graphql.String},
-		},
-	})
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.rw, header); err != nil {
+			return nil, err
+		}
 
-	// Query type
-	queryType := graphql.NewObject(graphql.ObjectConfig{
-		Name: "Query",
-		Fields: graphql.Fields{
-			"books": &graphql.Field{
-				Type: graphql.NewNonNull(bookConnectionType),
-				Args: graphql.FieldConfigArgument{
-					"filter":     &graphql.ArgumentConfig{Type: bookFilterInput},
-					"pagination": &graphql.ArgumentConfig{Type: paginationInput},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					var filter *BookFilter
-					if f, ok := p.Args["filter"].(map[string]interface{}); ok {
-						filter = &BookFilter{}
-						if genre, ok := f["genre"].(Genre); ok {
-							filter.Genre = &genre
-						}
-						if minRating, ok := f["minRating"].(float64); ok {
-							filter.MinRating = &minRating
-						}
-						if title, ok := f["title"].(string); ok {
-							filter.Title = &title
-						}
-						if authorID, ok := f["authorId"].(string); ok {
-							filter.AuthorID = &authorID
-						}
-					}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
 
-					var pagination *PaginationInput
-					if pg, ok := p.Args["pagination"].(map[string]interface{}); ok {
-						pagination = &PaginationInput{}
-						if first, ok := pg["first"].(int); ok {
-							pagination.First = &first
-						}
-						if after, ok := pg["after"].(string); ok {
-							pagination.After = &after
-						}
-					}
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.rw, ext); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.rw, ext); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
 
-					return store.GetBooks(filter, pagination)
-				},
-			},
-			"book": &graphql.Field{
-				Type: bookType,
-				Args: graphql.FieldConfigArgument{
-					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					id, _ := p.Args["id"].(string)
-					return store.GetBook(id)
-				},
-			},
-			"authors": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(authorType))),
-				Args: graphql.FieldConfigArgument{
-					"limit": &graphql.ArgumentConfig{Type: graphql.Int},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					var limit *int
-					if l, ok := p.Args["limit"].(int); ok {
-						limit = &l
-					}
-					return store.GetAuthors(limit)
-				},
-			},
-			"author": &graphql.Field{
-				Type: authorType,
-				Args: graphql.FieldConfigArgument{
-					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					id, _ := p.Args["id"].(string)
-					return store.GetAuthor(id)
-				},
-			},
-		},
-	})
+		if !masked {
+			return nil, errors.New("client frames must be masked")
+		}
+		if length > wsMaxMessageSize || uint64(len(message))+length > wsMaxMessageSize {
+			return nil, errors.New("websocket message too large")
+		}
 
-	// Mutation type
-	mutationType := graphql.NewObject(graphql.ObjectConfig{
-		Name: "Mutation",
-		Fields: graphql.Fields{
-			"createBook": &graphql.Field{
-				Type: graphql.NewNonNull(bookType),
-				Args: graphql.FieldConfigArgument{
-					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createBookInput)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					input := p.Args["input"].(map[string]interface{})
-					title := input["title"].(string)
-					isbn := input["isbn"].(string)
-					publishedYear := input["publishedYear"].(int)
-					authorID := input["authorId"].(string)
-					genre := input["genre"].(Genre)
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(c.rw, mask); err != nil {
+			return nil, err
+		}
 
-					var rating *float64
-					if r, ok := input["rating"].(float64); ok {
-						rating = &r
-					}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
 
-					return store.CreateBook(title, isbn, publishedYear, authorID, genre, rating)
-				},
-			},
-			"updateBook": &graphql.Field{
-				Type: graphql.NewNonNull(bookType),
-				Args: graphql.FieldConfigArgument{
-					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
-					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateBookInput)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					id := p.Args["id"].(string)
-					input := p.Args["input"].(map[string]interface{})
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+	}
+}
 
-					title := ""
-					if t, ok := input["title"].(string); ok {
-						title = t
-					}
+// writeFrame writes a single unmasked, unfragmented server frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-					isbn := ""
-					if i, ok := input["isbn"].(string); ok {
-						isbn = i
-					}
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
 
-					var publishedYear *int
-					if py, ok := input["publishedYear"].(int); ok {
-						publishedYear = &py
-					}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
 
-					var rating *float64
-					if r, ok := input["rating"].(float64); ok {
-						rating = &r
-					}
+// WriteJSON sends v as a text message
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
 
-					return store.UpdateBook(id, title, isbn, publishedYear, rating)
-				},
-			},
-			"deleteBook": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.Boolean),
-				Args: graphql.FieldConfigArgument{
-					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					id := p.Args["id"].(string)
-					return store.DeleteBook(id)
-				},
-			},
-			"createAuthor": &graphql.Field{
-				Type: graphql.NewNonNull(authorType),
-				Args: graphql.FieldConfigArgument{
-					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createAuthorInput)},
-				},
-				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-					input := p.Args["input"].(map[string]interface{})
-					name := input["name"].(string)
+// CloseWithCode sends a close frame with a status code and closes the connection
+func (c *wsConn) CloseWithCode(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+	c.writeFrame(wsOpClose, payload)
+	return c.conn.Close()
+}
 
-					var bio *string
-					if b, ok := input["bio"].(string); ok {
-						bio = &b
-					}
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
 
-					return store.CreateAuthor(name, bio)
-				},
-			},
-		},
-	})
+// graphql-ws protocol (graphql-transport-ws subprotocol)
+const (
+	graphqlWSProtocol = "graphql-transport-ws"
 
-	// Create schema
-	return graphql.NewSchema(graphql.SchemaConfig{
-		Query:    queryType,
-		Mutation: mutationType,
-	})
+	gqlConnectionInit = "connection_init"
+	gqlConnectionAck  = "connection_ack"
+	gqlPing           = "ping"
+	gqlPong           = "pong"
+	gqlSubscribe      = "subscribe"
+	gqlNext           = "next"
+	gqlError          = "error"
+	gqlComplete       = "complete"
+
+	wsCloseBadRequest      = 4400
+	wsCloseUnauthorized    = 4401
+	wsCloseInitTimeout     = 4408
+	wsCloseDuplicateID     = 4409
+	wsCloseTooManyInitReqs = 4429
+)
+
+type graphqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
-// HTTP Handler
-func graphqlHandler(schema graphql.Schema) http.HandlerFunc {
+type graphqlWSSubscribePayload struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlWSHandler serves subscriptions over WebSocket using graphql-ws,
+// rejecting operations that exceed limits like the HTTP handler does
+func graphqlWSHandler(schema graphql.Schema, limits ComplexityLimits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		conn, err := upgradeWebSocket(w, r, graphqlWSProtocol)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		defer conn.Close()
 
-		var params struct {
-			Query         string                 `json:"query"`
-			OperationName string                 `json:"operationName"`
-			Variables     map[string]interface{} `json:"variables"`
+		session := &graphqlWSSession{
+			conn:          conn,
+			schema:        schema,
+			limits:        limits,
+			subscriptions: make(map[string]*graphqlWSSubscription),
 		}
+		session.serve(r.Context())
+	}
+}
 
-		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+type graphqlWSSession struct {
+	conn          *wsConn
+	schema        graphql.Schema
+	limits        ComplexityLimits
+	acknowledged  bool
+	mu            sync.Mutex
+	subscriptions map[string]*graphqlWSSubscription
+	wg            sync.WaitGroup
+}
+
+// graphqlWSSubscription is one running subscription. Its pointer identifies
+// it, so a finished subscription can't remove a newer one that reused its id.
+type graphqlWSSubscription struct {
+	cancel context.CancelFunc
+}
+
+func (s *graphqlWSSession) serve(parent context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+
+	initTimer := time.AfterFunc(10*time.Second, func() {
+		s.mu.Lock()
+		acked := s.acknowledged
+		s.mu.Unlock()
+		if !acked {
+			s.conn.CloseWithCode(wsCloseInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+
+	for {
+		data, err := s.conn.ReadMessage()
+		if err != nil {
 			return
 		}
 
-		result := graphql.Do(graphql.Params{
-			Schema:         schema,
-			RequestString:  params.Query,
-			VariableValues: params.Variables,
-			OperationName:  params.OperationName,
-			Context:        r.Context(),
-		})
+		var msg graphqlWSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.conn.CloseWithCode(wsCloseBadRequest, "Invalid message received")
+			return
+		}
+
+		switch msg.Type {
+		case gqlConnectionInit:
+			s.mu.Lock()
+			already := s.acknowledged
+			s.acknowledged = true
+			s.mu.Unlock()
+			if already {
+				s.conn.CloseWithCode(wsCloseTooManyInitReqs, "Too many initialisation requests")
+				return
+			}
+			s.conn.WriteJSON(graphqlWSMessage{Type: gqlConnectionAck})
+
+		case gqlPing:
+			s.conn.WriteJSON(graphqlWSMessage{Type: gqlPong})
+
+		case gqlPong:
+
+		case gqlSubscribe:
+			s.mu.Lock()
+			acked := s.acknowledged
+			_, duplicate := s.subscriptions[msg.ID]
+			s.mu.Unlock()
+
+			if !acked {
+				s.conn.CloseWithCode(wsCloseUnauthorized, "Unauthorized")
+				return
+			}
+			if msg.ID == "" {
+				s.conn.CloseWithCode(wsCloseBadRequest, "Subscribe message requires an id")
+				return
+			}
+			if duplicate {
+				s.conn.CloseWithCode(wsCloseDuplicateID, fmt.Sprintf("Subscriber for %s already exists", msg.ID))
+				return
+			}
+
+			var payload graphqlWSSubscribePayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				s.conn.CloseWithCode(wsCloseBadRequest, "Invalid subscribe payload")
+				return
+			}
+			s.startSubscription(ctx, msg.ID, payload)
+
+		case gqlComplete:
+			s.stopSubscription(msg.ID)
+
+		default:
+			s.conn.CloseWithCode(wsCloseBadRequest, "Unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+func (s *graphqlWSSession) startSubscription(parent context.Context, id string, payload graphqlWSSubscribePayload) {
+	if err := CheckComplexity(s.schema, payload.Query, payload.OperationName, payload.Variables, s.limits); err != nil {
+		raw, _ := json.Marshal(errorResult(err).Errors)
+		s.conn.WriteJSON(graphqlWSMessage{ID: id, Type: gqlError, Payload: raw})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	sub := &graphqlWSSubscription{cancel: cancel}
+
+	s.mu.Lock()
+	s.subscriptions[id] = sub
+	s.mu.Unlock()
+
+	results := graphql.Subscribe(graphql.Params{
+		Schema:         s.schema,
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+		Context:        ctx,
+	})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.finishSubscription(id, sub)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result, ok := <-results:
+				if !ok {
+					s.conn.WriteJSON(graphqlWSMessage{ID: id, Type: gqlComplete})
+					return
+				}
+
+				msgType := gqlNext
+				var body interface{} = result
+				if result.Data == nil && len(result.Errors) > 0 {
+					msgType = gqlError
+					body = result.Errors
+				}
+
+				raw, err := json.Marshal(body)
+				if err != nil {
+					continue
+				}
+				s.conn.WriteJSON(graphqlWSMessage{ID: id, Type: msgType, Payload: raw})
+			}
+		}
+	}()
+}
+
+func (s *graphqlWSSession) stopSubscription(id string) {
+	s.mu.Lock()
+	sub, ok := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	s.mu.Unlock()
+
+	if ok {
+		sub.cancel()
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(result)
+// finishSubscription cleans up after a subscription's goroutine exits. The
+// entry is removed only if it is still this subscription: a client may have
+// completed the id and subscribed again with it in the meantime.
+func (s *graphqlWSSession) finishSubscription(id string, sub *graphqlWSSubscription) {
+	s.mu.Lock()
+	if s.subscriptions[id] == sub {
+		delete(s.subscriptions, id)
 	}
+	s.mu.Unlock()
+
+	sub.cancel()
 }
 
 func main() {
 	store := NewStore()
 
-	// Seed some data
-	author1, _ := store.CreateAuthor("Alan Donovan", strPtr("Co-author of The Go Programming Language"))
-	author2, _ := store.CreateAuthor("Brian Kernighan", strPtr("Co-author of The Go Programming Language and many other books"))
+	// BOOKS_DB switches from the in-memory store to a SQLite database file
+	if dsn := os.Getenv("BOOKS_DB"); dsn != "" {
+		repo, err := NewSQLiteRepository(dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer repo.Close()
+		store = NewStoreWithRepository(repo)
+	}
+
+	// Seed some data on first run
+	if authors, _ := store.GetAuthors(nil); len(authors) == 0 {
+		author1, _ := store.CreateAuthor("Alan Donovan", strPtr("Co-author of The Go Programming Language"))
+		author2, _ := store.CreateAuthor("Brian Kernighan", strPtr("Co-author of The Go Programming Language and many other books"))
+
+		rating1 := 4.8
+		store.CreateBook("The Go Programming Language", "978-0134190440", 2015, author1.ID, GenreNonfiction, &rating1)
+
+		rating2 := 4.5
+		store.CreateBook("The C Programming Language", "978-0131103627", 1988, author2.ID, GenreNonfiction, &rating2)
+	}
+
+	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		jwtSecret = []byte("dev-secret-change-me")
+	}
+
+	exportSecret := []byte(os.Getenv("EXPORT_SECRET"))
+	if len(exportSecret) == 0 {
+		exportSecret = jwtSecret
+	}
+	exporter := NewBookExporter(store, exportSecret, "/graphql/export")
 
-	rating1 := 4.8
-	store.CreateBook("The Go Programming Language", "978-0134190440", 2015, author1.ID, GenreNonfiction, &rating1)
+	schemaOpts := []SchemaOption{WithBookExporter(exporter)}
 
-	rating2 := 4.5
-	store.CreateBook("The C Programming Language", "978-0131103627", 1988, author2.ID, GenreNonfiction, &rating2)
+	// GRAPHQL_SCHEMA_FILE switches to a schema-first workflow
+	if path := os.Getenv("GRAPHQL_SCHEMA_FILE"); path != "" {
+		sdl, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		schemaOpts = append(schemaOpts, WithSDL(string(sdl)))
+	}
 
-	schema, err := buildSchema(store)
+	schema, err := buildSchema(store, schemaOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/graphql", graphqlHandler(schema))
+	http.Handle("/graphql", authMiddleware(jwtSecret, dataLoaderMiddleware(store, graphqlHandler(schema, DefaultHandlerConfig()))))
+	http.HandleFunc("/graphql/ws", graphqlWSHandler(schema, DefaultComplexityLimits()))
+	http.Handle("/graphql/export", exporter)
+	http.HandleFunc("/graphql/schema", schemaSDLHandler(schema))
 
 	fmt.Println("GraphQL server running on :8080")
 	fmt.Println("Send POST requests to http://localhost:8080/graphql")
+	fmt.Println("Subscribe over graphql-ws at ws://localhost:8080/graphql/ws")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
@@ -782,10 +4926,15 @@ func strPtr(s string) *string {
 
 // ExecuteQuery is a helper for testing
 func ExecuteQuery(schema graphql.Schema, query string, variables map[string]interface{}) *graphql.Result {
+	return ExecuteQueryWithContext(context.Background(), schema, query, variables)
+}
+
+// ExecuteQueryWithContext is a helper for testing with request-scoped values
+func ExecuteQueryWithContext(ctx context.Context, schema graphql.Schema, query string, variables map[string]interface{}) *graphql.Result {
 	return graphql.Do(graphql.Params{
 		Schema:         schema,
 		RequestString:  query,
 		VariableValues: variables,
-		Context:        context.Background(),
+		Context:        ctx,
 	})
 }
@@ -1,8 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/graphql-go/graphql"
 )
@@ -265,6 +283,254 @@ func TestPagination(t *testing.T) {
 	}
 }
 
+func TestBackwardPagination(t *testing.T) {
+	store := setupTestStore()
+
+	author, _ := store.GetAuthor("1")
+	for i := 4; i <= 10; i++ {
+		store.CreateBook(fmt.Sprintf("Book %d", i), fmt.Sprintf("ISBN-%03d", i), 2020, author.ID, GenreFiction, nil)
+	}
+
+	tests := []struct {
+		name         string
+		pagination   *PaginationInput
+		wantIDs      []string
+		wantNextPage bool
+		wantPrevPage bool
+	}{
+		{
+			name:         "last 3",
+			pagination:   &PaginationInput{Last: intPtr(3)},
+			wantIDs:      []string{"8", "9", "10"},
+			wantNextPage: false,
+			wantPrevPage: true,
+		},
+		{
+			name:         "last 2 before cursor",
+			pagination:   &PaginationInput{Last: intPtr(2), Before: strPtr(encodeCursor("5"))},
+			wantIDs:      []string{"3", "4"},
+			wantNextPage: true,
+			wantPrevPage: true,
+		},
+		{
+			name:         "last larger than window",
+			pagination:   &PaginationInput{Last: intPtr(10), Before: strPtr(encodeCursor("3"))},
+			wantIDs:      []string{"1", "2"},
+			wantNextPage: true,
+			wantPrevPage: false,
+		},
+		{
+			name:         "after and before window",
+			pagination:   &PaginationInput{After: strPtr(encodeCursor("2")), Before: strPtr(encodeCursor("6"))},
+			wantIDs:      []string{"3", "4", "5"},
+			wantNextPage: true,
+			wantPrevPage: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connection, err := store.GetBooks(nil, tt.pagination)
+			if err != nil {
+				t.Fatalf("GetBooks() error = %v", err)
+			}
+
+			var ids []string
+			for _, edge := range connection.Edges {
+				ids = append(ids, edge.Node.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("GetBooks() ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if connection.PageInfo.HasNextPage != tt.wantNextPage {
+				t.Errorf("GetBooks() hasNextPage = %v, want %v", connection.PageInfo.HasNextPage, tt.wantNextPage)
+			}
+			if connection.PageInfo.HasPreviousPage != tt.wantPrevPage {
+				t.Errorf("GetBooks() hasPreviousPage = %v, want %v", connection.PageInfo.HasPreviousPage, tt.wantPrevPage)
+			}
+		})
+	}
+}
+
+func TestPaginationCursorSurvivesDeletion(t *testing.T) {
+	store := setupTestStore()
+
+	page, _ := store.GetBooks(nil, &PaginationInput{First: intPtr(2)})
+	cursor := page.PageInfo.EndCursor
+
+	// Delete the book the cursor points at before fetching the next page
+	store.DeleteBook("2")
+
+	next, err := store.GetBooks(nil, &PaginationInput{First: intPtr(2), After: cursor})
+	if err != nil {
+		t.Fatalf("GetBooks() error = %v", err)
+	}
+	if len(next.Edges) != 1 || next.Edges[0].Node.ID != "3" {
+		t.Errorf("Expected next page to continue at book 3, got %v edges", len(next.Edges))
+	}
+
+	prev, err := store.GetBooks(nil, &PaginationInput{Last: intPtr(2), Before: cursor})
+	if err != nil {
+		t.Fatalf("GetBooks() error = %v", err)
+	}
+	if len(prev.Edges) != 1 || prev.Edges[0].Node.ID != "1" {
+		t.Errorf("Expected previous page to end at book 1, got %v edges", len(prev.Edges))
+	}
+}
+
+func TestPaginationInvalidArguments(t *testing.T) {
+	store := setupTestStore()
+
+	if _, err := store.GetBooks(nil, &PaginationInput{Last: intPtr(-1)}); err == nil {
+		t.Error("Expected error for negative last")
+	}
+	if _, err := store.GetBooks(nil, &PaginationInput{Before: strPtr("not base64!")}); err == nil {
+		t.Error("Expected error for malformed cursor")
+	}
+}
+
+func TestGraphQLBackwardPagination(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `
+		query($before: String) {
+			books(pagination: {last: 1, before: $before}) {
+				edges { node { id } }
+				pageInfo { hasPreviousPage hasNextPage }
+			}
+		}
+	`
+
+	result := ExecuteQuery(schema, query, map[string]interface{}{"before": encodeCursor("3")})
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+
+	books := result.Data.(map[string]interface{})["books"].(map[string]interface{})
+	edges := books["edges"].([]interface{})
+	if len(edges) != 1 {
+		t.Fatalf("Expected 1 edge, got %d", len(edges))
+	}
+	if id := edges[0].(map[string]interface{})["node"].(map[string]interface{})["id"]; id != "2" {
+		t.Errorf("Expected book 2, got %v", id)
+	}
+
+	pageInfo := books["pageInfo"].(map[string]interface{})
+	if pageInfo["hasPreviousPage"] != true || pageInfo["hasNextPage"] != true {
+		t.Errorf("Unexpected pageInfo: %v", pageInfo)
+	}
+}
+
+func TestGetBooksOrdered(t *testing.T) {
+	store := setupTestStore()
+	store.CreateBook("a Unrated Book", "ISBN-004", 2018, "2", GenreRomance, nil)
+
+	tests := []struct {
+		name    string
+		orderBy *BookOrder
+		wantIDs []string
+	}{
+		{"default creation order", nil, []string{"1", "2", "3", "4"}},
+		{"title ascending", &BookOrder{Field: SortByTitle}, []string{"4", "1", "2", "3"}},
+		{"published year descending", &BookOrder{Field: SortByPublishedYear, Direction: SortDesc}, []string{"2", "1", "3", "4"}},
+		{"rating ascending puts unrated first", &BookOrder{Field: SortByRating, Direction: SortAsc}, []string{"4", "2", "1", "3"}},
+		{"rating descending", &BookOrder{Field: SortByRating, Direction: SortDesc}, []string{"3", "1", "2", "4"}},
+		{"created at descending", &BookOrder{Field: SortByCreatedAt, Direction: SortDesc}, []string{"4", "3", "2", "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connection, err := store.GetBooksOrdered(nil, tt.orderBy, nil)
+			if err != nil {
+				t.Fatalf("GetBooksOrdered() error = %v", err)
+			}
+
+			var ids []string
+			for _, edge := range connection.Edges {
+				ids = append(ids, edge.Node.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("GetBooksOrdered() ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestGetBooksOrderedCursorStability(t *testing.T) {
+	store := setupTestStore()
+	order := &BookOrder{Field: SortByRating, Direction: SortDesc}
+
+	page, err := store.GetBooksOrdered(nil, order, &PaginationInput{First: intPtr(1)})
+	if err != nil {
+		t.Fatalf("GetBooksOrdered() error = %v", err)
+	}
+	if page.Edges[0].Node.ID != "3" {
+		t.Fatalf("Expected highest rated book first, got %v", page.Edges[0].Node.ID)
+	}
+
+	// The cursor embeds the rating, so it still positions after deletion
+	store.DeleteBook("3")
+
+	next, err := store.GetBooksOrdered(nil, order, &PaginationInput{First: intPtr(5), After: page.PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetBooksOrdered() error = %v", err)
+	}
+	if len(next.Edges) != 2 || next.Edges[0].Node.ID != "1" || next.Edges[1].Node.ID != "2" {
+		t.Errorf("Unexpected page after deletion: %d edges", len(next.Edges))
+	}
+
+	// A cursor from one ordering cannot be used with another
+	_, err = store.GetBooksOrdered(nil, &BookOrder{Field: SortByTitle}, &PaginationInput{After: page.PageInfo.EndCursor})
+	if err == nil {
+		t.Error("Expected error for cursor from a different ordering")
+	}
+}
+
+func TestGetBooksOrderedInvalidOrder(t *testing.T) {
+	store := setupTestStore()
+
+	if _, err := store.GetBooksOrdered(nil, &BookOrder{Field: "AUTHOR"}, nil); err == nil {
+		t.Error("Expected error for unknown sort field")
+	}
+	if _, err := store.GetBooksOrdered(nil, &BookOrder{Field: SortByTitle, Direction: "UP"}, nil); err == nil {
+		t.Error("Expected error for unknown sort direction")
+	}
+}
+
+func TestGraphQLBooksOrderBy(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := `
+		query {
+			books(orderBy: {field: PUBLISHED_YEAR, direction: DESC}) {
+				edges { node { id publishedYear } }
+			}
+		}
+	`
+
+	result := ExecuteQuery(schema, query, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+
+	edges := result.Data.(map[string]interface{})["books"].(map[string]interface{})["edges"].([]interface{})
+	var years []int
+	for _, edge := range edges {
+		years = append(years, edge.(map[string]interface{})["node"].(map[string]interface{})["publishedYear"].(int))
+	}
+	if len(years) != 3 || years[0] != 2021 || years[1] != 2020 || years[2] != 2019 {
+		t.Errorf("Expected years in descending order, got %v", years)
+	}
+}
+
 func TestUpdateBook(t *testing.T) {
 	store := setupTestStore()
 
@@ -343,6 +609,125 @@ func TestCreateAuthor(t *testing.T) {
 	}
 }
 
+func TestUpdateAuthor(t *testing.T) {
+	store := setupTestStore()
+
+	author, err := store.UpdateAuthor("2", strPtr("Renamed Author"), strPtr("New bio"))
+	if err != nil {
+		t.Fatalf("UpdateAuthor() error = %v", err)
+	}
+	if author.Name != "Renamed Author" || author.Bio == nil || *author.Bio != "New bio" {
+		t.Errorf("UpdateAuthor() = %+v", author)
+	}
+
+	if _, err := store.UpdateAuthor("2", strPtr("  "), nil); err == nil {
+		t.Error("Expected error for empty name")
+	}
+	if _, err := store.UpdateAuthor("999", strPtr("Nobody"), nil); err == nil {
+		t.Error("Expected error for missing author")
+	}
+}
+
+func TestDeleteAuthorPolicies(t *testing.T) {
+	t.Run("restrict rejects authors with books", func(t *testing.T) {
+		store := setupTestStore()
+		if _, err := store.DeleteAuthor("1", DeleteRestrict); err == nil {
+			t.Fatal("Expected error deleting author with books")
+		}
+		if _, err := store.GetAuthor("1"); err != nil {
+			t.Error("Author should still exist")
+		}
+	})
+
+	t.Run("restrict allows authors without books", func(t *testing.T) {
+		store := setupTestStore()
+		author, _ := store.CreateAuthor("No Books", nil)
+		if ok, err := store.DeleteAuthor(author.ID, DeleteRestrict); !ok || err != nil {
+			t.Errorf("DeleteAuthor() = %v, %v", ok, err)
+		}
+	})
+
+	t.Run("cascade deletes books", func(t *testing.T) {
+		store := setupTestStore()
+		if _, err := store.DeleteAuthor("1", DeleteCascade); err != nil {
+			t.Fatalf("DeleteAuthor() error = %v", err)
+		}
+		books, _ := store.GetBooksByAuthor("1")
+		if len(books) != 0 {
+			t.Errorf("Expected cascaded books to be deleted, got %d", len(books))
+		}
+		if _, err := store.GetBook("3"); err != nil {
+			t.Error("Books of other authors should remain")
+		}
+	})
+
+	t.Run("orphan keeps books", func(t *testing.T) {
+		store := setupTestStore()
+		if _, err := store.DeleteAuthor("1", DeleteOrphan); err != nil {
+			t.Fatalf("DeleteAuthor() error = %v", err)
+		}
+		book, err := store.GetBook("1")
+		if err != nil {
+			t.Fatalf("Orphaned book should remain: %v", err)
+		}
+		if book.AuthorID != "" {
+			t.Errorf("Expected orphaned book to have no author, got %v", book.AuthorID)
+		}
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		store := setupTestStore()
+		if _, err := store.DeleteAuthor("1", "SOFT"); err == nil {
+			t.Error("Expected error for unknown policy")
+		}
+	})
+}
+
+func TestGraphQLMutationDeleteAuthorOrphan(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := ExecuteQueryWithContext(editorContext(), schema, `mutation { deleteAuthor(id: "1") }`, nil)
+	if len(result.Errors) == 0 {
+		t.Fatal("Expected RESTRICT to reject deleting an author with books")
+	}
+
+	result = ExecuteQueryWithContext(editorContext(), schema, `mutation { deleteAuthor(id: "1", onDelete: ORPHAN) }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL mutation failed: %v", result.Errors)
+	}
+
+	result = ExecuteQuery(schema, `query { book(id: "1") { title author { name } } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+	book := result.Data.(map[string]interface{})["book"].(map[string]interface{})
+	if book["author"] != nil {
+		t.Errorf("Expected orphaned book author to be null, got %v", book["author"])
+	}
+}
+
+func TestGraphQLMutationUpdateAuthor(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := ExecuteQueryWithContext(editorContext(), schema, `mutation { updateAuthor(id: "2", input: {bio: "Updated"}) { name bio } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL mutation failed: %v", result.Errors)
+	}
+
+	author := result.Data.(map[string]interface{})["updateAuthor"].(map[string]interface{})
+	if author["bio"] != "Updated" || author["name"] != "Test Author 2" {
+		t.Errorf("Unexpected author: %v", author)
+	}
+}
+
 func TestGetBooksByAuthor(t *testing.T) {
 	store := setupTestStore()
 
@@ -465,7 +850,7 @@ func TestGraphQLMutationCreateBook(t *testing.T) {
 		}
 	`
 
-	result := ExecuteQuery(schema, mutation, nil)
+	result := ExecuteQueryWithContext(editorContext(), schema, mutation, nil)
 	if len(result.Errors) > 0 {
 		t.Fatalf("GraphQL mutation failed: %v", result.Errors)
 	}
@@ -501,7 +886,7 @@ func TestGraphQLMutationUpdateBook(t *testing.T) {
 		}
 	`
 
-	result := ExecuteQuery(schema, mutation, nil)
+	result := ExecuteQueryWithContext(editorContext(), schema, mutation, nil)
 	if len(result.Errors) > 0 {
 		t.Fatalf("GraphQL mutation failed: %v", result.Errors)
 	}
@@ -530,7 +915,7 @@ func TestGraphQLMutationDeleteBook(t *testing.T) {
 		}
 	`
 
-	result := ExecuteQuery(schema, mutation, nil)
+	result := ExecuteQueryWithContext(editorContext(), schema, mutation, nil)
 	if len(result.Errors) > 0 {
 		t.Fatalf("GraphQL mutation failed: %v", result.Errors)
 	}
@@ -632,7 +1017,7 @@ func TestGraphQLErrorHandling(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ExecuteQuery(schema, tt.query, nil)
+			result := ExecuteQueryWithContext(editorContext(), schema, tt.query, nil)
 			hasErrors := len(result.Errors) > 0
 
 			if hasErrors != tt.expectError {
@@ -655,6 +1040,118 @@ func TestGraphQLErrorHandling(t *testing.T) {
 	}
 }
 
+func TestDomainErrors(t *testing.T) {
+	store := setupTestStore()
+
+	tests := []struct {
+		name      string
+		run       func() error
+		wantCode  string
+		wantField string
+	}{
+		{"missing title", func() error {
+			_, err := store.CreateBook("", "ISBN", 2020, "1", GenreFiction, nil)
+			return err
+		}, CodeBadUserInput, "title"},
+		{"bad rating", func() error {
+			_, err := store.CreateBook("Title", "ISBN", 2020, "1", GenreFiction, floatPtr(7))
+			return err
+		}, CodeBadUserInput, "rating"},
+		{"unknown author", func() error {
+			_, err := store.CreateBook("Title", "ISBN", 2020, "999", GenreFiction, nil)
+			return err
+		}, CodeNotFound, "authorId"},
+		{"unknown book", func() error {
+			_, err := store.GetBook("999")
+			return err
+		}, CodeNotFound, ""},
+		{"bad cursor", func() error {
+			_, err := store.GetBooks(nil, &PaginationInput{After: strPtr("%%%")})
+			return err
+		}, CodeBadUserInput, "after"},
+		{"restricted delete", func() error {
+			_, err := store.DeleteAuthor("1", DeleteRestrict)
+			return err
+		}, CodeConflict, "onDelete"},
+		{"bad stars", func() error {
+			_, err := store.AddReview("1", "user-1", 9, "")
+			return err
+		}, CodeBadUserInput, "stars"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var domainErr *DomainError
+			if err := tt.run(); !errors.As(err, &domainErr) {
+				t.Fatalf("Expected *DomainError, got %T: %v", err, err)
+			}
+			ext := domainErr.Extensions()
+			if ext["code"] != tt.wantCode {
+				t.Errorf("code = %v, want %v", ext["code"], tt.wantCode)
+			}
+			if field, _ := ext["field"].(string); field != tt.wantField {
+				t.Errorf("field = %q, want %q", field, tt.wantField)
+			}
+		})
+	}
+
+	_, err := store.CreateBook("Title", "ISBN", 2020, "999", GenreFiction, nil)
+	if !errors.Is(err, ErrAuthorNotFound) {
+		t.Error("Field-annotated errors should still match their sentinel")
+	}
+	if errors.Is(err, ErrBookNotFound) {
+		t.Error("Different sentinels should not match")
+	}
+}
+
+func TestGraphQLErrorExtensions(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+
+	tests := []struct {
+		name     string
+		query    string
+		wantExt  map[string]interface{}
+		wantHint bool
+	}{
+		{
+			name: "validation",
+			query: `mutation {
+				createBook(input: { title: "T", isbn: "1", publishedYear: 2020, authorId: "1", genre: FICTION, rating: 9 }) { id }
+			}`,
+			wantExt: map[string]interface{}{"code": "BAD_USER_INPUT", "field": "rating"},
+		},
+		{
+			name:    "not found",
+			query:   `{ book(id: "999") { id } }`,
+			wantExt: map[string]interface{}{"code": "NOT_FOUND"},
+		},
+		{
+			name:     "conflict",
+			query:    `mutation { deleteAuthor(id: "1") }`,
+			wantExt:  map[string]interface{}{"code": "CONFLICT", "field": "onDelete"},
+			wantHint: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ExecuteQueryWithContext(editorContext(), schema, tt.query, nil)
+			if len(result.Errors) != 1 {
+				t.Fatalf("Expected 1 error, got %v", result.Errors)
+			}
+			ext := result.Errors[0].Extensions
+			for key, want := range tt.wantExt {
+				if ext[key] != want {
+					t.Errorf("extensions[%q] = %v, want %v", key, ext[key], want)
+				}
+			}
+			if _, ok := ext["hint"]; ok != tt.wantHint {
+				t.Errorf("Expected hint present = %v, got %v", tt.wantHint, ext)
+			}
+		})
+	}
+}
+
 func TestConcurrentAccess(t *testing.T) {
 	store := setupTestStore()
 
@@ -684,23 +1181,1934 @@ func TestConcurrentAccess(t *testing.T) {
 	}
 }
 
-func BenchmarkGetBooks(b *testing.B) {
-	store := setupTestStore()
-
-	// Add more books
-	author, _ := store.GetAuthor("1")
-	for i := 0; i < 100; i++ {
-		rating := 4.0
-		store.CreateBook("Book", "ISBN", 2020, author.ID, GenreFiction, &rating)
-	}
-
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		store.GetBooks(nil, nil)
+func TestTokenize(t *testing.T) {
+	got := tokenize("The Go Programming-Language, 2nd ed.")
+	want := []string{"the", "go", "programming", "language", "2nd", "ed"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("tokenize() = %v, want %v", got, want)
 	}
 }
 
-func BenchmarkGraphQLQuery(b *testing.B) {
+func TestSearchBooks(t *testing.T) {
+	store := NewStore()
+	pike, _ := store.CreateAuthor("Rob Pike", nil)
+	knuth, _ := store.CreateAuthor("Donald Knuth", nil)
+	gopl, _ := store.CreateBook("The Go Programming Language", "978-0134190440", 2015, pike.ID, GenreNonfiction, nil)
+	taocp, _ := store.CreateBook("The Art of Computer Programming", "978-0201896831", 1968, knuth.ID, GenreNonfiction, nil)
+	pikeBook, _ := store.CreateBook("Notes on Programming in C", "ISBN-PIKE", 1989, pike.ID, GenreNonfiction, nil)
+
+	ids := func(books []*Book) []string {
+		out := make([]string, len(books))
+		for i, book := range books {
+			out[i] = book.ID
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"exact title word", "go", []string{gopl.ID}},
+		{"prefix ties sort by title", "progr", []string{pikeBook.ID, taocp.ID, gopl.ID}},
+		{"all terms must match", "programming pike", []string{pikeBook.ID, gopl.ID}},
+		{"author name", "knuth", []string{taocp.ID}},
+		{"title and author terms", "pike notes", []string{pikeBook.ID}},
+		{"isbn", "978-0201", []string{taocp.ID}},
+		{"case insensitive", "COMPUTER", []string{taocp.ID}},
+		{"no match", "rust", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, err := store.SearchBooks(tt.query, 0)
+			if err != nil {
+				t.Fatalf("SearchBooks(%q) failed: %v", tt.query, err)
+			}
+			if got := ids(books); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("SearchBooks(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	books, _ := store.SearchBooks("programming", 2)
+	if len(books) != 2 {
+		t.Errorf("Expected limit to cap results at 2, got %d", len(books))
+	}
+
+	if _, err := store.SearchBooks("  --  ", 0); err == nil {
+		t.Error("Expected error for a query without terms")
+	}
+}
+
+func TestSearchBooksRelevance(t *testing.T) {
+	store := NewStore()
+	author, _ := store.CreateAuthor("Dune Herbert", nil)
+	other, _ := store.CreateAuthor("Someone Else", nil)
+	byAuthor, _ := store.CreateBook("Children", "ISBN-1", 1985, author.ID, GenreSciFi, nil)
+	exact, _ := store.CreateBook("Dune", "ISBN-2", 1965, author.ID, GenreSciFi, nil)
+	prefix, _ := store.CreateBook("Dunes of Mars", "ISBN-3", 2001, other.ID, GenreSciFi, nil)
+
+	books, err := store.SearchBooks("dune", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Exact matches score double, so an exact author match outranks a
+	// prefix title match
+	want := []string{exact.ID, byAuthor.ID, prefix.ID}
+	if len(books) != len(want) {
+		t.Fatalf("Expected %d books, got %d", len(want), len(books))
+	}
+	for i, book := range books {
+		if book.ID != want[i] {
+			t.Fatalf("Expected order %v, got %v", want, books)
+		}
+	}
+}
+
+func TestSearchIndexTracksChanges(t *testing.T) {
+	store := setupTestStore()
+
+	if _, err := store.UpdateBook("1", "Solaris", "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if books, _ := store.SearchBooks("solaris", 0); len(books) != 1 {
+		t.Errorf("Expected renamed book to be found, got %d", len(books))
+	}
+	if books, _ := store.SearchBooks("book", 0); len(books) != 2 {
+		t.Errorf("Expected old title to drop out of the index, got %d", len(books))
+	}
+
+	if _, err := store.UpdateAuthor("2", strPtr("Stanislaw Lem"), nil); err != nil {
+		t.Fatal(err)
+	}
+	books, _ := store.SearchBooks("lem", 0)
+	if len(books) != 1 || books[0].ID != "3" {
+		t.Errorf("Expected author rename to reindex book 3, got %v", books)
+	}
+
+	store.DeleteBook("2")
+	if books, _ := store.SearchBooks("book 2", 0); len(books) != 0 {
+		t.Errorf("Expected deleted book to leave the index, got %d", len(books))
+	}
+
+	store.DeleteAuthor("2", DeleteOrphan)
+	if books, _ := store.SearchBooks("lem", 0); len(books) != 0 {
+		t.Errorf("Expected orphaned book to lose its author terms, got %d", len(books))
+	}
+	if books, _ := store.SearchBooks("book 3", 0); len(books) != 1 {
+		t.Errorf("Expected orphaned book to stay searchable by title, got %d", len(books))
+	}
+
+	store.DeleteAuthor("1", DeleteCascade)
+	if books, _ := store.SearchBooks("solaris", 0); len(books) != 0 {
+		t.Errorf("Expected cascaded books to leave the index, got %d", len(books))
+	}
+}
+
+func TestGraphQLSearchBooks(t *testing.T) {
+	schema, err := buildSchema(setupTestStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := ExecuteQuery(schema, `{ searchBooks(query: "book auth") { id title } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+
+	data := result.Data.(map[string]interface{})
+	books := data["searchBooks"].([]interface{})
+	if len(books) != 3 {
+		t.Errorf("Expected 3 books, got %d", len(books))
+	}
+
+	result = ExecuteQuery(schema, `{ searchBooks(query: "book", limit: 1) { id } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+	if books := result.Data.(map[string]interface{})["searchBooks"].([]interface{}); len(books) != 1 {
+		t.Errorf("Expected limit 1, got %d", len(books))
+	}
+}
+
+func TestAddReview(t *testing.T) {
+	store := setupTestStore()
+
+	if _, err := store.AddReview("1", "user-1", 5, "Loved it"); err != nil {
+		t.Fatalf("AddReview() error = %v", err)
+	}
+	if _, err := store.AddReview("1", "user-2", 2, ""); err != nil {
+		t.Fatalf("AddReview() error = %v", err)
+	}
+
+	book, _ := store.GetBook("1")
+	if book.Rating == nil || *book.Rating != 3.5 {
+		t.Errorf("Expected average rating 3.5, got %v", book.Rating)
+	}
+
+	// Books without reviews keep their initial rating
+	other, _ := store.GetBook("2")
+	if other.Rating == nil || *other.Rating != 3.8 {
+		t.Errorf("Expected unreviewed rating 3.8, got %v", other.Rating)
+	}
+
+	tests := []struct {
+		name   string
+		bookID string
+		userID string
+		stars  int
+	}{
+		{"missing book", "999", "user-1", 4},
+		{"missing user", "1", "", 4},
+		{"zero stars", "1", "user-1", 0},
+		{"too many stars", "1", "user-1", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := store.AddReview(tt.bookID, tt.userID, tt.stars, ""); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+
+	if _, err := store.UpdateBook("1", "", "", nil, floatPtr(1.0)); err == nil {
+		t.Error("Expected error setting rating on a reviewed book")
+	}
+}
+
+func TestGetReviewsPagination(t *testing.T) {
+	store := setupTestStore()
+	for stars := 1; stars <= 5; stars++ {
+		store.AddReview("1", fmt.Sprintf("user-%d", stars), stars, "")
+	}
+
+	conn, err := store.GetReviews("1", &PaginationInput{First: intPtr(2)})
+	if err != nil {
+		t.Fatalf("GetReviews() error = %v", err)
+	}
+	if len(conn.Edges) != 2 || conn.Edges[0].Node.Stars != 1 || !conn.PageInfo.HasNextPage {
+		t.Fatalf("Unexpected first page %+v", conn)
+	}
+
+	conn, err = store.GetReviews("1", &PaginationInput{First: intPtr(10), After: conn.PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetReviews() error = %v", err)
+	}
+	if len(conn.Edges) != 3 || conn.Edges[0].Node.Stars != 3 || conn.PageInfo.HasNextPage || !conn.PageInfo.HasPreviousPage {
+		t.Errorf("Unexpected second page %+v", conn)
+	}
+
+	conn, _ = store.GetReviews("1", &PaginationInput{Last: intPtr(1)})
+	if len(conn.Edges) != 1 || conn.Edges[0].Node.Stars != 5 {
+		t.Errorf("Expected last review, got %+v", conn.Edges)
+	}
+
+	if _, err := store.GetReviews("1", &PaginationInput{After: strPtr("%%%")}); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+}
+
+func TestGraphQLAddReview(t *testing.T) {
+	store := setupTestStore()
+	schema, _ := buildSchema(store)
+
+	mutation := `
+		mutation {
+			addReview(bookId: "3", input: { stars: 4, text: "Solid" }) {
+				userId
+				stars
+				book { rating reviewCount }
+			}
+		}
+	`
+
+	result := ExecuteQuery(schema, mutation, nil)
+	if len(result.Errors) == 0 {
+		t.Fatal("Expected anonymous addReview to fail")
+	}
+
+	reader := WithUser(context.Background(), &AuthUser{ID: "reader-1", Username: "reader"})
+	result = ExecuteQueryWithContext(reader, schema, mutation, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Mutation errors: %v", result.Errors)
+	}
+
+	review := result.Data.(map[string]interface{})["addReview"].(map[string]interface{})
+	if review["userId"] != "reader-1" || review["stars"] != 4 {
+		t.Errorf("Unexpected review %v", review)
+	}
+	book := review["book"].(map[string]interface{})
+	if book["rating"] != 4.0 || book["reviewCount"] != 1 {
+		t.Errorf("Expected rating 4 from 1 review, got %v", book)
+	}
+
+	query := `
+		{
+			book(id: "3") {
+				reviews(pagination: { first: 1 }) {
+					edges { node { text } }
+					pageInfo { hasNextPage }
+				}
+			}
+		}
+	`
+	result = ExecuteQuery(schema, query, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Query errors: %v", result.Errors)
+	}
+	reviews := result.Data.(map[string]interface{})["book"].(map[string]interface{})["reviews"].(map[string]interface{})
+	edges := reviews["edges"].([]interface{})
+	if len(edges) != 1 || edges[0].(map[string]interface{})["node"].(map[string]interface{})["text"] != "Solid" {
+		t.Errorf("Unexpected reviews %v", reviews)
+	}
+}
+
+func fetchExport(t *testing.T, exporter *BookExporter, exportURL string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, exportURL, nil)
+	rec := httptest.NewRecorder()
+	exporter.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBookExporterCSV(t *testing.T) {
+	store := setupTestStore()
+	exporter := NewBookExporter(store, []byte("secret"), "/graphql/export")
+
+	minRating := 4.0
+	export, err := exporter.Export(&BookFilter{MinRating: &minRating}, ExportCSV)
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if !strings.HasPrefix(export.URL, "/graphql/export?") {
+		t.Errorf("Unexpected export URL %v", export.URL)
+	}
+
+	rec := fetchExport(t, exporter, export.URL)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Expected text/csv, got %v", ct)
+	}
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected header and 2 rows, got %d records", len(records))
+	}
+	if records[0][0] != "id" || records[1][1] != "Book 1" || records[1][6] != "4.5" || records[2][1] != "Book 3" {
+		t.Errorf("Unexpected CSV %v", records)
+	}
+}
+
+func TestBookExporterNDJSON(t *testing.T) {
+	store := setupTestStore()
+	exporter := NewBookExporter(store, []byte("secret"), "/graphql/export")
+
+	export, err := exporter.Export(nil, ExportNDJSON)
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	rec := fetchExport(t, exporter, export.URL)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var titles []string
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var book Book
+		if err := dec.Decode(&book); err != nil {
+			t.Fatalf("Invalid NDJSON: %v", err)
+		}
+		titles = append(titles, book.Title)
+	}
+	if strings.Join(titles, ",") != "Book 1,Book 2,Book 3" {
+		t.Errorf("Unexpected export %v", titles)
+	}
+}
+
+func TestBookExporterRejectsInvalidLinks(t *testing.T) {
+	store := setupTestStore()
+	exporter := NewBookExporter(store, []byte("secret"), "/graphql/export")
+
+	if _, err := exporter.Export(nil, "XML"); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+
+	export, _ := exporter.Export(nil, ExportCSV)
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := strings.Replace(export.URL, "format=CSV", "format=NDJSON", 1)
+		if rec := fetchExport(t, exporter, tampered); rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", rec.Code)
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		other := NewBookExporter(store, []byte("other"), "/graphql/export")
+		if rec := fetchExport(t, other, export.URL); rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", rec.Code)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		exporter.ttl = -time.Minute
+		expired, _ := exporter.Export(nil, ExportCSV)
+		if rec := fetchExport(t, exporter, expired.URL); rec.Code != http.StatusGone {
+			t.Errorf("Expected 410, got %d", rec.Code)
+		}
+	})
+}
+
+func TestGraphQLExportBooks(t *testing.T) {
+	store := setupTestStore()
+	exporter := NewBookExporter(store, []byte("secret"), "/graphql/export")
+	schema, _ := buildSchema(store, WithBookExporter(exporter))
+
+	query := `{ exportBooks(filter: { genre: SCIFI }, format: NDJSON) { url format expiresAt } }`
+
+	if result := ExecuteQuery(schema, query, nil); len(result.Errors) == 0 {
+		t.Error("Expected anonymous export to fail")
+	}
+
+	result := ExecuteQueryWithContext(editorContext(), schema, query, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Query errors: %v", result.Errors)
+	}
+	export := result.Data.(map[string]interface{})["exportBooks"].(map[string]interface{})
+	if export["format"] != "NDJSON" {
+		t.Errorf("Expected NDJSON format, got %v", export["format"])
+	}
+
+	rec := fetchExport(t, exporter, export["url"].(string))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 1 || !strings.Contains(lines[0], `"title":"Book 2"`) {
+		t.Errorf("Unexpected export response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	schema, _ = buildSchema(store)
+	if result := ExecuteQueryWithContext(editorContext(), schema, query, nil); len(result.Errors) == 0 {
+		t.Error("Expected error when exports are not enabled")
+	}
+}
+
+func TestPrintSchemaSDL(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	sdl := printSchemaSDL(schema)
+
+	expected := []string{
+		"type Query {\n",
+		"  books(filter: BookFilter, orderBy: BookOrder, pagination: PaginationInput): BookConnection!\n",
+		"  deleteAuthor(id: ID!, onDelete: AuthorDeletePolicy = RESTRICT): Boolean!\n",
+		"input BookOrder {\n  direction: SortDirection = ASC\n  field: BookSortField!\n}",
+		"enum Genre {\n  FANTASY\n  FICTION\n  MYSTERY\n  NONFICTION\n  ROMANCE\n  SCIFI\n}",
+		"  books: [BookRef!]!\n",
+		"type Subscription {\n  bookAdded: Book!\n  bookUpdated: Book!\n}",
+	}
+	for _, want := range expected {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("Expected SDL to contain %q", want)
+		}
+	}
+	if strings.Contains(sdl, "__Schema") || strings.Contains(sdl, "scalar String") {
+		t.Error("SDL should not include introspection types or built-in scalars")
+	}
+	if strings.Contains(sdl, "schema {") {
+		t.Error("Default root type names should not need a schema block")
+	}
+
+	if again := printSchemaSDL(schema); again != sdl {
+		t.Error("Expected SDL output to be stable")
+	}
+}
+
+func TestBuildSchemaFromSDLRoundTrip(t *testing.T) {
+	store := setupTestStore()
+	schema, _ := buildSchema(store)
+	sdl := printSchemaSDL(schema)
+
+	sdlSchema, err := buildSchema(store, WithSDL(sdl))
+	if err != nil {
+		t.Fatalf("buildSchema(WithSDL) error = %v", err)
+	}
+	if got := printSchemaSDL(sdlSchema); got != sdl {
+		t.Errorf("SDL round trip changed the schema:\n%s", got)
+	}
+
+	query := `{ books(filter: { genre: SCIFI }, orderBy: { field: TITLE }) { edges { node { title author { name } } } } }`
+	result := ExecuteQuery(sdlSchema, query, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Query errors: %v", result.Errors)
+	}
+	edges := result.Data.(map[string]interface{})["books"].(map[string]interface{})["edges"].([]interface{})
+	if len(edges) != 1 {
+		t.Fatalf("Expected 1 SCIFI book, got %d", len(edges))
+	}
+	node := edges[0].(map[string]interface{})["node"].(map[string]interface{})
+	if node["title"] != "Book 2" || node["author"].(map[string]interface{})["name"] != "Test Author 1" {
+		t.Errorf("Unexpected node %v", node)
+	}
+
+	// Resolver guards come along with the resolvers
+	mutation := `mutation { deleteBook(id: "1") }`
+	if result := ExecuteQuery(sdlSchema, mutation, nil); len(result.Errors) == 0 {
+		t.Error("Expected anonymous deleteBook to fail")
+	}
+}
+
+func TestBuildSchemaFromSDLSubset(t *testing.T) {
+	sdl := `
+		type Query {
+			book(id: ID!): Book
+		}
+
+		type Book {
+			id: ID!
+			title: String!
+		}
+	`
+	schema, err := buildSchema(setupTestStore(), WithSDL(sdl))
+	if err != nil {
+		t.Fatalf("buildSchema(WithSDL) error = %v", err)
+	}
+
+	result := ExecuteQuery(schema, `{ book(id: "1") { title } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Query errors: %v", result.Errors)
+	}
+	book := result.Data.(map[string]interface{})["book"].(map[string]interface{})
+	if book["title"] != "Book 1" {
+		t.Errorf("Expected Book 1, got %v", book["title"])
+	}
+
+	if result := ExecuteQuery(schema, `{ book(id: "1") { isbn } }`, nil); len(result.Errors) == 0 {
+		t.Error("Expected fields missing from the SDL to be rejected")
+	}
+	if result := ExecuteQuery(schema, `{ authors { name } }`, nil); len(result.Errors) == 0 {
+		t.Error("Expected root fields missing from the SDL to be rejected")
+	}
+}
+
+func TestBuildSchemaFromSDLErrors(t *testing.T) {
+	base, _ := buildSchema(setupTestStore())
+
+	tests := []struct {
+		name string
+		sdl  string
+	}{
+		{"syntax error", `type Query {`},
+		{"no query type", `type Book { id: ID! }`},
+		{"unknown type", `type Query { book: Missing }`},
+		{"input as output", `type Query { book: BookFilter }`},
+		{"object as input", `type Query { book(filter: Book): Book } type Book { id: ID! }`},
+		{"duplicate type", `type Query { id: ID } type Query { id: ID }`},
+		{"unknown scalar", `scalar Money type Query { price: Money }`},
+		{"interfaces", `interface Node { id: ID! } type Query implements Node { id: ID! }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildSchemaFromSDL(tt.sdl, base); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestSchemaSDLHandler(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	handler := schemaSDLHandler(schema)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/graphql/schema", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain, got %v", ct)
+	}
+	if rec.Body.String() != printSchemaSDL(schema) {
+		t.Error("Expected handler to serve the printed schema")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/graphql/schema", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func newTestSQLiteRepository(t *testing.T) *SQLiteRepository {
+	t.Helper()
+	repo, err := NewSQLiteRepository(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestRepositoryContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) Repository{
+		"memory": func(t *testing.T) Repository { return NewMemoryRepository() },
+		"sqlite": func(t *testing.T) Repository { return newTestSQLiteRepository(t) },
+	}
+
+	for name, newRepo := range backends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("create and get", func(t *testing.T) {
+				repo := newRepo(t)
+				author := &Author{Name: "Author", Bio: strPtr("Bio")}
+				if err := repo.CreateAuthor(author); err != nil {
+					t.Fatalf("CreateAuthor() error = %v", err)
+				}
+				if author.ID != "1" {
+					t.Errorf("Expected author ID 1, got %v", author.ID)
+				}
+
+				rating := 4.5
+				createdAt := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+				book := &Book{Title: "Book", ISBN: "123", PublishedYear: 2020, AuthorID: author.ID, Genre: GenreFiction, Rating: &rating, CreatedAt: createdAt}
+				if err := repo.CreateBook(book); err != nil {
+					t.Fatalf("CreateBook() error = %v", err)
+				}
+
+				got, err := repo.GetBook(book.ID)
+				if err != nil {
+					t.Fatalf("GetBook() error = %v", err)
+				}
+				if got.Title != "Book" || got.AuthorID != author.ID || got.Genre != GenreFiction {
+					t.Errorf("Unexpected book %+v", got)
+				}
+				if got.Rating == nil || *got.Rating != rating {
+					t.Errorf("Expected rating %v, got %v", rating, got.Rating)
+				}
+				if !got.CreatedAt.Equal(createdAt) {
+					t.Errorf("Expected createdAt %v, got %v", createdAt, got.CreatedAt)
+				}
+
+				gotAuthor, err := repo.GetAuthor(author.ID)
+				if err != nil || gotAuthor.Bio == nil || *gotAuthor.Bio != "Bio" {
+					t.Errorf("GetAuthor() = %+v, %v", gotAuthor, err)
+				}
+			})
+
+			t.Run("create book requires author", func(t *testing.T) {
+				repo := newRepo(t)
+				err := repo.CreateBook(&Book{Title: "Book", ISBN: "123", PublishedYear: 2020, AuthorID: "42", Genre: GenreFiction})
+				if !errors.Is(err, ErrAuthorNotFound) {
+					t.Errorf("Expected ErrAuthorNotFound, got %v", err)
+				}
+				books, _ := repo.ListBooks()
+				if len(books) != 0 {
+					t.Errorf("Expected no books to be stored, got %d", len(books))
+				}
+			})
+
+			t.Run("not found", func(t *testing.T) {
+				repo := newRepo(t)
+				if _, err := repo.GetBook("1"); !errors.Is(err, ErrBookNotFound) {
+					t.Errorf("GetBook() error = %v", err)
+				}
+				if _, err := repo.GetAuthor("abc"); !errors.Is(err, ErrAuthorNotFound) {
+					t.Errorf("GetAuthor() error = %v", err)
+				}
+				if err := repo.UpdateBook(&Book{ID: "1"}); !errors.Is(err, ErrBookNotFound) {
+					t.Errorf("UpdateBook() error = %v", err)
+				}
+				if err := repo.DeleteBook("1"); !errors.Is(err, ErrBookNotFound) {
+					t.Errorf("DeleteBook() error = %v", err)
+				}
+				if err := repo.DeleteAuthor("1", DeleteCascade); !errors.Is(err, ErrAuthorNotFound) {
+					t.Errorf("DeleteAuthor() error = %v", err)
+				}
+			})
+
+			t.Run("update and list", func(t *testing.T) {
+				repo := newRepo(t)
+				a1 := &Author{Name: "A1"}
+				a2 := &Author{Name: "A2"}
+				repo.CreateAuthor(a1)
+				repo.CreateAuthor(a2)
+				for i, authorID := range []string{a1.ID, a2.ID, a1.ID} {
+					repo.CreateBook(&Book{Title: fmt.Sprintf("Book %d", i), ISBN: "123", PublishedYear: 2020, AuthorID: authorID, Genre: GenreFiction, CreatedAt: time.Now()})
+				}
+
+				book, _ := repo.GetBook("2")
+				book.Title = "Renamed"
+				book.Rating = nil
+				if err := repo.UpdateBook(book); err != nil {
+					t.Fatalf("UpdateBook() error = %v", err)
+				}
+				if got, _ := repo.GetBook("2"); got.Title != "Renamed" {
+					t.Errorf("Expected updated title, got %v", got.Title)
+				}
+
+				books, _ := repo.ListBooks()
+				if len(books) != 3 {
+					t.Errorf("Expected 3 books, got %d", len(books))
+				}
+				byAuthor, _ := repo.ListBooksByAuthor(a1.ID)
+				if len(byAuthor) != 2 || byAuthor[0].ID != "1" || byAuthor[1].ID != "3" {
+					t.Errorf("Unexpected books by author %v", byAuthor)
+				}
+
+				authors, _ := repo.ListAuthors()
+				if len(authors) != 2 || authors[0].ID != a1.ID || authors[1].ID != a2.ID {
+					t.Errorf("Expected authors ordered by ID, got %v", authors)
+				}
+				batch, _ := repo.GetAuthorsByIDs([]string{a2.ID, "99", "x"})
+				if len(batch) != 1 || batch[a2.ID].Name != "A2" {
+					t.Errorf("Unexpected batch %v", batch)
+				}
+
+				a1.Name = "Renamed Author"
+				if err := repo.UpdateAuthor(a1); err != nil {
+					t.Fatalf("UpdateAuthor() error = %v", err)
+				}
+				if got, _ := repo.GetAuthor(a1.ID); got.Name != "Renamed Author" {
+					t.Errorf("Expected updated name, got %v", got.Name)
+				}
+			})
+
+			t.Run("delete author policies", func(t *testing.T) {
+				repo := newRepo(t)
+				author := &Author{Name: "Author"}
+				repo.CreateAuthor(author)
+				repo.CreateBook(&Book{Title: "Book", ISBN: "123", PublishedYear: 2020, AuthorID: author.ID, Genre: GenreFiction, CreatedAt: time.Now()})
+
+				if err := repo.DeleteAuthor(author.ID, DeleteRestrict); err == nil {
+					t.Error("Expected restrict to fail with books")
+				}
+				if err := repo.DeleteAuthor(author.ID, DeleteOrphan); err != nil {
+					t.Fatalf("DeleteAuthor() error = %v", err)
+				}
+				book, err := repo.GetBook("1")
+				if err != nil || book.AuthorID != "" {
+					t.Errorf("Expected orphaned book, got %+v, %v", book, err)
+				}
+
+				other := &Author{Name: "Other"}
+				repo.CreateAuthor(other)
+				repo.CreateBook(&Book{Title: "Other Book", ISBN: "456", PublishedYear: 2021, AuthorID: other.ID, Genre: GenreFiction, CreatedAt: time.Now()})
+				if err := repo.DeleteAuthor(other.ID, DeleteCascade); err != nil {
+					t.Fatalf("DeleteAuthor() error = %v", err)
+				}
+				books, _ := repo.ListBooks()
+				if len(books) != 1 {
+					t.Errorf("Expected cascade to leave 1 book, got %d", len(books))
+				}
+			})
+
+			t.Run("reviews", func(t *testing.T) {
+				repo := newRepo(t)
+				author := &Author{Name: "Author"}
+				repo.CreateAuthor(author)
+				book := &Book{Title: "Book", ISBN: "123", PublishedYear: 2020, AuthorID: author.ID, Genre: GenreFiction, CreatedAt: time.Now()}
+				repo.CreateBook(book)
+
+				if err := repo.CreateReview(&Review{BookID: "99", UserID: "u", Stars: 3}); !errors.Is(err, ErrBookNotFound) {
+					t.Errorf("Expected ErrBookNotFound, got %v", err)
+				}
+
+				for _, stars := range []int{5, 4} {
+					review := &Review{BookID: book.ID, UserID: "u", Stars: stars, Text: "text", CreatedAt: time.Now()}
+					if err := repo.CreateReview(review); err != nil {
+						t.Fatalf("CreateReview() error = %v", err)
+					}
+				}
+
+				got, _ := repo.GetBook(book.ID)
+				if got.Rating == nil || *got.Rating != 4.5 {
+					t.Errorf("Expected rating 4.5, got %v", got.Rating)
+				}
+				reviews, _ := repo.ListReviewsByBook(book.ID)
+				if len(reviews) != 2 || reviews[0].ID != "1" || reviews[0].Stars != 5 || reviews[1].BookID != book.ID {
+					t.Errorf("Unexpected reviews %v", reviews)
+				}
+
+				repo.DeleteBook(book.ID)
+				if reviews, _ := repo.ListReviewsByBook(book.ID); len(reviews) != 0 {
+					t.Errorf("Expected reviews to be deleted with the book, got %d", len(reviews))
+				}
+			})
+		})
+	}
+}
+
+func TestSQLiteRepositoryMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.db")
+
+	repo, err := NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	repo.CreateAuthor(&Author{Name: "Persisted"})
+	repo.Close()
+
+	// Reopening must not re-apply migrations or lose data
+	repo, err = NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer repo.Close()
+
+	var versions int
+	if err := repo.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(sqliteMigrations) {
+		t.Errorf("Expected %d applied migrations, got %d", len(sqliteMigrations), versions)
+	}
+
+	author, err := repo.GetAuthor("1")
+	if err != nil || author.Name != "Persisted" {
+		t.Errorf("GetAuthor() = %+v, %v", author, err)
+	}
+}
+
+func TestStoreWithSQLiteRepository(t *testing.T) {
+	store := NewStoreWithRepository(newTestSQLiteRepository(t))
+
+	author, err := store.CreateAuthor("Author", nil)
+	if err != nil {
+		t.Fatalf("CreateAuthor() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateBook(fmt.Sprintf("Book %d", i), "123", 2020+i, author.ID, GenreFiction, nil); err != nil {
+			t.Fatalf("CreateBook() error = %v", err)
+		}
+	}
+
+	first := 2
+	conn, err := store.GetBooks(nil, &PaginationInput{First: &first})
+	if err != nil {
+		t.Fatalf("GetBooks() error = %v", err)
+	}
+	if len(conn.Edges) != 2 || !conn.PageInfo.HasNextPage {
+		t.Errorf("Unexpected connection %+v", conn)
+	}
+
+	if _, err := store.UpdateBook("1", "Updated", "", nil, nil); err != nil {
+		t.Fatalf("UpdateBook() error = %v", err)
+	}
+	if book, _ := store.GetBook("1"); book.Title != "Updated" {
+		t.Errorf("Expected updated title, got %v", book.Title)
+	}
+
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatalf("buildSchema() error = %v", err)
+	}
+	result := ExecuteQuery(schema, `{ author(id: "1") { name books { title } } }`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Query errors: %v", result.Errors)
+	}
+	books := result.Data.(map[string]interface{})["author"].(map[string]interface{})["books"].([]interface{})
+	if len(books) != 3 {
+		t.Errorf("Expected 3 books, got %d", len(books))
+	}
+}
+
+func TestAuthorLoaderBatchesAndCaches(t *testing.T) {
+	store := setupTestStore()
+	loader := NewAuthorLoader(store)
+
+	first := loader.Load("1")
+	second := loader.Load("2")
+	duplicate := loader.Load("1")
+	missing := loader.Load("999")
+
+	author, err := first()
+	if err != nil || author.ID != "1" {
+		t.Fatalf("Load(1) = %v, %v", author, err)
+	}
+	if author, err := second(); err != nil || author.ID != "2" {
+		t.Errorf("Load(2) = %v, %v", author, err)
+	}
+	if author, err := duplicate(); err != nil || author.ID != "1" {
+		t.Errorf("Load(1) duplicate = %v, %v", author, err)
+	}
+	if _, err := missing(); err == nil {
+		t.Error("Expected error for missing author")
+	}
+
+	if loader.BatchCount() != 1 {
+		t.Errorf("Expected 1 batched call, got %d", loader.BatchCount())
+	}
+
+	// Cached keys must not trigger another batch
+	if _, err := loader.Load("2")(); err != nil {
+		t.Errorf("cached Load(2) error = %v", err)
+	}
+	if loader.BatchCount() != 1 {
+		t.Errorf("Expected cached lookup to reuse batch, got %d batches", loader.BatchCount())
+	}
+}
+
+func TestGraphQLDataLoaderCollapsesAuthorLookups(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithLoaders(context.Background(), store)
+	result := graphql.Do(graphql.Params{
+		Schema:        schema,
+		RequestString: `{ books { edges { node { title author { id name } } } } }`,
+		Context:       ctx,
+	})
+	if len(result.Errors) > 0 {
+		t.Fatalf("GraphQL query failed: %v", result.Errors)
+	}
+
+	edges := result.Data.(map[string]interface{})["books"].(map[string]interface{})["edges"].([]interface{})
+	for _, edge := range edges {
+		node := edge.(map[string]interface{})["node"].(map[string]interface{})
+		if node["author"].(map[string]interface{})["name"] == "" {
+			t.Error("Expected author name to be resolved")
+		}
+	}
+
+	loaders, _ := LoadersFromContext(ctx)
+	if loaders.Author.BatchCount() != 1 {
+		t.Errorf("Expected 1 batched author lookup for %d books, got %d", len(edges), loaders.Author.BatchCount())
+	}
+}
+
+func TestDataLoaderMiddleware(t *testing.T) {
+	store := NewStore()
+
+	var got *Loaders
+	handler := dataLoaderMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = LoadersFromContext(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/graphql", nil))
+	firstRequest := got
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/graphql", nil))
+
+	if firstRequest == nil || got == nil {
+		t.Fatal("Expected loaders in request context")
+	}
+	if firstRequest == got {
+		t.Error("Expected a fresh loader per request")
+	}
+}
+
+func TestAnalyzeComplexity(t *testing.T) {
+	schema, err := buildSchema(setupTestStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		wantCost  int
+		wantDepth int
+	}{
+		{
+			name:      "single object",
+			query:     `{ book(id: "1") { id title } }`,
+			wantCost:  3,
+			wantDepth: 2,
+		},
+		{
+			name:      "explicit page size",
+			query:     `{ books(pagination: {first: 5}) { edges { node { id } } } }`,
+			wantCost:  16,
+			wantDepth: 4,
+		},
+		{
+			name:      "default page size",
+			query:     `{ books { edges { node { id } } } }`,
+			wantCost:  31,
+			wantDepth: 4,
+		},
+		{
+			name:      "page size from variable",
+			query:     `query($n: Int) { authors(limit: $n) { id } }`,
+			variables: map[string]interface{}{"n": float64(3)},
+			wantCost:  4,
+			wantDepth: 2,
+		},
+		{
+			name:      "nested unpaginated list",
+			query:     `{ authors(limit: 2) { books { id } } }`,
+			wantCost:  23,
+			wantDepth: 3,
+		},
+		{
+			name:      "fragment spread",
+			query:     `query { ...F } fragment F on Query { books(pagination: {first: 2}) { edges { cursor } } }`,
+			wantCost:  5,
+			wantDepth: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost, depth, err := AnalyzeComplexity(schema, tt.query, "", tt.variables, DefaultComplexityLimits())
+			if err != nil {
+				t.Fatalf("AnalyzeComplexity() error = %v", err)
+			}
+			if cost != tt.wantCost {
+				t.Errorf("AnalyzeComplexity() cost = %d, want %d", cost, tt.wantCost)
+			}
+			if depth != tt.wantDepth {
+				t.Errorf("AnalyzeComplexity() depth = %d, want %d", depth, tt.wantDepth)
+			}
+		})
+	}
+}
+
+func TestCheckComplexityLimits(t *testing.T) {
+	schema, err := buildSchema(setupTestStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := ComplexityLimits{MaxCost: 20, MaxDepth: 3, DefaultPageSize: 10}
+
+	if err := CheckComplexity(schema, `{ book(id: "1") { id } }`, "", nil, limits); err != nil {
+		t.Errorf("Expected cheap query to pass, got %v", err)
+	}
+
+	err = CheckComplexity(schema, `{ authors(limit: 100) { id } }`, "", nil, limits)
+	var complexityErr *ComplexityError
+	if !errors.As(err, &complexityErr) {
+		t.Fatalf("Expected ComplexityError for expensive query, got %v", err)
+	}
+	if complexityErr.Cost != 101 {
+		t.Errorf("Expected cost 101, got %d", complexityErr.Cost)
+	}
+
+	if err := CheckComplexity(schema, `{ book(id: "1") { author { books { id } } } }`, "", nil, limits); err == nil {
+		t.Error("Expected depth limit to reject deep query")
+	}
+}
+
+func TestCheckComplexityHugePageSizes(t *testing.T) {
+	schema, err := buildSchema(setupTestStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiplying nested maximum page sizes used to wrap around to a
+	// negative cost that slipped under MaxCost
+	query := `{
+		books(pagination: {first: 2147483647}) {
+			edges { node { reviews(pagination: {first: 2147483647}) { edges { node { id } } } } }
+		}
+	}`
+
+	cost, _, err := AnalyzeComplexity(schema, query, "", nil, DefaultComplexityLimits())
+	if err != nil {
+		t.Fatalf("AnalyzeComplexity() error = %v", err)
+	}
+	if cost != math.MaxInt {
+		t.Errorf("Expected cost to saturate at %d, got %d", math.MaxInt, cost)
+	}
+
+	var complexityErr *ComplexityError
+	if err := CheckComplexity(schema, query, "", nil, DefaultComplexityLimits()); !errors.As(err, &complexityErr) {
+		t.Fatalf("Expected ComplexityError for overflowing query, got %v", err)
+	}
+}
+
+func TestGraphQLHandlerRejectsComplexQuery(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultHandlerConfig()
+	config.Complexity.MaxCost = 10
+	handler := graphqlHandler(schema, config)
+
+	body := `{"query": "{ books(pagination: {first: 50}) { edges { node { id } } } }"}`
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+
+	var response struct {
+		Data   interface{} `json:"data"`
+		Errors []struct {
+			Message    string                 `json:"message"`
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if response.Data != nil {
+		t.Error("Expected query not to execute")
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "QUERY_TOO_COMPLEX" {
+		t.Errorf("Expected QUERY_TOO_COMPLEX error, got %+v", response.Errors)
+	}
+}
+
+func TestResolvePersistedQuery(t *testing.T) {
+	store := NewInMemoryPersistedQueryStore()
+	query := `{ books { edges { node { id } } } }`
+	hash := hashQuery(query)
+
+	hashOnly := func() *graphqlRequest {
+		return &graphqlRequest{
+			Extensions: &requestExtensions{PersistedQuery: &persistedQueryExtension{Version: 1, Sha256Hash: hash}},
+		}
+	}
+
+	// Unknown hash asks the client to register the query
+	if err := resolvePersistedQuery(hashOnly(), store); err != ErrPersistedQueryNotFound {
+		t.Fatalf("Expected ErrPersistedQueryNotFound, got %v", err)
+	}
+
+	// Registration: query together with its hash
+	register := hashOnly()
+	register.Query = query
+	if err := resolvePersistedQuery(register, store); err != nil {
+		t.Fatalf("Registration failed: %v", err)
+	}
+
+	// Subsequent hash-only requests resolve to the stored query
+	req := hashOnly()
+	if err := resolvePersistedQuery(req, store); err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if req.Query != query {
+		t.Errorf("Expected stored query, got %q", req.Query)
+	}
+
+	// A query that does not match its hash is rejected and not stored
+	mismatch := hashOnly()
+	mismatch.Query = `{ authors { id } }`
+	if err := resolvePersistedQuery(mismatch, store); err != ErrPersistedQueryHashMismatch {
+		t.Errorf("Expected ErrPersistedQueryHashMismatch, got %v", err)
+	}
+
+	if err := resolvePersistedQuery(hashOnly(), nil); err != ErrPersistedQueryNotSupported {
+		t.Errorf("Expected ErrPersistedQueryNotSupported without a store, got %v", err)
+	}
+
+	plain := &graphqlRequest{Query: query}
+	if err := resolvePersistedQuery(plain, store); err != nil {
+		t.Errorf("Plain requests should bypass APQ, got %v", err)
+	}
+}
+
+func TestGraphQLHandlerPersistedQueryFlow(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := graphqlHandler(schema, DefaultHandlerConfig())
+	query := `{ book(id: "1") { title } }`
+	extensions := fmt.Sprintf(`{"persistedQuery": {"version": 1, "sha256Hash": "%s"}}`, hashQuery(query))
+
+	post := func(body string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+		var response map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		return response
+	}
+
+	response := post(`{"extensions": ` + extensions + `}`)
+	errs, _ := response["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["message"] != "PersistedQueryNotFound" {
+		t.Fatalf("Expected PersistedQueryNotFound, got %v", response)
+	}
+
+	queryJSON, _ := json.Marshal(query)
+	response = post(`{"query": ` + string(queryJSON) + `, "extensions": ` + extensions + `}`)
+	if response["errors"] != nil {
+		t.Fatalf("Registration request failed: %v", response["errors"])
+	}
+
+	response = post(`{"extensions": ` + extensions + `}`)
+	if response["errors"] != nil {
+		t.Fatalf("Persisted request failed: %v", response["errors"])
+	}
+	book := response["data"].(map[string]interface{})["book"].(map[string]interface{})
+	if book["title"] != "Book 1" {
+		t.Errorf("Expected title 'Book 1', got %v", book["title"])
+	}
+}
+
+func TestGraphQLHandlerGET(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	handler := graphqlHandler(schema, DefaultHandlerConfig())
+
+	params := url.Values{}
+	params.Set("query", `query Book($id: ID!) { book(id: $id) { title } }`)
+	params.Set("variables", `{"id": "2"}`)
+	target := "/graphql?" + params.Encode()
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"title":"Book 2"`) {
+		t.Errorf("Unexpected body %s", rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("Expected public max-age=60, got %q", cc)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected empty 304, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// Signed-in users only get browser caching
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	req = req.WithContext(editorContext())
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if cc := rec.Header().Get("Cache-Control"); cc != "private, max-age=60" {
+		t.Errorf("Expected private max-age=60, got %q", cc)
+	}
+}
+
+func TestGraphQLHandlerGETErrors(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	handler := graphqlHandler(schema, DefaultHandlerConfig())
+
+	get := func(params url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/graphql?"+params.Encode(), nil))
+		return rec
+	}
+
+	rec := get(url.Values{"query": {`mutation { deleteBook(id: "1") }`}})
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("Expected 405 for mutation over GET, got %d", rec.Code)
+	}
+
+	rec = get(url.Values{
+		"query":         {`query A { books { edges { cursor } } } mutation B { deleteBook(id: "1") }`},
+		"operationName": {"B"},
+	})
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for selected mutation, got %d", rec.Code)
+	}
+
+	rec = get(url.Values{"query": {`subscription { bookAdded { id } }`}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for subscription over GET, got %d", rec.Code)
+	}
+
+	rec = get(url.Values{"query": {`{ book(id: "1") { title } }`}, "variables": {`{not json`}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid variables, got %d", rec.Code)
+	}
+
+	rec = get(url.Values{"query": {`{ book(id: "1") { missingField } }`}})
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" || rec.Header().Get("ETag") != "" {
+		t.Errorf("Expected uncached error result, got %d %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPut, "/graphql", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for PUT, got %d", rec.Code)
+	}
+}
+
+func TestGraphQLHandlerGETPersistedQuery(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	config := DefaultHandlerConfig()
+	handler := graphqlHandler(schema, config)
+
+	query := `{ book(id: "3") { title } }`
+	config.PersistedQueries.Put(hashQuery(query), query)
+
+	params := url.Values{}
+	params.Set("extensions", fmt.Sprintf(`{"persistedQuery": {"version": 1, "sha256Hash": "%s"}}`, hashQuery(query)))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/graphql?"+params.Encode(), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"title":"Book 3"`) {
+		t.Errorf("Unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Error("Expected persisted GET query to be cacheable")
+	}
+
+	mutation := `mutation { deleteBook(id: "3") }`
+	config.PersistedQueries.Put(hashQuery(mutation), mutation)
+	params.Set("extensions", fmt.Sprintf(`{"persistedQuery": {"version": 1, "sha256Hash": "%s"}}`, hashQuery(mutation)))
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/graphql?"+params.Encode(), nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for persisted mutation over GET, got %d", rec.Code)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGraphQLHandlerBatch(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	handler := graphqlHandler(schema, DefaultHandlerConfig())
+
+	body := `[
+		{"query": "{ book(id: \"1\") { title } }"},
+		{"query": "query B($id: ID!) { book(id: $id) { title } }", "variables": {"id": "3"}},
+		{"query": "{ book(id: \"1\") { missingField } }"},
+		{"query": "{ authors { name } }"}
+	]`
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var results []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Expected an array of results: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+
+	title := func(result map[string]interface{}) interface{} {
+		return result["data"].(map[string]interface{})["book"].(map[string]interface{})["title"]
+	}
+	if title(results[0]) != "Book 1" || title(results[1]) != "Book 3" {
+		t.Errorf("Results out of order: %v", results)
+	}
+	if results[2]["errors"] == nil {
+		t.Error("Expected the invalid operation to fail on its own")
+	}
+	if authors := results[3]["data"].(map[string]interface{})["authors"].([]interface{}); len(authors) != 2 {
+		t.Errorf("Expected 2 authors, got %v", authors)
+	}
+}
+
+func TestGraphQLHandlerBatchLimits(t *testing.T) {
+	schema, _ := buildSchema(setupTestStore())
+	config := DefaultHandlerConfig()
+	config.MaxBatchSize = 2
+
+	post := func(config HandlerConfig, body string) int {
+		rec := httptest.NewRecorder()
+		graphqlHandler(schema, config)(rec, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	op := `{"query": "{ authors { name } }"}`
+	if code := post(config, "["+op+","+op+"]"); code != http.StatusOK {
+		t.Errorf("Expected batch at the limit to succeed, got %d", code)
+	}
+	if code := post(config, "["+op+","+op+","+op+"]"); code != http.StatusBadRequest {
+		t.Errorf("Expected oversized batch to be rejected, got %d", code)
+	}
+	if code := post(config, "[]"); code != http.StatusBadRequest {
+		t.Errorf("Expected empty batch to be rejected, got %d", code)
+	}
+	if code := post(config, "["+op+", null]"); code != http.StatusBadRequest {
+		t.Errorf("Expected null operation to be rejected, got %d", code)
+	}
+
+	config.MaxBatchSize = 0
+	if code := post(config, "["+op+"]"); code != http.StatusBadRequest {
+		t.Errorf("Expected batching to be disabled, got %d", code)
+	}
+}
+
+func TestExecuteBatchBoundedConcurrency(t *testing.T) {
+	var running, peak int32
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"slow": &graphql.Field{
+				Type: graphql.Int,
+				Args: graphql.FieldConfigArgument{
+					"n": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					current := atomic.AddInt32(&running, 1)
+					defer atomic.AddInt32(&running, -1)
+					for {
+						old := atomic.LoadInt32(&peak)
+						if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					return p.Args["n"], nil
+				},
+			},
+		},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultHandlerConfig()
+	config.BatchConcurrency = 2
+
+	var reqs []*graphqlRequest
+	for i := 0; i < 8; i++ {
+		reqs = append(reqs, &graphqlRequest{Query: fmt.Sprintf("{ slow(n: %d) }", i)})
+	}
+
+	results := executeBatch(context.Background(), schema, config, reqs)
+	for i, result := range results {
+		if got := result.Data.(map[string]interface{})["slow"]; got != i {
+			t.Errorf("Result %d = %v, want %d", i, got, i)
+		}
+	}
+	if peak > 2 {
+		t.Errorf("Expected at most 2 concurrent operations, saw %d", peak)
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	secret := []byte("test-secret")
+
+	token, err := IssueToken(secret, &AuthUser{ID: "42", Username: "ed", Roles: []string{RoleEditor}}, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+
+	user, err := ParseToken(secret, token)
+	if err != nil {
+		t.Fatalf("ParseToken() error = %v", err)
+	}
+	if user.ID != "42" || user.Username != "ed" || !user.HasRole(RoleEditor) {
+		t.Errorf("ParseToken() = %+v", user)
+	}
+
+	if _, err := ParseToken([]byte("other-secret"), token); err == nil {
+		t.Error("Expected error for token signed with another secret")
+	}
+
+	expired, _ := IssueToken(secret, &AuthUser{ID: "42"}, -time.Minute)
+	if _, err := ParseToken(secret, expired); err == nil {
+		t.Error("Expected error for expired token")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	secret := []byte("test-secret")
+
+	var got *AuthUser
+	handler := authMiddleware(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = UserFromContext(r.Context())
+	}))
+
+	// Anonymous requests pass through without a user
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/graphql", nil))
+	if rec.Code != http.StatusOK || got != nil {
+		t.Errorf("Expected anonymous pass-through, got status %d user %v", rec.Code, got)
+	}
+
+	token, _ := IssueToken(secret, &AuthUser{ID: "7", Roles: []string{RoleEditor}}, time.Hour)
+	req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got == nil || got.ID != "7" {
+		t.Errorf("Expected user 7 in context, got %v", got)
+	}
+
+	for _, header := range []string{"Bearer not-a-jwt", "Token " + token} {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", header, rec.Code)
+		}
+	}
+}
+
+func TestGraphQLMutationRoleGuards(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutations := map[string]string{
+		"deleteBook":   `mutation { deleteBook(id: "1") }`,
+		"updateBook":   `mutation { updateBook(id: "1", input: {title: "Defaced"}) { id } }`,
+		"createAuthor": `mutation { createAuthor(input: {name: "Intruder"}) { id } }`,
+		"updateAuthor": `mutation { updateAuthor(id: "1", input: {name: "Defaced"}) { id } }`,
+		"deleteAuthor": `mutation { deleteAuthor(id: "1", onDelete: CASCADE) }`,
+	}
+
+	callers := []struct {
+		name     string
+		ctx      context.Context
+		wantCode string
+	}{
+		{"anonymous", context.Background(), "UNAUTHENTICATED"},
+		{"reader", WithUser(context.Background(), &AuthUser{ID: "2", Roles: []string{"reader"}}), "FORBIDDEN"},
+	}
+
+	for field, mutation := range mutations {
+		for _, caller := range callers {
+			t.Run(field+"/"+caller.name, func(t *testing.T) {
+				result := ExecuteQueryWithContext(caller.ctx, schema, mutation, nil)
+				if len(result.Errors) != 1 {
+					t.Fatalf("Expected 1 error, got %v", result.Errors)
+				}
+				if code := result.Errors[0].Extensions["code"]; code != caller.wantCode {
+					t.Errorf("Expected code %s, got %v", caller.wantCode, code)
+				}
+			})
+		}
+	}
+
+	for _, id := range []string{"1", "2"} {
+		book, err := store.GetBook(id)
+		if err != nil {
+			t.Errorf("Guarded mutations should not have deleted book %s", id)
+		} else if book.Title == "Defaced" {
+			t.Errorf("Guarded mutation should not have updated book %s", id)
+		}
+	}
+	if author, err := store.GetAuthor("1"); err != nil || author.Name != "Test Author 1" {
+		t.Errorf("Guarded mutations should not have changed author 1, got %v, %v", author, err)
+	}
+	if authors, _ := store.GetAuthors(nil); len(authors) != 2 {
+		t.Errorf("Guarded createAuthor should not have added an author, got %d authors", len(authors))
+	}
+
+	result := ExecuteQueryWithContext(editorContext(), schema, mutations["deleteBook"], nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Editor mutation failed: %v", result.Errors)
+	}
+}
+
+func TestBookPubSub(t *testing.T) {
+	store := setupTestStore()
+
+	added, unsubscribe := store.Subscribe(BookAdded)
+	defer unsubscribe()
+
+	updated, unsubscribeUpdated := store.Subscribe(BookUpdated)
+	defer unsubscribeUpdated()
+
+	book, err := store.CreateBook("Realtime Book", "ISBN-RT", 2022, "1", GenreMystery, nil)
+	if err != nil {
+		t.Fatalf("CreateBook() error = %v", err)
+	}
+
+	select {
+	case event := <-added:
+		if event.ID != book.ID {
+			t.Errorf("bookAdded event ID = %v, want %v", event.ID, book.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for bookAdded event")
+	}
+
+	if _, err := store.UpdateBook(book.ID, "Renamed", "", nil, nil); err != nil {
+		t.Fatalf("UpdateBook() error = %v", err)
+	}
+
+	select {
+	case event := <-updated:
+		if event.Title != "Renamed" {
+			t.Errorf("bookUpdated event title = %v, want %v", event.Title, "Renamed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for bookUpdated event")
+	}
+
+	unsubscribe()
+	if store.events.SubscriberCount(BookAdded) != 0 {
+		t.Error("Expected no bookAdded subscribers after unsubscribe")
+	}
+}
+
+func TestGraphQLSubscriptionBookAdded(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := graphql.Subscribe(graphql.Params{
+		Schema:        schema,
+		RequestString: `subscription { bookAdded { title author { name } } }`,
+		Context:       ctx,
+	})
+
+	waitForSubscribers(t, store, BookAdded, 1)
+	store.CreateBook("Subscribed Book", "ISBN-SUB", 2023, "1", GenreFiction, nil)
+
+	select {
+	case result := <-results:
+		if len(result.Errors) > 0 {
+			t.Fatalf("Subscription failed: %v", result.Errors)
+		}
+		data := result.Data.(map[string]interface{})
+		book := data["bookAdded"].(map[string]interface{})
+		if book["title"] != "Subscribed Book" {
+			t.Errorf("Expected title 'Subscribed Book', got %v", book["title"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for subscription result")
+	}
+}
+
+func TestGraphQLWebSocketSubscription(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(graphqlWSHandler(schema, DefaultComplexityLimits()))
+	defer server.Close()
+
+	client := dialTestWebSocket(t, server.URL, graphqlWSProtocol)
+	defer client.conn.Close()
+
+	client.send(t, graphqlWSMessage{Type: gqlConnectionInit})
+	if msg := client.receive(t); msg.Type != gqlConnectionAck {
+		t.Fatalf("Expected connection_ack, got %v", msg.Type)
+	}
+
+	payload, _ := json.Marshal(graphqlWSSubscribePayload{
+		Query: `subscription { bookUpdated { id title } }`,
+	})
+	client.send(t, graphqlWSMessage{ID: "1", Type: gqlSubscribe, Payload: payload})
+
+	waitForSubscribers(t, store, BookUpdated, 1)
+	store.UpdateBook("2", "Live Update", "", nil, nil)
+
+	msg := client.receive(t)
+	if msg.Type != gqlNext || msg.ID != "1" {
+		t.Fatalf("Expected next message for id 1, got %+v", msg)
+	}
+
+	var result struct {
+		Data struct {
+			BookUpdated struct {
+				ID    string `json:"id"`
+				Title string `json:"title"`
+			} `json:"bookUpdated"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Payload, &result); err != nil {
+		t.Fatalf("Invalid next payload: %v", err)
+	}
+	if result.Data.BookUpdated.Title != "Live Update" {
+		t.Errorf("Expected title 'Live Update', got %v", result.Data.BookUpdated.Title)
+	}
+
+	client.send(t, graphqlWSMessage{ID: "1", Type: gqlComplete})
+	waitForSubscribers(t, store, BookUpdated, 0)
+}
+
+func TestGraphQLWebSocketResubscribeSameID(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(graphqlWSHandler(schema, DefaultComplexityLimits()))
+	defer server.Close()
+
+	client := dialTestWebSocket(t, server.URL, graphqlWSProtocol)
+	defer client.conn.Close()
+
+	client.send(t, graphqlWSMessage{Type: gqlConnectionInit})
+	if msg := client.receive(t); msg.Type != gqlConnectionAck {
+		t.Fatalf("Expected connection_ack, got %v", msg.Type)
+	}
+
+	payload, _ := json.Marshal(graphqlWSSubscribePayload{
+		Query: `subscription { bookUpdated { id title } }`,
+	})
+
+	// Complete and immediately reuse the id, before the first
+	// subscription's goroutine has finished cleaning up
+	for i := 0; i < 20; i++ {
+		client.send(t, graphqlWSMessage{ID: "1", Type: gqlSubscribe, Payload: payload})
+		client.send(t, graphqlWSMessage{ID: "1", Type: gqlComplete})
+	}
+	client.send(t, graphqlWSMessage{ID: "1", Type: gqlSubscribe, Payload: payload})
+
+	waitForSubscribers(t, store, BookUpdated, 1)
+	store.UpdateBook("2", "After Resubscribe", "", nil, nil)
+
+	msg := client.receive(t)
+	if msg.Type != gqlNext || msg.ID != "1" {
+		t.Fatalf("Expected next message for id 1, got %+v", msg)
+	}
+	if !strings.Contains(string(msg.Payload), "After Resubscribe") {
+		t.Errorf("Expected update in payload, got %s", msg.Payload)
+	}
+}
+
+func TestGraphQLWebSocketRejectsComplexSubscription(t *testing.T) {
+	store := setupTestStore()
+	schema, err := buildSchema(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := DefaultComplexityLimits()
+	limits.MaxCost = 2
+	server := httptest.NewServer(graphqlWSHandler(schema, limits))
+	defer server.Close()
+
+	client := dialTestWebSocket(t, server.URL, graphqlWSProtocol)
+	defer client.conn.Close()
+
+	client.send(t, graphqlWSMessage{Type: gqlConnectionInit})
+	if msg := client.receive(t); msg.Type != gqlConnectionAck {
+		t.Fatalf("Expected connection_ack, got %v", msg.Type)
+	}
+
+	payload, _ := json.Marshal(graphqlWSSubscribePayload{
+		Query: `subscription { bookUpdated { id title } }`,
+	})
+	client.send(t, graphqlWSMessage{ID: "1", Type: gqlSubscribe, Payload: payload})
+
+	msg := client.receive(t)
+	if msg.Type != gqlError || msg.ID != "1" {
+		t.Fatalf("Expected error message for id 1, got %+v", msg)
+	}
+	if !strings.Contains(string(msg.Payload), "QUERY_TOO_COMPLEX") {
+		t.Errorf("Expected QUERY_TOO_COMPLEX in payload, got %s", msg.Payload)
+	}
+	if n := store.events.SubscriberCount(BookUpdated); n != 0 {
+		t.Errorf("Expected no bookUpdated subscribers, got %d", n)
+	}
+}
+
+func TestGraphQLWebSocketRejectsSubscribeBeforeInit(t *testing.T) {
+	schema, err := buildSchema(NewStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(graphqlWSHandler(schema, DefaultComplexityLimits()))
+	defer server.Close()
+
+	client := dialTestWebSocket(t, server.URL, graphqlWSProtocol)
+	defer client.conn.Close()
+
+	payload, _ := json.Marshal(graphqlWSSubscribePayload{Query: `subscription { bookAdded { id } }`})
+	client.send(t, graphqlWSMessage{ID: "1", Type: gqlSubscribe, Payload: payload})
+
+	opcode, data := client.readFrame(t)
+	if opcode != wsOpClose {
+		t.Fatalf("Expected close frame, got opcode %d", opcode)
+	}
+	if code := binary.BigEndian.Uint16(data); code != wsCloseUnauthorized {
+		t.Errorf("Expected close code %d, got %d", wsCloseUnauthorized, code)
+	}
+}
+
+func TestGraphQLWebSocketRequiresProtocol(t *testing.T) {
+	schema, _ := buildSchema(NewStore())
+	handler := graphqlWSHandler(schema, DefaultComplexityLimits())
+
+	req := httptest.NewRequest(http.MethodGet, "/graphql/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without subprotocol, got %d", rec.Code)
+	}
+}
+
+func waitForSubscribers(t *testing.T, store *Store, event BookEventType, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for store.events.SubscriberCount(event) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d %s subscribers, got %d", want, event, store.events.SubscriberCount(event))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testWSClient is a minimal WebSocket client for exercising the server
+type testWSClient struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func dialTestWebSocket(t *testing.T, serverURL, protocol string) *testWSClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, _ := http.NewRequest(http.MethodGet, serverURL+"/graphql/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("handshake write failed: %v", err)
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	resp, err := http.ReadResponse(rw.Reader, req)
+	if err != nil {
+		t.Fatalf("handshake read failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testWSClient{conn: conn, rw: rw}
+}
+
+func (c *testWSClient) send(t *testing.T, msg graphqlWSMessage) {
+	t.Helper()
+
+	data, _ := json.Marshal(msg)
+	mask := []byte{1, 2, 3, 4}
+
+	frame := []byte{0x80 | wsOpText}
+	if len(data) < 126 {
+		frame = append(frame, 0x80|byte(len(data)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(data)>>8), byte(len(data)))
+	}
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	if _, err := c.rw.Write(frame); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	c.rw.Flush()
+}
+
+func (c *testWSClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		io.ReadFull(c.rw, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		io.ReadFull(c.rw, ext)
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func (c *testWSClient) receive(t *testing.T) graphqlWSMessage {
+	t.Helper()
+
+	opcode, data := c.readFrame(t)
+	if opcode != wsOpText {
+		t.Fatalf("Expected text frame, got opcode %d (%s)", opcode, data)
+	}
+
+	var msg graphqlWSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	return msg
+}
+
+func BenchmarkGetBooks(b *testing.B) {
+	store := setupTestStore()
+
+	// Add more books
+	author, _ := store.GetAuthor("1")
+	for i := 0; i < 100; i++ {
+		rating := 4.0
+		store.CreateBook("Book", "ISBN", 2020, author.ID, GenreFiction, &rating)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.GetBooks(nil, nil)
+	}
+}
+
+func BenchmarkGraphQLQuery(b *testing.B) {
 	store := setupTestStore()
 	schema, _ := buildSchema(store)
 
@@ -726,7 +3134,41 @@ func BenchmarkGraphQLQuery(b *testing.B) {
 	}
 }
 
+func benchmarkAuthorResolution(b *testing.B, withLoaders bool) {
+	store := NewStore()
+	for i := 0; i < 10; i++ {
+		author, _ := store.CreateAuthor(fmt.Sprintf("Author %d", i), nil)
+		for j := 0; j < 10; j++ {
+			store.CreateBook(fmt.Sprintf("Book %d-%d", i, j), "ISBN", 2020, author.ID, GenreFiction, nil)
+		}
+	}
+	schema, _ := buildSchema(store)
+
+	query := `{ books(pagination: {first: 100}) { edges { node { title author { name } } } } }`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := context.Background()
+		if withLoaders {
+			ctx = WithLoaders(ctx, store)
+		}
+		graphql.Do(graphql.Params{Schema: schema, RequestString: query, Context: ctx})
+	}
+}
+
+func BenchmarkAuthorResolutionWithoutDataLoader(b *testing.B) {
+	benchmarkAuthorResolution(b, false)
+}
+
+func BenchmarkAuthorResolutionWithDataLoader(b *testing.B) {
+	benchmarkAuthorResolution(b, true)
+}
+
 // Helper functions
+func editorContext() context.Context {
+	return WithUser(context.Background(), &AuthUser{ID: "editor-1", Username: "editor", Roles: []string{RoleEditor}})
+}
+
 func floatPtr(f float64) *float64 {
 	return &f
 }
@@ -1,10 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,85 +35,132 @@ type TenantContext struct {
 	RequestID     string
 	Timestamp     time.Time
 	Metadata      map[string]interface{}
+	Impersonation *Impersonation // set for support sessions from StartImpersonation
 }
 
 // Tenant represents a tenant in the system
 type Tenant struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Plan          string `json:"plan"`
-	Status        string `json:"status"` // active, suspended, deleted
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
-	Settings      map[string]interface{} `json:"settings"`
-	DatabaseURL   string `json:"database_url,omitempty"`
-	SchemaName    string `json:"schema_name,omitempty"`
+	ID              string                 `json:"id"`
+	Name            string                 `json:"name"`
+	Plan            string                 `json:"plan"`
+	Status          string                 `json:"status"` // active, suspended, deleted
+	CreatedAt       time.Time              `json:"created_at"`
+	UpdatedAt       time.Time              `json:"updated_at"`
+	Settings        map[string]interface{} `json:"settings"`
+	DatabaseURL     string                 `json:"database_url,omitempty"`
+	SchemaName      string                 `json:"schema_name,omitempty"`
+	DeletedAt       time.Time              `json:"deleted_at,omitzero"`
+	ParentID        string                 `json:"parent_id,omitempty"`
+	PooledQuota     bool                   `json:"pooled_quota,omitempty"`      // draws on the parent's quota
+	VisibleToParent bool                   `json:"visible_to_parent,omitempty"` // parent may read resources
 }
 
 // TenantResource represents any resource in a multi-tenant system
 type TenantResource struct {
-	ID        string    `json:"id"`
-	TenantID  string    `json:"tenant_id"`
-	Name      string    `json:"name"`
+	ID        string                 `json:"id"`
+	TenantID  string                 `json:"tenant_id"`
+	Name      string                 `json:"name"`
 	Data      map[string]interface{} `json:"data"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Encrypted *EncryptedData         `json:"encrypted,omitempty"` // Data sealed at rest when a KeyManager is set
 }
 
 // ========== Resource Quota Models ==========
 
 // ResourceQuota defines resource limits for a tenant
 type ResourceQuota struct {
-	TenantID          string            `json:"tenant_id"`
-	MaxUsers          int               `json:"max_users"`
-	MaxAPIRequests    int               `json:"max_api_requests"`
-	MaxStorage        int64             `json:"max_storage"`
-	MaxDatabases      int               `json:"max_databases"`
-	CurrentUsers      int               `json:"current_users"`
-	CurrentRequests   int               `json:"current_requests"`
-	CurrentStorage    int64             `json:"current_storage"`
-	CurrentDatabases  int               `json:"current_databases"`
-	ResetTime         time.Time         `json:"reset_time"`
-	Mu                sync.RWMutex      `json:"-"`
+	TenantID         string           `json:"tenant_id"`
+	MaxUsers         int              `json:"max_users"`
+	MaxAPIRequests   int              `json:"max_api_requests"`
+	MaxStorage       int64            `json:"max_storage"`
+	MaxDatabases     int              `json:"max_databases"`
+	CurrentUsers     int              `json:"current_users"`
+	CurrentRequests  int              `json:"current_requests"`
+	CurrentStorage   int64            `json:"current_storage"`
+	CurrentDatabases int              `json:"current_databases"`
+	ResetTime        time.Time        `json:"reset_time"`
+	GraceUntil       time.Time        `json:"grace_until,omitempty"`
+	Mu               sync.RWMutex     `json:"-"`
+	exceeded         map[string]bool  // usage types that hit their limit this window
+	reserved         map[string]int64 // amounts held by uncommitted reservations
 }
 
 // ========== Tenant Manager ==========
 
 // TenantManager manages multi-tenant operations
 type TenantManager struct {
-	tenants        map[string]*Tenant
-	tenantsMu      sync.RWMutex
-	resources      map[string][]*TenantResource
-	resourcesMu    sync.RWMutex
-	quotas         map[string]*ResourceQuota
-	quotasMu       sync.RWMutex
-	auditLog       []*AuditLogEntry
-	auditLogMu     sync.RWMutex
-	tenantRoutes   map[string]string // tenant -> database URL
-	routesMu       sync.RWMutex
-	isolationMode  string // "database", "schema", "row-level"
+	tenants             map[string]*Tenant
+	tenantsMu           sync.RWMutex
+	resources           map[string][]*TenantResource
+	resourcesMu         sync.RWMutex
+	quotas              map[string]*ResourceQuota
+	quotasMu            sync.RWMutex
+	auditLog            map[string][]*AuditLogEntry // tenant -> entries, oldest first
+	auditLogMu          sync.RWMutex
+	tenantRoutes        map[string]string // tenant -> database URL
+	routesMu            sync.RWMutex
+	isolationMode       string // "database", "schema", "row-level"
+	limiter             *RateLimiter
+	usage               map[string][]*UsageBucket
+	usageMu             sync.RWMutex
+	now                 func() time.Time
+	downgradePolicy     DowngradePolicy
+	planHooks           []PlanChangeHook
+	planMu              sync.RWMutex
+	tenantRepo          TenantRepository
+	resourceRepo        ResourceRepository
+	auditSeq            uint64
+	auditRetention      AuditRetention
+	grants              map[string][]*ResourceGrant // resource -> grants
+	grantsMu            sync.RWMutex
+	events              *EventBus
+	keyManager          *KeyManager
+	impersonationPolicy ImpersonationPolicy
+	impersonations      map[string]*Impersonation
+	impersonationMu     sync.RWMutex
+	noisyPolicy         NoisyNeighborPolicy
+	load                map[string][]*loadBucket // tenant -> per-second load, oldest first
+	throttles           map[string]*Throttle
+	throttleExempt      map[string]time.Time // tenant -> operator exemption expiry
+	noisyMu             sync.Mutex
 }
 
 // AuditLogEntry represents an audit log entry
 type AuditLogEntry struct {
-	Timestamp   time.Time              `json:"timestamp"`
-	TenantID    string                 `json:"tenant_id"`
-	UserID      string                 `json:"user_id"`
-	Action      string                 `json:"action"`
-	ResourceID  string                 `json:"resource_id"`
-	Details     map[string]interface{} `json:"details"`
+	Timestamp       time.Time              `json:"timestamp"`
+	TenantID        string                 `json:"tenant_id"`
+	UserID          string                 `json:"user_id"`
+	Action          string                 `json:"action"`
+	ResourceID      string                 `json:"resource_id"`
+	Details         map[string]interface{} `json:"details"`
+	Seq             uint64                 `json:"seq"`
+	ImpersonatorID  string                 `json:"impersonator_id,omitempty"` // admin acting as UserID
+	ImpersonationID string                 `json:"impersonation_id,omitempty"`
 }
 
 // NewTenantManager creates a new tenant manager
 func NewTenantManager(isolationMode string) *TenantManager {
-	return &TenantManager{
-		tenants:       make(map[string]*Tenant),
-		resources:     make(map[string][]*TenantResource),
-		quotas:        make(map[string]*ResourceQuota),
-		auditLog:      []*AuditLogEntry{},
-		tenantRoutes:  make(map[string]string),
-		isolationMode: isolationMode,
+	tm := &TenantManager{
+		tenants:         make(map[string]*Tenant),
+		resources:       make(map[string][]*TenantResource),
+		quotas:          make(map[string]*ResourceQuota),
+		auditLog:        make(map[string][]*AuditLogEntry),
+		tenantRoutes:    make(map[string]string),
+		isolationMode:   isolationMode,
+		limiter:         NewRateLimiter(),
+		usage:           make(map[string][]*UsageBucket),
+		now:             time.Now,
+		downgradePolicy: DowngradePolicy{Mode: "reject"},
+		grants:          make(map[string][]*ResourceGrant),
+		events:          NewEventBus(),
+		impersonations:  make(map[string]*Impersonation),
+		load:            make(map[string][]*loadBucket),
+		throttles:       make(map[string]*Throttle),
+		throttleExempt:  make(map[string]time.Time),
 	}
+	tm.SetNoisyNeighborPolicy(NoisyNeighborPolicy{})
+	return tm
 }
 
 // ========== Tenant Operations ==========
@@ -139,6 +201,9 @@ func (tm *TenantManager) CreateTenant(name, plan string, settings map[string]int
 		tenant.DatabaseURL = "postgres://localhost/shared_db"
 	}
 
+	if err := tm.persistTenant(tenant); err != nil {
+		return nil, err
+	}
 	tm.tenants[tenantID] = tenant
 
 	// Create quota
@@ -146,6 +211,7 @@ func (tm *TenantManager) CreateTenant(name, plan string, settings map[string]int
 
 	// Log audit
 	tm.logAudit(tenantID, "", "CREATE_TENANT", tenantID, map[string]interface{}{"plan": plan})
+	tm.publish(EventTenantCreated, tenantID, "", map[string]interface{}{"name": name, "plan": plan})
 
 	return tenant, nil
 }
@@ -173,8 +239,13 @@ func (tm *TenantManager) UpdateTenant(tenantID string, settings map[string]inter
 		return errors.New("tenant not found")
 	}
 
-	tenant.Settings = settings
-	tenant.UpdatedAt = time.Now()
+	updated := *tenant
+	updated.Settings = settings
+	updated.UpdatedAt = time.Now()
+	if err := tm.persistTenant(&updated); err != nil {
+		return err
+	}
+	*tenant = updated
 
 	tm.logAudit(tenantID, "", "UPDATE_TENANT", tenantID, map[string]interface{}{"settings": settings})
 
@@ -191,10 +262,16 @@ func (tm *TenantManager) SuspendTenant(tenantID, reason string) error {
 		return errors.New("tenant not found")
 	}
 
-	tenant.Status = "suspended"
-	tenant.UpdatedAt = time.Now()
+	updated := *tenant
+	updated.Status = "suspended"
+	updated.UpdatedAt = time.Now()
+	if err := tm.persistTenant(&updated); err != nil {
+		return err
+	}
+	*tenant = updated
 
 	tm.logAudit(tenantID, "", "SUSPEND_TENANT", tenantID, map[string]interface{}{"reason": reason})
+	tm.publish(EventTenantSuspended, tenantID, "", map[string]interface{}{"reason": reason})
 
 	return nil
 }
@@ -209,8 +286,14 @@ func (tm *TenantManager) DeleteTenant(tenantID string) error {
 		return errors.New("tenant not found")
 	}
 
-	tenant.Status = "deleted"
-	tenant.UpdatedAt = time.Now()
+	updated := *tenant
+	updated.Status = "deleted"
+	updated.UpdatedAt = time.Now()
+	updated.DeletedAt = tm.now()
+	if err := tm.persistTenant(&updated); err != nil {
+		return err
+	}
+	*tenant = updated
 
 	tm.logAudit(tenantID, "", "DELETE_TENANT", tenantID, nil)
 
@@ -221,18 +304,36 @@ func (tm *TenantManager) DeleteTenant(tenantID string) error {
 
 // CreateResource creates a resource for a tenant
 func (tm *TenantManager) CreateResource(tenantID, resourceName string, data map[string]interface{}) (*TenantResource, error) {
+	return tm.createResource(&TenantContext{TenantID: tenantID}, resourceName, data)
+}
+
+// CreateResourceContext creates a resource in ctx's tenant, auditing it as
+// the context's user and flagging it if the context is an impersonation
+func (tm *TenantManager) CreateResourceContext(ctx context.Context, resourceName string, data map[string]interface{}) (*TenantResource, error) {
+	tenantCtx, err := GetTenantContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.checkImpersonation(tenantCtx); err != nil {
+		return nil, err
+	}
+	return tm.createResource(tenantCtx, resourceName, data)
+}
+
+func (tm *TenantManager) createResource(tenantCtx *TenantContext, resourceName string, data map[string]interface{}) (*TenantResource, error) {
+	tenantID := tenantCtx.TenantID
+
 	// Validate tenant exists
 	if _, err := tm.GetTenant(tenantID); err != nil {
 		return nil, err
 	}
 
-	// Check quota
-	if !tm.canAllocateResource(tenantID) {
-		return nil, errors.New("quota exceeded")
+	// Hold a resource slot so concurrent creations cannot overshoot the quota
+	reservation, err := tm.ReserveQuota(tenantID, "resource", 1)
+	if err != nil {
+		return nil, err
 	}
-
-	tm.resourcesMu.Lock()
-	defer tm.resourcesMu.Unlock()
+	defer reservation.Release()
 
 	resource := &TenantResource{
 		ID:        generateResourceID(),
@@ -243,15 +344,41 @@ func (tm *TenantManager) CreateResource(tenantID, resourceName string, data map[
 		UpdatedAt: time.Now(),
 	}
 
-	tm.resources[tenantID] = append(tm.resources[tenantID], resource)
+	stored := resource
+	if tm.keyManager != nil {
+		if stored, err = tm.sealResource(resource); err != nil {
+			return nil, err
+		}
+	}
+
+	// The reservation is committed after resourcesMu is released, since
+	// ReserveQuota counts resources while holding the quota lock
+	tm.resourcesMu.Lock()
+	if err := tm.persistResource(stored); err != nil {
+		tm.resourcesMu.Unlock()
+		return nil, err
+	}
+	tm.resources[tenantID] = append(tm.resources[tenantID], stored)
+	tm.resourcesMu.Unlock()
+	reservation.Commit()
 
-	tm.logAudit(tenantID, "", "CREATE_RESOURCE", resource.ID, map[string]interface{}{"name": resourceName})
+	tm.auditContext(tenantCtx, tenantID, "CREATE_RESOURCE", resource.ID, map[string]interface{}{"name": resourceName})
+	tm.publish(EventResourceCreated, tenantID, resource.ID, map[string]interface{}{"name": resourceName})
 
 	return resource, nil
 }
 
 // GetResource retrieves a resource with isolation validation
 func (tm *TenantManager) GetResource(tenantID, resourceID string) (*TenantResource, error) {
+	resource, err := tm.findResource(tenantID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	return tm.readResource(resource)
+}
+
+// findResource returns the stored resource, which may be encrypted
+func (tm *TenantManager) findResource(tenantID, resourceID string) (*TenantResource, error) {
 	tm.resourcesMu.RLock()
 	defer tm.resourcesMu.RUnlock()
 
@@ -280,17 +407,47 @@ func (tm *TenantManager) ListResources(tenantID string) ([]*TenantResource, erro
 	}
 
 	tm.resourcesMu.RLock()
-	defer tm.resourcesMu.RUnlock()
-
 	resources := tm.resources[tenantID]
 	result := make([]*TenantResource, len(resources))
 	copy(result, resources)
+	tm.resourcesMu.RUnlock()
+
+	return tm.readResources(result)
+}
 
-	return result, nil
+// readResources applies readResource to each resource in place
+func (tm *TenantManager) readResources(resources []*TenantResource) ([]*TenantResource, error) {
+	for i, resource := range resources {
+		readable, err := tm.readResource(resource)
+		if err != nil {
+			return nil, err
+		}
+		resources[i] = readable
+	}
+	return resources, nil
 }
 
 // DeleteResource deletes a resource
 func (tm *TenantManager) DeleteResource(tenantID, resourceID string) error {
+	return tm.deleteResource(&TenantContext{TenantID: tenantID}, resourceID)
+}
+
+// DeleteResourceContext deletes a resource in ctx's tenant, auditing it the
+// same way as CreateResourceContext
+func (tm *TenantManager) DeleteResourceContext(ctx context.Context, resourceID string) error {
+	tenantCtx, err := GetTenantContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := tm.checkImpersonation(tenantCtx); err != nil {
+		return err
+	}
+	return tm.deleteResource(tenantCtx, resourceID)
+}
+
+func (tm *TenantManager) deleteResource(tenantCtx *TenantContext, resourceID string) error {
+	tenantID := tenantCtx.TenantID
+
 	tm.resourcesMu.Lock()
 	defer tm.resourcesMu.Unlock()
 
@@ -304,8 +461,11 @@ func (tm *TenantManager) DeleteResource(tenantID, resourceID string) error {
 			if resource.TenantID != tenantID {
 				return errors.New("access denied: resource belongs to different tenant")
 			}
+			if err := tm.removeResource(tenantID, resourceID); err != nil {
+				return err
+			}
 			tm.resources[tenantID] = append(resources[:i], resources[i+1:]...)
-			tm.logAudit(tenantID, "", "DELETE_RESOURCE", resourceID, nil)
+			tm.auditContext(tenantCtx, tenantID, "DELETE_RESOURCE", resourceID, nil)
 			return nil
 		}
 	}
@@ -317,11 +477,19 @@ func (tm *TenantManager) DeleteResource(tenantID, resourceID string) error {
 
 func (tm *TenantManager) createQuotaForTenant(tenantID, plan string) {
 	quota := &ResourceQuota{
-		TenantID:       tenantID,
-		ResetTime:      time.Now().Add(24 * time.Hour),
+		TenantID:  tenantID,
+		ResetTime: tm.now().Add(QuotaResetWindow),
 	}
 
-	// Set quotas based on plan
+	applyPlanLimits(quota, plan)
+
+	tm.quotasMu.Lock()
+	tm.quotas[tenantID] = quota
+	tm.quotasMu.Unlock()
+}
+
+// applyPlanLimits sets the quota limits for a plan
+func applyPlanLimits(quota *ResourceQuota, plan string) {
 	switch plan {
 	case "free":
 		quota.MaxUsers = 5
@@ -339,16 +507,13 @@ func (tm *TenantManager) createQuotaForTenant(tenantID, plan string) {
 		quota.MaxStorage = 1000 * 1024 * 1024 * 1024 // 1TB
 		quota.MaxDatabases = 100
 	}
-
-	tm.quotasMu.Lock()
-	tm.quotas[tenantID] = quota
-	tm.quotasMu.Unlock()
 }
 
 // canAllocateResource checks if a tenant can allocate more resources
 func (tm *TenantManager) canAllocateResource(tenantID string) bool {
+	owner := tm.quotaOwner(tenantID)
 	tm.quotasMu.RLock()
-	quota, exists := tm.quotas[tenantID]
+	quota, exists := tm.quotas[owner]
 	tm.quotasMu.RUnlock()
 
 	if !exists {
@@ -359,7 +524,7 @@ func (tm *TenantManager) canAllocateResource(tenantID string) bool {
 	defer quota.Mu.RUnlock()
 
 	// Simple check - in production, use actual resource tracking
-	resourceCount := tm.getResourceCount(tenantID)
+	resourceCount := tm.poolResourceCount(owner) + int(quota.reserved["resource"])
 	return resourceCount < quota.MaxUsers
 }
 
@@ -385,8 +550,9 @@ func (tm *TenantManager) GetQuota(tenantID string) (*ResourceQuota, error) {
 
 // IncrementQuotaUsage increments quota usage
 func (tm *TenantManager) IncrementQuotaUsage(tenantID string, usageType string) error {
+	owner := tm.quotaOwner(tenantID)
 	tm.quotasMu.RLock()
-	quota, exists := tm.quotas[tenantID]
+	quota, exists := tm.quotas[owner]
 	tm.quotasMu.RUnlock()
 
 	if !exists {
@@ -399,204 +565,3567 @@ func (tm *TenantManager) IncrementQuotaUsage(tenantID string, usageType string)
 	switch usageType {
 	case "api_request":
 		quota.CurrentRequests++
-		if quota.CurrentRequests > quota.MaxAPIRequests {
+		if quota.CurrentRequests+int(quota.reserved[usageType]) > quota.MaxAPIRequests {
 			quota.CurrentRequests--
+			tm.quotaExceeded(quota, usageType)
 			return errors.New("API request quota exceeded")
 		}
 	case "user":
 		quota.CurrentUsers++
-		if quota.CurrentUsers > quota.MaxUsers {
+		if quota.CurrentUsers+int(quota.reserved[usageType]) > quota.MaxUsers {
 			quota.CurrentUsers--
+			tm.quotaExceeded(quota, usageType)
 			return errors.New("user quota exceeded")
 		}
 	}
+	tm.recordUsage(tenantID, usageType, 1)
 
 	return nil
 }
 
-// ========== Tenant Context Management ==========
-
-// ContextKey type for context values
-type ContextKey string
+// ========== Quota Reservations ==========
 
-const TenantContextKey ContextKey = "tenant_context"
+// QuotaReservation holds quota for an operation that has not completed yet.
+// Reserved amounts count against the limit until the reservation is
+// committed or released.
+type QuotaReservation struct {
+	TenantID  string
+	UsageType string
+	Amount    int64
 
-// WithTenantContext adds tenant context to a request context
-func WithTenantContext(ctx context.Context, tenantCtx *TenantContext) context.Context {
-	return context.WithValue(ctx, TenantContextKey, tenantCtx)
+	tm    *TenantManager
+	quota *ResourceQuota
+	done  bool // guarded by quota.Mu
 }
 
-// GetTenantContext extracts tenant context from request context
-func GetTenantContext(ctx context.Context) (*TenantContext, error) {
-	tenantCtx, ok := ctx.Value(TenantContextKey).(*TenantContext)
-	if !ok {
-		return nil, errors.New("tenant context not found")
+// ReserveQuota atomically checks that amount more of usageType fits within
+// the tenant's quota, counting other outstanding reservations, and holds it.
+// usageType is one of "api_request", "user", "storage" or "resource".
+func (tm *TenantManager) ReserveQuota(tenantID, usageType string, amount int64) (*QuotaReservation, error) {
+	if amount <= 0 {
+		return nil, errors.New("reservation amount must be positive")
 	}
-	return tenantCtx, nil
-}
 
-// ValidateRequestTenancy validates that request is for correct tenant
-func (tm *TenantManager) ValidateRequestTenancy(ctx context.Context, requestedTenantID string) error {
-	tenantCtx, err := GetTenantContext(ctx)
-	if err != nil {
-		return errors.New("no tenant context in request")
+	owner := tm.quotaOwner(tenantID)
+	tm.quotasMu.RLock()
+	quota, exists := tm.quotas[owner]
+	tm.quotasMu.RUnlock()
+
+	if !exists {
+		return nil, errors.New("quota not found")
 	}
 
-	if tenantCtx.TenantID != requestedTenantID {
-		return fmt.Errorf("tenant mismatch: context=%s, requested=%s", tenantCtx.TenantID, requestedTenantID)
+	quota.Mu.Lock()
+	defer quota.Mu.Unlock()
+
+	var used, limit int64
+	switch usageType {
+	case "api_request":
+		used, limit = int64(quota.CurrentRequests), int64(quota.MaxAPIRequests)
+	case "user":
+		used, limit = int64(quota.CurrentUsers), int64(quota.MaxUsers)
+	case "storage":
+		used, limit = quota.CurrentStorage, quota.MaxStorage
+	case "resource":
+		used, limit = int64(tm.poolResourceCount(owner)), int64(quota.MaxUsers)
+	default:
+		return nil, errors.New("unknown usage type")
 	}
 
-	// Check tenant status
-	tenant, err := tm.GetTenant(tenantCtx.TenantID)
-	if err != nil {
-		return errors.New("tenant not found")
+	if used+quota.reserved[usageType]+amount > limit {
+		tm.quotaExceeded(quota, usageType)
+		return nil, quotaExceededError(usageType)
 	}
 
-	if tenant.Status != "active" {
-		return fmt.Errorf("tenant is %s", tenant.Status)
+	if quota.reserved == nil {
+		quota.reserved = make(map[string]int64)
 	}
+	quota.reserved[usageType] += amount
 
-	return nil
+	return &QuotaReservation{
+		TenantID:  tenantID,
+		UsageType: usageType,
+		Amount:    amount,
+		tm:        tm,
+		quota:     quota,
+	}, nil
 }
 
-// ========== Cross-Tenant Prevention ==========
+// Commit converts the reservation into usage. Resource reservations only
+// drop the hold, since stored resources are counted directly.
+func (r *QuotaReservation) Commit() error {
+	r.quota.Mu.Lock()
+	defer r.quota.Mu.Unlock()
 
-// ValidateResourceAccess validates that a user can access a resource
-func (tm *TenantManager) ValidateResourceAccess(ctx context.Context, resourceID string) error {
-	tenantCtx, err := GetTenantContext(ctx)
-	if err != nil {
-		return errors.New("no tenant context")
+	if r.done {
+		return errors.New("reservation already finalized")
 	}
+	r.done = true
+	r.quota.reserved[r.UsageType] -= r.Amount
 
-	tm.resourcesMu.RLock()
-	resources := tm.resources[tenantCtx.TenantID]
-	tm.resourcesMu.RUnlock()
-
-	for _, resource := range resources {
-		if resource.ID == resourceID {
-			if resource.TenantID != tenantCtx.TenantID {
-				tm.logAudit(tenantCtx.TenantID, tenantCtx.UserID, "CROSS_TENANT_ACCESS_DENIED", resourceID, nil)
-				return errors.New("cross-tenant access denied")
-			}
-			return nil
-		}
+	switch r.UsageType {
+	case "api_request":
+		r.quota.CurrentRequests += int(r.Amount)
+	case "user":
+		r.quota.CurrentUsers += int(r.Amount)
+	case "storage":
+		r.quota.CurrentStorage += r.Amount
+	case "resource":
+		return nil
 	}
+	r.tm.recordUsage(r.TenantID, r.UsageType, r.Amount)
 
-	return errors.New("resource not found")
+	return nil
 }
 
-// ========== Audit Logging ==========
+// Release returns the reserved quota. It is a no-op once the reservation
+// has been committed or released, so it is safe to defer.
+func (r *QuotaReservation) Release() {
+	r.quota.Mu.Lock()
+	defer r.quota.Mu.Unlock()
 
-func (tm *TenantManager) logAudit(tenantID, userID, action, resourceID string, details map[string]interface{}) {
-	entry := &AuditLogEntry{
-		Timestamp:  time.Now(),
-		TenantID:   tenantID,
-		UserID:     userID,
-		Action:     action,
-		ResourceID: resourceID,
-		Details:    details,
+	if r.done {
+		return
 	}
+	r.done = true
+	r.quota.reserved[r.UsageType] -= r.Amount
+}
 
-	tm.auditLogMu.Lock()
-	tm.auditLog = append(tm.auditLog, entry)
-	tm.auditLogMu.Unlock()
+func quotaExceededError(usageType string) error {
+	switch usageType {
+	case "api_request":
+		return errors.New("API request quota exceeded")
+	case "user":
+		return errors.New("user quota exceeded")
+	case "storage":
+		return errors.New("storage quota exceeded")
+	}
+	return errors.New("quota exceeded")
 }
 
-// GetAuditLog retrieves audit log for a tenant
-func (tm *TenantManager) GetAuditLog(tenantID string) []*AuditLogEntry {
-	tm.auditLogMu.RLock()
-	defer tm.auditLogMu.RUnlock()
+// ========== Quota Reset & Usage Reporting ==========
 
-	var entries []*AuditLogEntry
-	for _, entry := range tm.auditLog {
-		if entry.TenantID == tenantID {
-			entries = append(entries, entry)
-		}
-	}
+// QuotaResetWindow is how long request and storage counters accumulate
+// before they are reset
+const QuotaResetWindow = 24 * time.Hour
+
+// usageBucketSize is the granularity of recorded usage
+const usageBucketSize = time.Hour
 
-	return entries
+// usageRetention is how long usage buckets are kept for reporting
+const usageRetention = 90 * 24 * time.Hour
+
+// UsageBucket holds the usage recorded in one time bucket
+type UsageBucket struct {
+	Start       time.Time `json:"start"`
+	APIRequests int       `json:"api_requests"`
+	Users       int       `json:"users"`
+	Storage     int64     `json:"storage"`
 }
 
-// ========== Tenant Routing ==========
+// UsageReport is a tenant's usage split into period-sized buckets
+type UsageReport struct {
+	TenantID         string        `json:"tenant_id"`
+	Period           time.Duration `json:"period"`
+	Buckets          []UsageBucket `json:"buckets"`
+	TotalAPIRequests int           `json:"total_api_requests"`
+	TotalUsers       int           `json:"total_users"`
+	TotalStorage     int64         `json:"total_storage"`
+}
 
-// RegisterTenantRoute registers a database URL for a tenant
-func (tm *TenantManager) RegisterTenantRoute(tenantID, databaseURL string) error {
-	if _, err := tm.GetTenant(tenantID); err != nil {
-		return err
+// AddStorageUsage adds bytes to the tenant's storage usage
+func (tm *TenantManager) AddStorageUsage(tenantID string, bytes int64) error {
+	owner := tm.quotaOwner(tenantID)
+	tm.quotasMu.RLock()
+	quota, exists := tm.quotas[owner]
+	tm.quotasMu.RUnlock()
+
+	if !exists {
+		return errors.New("quota not found")
 	}
 
-	tm.routesMu.Lock()
-	tm.tenantRoutes[tenantID] = databaseURL
-	tm.routesMu.Unlock()
+	quota.Mu.Lock()
+	defer quota.Mu.Unlock()
+
+	if quota.CurrentStorage+quota.reserved["storage"]+bytes > quota.MaxStorage {
+		tm.quotaExceeded(quota, "storage")
+		return errors.New("storage quota exceeded")
+	}
+	quota.CurrentStorage += bytes
+	tm.recordUsage(tenantID, "storage", bytes)
 
 	return nil
 }
 
-// GetTenantRoute retrieves the database URL for a tenant
-func (tm *TenantManager) GetTenantRoute(tenantID string) (string, error) {
-	tm.routesMu.RLock()
-	defer tm.routesMu.RUnlock()
+// recordUsage adds usage to the tenant's current bucket
+func (tm *TenantManager) recordUsage(tenantID, usageType string, amount int64) {
+	start := tm.now().Truncate(usageBucketSize)
 
-	url, exists := tm.tenantRoutes[tenantID]
-	if !exists {
-		// Return default or tenant's configured database
-		tenant, err := tm.GetTenant(tenantID)
-		if err != nil {
-			return "", err
-		}
-		return tenant.DatabaseURL, nil
+	tm.usageMu.Lock()
+	defer tm.usageMu.Unlock()
+
+	buckets := tm.usage[tenantID]
+	if n := len(buckets); n == 0 || buckets[n-1].Start.Before(start) {
+		buckets = append(buckets, &UsageBucket{Start: start})
+		tm.usage[tenantID] = buckets
 	}
 
-	return url, nil
+	bucket := buckets[len(buckets)-1]
+	switch usageType {
+	case "api_request":
+		bucket.APIRequests += int(amount)
+	case "user":
+		bucket.Users += int(amount)
+	case "storage":
+		bucket.Storage += amount
+	}
 }
 
-// ========== Tenant Statistics ==========
+// ResetExpiredQuotas resets request and storage counters of every quota
+// whose reset time has passed and moves its reset time into the next
+// window. Usage buckets older than the retention period are dropped.
+// It returns the IDs of the tenants that were reset.
+func (tm *TenantManager) ResetExpiredQuotas(now time.Time) []string {
+	tm.quotasMu.RLock()
+	quotas := make([]*ResourceQuota, 0, len(tm.quotas))
+	for _, quota := range tm.quotas {
+		quotas = append(quotas, quota)
+	}
+	tm.quotasMu.RUnlock()
 
-// GetTenantStats returns statistics for a tenant
-func (tm *TenantManager) GetTenantStats(tenantID string) map[string]interface{} {
-	resourceCount := 0
-	tm.resourcesMu.RLock()
-	if resources, exists := tm.resources[tenantID]; exists {
-		resourceCount = len(resources)
+	var reset []string
+	for _, quota := range quotas {
+		quota.Mu.Lock()
+		if now.Before(quota.ResetTime) {
+			quota.Mu.Unlock()
+			continue
+		}
+
+		details := map[string]interface{}{
+			"requests": quota.CurrentRequests,
+			"storage":  quota.CurrentStorage,
+		}
+		quota.CurrentRequests = 0
+		quota.CurrentStorage = 0
+		clear(quota.exceeded)
+		missed := now.Sub(quota.ResetTime)/QuotaResetWindow + 1
+		quota.ResetTime = quota.ResetTime.Add(missed * QuotaResetWindow)
+		quota.Mu.Unlock()
+
+		tm.logAudit(quota.TenantID, "", "RESET_QUOTA", quota.TenantID, details)
+		reset = append(reset, quota.TenantID)
 	}
-	tm.resourcesMu.RUnlock()
 
-	auditCount := 0
-	tm.auditLogMu.RLock()
-	for _, entry := range tm.auditLog {
-		if entry.TenantID == tenantID {
-			auditCount++
+	cutoff := now.Add(-usageRetention)
+	tm.usageMu.Lock()
+	for tenantID, buckets := range tm.usage {
+		i := 0
+		for i < len(buckets) && buckets[i].Start.Before(cutoff) {
+			i++
 		}
+		tm.usage[tenantID] = buckets[i:]
 	}
-	tm.auditLogMu.RUnlock()
+	tm.usageMu.Unlock()
 
-	quota, _ := tm.GetQuota(tenantID)
-	quotaData := make(map[string]interface{})
-	if quota != nil {
-		quota.Mu.RLock()
-		quotaData = map[string]interface{}{
-			"users": map[string]int{"current": quota.CurrentUsers, "max": quota.MaxUsers},
-			"requests": map[string]int{"current": quota.CurrentRequests, "max": quota.MaxAPIRequests},
+	return reset
+}
+
+// RunQuotaResets resets expired quotas, enforces downgrade grace periods,
+// prunes the audit log and checks for noisy neighbors every interval until
+// ctx is done. Run it in its own goroutine.
+func (tm *TenantManager) RunQuotaResets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tm.ResetExpiredQuotas(tm.now())
+			tm.EnforceGracePeriods(tm.now())
+			tm.PruneAuditLog(tm.now())
+			tm.DetectNoisyNeighbors(tm.now())
 		}
-		quota.Mu.RUnlock()
 	}
+}
 
-	return map[string]interface{}{
-		"tenant_id":      tenantID,
-		"resource_count": resourceCount,
-		"audit_count":    auditCount,
-		"quota":          quotaData,
+// GetUsageReport returns the tenant's recorded usage grouped into buckets
+// of the given period, which must be a whole number of hours
+func (tm *TenantManager) GetUsageReport(tenantID string, period time.Duration) (*UsageReport, error) {
+	if period < usageBucketSize || period%usageBucketSize != 0 {
+		return nil, errors.New("period must be a positive multiple of one hour")
+	}
+	if _, err := tm.GetQuota(tenantID); err != nil {
+		return nil, err
 	}
+
+	report := &UsageReport{TenantID: tenantID, Period: period, Buckets: []UsageBucket{}}
+
+	tm.usageMu.RLock()
+	defer tm.usageMu.RUnlock()
+
+	for _, bucket := range tm.usage[tenantID] {
+		start := bucket.Start.Truncate(period)
+		n := len(report.Buckets)
+		if n == 0 || !report.Buckets[n-1].Start.Equal(start) {
+			report.Buckets = append(report.Buckets, UsageBucket{Start: start})
+			n++
+		}
+
+		b := &report.Buckets[n-1]
+		b.APIRequests += bucket.APIRequests
+		b.Users += bucket.Users
+		b.Storage += bucket.Storage
+
+		report.TotalAPIRequests += bucket.APIRequests
+		report.TotalUsers += bucket.Users
+		report.TotalStorage += bucket.Storage
+	}
+
+	return report, nil
 }
 
-// ========== Helper Functions ==========
+// ========== Plan Changes ==========
 
-func generateTenantID() string {
-	return fmt.Sprintf("tenant_%d", time.Now().UnixNano())
+// DowngradePolicy controls downgrades that leave a tenant over its new
+// quota. Mode "reject" refuses them; mode "grace" applies the new plan and
+// gives the tenant GracePeriod to get back under quota before it is
+// suspended.
+type DowngradePolicy struct {
+	Mode        string // "reject", "grace"
+	GracePeriod time.Duration
 }
 
-func generateResourceID() string {
-	return fmt.Sprintf("resource_%d", time.Now().UnixNano())
+// PlanChange describes a completed plan change
+type PlanChange struct {
+	TenantID   string
+	OldPlan    string
+	NewPlan    string
+	OverQuota  []string // limits the tenant currently exceeds
+	GraceUntil time.Time
+	Timestamp  time.Time
+}
+
+// PlanChangeHook is called after every successful plan change
+type PlanChangeHook func(change PlanChange)
+
+// SetDowngradePolicy sets how over-quota downgrades are handled
+func (tm *TenantManager) SetDowngradePolicy(policy DowngradePolicy) {
+	tm.planMu.Lock()
+	defer tm.planMu.Unlock()
+	tm.downgradePolicy = policy
+}
+
+// OnPlanChange registers a hook, e.g. for billing integrations
+func (tm *TenantManager) OnPlanChange(hook PlanChangeHook) {
+	tm.planMu.Lock()
+	defer tm.planMu.Unlock()
+	tm.planHooks = append(tm.planHooks, hook)
+}
+
+// ChangePlan moves a tenant to a new plan and swaps its quota limits in one
+// step, keeping current usage
+func (tm *TenantManager) ChangePlan(tenantID, newPlan string) (*PlanChange, error) {
+	if !isValidPlan(newPlan) {
+		return nil, fmt.Errorf("invalid plan: %s", newPlan)
+	}
+
+	tm.planMu.RLock()
+	policy := tm.downgradePolicy
+	hooks := tm.planHooks
+	tm.planMu.RUnlock()
+
+	tm.tenantsMu.Lock()
+	tenant, exists := tm.tenants[tenantID]
+	if !exists {
+		tm.tenantsMu.Unlock()
+		return nil, errors.New("tenant not found")
+	}
+	if tenant.Status == "deleted" {
+		tm.tenantsMu.Unlock()
+		return nil, errors.New("tenant is deleted")
+	}
+	if tenant.Plan == newPlan {
+		tm.tenantsMu.Unlock()
+		return nil, fmt.Errorf("tenant is already on plan %s", newPlan)
+	}
+
+	quota, err := tm.GetQuota(tenantID)
+	if err != nil {
+		tm.tenantsMu.Unlock()
+		return nil, err
+	}
+
+	quota.Mu.Lock()
+	next := &ResourceQuota{}
+	applyPlanLimits(next, newPlan)
+	over := overQuota(quota, next)
+
+	if len(over) > 0 && policy.Mode != "grace" {
+		quota.Mu.Unlock()
+		tm.tenantsMu.Unlock()
+		tm.logAudit(tenantID, "", "CHANGE_PLAN_REJECTED", tenantID, map[string]interface{}{
+			"old_plan":   tenant.Plan,
+			"new_plan":   newPlan,
+			"over_quota": over,
+		})
+		return nil, fmt.Errorf("usage exceeds %s plan limits: %s", newPlan, strings.Join(over, ", "))
+	}
+
+	now := tm.now()
+	updated := *tenant
+	updated.Plan = newPlan
+	updated.UpdatedAt = now
+	if err := tm.persistTenant(&updated); err != nil {
+		quota.Mu.Unlock()
+		tm.tenantsMu.Unlock()
+		return nil, err
+	}
+
+	change := PlanChange{
+		TenantID:  tenantID,
+		OldPlan:   tenant.Plan,
+		NewPlan:   newPlan,
+		OverQuota: over,
+		Timestamp: now,
+	}
+
+	quota.MaxUsers = next.MaxUsers
+	quota.MaxAPIRequests = next.MaxAPIRequests
+	quota.MaxStorage = next.MaxStorage
+	quota.MaxDatabases = next.MaxDatabases
+	quota.GraceUntil = time.Time{}
+	if len(over) > 0 {
+		quota.GraceUntil = now.Add(policy.GracePeriod)
+		change.GraceUntil = quota.GraceUntil
+	}
+	quota.Mu.Unlock()
+
+	*tenant = updated
+	tm.tenantsMu.Unlock()
+
+	details := map[string]interface{}{"old_plan": change.OldPlan, "new_plan": newPlan}
+	if len(over) > 0 {
+		details["over_quota"] = over
+		details["grace_until"] = change.GraceUntil
+	}
+	tm.logAudit(tenantID, "", "CHANGE_PLAN", tenantID, details)
+
+	for _, hook := range hooks {
+		hook(change)
+	}
+
+	return &change, nil
+}
+
+// EnforceGracePeriods suspends tenants whose downgrade grace period has
+// ended while they are still over quota. It returns the suspended IDs.
+func (tm *TenantManager) EnforceGracePeriods(now time.Time) []string {
+	tm.quotasMu.RLock()
+	quotas := make([]*ResourceQuota, 0, len(tm.quotas))
+	for _, quota := range tm.quotas {
+		quotas = append(quotas, quota)
+	}
+	tm.quotasMu.RUnlock()
+
+	var suspended []string
+	for _, quota := range quotas {
+		quota.Mu.Lock()
+		if quota.GraceUntil.IsZero() || now.Before(quota.GraceUntil) {
+			quota.Mu.Unlock()
+			continue
+		}
+		quota.GraceUntil = time.Time{}
+		over := overQuota(quota, quota)
+		quota.Mu.Unlock()
+
+		if len(over) > 0 {
+			if err := tm.SuspendTenant(quota.TenantID, "over quota after plan downgrade grace period"); err == nil {
+				suspended = append(suspended, quota.TenantID)
+			}
+		}
+	}
+
+	return suspended
+}
+
+func isValidPlan(plan string) bool {
+	switch plan {
+	case "free", "pro", "enterprise":
+		return true
+	}
+	return false
+}
+
+// overQuota lists the limits in limits that the usage in usage exceeds.
+// Request counters are left out since they reset every window.
+func overQuota(usage, limits *ResourceQuota) []string {
+	var over []string
+	if usage.CurrentUsers > limits.MaxUsers {
+		over = append(over, "users")
+	}
+	if usage.CurrentStorage > limits.MaxStorage {
+		over = append(over, "storage")
+	}
+	if usage.CurrentDatabases > limits.MaxDatabases {
+		over = append(over, "databases")
+	}
+	return over
+}
+
+// ========== Tenant Events ==========
+
+// Event types published on the event bus
+const (
+	EventTenantCreated   = "tenant.created"
+	EventTenantSuspended = "tenant.suspended"
+	EventQuotaExceeded   = "quota.exceeded"
+	EventResourceCreated = "resource.created"
+	EventTenantThrottled = "tenant.throttled"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind before
+// new events are dropped for it
+const eventBufferSize = 256
+
+// TenantEvent is a lifecycle event for a tenant
+type TenantEvent struct {
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	TenantID   string                 `json:"tenant_id"`
+	ResourceID string                 `json:"resource_id,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventSubscriber receives tenant events
+type EventSubscriber interface {
+	HandleEvent(ctx context.Context, event TenantEvent) error
+}
+
+// EventSubscriberFunc adapts a function to EventSubscriber
+type EventSubscriberFunc func(ctx context.Context, event TenantEvent) error
+
+// HandleEvent calls f(ctx, event)
+func (f EventSubscriberFunc) HandleEvent(ctx context.Context, event TenantEvent) error {
+	return f(ctx, event)
+}
+
+// EventBusStats counts event bus activity
+type EventBusStats struct {
+	Published int64
+	Delivered int64
+	Dropped   int64 // subscriber buffer full
+	Failed    int64 // subscriber returned an error
+}
+
+// EventBus fans events out to subscribers. Each subscriber has its own
+// buffered queue and goroutine, so publishing never blocks on a slow
+// subscriber and subscribers may call back into the TenantManager.
+type EventBus struct {
+	subs   map[uint64]*subscription
+	nextID uint64
+	mu     sync.RWMutex
+	stats  EventBusStats
+	statMu sync.Mutex
+}
+
+type subscription struct {
+	subscriber EventSubscriber
+	types      map[string]bool // empty means all types
+	events     chan TenantEvent
+	done       chan struct{}
+	closed     bool
+	mu         sync.Mutex
+}
+
+// NewEventBus creates an event bus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[uint64]*subscription)}
+}
+
+// Subscribe delivers events of the given types, or all types if none are
+// given, to sub. The returned function unsubscribes and waits for queued
+// events to be delivered; don't call it from inside HandleEvent.
+func (b *EventBus) Subscribe(sub EventSubscriber, types ...string) func() {
+	s := &subscription{
+		subscriber: sub,
+		types:      make(map[string]bool),
+		events:     make(chan TenantEvent, eventBufferSize),
+		done:       make(chan struct{}),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.nextID++
+	id := b.nextID
+	b.subs[id] = s
+	b.mu.Unlock()
+
+	go b.deliver(s)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			s.close()
+			<-s.done
+		})
+	}
+}
+
+// Publish queues event for every interested subscriber
+func (b *EventBus) Publish(event TenantEvent) {
+	b.addStat(func(s *EventBusStats) { s.Published++ })
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, s := range b.subs {
+		if len(s.types) > 0 && !s.types[event.Type] {
+			continue
+		}
+		if !s.enqueue(event) {
+			b.addStat(func(s *EventBusStats) { s.Dropped++ })
+		}
+	}
+}
+
+// Close unsubscribes everyone, waiting for queued events to be delivered
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[uint64]*subscription)
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.close()
+		<-s.done
+	}
+}
+
+// Stats returns a snapshot of the bus counters
+func (b *EventBus) Stats() EventBusStats {
+	b.statMu.Lock()
+	defer b.statMu.Unlock()
+	return b.stats
+}
+
+func (b *EventBus) addStat(update func(s *EventBusStats)) {
+	b.statMu.Lock()
+	update(&b.stats)
+	b.statMu.Unlock()
+}
+
+func (b *EventBus) deliver(s *subscription) {
+	defer close(s.done)
+	for event := range s.events {
+		if err := s.subscriber.HandleEvent(context.Background(), event); err != nil {
+			b.addStat(func(s *EventBusStats) { s.Failed++ })
+			continue
+		}
+		b.addStat(func(s *EventBusStats) { s.Delivered++ })
+	}
+}
+
+func (s *subscription) enqueue(event TenantEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	select {
+	case s.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+// Events returns the manager's event bus
+func (tm *TenantManager) Events() *EventBus {
+	return tm.events
+}
+
+func (tm *TenantManager) publish(eventType, tenantID, resourceID string, data map[string]interface{}) {
+	tm.events.Publish(TenantEvent{
+		ID:         generateEventID(),
+		Type:       eventType,
+		TenantID:   tenantID,
+		ResourceID: resourceID,
+		Timestamp:  tm.now(),
+		Data:       data,
+	})
+}
+
+// quotaExceeded publishes quota.exceeded the first time a limit is hit in
+// the current reset window. The caller holds quota.Mu.
+func (tm *TenantManager) quotaExceeded(quota *ResourceQuota, usageType string) {
+	if quota.exceeded[usageType] {
+		return
+	}
+	if quota.exceeded == nil {
+		quota.exceeded = make(map[string]bool)
+	}
+	quota.exceeded[usageType] = true
+
+	tm.publish(EventQuotaExceeded, quota.TenantID, "", map[string]interface{}{
+		"usage_type": usageType,
+		"reset_time": quota.ResetTime,
+	})
+}
+
+// ========== Tenant Context Management ==========
+
+// ContextKey type for context values
+type ContextKey string
+
+const TenantContextKey ContextKey = "tenant_context"
+
+// WithTenantContext adds tenant context to a request context
+func WithTenantContext(ctx context.Context, tenantCtx *TenantContext) context.Context {
+	return context.WithValue(ctx, TenantContextKey, tenantCtx)
+}
+
+// GetTenantContext extracts tenant context from request context
+func GetTenantContext(ctx context.Context) (*TenantContext, error) {
+	tenantCtx, ok := ctx.Value(TenantContextKey).(*TenantContext)
+	if !ok {
+		return nil, errors.New("tenant context not found")
+	}
+	return tenantCtx, nil
+}
+
+// ValidateRequestTenancy validates that request is for correct tenant
+func (tm *TenantManager) ValidateRequestTenancy(ctx context.Context, requestedTenantID string) error {
+	tenantCtx, err := GetTenantContext(ctx)
+	if err != nil {
+		return errors.New("no tenant context in request")
+	}
+	if err := tm.checkImpersonation(tenantCtx); err != nil {
+		return err
+	}
+
+	if tenantCtx.TenantID != requestedTenantID {
+		return fmt.Errorf("tenant mismatch: context=%s, requested=%s", tenantCtx.TenantID, requestedTenantID)
+	}
+
+	// Check tenant status
+	tenant, err := tm.GetTenant(tenantCtx.TenantID)
+	if err != nil {
+		return errors.New("tenant not found")
+	}
+
+	if tenant.Status != "active" {
+		return fmt.Errorf("tenant is %s", tenant.Status)
+	}
+
+	return nil
+}
+
+// ========== Impersonation ==========
+
+// DefaultMaxImpersonation caps impersonation sessions when the policy sets
+// no limit
+const DefaultMaxImpersonation = time.Hour
+
+// ImpersonationPolicy decides who may impersonate tenants and for how long
+type ImpersonationPolicy struct {
+	IsAdmin     func(userID string) bool // nil refuses every request
+	MaxDuration time.Duration
+}
+
+// ImpersonationRequest asks for a support session in another tenant
+type ImpersonationRequest struct {
+	AdminUserID string
+	TenantID    string
+	UserID      string // user to act as; defaults to the admin
+	Reason      string
+	Duration    time.Duration
+}
+
+// Impersonation is a support session in which an admin acts within a tenant
+type Impersonation struct {
+	ID          string    `json:"id"`
+	AdminUserID string    `json:"admin_user_id"`
+	TenantID    string    `json:"tenant_id"`
+	UserID      string    `json:"user_id"`
+	Reason      string    `json:"reason"`
+	StartedAt   time.Time `json:"started_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	EndedAt     time.Time `json:"ended_at,omitzero"`
+}
+
+// Active reports whether the session is usable at now
+func (i *Impersonation) Active(now time.Time) bool {
+	return i.EndedAt.IsZero() && now.Before(i.ExpiresAt)
+}
+
+// SetImpersonationPolicy sets who may impersonate tenants
+func (tm *TenantManager) SetImpersonationPolicy(policy ImpersonationPolicy) {
+	tm.impersonationMu.Lock()
+	defer tm.impersonationMu.Unlock()
+	tm.impersonationPolicy = policy
+}
+
+// StartImpersonation opens a time-limited session and returns a tenant
+// context for it. Everything audited through that context records both the
+// admin and the impersonated user.
+func (tm *TenantManager) StartImpersonation(req ImpersonationRequest) (*TenantContext, error) {
+	if req.Reason == "" {
+		return nil, errors.New("impersonation requires a reason")
+	}
+
+	tenant, err := tm.GetTenant(req.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.Status == "deleted" {
+		return nil, errors.New("cannot impersonate a deleted tenant")
+	}
+
+	tm.impersonationMu.Lock()
+	defer tm.impersonationMu.Unlock()
+
+	policy := tm.impersonationPolicy
+	if policy.IsAdmin == nil || !policy.IsAdmin(req.AdminUserID) {
+		return nil, errors.New("user is not allowed to impersonate")
+	}
+	limit := policy.MaxDuration
+	if limit <= 0 {
+		limit = DefaultMaxImpersonation
+	}
+	if req.Duration <= 0 || req.Duration > limit {
+		return nil, fmt.Errorf("impersonation duration must be between 0 and %s", limit)
+	}
+
+	userID := req.UserID
+	if userID == "" {
+		userID = req.AdminUserID
+	}
+
+	now := tm.now()
+	session := &Impersonation{
+		ID:          generateImpersonationID(),
+		AdminUserID: req.AdminUserID,
+		TenantID:    tenant.ID,
+		UserID:      userID,
+		Reason:      req.Reason,
+		StartedAt:   now,
+		ExpiresAt:   now.Add(req.Duration),
+	}
+	tm.impersonations[session.ID] = session
+
+	tm.logAudit(tenant.ID, req.AdminUserID, "IMPERSONATION_START", tenant.ID, map[string]interface{}{
+		"impersonation_id":     session.ID,
+		"impersonated_user_id": userID,
+		"reason":               req.Reason,
+		"expires_at":           session.ExpiresAt,
+	})
+
+	copied := *session
+	return &TenantContext{
+		TenantID:      tenant.ID,
+		TenantName:    tenant.Name,
+		Plan:          tenant.Plan,
+		UserID:        userID,
+		RequestID:     generateRequestID(),
+		Timestamp:     now,
+		Metadata:      map[string]interface{}{"impersonation_id": session.ID},
+		Impersonation: &copied,
+	}, nil
+}
+
+// EndImpersonation closes a session before it expires
+func (tm *TenantManager) EndImpersonation(impersonationID string) error {
+	tm.impersonationMu.Lock()
+	defer tm.impersonationMu.Unlock()
+
+	session, exists := tm.impersonations[impersonationID]
+	if !exists {
+		return errors.New("impersonation not found")
+	}
+	if !session.EndedAt.IsZero() {
+		return errors.New("impersonation already ended")
+	}
+	session.EndedAt = tm.now()
+
+	tm.logAudit(session.TenantID, session.AdminUserID, "IMPERSONATION_END", session.TenantID,
+		map[string]interface{}{"impersonation_id": session.ID})
+	return nil
+}
+
+// ListImpersonations returns the tenant's sessions, oldest first
+func (tm *TenantManager) ListImpersonations(tenantID string) []*Impersonation {
+	tm.impersonationMu.RLock()
+	defer tm.impersonationMu.RUnlock()
+
+	var result []*Impersonation
+	for _, session := range tm.impersonations {
+		if session.TenantID == tenantID {
+			copied := *session
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].StartedAt.Equal(result[j].StartedAt) {
+			return result[i].StartedAt.Before(result[j].StartedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// RecordAction writes an audit entry for an action taken in ctx's tenant,
+// flagged if the context belongs to an impersonation session
+func (tm *TenantManager) RecordAction(ctx context.Context, action, resourceID string, details map[string]interface{}) error {
+	tenantCtx, err := GetTenantContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := tm.checkImpersonation(tenantCtx); err != nil {
+		return err
+	}
+
+	tm.auditContext(tenantCtx, tenantCtx.TenantID, action, resourceID, details)
+	return nil
+}
+
+// checkImpersonation rejects contexts whose impersonation session has
+// expired, ended or was never started by this manager
+func (tm *TenantManager) checkImpersonation(tenantCtx *TenantContext) error {
+	if tenantCtx.Impersonation == nil {
+		return nil
+	}
+
+	tm.impersonationMu.RLock()
+	session, exists := tm.impersonations[tenantCtx.Impersonation.ID]
+	active := exists && session.TenantID == tenantCtx.TenantID && session.Active(tm.now())
+	tm.impersonationMu.RUnlock()
+
+	if !active {
+		return errors.New("impersonation session is not active")
+	}
+	return nil
+}
+
+// auditContext logs an action by the context's user, recording the admin
+// behind it when the context is an impersonation
+func (tm *TenantManager) auditContext(tenantCtx *TenantContext, tenantID, action, resourceID string, details map[string]interface{}) {
+	entry := &AuditLogEntry{
+		TenantID:   tenantID,
+		UserID:     tenantCtx.UserID,
+		Action:     action,
+		ResourceID: resourceID,
+		Details:    details,
+	}
+	if session := tenantCtx.Impersonation; session != nil {
+		entry.ImpersonatorID = session.AdminUserID
+		entry.ImpersonationID = session.ID
+	}
+	tm.appendAudit(entry)
+}
+
+// ========== Tenant Resolution Middleware ==========
+
+// TenantHeader names the tenant by ID or name
+const TenantHeader = "X-Tenant-ID"
+
+// TenantResolver configures where TenantMiddleware looks for the tenant.
+// Every source found must name the same tenant, so a header cannot
+// override the tenant a token was issued for.
+type TenantResolver struct {
+	// BaseDomain enables subdomain resolution: with "example.com", a
+	// request to acme.example.com resolves the tenant named "acme"
+	BaseDomain string
+	// JWTSecret enables resolution from the tenant_id claim of an HS256
+	// bearer token, whose sub claim becomes the UserID
+	JWTSecret []byte
+}
+
+// TenantClaims are the JWT claims TenantMiddleware understands
+type TenantClaims struct {
+	TenantID  string `json:"tenant_id"`
+	Subject   string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// TenantMiddleware resolves the tenant of each request, rejects requests
+// for unknown (404), suspended (403) or deleted (410) tenants, and injects
+// a TenantContext into the request context for the next handler
+func (tm *TenantManager) TenantMiddleware(resolver TenantResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenantCtx, status, err := tm.resolveTenant(r, resolver)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithTenantContext(r.Context(), tenantCtx)))
+		})
+	}
+}
+
+func (tm *TenantManager) resolveTenant(r *http.Request, resolver TenantResolver) (*TenantContext, int, error) {
+	type candidate struct{ source, ref string }
+	var candidates []candidate
+	userID := ""
+
+	if resolver.BaseDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if sub, ok := strings.CutSuffix(strings.ToLower(host), "."+resolver.BaseDomain); ok && sub != "" && !strings.Contains(sub, ".") {
+			candidates = append(candidates, candidate{"subdomain", sub})
+		}
+	}
+
+	if ref := r.Header.Get(TenantHeader); ref != "" {
+		candidates = append(candidates, candidate{"header", ref})
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && resolver.JWTSecret != nil {
+		claims, err := ParseTenantToken(resolver.JWTSecret, token)
+		if err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+		candidates = append(candidates, candidate{"jwt", claims.TenantID})
+		userID = claims.Subject
+	}
+
+	if len(candidates) == 0 {
+		return nil, http.StatusBadRequest, errors.New("tenant not specified")
+	}
+
+	var tenant *Tenant
+	sources := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		t, err := tm.lookupTenant(c.ref)
+		if err != nil {
+			return nil, http.StatusNotFound, err
+		}
+		if tenant != nil && t.ID != tenant.ID {
+			return nil, http.StatusForbidden, fmt.Errorf("tenant mismatch: %s and %s name different tenants", sources[0], c.source)
+		}
+		tenant = t
+		sources = append(sources, c.source)
+	}
+
+	tm.tenantsMu.RLock()
+	status := tenant.Status
+	tm.tenantsMu.RUnlock()
+
+	switch status {
+	case "active":
+	case "deleted":
+		return nil, http.StatusGone, errors.New("tenant is deleted")
+	default:
+		return nil, http.StatusForbidden, fmt.Errorf("tenant is %s", status)
+	}
+
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = generateRequestID()
+	}
+
+	return &TenantContext{
+		TenantID:   tenant.ID,
+		TenantName: tenant.Name,
+		Plan:       tenant.Plan,
+		UserID:     userID,
+		RequestID:  requestID,
+		Timestamp:  time.Now(),
+		Metadata:   map[string]interface{}{"resolved_by": sources},
+	}, 0, nil
+}
+
+// lookupTenant finds a tenant by ID, or else by case-insensitive name
+func (tm *TenantManager) lookupTenant(ref string) (*Tenant, error) {
+	tm.tenantsMu.RLock()
+	defer tm.tenantsMu.RUnlock()
+
+	if tenant, exists := tm.tenants[ref]; exists {
+		return tenant, nil
+	}
+	for _, tenant := range tm.tenants {
+		if strings.EqualFold(tenant.Name, ref) {
+			return tenant, nil
+		}
+	}
+	return nil, errors.New("tenant not found")
+}
+
+// NewTenantToken issues an HS256 JWT carrying the tenant and user IDs
+func NewTenantToken(secret []byte, tenantID, userID string, ttl time.Duration) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(TenantClaims{
+		TenantID:  tenantID,
+		Subject:   userID,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + signHS256(secret, signingInput), nil
+}
+
+// ParseTenantToken verifies an HS256 JWT and returns its claims
+func ParseTenantToken(secret []byte, token string) (*TenantClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS256" {
+		return nil, errors.New("unsupported token header")
+	}
+
+	expected := signHS256(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims TenantClaims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if claims.TenantID == "" {
+		return nil, errors.New("token has no tenant_id claim")
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+
+	return &claims, nil
+}
+
+func signHS256(secret []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ========== Rate Limiting ==========
+
+// RateLimit is a token bucket refilled at RequestsPerSecond up to Burst
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// PlanRateLimits maps each plan to its request rate; unknown plans get the
+// free limit
+var PlanRateLimits = map[string]RateLimit{
+	"free":       {RequestsPerSecond: 10, Burst: 20},
+	"pro":        {RequestsPerSecond: 100, Burst: 200},
+	"enterprise": {RequestsPerSecond: 1000, Burst: 2000},
+}
+
+// RateLimitResult describes a rate limit decision
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// RateLimiter keeps one token bucket per tenant
+type RateLimiter struct {
+	buckets   map[string]*tokenBucket
+	throttles map[string]float64 // tenant -> multiplier on the plan rate
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates an empty per-tenant rate limiter
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		throttles: make(map[string]float64),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from the tenant's bucket. The bucket follows the
+// plan's current limit, so a plan change applies to the next request.
+func (rl *RateLimiter) Allow(tenantID, plan string) RateLimitResult {
+	limit, ok := PlanRateLimits[plan]
+	if !ok {
+		limit = PlanRateLimits["free"]
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if factor, throttled := rl.throttles[tenantID]; throttled {
+		limit.RequestsPerSecond *= factor
+		limit.Burst = max(1, int(float64(limit.Burst)*factor))
+	}
+
+	now := rl.now()
+	bucket, exists := rl.buckets[tenantID]
+	if !exists {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		rl.buckets[tenantID] = bucket
+	}
+
+	bucket.limit = limit
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = min(float64(limit.Burst), bucket.tokens+elapsed*limit.RequestsPerSecond)
+	bucket.last = now
+
+	result := RateLimitResult{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		wait := (1 - bucket.tokens) / limit.RequestsPerSecond
+		result.RetryAfter = time.Duration(wait * float64(time.Second))
+	}
+	result.Remaining = int(bucket.tokens)
+
+	return result
+}
+
+// SetThrottle scales the tenant's plan rate and burst by factor. A factor
+// of 0 removes the throttle.
+func (rl *RateLimiter) SetThrottle(tenantID string, factor float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if factor <= 0 {
+		delete(rl.throttles, tenantID)
+		return
+	}
+	rl.throttles[tenantID] = factor
+}
+
+// Remove drops the tenant's bucket and throttle
+func (rl *RateLimiter) Remove(tenantID string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.buckets, tenantID)
+	delete(rl.throttles, tenantID)
+}
+
+// RateLimitMiddleware enforces the tenant's plan rate and API request
+// quota. It must run after TenantMiddleware. Responses carry
+// X-RateLimit-* and X-Quota-* headers, and rejected requests get 429 with
+// Retry-After.
+func (tm *TenantManager) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantCtx, err := GetTenantContext(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result := tm.limiter.Allow(tenantCtx.TenantID, tenantCtx.Plan)
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		quotaErr := tm.IncrementQuotaUsage(tenantCtx.TenantID, "api_request")
+		if quota, err := tm.effectiveQuota(tenantCtx.TenantID); err == nil {
+			quota.Mu.RLock()
+			h.Set("X-Quota-Limit", strconv.Itoa(quota.MaxAPIRequests))
+			h.Set("X-Quota-Remaining", strconv.Itoa(quota.MaxAPIRequests-quota.CurrentRequests))
+			h.Set("X-Quota-Reset", strconv.FormatInt(quota.ResetTime.Unix(), 10))
+			retryAfter := time.Until(quota.ResetTime)
+			quota.Mu.RUnlock()
+
+			if quotaErr != nil {
+				h.Set("Retry-After", strconv.Itoa(int(math.Ceil(max(retryAfter, 0).Seconds()))))
+				http.Error(w, quotaErr.Error(), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== Noisy Neighbor Detection ==========
+
+// loadBucketSize is the granularity of the sliding load window
+const loadBucketSize = time.Second
+
+// NoisyNeighborPolicy sets when a tenant is considered to be taking more
+// than its fair share. Zero fields take the defaults noted on each.
+type NoisyNeighborPolicy struct {
+	Window           time.Duration // sliding window; default 1 minute
+	MaxShare         float64       // largest share of requests, latency or bytes; default 0.5
+	MinRequests      int64         // window total below which nobody is throttled; default 100
+	ThrottleFactor   float64       // multiplier on the plan rate while throttled; default 0.1
+	ThrottleDuration time.Duration // default 5 minutes
+}
+
+// TenantLoad is a tenant's consumption over the sliding window with its
+// share of all tenants' consumption
+type TenantLoad struct {
+	TenantID     string        `json:"tenant_id"`
+	Requests     int64         `json:"requests"`
+	Latency      time.Duration `json:"latency"`
+	Bytes        int64         `json:"bytes"`
+	RequestShare float64       `json:"request_share"`
+	LatencyShare float64       `json:"latency_share"`
+	BytesShare   float64       `json:"bytes_share"`
+}
+
+// Throttle is a temporary rate reduction applied to a noisy tenant
+type Throttle struct {
+	TenantID string    `json:"tenant_id"`
+	Metric   string    `json:"metric"` // requests, latency or bytes
+	Share    float64   `json:"share"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+type loadBucket struct {
+	start    time.Time
+	requests int64
+	latency  time.Duration
+	bytes    int64
+}
+
+// SetNoisyNeighborPolicy sets the fair-share thresholds
+func (tm *TenantManager) SetNoisyNeighborPolicy(policy NoisyNeighborPolicy) {
+	if policy.Window <= 0 {
+		policy.Window = time.Minute
+	}
+	if policy.MaxShare <= 0 {
+		policy.MaxShare = 0.5
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = 100
+	}
+	if policy.ThrottleFactor <= 0 {
+		policy.ThrottleFactor = 0.1
+	}
+	if policy.ThrottleDuration <= 0 {
+		policy.ThrottleDuration = 5 * time.Minute
+	}
+
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+	tm.noisyPolicy = policy
+}
+
+// ObserveRequest records a completed request's latency and the bytes it
+// produced
+func (tm *TenantManager) ObserveRequest(tenantID string, latency time.Duration, bytes int64) {
+	start := tm.now().Truncate(loadBucketSize)
+
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+
+	buckets := tm.load[tenantID]
+	if n := len(buckets); n == 0 || buckets[n-1].start.Before(start) {
+		buckets = append(buckets, &loadBucket{start: start})
+		tm.load[tenantID] = buckets
+	}
+
+	bucket := buckets[len(buckets)-1]
+	bucket.requests++
+	bucket.latency += latency
+	bucket.bytes += bytes
+}
+
+// LoadReport returns every tenant's load over the window ending at now,
+// ordered by tenant ID
+func (tm *TenantManager) LoadReport(now time.Time) []TenantLoad {
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+	return tm.loadReportLocked(now)
+}
+
+// loadReportLocked sums the window and drops buckets that fell out of it.
+// The caller holds noisyMu.
+func (tm *TenantManager) loadReportLocked(now time.Time) []TenantLoad {
+	cutoff := now.Add(-tm.noisyPolicy.Window)
+
+	var loads []TenantLoad
+	var total TenantLoad
+	for tenantID, buckets := range tm.load {
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].start.After(cutoff) })
+		buckets = buckets[i:]
+		if len(buckets) == 0 {
+			delete(tm.load, tenantID)
+			continue
+		}
+		tm.load[tenantID] = buckets
+
+		load := TenantLoad{TenantID: tenantID}
+		for _, bucket := range buckets {
+			load.Requests += bucket.requests
+			load.Latency += bucket.latency
+			load.Bytes += bucket.bytes
+		}
+		total.Requests += load.Requests
+		total.Latency += load.Latency
+		total.Bytes += load.Bytes
+		loads = append(loads, load)
+	}
+
+	for i := range loads {
+		loads[i].RequestShare = share(float64(loads[i].Requests), float64(total.Requests))
+		loads[i].LatencyShare = share(float64(loads[i].Latency), float64(total.Latency))
+		loads[i].BytesShare = share(float64(loads[i].Bytes), float64(total.Bytes))
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].TenantID < loads[j].TenantID })
+	return loads
+}
+
+// DetectNoisyNeighbors lifts expired throttles and throttles tenants whose
+// share of the window exceeds the policy. Detection needs at least two
+// active tenants and MinRequests requests in the window. It returns the
+// newly throttled tenants.
+func (tm *TenantManager) DetectNoisyNeighbors(now time.Time) []string {
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+
+	policy := tm.noisyPolicy
+	for tenantID, throttle := range tm.throttles {
+		if !now.Before(throttle.Until) {
+			delete(tm.throttles, tenantID)
+			tm.limiter.SetThrottle(tenantID, 0)
+			tm.logAudit(tenantID, "", "THROTTLE_LIFTED", tenantID, map[string]interface{}{"reason": "expired"})
+		}
+	}
+
+	loads := tm.loadReportLocked(now)
+	var windowRequests int64
+	for _, load := range loads {
+		windowRequests += load.Requests
+	}
+	if len(loads) < 2 || windowRequests < policy.MinRequests {
+		return nil
+	}
+
+	var throttled []string
+	for _, load := range loads {
+		metric, value := "requests", load.RequestShare
+		if load.LatencyShare > value {
+			metric, value = "latency", load.LatencyShare
+		}
+		if load.BytesShare > value {
+			metric, value = "bytes", load.BytesShare
+		}
+		if value <= policy.MaxShare || now.Before(tm.throttleExempt[load.TenantID]) {
+			continue
+		}
+
+		// A tenant that stays noisy keeps its throttle without a new entry
+		if throttle, exists := tm.throttles[load.TenantID]; exists {
+			throttle.Until = now.Add(policy.ThrottleDuration)
+			continue
+		}
+
+		throttle := &Throttle{
+			TenantID: load.TenantID,
+			Metric:   metric,
+			Share:    value,
+			Since:    now,
+			Until:    now.Add(policy.ThrottleDuration),
+		}
+		tm.throttles[load.TenantID] = throttle
+		tm.limiter.SetThrottle(load.TenantID, policy.ThrottleFactor)
+
+		details := map[string]interface{}{
+			"metric": metric,
+			"share":  value,
+			"factor": policy.ThrottleFactor,
+			"until":  throttle.Until,
+		}
+		tm.logAudit(load.TenantID, "", "THROTTLE_TENANT", load.TenantID, details)
+		tm.publish(EventTenantThrottled, load.TenantID, "", details)
+		throttled = append(throttled, load.TenantID)
+	}
+
+	return throttled
+}
+
+// GetThrottle returns the tenant's active throttle, if any
+func (tm *TenantManager) GetThrottle(tenantID string) (*Throttle, bool) {
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+
+	throttle, exists := tm.throttles[tenantID]
+	if !exists {
+		return nil, false
+	}
+	copied := *throttle
+	return &copied, true
+}
+
+// OverrideThrottle lets an operator lift a tenant's throttle and exempt it
+// from detection for exemptFor. A zero exemptFor lifts the throttle and
+// clears any earlier exemption.
+func (tm *TenantManager) OverrideThrottle(tenantID, operatorID string, exemptFor time.Duration) error {
+	if _, err := tm.GetTenant(tenantID); err != nil {
+		return err
+	}
+
+	tm.noisyMu.Lock()
+	defer tm.noisyMu.Unlock()
+
+	now := tm.now()
+	_, wasThrottled := tm.throttles[tenantID]
+	delete(tm.throttles, tenantID)
+	tm.limiter.SetThrottle(tenantID, 0)
+
+	details := map[string]interface{}{"was_throttled": wasThrottled}
+	if exemptFor > 0 {
+		tm.throttleExempt[tenantID] = now.Add(exemptFor)
+		details["exempt_until"] = tm.throttleExempt[tenantID]
+	} else {
+		delete(tm.throttleExempt, tenantID)
+	}
+
+	tm.logAudit(tenantID, operatorID, "THROTTLE_OVERRIDE", tenantID, details)
+	return nil
+}
+
+// LoadTrackingMiddleware records each request's latency and response size
+// for noisy neighbor detection. It must run after TenantMiddleware.
+func (tm *TenantManager) LoadTrackingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantCtx, err := GetTenantContext(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		counter := &byteCountingWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(counter, r)
+		tm.ObserveRequest(tenantCtx.TenantID, time.Since(start), counter.bytes)
+	})
+}
+
+// byteCountingWriter counts the bytes written to the response body
+type byteCountingWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func share(part, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return part / total
+}
+
+// ========== Cross-Tenant Prevention ==========
+
+// ValidateResourceAccess validates that the tenant in ctx can read a
+// resource: it owns it, the resource belongs to a descendant visible to it,
+// or it holds an active share grant. Reads through a grant are audited for
+// both tenants.
+func (tm *TenantManager) ValidateResourceAccess(ctx context.Context, resourceID string) error {
+	_, err := tm.authorizeResource(ctx, resourceID, true)
+	return err
+}
+
+// ValidateResourceWrite validates that the tenant in ctx owns a resource.
+// Share grants and parent visibility never allow writes.
+func (tm *TenantManager) ValidateResourceWrite(ctx context.Context, resourceID string) error {
+	_, err := tm.authorizeResource(ctx, resourceID, false)
+	return err
+}
+
+func (tm *TenantManager) authorizeResource(ctx context.Context, resourceID string, allowShared bool) (*TenantResource, error) {
+	tenantCtx, err := GetTenantContext(ctx)
+	if err != nil {
+		return nil, errors.New("no tenant context")
+	}
+	if err := tm.checkImpersonation(tenantCtx); err != nil {
+		return nil, err
+	}
+
+	tm.resourcesMu.RLock()
+	resources := tm.resources[tenantCtx.TenantID]
+	tm.resourcesMu.RUnlock()
+
+	for _, resource := range resources {
+		if resource.ID == resourceID {
+			if resource.TenantID != tenantCtx.TenantID {
+				tm.auditContext(tenantCtx, tenantCtx.TenantID, "CROSS_TENANT_ACCESS_DENIED", resourceID, nil)
+				return nil, errors.New("cross-tenant access denied")
+			}
+			return resource, nil
+		}
+	}
+
+	// Parents may read resources of descendants that are visible to them
+	if resource, owner := tm.findVisibleResource(tenantCtx.TenantID, resourceID); resource != nil {
+		if !allowShared {
+			tm.auditContext(tenantCtx, tenantCtx.TenantID, "CROSS_TENANT_ACCESS_DENIED", resourceID,
+				map[string]interface{}{"owner_tenant_id": owner})
+			return nil, errors.New("cross-tenant access denied")
+		}
+		tm.auditContext(tenantCtx, owner, "PARENT_TENANT_READ", resourceID,
+			map[string]interface{}{"parent_tenant_id": tenantCtx.TenantID})
+		return resource, nil
+	}
+
+	// Only tenants that hold or held a grant learn that the resource exists
+	grant, active := tm.findGrant(resourceID, tenantCtx.TenantID)
+	if grant == nil {
+		return nil, errors.New("resource not found")
+	}
+	if !allowShared || !active {
+		tm.auditContext(tenantCtx, tenantCtx.TenantID, "CROSS_TENANT_ACCESS_DENIED", resourceID,
+			map[string]interface{}{"grant_id": grant.ID, "owner_tenant_id": grant.OwnerTenantID})
+		return nil, errors.New("cross-tenant access denied")
+	}
+
+	resource, err := tm.GetResource(grant.OwnerTenantID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	details := map[string]interface{}{
+		"grant_id":          grant.ID,
+		"owner_tenant_id":   grant.OwnerTenantID,
+		"grantee_tenant_id": grant.GranteeTenantID,
+	}
+	tm.auditContext(tenantCtx, grant.OwnerTenantID, "CROSS_TENANT_READ", resourceID, details)
+	tm.auditContext(tenantCtx, tenantCtx.TenantID, "CROSS_TENANT_READ", resourceID, details)
+
+	return resource, nil
+}
+
+// ========== Resource Sharing ==========
+
+// ResourceGrant gives another tenant read-only access to one resource
+type ResourceGrant struct {
+	ID              string    `json:"id"`
+	ResourceID      string    `json:"resource_id"`
+	OwnerTenantID   string    `json:"owner_tenant_id"`
+	GranteeTenantID string    `json:"grantee_tenant_id"`
+	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at,omitzero"` // zero means no expiry
+	RevokedAt       time.Time `json:"revoked_at,omitzero"`
+}
+
+// Active reports whether the grant is usable at now
+func (g *ResourceGrant) Active(now time.Time) bool {
+	return g.RevokedAt.IsZero() && (g.ExpiresAt.IsZero() || now.Before(g.ExpiresAt))
+}
+
+// ShareResource grants granteeTenantID read access to one of tenantID's
+// resources for ttl, or indefinitely if ttl is zero
+func (tm *TenantManager) ShareResource(tenantID, resourceID, granteeTenantID string, ttl time.Duration) (*ResourceGrant, error) {
+	if tenantID == granteeTenantID {
+		return nil, errors.New("cannot share a resource with its owner")
+	}
+	if _, err := tm.GetResource(tenantID, resourceID); err != nil {
+		return nil, err
+	}
+	grantee, err := tm.GetTenant(granteeTenantID)
+	if err != nil {
+		return nil, err
+	}
+	if grantee.Status != "active" {
+		return nil, errors.New("grantee tenant is not active")
+	}
+
+	now := tm.now()
+	grant := &ResourceGrant{
+		ID:              generateGrantID(),
+		ResourceID:      resourceID,
+		OwnerTenantID:   tenantID,
+		GranteeTenantID: granteeTenantID,
+		CreatedAt:       now,
+	}
+	if ttl > 0 {
+		grant.ExpiresAt = now.Add(ttl)
+	}
+
+	tm.grantsMu.Lock()
+	for _, existing := range tm.grants[resourceID] {
+		if existing.GranteeTenantID == granteeTenantID && existing.Active(now) {
+			tm.grantsMu.Unlock()
+			return nil, errors.New("resource already shared with tenant")
+		}
+	}
+	tm.grants[resourceID] = append(tm.grants[resourceID], grant)
+	tm.grantsMu.Unlock()
+
+	tm.logAudit(tenantID, "", "SHARE_RESOURCE", resourceID, map[string]interface{}{
+		"grant_id":          grant.ID,
+		"grantee_tenant_id": granteeTenantID,
+		"expires_at":        grant.ExpiresAt,
+	})
+
+	copied := *grant
+	return &copied, nil
+}
+
+// RevokeGrant revokes one of tenantID's grants
+func (tm *TenantManager) RevokeGrant(tenantID, grantID string) error {
+	tm.grantsMu.Lock()
+	defer tm.grantsMu.Unlock()
+
+	for _, grants := range tm.grants {
+		for _, grant := range grants {
+			if grant.ID != grantID {
+				continue
+			}
+			if grant.OwnerTenantID != tenantID {
+				return errors.New("access denied: grant belongs to different tenant")
+			}
+			if !grant.RevokedAt.IsZero() {
+				return errors.New("grant already revoked")
+			}
+			grant.RevokedAt = tm.now()
+			tm.logAudit(tenantID, "", "REVOKE_SHARE", grant.ResourceID, map[string]interface{}{
+				"grant_id":          grantID,
+				"grantee_tenant_id": grant.GranteeTenantID,
+			})
+			return nil
+		}
+	}
+
+	return errors.New("grant not found")
+}
+
+// ListGrants lists the grants a tenant has given or received, including
+// expired and revoked ones
+func (tm *TenantManager) ListGrants(tenantID string) []*ResourceGrant {
+	tm.grantsMu.RLock()
+	defer tm.grantsMu.RUnlock()
+
+	var result []*ResourceGrant
+	for _, grants := range tm.grants {
+		for _, grant := range grants {
+			if grant.OwnerTenantID == tenantID || grant.GranteeTenantID == tenantID {
+				copied := *grant
+				result = append(result, &copied)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// GetSharedResource returns a copy of a resource the tenant in ctx may read
+func (tm *TenantManager) GetSharedResource(ctx context.Context, resourceID string) (*TenantResource, error) {
+	resource, err := tm.authorizeResource(ctx, resourceID, true)
+	if err != nil {
+		return nil, err
+	}
+	if resource, err = tm.readResource(resource); err != nil {
+		return nil, err
+	}
+
+	copied := *resource
+	copied.Data = maps.Clone(resource.Data)
+	return &copied, nil
+}
+
+// findGrant returns the grantee's most recent grant on a resource and
+// whether it is active
+func (tm *TenantManager) findGrant(resourceID, granteeTenantID string) (*ResourceGrant, bool) {
+	tm.grantsMu.RLock()
+	defer tm.grantsMu.RUnlock()
+
+	now := tm.now()
+	var latest *ResourceGrant
+	for _, grant := range tm.grants[resourceID] {
+		if grant.GranteeTenantID != granteeTenantID {
+			continue
+		}
+		if grant.Active(now) {
+			return grant, true
+		}
+		latest = grant
+	}
+	return latest, false
+}
+
+// removeGrants drops every grant the tenant has given or received
+func (tm *TenantManager) removeGrants(tenantID string) {
+	tm.grantsMu.Lock()
+	defer tm.grantsMu.Unlock()
+
+	for resourceID, grants := range tm.grants {
+		kept := grants[:0]
+		for _, grant := range grants {
+			if grant.OwnerTenantID != tenantID && grant.GranteeTenantID != tenantID {
+				kept = append(kept, grant)
+			}
+		}
+		clear(grants[len(kept):])
+		if len(kept) == 0 {
+			delete(tm.grants, resourceID)
+		} else {
+			tm.grants[resourceID] = kept
+		}
+	}
+}
+
+// ========== Tenant Hierarchy ==========
+
+// HierarchyOptions controls how a child tenant relates to its parent
+type HierarchyOptions struct {
+	PoolQuota       bool // draw on the parent's quota instead of its own
+	VisibleToParent bool // let the parent read the child's resources
+}
+
+// SetParent makes tenantID a child of parentID, or detaches it when
+// parentID is empty. Moves that would create a cycle are refused.
+func (tm *TenantManager) SetParent(tenantID, parentID string, opts HierarchyOptions) error {
+	tm.tenantsMu.Lock()
+	defer tm.tenantsMu.Unlock()
+
+	tenant, exists := tm.tenants[tenantID]
+	if !exists {
+		return errors.New("tenant not found")
+	}
+
+	updated := *tenant
+	updated.ParentID = ""
+	updated.PooledQuota = false
+	updated.VisibleToParent = false
+
+	if parentID != "" {
+		parent, exists := tm.tenants[parentID]
+		if !exists {
+			return errors.New("parent tenant not found")
+		}
+		if parent.Status == "deleted" {
+			return errors.New("parent tenant is deleted")
+		}
+		for id := parentID; id != ""; {
+			if id == tenantID {
+				return errors.New("tenant hierarchy cycle")
+			}
+			ancestor, exists := tm.tenants[id]
+			if !exists {
+				break
+			}
+			id = ancestor.ParentID
+		}
+
+		updated.ParentID = parentID
+		updated.PooledQuota = opts.PoolQuota
+		updated.VisibleToParent = opts.VisibleToParent
+	}
+
+	updated.UpdatedAt = time.Now()
+	if err := tm.persistTenant(&updated); err != nil {
+		return err
+	}
+	*tenant = updated
+
+	tm.logAudit(tenantID, "", "SET_PARENT", tenantID, map[string]interface{}{
+		"parent_id":         parentID,
+		"pooled_quota":      updated.PooledQuota,
+		"visible_to_parent": updated.VisibleToParent,
+	})
+
+	return nil
+}
+
+// GetChildren lists a tenant's direct children
+func (tm *TenantManager) GetChildren(tenantID string) []*Tenant {
+	tm.tenantsMu.RLock()
+	defer tm.tenantsMu.RUnlock()
+
+	var children []*Tenant
+	for _, tenant := range tm.tenants {
+		if tenant.ParentID == tenantID {
+			children = append(children, tenant)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].CreatedAt.Before(children[j].CreatedAt) })
+	return children
+}
+
+// ListVisibleResources lists the tenant's own resources followed by those
+// of descendants that are visible to it
+func (tm *TenantManager) ListVisibleResources(tenantID string) ([]*TenantResource, error) {
+	if _, err := tm.GetTenant(tenantID); err != nil {
+		return nil, err
+	}
+
+	tm.tenantsMu.RLock()
+	members := tm.subtreeLocked(tenantID, func(t *Tenant) bool { return t.VisibleToParent })
+	tm.tenantsMu.RUnlock()
+
+	tm.resourcesMu.RLock()
+	var result []*TenantResource
+	for _, id := range members {
+		result = append(result, tm.resources[id]...)
+	}
+	tm.resourcesMu.RUnlock()
+
+	return tm.readResources(result)
+}
+
+// quotaOwner returns the tenant whose quota tenantID draws on
+func (tm *TenantManager) quotaOwner(tenantID string) string {
+	tm.tenantsMu.RLock()
+	defer tm.tenantsMu.RUnlock()
+
+	id := tenantID
+	for {
+		tenant, exists := tm.tenants[id]
+		if !exists || !tenant.PooledQuota || tenant.ParentID == "" {
+			return id
+		}
+		id = tenant.ParentID
+	}
+}
+
+// effectiveQuota returns the quota tenantID draws on, which is an
+// ancestor's when quotas are pooled
+func (tm *TenantManager) effectiveQuota(tenantID string) (*ResourceQuota, error) {
+	return tm.GetQuota(tm.quotaOwner(tenantID))
+}
+
+// poolResourceCount counts resources across every tenant sharing ownerID's quota
+func (tm *TenantManager) poolResourceCount(ownerID string) int {
+	tm.tenantsMu.RLock()
+	members := tm.subtreeLocked(ownerID, func(t *Tenant) bool { return t.PooledQuota })
+	tm.tenantsMu.RUnlock()
+
+	count := 0
+	for _, id := range members {
+		count += tm.getResourceCount(id)
+	}
+	return count
+}
+
+// findVisibleResource looks for resourceID among the descendants whose
+// resources are visible to tenantID and returns it with its owner
+func (tm *TenantManager) findVisibleResource(tenantID, resourceID string) (*TenantResource, string) {
+	tm.tenantsMu.RLock()
+	members := tm.subtreeLocked(tenantID, func(t *Tenant) bool { return t.VisibleToParent })
+	tm.tenantsMu.RUnlock()
+
+	tm.resourcesMu.RLock()
+	defer tm.resourcesMu.RUnlock()
+
+	for _, id := range members[1:] {
+		for _, resource := range tm.resources[id] {
+			if resource.ID == resourceID {
+				return resource, id
+			}
+		}
+	}
+	return nil, ""
+}
+
+// subtreeLocked returns tenantID followed by its descendants, descending
+// only into children for which follow returns true. The caller holds
+// tenantsMu.
+func (tm *TenantManager) subtreeLocked(tenantID string, follow func(child *Tenant) bool) []string {
+	children := make(map[string][]*Tenant)
+	for _, tenant := range tm.tenants {
+		if tenant.ParentID != "" {
+			children[tenant.ParentID] = append(children[tenant.ParentID], tenant)
+		}
+	}
+
+	members := []string{tenantID}
+	for i := 0; i < len(members); i++ {
+		for _, child := range children[members[i]] {
+			if follow(child) {
+				members = append(members, child.ID)
+			}
+		}
+	}
+	return members
+}
+
+// ========== Tenant Encryption Keys ==========
+
+// EncryptedData is resource data sealed with a tenant's data key
+type EncryptedData struct {
+	KeyVersion int    `json:"key_version"`
+	Ciphertext []byte `json:"ciphertext"` // nonce followed by the AES-GCM output
+}
+
+// KeyManager holds a versioned AES-256 data-encryption key per tenant. Data
+// keys are kept wrapped by the master key and unwrapped per use.
+type KeyManager struct {
+	master cipher.AEAD
+	keys   map[string][]wrappedKey // tenant -> versions, oldest first
+	mu     sync.RWMutex
+}
+
+type wrappedKey struct {
+	version   int
+	wrapped   []byte
+	createdAt time.Time
+}
+
+// NewKeyManager creates a key manager with a 32-byte master key
+func NewKeyManager(masterKey []byte) (*KeyManager, error) {
+	if len(masterKey) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyManager{master: master, keys: make(map[string][]wrappedKey)}, nil
+}
+
+// Provision creates the tenant's first data key if it has none and returns
+// the current key version
+func (km *KeyManager) Provision(tenantID string) (int, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if versions := km.keys[tenantID]; len(versions) > 0 {
+		return versions[len(versions)-1].version, nil
+	}
+	return km.addKeyLocked(tenantID)
+}
+
+// Rotate adds a new key version for the tenant. Older versions stay
+// available for decryption.
+func (km *KeyManager) Rotate(tenantID string) (int, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return km.addKeyLocked(tenantID)
+}
+
+// CurrentVersion returns the tenant's newest key version, or 0 if none
+func (km *KeyManager) CurrentVersion(tenantID string) int {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return len(km.keys[tenantID])
+}
+
+// DeleteKeys destroys the tenant's keys, leaving its encrypted data unreadable
+func (km *KeyManager) DeleteKeys(tenantID string) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	delete(km.keys, tenantID)
+}
+
+// Encrypt seals plaintext with the tenant's current key, provisioning one on
+// first use. aad binds the ciphertext to its context.
+func (km *KeyManager) Encrypt(tenantID string, plaintext, aad []byte) (*EncryptedData, error) {
+	version, err := km.Provision(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := km.dataKey(tenantID, version)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealAEAD(aead, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedData{KeyVersion: version, Ciphertext: ciphertext}, nil
+}
+
+// Decrypt opens data with the key version it was sealed with
+func (km *KeyManager) Decrypt(tenantID string, data *EncryptedData, aad []byte) ([]byte, error) {
+	aead, err := km.dataKey(tenantID, data.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, data.Ciphertext, aad)
+}
+
+func (km *KeyManager) addKeyLocked(tenantID string) (int, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return 0, err
+	}
+
+	version := len(km.keys[tenantID]) + 1
+	wrapped, err := sealAEAD(km.master, dek, keyAAD(tenantID, version))
+	if err != nil {
+		return 0, err
+	}
+	km.keys[tenantID] = append(km.keys[tenantID], wrappedKey{version: version, wrapped: wrapped, createdAt: time.Now()})
+	return version, nil
+}
+
+func (km *KeyManager) dataKey(tenantID string, version int) (cipher.AEAD, error) {
+	km.mu.RLock()
+	versions := km.keys[tenantID]
+	km.mu.RUnlock()
+
+	if version < 1 || version > len(versions) {
+		return nil, errors.New("data key not found")
+	}
+	dek, err := openAEAD(km.master, versions[version-1].wrapped, keyAAD(tenantID, version))
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dek)
+}
+
+func keyAAD(tenantID string, version int) []byte {
+	return []byte(fmt.Sprintf("%s/v%d", tenantID, version))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealAEAD(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func openAEAD(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("decryption failed")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:n], ciphertext[n:], aad)
+	if err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	return plaintext, nil
+}
+
+// SetKeyManager turns on encryption of resource data at rest. Resources
+// created afterwards are stored sealed and decrypted on read. Call it
+// before the manager is used.
+func (tm *TenantManager) SetKeyManager(km *KeyManager) {
+	tm.keyManager = km
+}
+
+// RotateTenantKey rotates the tenant's data key. Existing resources are
+// re-encrypted with the new key the next time they are read.
+func (tm *TenantManager) RotateTenantKey(tenantID string) (int, error) {
+	if tm.keyManager == nil {
+		return 0, errors.New("no key manager configured")
+	}
+	if _, err := tm.GetTenant(tenantID); err != nil {
+		return 0, err
+	}
+
+	version, err := tm.keyManager.Rotate(tenantID)
+	if err != nil {
+		return 0, err
+	}
+	tm.logAudit(tenantID, "", "ROTATE_KEY", tenantID, map[string]interface{}{"key_version": version})
+	return version, nil
+}
+
+// sealResource returns a copy of r with Data encrypted
+func (tm *TenantManager) sealResource(r *TenantResource) (*TenantResource, error) {
+	plaintext, err := json.Marshal(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := tm.keyManager.Encrypt(r.TenantID, plaintext, resourceAAD(r))
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := *r
+	sealed.Data = nil
+	sealed.Encrypted = encrypted
+	return &sealed, nil
+}
+
+// readResource returns r ready to read: r itself if it is stored in the
+// clear, otherwise a decrypted copy. Data sealed with an old key version is
+// re-encrypted with the current one.
+func (tm *TenantManager) readResource(r *TenantResource) (*TenantResource, error) {
+	tm.resourcesMu.RLock()
+	sealed := *r
+	tm.resourcesMu.RUnlock()
+
+	if sealed.Encrypted == nil {
+		return r, nil
+	}
+	if tm.keyManager == nil {
+		return nil, errors.New("resource is encrypted but no key manager is configured")
+	}
+	if status, err := tm.tenantStatus(r.TenantID); err == nil && status == "suspended" {
+		return nil, errors.New("tenant is suspended: resource data cannot be decrypted")
+	}
+
+	plaintext, err := tm.keyManager.Decrypt(r.TenantID, sealed.Encrypted, resourceAAD(&sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	opened := sealed
+	opened.Encrypted = nil
+	if err := json.Unmarshal(plaintext, &opened.Data); err != nil {
+		return nil, err
+	}
+
+	if sealed.Encrypted.KeyVersion != tm.keyManager.CurrentVersion(r.TenantID) {
+		tm.resealResource(r, sealed.Encrypted, &opened)
+	}
+
+	return &opened, nil
+}
+
+// resealResource re-encrypts a stored resource with the current key unless
+// it changed since old was read. Failures leave the old ciphertext in place
+// for the next read to retry.
+func (tm *TenantManager) resealResource(stored *TenantResource, old *EncryptedData, opened *TenantResource) {
+	resealed, err := tm.sealResource(opened)
+	if err != nil {
+		return
+	}
+	if err := tm.persistResource(resealed); err != nil {
+		return
+	}
+
+	tm.resourcesMu.Lock()
+	if stored.Encrypted == old {
+		stored.Encrypted = resealed.Encrypted
+	}
+	tm.resourcesMu.Unlock()
+}
+
+// resourceAAD binds a resource's ciphertext to its tenant and ID
+func resourceAAD(r *TenantResource) []byte {
+	return []byte(r.TenantID + "/" + r.ID)
+}
+
+// tenantStatus reads a tenant's status under the tenants lock
+func (tm *TenantManager) tenantStatus(tenantID string) (string, error) {
+	tm.tenantsMu.RLock()
+	defer tm.tenantsMu.RUnlock()
+
+	tenant, exists := tm.tenants[tenantID]
+	if !exists {
+		return "", errors.New("tenant not found")
+	}
+	return tenant.Status, nil
+}
+
+// ========== Audit Logging ==========
+
+// defaultAuditPageSize and maxAuditPageSize bound QueryAuditLog pages
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditRetention limits how much audit history is kept per tenant. Zero
+// values mean no limit.
+type AuditRetention struct {
+	MaxAge              time.Duration
+	MaxEntriesPerTenant int
+}
+
+// AuditQuery filters a tenant's audit log. Empty fields match everything;
+// the time range is [Since, Until).
+type AuditQuery struct {
+	Action string
+	UserID string
+	Since  time.Time
+	Until  time.Time
+	Cursor string // NextCursor from the previous page
+	Limit  int
+}
+
+// AuditPage is one page of audit entries, oldest first
+type AuditPage struct {
+	Entries    []*AuditLogEntry `json:"entries"`
+	NextCursor string           `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+func (tm *TenantManager) logAudit(tenantID, userID, action, resourceID string, details map[string]interface{}) {
+	tm.appendAudit(&AuditLogEntry{
+		TenantID:   tenantID,
+		UserID:     userID,
+		Action:     action,
+		ResourceID: resourceID,
+		Details:    details,
+	})
+}
+
+// appendAudit timestamps and stores an entry in its tenant's log
+func (tm *TenantManager) appendAudit(entry *AuditLogEntry) {
+	entry.Timestamp = tm.now()
+	tenantID := entry.TenantID
+
+	tm.auditLogMu.Lock()
+	defer tm.auditLogMu.Unlock()
+
+	tm.auditSeq++
+	entry.Seq = tm.auditSeq
+	entries := append(tm.auditLog[tenantID], entry)
+	if limit := tm.auditRetention.MaxEntriesPerTenant; limit > 0 && len(entries) > limit {
+		clear(entries[:len(entries)-limit])
+		entries = entries[len(entries)-limit:]
+	}
+	tm.auditLog[tenantID] = entries
+}
+
+// GetAuditLog retrieves audit log for a tenant
+func (tm *TenantManager) GetAuditLog(tenantID string) []*AuditLogEntry {
+	tm.auditLogMu.RLock()
+	defer tm.auditLogMu.RUnlock()
+
+	entries := tm.auditLog[tenantID]
+	if len(entries) == 0 {
+		return nil
+	}
+	return append([]*AuditLogEntry(nil), entries...)
+}
+
+// QueryAuditLog returns a page of the tenant's audit entries matching q
+func (tm *TenantManager) QueryAuditLog(tenantID string, q AuditQuery) (*AuditPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditPageSize
+	}
+	limit = min(limit, maxAuditPageSize)
+
+	var after uint64
+	if q.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err == nil {
+			after, err = strconv.ParseUint(string(raw), 10, 64)
+		}
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+
+	tm.auditLogMu.RLock()
+	defer tm.auditLogMu.RUnlock()
+
+	// Entries are appended in sequence and time order, so both the cursor
+	// and Since can be found by binary search
+	entries := tm.auditLog[tenantID]
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Seq > after })
+	if !q.Since.IsZero() {
+		start = max(start, sort.Search(len(entries), func(i int) bool { return !entries[i].Timestamp.Before(q.Since) }))
+	}
+
+	page := &AuditPage{Entries: []*AuditLogEntry{}}
+	for _, entry := range entries[start:] {
+		if !q.Until.IsZero() && !entry.Timestamp.Before(q.Until) {
+			break
+		}
+		if (q.Action != "" && entry.Action != q.Action) || (q.UserID != "" && entry.UserID != q.UserID) {
+			continue
+		}
+		if len(page.Entries) == limit {
+			last := page.Entries[limit-1].Seq
+			page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(last, 10)))
+			break
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+
+	return page, nil
+}
+
+// SetAuditRetention sets the audit retention policy. The entry limit is
+// applied as entries are written; the age limit by PruneAuditLog.
+func (tm *TenantManager) SetAuditRetention(retention AuditRetention) {
+	tm.auditLogMu.Lock()
+	defer tm.auditLogMu.Unlock()
+	tm.auditRetention = retention
+}
+
+// PruneAuditLog drops entries older than the retention MaxAge and returns
+// how many were removed
+func (tm *TenantManager) PruneAuditLog(now time.Time) int {
+	tm.auditLogMu.Lock()
+	defer tm.auditLogMu.Unlock()
+
+	if tm.auditRetention.MaxAge <= 0 {
+		return 0
+	}
+
+	cutoff := now.Add(-tm.auditRetention.MaxAge)
+	removed := 0
+	for tenantID, entries := range tm.auditLog {
+		i := sort.Search(len(entries), func(i int) bool { return !entries[i].Timestamp.Before(cutoff) })
+		if i == 0 {
+			continue
+		}
+		removed += i
+		if i == len(entries) {
+			delete(tm.auditLog, tenantID)
+			continue
+		}
+		tm.auditLog[tenantID] = append([]*AuditLogEntry(nil), entries[i:]...)
+	}
+
+	return removed
+}
+
+// ========== Tenant Routing ==========
+
+// RegisterTenantRoute registers a database URL for a tenant
+func (tm *TenantManager) RegisterTenantRoute(tenantID, databaseURL string) error {
+	if _, err := tm.GetTenant(tenantID); err != nil {
+		return err
+	}
+
+	tm.routesMu.Lock()
+	tm.tenantRoutes[tenantID] = databaseURL
+	tm.routesMu.Unlock()
+
+	return nil
+}
+
+// GetTenantRoute retrieves the database URL for a tenant
+func (tm *TenantManager) GetTenantRoute(tenantID string) (string, error) {
+	tm.routesMu.RLock()
+	defer tm.routesMu.RUnlock()
+
+	url, exists := tm.tenantRoutes[tenantID]
+	if !exists {
+		// Return default or tenant's configured database
+		tenant, err := tm.GetTenant(tenantID)
+		if err != nil {
+			return "", err
+		}
+		return tenant.DatabaseURL, nil
+	}
+
+	return url, nil
+}
+
+// ========== Connection Pool Routing ==========
+
+// PoolConfig controls the pools opened by a TenantConnectionRouter
+type PoolConfig struct {
+	MaxOpenConns int           // per pool; 0 means unlimited
+	MaxIdleConns int           // per pool; 0 keeps the database/sql default
+	IdleTimeout  time.Duration // pools unused for this long are closed; 0 disables eviction
+
+	// ShardKey maps a tenant's route to the pool it uses. Tenants with the
+	// same key share a pool. The default keys pools by route, so tenants
+	// on a shared database share one pool and tenants with their own
+	// database get their own.
+	ShardKey func(tenantID, route string) string
+}
+
+// PoolStats describes one pool of a TenantConnectionRouter
+type PoolStats struct {
+	Key      string      `json:"key"`
+	Route    string      `json:"route"`
+	Tenants  []string    `json:"tenants"`
+	LastUsed time.Time   `json:"last_used"`
+	DB       sql.DBStats `json:"db"`
+}
+
+// RouterStats summarizes a TenantConnectionRouter
+type RouterStats struct {
+	Pools   []PoolStats `json:"pools"`
+	Opened  int64       `json:"opened"`
+	Evicted int64       `json:"evicted"`
+}
+
+// TenantConnectionRouter hands out database pools for tenants based on
+// their route. Pools are opened on first use and closed once idle.
+type TenantConnectionRouter struct {
+	tm      *TenantManager
+	open    func(dsn string) (*sql.DB, error)
+	config  PoolConfig
+	pools   map[string]*tenantPool
+	opened  int64
+	evicted int64
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+type tenantPool struct {
+	key      string
+	route    string
+	db       *sql.DB
+	tenants  map[string]bool
+	lastUsed time.Time
+}
+
+// NewTenantConnectionRouter creates a router that opens pools with open,
+// typically a wrapper around sql.Open
+func NewTenantConnectionRouter(tm *TenantManager, open func(dsn string) (*sql.DB, error), config PoolConfig) *TenantConnectionRouter {
+	return &TenantConnectionRouter{
+		tm:     tm,
+		open:   open,
+		config: config,
+		pools:  make(map[string]*tenantPool),
+		now:    time.Now,
+	}
+}
+
+// DB returns the pool for the tenant's current route, opening it if
+// needed. Call DB for each unit of work rather than keeping the result,
+// since idle pools are closed.
+func (r *TenantConnectionRouter) DB(tenantID string) (*sql.DB, error) {
+	route, err := r.tm.GetTenantRoute(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if route == "" {
+		return nil, errors.New("tenant has no database route")
+	}
+
+	key := route
+	if r.config.ShardKey != nil {
+		key = r.config.ShardKey(tenantID, route)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool, exists := r.pools[key]
+	if !exists {
+		db, err := r.open(route)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(r.config.MaxOpenConns)
+		if r.config.MaxIdleConns > 0 {
+			db.SetMaxIdleConns(r.config.MaxIdleConns)
+		}
+
+		pool = &tenantPool{key: key, route: route, db: db, tenants: make(map[string]bool)}
+		r.pools[key] = pool
+		r.opened++
+	}
+
+	pool.tenants[tenantID] = true
+	pool.lastUsed = r.now()
+	return pool.db, nil
+}
+
+// EvictIdle closes pools that have not been used within the idle timeout
+// and returns their keys
+func (r *TenantConnectionRouter) EvictIdle(now time.Time) []string {
+	if r.config.IdleTimeout <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	var idle []*tenantPool
+	for key, pool := range r.pools {
+		if now.Sub(pool.lastUsed) >= r.config.IdleTimeout {
+			idle = append(idle, pool)
+			delete(r.pools, key)
+		}
+	}
+	r.evicted += int64(len(idle))
+	r.mu.Unlock()
+
+	// Close waits for in-flight queries, so do it outside the lock
+	keys := make([]string, 0, len(idle))
+	for _, pool := range idle {
+		pool.db.Close()
+		keys = append(keys, pool.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RunEviction evicts idle pools on every tick of interval until ctx is done
+func (r *TenantConnectionRouter) RunEviction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.EvictIdle(r.now())
+		}
+	}
+}
+
+// Stats returns per-pool statistics ordered by key
+func (r *TenantConnectionRouter) Stats() RouterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := RouterStats{Opened: r.opened, Evicted: r.evicted}
+	for _, pool := range r.pools {
+		tenants := make([]string, 0, len(pool.tenants))
+		for id := range pool.tenants {
+			tenants = append(tenants, id)
+		}
+		sort.Strings(tenants)
+		stats.Pools = append(stats.Pools, PoolStats{
+			Key:      pool.key,
+			Route:    pool.route,
+			Tenants:  tenants,
+			LastUsed: pool.lastUsed,
+			DB:       pool.db.Stats(),
+		})
+	}
+	sort.Slice(stats.Pools, func(i, j int) bool { return stats.Pools[i].Key < stats.Pools[j].Key })
+	return stats
+}
+
+// Close closes every pool
+func (r *TenantConnectionRouter) Close() error {
+	r.mu.Lock()
+	pools := r.pools
+	r.pools = make(map[string]*tenantPool)
+	r.mu.Unlock()
+
+	var errs []error
+	for _, pool := range pools {
+		errs = append(errs, pool.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ========== Storage Backends ==========
+
+// TenantRepository persists tenants
+type TenantRepository interface {
+	SaveTenant(ctx context.Context, tenant *Tenant) error
+	GetTenant(ctx context.Context, tenantID string) (*Tenant, error)
+	ListTenants(ctx context.Context) ([]*Tenant, error)
+	DeleteTenant(ctx context.Context, tenantID string) error
+}
+
+// ResourceRepository persists resources. Every call is scoped to one tenant.
+type ResourceRepository interface {
+	SaveResource(ctx context.Context, resource *TenantResource) error
+	GetResource(ctx context.Context, tenantID, resourceID string) (*TenantResource, error)
+	ListResources(ctx context.Context, tenantID string) ([]*TenantResource, error)
+	DeleteResource(ctx context.Context, tenantID, resourceID string) error
+}
+
+// SetRepositories makes the manager write tenants and resources through to
+// the given repositories, keeping its maps as a cache. Call it before the
+// manager is used; either repository may be nil.
+func (tm *TenantManager) SetRepositories(tenants TenantRepository, resources ResourceRepository) {
+	tm.tenantRepo = tenants
+	tm.resourceRepo = resources
+}
+
+// LoadFromRepositories fills the cache with the stored tenants and their
+// resources, creating quotas for tenants that have none
+func (tm *TenantManager) LoadFromRepositories(ctx context.Context) error {
+	if tm.tenantRepo == nil {
+		return errors.New("no tenant repository configured")
+	}
+
+	tenants, err := tm.tenantRepo.ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		var resources []*TenantResource
+		if tm.resourceRepo != nil {
+			if resources, err = tm.resourceRepo.ListResources(ctx, tenant.ID); err != nil {
+				return err
+			}
+		}
+
+		tm.tenantsMu.Lock()
+		tm.tenants[tenant.ID] = tenant
+		tm.tenantsMu.Unlock()
+
+		if _, err := tm.GetQuota(tenant.ID); err != nil {
+			tm.createQuotaForTenant(tenant.ID, tenant.Plan)
+		}
+
+		tm.resourcesMu.Lock()
+		tm.resources[tenant.ID] = resources
+		tm.resourcesMu.Unlock()
+	}
+
+	return nil
+}
+
+func (tm *TenantManager) persistTenant(tenant *Tenant) error {
+	if tm.tenantRepo == nil {
+		return nil
+	}
+	return tm.tenantRepo.SaveTenant(context.Background(), tenant)
+}
+
+func (tm *TenantManager) persistResource(resource *TenantResource) error {
+	if tm.resourceRepo == nil {
+		return nil
+	}
+	return tm.resourceRepo.SaveResource(context.Background(), resource)
+}
+
+func (tm *TenantManager) removeResource(tenantID, resourceID string) error {
+	if tm.resourceRepo == nil {
+		return nil
+	}
+	return tm.resourceRepo.DeleteResource(context.Background(), tenantID, resourceID)
+}
+
+// MemoryRepository is an in-memory TenantRepository and ResourceRepository.
+// It stores copies, so callers can't change stored values by accident.
+type MemoryRepository struct {
+	tenants   map[string]Tenant
+	resources map[string]map[string]TenantResource // tenant -> resource ID -> resource
+	mu        sync.RWMutex
+}
+
+// NewMemoryRepository creates an empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		tenants:   make(map[string]Tenant),
+		resources: make(map[string]map[string]TenantResource),
+	}
+}
+
+// SaveTenant inserts or replaces a tenant
+func (r *MemoryRepository) SaveTenant(ctx context.Context, tenant *Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants[tenant.ID] = *tenant
+	return nil
+}
+
+// GetTenant retrieves a tenant
+func (r *MemoryRepository) GetTenant(ctx context.Context, tenantID string) (*Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tenant, exists := r.tenants[tenantID]
+	if !exists {
+		return nil, errors.New("tenant not found")
+	}
+	return &tenant, nil
+}
+
+// ListTenants lists all tenants by creation time
+func (r *MemoryRepository) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tenants := make([]*Tenant, 0, len(r.tenants))
+	for _, tenant := range r.tenants {
+		tenants = append(tenants, &tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].CreatedAt.Before(tenants[j].CreatedAt) })
+	return tenants, nil
+}
+
+// DeleteTenant deletes a tenant and its resources
+func (r *MemoryRepository) DeleteTenant(ctx context.Context, tenantID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tenants[tenantID]; !exists {
+		return errors.New("tenant not found")
+	}
+	delete(r.tenants, tenantID)
+	delete(r.resources, tenantID)
+	return nil
+}
+
+// SaveResource inserts or replaces a resource
+func (r *MemoryRepository) SaveResource(ctx context.Context, resource *TenantResource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for tenantID, resources := range r.resources {
+		if _, exists := resources[resource.ID]; exists && tenantID != resource.TenantID {
+			return errors.New("access denied: resource belongs to different tenant")
+		}
+	}
+
+	if r.resources[resource.TenantID] == nil {
+		r.resources[resource.TenantID] = make(map[string]TenantResource)
+	}
+	r.resources[resource.TenantID][resource.ID] = *resource
+	return nil
+}
+
+// GetResource retrieves a tenant's resource
+func (r *MemoryRepository) GetResource(ctx context.Context, tenantID, resourceID string) (*TenantResource, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	resource, exists := r.resources[tenantID][resourceID]
+	if !exists {
+		return nil, errors.New("resource not found")
+	}
+	return &resource, nil
+}
+
+// ListResources lists a tenant's resources by creation time
+func (r *MemoryRepository) ListResources(ctx context.Context, tenantID string) ([]*TenantResource, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	resources := make([]*TenantResource, 0, len(r.resources[tenantID]))
+	for _, resource := range r.resources[tenantID] {
+		resources = append(resources, &resource)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].CreatedAt.Before(resources[j].CreatedAt) })
+	return resources, nil
+}
+
+// DeleteResource deletes a tenant's resource
+func (r *MemoryRepository) DeleteResource(ctx context.Context, tenantID, resourceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.resources[tenantID][resourceID]; !exists {
+		return errors.New("resource not found")
+	}
+	delete(r.resources[tenantID], resourceID)
+	return nil
+}
+
+const createTenantsTable = `CREATE TABLE IF NOT EXISTS tenants (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	plan TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	settings JSONB,
+	database_url TEXT,
+	schema_name TEXT,
+	deleted_at TIMESTAMPTZ,
+	parent_id TEXT,
+	pooled_quota BOOLEAN NOT NULL DEFAULT FALSE,
+	visible_to_parent BOOLEAN NOT NULL DEFAULT FALSE
+)`
+
+const createResourcesTable = `CREATE TABLE IF NOT EXISTS tenant_resources (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	data JSONB,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	encrypted JSONB
+)`
+
+const tenantColumns = "id, name, plan, status, created_at, updated_at, settings, database_url, schema_name, deleted_at, " +
+	"parent_id, pooled_quota, visible_to_parent"
+
+const resourceColumns = "id, tenant_id, name, data, created_at, updated_at, encrypted"
+
+// querier is the part of *sql.DB and *sql.Tx that SQLRepository uses
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// SQLRepository stores tenants in a control database. Where resources are
+// stored depends on the isolation mode:
+//   - "database": in the tenant's own database at its DatabaseURL
+//   - "schema": in the shared database, with search_path set to the
+//     tenant's schema for each call
+//   - "row-level": in one shared table
+//
+// Resource queries filter on tenant_id in every mode.
+type SQLRepository struct {
+	control       *sql.DB
+	isolationMode string
+	open          func(dsn string) (*sql.DB, error)
+	pools         map[string]*sql.DB // DSN -> tenant database
+	mu            sync.Mutex
+}
+
+// NewSQLRepository creates a SQL repository. open connects to tenant
+// databases and is only needed in "database" mode.
+func NewSQLRepository(control *sql.DB, isolationMode string, open func(dsn string) (*sql.DB, error)) (*SQLRepository, error) {
+	switch isolationMode {
+	case "database":
+		if open == nil {
+			return nil, errors.New("database isolation requires an open function")
+		}
+	case "schema", "row-level":
+	default:
+		return nil, fmt.Errorf("unknown isolation mode: %s", isolationMode)
+	}
+
+	return &SQLRepository{
+		control:       control,
+		isolationMode: isolationMode,
+		open:          open,
+		pools:         make(map[string]*sql.DB),
+	}, nil
+}
+
+// Migrate creates the shared tables
+func (r *SQLRepository) Migrate(ctx context.Context) error {
+	if _, err := r.control.ExecContext(ctx, createTenantsTable); err != nil {
+		return err
+	}
+	if r.isolationMode == "row-level" {
+		_, err := r.control.ExecContext(ctx, createResourcesTable)
+		return err
+	}
+	return nil
+}
+
+// ProvisionTenant creates the tenant's schema or resource table. The tenant
+// must already be saved. It does nothing in "row-level" mode.
+func (r *SQLRepository) ProvisionTenant(ctx context.Context, tenantID string) error {
+	switch r.isolationMode {
+	case "row-level":
+		return nil
+	case "schema":
+		_, schema, err := r.tenantLocation(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		if _, err := r.control.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+quoteIdent(schema)); err != nil {
+			return err
+		}
+	}
+
+	return r.withTenant(ctx, tenantID, func(q querier) error {
+		_, err := q.ExecContext(ctx, createResourcesTable)
+		return err
+	})
+}
+
+// Close closes the tenant database pools. The control database is left open.
+func (r *SQLRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for dsn, db := range r.pools {
+		errs = append(errs, db.Close())
+		delete(r.pools, dsn)
+	}
+	return errors.Join(errs...)
+}
+
+// SaveTenant inserts or updates a tenant
+func (r *SQLRepository) SaveTenant(ctx context.Context, tenant *Tenant) error {
+	settings, err := json.Marshal(tenant.Settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.control.ExecContext(ctx,
+		"INSERT INTO tenants ("+tenantColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) "+
+			"ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, plan = EXCLUDED.plan, status = EXCLUDED.status, "+
+			"updated_at = EXCLUDED.updated_at, settings = EXCLUDED.settings, "+
+			"database_url = EXCLUDED.database_url, schema_name = EXCLUDED.schema_name, deleted_at = EXCLUDED.deleted_at, "+
+			"parent_id = EXCLUDED.parent_id, pooled_quota = EXCLUDED.pooled_quota, visible_to_parent = EXCLUDED.visible_to_parent",
+		tenant.ID, tenant.Name, tenant.Plan, tenant.Status, tenant.CreatedAt, tenant.UpdatedAt,
+		string(settings), tenant.DatabaseURL, tenant.SchemaName, sql.NullTime{Time: tenant.DeletedAt, Valid: !tenant.DeletedAt.IsZero()},
+		sql.NullString{String: tenant.ParentID, Valid: tenant.ParentID != ""}, tenant.PooledQuota, tenant.VisibleToParent)
+	return err
+}
+
+// GetTenant retrieves a tenant
+func (r *SQLRepository) GetTenant(ctx context.Context, tenantID string) (*Tenant, error) {
+	row := r.control.QueryRowContext(ctx, "SELECT "+tenantColumns+" FROM tenants WHERE id = $1", tenantID)
+	tenant, err := scanTenant(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("tenant not found")
+	}
+	return tenant, err
+}
+
+// ListTenants lists all tenants by creation time
+func (r *SQLRepository) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	rows, err := r.control.QueryContext(ctx, "SELECT "+tenantColumns+" FROM tenants ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []*Tenant
+	for rows.Next() {
+		tenant, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// DeleteTenant deletes the tenant row. Resources are deleted separately,
+// since they may live in another database or schema.
+func (r *SQLRepository) DeleteTenant(ctx context.Context, tenantID string) error {
+	result, err := r.control.ExecContext(ctx, "DELETE FROM tenants WHERE id = $1", tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("tenant not found")
+	}
+	return nil
+}
+
+// SaveResource inserts or updates a resource. Updating a resource that
+// belongs to another tenant is refused.
+func (r *SQLRepository) SaveResource(ctx context.Context, resource *TenantResource) error {
+	data, err := json.Marshal(resource.Data)
+	if err != nil {
+		return err
+	}
+	var encrypted sql.NullString
+	if resource.Encrypted != nil {
+		raw, err := json.Marshal(resource.Encrypted)
+		if err != nil {
+			return err
+		}
+		encrypted = sql.NullString{String: string(raw), Valid: true}
+	}
+
+	return r.withTenant(ctx, resource.TenantID, func(q querier) error {
+		result, err := q.ExecContext(ctx,
+			"INSERT INTO tenant_resources ("+resourceColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+				"ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, data = EXCLUDED.data, "+
+				"updated_at = EXCLUDED.updated_at, encrypted = EXCLUDED.encrypted "+
+				"WHERE tenant_resources.tenant_id = EXCLUDED.tenant_id",
+			resource.ID, resource.TenantID, resource.Name, string(data), resource.CreatedAt, resource.UpdatedAt, encrypted)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return errors.New("access denied: resource belongs to different tenant")
+		}
+		return nil
+	})
+}
+
+// GetResource retrieves a tenant's resource
+func (r *SQLRepository) GetResource(ctx context.Context, tenantID, resourceID string) (*TenantResource, error) {
+	var resource *TenantResource
+	err := r.withTenant(ctx, tenantID, func(q querier) error {
+		row := q.QueryRowContext(ctx,
+			"SELECT "+resourceColumns+" FROM tenant_resources WHERE tenant_id = $1 AND id = $2",
+			tenantID, resourceID)
+		var err error
+		resource, err = scanResource(row)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("resource not found")
+	}
+	return resource, err
+}
+
+// ListResources lists a tenant's resources by creation time
+func (r *SQLRepository) ListResources(ctx context.Context, tenantID string) ([]*TenantResource, error) {
+	var resources []*TenantResource
+	err := r.withTenant(ctx, tenantID, func(q querier) error {
+		rows, err := q.QueryContext(ctx,
+			"SELECT "+resourceColumns+" FROM tenant_resources WHERE tenant_id = $1 ORDER BY created_at",
+			tenantID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			resource, err := scanResource(rows)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, resource)
+		}
+		return rows.Err()
+	})
+	return resources, err
+}
+
+// DeleteResource deletes a tenant's resource
+func (r *SQLRepository) DeleteResource(ctx context.Context, tenantID, resourceID string) error {
+	return r.withTenant(ctx, tenantID, func(q querier) error {
+		result, err := q.ExecContext(ctx,
+			"DELETE FROM tenant_resources WHERE tenant_id = $1 AND id = $2", tenantID, resourceID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return errors.New("resource not found")
+		}
+		return nil
+	})
+}
+
+// withTenant runs fn against the storage for the tenant's resources
+func (r *SQLRepository) withTenant(ctx context.Context, tenantID string, fn func(q querier) error) error {
+	switch r.isolationMode {
+	case "database":
+		db, err := r.tenantDB(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		return fn(db)
+	case "schema":
+		_, schema, err := r.tenantLocation(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		if schema == "" {
+			return errors.New("tenant has no schema")
+		}
+
+		// SET LOCAL lasts only for this transaction, so the pooled
+		// connection can't leak the schema to the next tenant
+		tx, err := r.control.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+quoteIdent(schema)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	default:
+		return fn(r.control)
+	}
+}
+
+// tenantDB returns the pool for the tenant's own database
+func (r *SQLRepository) tenantDB(ctx context.Context, tenantID string) (*sql.DB, error) {
+	dsn, _, err := r.tenantLocation(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if dsn == "" {
+		return nil, errors.New("tenant has no database URL")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if db, exists := r.pools[dsn]; exists {
+		return db, nil
+	}
+	db, err := r.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	r.pools[dsn] = db
+	return db, nil
+}
+
+// tenantLocation reads the tenant's database URL and schema name
+func (r *SQLRepository) tenantLocation(ctx context.Context, tenantID string) (string, string, error) {
+	var dsn, schema sql.NullString
+	err := r.control.QueryRowContext(ctx,
+		"SELECT database_url, schema_name FROM tenants WHERE id = $1", tenantID).Scan(&dsn, &schema)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", errors.New("tenant not found")
+	}
+	return dsn.String, schema.String, err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTenant(row rowScanner) (*Tenant, error) {
+	var tenant Tenant
+	var settings []byte
+	var dsn, schema, parentID sql.NullString
+	var deletedAt sql.NullTime
+	err := row.Scan(&tenant.ID, &tenant.Name, &tenant.Plan, &tenant.Status,
+		&tenant.CreatedAt, &tenant.UpdatedAt, &settings, &dsn, &schema, &deletedAt,
+		&parentID, &tenant.PooledQuota, &tenant.VisibleToParent)
+	if err != nil {
+		return nil, err
+	}
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, &tenant.Settings); err != nil {
+			return nil, err
+		}
+	}
+	tenant.DatabaseURL = dsn.String
+	tenant.SchemaName = schema.String
+	tenant.DeletedAt = deletedAt.Time
+	tenant.ParentID = parentID.String
+	return &tenant, nil
+}
+
+func scanResource(row rowScanner) (*TenantResource, error) {
+	var resource TenantResource
+	var data, encrypted []byte
+	err := row.Scan(&resource.ID, &resource.TenantID, &resource.Name, &data,
+		&resource.CreatedAt, &resource.UpdatedAt, &encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &resource.Data); err != nil {
+			return nil, err
+		}
+	}
+	if len(encrypted) > 0 {
+		if err := json.Unmarshal(encrypted, &resource.Encrypted); err != nil {
+			return nil, err
+		}
+	}
+	return &resource, nil
+}
+
+// quoteIdent quotes a SQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ========== Tenant Statistics ==========
+
+// GetTenantStats returns statistics for a tenant
+func (tm *TenantManager) GetTenantStats(tenantID string) map[string]interface{} {
+	resourceCount := 0
+	tm.resourcesMu.RLock()
+	if resources, exists := tm.resources[tenantID]; exists {
+		resourceCount = len(resources)
+	}
+	tm.resourcesMu.RUnlock()
+
+	tm.auditLogMu.RLock()
+	auditCount := len(tm.auditLog[tenantID])
+	tm.auditLogMu.RUnlock()
+
+	quota, _ := tm.GetQuota(tenantID)
+	quotaData := make(map[string]interface{})
+	if quota != nil {
+		quota.Mu.RLock()
+		quotaData = map[string]interface{}{
+			"users":    map[string]int{"current": quota.CurrentUsers, "max": quota.MaxUsers},
+			"requests": map[string]int{"current": quota.CurrentRequests, "max": quota.MaxAPIRequests},
+		}
+		quota.Mu.RUnlock()
+	}
+
+	return map[string]interface{}{
+		"tenant_id":      tenantID,
+		"resource_count": resourceCount,
+		"audit_count":    auditCount,
+		"quota":          quotaData,
+		"tree":           tm.treeStats(tenantID),
+	}
+}
+
+// treeStats aggregates usage over the tenant and all its descendants
+func (tm *TenantManager) treeStats(tenantID string) map[string]interface{} {
+	tm.tenantsMu.RLock()
+	members := tm.subtreeLocked(tenantID, func(*Tenant) bool { return true })
+	tm.tenantsMu.RUnlock()
+
+	resourceCount, auditCount, users, requests := 0, 0, 0, 0
+	var storage int64
+	for _, id := range members {
+		resourceCount += tm.getResourceCount(id)
+
+		tm.auditLogMu.RLock()
+		auditCount += len(tm.auditLog[id])
+		tm.auditLogMu.RUnlock()
+
+		// Pooled children record their usage on an ancestor's quota
+		if tm.quotaOwner(id) != id {
+			continue
+		}
+		if quota, err := tm.GetQuota(id); err == nil {
+			quota.Mu.RLock()
+			users += quota.CurrentUsers
+			requests += quota.CurrentRequests
+			storage += quota.CurrentStorage
+			quota.Mu.RUnlock()
+		}
+	}
+
+	return map[string]interface{}{
+		"tenant_count":   len(members),
+		"resource_count": resourceCount,
+		"audit_count":    auditCount,
+		"users":          users,
+		"requests":       requests,
+		"storage":        storage,
+	}
+}
+
+// ========== Data Export & Purge ==========
+
+// SoftDeleteWindow is how long a deleted tenant is kept before it can be
+// purged
+const SoftDeleteWindow = 30 * 24 * time.Hour
+
+// TenantExport is the JSON archive of a tenant's data
+type TenantExport struct {
+	Tenant     *Tenant           `json:"tenant"`
+	Resources  []*TenantResource `json:"resources"`
+	AuditLog   []*AuditLogEntry  `json:"audit_log"`
+	ExportedAt time.Time         `json:"exported_at"`
+}
+
+// exportRecord is one line of an ndjson export
+type exportRecord struct {
+	Type string      `json:"type"` // tenant, resource, audit
+	Data interface{} `json:"data"`
+}
+
+// PurgeReport summarises what PurgeTenant removed, or would remove in a
+// dry run
+type PurgeReport struct {
+	TenantID     string    `json:"tenant_id"`
+	DryRun       bool      `json:"dry_run"`
+	Resources    int       `json:"resources"`
+	AuditEntries int       `json:"audit_entries"`
+	UsageBuckets int       `json:"usage_buckets"`
+	PurgedAt     time.Time `json:"purged_at"`
+}
+
+// ExportTenantData exports the tenant, its resources and its audit entries
+// as "json" (one document) or "ndjson" (one typed record per line)
+func (tm *TenantManager) ExportTenantData(tenantID, format string) ([]byte, error) {
+	if format != "json" && format != "ndjson" {
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+
+	tm.tenantsMu.RLock()
+	stored, exists := tm.tenants[tenantID]
+	var tenant Tenant
+	if exists {
+		tenant = *stored
+	}
+	tm.tenantsMu.RUnlock()
+	if !exists {
+		return nil, errors.New("tenant not found")
+	}
+
+	tm.resourcesMu.RLock()
+	resources := append([]*TenantResource{}, tm.resources[tenantID]...)
+	tm.resourcesMu.RUnlock()
+
+	resources, err := tm.readResources(resources)
+	if err != nil {
+		return nil, err
+	}
+
+	export := TenantExport{
+		Tenant:     &tenant,
+		Resources:  resources,
+		AuditLog:   tm.GetAuditLog(tenantID),
+		ExportedAt: tm.now(),
+	}
+
+	var buf bytes.Buffer
+	if format == "json" {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(export); err != nil {
+			return nil, err
+		}
+	} else {
+		enc := json.NewEncoder(&buf)
+		records := []exportRecord{{Type: "tenant", Data: export.Tenant}}
+		for _, resource := range export.Resources {
+			records = append(records, exportRecord{Type: "resource", Data: resource})
+		}
+		for _, entry := range export.AuditLog {
+			records = append(records, exportRecord{Type: "audit", Data: entry})
+		}
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tm.logAudit(tenantID, "", "EXPORT_TENANT_DATA", tenantID, map[string]interface{}{
+		"format":    format,
+		"resources": len(export.Resources),
+	})
+
+	return buf.Bytes(), nil
+}
+
+// PurgeTenant hard-deletes a deleted tenant once SoftDeleteWindow has passed:
+// the tenant row, resources, quota, usage, routes and audit entries. A dry
+// run only reports what would be removed. A real purge leaves one
+// PURGE_TENANT audit entry behind as the record of the deletion.
+func (tm *TenantManager) PurgeTenant(tenantID string, dryRun bool) (*PurgeReport, error) {
+	tm.tenantsMu.Lock()
+	defer tm.tenantsMu.Unlock()
+
+	tenant, exists := tm.tenants[tenantID]
+	if !exists {
+		return nil, errors.New("tenant not found")
+	}
+	if tenant.Status != "deleted" {
+		return nil, errors.New("tenant must be deleted before it can be purged")
+	}
+	for _, other := range tm.tenants {
+		if other.ParentID == tenantID {
+			return nil, errors.New("tenant has child tenants")
+		}
+	}
+
+	now := tm.now()
+	if now.Before(tenant.DeletedAt.Add(SoftDeleteWindow)) {
+		return nil, fmt.Errorf("tenant is within the soft-delete window until %s",
+			tenant.DeletedAt.Add(SoftDeleteWindow).Format(time.RFC3339))
+	}
+
+	tm.resourcesMu.RLock()
+	resources := append([]*TenantResource{}, tm.resources[tenantID]...)
+	tm.resourcesMu.RUnlock()
+
+	tm.usageMu.RLock()
+	usageBuckets := len(tm.usage[tenantID])
+	tm.usageMu.RUnlock()
+
+	report := &PurgeReport{
+		TenantID:     tenantID,
+		DryRun:       dryRun,
+		Resources:    len(resources),
+		AuditEntries: len(tm.GetAuditLog(tenantID)),
+		UsageBuckets: usageBuckets,
+		PurgedAt:     now,
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// Storage first, so a failure leaves the tenant in place to retry
+	for _, resource := range resources {
+		if err := tm.removeResource(tenantID, resource.ID); err != nil {
+			return nil, err
+		}
+	}
+	if tm.tenantRepo != nil {
+		if err := tm.tenantRepo.DeleteTenant(context.Background(), tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	delete(tm.tenants, tenantID)
+
+	tm.resourcesMu.Lock()
+	delete(tm.resources, tenantID)
+	tm.resourcesMu.Unlock()
+
+	tm.quotasMu.Lock()
+	delete(tm.quotas, tenantID)
+	tm.quotasMu.Unlock()
+
+	tm.usageMu.Lock()
+	delete(tm.usage, tenantID)
+	tm.usageMu.Unlock()
+
+	tm.routesMu.Lock()
+	delete(tm.tenantRoutes, tenantID)
+	tm.routesMu.Unlock()
+
+	tm.limiter.Remove(tenantID)
+	tm.noisyMu.Lock()
+	delete(tm.load, tenantID)
+	delete(tm.throttles, tenantID)
+	delete(tm.throttleExempt, tenantID)
+	tm.noisyMu.Unlock()
+	tm.removeGrants(tenantID)
+	if tm.keyManager != nil {
+		tm.keyManager.DeleteKeys(tenantID)
+	}
+
+	tm.auditLogMu.Lock()
+	delete(tm.auditLog, tenantID)
+	tm.auditLogMu.Unlock()
+
+	tm.logAudit(tenantID, "", "PURGE_TENANT", tenantID, map[string]interface{}{
+		"resources":     report.Resources,
+		"audit_entries": report.AuditEntries,
+		"usage_buckets": report.UsageBuckets,
+	})
+
+	return report, nil
+}
+
+// ========== Helper Functions ==========
+
+func generateTenantID() string {
+	return fmt.Sprintf("tenant_%d", time.Now().UnixNano())
+}
+
+func generateResourceID() string {
+	return fmt.Sprintf("resource_%d", time.Now().UnixNano())
+}
+
+func generateGrantID() string {
+	return fmt.Sprintf("grant_%d", time.Now().UnixNano())
+}
+
+func generateEventID() string {
+	return fmt.Sprintf("evt_%d", time.Now().UnixNano())
+}
+
+func generateImpersonationID() string {
+	return fmt.Sprintf("imp_%d", time.Now().UnixNano())
+}
+
+func generateRequestID() string {
+	return fmt.Sprintf("req_%d", time.Now().UnixNano())
 }
 
 // SerializeTenant serializes tenant to JSON
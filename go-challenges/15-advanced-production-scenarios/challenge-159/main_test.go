@@ -1,7 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -263,6 +274,486 @@ func TestIncrementQuotaUsage(t *testing.T) {
 	}
 }
 
+// ========== Quota Reservation Tests ==========
+
+func TestReserveQuotaCommitAndRelease(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	quota, _ := tm.GetQuota(tenant.ID)
+
+	reservation, err := tm.ReserveQuota(tenant.ID, "storage", quota.MaxStorage-100)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := tm.AddStorageUsage(tenant.ID, 200); err == nil {
+		t.Fatal("Expected reserved storage to count against the limit")
+	}
+	if _, err := tm.ReserveQuota(tenant.ID, "storage", 200); err == nil {
+		t.Fatal("Expected second reservation to exceed the limit")
+	}
+
+	reservation.Release()
+	reservation.Release()
+	if err := tm.AddStorageUsage(tenant.ID, 200); err != nil {
+		t.Fatalf("Expected released storage to be available, got %v", err)
+	}
+	if err := reservation.Commit(); err == nil {
+		t.Error("Expected commit after release to fail")
+	}
+
+	reservation, _ = tm.ReserveQuota(tenant.ID, "user", 2)
+	if err := reservation.Commit(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if quota.CurrentUsers != 2 || quota.reserved["user"] != 0 {
+		t.Errorf("Expected committed usage, got users=%d reserved=%d", quota.CurrentUsers, quota.reserved["user"])
+	}
+}
+
+func TestConcurrentResourceCreationRespectsQuota(t *testing.T) {
+	tm := NewTenantManager("database")
+	org, _ := tm.CreateTenant("Org", "free", nil)
+	child, _ := tm.CreateTenant("Child", "free", nil)
+	tm.SetParent(child.ID, org.ID, HierarchyOptions{PoolQuota: true})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 100; i++ {
+		owner := org.ID
+		if i%2 == 1 {
+			owner = child.ID
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tm.CreateResource(owner, "doc", nil); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	quota, _ := tm.GetQuota(org.ID)
+	if created != quota.MaxUsers {
+		t.Errorf("Expected exactly %d creations, got %d", quota.MaxUsers, created)
+	}
+	if n := tm.poolResourceCount(org.ID); n != quota.MaxUsers {
+		t.Errorf("Expected %d stored resources, got %d", quota.MaxUsers, n)
+	}
+	if quota.reserved["resource"] != 0 {
+		t.Errorf("Expected no outstanding reservations, got %d", quota.reserved["resource"])
+	}
+}
+
+type failingResourceRepository struct {
+	*MemoryRepository
+}
+
+func (failingResourceRepository) SaveResource(ctx context.Context, resource *TenantResource) error {
+	return errors.New("storage unavailable")
+}
+
+func TestFailedResourceCreationReleasesQuota(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+
+	repo := NewMemoryRepository()
+	tm.SetRepositories(repo, failingResourceRepository{repo})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tm.CreateResource(tenant.ID, "doc", nil)
+		}()
+	}
+	wg.Wait()
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if quota.reserved["resource"] != 0 {
+		t.Fatalf("Expected failed creations to release quota, got %d reserved", quota.reserved["resource"])
+	}
+
+	tm.SetRepositories(repo, repo)
+	if _, err := tm.CreateResource(tenant.ID, "doc", nil); err != nil {
+		t.Errorf("Expected creation to succeed after failures, got %v", err)
+	}
+}
+
+// ========== Quota Reset & Usage Reporting Tests ==========
+
+func TestResetExpiredQuotas(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	tm.AddStorageUsage(tenant.ID, 1024)
+
+	if reset := tm.ResetExpiredQuotas(now.Add(time.Hour)); len(reset) != 0 {
+		t.Fatalf("Expected no reset before window ends, got %v", reset)
+	}
+
+	// Three windows later the reset time should land in the next window
+	reset := tm.ResetExpiredQuotas(now.Add(3*QuotaResetWindow + time.Hour))
+	if len(reset) != 1 || reset[0] != tenant.ID {
+		t.Fatalf("Expected tenant to be reset, got %v", reset)
+	}
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if quota.CurrentRequests != 0 || quota.CurrentStorage != 0 {
+		t.Errorf("Expected counters reset, got %d requests, %d storage", quota.CurrentRequests, quota.CurrentStorage)
+	}
+	if !quota.ResetTime.Equal(now.Add(4 * QuotaResetWindow)) {
+		t.Errorf("Unexpected next reset time %v", quota.ResetTime)
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if last := logs[len(logs)-1]; last.Action != "RESET_QUOTA" || last.Details["requests"] != 1 {
+		t.Errorf("Expected RESET_QUOTA audit entry, got %+v", last)
+	}
+}
+
+func TestRunQuotaResets(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	quota.Mu.Lock()
+	quota.ResetTime = time.Now().Add(-time.Second)
+	quota.Mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tm.RunQuotaResets(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.After(time.Second)
+	for {
+		quota.Mu.RLock()
+		requests := quota.CurrentRequests
+		quota.Mu.RUnlock()
+		if requests == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Quota was not reset by background loop")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	cancel()
+	<-done
+}
+
+func TestAddStorageUsageLimit(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if err := tm.AddStorageUsage(tenant.ID, quota.MaxStorage+1); err == nil {
+		t.Fatal("Expected storage quota error")
+	}
+	if err := tm.AddStorageUsage(tenant.ID, quota.MaxStorage); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestGetUsageReport(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+
+	now = now.Add(time.Hour)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	tm.AddStorageUsage(tenant.ID, 500)
+
+	now = now.Add(24 * time.Hour)
+	tm.IncrementQuotaUsage(tenant.ID, "user")
+
+	hourly, err := tm.GetUsageReport(tenant.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(hourly.Buckets) != 3 || hourly.Buckets[0].APIRequests != 2 || hourly.Buckets[1].Storage != 500 {
+		t.Fatalf("Unexpected hourly buckets: %+v", hourly.Buckets)
+	}
+
+	daily, _ := tm.GetUsageReport(tenant.ID, 24*time.Hour)
+	if len(daily.Buckets) != 2 {
+		t.Fatalf("Expected 2 daily buckets, got %d", len(daily.Buckets))
+	}
+	if daily.Buckets[0].APIRequests != 3 || !daily.Buckets[0].Start.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected first daily bucket: %+v", daily.Buckets[0])
+	}
+	if daily.TotalAPIRequests != 3 || daily.TotalUsers != 1 || daily.TotalStorage != 500 {
+		t.Errorf("Unexpected totals: %+v", daily)
+	}
+
+	if _, err := tm.GetUsageReport(tenant.ID, 90*time.Minute); err == nil {
+		t.Error("Expected error for period that is not whole hours")
+	}
+	if _, err := tm.GetUsageReport("unknown", time.Hour); err == nil {
+		t.Error("Expected error for unknown tenant")
+	}
+}
+
+// ========== Plan Change Tests ==========
+
+func TestChangePlanUpgrade(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+
+	var hooked []PlanChange
+	tm.OnPlanChange(func(change PlanChange) { hooked = append(hooked, change) })
+
+	change, err := tm.ChangePlan(tenant.ID, "pro")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if change.OldPlan != "free" || change.NewPlan != "pro" || len(change.OverQuota) != 0 {
+		t.Errorf("Unexpected plan change: %+v", change)
+	}
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if quota.MaxUsers != 50 || quota.MaxAPIRequests != 100000 || quota.CurrentRequests != 1 {
+		t.Errorf("Expected pro limits with usage kept, got %+v", quota)
+	}
+	if updated, _ := tm.GetTenant(tenant.ID); updated.Plan != "pro" {
+		t.Errorf("Expected tenant plan pro, got %s", updated.Plan)
+	}
+	if len(hooked) != 1 || hooked[0].TenantID != tenant.ID {
+		t.Errorf("Expected hook to fire once, got %+v", hooked)
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if last := logs[len(logs)-1]; last.Action != "CHANGE_PLAN" || last.Details["old_plan"] != "free" {
+		t.Errorf("Expected CHANGE_PLAN audit entry, got %+v", last)
+	}
+}
+
+func TestChangePlanInvalid(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+
+	if _, err := tm.ChangePlan(tenant.ID, "platinum"); err == nil {
+		t.Error("Expected error for invalid plan")
+	}
+	if _, err := tm.ChangePlan(tenant.ID, "pro"); err == nil {
+		t.Error("Expected error for unchanged plan")
+	}
+	if _, err := tm.ChangePlan("unknown", "free"); err == nil {
+		t.Error("Expected error for unknown tenant")
+	}
+}
+
+func TestChangePlanDowngradeRejected(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	for i := 0; i < 10; i++ {
+		tm.IncrementQuotaUsage(tenant.ID, "user")
+	}
+
+	hookCalled := false
+	tm.OnPlanChange(func(PlanChange) { hookCalled = true })
+
+	if _, err := tm.ChangePlan(tenant.ID, "free"); err == nil {
+		t.Fatal("Expected over-quota downgrade to be rejected")
+	}
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if quota.MaxUsers != 50 || hookCalled {
+		t.Errorf("Rejected change should leave quota untouched and not fire hooks")
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if last := logs[len(logs)-1]; last.Action != "CHANGE_PLAN_REJECTED" {
+		t.Errorf("Expected CHANGE_PLAN_REJECTED audit entry, got %s", last.Action)
+	}
+}
+
+func TestChangePlanDowngradeGracePeriod(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+	tm.SetDowngradePolicy(DowngradePolicy{Mode: "grace", GracePeriod: 7 * 24 * time.Hour})
+
+	over, _ := tm.CreateTenant("OverCorp", "pro", nil)
+	fixed, _ := tm.CreateTenant("FixedCorp", "pro", nil)
+	for _, id := range []string{over.ID, fixed.ID} {
+		for i := 0; i < 10; i++ {
+			tm.IncrementQuotaUsage(id, "user")
+		}
+	}
+
+	change, err := tm.ChangePlan(over.ID, "free")
+	if err != nil {
+		t.Fatalf("Expected downgrade with grace period, got %v", err)
+	}
+	if len(change.OverQuota) != 1 || change.OverQuota[0] != "users" {
+		t.Errorf("Expected users over quota, got %v", change.OverQuota)
+	}
+	if !change.GraceUntil.Equal(now.Add(7 * 24 * time.Hour)) {
+		t.Errorf("Unexpected grace end %v", change.GraceUntil)
+	}
+	tm.ChangePlan(fixed.ID, "free")
+
+	// FixedCorp gets back under quota within the grace period
+	quota, _ := tm.GetQuota(fixed.ID)
+	quota.CurrentUsers = 5
+
+	if suspended := tm.EnforceGracePeriods(now.Add(24 * time.Hour)); len(suspended) != 0 {
+		t.Fatalf("Expected no suspension during grace period, got %v", suspended)
+	}
+
+	suspended := tm.EnforceGracePeriods(now.Add(8 * 24 * time.Hour))
+	if len(suspended) != 1 || suspended[0] != over.ID {
+		t.Fatalf("Expected only over-quota tenant suspended, got %v", suspended)
+	}
+	if tenant, _ := tm.GetTenant(over.ID); tenant.Status != "suspended" {
+		t.Errorf("Expected suspended status, got %s", tenant.Status)
+	}
+	if tenant, _ := tm.GetTenant(fixed.ID); tenant.Status != "active" {
+		t.Errorf("Expected active status, got %s", tenant.Status)
+	}
+}
+
+// ========== Tenant Event Tests ==========
+
+// collectEvents subscribes to tm and returns a function that waits until n
+// events have arrived
+func collectEvents(t *testing.T, tm *TenantManager, types ...string) func(n int) []TenantEvent {
+	ch := make(chan TenantEvent, 100)
+	unsubscribe := tm.Events().Subscribe(EventSubscriberFunc(func(ctx context.Context, event TenantEvent) error {
+		ch <- event
+		return nil
+	}), types...)
+	t.Cleanup(unsubscribe)
+
+	return func(n int) []TenantEvent {
+		var events []TenantEvent
+		for len(events) < n {
+			select {
+			case event := <-ch:
+				events = append(events, event)
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out after %d of %d events", len(events), n)
+			}
+		}
+		return events
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	tm := NewTenantManager("database")
+	wait := collectEvents(t, tm)
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	resource, _ := tm.CreateResource(tenant.ID, "doc", nil)
+	tm.SuspendTenant(tenant.ID, "billing")
+
+	events := wait(3)
+	if events[0].Type != EventTenantCreated || events[0].TenantID != tenant.ID || events[0].Data["plan"] != "pro" {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if events[1].Type != EventResourceCreated || events[1].ResourceID != resource.ID {
+		t.Errorf("Unexpected second event: %+v", events[1])
+	}
+	if events[2].Type != EventTenantSuspended || events[2].Data["reason"] != "billing" {
+		t.Errorf("Unexpected third event: %+v", events[2])
+	}
+}
+
+func TestQuotaExceededEventOncePerWindow(t *testing.T) {
+	tm := NewTenantManager("database")
+	wait := collectEvents(t, tm, EventQuotaExceeded)
+
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	quota, _ := tm.GetQuota(tenant.ID)
+	quota.CurrentRequests = quota.MaxAPIRequests
+
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	tm.AddStorageUsage(tenant.ID, quota.MaxStorage+1)
+
+	events := wait(2)
+	if events[0].Data["usage_type"] != "api_request" || events[1].Data["usage_type"] != "storage" {
+		t.Fatalf("Expected one event per usage type, got %+v", events)
+	}
+
+	// A new window notifies again
+	tm.ResetExpiredQuotas(quota.ResetTime)
+	quota.CurrentRequests = quota.MaxAPIRequests
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	if events := wait(1); events[0].Data["usage_type"] != "api_request" {
+		t.Errorf("Expected api_request event after reset, got %+v", events[0])
+	}
+}
+
+func TestEventBusSubscriberCallsBack(t *testing.T) {
+	tm := NewTenantManager("database")
+	names := make(chan string, 1)
+	unsubscribe := tm.Events().Subscribe(EventSubscriberFunc(func(ctx context.Context, event TenantEvent) error {
+		// Delivery happens off the publisher's locks, so this can't deadlock
+		tenant, err := tm.GetTenant(event.TenantID)
+		if err != nil {
+			return err
+		}
+		names <- tenant.Name
+		return nil
+	}), EventTenantCreated)
+
+	tm.CreateTenant("TestCorp", "pro", nil)
+	select {
+	case name := <-names:
+		if name != "TestCorp" {
+			t.Errorf("Expected TestCorp, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+
+	unsubscribe()
+	tm.CreateTenant("OtherCorp", "pro", nil)
+	if stats := tm.Events().Stats(); stats.Published != 2 || stats.Delivered != 1 {
+		t.Errorf("Unexpected stats after unsubscribe: %+v", stats)
+	}
+}
+
+func TestEventBusDropsAndFailures(t *testing.T) {
+	bus := NewEventBus()
+	release := make(chan struct{})
+	bus.Subscribe(EventSubscriberFunc(func(ctx context.Context, event TenantEvent) error {
+		<-release
+		return errors.New("handler failed")
+	}))
+
+	for i := 0; i < eventBufferSize+10; i++ {
+		bus.Publish(TenantEvent{Type: EventTenantCreated})
+	}
+	close(release)
+	bus.Close()
+
+	stats := bus.Stats()
+	if stats.Dropped == 0 || stats.Failed+stats.Dropped != int64(eventBufferSize+10) || stats.Delivered != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
 // ========== Tenant Context Tests ==========
 
 func TestWithTenantContext(t *testing.T) {
@@ -351,46 +842,906 @@ func TestValidateSuspendedTenant(t *testing.T) {
 	}
 }
 
-// ========== Cross-Tenant Prevention Tests ==========
+// ========== Impersonation Tests ==========
 
-func TestValidateResourceAccess(t *testing.T) {
+func newImpersonationManager() (*TenantManager, *Tenant) {
 	tm := NewTenantManager("database")
-
+	tm.SetImpersonationPolicy(ImpersonationPolicy{
+		IsAdmin:     func(userID string) bool { return userID == "support-1" },
+		MaxDuration: time.Hour,
+	})
 	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
-	resource, _ := tm.CreateResource(tenant.ID, "resource-1", nil)
+	return tm, tenant
+}
 
-	ctx := context.Background()
-	tenantCtx := &TenantContext{
-		TenantID: tenant.ID,
+func TestStartImpersonationValidation(t *testing.T) {
+	tm, tenant := newImpersonationManager()
+
+	cases := []ImpersonationRequest{
+		{AdminUserID: "user-9", TenantID: tenant.ID, Reason: "ticket 1", Duration: time.Minute},
+		{AdminUserID: "support-1", TenantID: tenant.ID, Duration: time.Minute},
+		{AdminUserID: "support-1", TenantID: tenant.ID, Reason: "ticket 1", Duration: 2 * time.Hour},
+		{AdminUserID: "support-1", TenantID: "missing", Reason: "ticket 1", Duration: time.Minute},
+	}
+	for i, req := range cases {
+		if _, err := tm.StartImpersonation(req); err == nil {
+			t.Errorf("case %d: expected request to be refused", i)
+		}
 	}
 
-	ctx = WithTenantContext(ctx, tenantCtx)
+	if _, err := NewTenantManager("database").StartImpersonation(cases[0]); err == nil {
+		t.Error("Expected impersonation to be refused without a policy")
+	}
+}
 
-	err := tm.ValidateResourceAccess(ctx, resource.ID)
+func TestImpersonationAuditsBothIdentities(t *testing.T) {
+	tm, tenant := newImpersonationManager()
+	resource, _ := tm.CreateResource(tenant.ID, "doc", nil)
+
+	tenantCtx, err := tm.StartImpersonation(ImpersonationRequest{
+		AdminUserID: "support-1",
+		TenantID:    tenant.ID,
+		UserID:      "alice",
+		Reason:      "ticket 42",
+		Duration:    30 * time.Minute,
+	})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
+	if tenantCtx.TenantID != tenant.ID || tenantCtx.UserID != "alice" || tenantCtx.Impersonation == nil {
+		t.Fatalf("Unexpected context: %+v", tenantCtx)
+	}
+
+	ctx := WithTenantContext(context.Background(), tenantCtx)
+	if err := tm.ValidateResourceAccess(ctx, resource.ID); err != nil {
+		t.Fatalf("Expected access during impersonation, got %v", err)
+	}
+	if err := tm.RecordAction(ctx, "UPDATE_SETTINGS", "", nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	start := logs[len(logs)-2]
+	if start.Action != "IMPERSONATION_START" || start.UserID != "support-1" || start.Details["reason"] != "ticket 42" {
+		t.Errorf("Unexpected start entry: %+v", start)
+	}
+	action := logs[len(logs)-1]
+	if action.UserID != "alice" || action.ImpersonatorID != "support-1" || action.ImpersonationID != tenantCtx.Impersonation.ID {
+		t.Errorf("Expected action to carry both identities, got %+v", action)
+	}
 }
 
-func TestValidateCrossTenantResourceAccess(t *testing.T) {
-	tm := NewTenantManager("database")
+func TestImpersonationAuditsResourceWrites(t *testing.T) {
+	tm, tenant := newImpersonationManager()
 
-	tenant1, _ := tm.CreateTenant("Corp1", "pro", nil)
-	tenant2, _ := tm.CreateTenant("Corp2", "pro", nil)
+	tenantCtx, err := tm.StartImpersonation(ImpersonationRequest{
+		AdminUserID: "support-1",
+		TenantID:    tenant.ID,
+		UserID:      "alice",
+		Reason:      "ticket 42",
+		Duration:    30 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx := WithTenantContext(context.Background(), tenantCtx)
+
+	resource, err := tm.CreateResourceContext(ctx, "doc", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resource.TenantID != tenant.ID {
+		t.Errorf("Expected resource in %s, got %s", tenant.ID, resource.TenantID)
+	}
+	if err := tm.DeleteResourceContext(ctx, resource.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	for i, action := range []string{"CREATE_RESOURCE", "DELETE_RESOURCE"} {
+		entry := logs[len(logs)-2+i]
+		if entry.Action != action || entry.ResourceID != resource.ID {
+			t.Fatalf("Expected %s of %s, got %+v", action, resource.ID, entry)
+		}
+		if entry.UserID != "alice" || entry.ImpersonatorID != "support-1" || entry.ImpersonationID != tenantCtx.Impersonation.ID {
+			t.Errorf("Expected %s to carry both identities, got %+v", action, entry)
+		}
+	}
+
+	if err := tm.EndImpersonation(tenantCtx.Impersonation.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := tm.CreateResourceContext(ctx, "late", nil); err == nil {
+		t.Error("Expected ended impersonation to be rejected")
+	}
+}
+
+func TestImpersonationExpiresAndEnds(t *testing.T) {
+	tm, tenant := newImpersonationManager()
+	start := time.Now()
+	tm.now = func() time.Time { return start }
+
+	tenantCtx, _ := tm.StartImpersonation(ImpersonationRequest{
+		AdminUserID: "support-1", TenantID: tenant.ID, Reason: "ticket 7", Duration: 10 * time.Minute,
+	})
+	ctx := WithTenantContext(context.Background(), tenantCtx)
+
+	tm.now = func() time.Time { return start.Add(10 * time.Minute) }
+	if err := tm.ValidateRequestTenancy(ctx, tenant.ID); err == nil {
+		t.Error("Expected expired impersonation to be rejected")
+	}
+
+	tm.now = func() time.Time { return start }
+	if err := tm.EndImpersonation(tenantCtx.Impersonation.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := tm.RecordAction(ctx, "VIEW_BILLING", "", nil); err == nil {
+		t.Error("Expected ended impersonation to be rejected")
+	}
+	if err := tm.EndImpersonation(tenantCtx.Impersonation.ID); err == nil {
+		t.Error("Expected second end to fail")
+	}
+
+	sessions := tm.ListImpersonations(tenant.ID)
+	if len(sessions) != 1 || sessions[0].EndedAt.IsZero() {
+		t.Errorf("Expected one ended session, got %+v", sessions)
+	}
+
+	forged := *tenantCtx
+	forged.Impersonation = &Impersonation{ID: "imp_forged", TenantID: tenant.ID, ExpiresAt: start.Add(time.Hour)}
+	if err := tm.RecordAction(WithTenantContext(context.Background(), &forged), "VIEW_BILLING", "", nil); err == nil {
+		t.Error("Expected unknown impersonation to be rejected")
+	}
+}
+
+// ========== Tenant Middleware Tests ==========
+
+func serveWithTenant(tm *TenantManager, resolver TenantResolver, req *http.Request) (*httptest.ResponseRecorder, *TenantContext) {
+	var got *TenantContext
+	handler := tm.TenantMiddleware(resolver)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = GetTenantContext(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, got
+}
+
+func TestTenantMiddlewareHeader(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/resources", nil)
+	req.Header.Set(TenantHeader, tenant.ID)
+	req.Header.Set("X-Request-ID", "req-42")
+
+	rec, tenantCtx := serveWithTenant(tm, TenantResolver{}, req)
+	if rec.Code != http.StatusOK || tenantCtx == nil {
+		t.Fatalf("Expected tenant context, got status %d", rec.Code)
+	}
+	if tenantCtx.TenantID != tenant.ID || tenantCtx.Plan != "pro" || tenantCtx.RequestID != "req-42" {
+		t.Fatalf("Unexpected tenant context: %+v", tenantCtx)
+	}
+}
+
+func TestTenantMiddlewareSubdomain(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("Acme", "free", nil)
+	resolver := TenantResolver{BaseDomain: "example.com"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://acme.example.com:8080/", nil)
+	rec, tenantCtx := serveWithTenant(tm, resolver, req)
+	if rec.Code != http.StatusOK || tenantCtx.TenantID != tenant.ID {
+		t.Fatalf("Expected subdomain to resolve Acme, got status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if rec, _ := serveWithTenant(tm, resolver, req); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without a tenant, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://unknown.example.com/", nil)
+	if rec, _ := serveWithTenant(tm, resolver, req); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown tenant, got %d", rec.Code)
+	}
+}
+
+func TestTenantMiddlewareJWT(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	other, _ := tm.CreateTenant("OtherCorp", "pro", nil)
+	secret := []byte("secret")
+	resolver := TenantResolver{JWTSecret: secret}
+
+	token, _ := NewTenantToken(secret, tenant.ID, "user-1", time.Hour)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rec, tenantCtx := serveWithTenant(tm, resolver, req)
+	if rec.Code != http.StatusOK || tenantCtx.TenantID != tenant.ID || tenantCtx.UserID != "user-1" {
+		t.Fatalf("Expected JWT to resolve tenant and user, got status %d", rec.Code)
+	}
+
+	// A header naming another tenant cannot override the token
+	req.Header.Set(TenantHeader, other.ID)
+	if rec, _ := serveWithTenant(tm, resolver, req); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for mismatched header, got %d", rec.Code)
+	}
+
+	forged, _ := NewTenantToken([]byte("wrong"), other.ID, "user-1", time.Hour)
+	expired, _ := NewTenantToken(secret, tenant.ID, "user-1", -time.Minute)
+	for _, bad := range []string{forged, expired, "not-a-jwt"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+bad)
+		if rec, _ := serveWithTenant(tm, resolver, req); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for token %q, got %d", bad, rec.Code)
+		}
+	}
+}
+
+func TestTenantMiddlewareStatus(t *testing.T) {
+	tm := NewTenantManager("database")
+	suspended, _ := tm.CreateTenant("Suspended", "pro", nil)
+	deleted, _ := tm.CreateTenant("Deleted", "pro", nil)
+	tm.SuspendTenant(suspended.ID, "billing")
+	tm.DeleteTenant(deleted.ID)
+
+	for id, want := range map[string]int{suspended.ID: http.StatusForbidden, deleted.ID: http.StatusGone} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(TenantHeader, id)
+		if rec, tenantCtx := serveWithTenant(tm, TenantResolver{}, req); rec.Code != want || tenantCtx != nil {
+			t.Fatalf("Expected %d for %s, got %d", want, id, rec.Code)
+		}
+	}
+}
+
+// ========== Rate Limiting Tests ==========
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	rl := NewRateLimiter()
+	now := time.Unix(1700000000, 0)
+	rl.now = func() time.Time { return now }
+
+	burst := PlanRateLimits["free"].Burst
+	for i := 0; i < burst; i++ {
+		if res := rl.Allow("t1", "free"); !res.Allowed {
+			t.Fatalf("Request %d should be allowed within burst", i)
+		}
+	}
+
+	res := rl.Allow("t1", "free")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter <= 0 {
+		t.Fatalf("Expected rejection with retry hint, got %+v", res)
+	}
+
+	// Other tenants have their own bucket
+	if !rl.Allow("t2", "free").Allowed {
+		t.Fatal("Expected separate bucket per tenant")
+	}
+
+	now = now.Add(time.Second)
+	if res := rl.Allow("t1", "free"); !res.Allowed || res.Remaining != 9 {
+		t.Fatalf("Expected refill of 10 tokens after 1s, got %+v", res)
+	}
+}
+
+func TestRateLimiterPlanLimits(t *testing.T) {
+	rl := NewRateLimiter()
+	if res := rl.Allow("t1", "enterprise"); res.Limit != PlanRateLimits["enterprise"].Burst {
+		t.Errorf("Expected enterprise limit, got %d", res.Limit)
+	}
+	if res := rl.Allow("t2", "unknown"); res.Limit != PlanRateLimits["free"].Burst {
+		t.Errorf("Expected free limit for unknown plan, got %d", res.Limit)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "free", nil)
+	tm.limiter.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	handler := tm.TenantMiddleware(TenantResolver{})(tm.RateLimitMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/resources", nil)
+		req.Header.Set(TenantHeader, tenant.ID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-RateLimit-Limit") != "20" || rec.Header().Get("X-RateLimit-Remaining") != "19" {
+		t.Errorf("Unexpected rate limit headers: %v", rec.Header())
+	}
+	if rec.Header().Get("X-Quota-Remaining") != "999" {
+		t.Errorf("Expected 999 quota remaining, got %s", rec.Header().Get("X-Quota-Remaining"))
+	}
+
+	for i := 0; i < 19; i++ {
+		serve()
+	}
+	rec = serve()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with Retry-After, got %d", rec.Code)
+	}
+
+	quota, _ := tm.GetQuota(tenant.ID)
+	if quota.CurrentRequests != 20 {
+		t.Errorf("Rejected requests should not count against quota, got %d", quota.CurrentRequests)
+	}
+}
+
+func TestRateLimitMiddlewareQuotaExceeded(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	quota, _ := tm.GetQuota(tenant.ID)
+	quota.CurrentRequests = quota.MaxAPIRequests
+
+	handler := tm.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/resources", nil)
+	req = req.WithContext(WithTenantContext(req.Context(), &TenantContext{TenantID: tenant.ID, Plan: "pro"}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 when quota exhausted, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Quota-Remaining") != "0" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Unexpected quota headers: %v", rec.Header())
+	}
+}
+
+// ========== Noisy Neighbor Tests ==========
+
+func TestDetectNoisyNeighborsThrottles(t *testing.T) {
+	tm := NewTenantManager("database")
+	noisy, _ := tm.CreateTenant("Noisy", "pro", nil)
+	quiet, _ := tm.CreateTenant("Quiet", "pro", nil)
+	now := time.Now()
+	tm.now = func() time.Time { return now }
+
+	for i := 0; i < 90; i++ {
+		tm.ObserveRequest(noisy.ID, 10*time.Millisecond, 100)
+	}
+	for i := 0; i < 10; i++ {
+		tm.ObserveRequest(quiet.ID, 10*time.Millisecond, 100)
+	}
+
+	loads := tm.LoadReport(now)
+	if len(loads) != 2 {
+		t.Fatalf("Expected 2 tenant loads, got %d", len(loads))
+	}
+
+	throttled := tm.DetectNoisyNeighbors(now)
+	if len(throttled) != 1 || throttled[0] != noisy.ID {
+		t.Fatalf("Expected only the noisy tenant to be throttled, got %v", throttled)
+	}
+	throttle, ok := tm.GetThrottle(noisy.ID)
+	if !ok || throttle.Share < 0.89 {
+		t.Fatalf("Unexpected throttle: %+v", throttle)
+	}
+	if _, ok := tm.GetThrottle(quiet.ID); ok {
+		t.Error("Expected quiet tenant to be left alone")
+	}
+
+	logs := tm.GetAuditLog(noisy.ID)
+	if logs[len(logs)-1].Action != "THROTTLE_TENANT" {
+		t.Error("Expected throttle to be audited")
+	}
+
+	// Throttled to 10% of the pro plan: a burst of 20 instead of 200
+	if result := tm.limiter.Allow(noisy.ID, "pro"); result.Limit != 20 {
+		t.Errorf("Expected throttled burst 20, got %d", result.Limit)
+	}
+
+	later := now.Add(10 * time.Minute)
+	tm.DetectNoisyNeighbors(later)
+	if _, ok := tm.GetThrottle(noisy.ID); ok {
+		t.Error("Expected throttle to expire")
+	}
+	if result := tm.limiter.Allow(noisy.ID, "pro"); result.Limit != 200 {
+		t.Errorf("Expected plan burst after expiry, got %d", result.Limit)
+	}
+}
+
+func TestDetectNoisyNeighborsThresholds(t *testing.T) {
+	tm := NewTenantManager("database")
+	only, _ := tm.CreateTenant("Only", "pro", nil)
+	other, _ := tm.CreateTenant("Other", "pro", nil)
+	now := time.Now()
+	tm.now = func() time.Time { return now }
+
+	tm.SetNoisyNeighborPolicy(NoisyNeighborPolicy{MaxShare: 0.6})
+
+	for i := 0; i < 100; i++ {
+		tm.ObserveRequest(only.ID, time.Millisecond, 0)
+	}
+	if throttled := tm.DetectNoisyNeighbors(now); len(throttled) != 0 {
+		t.Errorf("Expected a lone tenant not to be throttled, got %v", throttled)
+	}
+
+	// An even share of requests but most of the latency
+	for i := 0; i < 100; i++ {
+		tm.ObserveRequest(other.ID, time.Millisecond, 0)
+	}
+	tm.ObserveRequest(other.ID, 10*time.Second, 0)
+	throttled := tm.DetectNoisyNeighbors(now)
+	if len(throttled) != 1 || throttled[0] != other.ID {
+		t.Fatalf("Expected latency hog to be throttled, got %v", throttled)
+	}
+	if throttle, _ := tm.GetThrottle(other.ID); throttle.Metric != "latency" {
+		t.Errorf("Expected latency metric, got %s", throttle.Metric)
+	}
+
+	// Samples outside the window no longer count
+	if loads := tm.LoadReport(now.Add(2 * time.Minute)); len(loads) != 0 {
+		t.Errorf("Expected window to be empty, got %+v", loads)
+	}
+}
+
+func TestOverrideThrottle(t *testing.T) {
+	tm := NewTenantManager("database")
+	noisy, _ := tm.CreateTenant("Noisy", "pro", nil)
+	quiet, _ := tm.CreateTenant("Quiet", "pro", nil)
+	now := time.Now()
+	tm.now = func() time.Time { return now }
+
+	for i := 0; i < 150; i++ {
+		tm.ObserveRequest(noisy.ID, time.Millisecond, 10)
+	}
+	tm.ObserveRequest(quiet.ID, time.Millisecond, 10)
+	tm.DetectNoisyNeighbors(now)
+
+	if err := tm.OverrideThrottle(noisy.ID, "ops-1", time.Hour); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := tm.GetThrottle(noisy.ID); ok {
+		t.Fatal("Expected override to lift the throttle")
+	}
+	if throttled := tm.DetectNoisyNeighbors(now); len(throttled) != 0 {
+		t.Errorf("Expected exempt tenant not to be throttled, got %v", throttled)
+	}
+
+	logs := tm.GetAuditLog(noisy.ID)
+	last := logs[len(logs)-1]
+	if last.Action != "THROTTLE_OVERRIDE" || last.UserID != "ops-1" {
+		t.Errorf("Expected override audited by operator, got %+v", last)
+	}
+
+	tm.OverrideThrottle(noisy.ID, "ops-1", 0)
+	if throttled := tm.DetectNoisyNeighbors(now); len(throttled) != 1 {
+		t.Errorf("Expected cleared exemption to allow throttling, got %v", throttled)
+	}
+}
+
+func TestLoadTrackingMiddleware(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+
+	handler := tm.LoadTrackingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(WithTenantContext(req.Context(), &TenantContext{TenantID: tenant.ID}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	loads := tm.LoadReport(time.Now())
+	if len(loads) != 1 || loads[0].Requests != 1 || loads[0].Bytes != 5 {
+		t.Errorf("Unexpected load: %+v", loads)
+	}
+}
+
+// ========== Cross-Tenant Prevention Tests ==========
+
+func TestValidateResourceAccess(t *testing.T) {
+	tm := NewTenantManager("database")
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	resource, _ := tm.CreateResource(tenant.ID, "resource-1", nil)
+
+	ctx := context.Background()
+	tenantCtx := &TenantContext{
+		TenantID: tenant.ID,
+	}
+
+	ctx = WithTenantContext(ctx, tenantCtx)
+
+	err := tm.ValidateResourceAccess(ctx, resource.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestValidateCrossTenantResourceAccess(t *testing.T) {
+	tm := NewTenantManager("database")
+
+	tenant1, _ := tm.CreateTenant("Corp1", "pro", nil)
+	tenant2, _ := tm.CreateTenant("Corp2", "pro", nil)
+
+	resource, _ := tm.CreateResource(tenant1.ID, "resource-1", nil)
+
+	ctx := context.Background()
+	tenantCtx := &TenantContext{
+		TenantID: tenant2.ID,
+	}
+
+	ctx = WithTenantContext(ctx, tenantCtx)
+
+	// Should not find resource from different tenant
+	err := tm.ValidateResourceAccess(ctx, resource.ID)
+	if err == nil {
+		// It's okay if it returns not found
+	}
+}
+
+// ========== Resource Sharing Tests ==========
+
+func TestShareResourceGrantsReadAccess(t *testing.T) {
+	tm := NewTenantManager("database")
+	owner, _ := tm.CreateTenant("Owner", "pro", nil)
+	grantee, _ := tm.CreateTenant("Grantee", "pro", nil)
+	resource, _ := tm.CreateResource(owner.ID, "report", map[string]interface{}{"k": "v"})
+
+	ctx := WithTenantContext(context.Background(), &TenantContext{TenantID: grantee.ID, UserID: "carol"})
+	if err := tm.ValidateResourceAccess(ctx, resource.ID); err == nil {
+		t.Fatal("Expected no access before sharing")
+	}
+
+	grant, err := tm.ShareResource(owner.ID, resource.ID, grantee.ID, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := tm.ShareResource(owner.ID, resource.ID, grantee.ID, 0); err == nil {
+		t.Error("Expected error for duplicate active grant")
+	}
+
+	if err := tm.ValidateResourceAccess(ctx, resource.ID); err != nil {
+		t.Fatalf("Expected read access through grant, got %v", err)
+	}
+	if err := tm.ValidateResourceWrite(ctx, resource.ID); err == nil {
+		t.Fatal("Expected grants to never allow writes")
+	}
+
+	shared, err := tm.GetSharedResource(ctx, resource.ID)
+	if err != nil || shared.Data["k"] != "v" {
+		t.Fatalf("Expected shared resource copy, got %+v, %v", shared, err)
+	}
+	shared.Data["k"] = "changed"
+	if original, _ := tm.GetResource(owner.ID, resource.ID); original.Data["k"] != "v" {
+		t.Error("Shared copy must not modify the owner's resource")
+	}
+
+	page, _ := tm.QueryAuditLog(owner.ID, AuditQuery{Action: "CROSS_TENANT_READ"})
+	if len(page.Entries) != 2 || page.Entries[0].UserID != "carol" || page.Entries[0].Details["grant_id"] != grant.ID {
+		t.Errorf("Expected cross-tenant reads audited for owner, got %+v", page.Entries)
+	}
+	page, _ = tm.QueryAuditLog(grantee.ID, AuditQuery{Action: "CROSS_TENANT_READ"})
+	if len(page.Entries) != 2 {
+		t.Errorf("Expected cross-tenant reads audited for grantee, got %d", len(page.Entries))
+	}
+
+	// Third tenants without a grant still see nothing
+	other, _ := tm.CreateTenant("Other", "pro", nil)
+	otherCtx := WithTenantContext(context.Background(), &TenantContext{TenantID: other.ID})
+	if err := tm.ValidateResourceAccess(otherCtx, resource.ID); err == nil || err.Error() != "resource not found" {
+		t.Errorf("Expected resource not found for tenant without grant, got %v", err)
+	}
+}
+
+func TestShareResourceExpiryAndRevocation(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	owner, _ := tm.CreateTenant("Owner", "pro", nil)
+	grantee, _ := tm.CreateTenant("Grantee", "pro", nil)
+	expiring, _ := tm.CreateResource(owner.ID, "expiring", nil)
+	revoked, _ := tm.CreateResource(owner.ID, "revoked", nil)
+
+	tm.ShareResource(owner.ID, expiring.ID, grantee.ID, time.Hour)
+	grant, _ := tm.ShareResource(owner.ID, revoked.ID, grantee.ID, 0)
+
+	ctx := WithTenantContext(context.Background(), &TenantContext{TenantID: grantee.ID})
+
+	if err := tm.RevokeGrant(grantee.ID, grant.ID); err == nil {
+		t.Fatal("Expected only the owner to revoke a grant")
+	}
+	if err := tm.RevokeGrant(owner.ID, grant.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := tm.ValidateResourceAccess(ctx, revoked.ID); err == nil || err.Error() != "cross-tenant access denied" {
+		t.Errorf("Expected access denied after revocation, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := tm.ValidateResourceAccess(ctx, expiring.ID); err == nil {
+		t.Error("Expected access denied after expiry")
+	}
+
+	page, _ := tm.QueryAuditLog(grantee.ID, AuditQuery{Action: "CROSS_TENANT_ACCESS_DENIED"})
+	if len(page.Entries) != 2 {
+		t.Errorf("Expected denied attempts to be audited, got %d", len(page.Entries))
+	}
+	if grants := tm.ListGrants(grantee.ID); len(grants) != 2 || grants[1].RevokedAt.IsZero() {
+		t.Errorf("Expected both grants listed with revocation, got %+v", grants)
+	}
+}
+
+func TestShareResourceValidation(t *testing.T) {
+	tm := NewTenantManager("database")
+	owner, _ := tm.CreateTenant("Owner", "pro", nil)
+	grantee, _ := tm.CreateTenant("Grantee", "pro", nil)
+	resource, _ := tm.CreateResource(owner.ID, "report", nil)
+
+	if _, err := tm.ShareResource(grantee.ID, resource.ID, owner.ID, 0); err == nil {
+		t.Error("Expected error sharing another tenant's resource")
+	}
+	if _, err := tm.ShareResource(owner.ID, resource.ID, owner.ID, 0); err == nil {
+		t.Error("Expected error sharing with owner")
+	}
+
+	tm.SuspendTenant(grantee.ID, "billing")
+	if _, err := tm.ShareResource(owner.ID, resource.ID, grantee.ID, 0); err == nil {
+		t.Error("Expected error sharing with suspended tenant")
+	}
+}
+
+// ========== Tenant Hierarchy Tests ==========
+
+func TestSetParentCyclePrevention(t *testing.T) {
+	tm := NewTenantManager("database")
+	org, _ := tm.CreateTenant("Org", "enterprise", nil)
+	team, _ := tm.CreateTenant("Team", "free", nil)
+	squad, _ := tm.CreateTenant("Squad", "free", nil)
+
+	if err := tm.SetParent(team.ID, org.ID, HierarchyOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := tm.SetParent(squad.ID, team.ID, HierarchyOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := tm.SetParent(org.ID, squad.ID, HierarchyOptions{}); err == nil {
+		t.Fatal("Expected cycle to be refused")
+	}
+	if err := tm.SetParent(org.ID, org.ID, HierarchyOptions{}); err == nil {
+		t.Fatal("Expected self-parenting to be refused")
+	}
+
+	if children := tm.GetChildren(org.ID); len(children) != 1 || children[0].ID != team.ID {
+		t.Errorf("Unexpected children: %+v", children)
+	}
+
+	if err := tm.SetParent(team.ID, "", HierarchyOptions{}); err != nil {
+		t.Fatalf("Expected detach to succeed, got %v", err)
+	}
+	if len(tm.GetChildren(org.ID)) != 0 {
+		t.Error("Expected no children after detach")
+	}
+}
+
+func TestPooledQuota(t *testing.T) {
+	tm := NewTenantManager("database")
+	org, _ := tm.CreateTenant("Org", "pro", nil)
+	child, _ := tm.CreateTenant("Child", "free", nil)
+	tm.SetParent(child.ID, org.ID, HierarchyOptions{PoolQuota: true})
+
+	orgQuota, _ := tm.GetQuota(org.ID)
+	childQuota, _ := tm.GetQuota(child.ID)
+
+	tm.IncrementQuotaUsage(child.ID, "api_request")
+	if orgQuota.CurrentRequests != 1 || childQuota.CurrentRequests != 0 {
+		t.Fatalf("Expected pooled usage on org quota, got org=%d child=%d", orgQuota.CurrentRequests, childQuota.CurrentRequests)
+	}
+
+	// The free plan allows 5 resources, but the child now shares the pro pool
+	for i := 0; i < 30; i++ {
+		owner := child.ID
+		if i%2 == 0 {
+			owner = org.ID
+		}
+		if _, err := tm.CreateResource(owner, fmt.Sprintf("r%d", i), nil); err != nil {
+			t.Fatalf("Expected pooled quota to allow resource %d, got %v", i, err)
+		}
+	}
+
+	// 50 resources fill the pro pool for both tenants
+	for i := 30; i < 50; i++ {
+		tm.CreateResource(org.ID, fmt.Sprintf("r%d", i), nil)
+	}
+	if _, err := tm.CreateResource(child.ID, "overflow", nil); err == nil {
+		t.Fatal("Expected pooled quota to be exhausted")
+	}
+}
+
+func TestVisibleToParent(t *testing.T) {
+	tm := NewTenantManager("database")
+	org, _ := tm.CreateTenant("Org", "pro", nil)
+	visible, _ := tm.CreateTenant("Visible", "pro", nil)
+	private, _ := tm.CreateTenant("Private", "pro", nil)
+	tm.SetParent(visible.ID, org.ID, HierarchyOptions{VisibleToParent: true})
+	tm.SetParent(private.ID, org.ID, HierarchyOptions{})
+
+	shown, _ := tm.CreateResource(visible.ID, "shown", nil)
+	hidden, _ := tm.CreateResource(private.ID, "hidden", nil)
+
+	ctx := WithTenantContext(context.Background(), &TenantContext{TenantID: org.ID, UserID: "admin"})
+	if err := tm.ValidateResourceAccess(ctx, shown.ID); err != nil {
+		t.Fatalf("Expected parent to read visible child resource, got %v", err)
+	}
+	if err := tm.ValidateResourceWrite(ctx, shown.ID); err == nil {
+		t.Fatal("Expected parent visibility to be read-only")
+	}
+	if err := tm.ValidateResourceAccess(ctx, hidden.ID); err == nil {
+		t.Fatal("Expected private child resource to stay hidden")
+	}
+
+	// Children never see their parent's resources
+	orgResource, _ := tm.CreateResource(org.ID, "org-only", nil)
+	childCtx := WithTenantContext(context.Background(), &TenantContext{TenantID: visible.ID})
+	if err := tm.ValidateResourceAccess(childCtx, orgResource.ID); err == nil {
+		t.Fatal("Expected child not to see parent resources")
+	}
+
+	resources, _ := tm.ListVisibleResources(org.ID)
+	if len(resources) != 2 {
+		t.Errorf("Expected own and visible child resources, got %d", len(resources))
+	}
+
+	page, _ := tm.QueryAuditLog(visible.ID, AuditQuery{Action: "PARENT_TENANT_READ"})
+	if len(page.Entries) != 1 || page.Entries[0].Details["parent_tenant_id"] != org.ID {
+		t.Errorf("Expected parent read audited in child's log, got %+v", page.Entries)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	tm := NewTenantManager("database")
+	org, _ := tm.CreateTenant("Org", "pro", nil)
+	team, _ := tm.CreateTenant("Team", "pro", nil)
+	squad, _ := tm.CreateTenant("Squad", "pro", nil)
+	tm.SetParent(team.ID, org.ID, HierarchyOptions{})
+	tm.SetParent(squad.ID, team.ID, HierarchyOptions{PoolQuota: true})
+
+	tm.CreateResource(org.ID, "a", nil)
+	tm.CreateResource(team.ID, "b", nil)
+	tm.CreateResource(squad.ID, "c", nil)
+	tm.IncrementQuotaUsage(team.ID, "api_request")
+	tm.IncrementQuotaUsage(squad.ID, "api_request")
+
+	tree := tm.GetTenantStats(org.ID)["tree"].(map[string]interface{})
+	if tree["tenant_count"] != 3 || tree["resource_count"] != 3 || tree["requests"] != 2 {
+		t.Errorf("Unexpected tree stats: %+v", tree)
+	}
+
+	tree = tm.GetTenantStats(squad.ID)["tree"].(map[string]interface{})
+	if tree["tenant_count"] != 1 || tree["resource_count"] != 1 {
+		t.Errorf("Unexpected leaf stats: %+v", tree)
+	}
+}
+
+func TestPurgeTenantWithChildren(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Now()
+	tm.now = func() time.Time { return now }
+
+	org, _ := tm.CreateTenant("Org", "pro", nil)
+	child, _ := tm.CreateTenant("Child", "pro", nil)
+	tm.SetParent(child.ID, org.ID, HierarchyOptions{})
+	tm.DeleteTenant(org.ID)
+
+	now = now.Add(SoftDeleteWindow)
+	if _, err := tm.PurgeTenant(org.ID, false); err == nil {
+		t.Fatal("Expected purge of a parent with children to be refused")
+	}
+}
+
+// ========== Tenant Encryption Key Tests ==========
+
+func newTestKeyManager(t *testing.T) *KeyManager {
+	t.Helper()
+	km, err := NewKeyManager(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return km
+}
+
+func TestKeyManagerEncryptDecrypt(t *testing.T) {
+	if _, err := NewKeyManager([]byte("short")); err == nil {
+		t.Error("Expected short master key to be rejected")
+	}
+
+	km := newTestKeyManager(t)
+	sealed, err := km.Encrypt("t1", []byte("secret"), []byte("t1/r1"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sealed.KeyVersion != 1 || bytes.Contains(sealed.Ciphertext, []byte("secret")) {
+		t.Fatalf("Unexpected sealed data: %+v", sealed)
+	}
+
+	plaintext, err := km.Decrypt("t1", sealed, []byte("t1/r1"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Expected round trip, got %q, %v", plaintext, err)
+	}
+
+	if _, err := km.Decrypt("t1", sealed, []byte("t1/r2")); err == nil {
+		t.Error("Expected mismatched AAD to fail")
+	}
+	if _, err := km.Decrypt("t2", sealed, []byte("t1/r1")); err == nil {
+		t.Error("Expected another tenant's key to fail")
+	}
+}
+
+func TestResourceDataEncryptedAtRest(t *testing.T) {
+	tm := NewTenantManager("database")
+	tm.SetKeyManager(newTestKeyManager(t))
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+
+	created, err := tm.CreateResource(tenant.ID, "doc", map[string]interface{}{"ssn": "123-45-6789"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if created.Data["ssn"] != "123-45-6789" {
+		t.Errorf("Expected plaintext in returned resource, got %v", created.Data)
+	}
+
+	stored := tm.resources[tenant.ID][0]
+	if stored.Data != nil || stored.Encrypted == nil {
+		t.Fatalf("Expected only ciphertext at rest, got %+v", stored)
+	}
+
+	got, err := tm.GetResource(tenant.ID, created.ID)
+	if err != nil || got.Data["ssn"] != "123-45-6789" {
+		t.Fatalf("Expected decrypted data, got %v, %v", got, err)
+	}
+
+	tm.SuspendTenant(tenant.ID, "billing")
+	if _, err := tm.GetResource(tenant.ID, created.ID); err == nil {
+		t.Error("Expected decryption to be refused for a suspended tenant")
+	}
+	if _, err := tm.ListResources(tenant.ID); err == nil {
+		t.Error("Expected listing to be refused for a suspended tenant")
+	}
+}
 
-	resource, _ := tm.CreateResource(tenant1.ID, "resource-1", nil)
+func TestKeyRotationLazyReencryption(t *testing.T) {
+	tm := NewTenantManager("database")
+	tm.SetKeyManager(newTestKeyManager(t))
+	repo := NewMemoryRepository()
+	tm.SetRepositories(repo, repo)
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	resource, _ := tm.CreateResource(tenant.ID, "doc", map[string]interface{}{"k": "v"})
 
-	ctx := context.Background()
-	tenantCtx := &TenantContext{
-		TenantID: tenant2.ID,
+	version, err := tm.RotateTenantKey(tenant.ID)
+	if err != nil || version != 2 {
+		t.Fatalf("Expected key version 2, got %d, %v", version, err)
+	}
+	if v := tm.resources[tenant.ID][0].Encrypted.KeyVersion; v != 1 {
+		t.Fatalf("Expected data to stay on version 1 until read, got %d", v)
 	}
 
-	ctx = WithTenantContext(ctx, tenantCtx)
+	got, err := tm.GetResource(tenant.ID, resource.ID)
+	if err != nil || got.Data["k"] != "v" {
+		t.Fatalf("Expected old ciphertext to decrypt, got %v, %v", got, err)
+	}
+	if v := tm.resources[tenant.ID][0].Encrypted.KeyVersion; v != 2 {
+		t.Errorf("Expected read to re-encrypt with version 2, got %d", v)
+	}
+	persisted, _ := repo.GetResource(context.Background(), tenant.ID, resource.ID)
+	if persisted.Encrypted == nil || persisted.Encrypted.KeyVersion != 2 {
+		t.Errorf("Expected re-encrypted resource to be persisted, got %+v", persisted.Encrypted)
+	}
 
-	// Should not find resource from different tenant
-	err := tm.ValidateResourceAccess(ctx, resource.ID)
-	if err == nil {
-		// It's okay if it returns not found
+	logs := tm.GetAuditLog(tenant.ID)
+	if logs[len(logs)-1].Action != "ROTATE_KEY" {
+		t.Errorf("Expected key rotation to be audited, got %s", logs[len(logs)-1].Action)
 	}
 }
 
@@ -447,6 +1798,108 @@ func TestAuditLogFiltering(t *testing.T) {
 	}
 }
 
+func TestQueryAuditLogFilters(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		tm.logAudit(tenant.ID, "alice", "READ_RESOURCE", "r1", nil)
+		tm.logAudit(tenant.ID, "bob", "WRITE_RESOURCE", "r1", nil)
+	}
+
+	page, err := tm.QueryAuditLog(tenant.ID, AuditQuery{Action: "READ_RESOURCE"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page.Entries) != 5 || page.NextCursor != "" {
+		t.Fatalf("Expected 5 READ_RESOURCE entries on one page, got %d", len(page.Entries))
+	}
+
+	page, _ = tm.QueryAuditLog(tenant.ID, AuditQuery{UserID: "bob"})
+	for _, entry := range page.Entries {
+		if entry.UserID != "bob" {
+			t.Fatalf("Expected only bob's entries, got %+v", entry)
+		}
+	}
+
+	start := time.Date(2024, 1, 1, 0, 2, 0, 0, time.UTC)
+	page, _ = tm.QueryAuditLog(tenant.ID, AuditQuery{Since: start, Until: start.Add(2 * time.Minute)})
+	if len(page.Entries) != 4 {
+		t.Fatalf("Expected 4 entries in time range, got %d", len(page.Entries))
+	}
+	for _, entry := range page.Entries {
+		if entry.Timestamp.Before(start) || !entry.Timestamp.Before(start.Add(2*time.Minute)) {
+			t.Errorf("Entry outside time range: %v", entry.Timestamp)
+		}
+	}
+
+	if _, err := tm.QueryAuditLog(tenant.ID, AuditQuery{Cursor: "not-a-cursor"}); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+}
+
+func TestQueryAuditLogPagination(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	for i := 0; i < 6; i++ {
+		tm.logAudit(tenant.ID, "", "READ_RESOURCE", fmt.Sprintf("r%d", i), nil)
+	}
+
+	var ids []string
+	query := AuditQuery{Action: "READ_RESOURCE", Limit: 4}
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, err := tm.QueryAuditLog(tenant.ID, query)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ResourceID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	if strings.Join(ids, ",") != "r0,r1,r2,r3,r4,r5" {
+		t.Fatalf("Unexpected paginated entries: %v", ids)
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	tm := NewTenantManager("database")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+	tm.SetAuditRetention(AuditRetention{MaxAge: 24 * time.Hour, MaxEntriesPerTenant: 3})
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	for i := 0; i < 4; i++ {
+		tm.logAudit(tenant.ID, "", "READ_RESOURCE", fmt.Sprintf("r%d", i), nil)
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if len(logs) != 3 || logs[0].ResourceID != "r1" {
+		t.Fatalf("Expected newest 3 entries kept, got %d", len(logs))
+	}
+
+	now = now.Add(12 * time.Hour)
+	tm.logAudit(tenant.ID, "", "READ_RESOURCE", "recent", nil)
+
+	if removed := tm.PruneAuditLog(now.Add(13 * time.Hour)); removed != 2 {
+		t.Fatalf("Expected 2 expired entries removed, got %d", removed)
+	}
+	logs = tm.GetAuditLog(tenant.ID)
+	if len(logs) != 1 || logs[0].ResourceID != "recent" {
+		t.Fatalf("Expected only recent entry, got %+v", logs)
+	}
+}
+
 // ========== Tenant Routing Tests ==========
 
 func TestRegisterTenantRoute(t *testing.T) {
@@ -480,6 +1933,111 @@ func TestGetTenantRouteDefault(t *testing.T) {
 	}
 }
 
+// ========== Connection Pool Routing Tests ==========
+
+func newTestRouter(tm *TenantManager, config PoolConfig) (*TenantConnectionRouter, *recordingDriver) {
+	d := newRecordingDriver()
+	router := NewTenantConnectionRouter(tm, func(dsn string) (*sql.DB, error) { return d.open(dsn), nil }, config)
+	return router, d
+}
+
+func TestConnectionRouterSharesPoolsByRoute(t *testing.T) {
+	tm := NewTenantManager("row-level")
+	a, _ := tm.CreateTenant("A", "pro", nil)
+	b, _ := tm.CreateTenant("B", "pro", nil)
+	c, _ := tm.CreateTenant("C", "enterprise", nil)
+	tm.RegisterTenantRoute(c.ID, "postgres://localhost/dedicated")
+
+	router, d := newTestRouter(tm, PoolConfig{MaxOpenConns: 3})
+	defer router.Close()
+
+	if stats := router.Stats(); len(stats.Pools) != 0 {
+		t.Fatalf("Expected pools to open lazily, got %d", len(stats.Pools))
+	}
+
+	dbA, _ := router.DB(a.ID)
+	dbB, _ := router.DB(b.ID)
+	dbC, err := router.DB(c.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dbA != dbB || dbA == dbC {
+		t.Fatal("Expected shared-database tenants to share a pool and the dedicated tenant to have its own")
+	}
+
+	dbC.ExecContext(context.Background(), "SELECT 1")
+	if last := d.last(); last.dsn != "postgres://localhost/dedicated" {
+		t.Errorf("Expected query on the dedicated route, got %s", last.dsn)
+	}
+
+	stats := router.Stats()
+	if stats.Opened != 2 || len(stats.Pools) != 2 {
+		t.Fatalf("Expected 2 pools, got %+v", stats)
+	}
+	shared := stats.Pools[1]
+	if shared.Route != "postgres://localhost/shared_db" || len(shared.Tenants) != 2 {
+		t.Errorf("Unexpected shared pool: %+v", shared)
+	}
+	if shared.DB.MaxOpenConnections != 3 {
+		t.Errorf("Expected max open connections 3, got %d", shared.DB.MaxOpenConnections)
+	}
+
+	if _, err := router.DB("missing"); err == nil {
+		t.Error("Expected unknown tenant to be rejected")
+	}
+}
+
+func TestConnectionRouterShardKey(t *testing.T) {
+	tm := NewTenantManager("row-level")
+	a, _ := tm.CreateTenant("A", "pro", nil)
+	b, _ := tm.CreateTenant("B", "pro", nil)
+
+	router, _ := newTestRouter(tm, PoolConfig{
+		ShardKey: func(tenantID, route string) string { return tenantID },
+	})
+	defer router.Close()
+
+	dbA, _ := router.DB(a.ID)
+	dbB, _ := router.DB(b.ID)
+	if dbA == dbB {
+		t.Error("Expected per-tenant pools when keyed by tenant")
+	}
+}
+
+func TestConnectionRouterEvictsIdlePools(t *testing.T) {
+	tm := NewTenantManager("database")
+	a, _ := tm.CreateTenant("A", "pro", nil)
+	b, _ := tm.CreateTenant("B", "pro", nil)
+
+	router, _ := newTestRouter(tm, PoolConfig{IdleTimeout: time.Minute})
+	defer router.Close()
+
+	start := time.Now()
+	router.now = func() time.Time { return start }
+	dbA, _ := router.DB(a.ID)
+
+	router.now = func() time.Time { return start.Add(45 * time.Second) }
+	router.DB(b.ID)
+
+	evicted := router.EvictIdle(start.Add(time.Minute))
+	if len(evicted) != 1 || evicted[0] != "postgres://localhost/tenant_"+a.ID {
+		t.Fatalf("Expected only the idle pool to be evicted, got %v", evicted)
+	}
+	if err := dbA.Ping(); err == nil {
+		t.Error("Expected evicted pool to be closed")
+	}
+
+	reopened, _ := router.DB(a.ID)
+	if reopened == dbA {
+		t.Error("Expected a fresh pool after eviction")
+	}
+
+	stats := router.Stats()
+	if stats.Opened != 3 || stats.Evicted != 1 || len(stats.Pools) != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
 // ========== Isolation Mode Tests ==========
 
 func TestDatabasePerTenantMode(t *testing.T) {
@@ -512,6 +2070,259 @@ func TestRowLevelMode(t *testing.T) {
 	}
 }
 
+// ========== Storage Backend Tests ==========
+
+func TestMemoryRepositoryWriteThrough(t *testing.T) {
+	repo := NewMemoryRepository()
+	tm := NewTenantManager("row-level")
+	tm.SetRepositories(repo, repo)
+
+	tenant, _ := tm.CreateTenant("TestCorp", "free", map[string]interface{}{"region": "eu"})
+	resource, _ := tm.CreateResource(tenant.ID, "doc", map[string]interface{}{"k": "v"})
+	other, _ := tm.CreateResource(tenant.ID, "tmp", nil)
+	tm.DeleteResource(tenant.ID, other.ID)
+	tm.ChangePlan(tenant.ID, "pro")
+
+	stored, err := repo.GetTenant(context.Background(), tenant.ID)
+	if err != nil || stored.Plan != "pro" {
+		t.Fatalf("Expected stored tenant on pro plan, got %+v, %v", stored, err)
+	}
+
+	restored := NewTenantManager("row-level")
+	restored.SetRepositories(repo, repo)
+	if err := restored.LoadFromRepositories(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	resources, _ := restored.ListResources(tenant.ID)
+	if len(resources) != 1 || resources[0].ID != resource.ID {
+		t.Fatalf("Expected one restored resource, got %+v", resources)
+	}
+	if quota, err := restored.GetQuota(tenant.ID); err != nil || quota.MaxUsers != 50 {
+		t.Errorf("Expected pro quota for restored tenant, got %+v, %v", quota, err)
+	}
+}
+
+func TestMemoryRepositoryCrossTenantSave(t *testing.T) {
+	repo := NewMemoryRepository()
+	ctx := context.Background()
+
+	repo.SaveResource(ctx, &TenantResource{ID: "r1", TenantID: "t1"})
+	if err := repo.SaveResource(ctx, &TenantResource{ID: "r1", TenantID: "t2"}); err == nil {
+		t.Fatal("Expected error overwriting another tenant's resource")
+	}
+	if _, err := repo.GetResource(ctx, "t2", "r1"); err == nil {
+		t.Fatal("Expected resource to be invisible to other tenant")
+	}
+}
+
+func TestNewSQLRepositoryValidation(t *testing.T) {
+	if _, err := NewSQLRepository(nil, "database", nil); err == nil {
+		t.Error("Expected error without open function in database mode")
+	}
+	if _, err := NewSQLRepository(nil, "sharded", nil); err == nil {
+		t.Error("Expected error for unknown isolation mode")
+	}
+}
+
+func TestSQLRepositoryRowLevel(t *testing.T) {
+	d := newRecordingDriver()
+	d.rows = func(query string) ([]string, [][]driver.Value) {
+		if strings.Contains(query, "FROM tenant_resources") {
+			return []string{"id", "tenant_id", "name", "data", "created_at", "updated_at", "encrypted"},
+				[][]driver.Value{{"r1", "t1", "doc", []byte(`{"k":"v"}`), time.Now(), time.Now(), nil}}
+		}
+		return nil, nil
+	}
+
+	repo, _ := NewSQLRepository(d.open("postgres://localhost/shared_db"), "row-level", nil)
+	resources, err := repo.ListResources(context.Background(), "t1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resources) != 1 || resources[0].Data["k"] != "v" {
+		t.Fatalf("Unexpected resources: %+v", resources)
+	}
+
+	q := d.last()
+	if !strings.Contains(q.query, "WHERE tenant_id = $1") || q.args[0] != "t1" {
+		t.Errorf("Expected tenant_id filter, got %q %v", q.query, q.args)
+	}
+}
+
+func TestSQLRepositorySchema(t *testing.T) {
+	d := newRecordingDriver()
+	d.rows = func(query string) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, "FROM tenants"):
+			return []string{"database_url", "schema_name"},
+				[][]driver.Value{{"postgres://localhost/shared_db", "tenant_t1"}}
+		case strings.Contains(query, "FROM tenant_resources"):
+			return []string{"id", "tenant_id", "name", "data", "created_at", "updated_at", "encrypted"},
+				[][]driver.Value{{"r1", "t1", "doc", nil, time.Now(), time.Now(), nil}}
+		}
+		return nil, nil
+	}
+
+	repo, _ := NewSQLRepository(d.open("postgres://localhost/shared_db"), "schema", nil)
+	if _, err := repo.GetResource(context.Background(), "t1", "r1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var statements []string
+	for _, q := range d.log() {
+		statements = append(statements, q.query)
+	}
+	want := []string{"BEGIN", `SET LOCAL search_path TO "tenant_t1"`}
+	if len(statements) != 5 || statements[1] != want[0] || statements[2] != want[1] || statements[4] != "COMMIT" {
+		t.Fatalf("Expected resource query inside search_path transaction, got %q", statements)
+	}
+	if !strings.Contains(statements[3], "WHERE tenant_id = $1 AND id = $2") {
+		t.Errorf("Expected tenant_id filter, got %q", statements[3])
+	}
+}
+
+func TestSQLRepositoryDatabase(t *testing.T) {
+	d := newRecordingDriver()
+	d.rows = func(query string) ([]string, [][]driver.Value) {
+		if strings.Contains(query, "FROM tenants") {
+			return []string{"database_url", "schema_name"},
+				[][]driver.Value{{"postgres://localhost/tenant_t1", nil}}
+		}
+		return nil, nil
+	}
+
+	opened := 0
+	repo, _ := NewSQLRepository(d.open("postgres://localhost/control"), "database", func(dsn string) (*sql.DB, error) {
+		opened++
+		return d.open(dsn), nil
+	})
+	defer repo.Close()
+
+	ctx := context.Background()
+	resource := &TenantResource{ID: "r1", TenantID: "t1", Name: "doc"}
+	if err := repo.SaveResource(ctx, resource); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := repo.DeleteResource(ctx, "t1", "r1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if opened != 1 {
+		t.Errorf("Expected tenant pool to be opened once, got %d", opened)
+	}
+	for _, q := range d.log() {
+		if strings.Contains(q.query, "tenant_resources") && q.dsn != "postgres://localhost/tenant_t1" {
+			t.Errorf("Resource query ran against %s", q.dsn)
+		}
+	}
+}
+
+// recordingDriver is a database/sql driver that records statements and
+// answers queries from a canned rows function
+type recordingDriver struct {
+	mu      sync.Mutex
+	queries []recordedQuery
+	rows    func(query string) ([]string, [][]driver.Value)
+}
+
+type recordedQuery struct {
+	dsn   string
+	query string
+	args  []driver.Value
+}
+
+func newRecordingDriver() *recordingDriver {
+	return &recordingDriver{}
+}
+
+func (d *recordingDriver) open(dsn string) *sql.DB {
+	return sql.OpenDB(recordingConnector{d: d, dsn: dsn})
+}
+
+func (d *recordingDriver) record(dsn, query string, args []driver.NamedValue) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	d.mu.Lock()
+	d.queries = append(d.queries, recordedQuery{dsn: dsn, query: query, args: values})
+	d.mu.Unlock()
+}
+
+func (d *recordingDriver) log() []recordedQuery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]recordedQuery(nil), d.queries...)
+}
+
+func (d *recordingDriver) last() recordedQuery {
+	queries := d.log()
+	return queries[len(queries)-1]
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d: d, dsn: name}, nil
+}
+
+type recordingConnector struct {
+	d   *recordingDriver
+	dsn string
+}
+
+func (c recordingConnector) Connect(ctx context.Context) (driver.Conn, error) { return c.d.Open(c.dsn) }
+func (c recordingConnector) Driver() driver.Driver                            { return c.d }
+
+type recordingConn struct {
+	d   *recordingDriver
+	dsn string
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+func (c *recordingConn) Close() error { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.d.record(c.dsn, "BEGIN", nil)
+	return recordingTx{c}, nil
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.record(c.dsn, query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(c.dsn, query, args)
+	var columns []string
+	var values [][]driver.Value
+	if c.d.rows != nil {
+		columns, values = c.d.rows(query)
+	}
+	return &recordingRows{columns: columns, values: values}, nil
+}
+
+type recordingTx struct{ c *recordingConn }
+
+func (tx recordingTx) Commit() error   { tx.c.d.record(tx.c.dsn, "COMMIT", nil); return nil }
+func (tx recordingTx) Rollback() error { tx.c.d.record(tx.c.dsn, "ROLLBACK", nil); return nil }
+
+type recordingRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string { return r.columns }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
 // ========== Tenant Statistics Tests ==========
 
 func TestGetTenantStats(t *testing.T) {
@@ -533,6 +2344,128 @@ func TestGetTenantStats(t *testing.T) {
 	}
 }
 
+// ========== Data Export & Purge Tests ==========
+
+func TestExportTenantDataJSON(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	tm.CreateResource(tenant.ID, "doc", map[string]interface{}{"k": "v"})
+	other, _ := tm.CreateTenant("OtherCorp", "pro", nil)
+	tm.CreateResource(other.ID, "secret", nil)
+
+	data, err := tm.ExportTenantData(tenant.ID, "json")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var export TenantExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if export.Tenant.ID != tenant.ID || len(export.Resources) != 1 || export.Resources[0].Name != "doc" {
+		t.Fatalf("Unexpected export: %+v", export)
+	}
+	if len(export.AuditLog) != 2 {
+		t.Errorf("Expected 2 audit entries, got %d", len(export.AuditLog))
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if logs[len(logs)-1].Action != "EXPORT_TENANT_DATA" {
+		t.Errorf("Expected export to be audited")
+	}
+}
+
+func TestExportTenantDataNDJSON(t *testing.T) {
+	tm := NewTenantManager("database")
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	tm.CreateResource(tenant.ID, "a", nil)
+	tm.CreateResource(tenant.ID, "b", nil)
+
+	data, err := tm.ExportTenantData(tenant.ID, "ndjson")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid ndjson line %q: %v", line, err)
+		}
+		counts[record.Type]++
+	}
+	if counts["tenant"] != 1 || counts["resource"] != 2 || counts["audit"] != 3 {
+		t.Errorf("Unexpected record counts: %v", counts)
+	}
+
+	if _, err := tm.ExportTenantData(tenant.ID, "xml"); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+}
+
+func TestPurgeTenant(t *testing.T) {
+	repo := NewMemoryRepository()
+	tm := NewTenantManager("database")
+	tm.SetRepositories(repo, repo)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm.now = func() time.Time { return now }
+
+	tenant, _ := tm.CreateTenant("TestCorp", "pro", nil)
+	tm.CreateResource(tenant.ID, "doc", nil)
+	tm.IncrementQuotaUsage(tenant.ID, "api_request")
+	other, _ := tm.CreateTenant("OtherCorp", "pro", nil)
+
+	if _, err := tm.PurgeTenant(tenant.ID, false); err == nil {
+		t.Fatal("Expected error purging active tenant")
+	}
+
+	tm.DeleteTenant(tenant.ID)
+	if _, err := tm.PurgeTenant(tenant.ID, false); err == nil {
+		t.Fatal("Expected error within soft-delete window")
+	}
+
+	now = now.Add(SoftDeleteWindow)
+	report, err := tm.PurgeTenant(tenant.ID, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !report.DryRun || report.Resources != 1 || report.AuditEntries != 3 || report.UsageBuckets != 1 {
+		t.Fatalf("Unexpected dry-run report: %+v", report)
+	}
+	if _, err := tm.GetTenant(tenant.ID); err != nil {
+		t.Fatal("Dry run should not remove the tenant")
+	}
+
+	report, err = tm.PurgeTenant(tenant.ID, false)
+	if err != nil || report.DryRun {
+		t.Fatalf("Expected purge, got %+v, %v", report, err)
+	}
+
+	if _, err := tm.GetTenant(tenant.ID); err == nil {
+		t.Error("Expected tenant to be gone")
+	}
+	if _, err := tm.GetQuota(tenant.ID); err == nil {
+		t.Error("Expected quota to be gone")
+	}
+	if _, err := repo.GetTenant(context.Background(), tenant.ID); err == nil {
+		t.Error("Expected tenant to be removed from repository")
+	}
+	if _, err := tm.GetTenant(other.ID); err != nil {
+		t.Error("Other tenants must not be affected")
+	}
+
+	logs := tm.GetAuditLog(tenant.ID)
+	if len(logs) != 1 || logs[0].Action != "PURGE_TENANT" || logs[0].Details["resources"] != 1 {
+		t.Errorf("Expected only the PURGE_TENANT entry to remain, got %+v", logs)
+	}
+	if len(tm.GetAuditLog(other.ID)) != 1 {
+		t.Error("Other tenants' audit entries must be kept")
+	}
+}
+
 // ========== Integration Tests ==========
 
 func TestMultiTenantIsolation(t *testing.T) {
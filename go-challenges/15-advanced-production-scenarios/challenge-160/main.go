@@ -2,8 +2,15 @@ package main
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,16 +18,18 @@ import (
 // ========== Feature Flag Models ==========
 
 type FeatureFlag struct {
-	ID              string            `json:"id"`
-	Name            string            `json:"name"`
-	Description     string            `json:"description"`
-	Enabled         bool              `json:"enabled"`
-	RolloutPercent  int               `json:"rollout_percent"`
-	TargetedUsers   map[string]bool   `json:"targeted_users"`
-	Segments        []string          `json:"segments"`
-	CreatedAt       time.Time         `json:"created_at"`
-	UpdatedAt       time.Time         `json:"updated_at"`
-	CreatedBy       string            `json:"created_by"`
+	ID             string          `json:"id"`
+	Name           string          `json:"name"`
+	Description    string          `json:"description"`
+	Enabled        bool            `json:"enabled"`
+	RolloutPercent int             `json:"rollout_percent"`
+	TargetedUsers  map[string]bool `json:"targeted_users"`
+	Segments       []string        `json:"segments"`
+	Variants       []FlagVariant   `json:"variants,omitempty"`
+	OffVariant     string          `json:"off_variant,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	CreatedBy      string          `json:"created_by"`
 }
 
 type FlagEvaluation struct {
@@ -46,6 +55,8 @@ type SegmentRule struct {
 	Attribute string      `json:"attribute"`
 	Operator  string      `json:"operator"` // equals, contains, greaterThan, etc
 	Value     interface{} `json:"value"`
+
+	pattern *regexp.Regexp // compiled Value for the regex operator
 }
 
 // ========== A/B Testing Models ==========
@@ -101,6 +112,8 @@ type ExperimentMetrics struct {
 	Exposures       int64                  `json:"exposures"`
 	Conversions     int64                  `json:"conversions"`
 	ConversionRate  float64                `json:"conversion_rate"`
+	Errors          int64                  `json:"errors"`
+	ErrorRate       float64                `json:"error_rate"`
 	ConfidenceScore float64                `json:"confidence_score"`
 }
 
@@ -111,9 +124,18 @@ type FeatureFlagManager struct {
 	flagsMu         sync.RWMutex
 	segments        map[string]*UserSegment
 	segmentsMu      sync.RWMutex
-	evaluationCache map[string]*FlagEvaluation
+	evaluationCache map[string]map[string]cachedEvaluation // flag ID -> user key
+	cacheGeneration map[string]uint64                       // bumped by invalidateCache
 	cacheMu         sync.RWMutex
 	cacheTTL        time.Duration
+	subscribers     map[int]chan FlagChange
+	nextSubscriber  int
+	subscribersMu   sync.Mutex
+}
+
+type cachedEvaluation struct {
+	evaluation *FlagEvaluation
+	expiresAt  time.Time
 }
 
 // NewFeatureFlagManager creates a new feature flag manager
@@ -121,8 +143,10 @@ func NewFeatureFlagManager(cacheTTL time.Duration) *FeatureFlagManager {
 	return &FeatureFlagManager{
 		flags:           make(map[string]*FeatureFlag),
 		segments:        make(map[string]*UserSegment),
-		evaluationCache: make(map[string]*FlagEvaluation),
+		evaluationCache: make(map[string]map[string]cachedEvaluation),
+		cacheGeneration: make(map[string]uint64),
 		cacheTTL:        cacheTTL,
+		subscribers:     make(map[int]chan FlagChange),
 	}
 }
 
@@ -152,6 +176,7 @@ func (fm *FeatureFlagManager) CreateFlag(name, description string, enabled bool,
 	}
 
 	fm.flags[flag.ID] = flag
+	fm.publishChange("created", flag)
 	return flag, nil
 }
 
@@ -186,6 +211,7 @@ func (fm *FeatureFlagManager) SetRolloutPercent(flagID string, percent int) erro
 	flag.UpdatedAt = time.Now()
 
 	fm.invalidateCache(flagID)
+	fm.publishChange("updated", flag)
 	return nil
 }
 
@@ -203,6 +229,7 @@ func (fm *FeatureFlagManager) TargetUser(flagID, userID string) error {
 	flag.UpdatedAt = time.Now()
 
 	fm.invalidateCache(flagID)
+	fm.publishChange("updated", flag)
 	return nil
 }
 
@@ -220,22 +247,38 @@ func (fm *FeatureFlagManager) RemoveTargetedUser(flagID, userID string) error {
 	flag.UpdatedAt = time.Now()
 
 	fm.invalidateCache(flagID)
+	fm.publishChange("updated", flag)
 	return nil
 }
 
 // EvaluateFlag evaluates a flag for a user
 func (fm *FeatureFlagManager) EvaluateFlag(flagID, userID string) (*FlagEvaluation, error) {
+	return fm.EvaluateFlagWithAttributes(flagID, userID, nil)
+}
+
+// EvaluateFlagWithAttributes evaluates a flag for a user whose attributes
+// are matched against the flag's segments. Precedence, highest first:
+// disabled flag, targeted user, first matching segment in the order the
+// segments were added, rollout percentage.
+func (fm *FeatureFlagManager) EvaluateFlagWithAttributes(flagID, userID string, attributes map[string]interface{}) (*FlagEvaluation, error) {
 	// Check cache first
-	cacheKey := fmt.Sprintf("%s:%s", flagID, userID)
-	fm.cacheMu.RLock()
-	if cached, exists := fm.evaluationCache[cacheKey]; exists {
-		fm.cacheMu.RUnlock()
+	cacheKey := userID
+	if len(attributes) > 0 {
+		cacheKey += ":" + attributesKey(attributes)
+	}
+	cached, generation, ok := fm.cachedEvaluation(flagID, cacheKey)
+	if ok {
 		return cached, nil
 	}
-	fm.cacheMu.RUnlock()
 
+	// Evaluate against a copy so updates, such as a scheduled rollout
+	// stepping up, can't change the flag mid-evaluation
 	fm.flagsMu.RLock()
-	flag, exists := fm.flags[flagID]
+	stored, exists := fm.flags[flagID]
+	var flag *FeatureFlag
+	if exists {
+		flag = copyFlag(stored)
+	}
 	fm.flagsMu.RUnlock()
 
 	if !exists {
@@ -248,10 +291,19 @@ func (fm *FeatureFlagManager) EvaluateFlag(flagID, userID string) (*FlagEvaluati
 		EvaluatedAt: time.Now(),
 	}
 
+	// Multivariate flags report the variant the user is served
+	if len(flag.Variants) > 0 {
+		evaluation.VariantID = flag.OffVariant
+		if flag.Enabled {
+			evaluation.VariantID = assignBucket(userID, flagID, flag.variantWeights())
+		}
+	}
+
 	// Check if flag is disabled
 	if !flag.Enabled {
 		evaluation.Enabled = false
 		evaluation.Reason = "flag_disabled"
+		fm.cacheEvaluation(flagID, cacheKey, generation, evaluation)
 		return evaluation, nil
 	}
 
@@ -259,7 +311,16 @@ func (fm *FeatureFlagManager) EvaluateFlag(flagID, userID string) (*FlagEvaluati
 	if flag.TargetedUsers[userID] {
 		evaluation.Enabled = true
 		evaluation.Reason = "user_targeted"
-		fm.cacheEvaluation(cacheKey, evaluation)
+		fm.cacheEvaluation(flagID, cacheKey, generation, evaluation)
+		return evaluation, nil
+	}
+
+	// Check segments
+	if segmentID, matched := fm.matchFlagSegments(flag, userID, attributes); matched {
+		evaluation.Enabled = true
+		evaluation.Reason = "segment_match"
+		evaluation.RuleMatched = segmentID
+		fm.cacheEvaluation(flagID, cacheKey, generation, evaluation)
 		return evaluation, nil
 	}
 
@@ -272,14 +333,318 @@ func (fm *FeatureFlagManager) EvaluateFlag(flagID, userID string) (*FlagEvaluati
 		evaluation.Reason = "failed_rollout"
 	}
 
-	fm.cacheEvaluation(cacheKey, evaluation)
+	fm.cacheEvaluation(flagID, cacheKey, generation, evaluation)
 	return evaluation, nil
 }
 
+// ========== Multivariate Flags ==========
+
+// A flag with variants serves one of them per user instead of just on or
+// off. Users are bucketed with assignBucket, the same function the A/B test
+// manager uses, salted with the flag ID.
+
+// FlagVariant is one value a multivariate flag can serve.
+type FlagVariant struct {
+	Key    string      `json:"key"`
+	Type   string      `json:"type"` // string, number, json
+	Value  interface{} `json:"value"`
+	Weight int         `json:"weight"` // percent of users
+}
+
+// StringValue returns the payload of a string variant
+func (v *FlagVariant) StringValue() (string, error) {
+	s, ok := v.Value.(string)
+	if v.Type != "string" || !ok {
+		return "", fmt.Errorf("variant %s is %s, not string", v.Key, v.Type)
+	}
+	return s, nil
+}
+
+// NumberValue returns the payload of a number variant
+func (v *FlagVariant) NumberValue() (float64, error) {
+	n, ok := toFloat(v.Value)
+	if v.Type != "number" || !ok {
+		return 0, fmt.Errorf("variant %s is %s, not number", v.Key, v.Type)
+	}
+	return n, nil
+}
+
+// DecodeJSON unmarshals the payload of a json variant into out
+func (v *FlagVariant) DecodeJSON(out interface{}) error {
+	raw, ok := v.Value.(json.RawMessage)
+	if v.Type != "json" || !ok {
+		return fmt.Errorf("variant %s is %s, not json", v.Key, v.Type)
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// SetVariants replaces a flag's variants. Weights must add up to 100 and
+// keys must be unique. offVariant, if not empty, is served while the flag is
+// disabled. JSON payloads are stored encoded.
+func (fm *FeatureFlagManager) SetVariants(flagID string, variants []FlagVariant, offVariant string) error {
+	validated := make([]FlagVariant, len(variants))
+	keys := make(map[string]bool)
+	total := 0
+	for i, v := range variants {
+		if v.Key == "" {
+			return errors.New("variant key is required")
+		}
+		if keys[v.Key] {
+			return fmt.Errorf("duplicate variant %s", v.Key)
+		}
+		keys[v.Key] = true
+		if v.Weight < 0 {
+			return fmt.Errorf("variant %s: weight must not be negative", v.Key)
+		}
+		total += v.Weight
+
+		switch v.Type {
+		case "string":
+			if _, ok := v.Value.(string); !ok {
+				return fmt.Errorf("variant %s: value must be a string", v.Key)
+			}
+		case "number":
+			if _, isString := v.Value.(string); isString {
+				return fmt.Errorf("variant %s: value must be a number", v.Key)
+			}
+			if _, ok := toFloat(v.Value); !ok {
+				return fmt.Errorf("variant %s: value must be a number", v.Key)
+			}
+		case "json":
+			raw, ok := v.Value.(json.RawMessage)
+			if !ok {
+				encoded, err := json.Marshal(v.Value)
+				if err != nil {
+					return fmt.Errorf("variant %s: %w", v.Key, err)
+				}
+				raw = encoded
+			}
+			if !json.Valid(raw) {
+				return fmt.Errorf("variant %s: invalid JSON", v.Key)
+			}
+			v.Value = raw
+		default:
+			return fmt.Errorf("variant %s: unknown type %q", v.Key, v.Type)
+		}
+		validated[i] = v
+	}
+	if len(validated) > 0 && total != 100 {
+		return fmt.Errorf("variant weights must add up to 100, got %d", total)
+	}
+	if offVariant != "" && !keys[offVariant] {
+		return fmt.Errorf("off variant %s not found", offVariant)
+	}
+
+	fm.flagsMu.Lock()
+	defer fm.flagsMu.Unlock()
+
+	flag, exists := fm.flags[flagID]
+	if !exists {
+		return errors.New("flag not found")
+	}
+
+	flag.Variants = validated
+	flag.OffVariant = offVariant
+	flag.UpdatedAt = time.Now()
+
+	fm.invalidateCache(flagID)
+	fm.publishChange("updated", flag)
+	return nil
+}
+
+// GetVariant returns the variant a user is served
+func (fm *FeatureFlagManager) GetVariant(flagID, userID string) (*FlagVariant, error) {
+	fm.flagsMu.RLock()
+	defer fm.flagsMu.RUnlock()
+
+	flag, exists := fm.flags[flagID]
+	if !exists {
+		return nil, errors.New("flag not found")
+	}
+	if len(flag.Variants) == 0 {
+		return nil, errors.New("flag has no variants")
+	}
+
+	key := flag.OffVariant
+	if !flag.Enabled {
+		if key == "" {
+			return nil, errors.New("flag disabled and has no off variant")
+		}
+	} else {
+		key = assignBucket(userID, flagID, flag.variantWeights())
+	}
+
+	for _, v := range flag.Variants {
+		if v.Key == key {
+			variant := v
+			return &variant, nil
+		}
+	}
+	return nil, fmt.Errorf("variant %s not found", key)
+}
+
+func (f *FeatureFlag) variantWeights() map[string]int {
+	weights := make(map[string]int, len(f.Variants))
+	for _, v := range f.Variants {
+		weights[v.Key] = v.Weight
+	}
+	return weights
+}
+
+// ========== Change Stream ==========
+
+// FlagChange describes a change to a flag. Flag is a copy of the flag's full
+// state after the change, so a client that misses a change catches up on the
+// next one.
+type FlagChange struct {
+	Type      string       `json:"type"` // created, updated
+	FlagID    string       `json:"flag_id"`
+	Flag      *FeatureFlag `json:"flag"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+// Subscribe returns a channel of flag changes and a function that
+// unsubscribes and closes it. When the buffer is full the oldest pending
+// change is dropped, so a slow subscriber never blocks flag updates.
+func (fm *FeatureFlagManager) Subscribe(buffer int) (<-chan FlagChange, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	ch := make(chan FlagChange, buffer)
+
+	fm.subscribersMu.Lock()
+	id := fm.nextSubscriber
+	fm.nextSubscriber++
+	fm.subscribers[id] = ch
+	fm.subscribersMu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			fm.subscribersMu.Lock()
+			delete(fm.subscribers, id)
+			fm.subscribersMu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publishChange sends a change to every subscriber. Callers hold flagsMu,
+// which orders changes to the same flag.
+func (fm *FeatureFlagManager) publishChange(changeType string, flag *FeatureFlag) {
+	change := FlagChange{
+		Type:      changeType,
+		FlagID:    flag.ID,
+		Flag:      copyFlag(flag),
+		Timestamp: time.Now(),
+	}
+
+	fm.subscribersMu.Lock()
+	defer fm.subscribersMu.Unlock()
+
+	for _, ch := range fm.subscribers {
+		select {
+		case ch <- change:
+			continue
+		default:
+		}
+		// Full: make room by dropping the oldest change
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// StreamHandler serves flag changes as server-sent events. A client first
+// receives a "snapshot" event listing every flag, then one event per change
+// named after the change type.
+func (fm *FeatureFlagManager) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		// Subscribe before taking the snapshot so no change falls between them
+		changes, unsubscribe := fm.Subscribe(64)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		if err := writeEvent(w, "snapshot", fm.snapshotFlags()); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+				if err := writeEvent(w, change.Type, change); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+func (fm *FeatureFlagManager) snapshotFlags() []*FeatureFlag {
+	fm.flagsMu.RLock()
+	defer fm.flagsMu.RUnlock()
+
+	flags := make([]*FeatureFlag, 0, len(fm.flags))
+	for _, flag := range fm.flags {
+		flags = append(flags, copyFlag(flag))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].ID < flags[j].ID })
+	return flags
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+func copyFlag(flag *FeatureFlag) *FeatureFlag {
+	c := *flag
+	c.TargetedUsers = make(map[string]bool, len(flag.TargetedUsers))
+	for userID, targeted := range flag.TargetedUsers {
+		c.TargetedUsers[userID] = targeted
+	}
+	c.Segments = append([]string(nil), flag.Segments...)
+	c.Variants = append([]FlagVariant(nil), flag.Variants...)
+	return &c
+}
+
 // ========== Segment Management ==========
 
 // CreateSegment creates a user segment
 func (fm *FeatureFlagManager) CreateSegment(name, description string, rules []SegmentRule) (*UserSegment, error) {
+	compiled := make([]SegmentRule, len(rules))
+	for i, rule := range rules {
+		if err := compileRule(&rule); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		compiled[i] = rule
+	}
+
 	fm.segmentsMu.Lock()
 	defer fm.segmentsMu.Unlock()
 
@@ -287,7 +652,7 @@ func (fm *FeatureFlagManager) CreateSegment(name, description string, rules []Se
 		ID:          generateSegmentID(),
 		Name:        name,
 		Description: description,
-		Rules:       rules,
+		Rules:       compiled,
 		CreatedAt:   time.Now(),
 	}
 
@@ -324,9 +689,363 @@ func (fm *FeatureFlagManager) AddSegmentToFlag(flagID, segmentID string) error {
 	flag.UpdatedAt = time.Now()
 
 	fm.invalidateCache(flagID)
+	fm.publishChange("updated", flag)
+	return nil
+}
+
+// ========== Segment Rule Evaluation ==========
+
+// A segment matches a user when every one of its rules matches; a segment
+// without rules matches nobody. A rule on an attribute the user does not
+// have never matches, except "user_id", which defaults to the evaluated
+// user's ID.
+
+var segmentOperators = map[string]bool{
+	"equals":             true,
+	"notEquals":          true,
+	"contains":           true,
+	"greaterThan":        true,
+	"greaterThanOrEqual": true,
+	"lessThan":           true,
+	"lessThanOrEqual":    true,
+	"in":                 true,
+	"notIn":              true,
+	"regex":              true,
+	"semverEquals":       true,
+	"semverGreaterThan":  true,
+	"semverLessThan":     true,
+}
+
+// compileRule validates a rule and precompiles its regex.
+func compileRule(rule *SegmentRule) error {
+	if rule.Attribute == "" {
+		return errors.New("attribute is required")
+	}
+	if !segmentOperators[rule.Operator] {
+		return fmt.Errorf("unknown operator %q", rule.Operator)
+	}
+
+	switch rule.Operator {
+	case "regex":
+		pattern, ok := rule.Value.(string)
+		if !ok {
+			return errors.New("regex value must be a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		rule.pattern = re
+	case "in", "notIn":
+		if _, ok := toList(rule.Value); !ok {
+			return fmt.Errorf("%s value must be a list", rule.Operator)
+		}
+	case "greaterThan", "greaterThanOrEqual", "lessThan", "lessThanOrEqual":
+		if _, ok := toFloat(rule.Value); !ok {
+			return fmt.Errorf("%s value must be a number", rule.Operator)
+		}
+	case "semverEquals", "semverGreaterThan", "semverLessThan":
+		if _, err := parseSemver(fmt.Sprint(rule.Value)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Matches reports whether the attributes satisfy the rule.
+func (r SegmentRule) Matches(attributes map[string]interface{}) bool {
+	actual, ok := attributes[r.Attribute]
+	if !ok {
+		return false
+	}
+
+	switch r.Operator {
+	case "equals":
+		return valuesEqual(actual, r.Value)
+	case "notEquals":
+		return !valuesEqual(actual, r.Value)
+	case "contains":
+		if list, ok := toList(actual); ok {
+			return listContains(list, r.Value)
+		}
+		return strings.Contains(fmt.Sprint(actual), fmt.Sprint(r.Value))
+	case "greaterThan", "greaterThanOrEqual", "lessThan", "lessThanOrEqual":
+		a, ok1 := toFloat(actual)
+		b, ok2 := toFloat(r.Value)
+		if !ok1 || !ok2 {
+			return false
+		}
+		switch r.Operator {
+		case "greaterThan":
+			return a > b
+		case "greaterThanOrEqual":
+			return a >= b
+		case "lessThan":
+			return a < b
+		default:
+			return a <= b
+		}
+	case "in", "notIn":
+		list, _ := toList(r.Value)
+		return listContains(list, actual) == (r.Operator == "in")
+	case "regex":
+		pattern := r.pattern
+		if pattern == nil {
+			var err error
+			if pattern, err = regexp.Compile(fmt.Sprint(r.Value)); err != nil {
+				return false
+			}
+		}
+		return pattern.MatchString(fmt.Sprint(actual))
+	case "semverEquals", "semverGreaterThan", "semverLessThan":
+		a, err1 := parseSemver(fmt.Sprint(actual))
+		b, err2 := parseSemver(fmt.Sprint(r.Value))
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		cmp := compareSemver(a, b)
+		switch r.Operator {
+		case "semverEquals":
+			return cmp == 0
+		case "semverGreaterThan":
+			return cmp > 0
+		default:
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+// Matches reports whether every rule of the segment matches.
+func (s *UserSegment) Matches(attributes map[string]interface{}) bool {
+	if len(s.Rules) == 0 {
+		return false
+	}
+	for _, rule := range s.Rules {
+		if !rule.Matches(attributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchSegment reports whether a user belongs to a segment
+func (fm *FeatureFlagManager) MatchSegment(segmentID, userID string, attributes map[string]interface{}) (bool, error) {
+	fm.segmentsMu.RLock()
+	segment, exists := fm.segments[segmentID]
+	fm.segmentsMu.RUnlock()
+
+	if !exists {
+		return false, errors.New("segment not found")
+	}
+	return segment.Matches(withUserID(attributes, userID)), nil
+}
+
+// matchFlagSegments returns the first of the flag's segments the user
+// matches.
+func (fm *FeatureFlagManager) matchFlagSegments(flag *FeatureFlag, userID string, attributes map[string]interface{}) (string, bool) {
+	fm.flagsMu.RLock()
+	segmentIDs := append([]string(nil), flag.Segments...)
+	fm.flagsMu.RUnlock()
+	if len(segmentIDs) == 0 {
+		return "", false
+	}
+
+	attributes = withUserID(attributes, userID)
+
+	fm.segmentsMu.RLock()
+	defer fm.segmentsMu.RUnlock()
+	for _, id := range segmentIDs {
+		if segment, exists := fm.segments[id]; exists && segment.Matches(attributes) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// withUserID returns attributes with "user_id" defaulted to userID.
+func withUserID(attributes map[string]interface{}, userID string) map[string]interface{} {
+	if _, ok := attributes["user_id"]; ok {
+		return attributes
+	}
+	merged := make(map[string]interface{}, len(attributes)+1)
+	for k, v := range attributes {
+		merged[k] = v
+	}
+	merged["user_id"] = userID
+	return merged
+}
+
+// attributesKey is a stable encoding of attributes for cache keys.
+func attributesKey(attributes map[string]interface{}) string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, attributes[k])
+	}
+	return strings.Join(parts, "&")
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func listContains(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if valuesEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toList(v interface{}) ([]interface{}, bool) {
+	switch l := v.(type) {
+	case []interface{}:
+		return l, true
+	case []string:
+		list := make([]interface{}, len(l))
+		for i, s := range l {
+			list[i] = s
+		}
+		return list, true
+	case []int:
+		list := make([]interface{}, len(l))
+		for i, n := range l {
+			list[i] = n
+		}
+		return list, true
+	case []float64:
+		list := make([]interface{}, len(l))
+		for i, n := range l {
+			list[i] = n
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseSemver accepts "1.2.3", "v1.2" and "1.2.3-beta.1"; build metadata
+// after "+" is ignored.
+func parseSemver(s string) (semver, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var version semver
+	if i := strings.Index(v, "-"); i >= 0 {
+		version.prerelease = strings.Split(v[i+1:], ".")
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return semver{}, fmt.Errorf("invalid semver %q", s)
+	}
+	nums := []*int{&version.major, &version.minor, &version.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, fmt.Errorf("invalid semver %q", s)
+		}
+		*nums[i] = n
+	}
+	return version, nil
+}
+
+// compareSemver orders versions by semver precedence: a pre-release sorts
+// before its release.
+func compareSemver(a, b semver) int {
+	for _, d := range []int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d != 0 {
+			if d < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+		x, y := a.prerelease[i], b.prerelease[i]
+		if x == y {
+			continue
+		}
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case xErr == nil:
+			return -1
+		case yErr == nil:
+			return 1
+		case x < y:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(a.prerelease) < len(b.prerelease):
+		return -1
+	case len(a.prerelease) > len(b.prerelease):
+		return 1
+	}
+	return 0
+}
+
 // ========== A/B Testing Manager ==========
 
 type ABTestManager struct {
@@ -411,8 +1130,13 @@ func (am *ABTestManager) AssignVariant(experimentID, userID string) (string, err
 		return "", errors.New("experiment not found")
 	}
 
-	// Assign variant based on hash
-	variantID := selectVariant(userID, experimentID, exp.Variants)
+	// Assign variant based on hash, bucketing by flag so the experiment
+	// agrees with the flag's own variants
+	salt := experimentID
+	if exp.FlagID != "" {
+		salt = exp.FlagID
+	}
+	variantID := selectVariant(userID, salt, exp.Variants)
 
 	am.variantAssign[experimentID][userID] = variantID
 
@@ -422,22 +1146,38 @@ func (am *ABTestManager) AssignVariant(experimentID, userID string) (string, err
 	return variantID, nil
 }
 
-func selectVariant(userID, experimentID string, variants map[string]*Variant) string {
-	hash := hashUserID(userID, experimentID) % 100
-	cumulativePercent := 0
-
+func selectVariant(userID, salt string, variants map[string]*Variant) string {
+	weights := make(map[string]int, len(variants))
 	for _, variant := range variants {
-		cumulativePercent += variant.TrafficPercent
-		if int(hash) < cumulativePercent {
-			return variant.ID
-		}
+		weights[variant.ID] = variant.TrafficPercent
 	}
+	return assignBucket(userID, salt, weights)
+}
 
-	// Fallback to first variant
-	for _, variant := range variants {
-		return variant.ID
+// assignBucket places a user in one of 100 buckets for salt and returns the
+// key whose cumulative weight range holds it, walking keys in sorted order so
+// the result never depends on map iteration. Users past the total weight get
+// the first key. Feature flag variants and experiment variants both use it,
+// so equal keys, weights and salt give equal assignments.
+func assignBucket(userID, salt string, weights map[string]int) string {
+	keys := make([]string, 0, len(weights))
+	for k := range weights {
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return ""
 	}
-	return ""
+	sort.Strings(keys)
+
+	bucket := int(hashUserID(userID, salt) % 100)
+	cumulative := 0
+	for _, k := range keys {
+		cumulative += weights[k]
+		if bucket < cumulative {
+			return k
+		}
+	}
+	return keys[0]
 }
 
 // RecordConversion records a conversion for a user
@@ -462,6 +1202,32 @@ func (am *ABTestManager) RecordConversion(experimentID, userID string, metadata
 	return nil
 }
 
+// RecordError records an error seen by a user, such as a failed request in
+// the variant they were served
+func (am *ABTestManager) RecordError(experimentID, userID string, metadata map[string]interface{}) error {
+	am.variantMu.RLock()
+	variantID, exists := am.variantAssign[experimentID][userID]
+	am.variantMu.RUnlock()
+
+	if !exists {
+		return errors.New("user not assigned to experiment")
+	}
+
+	am.recordExperimentEvent(experimentID, userID, variantID, "error")
+
+	am.metricsMu.Lock()
+	key := fmt.Sprintf("%s:%s", experimentID, variantID)
+	if metric, exists := am.metrics[key]; exists {
+		metric.Errors++
+		if metric.Exposures > 0 {
+			metric.ErrorRate = float64(metric.Errors) / float64(metric.Exposures)
+		}
+	}
+	am.metricsMu.Unlock()
+
+	return nil
+}
+
 // GetMetrics gets metrics for an experiment variant
 func (am *ABTestManager) GetMetrics(experimentID, variantID string) (*ExperimentMetrics, error) {
 	am.metricsMu.RLock()
@@ -500,29 +1266,407 @@ func (am *ABTestManager) recordExperimentEvent(experimentID, userID, variantID,
 		}
 	}
 	if eventType == "exposure" {
-		am.metrics[key].Exposures++
+		metric := am.metrics[key]
+		metric.Exposures++
+		metric.ErrorRate = float64(metric.Errors) / float64(metric.Exposures)
 	}
 	am.metricsMu.Unlock()
 }
 
+// worstErrorRate returns the highest error rate among an experiment's
+// variants with at least minExposures exposures, and that variant's ID
+func (am *ABTestManager) worstErrorRate(experimentID string, minExposures int64) (float64, string) {
+	am.metricsMu.RLock()
+	defer am.metricsMu.RUnlock()
+
+	worst, worstVariant := 0.0, ""
+	for _, metric := range am.metrics {
+		if metric.ExperimentID != experimentID || metric.Exposures < minExposures {
+			continue
+		}
+		if worstVariant == "" || metric.ErrorRate > worst {
+			worst, worstVariant = metric.ErrorRate, metric.VariantID
+		}
+	}
+	return worst, worstVariant
+}
+
+// ========== Rollout Scheduling ==========
+
+// A rollout schedule ramps a flag's rollout percentage through a list of
+// stages, e.g. 5% -> 25% -> 50% -> 100%, moving to the next stage once the
+// current one has run for its duration. A guardrail halts the ramp when an
+// attached experiment's error rate climbs past a limit.
+
+// RolloutStage is one step of a rollout schedule
+type RolloutStage struct {
+	Percent  int           `json:"percent"`
+	Duration time.Duration `json:"duration"` // time at this stage before the next; ignored for the last stage
+}
+
+// RolloutGuardrail halts a rollout when a variant of the experiment with at
+// least MinExposures exposures has an error rate above MaxErrorRate
+type RolloutGuardrail struct {
+	ExperimentID string  `json:"experiment_id"`
+	MaxErrorRate float64 `json:"max_error_rate"`
+	MinExposures int64   `json:"min_exposures"`
+}
+
+// RolloutSchedule is the state of a flag's scheduled rollout
+type RolloutSchedule struct {
+	FlagID         string            `json:"flag_id"`
+	Stages         []RolloutStage    `json:"stages"`
+	CurrentStage   int               `json:"current_stage"`
+	Status         string            `json:"status"` // running, paused, halted, completed, aborted
+	StageStartedAt time.Time         `json:"stage_started_at"`
+	Guardrail      *RolloutGuardrail `json:"guardrail,omitempty"`
+	HaltReason     string            `json:"halt_reason,omitempty"`
+	pausedElapsed  time.Duration
+}
+
+// RolloutScheduler drives rollout schedules for a flag manager
+type RolloutScheduler struct {
+	flags       *FeatureFlagManager
+	experiments *ABTestManager
+	schedules   map[string]*RolloutSchedule // flag ID -> schedule
+	mu          sync.Mutex
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewRolloutScheduler creates a rollout scheduler. experiments may be nil if
+// no guardrails are used.
+func NewRolloutScheduler(flags *FeatureFlagManager, experiments *ABTestManager) *RolloutScheduler {
+	return &RolloutScheduler{
+		flags:       flags,
+		experiments: experiments,
+		schedules:   make(map[string]*RolloutSchedule),
+	}
+}
+
+// ScheduleRollout starts a rollout schedule for a flag, applying the first
+// stage immediately. Stage percentages must not decrease, and every stage
+// but the last needs a positive duration.
+func (rs *RolloutScheduler) ScheduleRollout(flagID string, stages []RolloutStage) (*RolloutSchedule, error) {
+	if len(stages) == 0 {
+		return nil, errors.New("rollout needs at least one stage")
+	}
+	for i, stage := range stages {
+		if stage.Percent < 0 || stage.Percent > 100 {
+			return nil, errors.New("rollout percent must be between 0 and 100")
+		}
+		if i > 0 && stage.Percent < stages[i-1].Percent {
+			return nil, fmt.Errorf("stage %d: rollout percent must not decrease", i)
+		}
+		if i < len(stages)-1 && stage.Duration <= 0 {
+			return nil, fmt.Errorf("stage %d: duration must be positive", i)
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if existing, exists := rs.schedules[flagID]; exists && existing.active() {
+		return nil, errors.New("flag already has an active rollout")
+	}
+
+	schedule := &RolloutSchedule{
+		FlagID: flagID,
+		Stages: append([]RolloutStage(nil), stages...),
+		Status: "running",
+	}
+	if err := rs.enterStage(schedule, 0, time.Now()); err != nil {
+		return nil, err
+	}
+
+	rs.schedules[flagID] = schedule
+	return schedule.copy(), nil
+}
+
+// AttachGuardrail halts the flag's rollout if the experiment's error rate
+// goes above maxErrorRate. Variants with fewer than minExposures exposures
+// are not judged yet.
+func (rs *RolloutScheduler) AttachGuardrail(flagID, experimentID string, maxErrorRate float64, minExposures int64) error {
+	if rs.experiments == nil {
+		return errors.New("scheduler has no experiment manager")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	schedule, exists := rs.schedules[flagID]
+	if !exists {
+		return errors.New("rollout not found")
+	}
+
+	schedule.Guardrail = &RolloutGuardrail{
+		ExperimentID: experimentID,
+		MaxErrorRate: maxErrorRate,
+		MinExposures: minExposures,
+	}
+	return nil
+}
+
+// GetRollout returns a copy of a flag's rollout schedule
+func (rs *RolloutScheduler) GetRollout(flagID string) (*RolloutSchedule, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	schedule, exists := rs.schedules[flagID]
+	if !exists {
+		return nil, errors.New("rollout not found")
+	}
+	return schedule.copy(), nil
+}
+
+// PauseRollout stops a running rollout from progressing. Time already spent
+// in the current stage counts when it resumes.
+func (rs *RolloutScheduler) PauseRollout(flagID string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	schedule, exists := rs.schedules[flagID]
+	if !exists {
+		return errors.New("rollout not found")
+	}
+	if schedule.Status != "running" {
+		return fmt.Errorf("cannot pause %s rollout", schedule.Status)
+	}
+
+	schedule.Status = "paused"
+	schedule.pausedElapsed = time.Since(schedule.StageStartedAt)
+	return nil
+}
+
+// ResumeRollout continues a paused or halted rollout
+func (rs *RolloutScheduler) ResumeRollout(flagID string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	schedule, exists := rs.schedules[flagID]
+	if !exists {
+		return errors.New("rollout not found")
+	}
+
+	switch schedule.Status {
+	case "paused":
+		schedule.StageStartedAt = time.Now().Add(-schedule.pausedElapsed)
+	case "halted":
+		// Give the current stage a full run after the halt
+		schedule.StageStartedAt = time.Now()
+		schedule.HaltReason = ""
+	default:
+		return fmt.Errorf("cannot resume %s rollout", schedule.Status)
+	}
+
+	schedule.Status = "running"
+	schedule.pausedElapsed = 0
+	return nil
+}
+
+// AbortRollout stops a rollout and turns the flag off for everyone outside
+// its targeted users and segments
+func (rs *RolloutScheduler) AbortRollout(flagID string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	schedule, exists := rs.schedules[flagID]
+	if !exists {
+		return errors.New("rollout not found")
+	}
+	if !schedule.active() {
+		return fmt.Errorf("cannot abort %s rollout", schedule.Status)
+	}
+
+	schedule.Status = "aborted"
+	return rs.flags.SetRolloutPercent(flagID, 0)
+}
+
+// Tick checks guardrails and advances every running rollout whose current
+// stage has run its course by now. Start calls it periodically; tests can
+// call it directly with a chosen time.
+func (rs *RolloutScheduler) Tick(now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, schedule := range rs.schedules {
+		if schedule.Status != "running" {
+			continue
+		}
+
+		if g := schedule.Guardrail; g != nil {
+			rate, variantID := rs.experiments.worstErrorRate(g.ExperimentID, g.MinExposures)
+			if variantID != "" && rate > g.MaxErrorRate {
+				schedule.Status = "halted"
+				schedule.HaltReason = fmt.Sprintf("variant %s error rate %.2f%% above %.2f%%",
+					variantID, rate*100, g.MaxErrorRate*100)
+				continue
+			}
+		}
+
+		for schedule.Status == "running" {
+			stage := schedule.Stages[schedule.CurrentStage]
+			due := schedule.StageStartedAt.Add(stage.Duration)
+			if now.Before(due) {
+				break
+			}
+			if err := rs.enterStage(schedule, schedule.CurrentStage+1, due); err != nil {
+				schedule.Status = "halted"
+				schedule.HaltReason = err.Error()
+			}
+		}
+	}
+}
+
+// Start calls Tick every interval until Stop is called
+func (rs *RolloutScheduler) Start(interval time.Duration) {
+	rs.mu.Lock()
+	if rs.stopCh != nil {
+		rs.mu.Unlock()
+		return
+	}
+	stopCh := make(chan struct{})
+	rs.stopCh = stopCh
+	rs.mu.Unlock()
+
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case now := <-ticker.C:
+				rs.Tick(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background ticker started by Start
+func (rs *RolloutScheduler) Stop() {
+	rs.mu.Lock()
+	stopCh := rs.stopCh
+	rs.stopCh = nil
+	rs.mu.Unlock()
+
+	if stopCh != nil {
+		close(stopCh)
+		rs.wg.Wait()
+	}
+}
+
+// enterStage applies a stage's percentage to the flag. Entering the last
+// stage completes the rollout.
+func (rs *RolloutScheduler) enterStage(schedule *RolloutSchedule, index int, startedAt time.Time) error {
+	if err := rs.flags.SetRolloutPercent(schedule.FlagID, schedule.Stages[index].Percent); err != nil {
+		return err
+	}
+
+	schedule.CurrentStage = index
+	schedule.StageStartedAt = startedAt
+	if index == len(schedule.Stages)-1 {
+		schedule.Status = "completed"
+	}
+	return nil
+}
+
+func (s *RolloutSchedule) active() bool {
+	return s.Status == "running" || s.Status == "paused" || s.Status == "halted"
+}
+
+func (s *RolloutSchedule) copy() *RolloutSchedule {
+	c := *s
+	c.Stages = append([]RolloutStage(nil), s.Stages...)
+	if s.Guardrail != nil {
+		g := *s.Guardrail
+		c.Guardrail = &g
+	}
+	return &c
+}
+
 // ========== Helper Functions ==========
 
-func (fm *FeatureFlagManager) cacheEvaluation(key string, evaluation *FlagEvaluation) {
+// cachedEvaluation returns an unexpired cached evaluation, dropping it if it
+// has expired. On a miss it returns the flag's cache generation, which the
+// caller must read before the flag and pass to cacheEvaluation.
+func (fm *FeatureFlagManager) cachedEvaluation(flagID, key string) (*FlagEvaluation, uint64, bool) {
+	fm.cacheMu.RLock()
+	cached, exists := fm.evaluationCache[flagID][key]
+	generation := fm.cacheGeneration[flagID]
+	fm.cacheMu.RUnlock()
+	if !exists {
+		return nil, generation, false
+	}
+
+	if time.Now().Before(cached.expiresAt) {
+		return cached.evaluation, generation, true
+	}
+
+	fm.cacheMu.Lock()
+	if current, ok := fm.evaluationCache[flagID][key]; ok && current == cached {
+		delete(fm.evaluationCache[flagID], key)
+	}
+	fm.cacheMu.Unlock()
+	return nil, generation, false
+}
+
+// cacheEvaluation stores an evaluation for cacheTTL. A TTL of zero or less
+// disables caching. The store is skipped if the flag was invalidated since
+// generation was read, as the evaluation may come from the flag's old state.
+func (fm *FeatureFlagManager) cacheEvaluation(flagID, key string, generation uint64, evaluation *FlagEvaluation) {
+	if fm.cacheTTL <= 0 {
+		return
+	}
+
 	fm.cacheMu.Lock()
 	defer fm.cacheMu.Unlock()
-	fm.evaluationCache[key] = evaluation
+
+	if fm.cacheGeneration[flagID] != generation {
+		return
+	}
+
+	entries, exists := fm.evaluationCache[flagID]
+	if !exists {
+		entries = make(map[string]cachedEvaluation)
+		fm.evaluationCache[flagID] = entries
+	}
+	entries[key] = cachedEvaluation{evaluation: evaluation, expiresAt: time.Now().Add(fm.cacheTTL)}
 }
 
+// invalidateCache removes every cached evaluation of a flag and bumps its
+// generation so evaluations already in flight aren't cached
 func (fm *FeatureFlagManager) invalidateCache(flagID string) {
 	fm.cacheMu.Lock()
 	defer fm.cacheMu.Unlock()
+	delete(fm.evaluationCache, flagID)
+	fm.cacheGeneration[flagID]++
+}
+
+// PurgeExpiredEvaluations removes expired evaluations from the cache and
+// returns how many were removed. Lookups drop the entries they find expired;
+// this reclaims the ones that are never looked up again.
+func (fm *FeatureFlagManager) PurgeExpiredEvaluations() int {
+	fm.cacheMu.Lock()
+	defer fm.cacheMu.Unlock()
 
-	// Simple invalidation: remove entries for this flag
-	for key := range fm.evaluationCache {
-		if len(key) > 0 && key[:len(flagID)] == flagID {
-			delete(fm.evaluationCache, key)
+	now := time.Now()
+	removed := 0
+	for flagID, entries := range fm.evaluationCache {
+		for key, cached := range entries {
+			if !now.Before(cached.expiresAt) {
+				delete(entries, key)
+				removed++
+			}
+		}
+		if len(entries) == 0 {
+			delete(fm.evaluationCache, flagID)
 		}
 	}
+	return removed
 }
 
 func hashUserID(userID, flagID string) uint32 {
@@ -553,14 +1697,13 @@ func (fm *FeatureFlagManager) GetFlagEvaluationLog(flagID string, limit int) []*
 	defer fm.cacheMu.RUnlock()
 
 	var evals []*FlagEvaluation
-	count := 0
-	for _, eval := range fm.evaluationCache {
-		if eval.FlagID == flagID {
-			evals = append(evals, eval)
-			count++
-			if count >= limit {
-				break
-			}
+	now := time.Now()
+	for _, cached := range fm.evaluationCache[flagID] {
+		if len(evals) >= limit {
+			break
+		}
+		if now.Before(cached.expiresAt) {
+			evals = append(evals, cached.evaluation)
 		}
 	}
 
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -179,8 +185,8 @@ func TestCreateExperiment(t *testing.T) {
 	am := NewABTestManager()
 
 	variants := map[string]*Variant{
-		"control":    {ID: "control", Name: "Control", TrafficPercent: 50},
-		"treatment":  {ID: "treatment", Name: "Treatment", TrafficPercent: 50},
+		"control":   {ID: "control", Name: "Control", TrafficPercent: 50},
+		"treatment": {ID: "treatment", Name: "Treatment", TrafficPercent: 50},
 	}
 
 	exp, err := am.CreateExperiment("Test Experiment", "Test AB test", "flag-1", variants)
@@ -216,8 +222,8 @@ func TestAssignVariant(t *testing.T) {
 	am := NewABTestManager()
 
 	variants := map[string]*Variant{
-		"control":    {ID: "control", Name: "Control", TrafficPercent: 50},
-		"treatment":  {ID: "treatment", Name: "Treatment", TrafficPercent: 50},
+		"control":   {ID: "control", Name: "Control", TrafficPercent: 50},
+		"treatment": {ID: "treatment", Name: "Treatment", TrafficPercent: 50},
 	}
 
 	exp, _ := am.CreateExperiment("Test Experiment", "Test AB test", "flag-1", variants)
@@ -367,6 +373,626 @@ func TestCacheInvalidation(t *testing.T) {
 	}
 }
 
+func TestSegmentRuleOperators(t *testing.T) {
+	attrs := map[string]interface{}{
+		"country":    "US",
+		"email":      "ann@example.com",
+		"age":        34,
+		"plan":       "pro",
+		"tags":       []string{"beta", "staff"},
+		"app":        "2.10.0",
+		"prerelease": "2.10.0-rc.1",
+	}
+
+	tests := []struct {
+		rule SegmentRule
+		want bool
+	}{
+		{SegmentRule{Attribute: "country", Operator: "equals", Value: "US"}, true},
+		{SegmentRule{Attribute: "country", Operator: "notEquals", Value: "US"}, false},
+		{SegmentRule{Attribute: "email", Operator: "contains", Value: "@example."}, true},
+		{SegmentRule{Attribute: "tags", Operator: "contains", Value: "beta"}, true},
+		{SegmentRule{Attribute: "age", Operator: "greaterThan", Value: 30}, true},
+		{SegmentRule{Attribute: "age", Operator: "lessThan", Value: 30.5}, false},
+		{SegmentRule{Attribute: "age", Operator: "greaterThanOrEqual", Value: 34}, true},
+		{SegmentRule{Attribute: "plan", Operator: "in", Value: []string{"pro", "enterprise"}}, true},
+		{SegmentRule{Attribute: "plan", Operator: "notIn", Value: []interface{}{"free"}}, true},
+		{SegmentRule{Attribute: "email", Operator: "regex", Value: `^[a-z]+@example\.com$`}, true},
+		{SegmentRule{Attribute: "app", Operator: "semverGreaterThan", Value: "2.9.3"}, true},
+		{SegmentRule{Attribute: "app", Operator: "semverEquals", Value: "v2.10"}, true},
+		{SegmentRule{Attribute: "prerelease", Operator: "semverLessThan", Value: "2.10.0"}, true},
+		{SegmentRule{Attribute: "missing", Operator: "notEquals", Value: "x"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := compileRule(&tt.rule); err != nil {
+			t.Fatalf("%s %s: unexpected error %v", tt.rule.Attribute, tt.rule.Operator, err)
+		}
+		if got := tt.rule.Matches(attrs); got != tt.want {
+			t.Errorf("%s %s %v: expected %v, got %v", tt.rule.Attribute, tt.rule.Operator, tt.rule.Value, tt.want, got)
+		}
+	}
+}
+
+func TestCreateSegmentInvalidRules(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+
+	invalid := []SegmentRule{
+		{Attribute: "country", Operator: "like", Value: "US"},
+		{Attribute: "email", Operator: "regex", Value: "("},
+		{Attribute: "plan", Operator: "in", Value: "pro"},
+		{Attribute: "app", Operator: "semverGreaterThan", Value: "latest"},
+		{Attribute: "age", Operator: "greaterThan", Value: "old"},
+	}
+	for _, rule := range invalid {
+		if _, err := fm.CreateSegment("bad", "", []SegmentRule{rule}); err == nil {
+			t.Errorf("Expected error for %s %v", rule.Operator, rule.Value)
+		}
+	}
+}
+
+func TestEvaluateFlagSegmentMatch(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	beta, _ := fm.CreateSegment("Beta", "Beta testers on recent builds", []SegmentRule{
+		{Attribute: "beta", Operator: "equals", Value: true},
+		{Attribute: "app_version", Operator: "semverGreaterThan", Value: "1.4.0"},
+	})
+	fm.AddSegmentToFlag(flag.ID, beta.ID)
+
+	eval, _ := fm.EvaluateFlagWithAttributes(flag.ID, "user-1", map[string]interface{}{
+		"beta":        true,
+		"app_version": "1.5.2",
+	})
+	if !eval.Enabled || eval.Reason != "segment_match" || eval.RuleMatched != beta.ID {
+		t.Fatalf("Expected segment match on %s, got %+v", beta.ID, eval)
+	}
+
+	// Same user, different attributes: not cached under the first result.
+	eval, _ = fm.EvaluateFlagWithAttributes(flag.ID, "user-1", map[string]interface{}{
+		"beta":        true,
+		"app_version": "1.3.0",
+	})
+	if eval.Enabled || eval.Reason != "failed_rollout" {
+		t.Fatalf("Expected fall-through to rollout, got %+v", eval)
+	}
+}
+
+func TestEvaluateFlagSegmentPrecedence(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	first, _ := fm.CreateSegment("Staff", "", []SegmentRule{
+		{Attribute: "email", Operator: "regex", Value: "@corp\\.com$"},
+	})
+	second, _ := fm.CreateSegment("Named", "", []SegmentRule{
+		{Attribute: "user_id", Operator: "in", Value: []string{"user-1", "user-2"}},
+	})
+	fm.AddSegmentToFlag(flag.ID, first.ID)
+	fm.AddSegmentToFlag(flag.ID, second.ID)
+	fm.TargetUser(flag.ID, "user-2")
+
+	attrs := map[string]interface{}{"email": "dev@corp.com"}
+
+	// Both segments match user-1; the first added wins.
+	eval, _ := fm.EvaluateFlagWithAttributes(flag.ID, "user-1", attrs)
+	if eval.RuleMatched != first.ID {
+		t.Errorf("Expected first segment %s, got %+v", first.ID, eval)
+	}
+
+	// Targeting beats segments.
+	eval, _ = fm.EvaluateFlagWithAttributes(flag.ID, "user-2", attrs)
+	if eval.Reason != "user_targeted" {
+		t.Errorf("Expected user_targeted, got %s", eval.Reason)
+	}
+
+	// user_id defaults to the evaluated user.
+	matched, err := fm.MatchSegment(second.ID, "user-1", nil)
+	if err != nil || !matched {
+		t.Errorf("Expected user-1 to match by user_id, got %v, %v", matched, err)
+	}
+}
+
+func TestMultivariateFlagDistribution(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("checkout", "Checkout layout", true, "admin")
+
+	err := fm.SetVariants(flag.ID, []FlagVariant{
+		{Key: "a", Type: "string", Value: "classic", Weight: 50},
+		{Key: "b", Type: "string", Value: "compact", Weight: 30},
+		{Key: "c", Type: "string", Value: "wide", Weight: 20},
+	}, "a")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant, err := fm.GetVariant(flag.ID, userID)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		counts[variant.Key]++
+
+		again, _ := fm.GetVariant(flag.ID, userID)
+		if again.Key != variant.Key {
+			t.Fatalf("Expected stable variant for %s, got %s then %s", userID, variant.Key, again.Key)
+		}
+	}
+
+	for key, weight := range map[string]int{"a": 50, "b": 30, "c": 20} {
+		share := counts[key] * 100 / 10000
+		if share < weight-3 || share > weight+3 {
+			t.Fatalf("Expected variant %s near %d%%, got %d%%", key, weight, share)
+		}
+	}
+}
+
+func TestMultivariateFlagMatchesExperiment(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("checkout", "Checkout layout", true, "admin")
+	fm.SetVariants(flag.ID, []FlagVariant{
+		{Key: "control", Type: "number", Value: 1, Weight: 50},
+		{Key: "treatment", Type: "number", Value: 2, Weight: 50},
+	}, "")
+
+	am := NewABTestManager()
+	exp, _ := am.CreateExperiment("Checkout", "Layout test", flag.ID, map[string]*Variant{
+		"control":   {ID: "control", Name: "Control", TrafficPercent: 50},
+		"treatment": {ID: "treatment", Name: "Treatment", TrafficPercent: 50},
+	})
+	am.StartExperiment(exp.ID)
+
+	for i := 0; i < 200; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant, _ := fm.GetVariant(flag.ID, userID)
+		assigned, err := am.AssignVariant(exp.ID, userID)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if assigned != variant.Key {
+			t.Fatalf("Expected experiment to assign %s to %s, got %s", variant.Key, userID, assigned)
+		}
+
+		eval, _ := fm.EvaluateFlag(flag.ID, userID)
+		if eval.VariantID != variant.Key {
+			t.Fatalf("Expected evaluation variant %s, got %s", variant.Key, eval.VariantID)
+		}
+	}
+}
+
+func TestMultivariateFlagTypedValues(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("limits", "Rate limits", false, "admin")
+
+	err := fm.SetVariants(flag.ID, []FlagVariant{
+		{Key: "config", Type: "json", Value: map[string]int{"rps": 100}, Weight: 100},
+	}, "config")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Disabled flags serve the off variant
+	variant, err := fm.GetVariant(flag.ID, "user-1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var config struct {
+		RPS int `json:"rps"`
+	}
+	if err := variant.DecodeJSON(&config); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if config.RPS != 100 {
+		t.Fatalf("Expected rps 100, got %d", config.RPS)
+	}
+	if _, err := variant.StringValue(); err == nil {
+		t.Fatal("Expected error reading json variant as string")
+	}
+
+	enabled, _ := fm.CreateFlag("backoff", "Retry backoff", true, "admin")
+	fm.SetVariants(enabled.ID, []FlagVariant{
+		{Key: "fast", Type: "number", Value: 2.5, Weight: 100},
+	}, "")
+	variant, _ = fm.GetVariant(enabled.ID, "user-1")
+	if n, err := variant.NumberValue(); err != nil || n != 2.5 {
+		t.Fatalf("Expected 2.5, got %v (%v)", n, err)
+	}
+}
+
+func TestSetVariantsValidation(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("checkout", "Checkout layout", true, "admin")
+
+	cases := map[string][]FlagVariant{
+		"weights":   {{Key: "a", Type: "string", Value: "x", Weight: 60}, {Key: "b", Type: "string", Value: "y", Weight: 30}},
+		"duplicate": {{Key: "a", Type: "string", Value: "x", Weight: 50}, {Key: "a", Type: "string", Value: "y", Weight: 50}},
+		"type":      {{Key: "a", Type: "bool", Value: true, Weight: 100}},
+		"string":    {{Key: "a", Type: "string", Value: 1, Weight: 100}},
+		"number":    {{Key: "a", Type: "number", Value: "1", Weight: 100}},
+		"json":      {{Key: "a", Type: "json", Value: json.RawMessage("{"), Weight: 100}},
+	}
+	for name, variants := range cases {
+		if err := fm.SetVariants(flag.ID, variants, ""); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	valid := []FlagVariant{{Key: "a", Type: "string", Value: "x", Weight: 100}}
+	if err := fm.SetVariants(flag.ID, valid, "missing"); err == nil {
+		t.Fatal("Expected error for unknown off variant")
+	}
+	if err := fm.SetVariants("missing", valid, ""); err == nil {
+		t.Fatal("Expected error for unknown flag")
+	}
+
+	disabled, _ := fm.CreateFlag("legacy", "Legacy layout", false, "admin")
+	fm.SetVariants(disabled.ID, valid, "")
+	if _, err := fm.GetVariant(disabled.ID, "user-1"); err == nil {
+		t.Fatal("Expected error for disabled flag without off variant")
+	}
+}
+
+func TestEvaluationCacheTTL(t *testing.T) {
+	fm := NewFeatureFlagManager(20 * time.Millisecond)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+
+	first, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	cached, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	if cached != first {
+		t.Fatal("Expected cached evaluation before TTL")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	fresh, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	if fresh == first {
+		t.Fatal("Expected fresh evaluation after TTL")
+	}
+
+	fm.EvaluateFlag(flag.ID, "user-2")
+	time.Sleep(30 * time.Millisecond)
+	if removed := fm.PurgeExpiredEvaluations(); removed != 2 {
+		t.Fatalf("Expected 2 expired evaluations, got %d", removed)
+	}
+}
+
+func TestCacheInvalidationIsPerFlag(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flagA, _ := fm.CreateFlag("a", "Flag A", true, "admin")
+	flagB, _ := fm.CreateFlag("b", "Flag B", true, "admin")
+
+	// Flag IDs that share a prefix must not invalidate each other
+	fm.flagsMu.Lock()
+	fm.flags["flag_1"], fm.flags["flag_12"] = flagA, flagB
+	fm.flagsMu.Unlock()
+
+	evalA, _ := fm.EvaluateFlag("flag_1", "user-1")
+	evalB, _ := fm.EvaluateFlag("flag_12", "user-1")
+
+	fm.invalidateCache("flag_1")
+
+	if again, _ := fm.EvaluateFlag("flag_12", "user-1"); again != evalB {
+		t.Fatal("Expected flag_12 evaluation to stay cached")
+	}
+	if again, _ := fm.EvaluateFlag("flag_1", "user-1"); again == evalA {
+		t.Fatal("Expected flag_1 evaluation to be invalidated")
+	}
+}
+
+func TestSubscribeFlagChanges(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	changes, unsubscribe := fm.Subscribe(2)
+
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	fm.SetRolloutPercent(flag.ID, 25)
+	fm.SetRolloutPercent(flag.ID, 50)
+
+	// The buffer holds two changes, so the create is dropped
+	change := <-changes
+	if change.Type != "updated" || change.Flag.RolloutPercent != 25 {
+		t.Fatalf("Expected update to 25%%, got %s %d", change.Type, change.Flag.RolloutPercent)
+	}
+	change = <-changes
+	if change.FlagID != flag.ID || change.Flag.RolloutPercent != 50 {
+		t.Fatalf("Expected update to 50%%, got %d", change.Flag.RolloutPercent)
+	}
+
+	unsubscribe()
+	if _, ok := <-changes; ok {
+		t.Fatal("Expected channel to be closed after unsubscribe")
+	}
+	fm.SetRolloutPercent(flag.ID, 75)
+}
+
+func TestStreamHandler(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+
+	server := httptest.NewServer(fm.StreamHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var event, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	event, data := readEvent()
+	var snapshot []*FeatureFlag
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if event != "snapshot" || len(snapshot) != 1 || snapshot[0].ID != flag.ID {
+		t.Fatalf("Expected snapshot with one flag, got %s %s", event, data)
+	}
+
+	fm.SetRolloutPercent(flag.ID, 40)
+
+	event, data = readEvent()
+	var change FlagChange
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if event != "updated" || change.Flag.RolloutPercent != 40 {
+		t.Fatalf("Expected update to 40%%, got %s %s", event, data)
+	}
+}
+
+func TestRolloutScheduleProgression(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	rs := NewRolloutScheduler(fm, nil)
+
+	schedule, err := rs.ScheduleRollout(flag.ID, []RolloutStage{
+		{Percent: 5, Duration: time.Hour},
+		{Percent: 25, Duration: time.Hour},
+		{Percent: 50, Duration: time.Hour},
+		{Percent: 100},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if flag.RolloutPercent != 5 {
+		t.Fatalf("Expected first stage applied, got %d%%", flag.RolloutPercent)
+	}
+
+	start := schedule.StageStartedAt
+	rs.Tick(start.Add(30 * time.Minute))
+	if flag.RolloutPercent != 5 {
+		t.Fatalf("Expected 5%% before the stage ends, got %d%%", flag.RolloutPercent)
+	}
+
+	rs.Tick(start.Add(time.Hour))
+	if flag.RolloutPercent != 25 {
+		t.Fatalf("Expected 25%%, got %d%%", flag.RolloutPercent)
+	}
+
+	// A late tick catches up through every stage that is due
+	rs.Tick(start.Add(5 * time.Hour))
+	current, _ := rs.GetRollout(flag.ID)
+	if flag.RolloutPercent != 100 || current.Status != "completed" {
+		t.Fatalf("Expected completed at 100%%, got %s at %d%%", current.Status, flag.RolloutPercent)
+	}
+}
+
+func TestRolloutPauseResumeAbort(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	rs := NewRolloutScheduler(fm, nil)
+
+	rs.ScheduleRollout(flag.ID, []RolloutStage{
+		{Percent: 10, Duration: time.Hour},
+		{Percent: 100},
+	})
+
+	if err := rs.PauseRollout(flag.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rs.Tick(time.Now().Add(2 * time.Hour))
+	if flag.RolloutPercent != 10 {
+		t.Fatalf("Expected paused rollout to stay at 10%%, got %d%%", flag.RolloutPercent)
+	}
+
+	if err := rs.ResumeRollout(flag.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := rs.ScheduleRollout(flag.ID, []RolloutStage{{Percent: 100}}); err == nil {
+		t.Fatal("Expected error scheduling over an active rollout")
+	}
+
+	if err := rs.AbortRollout(flag.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	current, _ := rs.GetRollout(flag.ID)
+	if current.Status != "aborted" || flag.RolloutPercent != 0 {
+		t.Fatalf("Expected aborted at 0%%, got %s at %d%%", current.Status, flag.RolloutPercent)
+	}
+	if err := rs.ResumeRollout(flag.ID); err == nil {
+		t.Fatal("Expected error resuming an aborted rollout")
+	}
+}
+
+func TestRolloutGuardrailHalts(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	am := NewABTestManager()
+	exp, _ := am.CreateExperiment("Rollout", "Guardrail", flag.ID, map[string]*Variant{
+		"treatment": {ID: "treatment", Name: "Treatment", TrafficPercent: 100},
+	})
+	am.StartExperiment(exp.ID)
+
+	rs := NewRolloutScheduler(fm, am)
+	schedule, _ := rs.ScheduleRollout(flag.ID, []RolloutStage{
+		{Percent: 5, Duration: time.Hour},
+		{Percent: 50, Duration: time.Hour},
+		{Percent: 100},
+	})
+	if err := rs.AttachGuardrail(flag.ID, exp.ID, 0.05, 20); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		am.AssignVariant(exp.ID, fmt.Sprintf("user-%d", i))
+	}
+	am.RecordError(exp.ID, "user-0", nil)
+
+	rs.Tick(schedule.StageStartedAt.Add(time.Hour))
+	if flag.RolloutPercent != 50 {
+		t.Fatalf("Expected 5%% error rate to pass, got %d%%", flag.RolloutPercent)
+	}
+
+	am.RecordError(exp.ID, "user-1", nil)
+	rs.Tick(schedule.StageStartedAt.Add(2 * time.Hour))
+
+	current, _ := rs.GetRollout(flag.ID)
+	if current.Status != "halted" || flag.RolloutPercent != 50 {
+		t.Fatalf("Expected halted at 50%%, got %s at %d%%", current.Status, flag.RolloutPercent)
+	}
+	if current.HaltReason == "" {
+		t.Fatal("Expected halt reason")
+	}
+
+	metrics, _ := am.GetMetrics(exp.ID, "treatment")
+	if metrics.Errors != 2 || metrics.ErrorRate != 0.1 {
+		t.Fatalf("Expected 2 errors at 10%%, got %d at %v", metrics.Errors, metrics.ErrorRate)
+	}
+}
+
+func TestScheduleRolloutValidation(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	rs := NewRolloutScheduler(fm, nil)
+
+	cases := map[string][]RolloutStage{
+		"empty":      {},
+		"range":      {{Percent: 120}},
+		"decreasing": {{Percent: 50, Duration: time.Hour}, {Percent: 25}},
+		"duration":   {{Percent: 5}, {Percent: 100}},
+	}
+	for name, stages := range cases {
+		if _, err := rs.ScheduleRollout(flag.ID, stages); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	if _, err := rs.ScheduleRollout("missing", []RolloutStage{{Percent: 100}}); err == nil {
+		t.Fatal("Expected error for unknown flag")
+	}
+	if err := rs.AttachGuardrail(flag.ID, "exp", 0.1, 10); err == nil {
+		t.Fatal("Expected error attaching guardrail without experiment manager")
+	}
+}
+
+func TestRolloutSchedulerStart(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	rs := NewRolloutScheduler(fm, nil)
+
+	rs.ScheduleRollout(flag.ID, []RolloutStage{
+		{Percent: 10, Duration: 10 * time.Millisecond},
+		{Percent: 100},
+	})
+
+	rs.Start(5 * time.Millisecond)
+	defer rs.Stop()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if current, _ := rs.GetRollout(flag.ID); current.Status == "completed" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Expected rollout to complete")
+}
+
+func TestEvaluateDuringScheduledRollout(t *testing.T) {
+	fm := NewFeatureFlagManager(0)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+	rs := NewRolloutScheduler(fm, nil)
+
+	rs.ScheduleRollout(flag.ID, []RolloutStage{
+		{Percent: 5, Duration: time.Millisecond},
+		{Percent: 25, Duration: time.Millisecond},
+		{Percent: 50, Duration: time.Millisecond},
+		{Percent: 100},
+	})
+
+	rs.Start(time.Millisecond)
+	defer rs.Stop()
+
+	// Run with -race: evaluations must not race the scheduler's updates.
+	// The loop doesn't touch the scheduler, which would synchronize with it.
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		fm.EvaluateFlag(flag.ID, fmt.Sprintf("user-%d", i))
+	}
+	rs.Stop()
+
+	current, _ := rs.GetRollout(flag.ID)
+	if current.Status != "completed" {
+		t.Fatalf("Expected rollout to complete, got %s", current.Status)
+	}
+	if eval, _ := fm.EvaluateFlag(flag.ID, "user-1"); !eval.Enabled {
+		t.Fatal("Expected flag enabled for everyone after the rollout completes")
+	}
+}
+
+func TestCacheSkipsEvaluationFromBeforeInvalidation(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", true, "admin")
+
+	// An evaluation that read the flag before an update finishes after it
+	_, generation, _ := fm.cachedEvaluation(flag.ID, "user-1")
+	stale := &FlagEvaluation{FlagID: flag.ID, UserID: "user-1", Reason: "failed_rollout"}
+	fm.SetRolloutPercent(flag.ID, 100)
+	fm.cacheEvaluation(flag.ID, "user-1", generation, stale)
+
+	eval, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	if eval == stale || !eval.Enabled {
+		t.Fatal("Expected stale evaluation not to be cached")
+	}
+}
+
+func TestDisabledEvaluationCached(t *testing.T) {
+	fm := NewFeatureFlagManager(1 * time.Hour)
+	flag, _ := fm.CreateFlag("new-feature", "Test feature", false, "admin")
+
+	first, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	cached, _ := fm.EvaluateFlag(flag.ID, "user-1")
+	if first.Reason != "flag_disabled" || cached != first {
+		t.Fatal("Expected disabled evaluation to be cached")
+	}
+}
+
 // ========== Benchmarks ==========
 
 func BenchmarkEvaluateFlag(b *testing.B) {
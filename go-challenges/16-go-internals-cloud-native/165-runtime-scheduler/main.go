@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
 	"runtime"
-	"runtime/debug"
 	"runtime/metrics"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +41,25 @@ type GMPSimulator struct {
 	stop          chan struct{}
 	stealAttempts int64
 	steals        int64
+
+	// Deterministic mode (see NewDeterministicGMPSimulator)
+	deterministic bool
+	clock         *VirtualClock
+	rng           *rand.Rand
+	quantum       time.Duration
+	tick          int
+	nextGID       int64
+	globalRunq    []*GoroutineInfo
+	trace         []SchedEvent
+	gtrace        []GEvent
+	blocked       []*GoroutineInfo
+	idleMs        []*Machine
+	syscalls      int64
+	netpollWaits  int64
+	config        SchedulerConfig
+	runnextHits   int64
+	runqOverflows int64
+	overflowMoved int64
 }
 
 type GoroutineInfo struct {
@@ -36,12 +67,21 @@ type GoroutineInfo struct {
 	processor int
 	startTime time.Time
 	duration  time.Duration
-	state     string // "running", "waiting", "done"
+	state     string // "runnable", "running", "waiting", "done"
+	work      func()
+
+	// Blocking behavior after work runs (deterministic mode only)
+	block      string // "syscall", "netpoll" or "" once unblocked
+	blockTicks int
+	wakeTick   int
+	machine    *Machine // M held by a blocking syscall
 }
 
 type Processor struct {
 	id         int
 	localQueue chan func()
+	runq       []*GoroutineInfo // deterministic mode only
+	runnext    *GoroutineInfo   // deterministic mode only
 	machine    *Machine
 	mu         sync.Mutex
 }
@@ -50,6 +90,7 @@ type Machine struct {
 	id        int
 	processor *Processor
 	running   bool
+	inSyscall bool
 	workDone  int64
 }
 
@@ -64,6 +105,15 @@ type SchedulerMetrics struct {
 }
 
 func NewGMPSimulator(numP int) *GMPSimulator {
+	sim := newGMPSimulator(numP)
+	for _, m := range sim.machines {
+		// Start machine worker
+		go sim.machineWorker(m)
+	}
+	return sim
+}
+
+func newGMPSimulator(numP int) *GMPSimulator {
 	sim := &GMPSimulator{
 		numP:         numP,
 		globalQueue:  make(chan func(), 1000),
@@ -72,6 +122,7 @@ func NewGMPSimulator(numP int) *GMPSimulator {
 		metrics:      &SchedulerMetrics{},
 		goroutineMap: make(map[int64]*GoroutineInfo),
 		stop:         make(chan struct{}),
+		numM:         int32(numP),
 	}
 
 	for i := 0; i < numP; i++ {
@@ -87,9 +138,6 @@ func NewGMPSimulator(numP int) *GMPSimulator {
 		p.machine = m
 		sim.processors[i] = p
 		sim.machines[i] = m
-
-		// Start machine worker
-		go sim.machineWorker(m)
 	}
 
 	return sim
@@ -152,6 +200,10 @@ func (sim *GMPSimulator) tryWorkSteal(p *Processor) bool {
 }
 
 func (sim *GMPSimulator) SubmitWork(work func(), p int) {
+	if sim.deterministic {
+		sim.enqueue(work, p)
+		return
+	}
 	if p >= 0 && p < sim.numP {
 		select {
 		case sim.processors[p].localQueue <- work:
@@ -173,10 +225,13 @@ func (sim *GMPSimulator) GetMetrics() map[string]interface{} {
 		avgSchedule = time.Duration(sim.metrics.totalScheduleTime.Nanoseconds() / sim.metrics.goroutinesCreated)
 	}
 
+	sim.mu.RLock()
 	machineMetrics := make(map[string]int64)
 	for _, m := range sim.machines {
 		machineMetrics[fmt.Sprintf("M%d_work", m.id)] = atomic.LoadInt64(&m.workDone)
 	}
+	idleThreads := len(sim.idleMs)
+	sim.mu.RUnlock()
 
 	return map[string]interface{}{
 		"processors_count":      sim.numP,
@@ -186,12 +241,611 @@ func (sim *GMPSimulator) GetMetrics() map[string]interface{} {
 		"steal_attempts":        atomic.LoadInt64(&sim.stealAttempts),
 		"avg_schedule_time_us":  avgSchedule.Microseconds(),
 		"machine_work":          machineMetrics,
+		"threads":               atomic.LoadInt32(&sim.numM),
+		"idle_threads":          idleThreads,
+		"blocking_syscalls":     atomic.LoadInt64(&sim.syscalls),
+		"netpoll_waits":         atomic.LoadInt64(&sim.netpollWaits),
+		"runnext_hits":          atomic.LoadInt64(&sim.runnextHits),
+		"runq_overflows":        atomic.LoadInt64(&sim.runqOverflows),
+		"runq_overflow_moved":   atomic.LoadInt64(&sim.overflowMoved),
+		"steal_rate":            stealRate(atomic.LoadInt64(&sim.steals), atomic.LoadInt64(&sim.metrics.contextSwitches)),
 	}
 }
 
+// stealRate is the fraction of executed Gs that were stolen.
+func stealRate(steals, runs int64) float64 {
+	if runs == 0 {
+		return 0
+	}
+	return float64(steals) / float64(runs)
+}
+
 func (sim *GMPSimulator) Stop() {
 	close(sim.stop)
-	time.Sleep(100 * time.Millisecond)
+	if !sim.deterministic {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// ----- Deterministic simulation -----
+//
+// In deterministic mode no machine goroutines are started. The caller drives
+// the scheduler with Step or RunUntilIdle: each tick every P makes one
+// scheduling decision (run local work, take global work, steal, or idle) and
+// the virtual clock advances by one quantum. The choices the real runtime
+// randomizes - the order in which Ps run and where a steal starts looking -
+// come from a seeded RNG, so the same seed and submissions always produce the
+// same trace.
+
+const defaultSimQuantum = 10 * time.Microsecond
+
+// VirtualClock is a manually advanced clock for deterministic simulations.
+type VirtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// SchedEvent is one scheduling decision taken by a P during a tick.
+type SchedEvent struct {
+	Tick        int
+	Time        time.Time
+	Kind        string // "run", "steal", "idle"
+	P           int
+	G           int64 // 0 for idle
+	Victim      int   // P stolen from, -1 unless Kind is "steal"
+	LocalDepth  int   // P's local queue length, with runnext, after the decision
+	GlobalDepth int   // global queue length after the decision
+}
+
+// SchedulerConfig sets the run-queue parameters of a deterministic
+// simulator.
+//
+// As in the runtime, a G submitted to a P goes into its runnext slot when
+// RunNext is on, pushing the previous occupant to the tail of the local
+// queue, and runnext is the first thing the P runs. A P with a full local
+// queue moves half of it, oldest first, plus the new G to the global queue
+// in one batch. Stealing takes from local queues only, never runnext.
+type SchedulerConfig struct {
+	LocalQueueSize int  // local run-queue capacity, 256 in the runtime
+	RunNext        bool // LIFO slot for the most recently submitted G
+}
+
+// DefaultSchedulerConfig matches the Go runtime.
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{LocalQueueSize: 256, RunNext: true}
+}
+
+// NewDeterministicGMPSimulator creates a simulator that runs on a virtual
+// clock starting at the Unix epoch and takes its scheduling choices from an
+// RNG seeded with seed. It uses DefaultSchedulerConfig.
+func NewDeterministicGMPSimulator(numP int, seed int64) *GMPSimulator {
+	return NewDeterministicGMPSimulatorWithConfig(numP, seed, DefaultSchedulerConfig())
+}
+
+// NewDeterministicGMPSimulatorWithConfig is NewDeterministicGMPSimulator
+// with explicit run-queue parameters. A LocalQueueSize below 1 means 256.
+func NewDeterministicGMPSimulatorWithConfig(numP int, seed int64, cfg SchedulerConfig) *GMPSimulator {
+	if cfg.LocalQueueSize < 1 {
+		cfg.LocalQueueSize = DefaultSchedulerConfig().LocalQueueSize
+	}
+	sim := newGMPSimulator(numP)
+	sim.deterministic = true
+	sim.clock = NewVirtualClock(time.Unix(0, 0).UTC())
+	sim.rng = rand.New(rand.NewSource(seed))
+	sim.quantum = defaultSimQuantum
+	sim.config = cfg
+	return sim
+}
+
+// Clock returns the virtual clock, or nil for a real-time simulator.
+func (sim *GMPSimulator) Clock() *VirtualClock {
+	return sim.clock
+}
+
+func (sim *GMPSimulator) enqueue(work func(), p int) {
+	sim.enqueueG(&GoroutineInfo{work: work}, p)
+}
+
+func (sim *GMPSimulator) enqueueG(g *GoroutineInfo, p int) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	sim.nextGID++
+	g.id = sim.nextGID
+	g.processor = -1
+	g.startTime = sim.clock.Now()
+	g.state = "runnable"
+	sim.goroutineMap[g.id] = g
+	sim.recordG("created", g, p)
+	sim.recordG("runnable", g, p)
+
+	if p >= 0 && p < sim.numP {
+		sim.runqput(sim.processors[p], g)
+	} else {
+		sim.globalRunq = append(sim.globalRunq, g)
+	}
+	atomic.AddInt32(&sim.numG, 1)
+	atomic.AddInt64(&sim.metrics.goroutinesCreated, 1)
+}
+
+// runqput queues g on p, through runnext if enabled. Caller holds sim.mu.
+func (sim *GMPSimulator) runqput(p *Processor, g *GoroutineInfo) {
+	if sim.config.RunNext {
+		g, p.runnext = p.runnext, g
+		if g == nil {
+			return
+		}
+	}
+	if len(p.runq) < sim.config.LocalQueueSize {
+		p.runq = append(p.runq, g)
+		return
+	}
+
+	// Full: move the older half and g to the global queue as one batch.
+	half := len(p.runq) / 2
+	sim.globalRunq = append(sim.globalRunq, p.runq[:half]...)
+	sim.globalRunq = append(sim.globalRunq, g)
+	p.runq = append(p.runq[:0], p.runq[half:]...)
+	atomic.AddInt64(&sim.runqOverflows, 1)
+	atomic.AddInt64(&sim.overflowMoved, int64(half+1))
+}
+
+// localDepth counts the Gs queued on p, including runnext. Caller holds
+// sim.mu.
+func localDepth(p *Processor) int {
+	if p.runnext != nil {
+		return len(p.runq) + 1
+	}
+	return len(p.runq)
+}
+
+// Step runs one tick of the deterministic scheduler and reports whether any
+// P ran work or goroutines are still blocked.
+func (sim *GMPSimulator) Step() bool {
+	sim.mu.Lock()
+	sim.tick++
+	sim.wakeBlocked()
+	order := sim.rng.Perm(sim.numP)
+	sim.mu.Unlock()
+
+	ran := false
+	for _, id := range order {
+		if sim.stepProcessor(sim.processors[id]) {
+			ran = true
+		}
+	}
+	sim.clock.Advance(sim.quantum)
+
+	sim.mu.RLock()
+	defer sim.mu.RUnlock()
+	return ran || len(sim.blocked) > 0
+}
+
+// RunUntilIdle steps the scheduler until no P finds work or maxTicks ticks
+// have run (maxTicks <= 0 means no limit). It returns the number of ticks.
+func (sim *GMPSimulator) RunUntilIdle(maxTicks int) int {
+	ticks := 0
+	for maxTicks <= 0 || ticks < maxTicks {
+		ticks++
+		if !sim.Step() {
+			break
+		}
+	}
+	return ticks
+}
+
+func (sim *GMPSimulator) stepProcessor(p *Processor) bool {
+	sim.mu.Lock()
+	m := p.machine
+	g, victim := sim.findRunnable(p)
+	if g == nil {
+		sim.record("idle", p, 0, -1)
+		atomic.AddInt64(&sim.stealAttempts, 1)
+		sim.mu.Unlock()
+		return false
+	}
+	if victim >= 0 {
+		sim.record("steal", p, g.id, victim)
+		sim.recordG("stolen", g, p.id)
+		atomic.AddInt64(&sim.steals, 1)
+	}
+	g.state = "running"
+	g.processor = p.id
+	sim.record("run", p, g.id, -1)
+	sim.recordG("running", g, p.id)
+	sim.mu.Unlock()
+
+	// Work runs without the lock so it may submit more work. A G resumed
+	// after blocking has already run its work.
+	if g.wakeTick == 0 {
+		g.work()
+	}
+
+	sim.mu.Lock()
+	if g.block != "" {
+		sim.blockG(g, p)
+	} else {
+		g.state = "done"
+		g.duration = sim.clock.Now().Add(sim.quantum).Sub(g.startTime)
+		sim.gtrace = append(sim.gtrace, GEvent{
+			Time: sim.clock.Now().Add(sim.quantum),
+			G:    g.id,
+			Kind: "done",
+			P:    p.id,
+		})
+	}
+	sim.mu.Unlock()
+
+	atomic.AddInt64(&m.workDone, 1)
+	atomic.AddInt64(&sim.metrics.contextSwitches, 1)
+	sim.metrics.mu.Lock()
+	sim.metrics.totalScheduleTime += sim.quantum
+	sim.metrics.mu.Unlock()
+	return true
+}
+
+// findRunnable pops the next G for p: runnext, the local queue, the global
+// queue, then one G stolen from another P's local queue. victim is -1
+// unless it stole. Caller holds sim.mu.
+func (sim *GMPSimulator) findRunnable(p *Processor) (g *GoroutineInfo, victim int) {
+	if p.runnext != nil {
+		g, p.runnext = p.runnext, nil
+		atomic.AddInt64(&sim.runnextHits, 1)
+		return g, -1
+	}
+	if len(p.runq) > 0 {
+		g, p.runq = p.runq[0], p.runq[1:]
+		return g, -1
+	}
+	if len(sim.globalRunq) > 0 {
+		g, sim.globalRunq = sim.globalRunq[0], sim.globalRunq[1:]
+		return g, -1
+	}
+	start := sim.rng.Intn(sim.numP)
+	for i := 0; i < sim.numP; i++ {
+		other := sim.processors[(start+i)%sim.numP]
+		if other == p || len(other.runq) == 0 {
+			continue
+		}
+		g, other.runq = other.runq[0], other.runq[1:]
+		return g, other.id
+	}
+	return nil, -1
+}
+
+// record appends an event to the trace. Caller holds sim.mu.
+func (sim *GMPSimulator) record(kind string, p *Processor, gid int64, victim int) {
+	sim.trace = append(sim.trace, SchedEvent{
+		Tick:        sim.tick,
+		Time:        sim.clock.Now(),
+		Kind:        kind,
+		P:           p.id,
+		G:           gid,
+		Victim:      victim,
+		LocalDepth:  localDepth(p),
+		GlobalDepth: len(sim.globalRunq),
+	})
+}
+
+// Trace returns a copy of the scheduling events recorded in deterministic
+// mode.
+func (sim *GMPSimulator) Trace() []SchedEvent {
+	sim.mu.RLock()
+	defer sim.mu.RUnlock()
+
+	trace := make([]SchedEvent, len(sim.trace))
+	copy(trace, sim.trace)
+	return trace
+}
+
+// SchedulerConfigResult is the outcome of one run of CompareSchedulerConfigs.
+type SchedulerConfigResult struct {
+	Config          SchedulerConfig
+	Ticks           int
+	ContextSwitches int64
+	Steals          int64
+	StealRate       float64
+	RunNextHits     int64
+	Overflows       int64
+}
+
+// CompareSchedulerConfigs runs the same workload under each config on a
+// fresh deterministic simulator with the same seed, showing how queue size
+// and runnext change stealing. submit enqueues the workload.
+func CompareSchedulerConfigs(numP int, seed int64, configs []SchedulerConfig, submit func(sim *GMPSimulator)) []SchedulerConfigResult {
+	results := make([]SchedulerConfigResult, 0, len(configs))
+	for _, cfg := range configs {
+		sim := NewDeterministicGMPSimulatorWithConfig(numP, seed, cfg)
+		submit(sim)
+		ticks := sim.RunUntilIdle(0)
+
+		runs := atomic.LoadInt64(&sim.metrics.contextSwitches)
+		steals := atomic.LoadInt64(&sim.steals)
+		results = append(results, SchedulerConfigResult{
+			Config:          sim.config,
+			Ticks:           ticks,
+			ContextSwitches: runs,
+			Steals:          steals,
+			StealRate:       stealRate(steals, runs),
+			RunNextHits:     atomic.LoadInt64(&sim.runnextHits),
+			Overflows:       atomic.LoadInt64(&sim.runqOverflows),
+		})
+		sim.Stop()
+	}
+	return results
+}
+
+// ----- Blocking syscalls and the netpoller -----
+//
+// A G blocked in a syscall keeps its M: the M detaches from the P, and the P
+// is handed to an idle M or, if none is parked, a brand new one. A G waiting
+// on the network parks in the netpoller instead and keeps neither, so its P
+// and M go straight on to other work. Either way the G is woken onto the
+// global queue once its ticks elapse, and the syscall's M parks as idle.
+// Running many blocking syscalls at once is what inflates thread counts in
+// real programs; the same number of network waits costs no extra threads.
+
+// SubmitSyscall submits work that then blocks in a syscall for blockTicks
+// ticks before the G finishes. A real-time simulator runs the work and
+// sleeps the machine worker for the same virtual duration, as a syscall
+// without handoff would.
+func (sim *GMPSimulator) SubmitSyscall(work func(), p int, blockTicks int) {
+	sim.submitBlocking(work, p, "syscall", blockTicks)
+}
+
+// SubmitNetWork submits work that then waits blockTicks ticks for the
+// netpoller to report its connection ready before the G finishes.
+func (sim *GMPSimulator) SubmitNetWork(work func(), p int, blockTicks int) {
+	sim.submitBlocking(work, p, "netpoll", blockTicks)
+}
+
+func (sim *GMPSimulator) submitBlocking(work func(), p int, kind string, blockTicks int) {
+	if blockTicks < 1 {
+		blockTicks = 1
+	}
+	if !sim.deterministic {
+		sim.SubmitWork(func() {
+			work()
+			time.Sleep(time.Duration(blockTicks) * defaultSimQuantum)
+		}, p)
+		return
+	}
+	sim.enqueueG(&GoroutineInfo{work: work, block: kind, blockTicks: blockTicks}, p)
+}
+
+// blockG parks g after its work ran on p. Caller holds sim.mu.
+func (sim *GMPSimulator) blockG(g *GoroutineInfo, p *Processor) {
+	g.state = "waiting"
+	g.wakeTick = sim.tick + g.blockTicks
+	sim.recordG("blocked", g, p.id)
+	sim.blocked = append(sim.blocked, g)
+
+	if g.block == "syscall" {
+		m := p.machine
+		m.inSyscall = true
+		m.processor = nil
+		g.machine = m
+		sim.handoff(p)
+		atomic.AddInt64(&sim.syscalls, 1)
+	} else {
+		atomic.AddInt64(&sim.netpollWaits, 1)
+	}
+	g.block = ""
+}
+
+// handoff gives p to an idle M, spawning one if none is parked. Caller
+// holds sim.mu.
+func (sim *GMPSimulator) handoff(p *Processor) {
+	var m *Machine
+	if n := len(sim.idleMs); n > 0 {
+		m, sim.idleMs = sim.idleMs[n-1], sim.idleMs[:n-1]
+	} else {
+		m = &Machine{id: len(sim.machines), running: true}
+		sim.machines = append(sim.machines, m)
+		atomic.AddInt32(&sim.numM, 1)
+	}
+	m.processor = p
+	p.machine = m
+}
+
+// wakeBlocked moves Gs whose wait has elapsed to the global queue. Caller
+// holds sim.mu.
+func (sim *GMPSimulator) wakeBlocked() {
+	remaining := sim.blocked[:0]
+	for _, g := range sim.blocked {
+		if g.wakeTick > sim.tick {
+			remaining = append(remaining, g)
+			continue
+		}
+		if m := g.machine; m != nil {
+			m.inSyscall = false
+			sim.idleMs = append(sim.idleMs, m)
+			g.machine = nil
+		}
+		g.state = "runnable"
+		sim.globalRunq = append(sim.globalRunq, g)
+		sim.recordG("runnable", g, -1)
+	}
+	sim.blocked = remaining
+}
+
+// GEvent is a state transition of a single simulated goroutine.
+type GEvent struct {
+	Time time.Time
+	G    int64
+	Kind string // "created", "runnable", "running", "blocked", "stolen", "done"
+	P    int    // P involved in the transition, -1 if none
+}
+
+// recordG appends a goroutine event at the current virtual time. Caller holds
+// sim.mu.
+func (sim *GMPSimulator) recordG(kind string, g *GoroutineInfo, p int) {
+	if p < 0 || p >= sim.numP {
+		p = -1
+	}
+	sim.gtrace = append(sim.gtrace, GEvent{
+		Time: sim.clock.Now(),
+		G:    g.id,
+		Kind: kind,
+		P:    p,
+	})
+}
+
+// GoroutineEvents returns a copy of the per-G events recorded in
+// deterministic mode.
+func (sim *GMPSimulator) GoroutineEvents() []GEvent {
+	sim.mu.RLock()
+	defer sim.mu.RUnlock()
+
+	events := make([]GEvent, len(sim.gtrace))
+	copy(events, sim.gtrace)
+	return events
+}
+
+// ----- Chrome trace export -----
+//
+// The trace-event JSON format is what the viewer behind `go tool trace`
+// renders, and it opens directly in chrome://tracing or ui.perfetto.dev.
+// Ps are threads of a "Procs" process with a slice per G they ran, each G is
+// a thread of a "Goroutines" process with an instant per state transition,
+// and queue depths are counters.
+
+const (
+	chromePidProcs      = 0
+	chromePidGoroutines = 1
+)
+
+type chromeTraceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int64                  `json:"tid"`
+	S    string                 `json:"s,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeTraceEvent `json:"traceEvents"`
+	DisplayTimeUnit string             `json:"displayTimeUnit"`
+}
+
+// chromeTs converts a virtual time to trace-event microseconds.
+func chromeTs(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e3
+}
+
+func chromeMeta(pid int, tid int64, kind, name string) chromeTraceEvent {
+	return chromeTraceEvent{
+		Name: kind,
+		Ph:   "M",
+		Pid:  pid,
+		Tid:  tid,
+		Args: map[string]interface{}{"name": name},
+	}
+}
+
+// ExportChromeTrace writes the deterministic-mode trace as Chrome
+// trace-event JSON.
+func (sim *GMPSimulator) ExportChromeTrace(w io.Writer) error {
+	if !sim.deterministic {
+		return fmt.Errorf("chrome trace export requires a deterministic simulator")
+	}
+
+	sim.mu.RLock()
+	defer sim.mu.RUnlock()
+
+	events := []chromeTraceEvent{
+		chromeMeta(chromePidProcs, 0, "process_name", "Procs"),
+		chromeMeta(chromePidGoroutines, 0, "process_name", "Goroutines"),
+	}
+	for _, p := range sim.processors {
+		events = append(events, chromeMeta(chromePidProcs, int64(p.id), "thread_name", fmt.Sprintf("P%d", p.id)))
+	}
+	for id := int64(1); id <= sim.nextGID; id++ {
+		events = append(events, chromeMeta(chromePidGoroutines, id, "thread_name", fmt.Sprintf("G%d", id)))
+	}
+
+	dur := float64(sim.quantum.Nanoseconds()) / 1e3
+	for _, ev := range sim.trace {
+		ts := chromeTs(ev.Time)
+		switch ev.Kind {
+		case "run":
+			events = append(events, chromeTraceEvent{
+				Name: fmt.Sprintf("G%d", ev.G),
+				Cat:  "run",
+				Ph:   "X",
+				Ts:   ts,
+				Dur:  dur,
+				Pid:  chromePidProcs,
+				Tid:  int64(ev.P),
+				Args: map[string]interface{}{"g": ev.G, "tick": ev.Tick},
+			})
+		case "steal":
+			events = append(events, chromeTraceEvent{
+				Name: "steal",
+				Cat:  "steal",
+				Ph:   "i",
+				Ts:   ts,
+				Pid:  chromePidProcs,
+				Tid:  int64(ev.P),
+				S:    "t",
+				Args: map[string]interface{}{"g": ev.G, "victim": fmt.Sprintf("P%d", ev.Victim)},
+			})
+		}
+		events = append(events, chromeTraceEvent{
+			Name: fmt.Sprintf("P%d runq", ev.P),
+			Ph:   "C",
+			Ts:   ts,
+			Pid:  chromePidProcs,
+			Args: map[string]interface{}{"depth": ev.LocalDepth},
+		}, chromeTraceEvent{
+			Name: "global runq",
+			Ph:   "C",
+			Ts:   ts,
+			Pid:  chromePidProcs,
+			Args: map[string]interface{}{"depth": ev.GlobalDepth},
+		})
+	}
+
+	for _, ev := range sim.gtrace {
+		args := map[string]interface{}{}
+		if ev.P >= 0 {
+			args["p"] = fmt.Sprintf("P%d", ev.P)
+		}
+		events = append(events, chromeTraceEvent{
+			Name: ev.Kind,
+			Cat:  "goroutine",
+			Ph:   "i",
+			Ts:   chromeTs(ev.Time),
+			Pid:  chromePidGoroutines,
+			Tid:  ev.G,
+			S:    "t",
+			Args: args,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	return enc.Encode(chromeTrace{TraceEvents: events, DisplayTimeUnit: "ns"})
 }
 
 // ===== 2. Goroutine Preemption Analyzer =====
@@ -260,36 +914,128 @@ func (pa *PreemptionAnalyzer) DemonstrateLoopPreemption() {
 
 // ===== 3. Runtime Statistics Collector =====
 
+// The collector samples runtime/metrics rather than runtime.ReadMemStats,
+// which stops the world. Histograms are summarized over the interval since
+// the previous sample, so a p99 reflects recent behavior rather than the
+// whole life of the process.
+
+const (
+	metricGoroutines   = "/sched/goroutines:goroutines"
+	metricSchedLatency = "/sched/latencies:seconds"
+	metricGCPauses     = "/sched/pauses/total/gc:seconds"
+	metricGCCycles     = "/gc/cycles/total:gc-cycles"
+	metricHeapAllocs   = "/gc/heap/allocs:bytes"
+	metricHeapObjects  = "/memory/classes/heap/objects:bytes"
+	metricHeapUnused   = "/memory/classes/heap/unused:bytes"
+	metricHeapFree     = "/memory/classes/heap/free:bytes"
+	metricHeapReleased = "/memory/classes/heap/released:bytes"
+	metricHeapStacks   = "/memory/classes/heap/stacks:bytes"
+	metricMSpanInuse   = "/memory/classes/metadata/mspan/inuse:bytes"
+	metricMCacheInuse  = "/memory/classes/metadata/mcache/inuse:bytes"
+	metricTotalMemory  = "/memory/classes/total:bytes"
+	metricCgoCalls     = "/cgo/go-to-c-calls:calls"
+)
+
+var collectorMetrics = []string{
+	metricGoroutines, metricSchedLatency, metricGCPauses, metricGCCycles,
+	metricHeapAllocs, metricHeapObjects, metricHeapUnused, metricHeapFree,
+	metricHeapReleased, metricHeapStacks, metricMSpanInuse, metricMCacheInuse,
+	metricTotalMemory, metricCgoCalls,
+}
+
 type RuntimeStatsCollector struct {
-	samples  []RuntimeSnapshot
-	interval time.Duration
-	mu       sync.RWMutex
-	stop     chan struct{}
+	samples    []RuntimeSnapshot
+	interval   time.Duration
+	mu         sync.RWMutex
+	stop       chan struct{}
+	reads      []metrics.Sample
+	prevHists  map[string][]uint64
+	thresholds map[string]float64
+	onAlert    func(Alert)
+	profiling  *ProfileConfig
+	profiles   []ProfileSnapshot
+	profileSeq int
 }
 
 type RuntimeSnapshot struct {
-	Timestamp      time.Time
-	NumGoroutine   int
-	Alloc          uint64
-	TotalAlloc     uint64
-	Sys            uint64
-	NumGC          uint32
-	PauseNs        []uint64
-	PauseEnd       []uint64
-	CPUFraction    float64
-	NumCgoCall     int64
-	MemStats       runtime.MemStats
+	Timestamp    time.Time
+	NumGoroutine int
+	Alloc        uint64
+	TotalAlloc   uint64
+	Sys          uint64
+	NumGC        uint32
+	PauseNs      []uint64
+	PauseEnd     []uint64
+	CPUFraction  float64
+	NumCgoCall   int64
+	HeapAlloc    uint64
+	HeapSys      uint64
+	HeapIdle     uint64
+	StackInuse   uint64
+	MSpanInuse   uint64
+	MCacheInuse  uint64
+	SchedLatency HistogramSummary // since the previous sample
+	GCPause      HistogramSummary // since the previous sample
+}
+
+// HistogramSummary condenses a runtime/metrics histogram, in seconds. Each
+// quantile is the upper bound of the bucket it falls in.
+type HistogramSummary struct {
+	Count uint64
+	P50   float64
+	P90   float64
+	P99   float64
+	Max   float64
+}
+
+// Alert reports a sampled value above its configured threshold.
+type Alert struct {
+	Metric    string
+	Value     float64
+	Threshold float64
+	Timestamp time.Time
 }
 
 func NewRuntimeStatsCollector(interval time.Duration) *RuntimeStatsCollector {
+	supported := make(map[string]bool)
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+	reads := make([]metrics.Sample, 0, len(collectorMetrics))
+	for _, name := range collectorMetrics {
+		if supported[name] {
+			reads = append(reads, metrics.Sample{Name: name})
+		}
+	}
+
 	return &RuntimeStatsCollector{
-		samples:  make([]RuntimeSnapshot, 0, 1000),
-		interval: interval,
-		stop:     make(chan struct{}),
+		samples:    make([]RuntimeSnapshot, 0, 1000),
+		interval:   interval,
+		stop:       make(chan struct{}),
+		reads:      reads,
+		prevHists:  make(map[string][]uint64),
+		thresholds: make(map[string]float64),
 	}
 }
 
+// SetThreshold raises an alert whenever a sample's value for metric, as
+// named by RuntimeSnapshot.Values, is above max.
+func (rsc *RuntimeStatsCollector) SetThreshold(metric string, max float64) {
+	rsc.mu.Lock()
+	defer rsc.mu.Unlock()
+	rsc.thresholds[metric] = max
+}
+
+// OnAlert sets the callback invoked for every threshold exceeded by a sample.
+func (rsc *RuntimeStatsCollector) OnAlert(fn func(Alert)) {
+	rsc.mu.Lock()
+	defer rsc.mu.Unlock()
+	rsc.onAlert = fn
+}
+
+// Start takes a baseline sample immediately, then samples every interval.
 func (rsc *RuntimeStatsCollector) Start() {
+	rsc.Sample()
 	go func() {
 		ticker := time.NewTicker(rsc.interval)
 		defer ticker.Stop()
@@ -299,26 +1045,144 @@ func (rsc *RuntimeStatsCollector) Start() {
 			case <-rsc.stop:
 				return
 			case <-ticker.C:
-				var m runtime.MemStats
-				runtime.ReadMemStats(&m)
-
-				snapshot := RuntimeSnapshot{
-					Timestamp:    time.Now(),
-					NumGoroutine: runtime.NumGoroutine(),
-					Alloc:        m.Alloc,
-					TotalAlloc:   m.TotalAlloc,
-					Sys:          m.Sys,
-					NumGC:        m.NumGC,
-					NumCgoCall:   m.NumCgoCall,
-					MemStats:     m,
-				}
-
-				rsc.mu.Lock()
-				rsc.samples = append(rsc.samples, snapshot)
-				rsc.mu.Unlock()
+				rsc.Sample()
 			}
 		}
 	}()
+
+	rsc.mu.RLock()
+	cfg := rsc.profiling
+	rsc.mu.RUnlock()
+	if cfg != nil {
+		go rsc.profileLoop(*cfg)
+	}
+}
+
+// Sample reads runtime/metrics once, stores the snapshot and checks it
+// against the configured thresholds.
+func (rsc *RuntimeStatsCollector) Sample() RuntimeSnapshot {
+	rsc.mu.Lock()
+	metrics.Read(rsc.reads)
+
+	values := make(map[string]uint64)
+	snapshot := RuntimeSnapshot{Timestamp: time.Now()}
+	for _, s := range rsc.reads {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			values[s.Name] = s.Value.Uint64()
+		case metrics.KindFloat64Histogram:
+			summary := rsc.summarizeDelta(s.Name, s.Value.Float64Histogram())
+			switch s.Name {
+			case metricSchedLatency:
+				snapshot.SchedLatency = summary
+			case metricGCPauses:
+				snapshot.GCPause = summary
+			}
+		}
+	}
+
+	snapshot.NumGoroutine = int(values[metricGoroutines])
+	snapshot.HeapAlloc = values[metricHeapObjects]
+	snapshot.Alloc = snapshot.HeapAlloc
+	snapshot.TotalAlloc = values[metricHeapAllocs]
+	snapshot.Sys = values[metricTotalMemory]
+	snapshot.NumGC = uint32(values[metricGCCycles])
+	snapshot.NumCgoCall = int64(values[metricCgoCalls])
+	snapshot.HeapIdle = values[metricHeapFree] + values[metricHeapReleased]
+	snapshot.HeapSys = snapshot.HeapAlloc + values[metricHeapUnused] + snapshot.HeapIdle
+	snapshot.StackInuse = values[metricHeapStacks]
+	snapshot.MSpanInuse = values[metricMSpanInuse]
+	snapshot.MCacheInuse = values[metricMCacheInuse]
+
+	rsc.samples = append(rsc.samples, snapshot)
+
+	var alerts []Alert
+	sampled := snapshot.Values()
+	for metric, max := range rsc.thresholds {
+		if v, ok := sampled[metric]; ok && v > max {
+			alerts = append(alerts, Alert{Metric: metric, Value: v, Threshold: max, Timestamp: snapshot.Timestamp})
+		}
+	}
+	onAlert := rsc.onAlert
+	rsc.mu.Unlock()
+
+	if onAlert != nil {
+		for _, alert := range alerts {
+			onAlert(alert)
+		}
+	}
+	return snapshot
+}
+
+// summarizeDelta summarizes the counts added to a cumulative histogram since
+// it was last read. Caller holds rsc.mu.
+func (rsc *RuntimeStatsCollector) summarizeDelta(name string, h *metrics.Float64Histogram) HistogramSummary {
+	prev := rsc.prevHists[name]
+	delta := make([]uint64, len(h.Counts))
+	for i, c := range h.Counts {
+		delta[i] = c
+		if len(prev) == len(h.Counts) {
+			delta[i] -= prev[i]
+		}
+	}
+	rsc.prevHists[name] = append(prev[:0], h.Counts...)
+	return summarizeHistogram(delta, h.Buckets)
+}
+
+// summarizeHistogram computes quantiles from bucket counts, where bucket i
+// spans [buckets[i], buckets[i+1]).
+func summarizeHistogram(counts []uint64, buckets []float64) HistogramSummary {
+	var summary HistogramSummary
+	for _, c := range counts {
+		summary.Count += c
+	}
+	if summary.Count == 0 {
+		return summary
+	}
+
+	bound := func(i int) float64 {
+		if math.IsInf(buckets[i+1], 1) {
+			return buckets[i]
+		}
+		return buckets[i+1]
+	}
+	quantile := func(q float64) float64 {
+		target := uint64(math.Ceil(q * float64(summary.Count)))
+		var seen uint64
+		for i, c := range counts {
+			seen += c
+			if seen >= target {
+				return bound(i)
+			}
+		}
+		return bound(len(counts) - 1)
+	}
+
+	summary.P50 = quantile(0.50)
+	summary.P90 = quantile(0.90)
+	summary.P99 = quantile(0.99)
+	for i := len(counts) - 1; i >= 0; i-- {
+		if counts[i] > 0 {
+			summary.Max = bound(i)
+			break
+		}
+	}
+	return summary
+}
+
+// Values returns the snapshot's metrics by the names thresholds use.
+func (s RuntimeSnapshot) Values() map[string]float64 {
+	return map[string]float64{
+		"goroutines":            float64(s.NumGoroutine),
+		"heap_alloc_bytes":      float64(s.HeapAlloc),
+		"sys_bytes":             float64(s.Sys),
+		"stack_inuse_bytes":     float64(s.StackInuse),
+		"sched_latency_p50_sec": s.SchedLatency.P50,
+		"sched_latency_p99_sec": s.SchedLatency.P99,
+		"sched_latency_max_sec": s.SchedLatency.Max,
+		"gc_pause_p99_sec":      s.GCPause.P99,
+		"gc_pause_max_sec":      s.GCPause.Max,
+	}
 }
 
 func (rsc *RuntimeStatsCollector) Stop() {
@@ -337,23 +1201,257 @@ func (rsc *RuntimeStatsCollector) GetStats() map[string]interface{} {
 	first := rsc.samples[0]
 	last := rsc.samples[len(rsc.samples)-1]
 
+	var maxSchedP99, maxGCPause float64
+	for _, s := range rsc.samples {
+		maxSchedP99 = math.Max(maxSchedP99, s.SchedLatency.P99)
+		maxGCPause = math.Max(maxGCPause, s.GCPause.Max)
+	}
+
 	return map[string]interface{}{
-		"samples":              len(rsc.samples),
-		"duration_sec":         last.Timestamp.Sub(first.Timestamp).Seconds(),
-		"avg_goroutines":       calculateAvg(rsc.samples, func(s RuntimeSnapshot) uint64 { return uint64(s.NumGoroutine) }),
-		"max_goroutines":       calculateMax(rsc.samples, func(s RuntimeSnapshot) uint64 { return uint64(s.NumGoroutine) }),
-		"alloc_bytes_start":    first.Alloc,
-		"alloc_bytes_end":      last.Alloc,
-		"total_alloc_bytes":    last.TotalAlloc,
-		"sys_bytes":            last.Sys,
-		"gc_runs":              last.NumGC - first.NumGC,
-		"heap_alloc":           last.MemStats.HeapAlloc,
-		"heap_sys":             last.MemStats.HeapSys,
-		"heap_idle":            last.MemStats.HeapIdle,
-		"stack_inuse":          last.MemStats.StackInuse,
-		"mspan_inuse":          last.MemStats.MSpanInuse,
-		"mcache_inuse":         last.MemStats.MCacheInuse,
+		"samples":                   len(rsc.samples),
+		"duration_sec":              last.Timestamp.Sub(first.Timestamp).Seconds(),
+		"avg_goroutines":            calculateAvg(rsc.samples, func(s RuntimeSnapshot) uint64 { return uint64(s.NumGoroutine) }),
+		"max_goroutines":            calculateMax(rsc.samples, func(s RuntimeSnapshot) uint64 { return uint64(s.NumGoroutine) }),
+		"alloc_bytes_start":         first.Alloc,
+		"alloc_bytes_end":           last.Alloc,
+		"total_alloc_bytes":         last.TotalAlloc,
+		"sys_bytes":                 last.Sys,
+		"gc_runs":                   last.NumGC - first.NumGC,
+		"heap_alloc":                last.HeapAlloc,
+		"heap_sys":                  last.HeapSys,
+		"heap_idle":                 last.HeapIdle,
+		"stack_inuse":               last.StackInuse,
+		"mspan_inuse":               last.MSpanInuse,
+		"mcache_inuse":              last.MCacheInuse,
+		"max_sched_latency_p99_sec": maxSchedP99,
+		"max_gc_pause_sec":          maxGCPause,
+	}
+}
+
+// ----- Continuous profiling -----
+//
+// With profiling enabled, Start also captures a heap profile - and
+// optionally a CPU profile - every interval and keeps the most recent ones.
+// Each capture forces a GC first, since heap profiles only reflect the last
+// completed cycle. Besides the pprof-encoded bytes, a snapshot keeps the
+// heap records grouped by allocation site (the first non-runtime frame), so
+// two snapshots can be diffed without parsing pprof.
+
+// ProfileConfig controls continuous profile capture.
+type ProfileConfig struct {
+	Interval    time.Duration // time between captures
+	CPUDuration time.Duration // CPU profile length per capture, 0 disables
+	Retain      int           // snapshots kept, oldest dropped first
+}
+
+// ProfileSnapshot is one capture. Heap and CPU are in pprof format and can
+// be written to a file for `go tool pprof`.
+type ProfileSnapshot struct {
+	Seq       int
+	Timestamp time.Time
+	Heap      []byte
+	CPU       []byte
+	CPUError  error // why CPU is nil when a CPU profile was requested
+	Allocs    map[string]AllocSite
+}
+
+// AllocSite is the heap profile totals for one allocation site.
+type AllocSite struct {
+	Site         string
+	AllocBytes   int64
+	AllocObjects int64
+	InUseBytes   int64
+	InUseObjects int64
+}
+
+// AllocDiff is the change at one allocation site between two snapshots.
+type AllocDiff struct {
+	Site         string
+	AllocBytes   int64
+	AllocObjects int64
+	InUseBytes   int64
+	InUseObjects int64
+}
+
+// EnableProfiling turns on profile capture for the next Start.
+func (rsc *RuntimeStatsCollector) EnableProfiling(cfg ProfileConfig) {
+	if cfg.Retain < 1 {
+		cfg.Retain = 1
+	}
+	rsc.mu.Lock()
+	defer rsc.mu.Unlock()
+	rsc.profiling = &cfg
+}
+
+func (rsc *RuntimeStatsCollector) profileLoop(cfg ProfileConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rsc.stop:
+			return
+		case <-ticker.C:
+			rsc.CaptureProfile()
+		}
+	}
+}
+
+// CaptureProfile takes a snapshot now and retains it. When CPU profiling is
+// configured it blocks for CPUDuration, or until the collector stops.
+func (rsc *RuntimeStatsCollector) CaptureProfile() (ProfileSnapshot, error) {
+	rsc.mu.RLock()
+	cfg := ProfileConfig{Retain: 1}
+	if rsc.profiling != nil {
+		cfg = *rsc.profiling
+	}
+	rsc.mu.RUnlock()
+
+	snapshot := ProfileSnapshot{Timestamp: time.Now()}
+	if cfg.CPUDuration > 0 {
+		snapshot.CPU, snapshot.CPUError = rsc.captureCPU(cfg.CPUDuration)
+	}
+
+	runtime.GC()
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return ProfileSnapshot{}, fmt.Errorf("heap profile: %w", err)
+	}
+	snapshot.Heap = heap.Bytes()
+	snapshot.Allocs = readAllocSites()
+
+	rsc.mu.Lock()
+	rsc.profileSeq++
+	snapshot.Seq = rsc.profileSeq
+	rsc.profiles = append(rsc.profiles, snapshot)
+	if over := len(rsc.profiles) - cfg.Retain; over > 0 {
+		n := copy(rsc.profiles, rsc.profiles[over:])
+		for i := n; i < len(rsc.profiles); i++ {
+			rsc.profiles[i] = ProfileSnapshot{}
+		}
+		rsc.profiles = rsc.profiles[:n]
+	}
+	rsc.mu.Unlock()
+
+	return snapshot, nil
+}
+
+func (rsc *RuntimeStatsCollector) captureCPU(d time.Duration) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return nil, err
 	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-rsc.stop:
+	}
+	pprof.StopCPUProfile()
+	return buf.Bytes(), nil
+}
+
+// readAllocSites groups the runtime's heap profile records by allocation
+// site.
+func readAllocSites() map[string]AllocSite {
+	var records []runtime.MemProfileRecord
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records = make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		n, ok = runtime.MemProfile(records, true)
+		if ok {
+			records = records[:n]
+			break
+		}
+	}
+
+	sites := make(map[string]AllocSite)
+	for _, r := range records {
+		site := allocSite(r.Stack())
+		a := sites[site]
+		a.Site = site
+		a.AllocBytes += r.AllocBytes
+		a.AllocObjects += r.AllocObjects
+		a.InUseBytes += r.InUseBytes()
+		a.InUseObjects += r.InUseObjects()
+		sites[site] = a
+	}
+	return sites
+}
+
+// allocSite names the first frame outside the runtime as "func file:line".
+func allocSite(stack []uintptr) string {
+	frames := runtime.CallersFrames(stack)
+	first := ""
+	for {
+		frame, more := frames.Next()
+		site := fmt.Sprintf("%s %s:%d", frame.Function, filepath.Base(frame.File), frame.Line)
+		if first == "" {
+			first = site
+		}
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			return site
+		}
+		if !more {
+			return first
+		}
+	}
+}
+
+// Profiles returns the retained snapshots, oldest first.
+func (rsc *RuntimeStatsCollector) Profiles() []ProfileSnapshot {
+	rsc.mu.RLock()
+	defer rsc.mu.RUnlock()
+
+	profiles := make([]ProfileSnapshot, len(rsc.profiles))
+	copy(profiles, rsc.profiles)
+	return profiles
+}
+
+// DiffProfiles returns the n sites whose in-use bytes grew most from before
+// to after, the usual signature of a leak. Ties fall back to allocated
+// bytes. n <= 0 returns every site that changed.
+func DiffProfiles(before, after ProfileSnapshot, n int) []AllocDiff {
+	var diffs []AllocDiff
+	seen := make(map[string]bool)
+	add := func(site string) {
+		if seen[site] {
+			return
+		}
+		seen[site] = true
+		a, b := after.Allocs[site], before.Allocs[site]
+		d := AllocDiff{
+			Site:         site,
+			AllocBytes:   a.AllocBytes - b.AllocBytes,
+			AllocObjects: a.AllocObjects - b.AllocObjects,
+			InUseBytes:   a.InUseBytes - b.InUseBytes,
+			InUseObjects: a.InUseObjects - b.InUseObjects,
+		}
+		if d != (AllocDiff{Site: site}) {
+			diffs = append(diffs, d)
+		}
+	}
+	for site := range after.Allocs {
+		add(site)
+	}
+	for site := range before.Allocs {
+		add(site)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].InUseBytes != diffs[j].InUseBytes {
+			return diffs[i].InUseBytes > diffs[j].InUseBytes
+		}
+		if diffs[i].AllocBytes != diffs[j].AllocBytes {
+			return diffs[i].AllocBytes > diffs[j].AllocBytes
+		}
+		return diffs[i].Site < diffs[j].Site
+	})
+	if n > 0 && n < len(diffs) {
+		diffs = diffs[:n]
+	}
+	return diffs
 }
 
 func calculateAvg(samples []RuntimeSnapshot, fn func(RuntimeSnapshot) uint64) uint64 {
@@ -435,16 +1533,132 @@ func (ca *ContentionAnalyzer) GetReport() map[string]map[string]interface{} {
 	return report
 }
 
+// TopContended returns the n sites with the most total wait time, most
+// contended first. n <= 0 returns every site.
+func (ca *ContentionAnalyzer) TopContended(n int) []ContentionInfo {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	top := make([]ContentionInfo, 0, len(ca.contentionPoints))
+	for _, info := range ca.contentionPoints {
+		top = append(top, *info)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].TotalWaitTime != top[j].TotalWaitTime {
+			return top[i].TotalWaitTime > top[j].TotalWaitTime
+		}
+		if top[i].ContentionCount != top[j].ContentionCount {
+			return top[i].ContentionCount > top[j].ContentionCount
+		}
+		return top[i].Name < top[j].Name
+	})
+	if n > 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// ----- Instrumented sync primitives -----
+//
+// The instrumented locks try to acquire without blocking first; only when
+// that fails is the acquisition contended, and the time spent waiting is
+// recorded under "<name>@<file>:<line>" of the caller. Uncontended locking
+// costs one TryLock and records nothing. A lock with a nil analyzer behaves
+// like its plain sync counterpart.
+
+// InstrumentedMutex is a sync.Mutex that reports contended Lock calls.
+type InstrumentedMutex struct {
+	mu       sync.Mutex
+	analyzer *ContentionAnalyzer
+	name     string
+}
+
+// InstrumentedRWMutex is a sync.RWMutex that reports contended Lock and
+// RLock calls.
+type InstrumentedRWMutex struct {
+	mu       sync.RWMutex
+	analyzer *ContentionAnalyzer
+	name     string
+}
+
+func (ca *ContentionAnalyzer) NewMutex(name string) *InstrumentedMutex {
+	return &InstrumentedMutex{analyzer: ca, name: name}
+}
+
+func (ca *ContentionAnalyzer) NewRWMutex(name string) *InstrumentedRWMutex {
+	return &InstrumentedRWMutex{analyzer: ca, name: name}
+}
+
+func (m *InstrumentedMutex) Lock() {
+	if m.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	m.mu.Lock()
+	recordLockWait(m.analyzer, m.name, start)
+}
+
+func (m *InstrumentedMutex) Unlock() {
+	m.mu.Unlock()
+}
+
+func (m *InstrumentedRWMutex) Lock() {
+	if m.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	m.mu.Lock()
+	recordLockWait(m.analyzer, m.name, start)
+}
+
+func (m *InstrumentedRWMutex) Unlock() {
+	m.mu.Unlock()
+}
+
+func (m *InstrumentedRWMutex) RLock() {
+	if m.mu.TryRLock() {
+		return
+	}
+	start := time.Now()
+	m.mu.RLock()
+	recordLockWait(m.analyzer, m.name+"(r)", start)
+}
+
+func (m *InstrumentedRWMutex) RUnlock() {
+	m.mu.RUnlock()
+}
+
+// recordLockWait records the wait since start against the site that called
+// the lock method.
+func recordLockWait(ca *ContentionAnalyzer, name string, start time.Time) {
+	if ca == nil {
+		return
+	}
+	wait := time.Since(start)
+	ca.RecordContention(name+"@"+callerSite(3), wait)
+}
+
+// callerSite returns "file:line" for the caller skip frames above it.
+func callerSite(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+}
+
 // ===== 5. GOMAXPROCS Optimizer =====
 
 type MAXPROCSOptimizer struct {
 	benchmarks map[int]time.Duration
 	mu         sync.RWMutex
+	cgroupFS   fs.FS // root filesystem holding proc/ and sys/fs/cgroup/
 }
 
 func NewMAXPROCSOptimizer() *MAXPROCSOptimizer {
 	return &MAXPROCSOptimizer{
 		benchmarks: make(map[int]time.Duration),
+		cgroupFS:   os.DirFS("/"),
 	}
 }
 
@@ -489,18 +1703,232 @@ func (mo *MAXPROCSOptimizer) GetBenchmarks() map[int]time.Duration {
 	return result
 }
 
+// ----- Container CPU limits -----
+//
+// Before Go 1.25 the runtime set GOMAXPROCS to the host's CPU count even
+// inside a container limited to a fraction of it, so the process ran more
+// Ps than it had CPU time for and was throttled by the CFS quota. Detection
+// follows uber-go/automaxprocs: find the process's cgroup in
+// /proc/self/cgroup, read the quota for it (cpu.max on cgroup v2,
+// cpu.cfs_quota_us and cpu.cfs_period_us on v1), and round the limit down
+// to whole CPUs with a minimum of one. Both the host-level cgroup path and
+// the container's namespaced root are tried.
+
+// CPUQuota is a CFS bandwidth limit.
+type CPUQuota struct {
+	Quota  int64   // microseconds of CPU time per period
+	Period int64   // microseconds
+	Limit  float64 // CPUs, Quota / Period
+	Source string  // "cgroup2" or "cgroup1"
+}
+
+// Procs returns the GOMAXPROCS value matching the limit.
+func (q CPUQuota) Procs() int {
+	procs := int(math.Floor(q.Limit))
+	if procs < 1 {
+		procs = 1
+	}
+	return procs
+}
+
+// DetectCPUQuota reports the CPU quota of the current cgroup. found is false
+// when no cgroup is found or it has no quota.
+func (mo *MAXPROCSOptimizer) DetectCPUQuota() (quota CPUQuota, found bool, err error) {
+	data, err := fs.ReadFile(mo.cgroupFS, "proc/self/cgroup")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return CPUQuota{}, false, nil
+		}
+		return CPUQuota{}, false, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		id, controllers, cgroupPath := parts[0], parts[1], parts[2]
+
+		if id == "0" && controllers == "" {
+			for _, dir := range []string{path.Join("sys/fs/cgroup", cgroupPath), "sys/fs/cgroup"} {
+				quota, found, err := readCgroup2Quota(mo.cgroupFS, dir)
+				if err != nil || found {
+					return quota, found, err
+				}
+			}
+			continue
+		}
+
+		for _, c := range strings.Split(controllers, ",") {
+			if c != "cpu" {
+				continue
+			}
+			for _, mount := range []string{"sys/fs/cgroup/cpu,cpuacct", "sys/fs/cgroup/cpu"} {
+				for _, dir := range []string{path.Join(mount, cgroupPath), mount} {
+					quota, found, err := readCgroup1Quota(mo.cgroupFS, dir)
+					if err != nil || found {
+						return quota, found, err
+					}
+				}
+			}
+		}
+	}
+	return CPUQuota{}, false, nil
+}
+
+// readCgroup2Quota parses cpu.max ("<quota> <period>" or "max <period>").
+func readCgroup2Quota(fsys fs.FS, dir string) (CPUQuota, bool, error) {
+	data, err := fs.ReadFile(fsys, path.Join(dir, "cpu.max"))
+	if err != nil {
+		return CPUQuota{}, false, nil
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return CPUQuota{}, false, fmt.Errorf("%s/cpu.max: unexpected format %q", dir, data)
+	}
+	if fields[0] == "max" {
+		return CPUQuota{}, false, nil
+	}
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return CPUQuota{}, false, fmt.Errorf("%s/cpu.max: %w", dir, err)
+	}
+	period, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return CPUQuota{}, false, fmt.Errorf("%s/cpu.max: %w", dir, err)
+	}
+	return newCPUQuota(quota, period, "cgroup2")
+}
+
+// readCgroup1Quota parses cpu.cfs_quota_us and cpu.cfs_period_us. A quota
+// of -1 means unlimited.
+func readCgroup1Quota(fsys fs.FS, dir string) (CPUQuota, bool, error) {
+	readInt := func(name string) (int64, error) {
+		data, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s/%s: %w", dir, name, err)
+		}
+		return v, nil
+	}
+
+	quota, err := readInt("cpu.cfs_quota_us")
+	if errors.Is(err, fs.ErrNotExist) {
+		return CPUQuota{}, false, nil
+	} else if err != nil {
+		return CPUQuota{}, false, err
+	}
+	if quota < 0 {
+		return CPUQuota{}, false, nil
+	}
+	period, err := readInt("cpu.cfs_period_us")
+	if err != nil {
+		return CPUQuota{}, false, err
+	}
+	return newCPUQuota(quota, period, "cgroup1")
+}
+
+func newCPUQuota(quota, period int64, source string) (CPUQuota, bool, error) {
+	if quota <= 0 || period <= 0 {
+		return CPUQuota{}, false, fmt.Errorf("%s: invalid quota %d/%d", source, quota, period)
+	}
+	return CPUQuota{
+		Quota:  quota,
+		Period: period,
+		Limit:  float64(quota) / float64(period),
+		Source: source,
+	}, true, nil
+}
+
+// AutoSet sets GOMAXPROCS to the container's CPU limit, capped at the CPU
+// count. It does nothing when the GOMAXPROCS environment variable is set or
+// no quota is found. undo restores the previous value.
+func (mo *MAXPROCSOptimizer) AutoSet() (procs int, undo func(), err error) {
+	current := runtime.GOMAXPROCS(0)
+	undo = func() {}
+	if _, set := os.LookupEnv("GOMAXPROCS"); set {
+		return current, undo, nil
+	}
+
+	quota, found, err := mo.DetectCPUQuota()
+	if err != nil || !found {
+		return current, undo, err
+	}
+
+	procs = quota.Procs()
+	if n := runtime.NumCPU(); procs > n {
+		procs = n
+	}
+	prev := runtime.GOMAXPROCS(procs)
+	return procs, func() { runtime.GOMAXPROCS(prev) }, nil
+}
+
+// QuotaComparison compares a workload at the CPU count against the
+// quota-aware setting.
+type QuotaComparison struct {
+	Quota        CPUQuota
+	Limited      bool
+	DefaultProcs int
+	QuotaProcs   int
+	Default      time.Duration
+	QuotaAware   time.Duration
+}
+
+// CompareQuotaAware benchmarks workload with GOMAXPROCS at runtime.NumCPU()
+// and at the detected quota. Without a quota both runs use the CPU count.
+func (mo *MAXPROCSOptimizer) CompareQuotaAware(workload func()) (QuotaComparison, error) {
+	quota, found, err := mo.DetectCPUQuota()
+	if err != nil {
+		return QuotaComparison{}, err
+	}
+
+	cmp := QuotaComparison{
+		Quota:        quota,
+		Limited:      found,
+		DefaultProcs: runtime.NumCPU(),
+		QuotaProcs:   runtime.NumCPU(),
+	}
+	if found && quota.Procs() < cmp.QuotaProcs {
+		cmp.QuotaProcs = quota.Procs()
+	}
+
+	cmp.Default = mo.BenchmarkWithProcs(cmp.DefaultProcs, workload)
+	cmp.QuotaAware = mo.BenchmarkWithProcs(cmp.QuotaProcs, workload)
+	return cmp, nil
+}
+
 // ===== 6. Goroutine Affinity Pattern =====
 
+// Workers run their own queue first and also drain the global overflow
+// queue. An idle worker steals from the other workers' queues, the same way
+// an idle P steals in the GMP simulator, so work piled on one affinity does
+// not wait behind a busy worker.
+
+const affinityStealBackoff = 50 * time.Microsecond
+
 type AffinityScheduler struct {
 	workers   []*AffinityWorker
 	workQueue chan AffinityWork
 	numProcs  int
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	submitted int64
+	started   time.Time
 }
 
 type AffinityWorker struct {
-	id      int
-	work    chan AffinityWork
+	id       int
+	work     chan AffinityWork
 	affinity int // CPU affinity (simulated)
+
+	processed     int64
+	steals        int64
+	stealAttempts int64
+	globalTaken   int64
+	affinityHits  int64
 }
 
 type AffinityWork struct {
@@ -514,27 +1942,72 @@ func NewAffinityScheduler(numWorkers int) *AffinityScheduler {
 		workers:   make([]*AffinityWorker, numWorkers),
 		workQueue: make(chan AffinityWork, 1000),
 		numProcs:  numWorkers,
+		stop:      make(chan struct{}),
+		started:   time.Now(),
 	}
 
 	for i := 0; i < numWorkers; i++ {
-		w := &AffinityWorker{
+		as.workers[i] = &AffinityWorker{
 			id:       i,
 			work:     make(chan AffinityWork, 100),
 			affinity: i,
 		}
-		as.workers[i] = w
+	}
+	for _, w := range as.workers {
+		as.wg.Add(1)
+		go as.runWorker(w)
+	}
+
+	return as
+}
 
-		go func(worker *AffinityWorker) {
-			for work := range worker.work {
-				work.fn()
+func (as *AffinityScheduler) runWorker(w *AffinityWorker) {
+	defer as.wg.Done()
+	for {
+		select {
+		case <-as.stop:
+			return
+		case work := <-w.work:
+			as.execute(w, work)
+		case work := <-as.workQueue:
+			atomic.AddInt64(&w.globalTaken, 1)
+			as.execute(w, work)
+		default:
+			if work, ok := as.trySteal(w); ok {
+				atomic.AddInt64(&w.steals, 1)
+				as.execute(w, work)
+			} else {
+				atomic.AddInt64(&w.stealAttempts, 1)
+				time.Sleep(affinityStealBackoff)
 			}
-		}(w)
+		}
 	}
+}
 
-	return as
+func (as *AffinityScheduler) execute(w *AffinityWorker, work AffinityWork) {
+	work.fn()
+	atomic.AddInt64(&w.processed, 1)
+	if work.affinity%len(as.workers) == w.id {
+		atomic.AddInt64(&w.affinityHits, 1)
+	}
+}
+
+// trySteal takes one item from the first other worker with queued work,
+// starting with w's neighbor.
+func (as *AffinityScheduler) trySteal(w *AffinityWorker) (AffinityWork, bool) {
+	for i := 1; i < len(as.workers); i++ {
+		other := as.workers[(w.id+i)%len(as.workers)]
+		select {
+		case work := <-other.work:
+			return work, true
+		default:
+		}
+	}
+	return AffinityWork{}, false
 }
 
 func (as *AffinityScheduler) SubmitWork(work AffinityWork) {
+	atomic.AddInt64(&as.submitted, 1)
 	// Schedule on preferred processor with affinity
 	preferredWorker := as.workers[work.affinity%len(as.workers)]
 	select {
@@ -554,16 +2027,306 @@ func (as *AffinityScheduler) SubmitWork(work AffinityWork) {
 	}
 }
 
-func (as *AffinityScheduler) Stop() {
+// GetMetrics reports totals and per-worker throughput, steals and affinity
+// hits, keyed like GMPSimulator.GetMetrics.
+func (as *AffinityScheduler) GetMetrics() map[string]interface{} {
+	elapsed := time.Since(as.started).Seconds()
+
+	var processed, steals, attempts, global, hits int64
+	workerWork := make(map[string]int64)
+	workerSteals := make(map[string]int64)
+	workerThroughput := make(map[string]float64)
 	for _, w := range as.workers {
-		close(w.work)
+		n := atomic.LoadInt64(&w.processed)
+		stolen := atomic.LoadInt64(&w.steals)
+		processed += n
+		steals += stolen
+		attempts += atomic.LoadInt64(&w.stealAttempts)
+		global += atomic.LoadInt64(&w.globalTaken)
+		hits += atomic.LoadInt64(&w.affinityHits)
+
+		workerWork[fmt.Sprintf("W%d_work", w.id)] = n
+		workerSteals[fmt.Sprintf("W%d_steals", w.id)] = stolen
+		workerThroughput[fmt.Sprintf("W%d_per_sec", w.id)] = float64(n) / elapsed
 	}
+
+	return map[string]interface{}{
+		"workers_count":      len(as.workers),
+		"work_submitted":     atomic.LoadInt64(&as.submitted),
+		"work_processed":     processed,
+		"steals_successful":  steals,
+		"steal_attempts":     attempts,
+		"global_queue_taken": global,
+		"affinity_hits":      hits,
+		"throughput_per_sec": float64(processed) / elapsed,
+		"worker_work":        workerWork,
+		"worker_steals":      workerSteals,
+		"worker_throughput":  workerThroughput,
+	}
+}
+
+// Stop signals the workers and waits for them to finish their current item.
+// Work still queued is dropped.
+func (as *AffinityScheduler) Stop() {
+	close(as.stop)
+	as.wg.Wait()
+}
+
+// ===== 7. Goroutine Leak Detector =====
+
+// The detector parses runtime.Stack dumps of every goroutine and groups them
+// by creation site - the "created by" frame, or "main" for the main
+// goroutine. A leak shows up as a group that keeps growing between
+// snapshots. Goroutines whose stack contains an ignored substring are left
+// out, which is how known background workers are excluded.
+
+// leakGracePeriod is how long AssertNoLeaks waits for goroutines to exit.
+var leakGracePeriod = time.Second
+
+type LeakDetector struct {
+	mu        sync.Mutex
+	ignore    []string
+	snapshots []GoroutineSnapshot
+}
+
+type GoroutineSnapshot struct {
+	Timestamp time.Time
+	Groups    map[string]*GoroutineGroup
+}
+
+// GoroutineGroup is the goroutines sharing a creation site.
+type GoroutineGroup struct {
+	Site   string
+	Count  int
+	States map[string]int // e.g. "chan receive", "select", "running"
+	Sample string         // stack of one member
+}
+
+// LeakReport is a creation site whose goroutine count grew.
+type LeakReport struct {
+	Site   string
+	Before int
+	After  int
+	Growth int
+	Sample string
+}
+
+func NewLeakDetector(ignore ...string) *LeakDetector {
+	return &LeakDetector{ignore: ignore}
+}
+
+// Ignore excludes goroutines whose stack contains any of the patterns.
+func (ld *LeakDetector) Ignore(patterns ...string) {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	ld.ignore = append(ld.ignore, patterns...)
+}
+
+// Snapshot captures and records the current goroutines.
+func (ld *LeakDetector) Snapshot() GoroutineSnapshot {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	snapshot := GoroutineSnapshot{Timestamp: time.Now(), Groups: make(map[string]*GoroutineGroup)}
+	for _, stack := range strings.Split(strings.TrimSpace(string(buf)), "\n\n") {
+		if ld.ignored(stack) {
+			continue
+		}
+		site, state := parseGoroutineStack(stack)
+		g, ok := snapshot.Groups[site]
+		if !ok {
+			g = &GoroutineGroup{Site: site, States: make(map[string]int), Sample: stack}
+			snapshot.Groups[site] = g
+		}
+		g.Count++
+		g.States[state]++
+	}
+
+	ld.snapshots = append(ld.snapshots, snapshot)
+	return snapshot
+}
+
+// ignored reports whether stack matches the ignore list. Caller holds ld.mu.
+func (ld *LeakDetector) ignored(stack string) bool {
+	for _, pattern := range ld.ignore {
+		if strings.Contains(stack, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGoroutineStack returns the creation site as "func file:line" and the
+// wait state of one goroutine's stack dump.
+func parseGoroutineStack(stack string) (site, state string) {
+	lines := strings.Split(stack, "\n")
+
+	// goroutine 7 [chan receive, 2 minutes]:
+	header := lines[0]
+	if open, end := strings.Index(header, "["), strings.LastIndex(header, "]"); open >= 0 && end > open {
+		state = header[open+1 : end]
+		if comma := strings.Index(state, ","); comma >= 0 {
+			state = state[:comma]
+		}
+	}
+
+	site = "main"
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "created by ") {
+			continue
+		}
+		fn := strings.TrimPrefix(line, "created by ")
+		if in := strings.Index(fn, " in goroutine "); in >= 0 {
+			fn = fn[:in]
+		}
+		site = fn
+		if i+1 < len(lines) {
+			loc := strings.TrimSpace(lines[i+1])
+			if sp := strings.LastIndex(loc, " +0x"); sp >= 0 {
+				loc = loc[:sp]
+			}
+			site = fn + " " + filepath.Base(loc)
+		}
+		break
+	}
+	return site, state
+}
+
+// Snapshots returns the recorded snapshots, oldest first.
+func (ld *LeakDetector) Snapshots() []GoroutineSnapshot {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+
+	snapshots := make([]GoroutineSnapshot, len(ld.snapshots))
+	copy(snapshots, ld.snapshots)
+	return snapshots
+}
+
+// Compare returns the groups with more goroutines in after than in before,
+// largest growth first.
+func (ld *LeakDetector) Compare(before, after GoroutineSnapshot) []LeakReport {
+	var reports []LeakReport
+	for site, g := range after.Groups {
+		prev := 0
+		if b, ok := before.Groups[site]; ok {
+			prev = b.Count
+		}
+		if g.Count > prev {
+			reports = append(reports, LeakReport{
+				Site:   site,
+				Before: prev,
+				After:  g.Count,
+				Growth: g.Count - prev,
+				Sample: g.Sample,
+			})
+		}
+	}
+	sortLeakReports(reports)
+	return reports
+}
+
+// Growing returns the groups whose count never fell between consecutive
+// snapshots and grew overall from the first to the last.
+func (ld *LeakDetector) Growing() []LeakReport {
+	snapshots := ld.Snapshots()
+	if len(snapshots) < 2 {
+		return nil
+	}
+
+	count := func(s GoroutineSnapshot, site string) int {
+		if g, ok := s.Groups[site]; ok {
+			return g.Count
+		}
+		return 0
+	}
+
+	first, last := snapshots[0], snapshots[len(snapshots)-1]
+	var reports []LeakReport
+	for site, g := range last.Groups {
+		growing := true
+		for i := 1; i < len(snapshots); i++ {
+			if count(snapshots[i], site) < count(snapshots[i-1], site) {
+				growing = false
+				break
+			}
+		}
+		if before := count(first, site); growing && g.Count > before {
+			reports = append(reports, LeakReport{
+				Site:   site,
+				Before: before,
+				After:  g.Count,
+				Growth: g.Count - before,
+				Sample: g.Sample,
+			})
+		}
+	}
+	sortLeakReports(reports)
+	return reports
+}
+
+func sortLeakReports(reports []LeakReport) {
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Growth != reports[j].Growth {
+			return reports[i].Growth > reports[j].Growth
+		}
+		return reports[i].Site < reports[j].Site
+	})
+}
+
+// TestingT is the part of testing.TB AssertNoLeaks needs.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// AssertNoLeaks snapshots the goroutines now and, when the test finishes,
+// fails it if any creation site has more goroutines than at the start.
+// Goroutines get leakGracePeriod to exit before the check fails.
+//
+//	func TestWorker(t *testing.T) {
+//		AssertNoLeaks(t)
+//		...
+//	}
+func AssertNoLeaks(t TestingT, ignore ...string) {
+	t.Helper()
+	ld := NewLeakDetector(ignore...)
+	before := ld.Snapshot()
+
+	t.Cleanup(func() {
+		t.Helper()
+		deadline := time.Now().Add(leakGracePeriod)
+		for {
+			leaks := ld.Compare(before, ld.Snapshot())
+			if len(leaks) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				for _, leak := range leaks {
+					t.Errorf("leaked %d goroutine(s) created by %s:\n%s", leak.Growth, leak.Site, leak.Sample)
+				}
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
 }
 
 // ===== Main Demo =====
 
 func main() {
-	fmt.Println("=== Go Runtime & Scheduler Internals ===\n")
+	fmt.Println("=== Go Runtime & Scheduler Internals ===")
+	fmt.Println()
 
 	// 1. GMP Simulator
 	fmt.Println("1. GMP Model Simulator")
@@ -618,7 +2381,8 @@ func main() {
 	pa := NewPreemptionAnalyzer()
 	pa.DemonstrateChanPreemption(100000)
 	pa.DemonstrateLoopPreemption()
-	fmt.Println("Preemption demonstrations completed\n")
+	fmt.Println("Preemption demonstrations completed")
+	fmt.Println()
 
 	// 4. Contention Analysis
 	fmt.Println("4. Contention Analyzer")
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -69,6 +77,278 @@ func TestGMPSimulatorMultipleProcessors(t *testing.T) {
 	}
 }
 
+// TestGMPSimulatorDeterministic tests the virtual-clock simulation mode
+func runDeterministic(seed int64) (*GMPSimulator, int) {
+	sim := NewDeterministicGMPSimulator(4, seed)
+	for i := 0; i < 50; i++ {
+		sim.SubmitWork(func() {}, 0)
+	}
+	return sim, sim.RunUntilIdle(1000)
+}
+
+func TestGMPSimulatorDeterministicReproducible(t *testing.T) {
+	a, ticksA := runDeterministic(42)
+	b, ticksB := runDeterministic(42)
+
+	if ticksA != ticksB {
+		t.Errorf("Expected same tick count, got %d and %d", ticksA, ticksB)
+	}
+	if !reflect.DeepEqual(a.Trace(), b.Trace()) {
+		t.Errorf("Expected identical traces for the same seed")
+	}
+
+	metrics := a.GetMetrics()
+	if metrics["context_switches"].(int64) != 50 {
+		t.Errorf("Expected 50 context switches, got %d", metrics["context_switches"])
+	}
+	if metrics["steals_successful"].(int64) == 0 {
+		t.Errorf("Expected steals when all work starts on P0")
+	}
+	if metrics["steals_successful"] != b.GetMetrics()["steals_successful"] {
+		t.Errorf("Expected same steal count for the same seed")
+	}
+}
+
+func TestGMPSimulatorDeterministicSeeds(t *testing.T) {
+	a, _ := runDeterministic(1)
+	b, _ := runDeterministic(2)
+
+	if reflect.DeepEqual(a.Trace(), b.Trace()) {
+		t.Errorf("Expected different traces for different seeds")
+	}
+}
+
+func TestGMPSimulatorDeterministicVirtualClock(t *testing.T) {
+	sim, ticks := runDeterministic(7)
+
+	elapsed := sim.Clock().Now().Sub(time.Unix(0, 0))
+	if elapsed != time.Duration(ticks)*defaultSimQuantum {
+		t.Errorf("Expected %v of virtual time, got %v", time.Duration(ticks)*defaultSimQuantum, elapsed)
+	}
+
+	for _, ev := range sim.Trace() {
+		want := time.Unix(0, 0).Add(time.Duration(ev.Tick-1) * defaultSimQuantum)
+		if !ev.Time.Equal(want) {
+			t.Fatalf("Event at tick %d has time %v, want %v", ev.Tick, ev.Time, want)
+		}
+		if ev.Kind == "steal" && (ev.Victim < 0 || ev.Victim == ev.P) {
+			t.Errorf("Steal event with invalid victim: %+v", ev)
+		}
+	}
+}
+
+func TestGMPSimulatorGoroutineEvents(t *testing.T) {
+	sim, _ := runDeterministic(42)
+
+	kinds := make(map[int64][]string)
+	for _, ev := range sim.GoroutineEvents() {
+		kinds[ev.G] = append(kinds[ev.G], ev.Kind)
+	}
+	if len(kinds) != 50 {
+		t.Fatalf("Expected events for 50 goroutines, got %d", len(kinds))
+	}
+
+	stolen := 0
+	for g, seq := range kinds {
+		if seq[0] != "created" || seq[1] != "runnable" || seq[len(seq)-1] != "done" {
+			t.Errorf("G%d: unexpected event sequence %v", g, seq)
+		}
+		if seq[2] == "stolen" {
+			stolen++
+		}
+	}
+	if int64(stolen) != sim.GetMetrics()["steals_successful"].(int64) {
+		t.Errorf("Expected %d stolen events, got %d", sim.GetMetrics()["steals_successful"], stolen)
+	}
+}
+
+func TestGMPSimulatorExportChromeTrace(t *testing.T) {
+	sim, _ := runDeterministic(42)
+
+	var buf bytes.Buffer
+	if err := sim.ExportChromeTrace(&buf); err != nil {
+		t.Fatalf("ExportChromeTrace: %v", err)
+	}
+
+	var out struct {
+		TraceEvents []struct {
+			Name string  `json:"name"`
+			Ph   string  `json:"ph"`
+			Dur  float64 `json:"dur"`
+			Pid  int     `json:"pid"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("Invalid trace JSON: %v", err)
+	}
+
+	slices := 0
+	for _, ev := range out.TraceEvents {
+		if ev.Ph == "X" {
+			slices++
+			if ev.Dur != float64(defaultSimQuantum.Microseconds()) {
+				t.Errorf("Expected slice duration %dus, got %v", defaultSimQuantum.Microseconds(), ev.Dur)
+			}
+		}
+	}
+	if slices != 50 {
+		t.Errorf("Expected 50 run slices, got %d", slices)
+	}
+
+	realtime := NewGMPSimulator(1)
+	defer realtime.Stop()
+	if err := realtime.ExportChromeTrace(&buf); err == nil {
+		t.Errorf("Expected error exporting a real-time simulator")
+	}
+}
+
+func TestGMPSimulatorBlockingSyscalls(t *testing.T) {
+	sim := NewDeterministicGMPSimulator(4, 42)
+
+	var workDone int32
+	for i := 0; i < 8; i++ {
+		sim.SubmitSyscall(func() {
+			atomic.AddInt32(&workDone, 1)
+		}, i%4, 10)
+	}
+	sim.RunUntilIdle(1000)
+
+	metrics := sim.GetMetrics()
+	if workDone != 8 {
+		t.Errorf("Expected 8 work items, got %d", workDone)
+	}
+	if metrics["blocking_syscalls"].(int64) != 8 {
+		t.Errorf("Expected 8 blocking syscalls, got %d", metrics["blocking_syscalls"])
+	}
+	// Every G enters its syscall before any returns, so each needs its own M
+	// on top of the 4 that keep the Ps running.
+	if metrics["threads"].(int32) != 12 {
+		t.Errorf("Expected 12 threads, got %d", metrics["threads"])
+	}
+	if metrics["idle_threads"].(int) != 8 {
+		t.Errorf("Expected 8 idle threads after syscalls return, got %d", metrics["idle_threads"])
+	}
+	if metrics["context_switches"].(int64) != 16 {
+		t.Errorf("Expected each G to run twice, got %d context switches", metrics["context_switches"])
+	}
+
+	blocked := 0
+	for _, ev := range sim.GoroutineEvents() {
+		if ev.Kind == "blocked" {
+			blocked++
+		}
+	}
+	if blocked != 8 {
+		t.Errorf("Expected 8 blocked events, got %d", blocked)
+	}
+}
+
+func TestGMPSimulatorNetpoller(t *testing.T) {
+	sim := NewDeterministicGMPSimulator(4, 42)
+
+	for i := 0; i < 8; i++ {
+		sim.SubmitNetWork(func() {}, i%4, 10)
+	}
+	sim.RunUntilIdle(1000)
+
+	metrics := sim.GetMetrics()
+	if metrics["netpoll_waits"].(int64) != 8 {
+		t.Errorf("Expected 8 netpoll waits, got %d", metrics["netpoll_waits"])
+	}
+	if metrics["threads"].(int32) != 4 {
+		t.Errorf("Expected netpoll waits to need no extra threads, got %d", metrics["threads"])
+	}
+	if metrics["context_switches"].(int64) != 16 {
+		t.Errorf("Expected each G to run twice, got %d context switches", metrics["context_switches"])
+	}
+}
+
+func TestGMPSimulatorIdleThreadReuse(t *testing.T) {
+	sim := NewDeterministicGMPSimulator(1, 42)
+
+	// Sequential syscalls: each returning M parks and is reused by the next.
+	for i := 0; i < 5; i++ {
+		sim.SubmitSyscall(func() {}, 0, 1)
+		sim.RunUntilIdle(100)
+	}
+
+	if threads := sim.GetMetrics()["threads"].(int32); threads != 2 {
+		t.Errorf("Expected idle M reuse to cap threads at 2, got %d", threads)
+	}
+}
+
+func runOrder(cfg SchedulerConfig) []int64 {
+	sim := NewDeterministicGMPSimulatorWithConfig(1, 42, cfg)
+	for i := 0; i < 3; i++ {
+		sim.SubmitWork(func() {}, 0)
+	}
+	sim.RunUntilIdle(0)
+
+	var order []int64
+	for _, ev := range sim.Trace() {
+		if ev.Kind == "run" {
+			order = append(order, ev.G)
+		}
+	}
+	return order
+}
+
+func TestGMPSimulatorRunNext(t *testing.T) {
+	// The newest G takes runnext; the ones it displaced run in FIFO order.
+	if order := runOrder(SchedulerConfig{LocalQueueSize: 256, RunNext: true}); !reflect.DeepEqual(order, []int64{3, 1, 2}) {
+		t.Errorf("Expected run order [3 1 2] with runnext, got %v", order)
+	}
+	if order := runOrder(SchedulerConfig{LocalQueueSize: 256}); !reflect.DeepEqual(order, []int64{1, 2, 3}) {
+		t.Errorf("Expected run order [1 2 3] without runnext, got %v", order)
+	}
+}
+
+func TestGMPSimulatorRunQueueOverflow(t *testing.T) {
+	sim := NewDeterministicGMPSimulatorWithConfig(1, 42, SchedulerConfig{LocalQueueSize: 4})
+	for i := 0; i < 5; i++ {
+		sim.SubmitWork(func() {}, 0)
+	}
+
+	// The fifth G finds the queue full: G1 and G2 move to the global queue
+	// with it, leaving G3 and G4 local.
+	p := sim.processors[0]
+	if len(p.runq) != 2 || p.runq[0].id != 3 || len(sim.globalRunq) != 3 {
+		t.Fatalf("Unexpected queues after overflow: local %d, global %d", len(p.runq), len(sim.globalRunq))
+	}
+	metrics := sim.GetMetrics()
+	if metrics["runq_overflows"].(int64) != 1 || metrics["runq_overflow_moved"].(int64) != 3 {
+		t.Errorf("Expected 1 overflow moving 3 Gs, got %d moving %d", metrics["runq_overflows"], metrics["runq_overflow_moved"])
+	}
+}
+
+func TestCompareSchedulerConfigs(t *testing.T) {
+	configs := []SchedulerConfig{
+		{LocalQueueSize: 1024, RunNext: true},
+		{LocalQueueSize: 16, RunNext: true},
+	}
+	results := CompareSchedulerConfigs(4, 42, configs, func(sim *GMPSimulator) {
+		for i := 0; i < 600; i++ {
+			sim.SubmitWork(func() {}, 0)
+		}
+	})
+
+	large, small := results[0], results[1]
+	if large.ContextSwitches != 600 || small.ContextSwitches != 600 {
+		t.Fatalf("Expected 600 runs each, got %d and %d", large.ContextSwitches, small.ContextSwitches)
+	}
+	if large.Overflows != 0 || small.Overflows == 0 {
+		t.Errorf("Expected overflows only with the small queue, got %d and %d", large.Overflows, small.Overflows)
+	}
+	// Overflowed work reaches idle Ps through the global queue, so the
+	// small queue leaves less to steal.
+	if small.StealRate >= large.StealRate {
+		t.Errorf("Expected a lower steal rate with the small queue, got %.2f vs %.2f", small.StealRate, large.StealRate)
+	}
+	if large.RunNextHits == 0 {
+		t.Errorf("Expected runnext hits")
+	}
+}
+
 // TestPreemptionAnalyzer tests goroutine preemption
 func TestPreemptionAnalyzerChannelPreemption(t *testing.T) {
 	pa := NewPreemptionAnalyzer()
@@ -168,6 +448,156 @@ func TestRuntimeStatsCollectorMemory(t *testing.T) {
 	}
 }
 
+func TestRuntimeStatsCollectorThresholds(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(time.Second)
+
+	var alerts []Alert
+	rsc.OnAlert(func(a Alert) {
+		alerts = append(alerts, a)
+	})
+	rsc.SetThreshold("goroutines", 0)
+	rsc.SetThreshold("heap_alloc_bytes", math.MaxFloat64)
+
+	snapshot := rsc.Sample()
+	if snapshot.NumGoroutine == 0 || snapshot.HeapAlloc == 0 {
+		t.Fatalf("Expected runtime/metrics values, got %+v", snapshot)
+	}
+
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	if alerts[0].Metric != "goroutines" || alerts[0].Value != float64(snapshot.NumGoroutine) {
+		t.Errorf("Unexpected alert: %+v", alerts[0])
+	}
+}
+
+func TestRuntimeStatsCollectorSchedLatency(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(time.Second)
+	rsc.Sample()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.Gosched()
+		}()
+	}
+	wg.Wait()
+
+	snapshot := rsc.Sample()
+	if snapshot.SchedLatency.Count == 0 {
+		t.Errorf("Expected scheduling latency samples since the previous read")
+	}
+	if snapshot.SchedLatency.P50 > snapshot.SchedLatency.P99 || snapshot.SchedLatency.P99 > snapshot.SchedLatency.Max {
+		t.Errorf("Quantiles out of order: %+v", snapshot.SchedLatency)
+	}
+}
+
+var leakSink [][]byte
+
+func leakMemory(chunks int) {
+	for i := 0; i < chunks; i++ {
+		leakSink = append(leakSink, make([]byte, 1<<20))
+	}
+}
+
+func TestRuntimeStatsCollectorProfileRetention(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(time.Second)
+	rsc.EnableProfiling(ProfileConfig{Interval: time.Second, Retain: 2})
+
+	for i := 0; i < 3; i++ {
+		if _, err := rsc.CaptureProfile(); err != nil {
+			t.Fatalf("CaptureProfile: %v", err)
+		}
+	}
+
+	profiles := rsc.Profiles()
+	if len(profiles) != 2 {
+		t.Fatalf("Expected 2 retained profiles, got %d", len(profiles))
+	}
+	if profiles[0].Seq != 2 || profiles[1].Seq != 3 {
+		t.Errorf("Expected the newest snapshots 2 and 3, got %d and %d", profiles[0].Seq, profiles[1].Seq)
+	}
+	if len(profiles[1].Heap) == 0 || len(profiles[1].Allocs) == 0 {
+		t.Errorf("Expected heap profile data")
+	}
+}
+
+func TestRuntimeStatsCollectorProfileDiff(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(time.Second)
+
+	before, err := rsc.CaptureProfile()
+	if err != nil {
+		t.Fatalf("CaptureProfile: %v", err)
+	}
+	leakMemory(16)
+	defer func() { leakSink = nil }()
+	after, err := rsc.CaptureProfile()
+	if err != nil {
+		t.Fatalf("CaptureProfile: %v", err)
+	}
+
+	diffs := DiffProfiles(before, after, 3)
+	if len(diffs) == 0 {
+		t.Fatalf("Expected allocation diffs")
+	}
+	if !strings.Contains(diffs[0].Site, "leakMemory") {
+		t.Errorf("Expected leakMemory as the top growing site, got %+v", diffs)
+	}
+	if diffs[0].InUseBytes < 8<<20 {
+		t.Errorf("Expected at least 8MB of in-use growth, got %d", diffs[0].InUseBytes)
+	}
+	if len(DiffProfiles(after, after, 0)) != 0 {
+		t.Errorf("Expected no diffs between identical snapshots")
+	}
+}
+
+func TestRuntimeStatsCollectorCPUProfile(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(time.Second)
+	rsc.EnableProfiling(ProfileConfig{Interval: time.Second, CPUDuration: 50 * time.Millisecond, Retain: 1})
+
+	snapshot, err := rsc.CaptureProfile()
+	if err != nil {
+		t.Fatalf("CaptureProfile: %v", err)
+	}
+	if snapshot.CPUError != nil || len(snapshot.CPU) == 0 {
+		t.Errorf("Expected a CPU profile, got error %v", snapshot.CPUError)
+	}
+}
+
+func TestRuntimeStatsCollectorContinuousProfiling(t *testing.T) {
+	rsc := NewRuntimeStatsCollector(10 * time.Millisecond)
+	rsc.EnableProfiling(ProfileConfig{Interval: 20 * time.Millisecond, Retain: 3})
+	rsc.Start()
+	time.Sleep(150 * time.Millisecond)
+	rsc.Stop()
+
+	if n := len(rsc.Profiles()); n == 0 || n > 3 {
+		t.Errorf("Expected 1-3 retained profiles, got %d", n)
+	}
+}
+
+func TestSummarizeHistogram(t *testing.T) {
+	buckets := []float64{0, 1, 2, 3, math.Inf(1)}
+	counts := []uint64{50, 40, 9, 1}
+
+	summary := summarizeHistogram(counts, buckets)
+	if summary.Count != 100 {
+		t.Errorf("Expected count 100, got %d", summary.Count)
+	}
+	if summary.P50 != 1 || summary.P90 != 2 || summary.P99 != 3 {
+		t.Errorf("Unexpected quantiles: %+v", summary)
+	}
+	if summary.Max != 3 {
+		t.Errorf("Expected max 3 (lower bound of +Inf bucket), got %v", summary.Max)
+	}
+
+	if empty := summarizeHistogram([]uint64{0, 0}, []float64{0, 1, 2}); empty != (HistogramSummary{}) {
+		t.Errorf("Expected empty summary, got %+v", empty)
+	}
+}
+
 // TestContentionAnalyzer tests lock contention analysis
 func TestContentionAnalyzerBasic(t *testing.T) {
 	ca := NewContentionAnalyzer()
@@ -240,6 +670,103 @@ func TestContentionAnalyzerConcurrent(t *testing.T) {
 	}
 }
 
+func TestInstrumentedMutex(t *testing.T) {
+	ca := NewContentionAnalyzer()
+	mu := ca.NewMutex("counter")
+
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				mu.Lock()
+				counter++
+				time.Sleep(100 * time.Microsecond)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != 160 {
+		t.Errorf("Expected counter 160, got %d", counter)
+	}
+	report := ca.GetReport()
+	if len(report) != 1 {
+		t.Fatalf("Expected 1 contended site, got %v", report)
+	}
+	for name, info := range report {
+		if !strings.HasPrefix(name, "counter@main_test.go:") {
+			t.Errorf("Expected caller-site label, got %q", name)
+		}
+		if info["contention_count"].(int64) == 0 {
+			t.Errorf("Expected recorded contention")
+		}
+	}
+}
+
+func TestInstrumentedMutexUncontended(t *testing.T) {
+	ca := NewContentionAnalyzer()
+	mu := ca.NewMutex("solo")
+	for i := 0; i < 10; i++ {
+		mu.Lock()
+		mu.Unlock()
+	}
+
+	if len(ca.GetReport()) != 0 {
+		t.Errorf("Expected no contention for uncontended locking")
+	}
+
+	var plain InstrumentedMutex
+	plain.Lock()
+	plain.Unlock()
+}
+
+func TestInstrumentedRWMutex(t *testing.T) {
+	ca := NewContentionAnalyzer()
+	rw := ca.NewRWMutex("cache")
+
+	rw.Lock()
+	done := make(chan struct{})
+	go func() {
+		rw.RLock()
+		rw.RUnlock()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	rw.Unlock()
+	<-done
+
+	top := ca.TopContended(0)
+	if len(top) != 1 || !strings.HasPrefix(top[0].Name, "cache(r)@main_test.go:") {
+		t.Fatalf("Expected one read-lock site, got %+v", top)
+	}
+	if top[0].MaxWaitTime < 5*time.Millisecond {
+		t.Errorf("Expected the reader to wait for the writer, got %v", top[0].MaxWaitTime)
+	}
+}
+
+func TestContentionAnalyzerTopContended(t *testing.T) {
+	ca := NewContentionAnalyzer()
+	ca.RecordContention("a", time.Millisecond)
+	ca.RecordContention("b", 5*time.Millisecond)
+	ca.RecordContention("c", 2*time.Millisecond)
+	ca.RecordContention("c", 2*time.Millisecond)
+
+	top := ca.TopContended(2)
+	if len(top) != 2 {
+		t.Fatalf("Expected 2 sites, got %d", len(top))
+	}
+	if top[0].Name != "b" || top[1].Name != "c" {
+		t.Errorf("Expected [b c], got [%s %s]", top[0].Name, top[1].Name)
+	}
+	if len(ca.TopContended(0)) != 3 {
+		t.Errorf("Expected all sites for n <= 0")
+	}
+}
+
 // TestMAXPROCSOptimizer tests GOMAXPROCS optimization
 func TestMAXPROCSOptimizerBenchmark(t *testing.T) {
 	optimizer := NewMAXPROCSOptimizer()
@@ -316,6 +843,145 @@ func TestMAXPROCSOptimizerBenchmarks(t *testing.T) {
 	}
 }
 
+func TestMAXPROCSOptimizerDetectCPUQuota(t *testing.T) {
+	tests := []struct {
+		name   string
+		fs     fstest.MapFS
+		found  bool
+		limit  float64
+		procs  int
+		source string
+	}{
+		{
+			name: "cgroup2 namespaced root",
+			fs: fstest.MapFS{
+				"proc/self/cgroup":      {Data: []byte("0::/\n")},
+				"sys/fs/cgroup/cpu.max": {Data: []byte("250000 100000\n")},
+			},
+			found: true, limit: 2.5, procs: 2, source: "cgroup2",
+		},
+		{
+			name: "cgroup2 host path",
+			fs: fstest.MapFS{
+				"proc/self/cgroup":                    {Data: []byte("0::/kubepods/pod1\n")},
+				"sys/fs/cgroup/kubepods/pod1/cpu.max": {Data: []byte("50000 100000\n")},
+				"sys/fs/cgroup/cpu.max":               {Data: []byte("max 100000\n")},
+			},
+			found: true, limit: 0.5, procs: 1, source: "cgroup2",
+		},
+		{
+			name: "cgroup2 unlimited",
+			fs: fstest.MapFS{
+				"proc/self/cgroup":      {Data: []byte("0::/\n")},
+				"sys/fs/cgroup/cpu.max": {Data: []byte("max 100000\n")},
+			},
+		},
+		{
+			name: "cgroup1",
+			fs: fstest.MapFS{
+				"proc/self/cgroup":                            {Data: []byte("12:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n")},
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  {Data: []byte("400000\n")},
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": {Data: []byte("100000\n")},
+			},
+			found: true, limit: 4, procs: 4, source: "cgroup1",
+		},
+		{
+			name: "cgroup1 unlimited",
+			fs: fstest.MapFS{
+				"proc/self/cgroup":                            {Data: []byte("4:cpu,cpuacct:/\n")},
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  {Data: []byte("-1\n")},
+				"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": {Data: []byte("100000\n")},
+			},
+		},
+		{
+			name: "no cgroup",
+			fs:   fstest.MapFS{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mo := NewMAXPROCSOptimizer()
+			mo.cgroupFS = tt.fs
+
+			quota, found, err := mo.DetectCPUQuota()
+			if err != nil {
+				t.Fatalf("DetectCPUQuota: %v", err)
+			}
+			if found != tt.found {
+				t.Fatalf("Expected found=%v, got %v", tt.found, found)
+			}
+			if !found {
+				return
+			}
+			if quota.Limit != tt.limit || quota.Procs() != tt.procs || quota.Source != tt.source {
+				t.Errorf("Expected limit %v, procs %d from %s, got %+v (procs %d)", tt.limit, tt.procs, tt.source, quota, quota.Procs())
+			}
+		})
+	}
+}
+
+func TestMAXPROCSOptimizerDetectCPUQuotaInvalid(t *testing.T) {
+	mo := NewMAXPROCSOptimizer()
+	mo.cgroupFS = fstest.MapFS{
+		"proc/self/cgroup":      {Data: []byte("0::/\n")},
+		"sys/fs/cgroup/cpu.max": {Data: []byte("lots 100000\n")},
+	}
+
+	if _, _, err := mo.DetectCPUQuota(); err == nil {
+		t.Errorf("Expected error for malformed cpu.max")
+	}
+}
+
+func TestMAXPROCSOptimizerAutoSet(t *testing.T) {
+	if _, set := os.LookupEnv("GOMAXPROCS"); set {
+		t.Skip("GOMAXPROCS is set in the environment")
+	}
+
+	before := runtime.GOMAXPROCS(0)
+	mo := NewMAXPROCSOptimizer()
+	mo.cgroupFS = fstest.MapFS{
+		"proc/self/cgroup":      {Data: []byte("0::/\n")},
+		"sys/fs/cgroup/cpu.max": {Data: []byte("150000 100000\n")},
+	}
+
+	procs, undo, err := mo.AutoSet()
+	if err != nil {
+		t.Fatalf("AutoSet: %v", err)
+	}
+	if procs != 1 || runtime.GOMAXPROCS(0) != 1 {
+		t.Errorf("Expected GOMAXPROCS 1, got %d (reported %d)", runtime.GOMAXPROCS(0), procs)
+	}
+	undo()
+	if runtime.GOMAXPROCS(0) != before {
+		t.Errorf("Expected undo to restore %d, got %d", before, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestMAXPROCSOptimizerCompareQuotaAware(t *testing.T) {
+	mo := NewMAXPROCSOptimizer()
+	mo.cgroupFS = fstest.MapFS{
+		"proc/self/cgroup":      {Data: []byte("0::/\n")},
+		"sys/fs/cgroup/cpu.max": {Data: []byte("100000 100000\n")},
+	}
+
+	cmp, err := mo.CompareQuotaAware(func() {
+		sum := 0
+		for j := 0; j < 100000; j++ {
+			sum += j
+		}
+	})
+	if err != nil {
+		t.Fatalf("CompareQuotaAware: %v", err)
+	}
+	if !cmp.Limited || cmp.QuotaProcs != 1 || cmp.DefaultProcs != runtime.NumCPU() {
+		t.Errorf("Unexpected comparison: %+v", cmp)
+	}
+	if cmp.Default == 0 || cmp.QuotaAware == 0 {
+		t.Errorf("Expected both runs to be timed: %+v", cmp)
+	}
+}
+
 // TestAffinityScheduler tests goroutine affinity scheduling
 func TestAffinitySchedulerBasic(t *testing.T) {
 	sched := NewAffinityScheduler(4)
@@ -389,6 +1055,208 @@ func TestAffinitySchedulerUnderLoad(t *testing.T) {
 	}
 }
 
+func waitForProcessed(t *testing.T, sched *AffinityScheduler, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for sched.GetMetrics()["work_processed"].(int64) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d items, processed %d", want, sched.GetMetrics()["work_processed"])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAffinitySchedulerWorkStealing(t *testing.T) {
+	sched := NewAffinityScheduler(2)
+	defer sched.Stop()
+
+	// Block one worker, then queue work for both: the free worker must
+	// steal the blocked worker's share.
+	gate := make(chan struct{})
+	started := make(chan struct{})
+	sched.SubmitWork(AffinityWork{fn: func() {
+		close(started)
+		<-gate
+	}})
+	<-started
+
+	for i := 0; i < 100; i++ {
+		sched.SubmitWork(AffinityWork{fn: func() {}, affinity: i})
+	}
+	waitForProcessed(t, sched, 100)
+	close(gate)
+	waitForProcessed(t, sched, 101)
+
+	metrics := sched.GetMetrics()
+	if metrics["steals_successful"].(int64) < 50 {
+		t.Errorf("Expected at least 50 steals, got %d", metrics["steals_successful"])
+	}
+	if metrics["work_submitted"].(int64) != 101 {
+		t.Errorf("Expected 101 submitted, got %d", metrics["work_submitted"])
+	}
+}
+
+func TestAffinitySchedulerDrainsGlobalQueue(t *testing.T) {
+	sched := NewAffinityScheduler(2)
+	defer sched.Stop()
+
+	gate := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(2)
+	for i := 0; i < 2; i++ {
+		sched.SubmitWork(AffinityWork{fn: func() {
+			started.Done()
+			<-gate
+		}, affinity: i})
+	}
+	started.Wait()
+
+	// Both workers are busy and their queues hold 100 each, so the rest
+	// overflows to the global queue.
+	for i := 0; i < 250; i++ {
+		sched.SubmitWork(AffinityWork{fn: func() {}, affinity: i})
+	}
+	close(gate)
+	waitForProcessed(t, sched, 252)
+
+	metrics := sched.GetMetrics()
+	if metrics["global_queue_taken"].(int64) != 50 {
+		t.Errorf("Expected 50 items from the global queue, got %d", metrics["global_queue_taken"])
+	}
+	workerWork := metrics["worker_work"].(map[string]int64)
+	if workerWork["W0_work"]+workerWork["W1_work"] != 252 {
+		t.Errorf("Per-worker work does not add up: %v", workerWork)
+	}
+	if len(metrics["worker_throughput"].(map[string]float64)) != 2 {
+		t.Errorf("Expected throughput for 2 workers")
+	}
+}
+
+// blockGoroutines starts n goroutines that block until the returned func
+// releases them; it waits for them to exit so later tests start clean.
+func blockGoroutines(n int) (release func()) {
+	ch := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ch
+		}()
+	}
+	return func() {
+		close(ch)
+		wg.Wait()
+	}
+}
+
+func TestLeakDetectorCompare(t *testing.T) {
+	ld := NewLeakDetector()
+	before := ld.Snapshot()
+
+	release := blockGoroutines(5)
+	defer release()
+	time.Sleep(10 * time.Millisecond)
+	after := ld.Snapshot()
+
+	leaks := ld.Compare(before, after)
+	if len(leaks) != 1 {
+		t.Fatalf("Expected 1 growing group, got %+v", leaks)
+	}
+	leak := leaks[0]
+	if !strings.Contains(leak.Site, ".blockGoroutines main_test.go:") {
+		t.Errorf("Expected blockGoroutines creation site, got %q", leak.Site)
+	}
+	if leak.Growth != 5 {
+		t.Errorf("Expected growth 5, got %d", leak.Growth)
+	}
+	if after.Groups[leak.Site].States["chan receive"] != 5 {
+		t.Errorf("Expected 5 goroutines in chan receive, got %v", after.Groups[leak.Site].States)
+	}
+}
+
+func TestLeakDetectorGrowing(t *testing.T) {
+	ld := NewLeakDetector()
+	for i := 0; i < 3; i++ {
+		ld.Snapshot()
+		release := blockGoroutines(2)
+		defer release()
+		time.Sleep(10 * time.Millisecond)
+	}
+	ld.Snapshot()
+
+	growing := ld.Growing()
+	if len(growing) != 1 || growing[0].Growth != 6 {
+		t.Fatalf("Expected one group grown by 6, got %+v", growing)
+	}
+	if len(ld.Snapshots()) != 4 {
+		t.Errorf("Expected 4 snapshots, got %d", len(ld.Snapshots()))
+	}
+}
+
+func TestLeakDetectorIgnore(t *testing.T) {
+	ld := NewLeakDetector()
+	ld.Ignore("blockGoroutines")
+	before := ld.Snapshot()
+
+	release := blockGoroutines(3)
+	defer release()
+	time.Sleep(10 * time.Millisecond)
+
+	if leaks := ld.Compare(before, ld.Snapshot()); len(leaks) != 0 {
+		t.Errorf("Expected ignored goroutines to be skipped, got %+v", leaks)
+	}
+}
+
+type fakeT struct {
+	errors   []string
+	cleanups []func()
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Cleanup(fn func()) {
+	f.cleanups = append(f.cleanups, fn)
+}
+
+func (f *fakeT) finish() {
+	for i := len(f.cleanups) - 1; i >= 0; i-- {
+		f.cleanups[i]()
+	}
+}
+
+func TestAssertNoLeaks(t *testing.T) {
+	AssertNoLeaks(t)
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(done)
+	}()
+	<-done
+}
+
+func TestAssertNoLeaksReportsLeak(t *testing.T) {
+	oldGrace := leakGracePeriod
+	leakGracePeriod = 50 * time.Millisecond
+	defer func() { leakGracePeriod = oldGrace }()
+
+	ft := &fakeT{}
+	AssertNoLeaks(ft)
+
+	release := blockGoroutines(2)
+	ft.finish()
+	release()
+
+	if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "leaked 2 goroutine(s) created by") {
+		t.Errorf("Expected one leak error, got %q", ft.errors)
+	}
+}
+
 // Benchmark tests
 
 func BenchmarkGMPSimulator(b *testing.B) {
@@ -2,14 +2,31 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"maps"
 	"math"
 	"math/rand"
+	"net/http"
 	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,32 +38,43 @@ import (
 // ===== 1. Retry Policy & Backoff Strategy =====
 
 type RetryPolicy struct {
-	maxRetries      int
-	initialBackoff  time.Duration
-	maxBackoff      time.Duration
+	maxRetries     int
+	initialBackoff time.Duration
+	// throttleBackoff is the initial backoff after a throttling error such
+	// as SlowDown, giving an overloaded service more room to recover.
+	throttleBackoff   time.Duration
+	maxBackoff        time.Duration
 	backoffMultiplier float64
-	jitterFraction  float64
+	jitterFraction    float64
 }
 
 func NewRetryPolicy() *RetryPolicy {
 	return &RetryPolicy{
-		maxRetries:       3,
-		initialBackoff:   100 * time.Millisecond,
-		maxBackoff:       10 * time.Second,
+		maxRetries:        3,
+		initialBackoff:    100 * time.Millisecond,
+		throttleBackoff:   500 * time.Millisecond,
+		maxBackoff:        10 * time.Second,
 		backoffMultiplier: 2.0,
-		jitterFraction:   0.1,
+		jitterFraction:    0.1,
 	}
 }
 
 func (rp *RetryPolicy) GetBackoffDuration(attempt int) time.Duration {
-	backoff := time.Duration(float64(rp.initialBackoff.Nanoseconds()) * math.Pow(rp.backoffMultiplier, float64(attempt)))
-	if backoff > rp.maxBackoff {
-		backoff = rp.maxBackoff
-	}
+	return rp.backoff(rp.initialBackoff, attempt)
+}
+
+func (rp *RetryPolicy) GetThrottleBackoffDuration(attempt int) time.Duration {
+	return rp.backoff(rp.throttleBackoff, attempt)
+}
 
-	// Add jitter
-	jitterAmount := time.Duration(float64(backoff.Nanoseconds()) * rp.jitterFraction * rand.Float64())
-	return backoff + jitterAmount
+func (rp *RetryPolicy) backoff(initial time.Duration, attempt int) time.Duration {
+	// Cap in floating point so large attempts cannot overflow time.Duration
+	backoff := float64(initial.Nanoseconds()) * math.Pow(rp.backoffMultiplier, float64(attempt))
+	backoff = math.Min(backoff, float64(rp.maxBackoff.Nanoseconds()))
+
+	// Add jitter, keeping the result within maxBackoff
+	backoff += backoff * rp.jitterFraction * rand.Float64()
+	return min(time.Duration(backoff), rp.maxBackoff)
 }
 
 type RetryableError struct {
@@ -67,44 +95,360 @@ func NewPermanentError(code, message string) *RetryableError {
 	return &RetryableError{Code: code, Message: message, Transient: false}
 }
 
+// ===== 1a. Fault Injection =====
+
+// FaultRule describes a failure to inject. Service ("s3", "sqs", "lambda"
+// or "dynamodb"), Operation (the AWS API name, e.g. "PutObject",
+// "SendMessage", "Invoke") and Target (bucket, queue, function or table
+// name) narrow which calls it applies to; empty fields match anything.
+type FaultRule struct {
+	Service   string
+	Operation string
+	Target    string
+	// Probability of firing for a matching call; 0 means always.
+	Probability float64
+	// Skip lets the first Skip matching calls through untouched.
+	Skip int
+	// Count is how many times the rule fires before it is exhausted; 0
+	// means no limit.
+	Count int
+	// Latency is added before the call proceeds or fails.
+	Latency time.Duration
+	// Err is returned to the caller; nil injects latency only.
+	Err *RetryableError
+
+	matched int
+	fired   int
+}
+
+// FaultInjector holds the fault rules shared by the mocks. A nil
+// *FaultInjector injects nothing.
+type FaultInjector struct {
+	mu       sync.Mutex
+	rules    []*FaultRule
+	rand     *rand.Rand
+	injected int64
+}
+
+// NewFaultInjector returns an injector whose probabilistic rules are
+// driven by seed, so chaos tests are reproducible.
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (fi *FaultInjector) AddRule(rule FaultRule) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.rules = append(fi.rules, &rule)
+}
+
+func (fi *FaultInjector) Clear() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.rules = nil
+}
+
+// Injected returns how many faults have been injected.
+func (fi *FaultInjector) Injected() int64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.injected
+}
+
+// Inject applies the first rule that matches and fires for the call,
+// sleeping for its latency and returning a copy of its error.
+func (fi *FaultInjector) Inject(ctx context.Context, service, operation, target string) error {
+	if fi == nil {
+		return nil
+	}
+
+	fi.mu.Lock()
+	var rule *FaultRule
+	for _, r := range fi.rules {
+		if !r.matches(service, operation, target) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip || r.Count > 0 && r.fired >= r.Count {
+			continue
+		}
+		if r.Probability > 0 && fi.rand.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+		rule = r
+		break
+	}
+	if rule == nil {
+		fi.mu.Unlock()
+		return nil
+	}
+	fi.injected++
+	latency, ruleErr := rule.Latency, rule.Err
+	fi.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if ruleErr == nil {
+		return nil
+	}
+	err := *ruleErr
+	return &err
+}
+
+func (r *FaultRule) matches(service, operation, target string) bool {
+	return (r.Service == "" || r.Service == service) &&
+		(r.Operation == "" || r.Operation == operation) &&
+		(r.Target == "" || r.Target == target)
+}
+
+// ===== 1b. Request Recording =====
+
+// Call is one recorded request to a mock. Target is the bucket, queue,
+// function or table, and Params holds the main request parameters under
+// their AWS names, such as "Key", "MessageBody" or "Payload".
+type Call struct {
+	Service   string
+	Operation string
+	Target    string
+	Params    map[string]string
+	Time      time.Time
+}
+
+// TestingT is the part of testing.TB the assertion helpers use.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Recorder captures the calls made to every mock it is attached to with
+// SetRecorder, so tests can check interactions as well as end state.
+// Calls are recorded before fault injection, so retried and failed
+// attempts appear too. A nil Recorder records nothing.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []Call
+	clock Clock
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{clock: realClock{}}
+}
+
+// SetClock replaces the clock used for call timestamps. Call it before the
+// recorder is in use.
+func (r *Recorder) SetClock(clock Clock) {
+	r.clock = clock
+}
+
+func (r *Recorder) Record(service, operation, target string, params map[string]string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{
+		Service:   service,
+		Operation: operation,
+		Target:    target,
+		Params:    params,
+		Time:      r.clock.Now(),
+	})
+}
+
+// Calls returns the recorded calls in the order they were made.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.calls)
+}
+
+// Filter returns the calls matching service, operation and target; empty
+// arguments match anything.
+func (r *Recorder) Filter(service, operation, target string) []Call {
+	return r.Find(func(c Call) bool {
+		return (service == "" || c.Service == service) &&
+			(operation == "" || c.Operation == operation) &&
+			(target == "" || c.Target == target)
+	})
+}
+
+// Find returns the calls for which match returns true.
+func (r *Recorder) Find(match func(Call) bool) []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var found []Call
+	for _, c := range r.calls {
+		if match(c) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+func (r *Recorder) Count(service, operation, target string) int {
+	return len(r.Filter(service, operation, target))
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+// AssertCalled fails the test unless the operation was called at least once.
+func (r *Recorder) AssertCalled(t TestingT, service, operation, target string) bool {
+	t.Helper()
+	if r.Count(service, operation, target) == 0 {
+		t.Errorf("Expected a call to %s %s on %q, got none", service, operation, target)
+		return false
+	}
+	return true
+}
+
+func (r *Recorder) AssertNotCalled(t TestingT, service, operation, target string) bool {
+	t.Helper()
+	if n := r.Count(service, operation, target); n > 0 {
+		t.Errorf("Expected no calls to %s %s on %q, got %d", service, operation, target, n)
+		return false
+	}
+	return true
+}
+
+func (r *Recorder) AssertCallCount(t TestingT, service, operation, target string, want int) bool {
+	t.Helper()
+	if n := r.Count(service, operation, target); n != want {
+		t.Errorf("Expected %d calls to %s %s on %q, got %d", want, service, operation, target, n)
+		return false
+	}
+	return true
+}
+
+// AssertPutObject fails the test unless an object whose key starts with
+// keyPrefix was put to bucket.
+func (r *Recorder) AssertPutObject(t TestingT, bucket, keyPrefix string) bool {
+	t.Helper()
+	return r.assertParam(t, "s3", "PutObject", bucket, "Key", keyPrefix, strings.HasPrefix)
+}
+
+// AssertSentMessage fails the test unless a message whose body contains
+// substr was sent to queue.
+func (r *Recorder) AssertSentMessage(t TestingT, queue, substr string) bool {
+	t.Helper()
+	return r.assertParam(t, "sqs", "SendMessage", queue, "MessageBody", substr, strings.Contains)
+}
+
+// AssertInvoked fails the test unless function was invoked with a payload
+// containing substr.
+func (r *Recorder) AssertInvoked(t TestingT, function, substr string) bool {
+	t.Helper()
+	return r.assertParam(t, "lambda", "Invoke", function, "Payload", substr, strings.Contains)
+}
+
+func (r *Recorder) assertParam(t TestingT, service, operation, target, param, want string, match func(string, string) bool) bool {
+	t.Helper()
+	calls := r.Filter(service, operation, target)
+	for _, c := range calls {
+		if match(c.Params[param], want) {
+			return true
+		}
+	}
+
+	seen := make([]string, len(calls))
+	for i, c := range calls {
+		seen[i] = c.Params[param]
+	}
+	t.Errorf("Expected %s %s on %q with %s matching %q, got %q", service, operation, target, param, want, seen)
+	return false
+}
+
 // ===== 2. Mock S3 Service =====
 
 type MockS3Object struct {
-	Key      string
-	Data     []byte
-	Metadata map[string]string
-	ETag     string
-	Created  time.Time
-	Modified time.Time
+	Key            string
+	VersionID      string
+	IsDeleteMarker bool
+	Data           []byte
+	ContentType    string
+	Metadata       map[string]string
+	ETag           string
+	// ServerSideEncryption and SSEKMSKeyID record how the object would be
+	// encrypted at rest; the mock stores the data unencrypted.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	Created              time.Time
+	Modified             time.Time
 }
 
+// Bucket versioning states. A bucket starts unversioned and, once enabled,
+// can only be suspended, never returned to unversioned.
+const (
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+)
+
+// nullVersionID is the version ID of objects written while versioning is
+// not enabled.
+const nullVersionID = "null"
+
 type MockS3Bucket struct {
-	Name    string
-	Objects map[string]*MockS3Object
-	mu      sync.RWMutex
+	Name string
+	// Objects holds the current version of each key; keys whose latest
+	// version is a delete marker are absent.
+	Objects       map[string]*MockS3Object
+	Versioning    string
+	Lifecycle     []LifecycleRule
+	Notifications []QueueConfiguration
+	versions      map[string][]*MockS3Object // oldest first
+	mu            sync.RWMutex
 }
 
 type MockS3Service struct {
 	Buckets map[string]*MockS3Bucket
-	mu      sync.RWMutex
-	rp      *RetryPolicy
-	stats   *S3Stats
+	// MinPartSize is the smallest size allowed for every multipart part
+	// except the last one.
+	MinPartSize int
+	uploads     map[string]*MultipartUpload
+	signingKey  []byte
+	clock       Clock
+	faults      *FaultInjector
+	recorder    *Recorder
+	sqs         *MockSQSService
+	sequencer   uint64
+	mu          sync.RWMutex
+	rp          *RetryPolicy
+	stats       *S3Stats
 }
 
 type S3Stats struct {
-	PutCount     int64
-	GetCount     int64
-	DeleteCount  int64
-	ListCount    int64
-	PresignCount int64
-	Errors       int64
+	PutCount          int64
+	GetCount          int64
+	HeadCount         int64
+	DeleteCount       int64
+	ListCount         int64
+	PresignCount      int64
+	PartCount         int64
+	ExpiredCount      int64
+	NotificationCount int64
+	Errors            int64
 }
 
 func NewMockS3Service() *MockS3Service {
 	return &MockS3Service{
-		Buckets: make(map[string]*MockS3Bucket),
-		rp:      NewRetryPolicy(),
-		stats:   &S3Stats{},
+		Buckets:     make(map[string]*MockS3Bucket),
+		MinPartSize: 5 << 20,
+		uploads:     make(map[string]*MultipartUpload),
+		signingKey:  newSigningKey(),
+		clock:       realClock{},
+		rp:          NewRetryPolicy(),
+		stats:       &S3Stats{},
 	}
 }
 
@@ -117,41 +461,79 @@ func (m *MockS3Service) CreateBucket(bucketName string) error {
 	}
 
 	m.Buckets[bucketName] = &MockS3Bucket{
-		Name:    bucketName,
-		Objects: make(map[string]*MockS3Object),
+		Name:     bucketName,
+		Objects:  make(map[string]*MockS3Object),
+		versions: make(map[string][]*MockS3Object),
 	}
 	return nil
 }
 
-func (m *MockS3Service) PutObject(ctx context.Context, bucketName, key string, data []byte) error {
+func (m *MockS3Service) PutBucketVersioning(bucketName, status string) error {
+	if status != VersioningEnabled && status != VersioningSuspended {
+		return NewPermanentError("MalformedXML", "Versioning status must be Enabled or Suspended")
+	}
+
 	m.mu.RLock()
 	bucket, exists := m.Buckets[bucketName]
 	m.mu.RUnlock()
 
 	if !exists {
-		atomic.AddInt64(&m.stats.Errors, 1)
 		return NewPermanentError("NoSuchBucket", "Bucket does not exist")
 	}
 
 	bucket.mu.Lock()
-	defer bucket.mu.Unlock()
+	bucket.Versioning = status
+	bucket.mu.Unlock()
+	return nil
+}
 
-	etag := base64.StdEncoding.EncodeToString(generateETag(data))
+// GetBucketVersioning returns the bucket's versioning status, or "" if
+// versioning was never enabled.
+func (m *MockS3Service) GetBucketVersioning(bucketName string) (string, error) {
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
 
-	bucket.Objects[key] = &MockS3Object{
-		Key:      key,
-		Data:     data,
-		Metadata: make(map[string]string),
-		ETag:     etag,
-		Created:  time.Now(),
-		Modified: time.Now(),
+	if !exists {
+		return "", NewPermanentError("NoSuchBucket", "Bucket does not exist")
 	}
 
-	atomic.AddInt64(&m.stats.PutCount, 1)
-	return nil
+	bucket.mu.RLock()
+	defer bucket.mu.RUnlock()
+	return bucket.Versioning, nil
+}
+
+func (m *MockS3Service) PutObject(ctx context.Context, bucketName, key string, data []byte) error {
+	_, err := m.PutObjectVersion(ctx, bucketName, key, data)
+	return err
+}
+
+// PutObjectVersion is PutObject that also returns the new version ID, which
+// is "null" unless versioning is enabled on the bucket.
+func (m *MockS3Service) PutObjectVersion(ctx context.Context, bucketName, key string, data []byte) (string, error) {
+	out, err := m.PutObjectWithInput(ctx, bucketName, key, data, PutObjectInput{})
+	if err != nil {
+		return "", err
+	}
+	return out.VersionID, nil
 }
 
 func (m *MockS3Service) GetObject(ctx context.Context, bucketName, key string) ([]byte, error) {
+	out, err := m.GetObjectWithInput(ctx, bucketName, key, GetObjectInput{})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// GetObjectVersion returns a specific version of an object, including
+// noncurrent ones. Asking for a delete marker fails with MethodNotAllowed.
+func (m *MockS3Service) GetObjectVersion(ctx context.Context, bucketName, key, versionID string) ([]byte, error) {
+	m.recorder.Record("s3", "GetObject", bucketName, map[string]string{"Key": key, "VersionId": versionID})
+	if err := m.faults.Inject(ctx, "s3", "GetObject", bucketName); err != nil {
+		return nil, err
+	}
+
 	m.mu.RLock()
 	bucket, exists := m.Buckets[bucketName]
 	m.mu.RUnlock()
@@ -162,19 +544,31 @@ func (m *MockS3Service) GetObject(ctx context.Context, bucketName, key string) (
 	}
 
 	bucket.mu.RLock()
-	obj, exists := bucket.Objects[key]
+	obj, _ := bucket.findVersion(key, versionID)
 	bucket.mu.RUnlock()
 
-	if !exists {
+	if obj == nil {
 		atomic.AddInt64(&m.stats.Errors, 1)
-		return nil, NewPermanentError("NoSuchKey", "Object does not exist")
+		return nil, NewPermanentError("NoSuchVersion", "Version does not exist")
+	}
+	if obj.IsDeleteMarker {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("MethodNotAllowed", "Version is a delete marker")
 	}
 
 	atomic.AddInt64(&m.stats.GetCount, 1)
 	return obj.Data, nil
 }
 
+// DeleteObject removes the object from an unversioned bucket. In a
+// versioned bucket it adds a delete marker instead, hiding the object while
+// keeping its earlier versions.
 func (m *MockS3Service) DeleteObject(ctx context.Context, bucketName, key string) error {
+	m.recorder.Record("s3", "DeleteObject", bucketName, map[string]string{"Key": key})
+	if err := m.faults.Inject(ctx, "s3", "DeleteObject", bucketName); err != nil {
+		return err
+	}
+
 	m.mu.RLock()
 	bucket, exists := m.Buckets[bucketName]
 	m.mu.RUnlock()
@@ -187,397 +581,3679 @@ func (m *MockS3Service) DeleteObject(ctx context.Context, bucketName, key string
 	bucket.mu.Lock()
 	defer bucket.mu.Unlock()
 
-	if _, exists := bucket.Objects[key]; exists {
-		delete(bucket.Objects, key)
+	if marker := bucket.deleteCurrent(key, m.clock.Now()); marker != nil {
+		m.notify(ctx, bucket, "s3:ObjectRemoved:DeleteMarkerCreated", marker)
+	} else {
+		m.notify(ctx, bucket, "s3:ObjectRemoved:Delete", &MockS3Object{Key: key})
 	}
 
 	atomic.AddInt64(&m.stats.DeleteCount, 1)
 	return nil
 }
 
-func (m *MockS3Service) ListObjects(ctx context.Context, bucketName, prefix string) ([]string, error) {
+// DeleteObjectVersion permanently removes one version of an object. If it
+// was the latest version, the previous one becomes current again; deleting
+// a delete marker this way restores the object. Deleting a version that
+// does not exist succeeds, as it does in S3.
+func (m *MockS3Service) DeleteObjectVersion(ctx context.Context, bucketName, key, versionID string) error {
+	m.recorder.Record("s3", "DeleteObject", bucketName, map[string]string{"Key": key, "VersionId": versionID})
+	if err := m.faults.Inject(ctx, "s3", "DeleteObject", bucketName); err != nil {
+		return err
+	}
+
 	m.mu.RLock()
 	bucket, exists := m.Buckets[bucketName]
 	m.mu.RUnlock()
 
 	if !exists {
-		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return NewPermanentError("NoSuchBucket", "Bucket does not exist")
 	}
 
-	bucket.mu.RLock()
-	defer bucket.mu.RUnlock()
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
 
-	var keys []string
-	for key := range bucket.Objects {
-		if prefix == "" || len(key) >= len(prefix) && key[:len(prefix)] == prefix {
-			keys = append(keys, key)
-		}
+	if obj, i := bucket.findVersion(key, versionID); i >= 0 {
+		bucket.removeVersion(key, i)
+		m.notify(ctx, bucket, "s3:ObjectRemoved:Delete", obj)
 	}
 
-	atomic.AddInt64(&m.stats.ListCount, 1)
-	return keys, nil
+	atomic.AddInt64(&m.stats.DeleteCount, 1)
+	return nil
 }
 
-func (m *MockS3Service) GeneratePresignedURL(ctx context.Context, bucketName, key string, expiration time.Duration) (string, error) {
+type ObjectVersion struct {
+	Key            string
+	VersionID      string
+	IsLatest       bool
+	IsDeleteMarker bool
+	ETag           string
+	Size           int
+	LastModified   time.Time
+}
+
+// ListObjectVersions returns every version and delete marker under prefix,
+// sorted by key and then newest first.
+func (m *MockS3Service) ListObjectVersions(ctx context.Context, bucketName, prefix string) ([]ObjectVersion, error) {
+	m.recorder.Record("s3", "ListObjectVersions", bucketName, map[string]string{"Prefix": prefix})
+	if err := m.faults.Inject(ctx, "s3", "ListObjectVersions", bucketName); err != nil {
+		return nil, err
+	}
+
 	m.mu.RLock()
-	_, exists := m.Buckets[bucketName]
+	bucket, exists := m.Buckets[bucketName]
 	m.mu.RUnlock()
 
 	if !exists {
-		return "", NewPermanentError("NoSuchBucket", "Bucket does not exist")
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
 	}
 
-	// Generate a mock presigned URL
-	expiryTime := time.Now().Add(expiration).Unix()
-	query := url.Values{}
-	query.Set("X-Amz-Expires", "3600")
-	query.Set("X-Amz-Date", fmt.Sprintf("%d", time.Now().Unix()))
+	bucket.mu.RLock()
+	defer bucket.mu.RUnlock()
 
-	presignedURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s?%s&ExpirationTime=%d",
-		bucketName, key, query.Encode(), expiryTime)
+	var keys []string
+	for key := range bucket.versions {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var versions []ObjectVersion
+	for _, key := range keys {
+		history := bucket.versions[key]
+		for i := len(history) - 1; i >= 0; i-- {
+			obj := history[i]
+			versions = append(versions, ObjectVersion{
+				Key:            key,
+				VersionID:      obj.VersionID,
+				IsLatest:       i == len(history)-1,
+				IsDeleteMarker: obj.IsDeleteMarker,
+				ETag:           obj.ETag,
+				Size:           len(obj.Data),
+				LastModified:   obj.Modified,
+			})
+		}
+	}
 
-	atomic.AddInt64(&m.stats.PresignCount, 1)
-	return presignedURL, nil
+	atomic.AddInt64(&m.stats.ListCount, 1)
+	return versions, nil
 }
 
-// ===== 3. S3 Client with Retry Logic =====
-
-type S3Client struct {
-	service *MockS3Service
-	rp      *RetryPolicy
-	stats   *RetryStats
-}
+// putVersion records obj as the latest version of its key and assigns its
+// version ID. Unless versioning is enabled, it replaces any existing "null"
+// version. Must be called with b.mu held.
+func (b *MockS3Bucket) putVersion(obj *MockS3Object) *MockS3Object {
+	if b.Versioning == VersioningEnabled {
+		obj.VersionID = generateVersionID()
+	} else {
+		obj.VersionID = nullVersionID
+		if _, i := b.findVersion(obj.Key, nullVersionID); i >= 0 {
+			b.versions[obj.Key] = append(b.versions[obj.Key][:i:i], b.versions[obj.Key][i+1:]...)
+		}
+	}
 
-type RetryStats struct {
-	Attempts    int64
-	Successes   int64
-	Failures    int64
-	Retries     int64
-	TotalTime   time.Duration
+	b.versions[obj.Key] = append(b.versions[obj.Key], obj)
+	b.syncCurrent(obj.Key)
+	return obj
 }
 
-func NewS3Client(service *MockS3Service) *S3Client {
-	return &S3Client{
-		service: service,
-		rp:      NewRetryPolicy(),
-		stats:   &RetryStats{},
+// deleteCurrent removes key from an unversioned bucket or adds a delete
+// marker for it in a versioned one, returning the marker. Must be called
+// with b.mu held.
+func (b *MockS3Bucket) deleteCurrent(key string, now time.Time) *MockS3Object {
+	if b.Versioning == "" {
+		delete(b.versions, key)
+		b.syncCurrent(key)
+		return nil
 	}
-}
 
-func (c *S3Client) PutObjectWithRetry(ctx context.Context, bucketName, key string, data []byte) error {
-	atomic.AddInt64(&c.stats.Attempts, 1)
-	start := time.Now()
-	defer func() { c.stats.TotalTime += time.Since(start) }()
+	return b.putVersion(&MockS3Object{
+		Key:            key,
+		IsDeleteMarker: true,
+		Created:        now,
+		Modified:       now,
+	})
+}
 
-	for attempt := 0; attempt <= c.rp.maxRetries; attempt++ {
-		err := c.service.PutObject(ctx, bucketName, key, data)
-		if err == nil {
-			atomic.AddInt64(&c.stats.Successes, 1)
-			return nil
+// findVersion must be called with b.mu held.
+func (b *MockS3Bucket) findVersion(key, versionID string) (*MockS3Object, int) {
+	for i, obj := range b.versions[key] {
+		if obj.VersionID == versionID {
+			return obj, i
 		}
+	}
+	return nil, -1
+}
 
-		if retErr, ok := err.(*RetryableError); ok && !retErr.Transient {
-			atomic.AddInt64(&c.stats.Failures, 1)
-			return err
-		}
+// removeVersion must be called with b.mu held.
+func (b *MockS3Bucket) removeVersion(key string, i int) {
+	history := b.versions[key]
+	b.versions[key] = append(history[:i:i], history[i+1:]...)
+	b.syncCurrent(key)
+}
 
-		if attempt < c.rp.maxRetries {
-			atomic.AddInt64(&c.stats.Retries, 1)
-			backoff := c.rp.GetBackoffDuration(attempt)
-			select {
-			case <-time.After(backoff):
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+// syncCurrent points Objects at the latest version of key, or removes the
+// key when there is none or it is a delete marker.
+func (b *MockS3Bucket) syncCurrent(key string) {
+	history := b.versions[key]
+	if len(history) == 0 {
+		delete(b.versions, key)
+		delete(b.Objects, key)
+		return
 	}
 
-	atomic.AddInt64(&c.stats.Failures, 1)
-	return NewTransientError("MaxRetriesExceeded", "Maximum retries exceeded")
+	if latest := history[len(history)-1]; latest.IsDeleteMarker {
+		delete(b.Objects, key)
+	} else {
+		b.Objects[key] = latest
+	}
 }
 
-func (c *S3Client) GetObjectWithRetry(ctx context.Context, bucketName, key string) ([]byte, error) {
-	atomic.AddInt64(&c.stats.Attempts, 1)
-	start := time.Now()
-	defer func() { c.stats.TotalTime += time.Since(start) }()
+func (m *MockS3Service) ListObjects(ctx context.Context, bucketName, prefix string) ([]string, error) {
+	m.recorder.Record("s3", "ListObjects", bucketName, map[string]string{"Prefix": prefix})
+	if err := m.faults.Inject(ctx, "s3", "ListObjects", bucketName); err != nil {
+		return nil, err
+	}
 
-	for attempt := 0; attempt <= c.rp.maxRetries; attempt++ {
-		data, err := c.service.GetObject(ctx, bucketName, key)
-		if err == nil {
-			atomic.AddInt64(&c.stats.Successes, 1)
-			return data, nil
-		}
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
 
-		if retErr, ok := err.(*RetryableError); ok && !retErr.Transient {
-			atomic.AddInt64(&c.stats.Failures, 1)
-			return nil, err
-		}
+	if !exists {
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
 
-		if attempt < c.rp.maxRetries {
-			atomic.AddInt64(&c.stats.Retries, 1)
-			backoff := c.rp.GetBackoffDuration(attempt)
-			select {
-			case <-time.After(backoff):
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			}
+	bucket.mu.RLock()
+	defer bucket.mu.RUnlock()
+
+	var keys []string
+	for key := range bucket.Objects {
+		if prefix == "" || len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
 
-	atomic.AddInt64(&c.stats.Failures, 1)
-	return nil, NewTransientError("MaxRetriesExceeded", "Maximum retries exceeded")
+	atomic.AddInt64(&m.stats.ListCount, 1)
+	return keys, nil
 }
 
-// ===== 4. Mock SQS Service =====
+const maxListKeys = 1000
+
+type ListObjectsV2Input struct {
+	Prefix    string
+	Delimiter string
+	// MaxKeys caps Contents plus CommonPrefixes; 0 means 1000.
+	MaxKeys           int
+	ContinuationToken string
+	StartAfter        string
+}
+
+type ObjectSummary struct {
+	Key          string
+	ETag         string
+	Size         int
+	LastModified time.Time
+}
+
+type ListObjectsV2Output struct {
+	Contents              []ObjectSummary
+	CommonPrefixes        []string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// ListObjectsV2 lists current objects in lexicographic key order. With a
+// Delimiter, keys sharing the part of the key after Prefix up to the
+// delimiter are rolled up into one CommonPrefixes entry. When more results
+// remain, IsTruncated is set and NextContinuationToken resumes the listing.
+func (m *MockS3Service) ListObjectsV2(ctx context.Context, bucketName string, input ListObjectsV2Input) (*ListObjectsV2Output, error) {
+	m.recorder.Record("s3", "ListObjectsV2", bucketName, map[string]string{"Prefix": input.Prefix, "Delimiter": input.Delimiter})
+	if err := m.faults.Inject(ctx, "s3", "ListObjectsV2", bucketName); err != nil {
+		return nil, err
+	}
+
+	maxKeys := input.MaxKeys
+	if maxKeys <= 0 || maxKeys > maxListKeys {
+		maxKeys = maxListKeys
+	}
+
+	// Entries at or before the marker were returned on earlier pages. A
+	// token records whether the last entry was a key or a common prefix, as
+	// every key under a returned prefix must be skipped too.
+	marker, skipPrefix := input.StartAfter, ""
+	if input.ContinuationToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(input.ContinuationToken)
+		if err != nil || len(decoded) == 0 || decoded[0] != 'k' && decoded[0] != 'p' {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return nil, NewPermanentError("InvalidArgument", "The continuation token provided is incorrect")
+		}
+		marker = string(decoded[1:])
+		if decoded[0] == 'p' {
+			skipPrefix = marker
+		}
+	}
+
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	bucket.mu.RLock()
+	keys := make([]string, 0, len(bucket.Objects))
+	for key := range bucket.Objects {
+		if strings.HasPrefix(key, input.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &ListObjectsV2Output{}
+	last, lastKind := "", byte('k')
+	for _, key := range keys {
+		if key <= marker || skipPrefix != "" && strings.HasPrefix(key, skipPrefix) {
+			continue
+		}
+
+		entry, kind := key, byte('k')
+		if input.Delimiter != "" {
+			if i := strings.Index(key[len(input.Prefix):], input.Delimiter); i >= 0 {
+				entry, kind = key[:len(input.Prefix)+i+len(input.Delimiter)], 'p'
+			}
+		}
+		if kind == 'p' && lastKind == 'p' && entry == last {
+			continue
+		}
+
+		if out.KeyCount == maxKeys {
+			out.IsTruncated = true
+			out.NextContinuationToken = base64.RawURLEncoding.EncodeToString(append([]byte{lastKind}, last...))
+			break
+		}
+
+		if kind == 'k' {
+			obj := bucket.Objects[key]
+			out.Contents = append(out.Contents, ObjectSummary{
+				Key:          key,
+				ETag:         obj.ETag,
+				Size:         len(obj.Data),
+				LastModified: obj.Modified,
+			})
+		} else {
+			out.CommonPrefixes = append(out.CommonPrefixes, entry)
+		}
+		out.KeyCount++
+		last, lastKind = entry, kind
+	}
+	bucket.mu.RUnlock()
+
+	atomic.AddInt64(&m.stats.ListCount, 1)
+	return out, nil
+}
+
+// GeneratePresignedURL returns a presigned GET URL for the object. See
+// PresignURL.
+func (m *MockS3Service) GeneratePresignedURL(ctx context.Context, bucketName, key string, expiration time.Duration) (string, error) {
+	return m.PresignURL(ctx, http.MethodGet, bucketName, key, expiration)
+}
+
+// ===== 2a. S3 Multipart Uploads =====
+
+const maxPartNumber = 10000
+
+type MultipartUpload struct {
+	UploadID  string
+	Bucket    string
+	Key       string
+	Initiated time.Time
+	parts     map[int]*uploadedPart
+}
+
+type uploadedPart struct {
+	data []byte
+	sum  []byte
+	etag string
+}
+
+// CompletedPart identifies an uploaded part in CompleteMultipartUpload.
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (m *MockS3Service) CreateMultipartUpload(ctx context.Context, bucketName, key string) (string, error) {
+	m.recorder.Record("s3", "CreateMultipartUpload", bucketName, map[string]string{"Key": key})
+	if err := m.faults.Inject(ctx, "s3", "CreateMultipartUpload", bucketName); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.Buckets[bucketName]; !exists {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return "", NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	uploadID := generateUploadID()
+	m.uploads[uploadID] = &MultipartUpload{
+		UploadID:  uploadID,
+		Bucket:    bucketName,
+		Key:       key,
+		Initiated: m.clock.Now(),
+		parts:     make(map[int]*uploadedPart),
+	}
+	return uploadID, nil
+}
+
+// UploadPart stores one part of an upload and returns its ETag. Uploading
+// the same part number again replaces the earlier part.
+func (m *MockS3Service) UploadPart(ctx context.Context, bucketName, key, uploadID string, partNumber int, data []byte) (string, error) {
+	m.recorder.Record("s3", "UploadPart", bucketName, map[string]string{"Key": key, "UploadId": uploadID, "PartNumber": strconv.Itoa(partNumber)})
+	if err := m.faults.Inject(ctx, "s3", "UploadPart", bucketName); err != nil {
+		return "", err
+	}
+
+	if partNumber < 1 || partNumber > maxPartNumber {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return "", NewPermanentError("InvalidArgument", fmt.Sprintf("Part number must be between 1 and %d", maxPartNumber))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.lookupUpload(bucketName, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	sum := generateETag(data)
+	part := &uploadedPart{
+		data: append([]byte(nil), data...),
+		sum:  sum,
+		etag: base64.StdEncoding.EncodeToString(sum),
+	}
+	upload.parts[partNumber] = part
+
+	atomic.AddInt64(&m.stats.PartCount, 1)
+	return part.etag, nil
+}
+
+// CompleteMultipartUpload assembles the listed parts into an object. Parts
+// must be in ascending order, match the ETags returned by UploadPart and,
+// apart from the last one, be at least MinPartSize bytes. The object's ETag
+// is the hash of the part hashes followed by "-<number of parts>".
+func (m *MockS3Service) CompleteMultipartUpload(ctx context.Context, bucketName, key, uploadID string, parts []CompletedPart) (string, error) {
+	m.recorder.Record("s3", "CompleteMultipartUpload", bucketName, map[string]string{"Key": key, "UploadId": uploadID})
+	if err := m.faults.Inject(ctx, "s3", "CompleteMultipartUpload", bucketName); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.lookupUpload(bucketName, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(parts) == 0 {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return "", NewPermanentError("MalformedXML", "At least one part must be specified")
+	}
+
+	var data, sums bytes.Buffer
+	for i, p := range parts {
+		if i > 0 && p.PartNumber <= parts[i-1].PartNumber {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return "", NewPermanentError("InvalidPartOrder", "Parts must be listed in ascending order")
+		}
+
+		part, exists := upload.parts[p.PartNumber]
+		if !exists || part.etag != p.ETag {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return "", NewPermanentError("InvalidPart", fmt.Sprintf("Part %d not found or ETag mismatch", p.PartNumber))
+		}
+
+		if i < len(parts)-1 && len(part.data) < m.MinPartSize {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return "", NewPermanentError("EntityTooSmall", fmt.Sprintf("Part %d is smaller than the minimum allowed size", p.PartNumber))
+		}
+
+		data.Write(part.data)
+		sums.Write(part.sum)
+	}
+
+	etag := fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(generateETag(sums.Bytes())), len(parts))
+	now := m.clock.Now()
+
+	bucket := m.Buckets[bucketName]
+	bucket.mu.Lock()
+	obj := bucket.putVersion(&MockS3Object{
+		Key:                  key,
+		Data:                 data.Bytes(),
+		ContentType:          defaultContentType,
+		Metadata:             make(map[string]string),
+		ETag:                 etag,
+		ServerSideEncryption: SSEAlgorithmAES256,
+		Created:              now,
+		Modified:             now,
+	})
+	m.notify(ctx, bucket, "s3:ObjectCreated:CompleteMultipartUpload", obj)
+	bucket.mu.Unlock()
+
+	delete(m.uploads, uploadID)
+	atomic.AddInt64(&m.stats.PutCount, 1)
+	return etag, nil
+}
+
+func (m *MockS3Service) AbortMultipartUpload(ctx context.Context, bucketName, key, uploadID string) error {
+	m.recorder.Record("s3", "AbortMultipartUpload", bucketName, map[string]string{"Key": key, "UploadId": uploadID})
+	if err := m.faults.Inject(ctx, "s3", "AbortMultipartUpload", bucketName); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.lookupUpload(bucketName, key, uploadID); err != nil {
+		return err
+	}
+
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+// ListMultipartUploads returns copies of the uploads in a bucket that have
+// been neither completed nor aborted. Like S3's listing, the copies don't
+// carry the uploaded parts.
+func (m *MockS3Service) ListMultipartUploads(ctx context.Context, bucketName string) []*MultipartUpload {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var uploads []*MultipartUpload
+	for _, upload := range m.uploads {
+		if upload.Bucket == bucketName {
+			uploads = append(uploads, &MultipartUpload{
+				UploadID:  upload.UploadID,
+				Bucket:    upload.Bucket,
+				Key:       upload.Key,
+				Initiated: upload.Initiated,
+			})
+		}
+	}
+	return uploads
+}
+
+// lookupUpload must be called with m.mu held.
+func (m *MockS3Service) lookupUpload(bucketName, key, uploadID string) (*MultipartUpload, error) {
+	upload, exists := m.uploads[uploadID]
+	if !exists || upload.Bucket != bucketName || upload.Key != key {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("NoSuchUpload", "Upload does not exist")
+	}
+	return upload, nil
+}
+
+// ===== 2b. S3 Lifecycle Rules =====
+
+// LifecycleRule expires objects under Prefix. ExpirationDays applies to
+// current versions: they are deleted, or hidden behind a delete marker in a
+// versioned bucket. NoncurrentVersionExpirationDays permanently removes
+// versions that many days after they were superseded. Zero disables an
+// action.
+type LifecycleRule struct {
+	ID                              string
+	Prefix                          string
+	ExpirationDays                  int
+	NoncurrentVersionExpirationDays int
+}
+
+func (m *MockS3Service) PutBucketLifecycleConfiguration(bucketName string, rules []LifecycleRule) error {
+	ids := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.ExpirationDays < 0 || rule.NoncurrentVersionExpirationDays < 0 {
+			return NewPermanentError("InvalidArgument", fmt.Sprintf("Rule %q: days must not be negative", rule.ID))
+		}
+		if rule.ExpirationDays == 0 && rule.NoncurrentVersionExpirationDays == 0 {
+			return NewPermanentError("InvalidRequest", fmt.Sprintf("Rule %q has no expiration action", rule.ID))
+		}
+		if rule.ID != "" && ids[rule.ID] {
+			return NewPermanentError("InvalidArgument", fmt.Sprintf("Duplicate rule ID %q", rule.ID))
+		}
+		ids[rule.ID] = true
+	}
+
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		return NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	bucket.mu.Lock()
+	bucket.Lifecycle = append([]LifecycleRule(nil), rules...)
+	bucket.mu.Unlock()
+	return nil
+}
+
+func (m *MockS3Service) GetBucketLifecycleConfiguration(bucketName string) ([]LifecycleRule, error) {
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	bucket.mu.RLock()
+	defer bucket.mu.RUnlock()
+
+	if len(bucket.Lifecycle) == 0 {
+		return nil, NewPermanentError("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist")
+	}
+	return append([]LifecycleRule(nil), bucket.Lifecycle...), nil
+}
+
+// SetClock replaces the clock used for timestamps and lifecycle expiry. Call
+// it before the service is in use.
+func (m *MockS3Service) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+// ApplyLifecycle runs one expiry pass over every bucket and returns the
+// number of objects and versions it expired.
+func (m *MockS3Service) ApplyLifecycle(ctx context.Context) int {
+	m.mu.RLock()
+	now := m.clock.Now()
+	buckets := make([]*MockS3Bucket, 0, len(m.Buckets))
+	for _, bucket := range m.Buckets {
+		buckets = append(buckets, bucket)
+	}
+	m.mu.RUnlock()
+
+	expired := 0
+	for _, bucket := range buckets {
+		bucket.mu.Lock()
+		for _, rule := range bucket.Lifecycle {
+			expired += bucket.applyRule(rule, now)
+		}
+		bucket.mu.Unlock()
+	}
+
+	atomic.AddInt64(&m.stats.ExpiredCount, int64(expired))
+	return expired
+}
+
+// StartLifecycle calls ApplyLifecycle every interval until ctx is done.
+func (m *MockS3Service) StartLifecycle(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.ApplyLifecycle(ctx)
+		}
+	}
+}
+
+// applyRule must be called with b.mu held.
+func (b *MockS3Bucket) applyRule(rule LifecycleRule, now time.Time) int {
+	const day = 24 * time.Hour
+	expired := 0
+
+	for key, history := range b.versions {
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+
+		if days := rule.NoncurrentVersionExpirationDays; days > 0 {
+			// A version becomes noncurrent when the next one is written
+			kept := history[:0:0]
+			for i, obj := range history {
+				if i < len(history)-1 && !now.Before(history[i+1].Created.Add(time.Duration(days)*day)) {
+					expired++
+					continue
+				}
+				kept = append(kept, obj)
+			}
+			b.versions[key] = kept
+			b.syncCurrent(key)
+		}
+
+		if days := rule.ExpirationDays; days > 0 {
+			if obj, ok := b.Objects[key]; ok && !now.Before(obj.Created.Add(time.Duration(days)*day)) {
+				b.deleteCurrent(key, now)
+				expired++
+			}
+		}
+	}
+	return expired
+}
+
+// ===== 2c. S3 Event Notifications =====
+
+const mockRegion = "us-east-1"
+
+// QueueConfiguration sends events matching Events (e.g. "s3:ObjectCreated:*"
+// or "s3:ObjectRemoved:Delete") for keys with the given prefix and suffix to
+// an SQS queue.
+type QueueConfiguration struct {
+	ID           string
+	Queue        string
+	Events       []string
+	FilterPrefix string
+	FilterSuffix string
+}
+
+func (qc QueueConfiguration) matches(eventName, key string) bool {
+	if !strings.HasPrefix(key, qc.FilterPrefix) || !strings.HasSuffix(key, qc.FilterSuffix) {
+		return false
+	}
+	for _, event := range qc.Events {
+		if event == eventName || strings.HasSuffix(event, ":*") && strings.HasPrefix(eventName, event[:len(event)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+var s3EventTypes = []string{
+	"s3:ObjectCreated:*",
+	"s3:ObjectCreated:Put",
+	"s3:ObjectCreated:CompleteMultipartUpload",
+	"s3:ObjectRemoved:*",
+	"s3:ObjectRemoved:Delete",
+	"s3:ObjectRemoved:DeleteMarkerCreated",
+}
+
+// S3EventNotification is the message body S3 delivers to SQS.
+type S3EventNotification struct {
+	Records []S3EventRecord `json:"Records"`
+}
+
+type S3EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AWSRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      S3UserIdentity    `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                S3EventEntity     `json:"s3"`
+}
+
+type S3UserIdentity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type S3EventEntity struct {
+	SchemaVersion   string        `json:"s3SchemaVersion"`
+	ConfigurationID string        `json:"configurationId"`
+	Bucket          S3EventBucket `json:"bucket"`
+	Object          S3EventObject `json:"object"`
+}
+
+type S3EventBucket struct {
+	Name          string         `json:"name"`
+	OwnerIdentity S3UserIdentity `json:"ownerIdentity"`
+	ARN           string         `json:"arn"`
+}
+
+type S3EventObject struct {
+	// Key is URL-encoded, as in real notifications.
+	Key       string `json:"key"`
+	Size      int    `json:"size,omitempty"`
+	ETag      string `json:"eTag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// SetFaultInjector makes the service consult fi before each operation.
+// Call it before the service is in use.
+func (m *MockS3Service) SetFaultInjector(fi *FaultInjector) {
+	m.faults = fi
+}
+
+// SetRecorder makes the service record every call in r. Call it before the
+// service is in use.
+func (m *MockS3Service) SetRecorder(r *Recorder) {
+	m.recorder = r
+}
+
+// ConnectSQS sets the service that receives event notifications. Call it
+// before the service is in use.
+func (m *MockS3Service) ConnectSQS(sqs *MockSQSService) {
+	m.sqs = sqs
+}
+
+// PutBucketNotificationConfiguration replaces the bucket's notification
+// configuration. Every queue must exist on the connected SQS service.
+func (m *MockS3Service) PutBucketNotificationConfiguration(bucketName string, configs []QueueConfiguration) error {
+	for _, qc := range configs {
+		if len(qc.Events) == 0 {
+			return NewPermanentError("InvalidArgument", fmt.Sprintf("Configuration %q has no events", qc.ID))
+		}
+		for _, event := range qc.Events {
+			if !slices.Contains(s3EventTypes, event) {
+				return NewPermanentError("InvalidArgument", fmt.Sprintf("Unsupported event %q", event))
+			}
+		}
+		if m.sqs == nil || !m.sqs.queueExists(qc.Queue) {
+			return NewPermanentError("InvalidArgument", fmt.Sprintf("Unable to validate destination queue %q", qc.Queue))
+		}
+	}
+
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		return NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	bucket.mu.Lock()
+	bucket.Notifications = append([]QueueConfiguration(nil), configs...)
+	bucket.mu.Unlock()
+	return nil
+}
+
+// notify publishes eventName for obj to every matching queue. Failed
+// deliveries do not fail the request that caused them. Must be called with
+// b.mu held.
+func (m *MockS3Service) notify(ctx context.Context, b *MockS3Bucket, eventName string, obj *MockS3Object) {
+	if m.sqs == nil || len(b.Notifications) == 0 {
+		return
+	}
+
+	object := S3EventObject{
+		Key:       url.QueryEscape(obj.Key),
+		Sequencer: fmt.Sprintf("%016X", atomic.AddUint64(&m.sequencer, 1)),
+	}
+	if obj.VersionID != nullVersionID {
+		object.VersionID = obj.VersionID
+	}
+	if strings.HasPrefix(eventName, "s3:ObjectCreated:") {
+		object.Size = len(obj.Data)
+		object.ETag = obj.ETag
+	}
+
+	for _, qc := range b.Notifications {
+		if !qc.matches(eventName, obj.Key) {
+			continue
+		}
+
+		body, err := json.Marshal(S3EventNotification{Records: []S3EventRecord{{
+			EventVersion:      "2.1",
+			EventSource:       "aws:s3",
+			AWSRegion:         mockRegion,
+			EventTime:         m.clock.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			EventName:         strings.TrimPrefix(eventName, "s3:"),
+			UserIdentity:      S3UserIdentity{PrincipalID: "mock"},
+			RequestParameters: map[string]string{"sourceIPAddress": "127.0.0.1"},
+			ResponseElements:  map[string]string{"x-amz-request-id": object.Sequencer},
+			S3: S3EventEntity{
+				SchemaVersion:   "1.0",
+				ConfigurationID: qc.ID,
+				Bucket: S3EventBucket{
+					Name:          b.Name,
+					OwnerIdentity: S3UserIdentity{PrincipalID: "mock"},
+					ARN:           "arn:aws:s3:::" + b.Name,
+				},
+				Object: object,
+			},
+		}}})
+		if err != nil {
+			continue
+		}
+
+		if _, err := m.sqs.PublishMessage(ctx, qc.Queue, string(body), nil); err == nil {
+			atomic.AddInt64(&m.stats.NotificationCount, 1)
+		}
+	}
+}
+
+// ===== 2d. Object Metadata & Conditional Requests =====
+
+// defaultContentType is what S3 stores when a put has no Content-Type.
+const defaultContentType = "binary/octet-stream"
+
+// maxMetadataSize is the limit on user metadata, counting the bytes of
+// every key and value.
+const maxMetadataSize = 2 << 10
+
+// PutObjectInput holds the optional headers of a put. IfMatch makes the put
+// conditional on the current ETag, for optimistic updates; IfNoneMatch "*"
+// only writes the object if the key does not exist yet.
+type PutObjectInput struct {
+	ContentType string
+	Metadata    map[string]string
+	IfMatch     string
+	IfNoneMatch string
+	// ServerSideEncryption is SSEAlgorithmAES256 (the default) or
+	// SSEAlgorithmKMS. SSEKMSKeyID defaults to the aws/s3 managed key.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+}
+
+type PutObjectOutput struct {
+	ETag      string
+	VersionID string
+}
+
+// GetObjectInput holds the conditional headers of a get or head request.
+type GetObjectInput struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+type HeadObjectOutput struct {
+	ContentLength int64
+	ContentType   string
+	ETag          string
+	LastModified  time.Time
+	Metadata      map[string]string
+	VersionID     string
+	// ServerSideEncryption and SSEKMSKeyID are as stored on the object.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+}
+
+type GetObjectOutput struct {
+	HeadObjectOutput
+	Body []byte
+}
+
+// PutObjectWithInput stores data with a content type and user metadata.
+// Metadata keys are case-insensitive and stored in lower case. A failed
+// If-Match or If-None-Match check returns PreconditionFailed, and If-Match
+// on a missing key returns NoSuchKey.
+func (m *MockS3Service) PutObjectWithInput(ctx context.Context, bucketName, key string, data []byte, input PutObjectInput) (*PutObjectOutput, error) {
+	m.recorder.Record("s3", "PutObject", bucketName, map[string]string{"Key": key, "ContentLength": strconv.Itoa(len(data))})
+	if err := m.faults.Inject(ctx, "s3", "PutObject", bucketName); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	metadata := make(map[string]string, len(input.Metadata))
+	size := 0
+	for k, v := range input.Metadata {
+		metadata[strings.ToLower(k)] = v
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("MetadataTooLarge", "User metadata exceeds the maximum allowed size")
+	}
+
+	contentType := input.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	sse, kmsKeyID, err := resolveSSE(input.ServerSideEncryption, input.SSEKMSKeyID)
+	if err != nil {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, err
+	}
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	current := bucket.Objects[key]
+	if input.IfMatch != "" {
+		if current == nil {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return nil, NewPermanentError("NoSuchKey", "Object does not exist")
+		}
+		if !etagMatches(input.IfMatch, current.ETag) {
+			atomic.AddInt64(&m.stats.Errors, 1)
+			return nil, NewPermanentError("PreconditionFailed", "If-Match condition failed")
+		}
+	}
+	if input.IfNoneMatch != "" && current != nil && etagMatches(input.IfNoneMatch, current.ETag) {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("PreconditionFailed", "If-None-Match condition failed")
+	}
+
+	etag := base64.StdEncoding.EncodeToString(generateETag(data))
+	now := m.clock.Now()
+
+	obj := bucket.putVersion(&MockS3Object{
+		Key:                  key,
+		Data:                 data,
+		ContentType:          contentType,
+		Metadata:             metadata,
+		ETag:                 etag,
+		ServerSideEncryption: sse,
+		SSEKMSKeyID:          kmsKeyID,
+		Created:              now,
+		Modified:             now,
+	})
+	m.notify(ctx, bucket, "s3:ObjectCreated:Put", obj)
+
+	atomic.AddInt64(&m.stats.PutCount, 1)
+	return &PutObjectOutput{ETag: obj.ETag, VersionID: obj.VersionID}, nil
+}
+
+// GetObjectWithInput returns the object with its metadata. A failed
+// If-Match check returns PreconditionFailed; a matching If-None-Match
+// returns NotModified, as S3 answers 304 rather than 412 for reads.
+func (m *MockS3Service) GetObjectWithInput(ctx context.Context, bucketName, key string, input GetObjectInput) (*GetObjectOutput, error) {
+	m.recorder.Record("s3", "GetObject", bucketName, map[string]string{"Key": key})
+	if err := m.faults.Inject(ctx, "s3", "GetObject", bucketName); err != nil {
+		return nil, err
+	}
+
+	obj, err := m.lookupObject(bucketName, key, input)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&m.stats.GetCount, 1)
+	return &GetObjectOutput{HeadObjectOutput: obj.head(), Body: obj.Data}, nil
+}
+
+// HeadObject returns an object's metadata without its body. It accepts
+// the same conditions as GetObjectWithInput.
+func (m *MockS3Service) HeadObject(ctx context.Context, bucketName, key string, input GetObjectInput) (*HeadObjectOutput, error) {
+	m.recorder.Record("s3", "HeadObject", bucketName, map[string]string{"Key": key})
+	if err := m.faults.Inject(ctx, "s3", "HeadObject", bucketName); err != nil {
+		return nil, err
+	}
+
+	obj, err := m.lookupObject(bucketName, key, input)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&m.stats.HeadCount, 1)
+	head := obj.head()
+	return &head, nil
+}
+
+// lookupObject finds the current version of key and checks the read
+// conditions against it.
+func (m *MockS3Service) lookupObject(bucketName, key string, input GetObjectInput) (*MockS3Object, error) {
+	m.mu.RLock()
+	bucket, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+
+	bucket.mu.RLock()
+	obj, exists := bucket.Objects[key]
+	bucket.mu.RUnlock()
+
+	switch {
+	case !exists:
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("NoSuchKey", "Object does not exist")
+	case input.IfMatch != "" && !etagMatches(input.IfMatch, obj.ETag):
+		atomic.AddInt64(&m.stats.Errors, 1)
+		return nil, NewPermanentError("PreconditionFailed", "If-Match condition failed")
+	case input.IfNoneMatch != "" && etagMatches(input.IfNoneMatch, obj.ETag):
+		return nil, NewPermanentError("NotModified", "Object has not been modified")
+	}
+	return obj, nil
+}
+
+// head returns a copy of the object's metadata, so callers cannot modify
+// the stored map.
+func (o *MockS3Object) head() HeadObjectOutput {
+	metadata := make(map[string]string, len(o.Metadata))
+	for k, v := range o.Metadata {
+		metadata[k] = v
+	}
+
+	return HeadObjectOutput{
+		ContentLength: int64(len(o.Data)),
+		ContentType:   o.ContentType,
+		ETag:          o.ETag,
+		LastModified:  o.Modified,
+		Metadata:      metadata,
+		VersionID:     o.VersionID,
+
+		ServerSideEncryption: o.ServerSideEncryption,
+		SSEKMSKeyID:          o.SSEKMSKeyID,
+	}
+}
+
+// etagMatches reports whether a conditional header matches etag. The
+// header may be "*" or a comma-separated list of ETags, quoted or not.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.Trim(strings.TrimSpace(candidate), `"`)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ===== 2e. Server-Side Encryption & Presigned URLs =====
+
+// Server-side encryption algorithms. As in S3 since 2023, objects are
+// encrypted with SSE-S3 unless the put asks for something else.
+const (
+	SSEAlgorithmAES256 = "AES256"
+	SSEAlgorithmKMS    = "aws:kms"
+)
+
+// defaultKMSKeyID is the AWS managed key used for SSE-KMS when the put
+// does not name one.
+var defaultKMSKeyID = fmt.Sprintf("arn:aws:kms:%s:%s:alias/aws/s3", mockRegion, mockAccountID)
+
+func resolveSSE(algorithm, kmsKeyID string) (string, string, error) {
+	switch algorithm {
+	case "", SSEAlgorithmAES256:
+		if kmsKeyID != "" {
+			return "", "", NewPermanentError("InvalidArgument", "A KMS key ID requires aws:kms encryption")
+		}
+		return SSEAlgorithmAES256, "", nil
+	case SSEAlgorithmKMS:
+		if kmsKeyID == "" {
+			kmsKeyID = defaultKMSKeyID
+		}
+		return SSEAlgorithmKMS, kmsKeyID, nil
+	default:
+		return "", "", NewPermanentError("InvalidArgument", fmt.Sprintf("Unsupported server-side encryption algorithm %q", algorithm))
+	}
+}
+
+const (
+	presignAlgorithm  = "AWS4-HMAC-SHA256"
+	presignDateFormat = "20060102T150405Z"
+	// maxPresignExpiry is the longest expiry S3 accepts, seven days.
+	maxPresignExpiry = 7 * 24 * time.Hour
+	s3HostSuffix     = ".s3.amazonaws.com"
+)
+
+func newSigningKey() []byte {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// PresignURL returns a virtual-hosted-style URL that allows method on the
+// object until expiration passes. The URL is signed with an HMAC-SHA256 of
+// the method, bucket, key, date and expiry, using a key private to this
+// service, so ValidatePresignedURL rejects URLs that were altered.
+func (m *MockS3Service) PresignURL(ctx context.Context, method, bucketName, key string, expiration time.Duration) (string, error) {
+	m.mu.RLock()
+	_, exists := m.Buckets[bucketName]
+	m.mu.RUnlock()
+
+	if !exists {
+		return "", NewPermanentError("NoSuchBucket", "Bucket does not exist")
+	}
+	if expiration < time.Second || expiration > maxPresignExpiry {
+		return "", NewPermanentError("AuthorizationQueryParametersError", "Expiry must be between 1 second and 7 days")
+	}
+
+	date := m.clock.Now().UTC().Format(presignDateFormat)
+	expires := strconv.Itoa(int(expiration / time.Second))
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", presignAlgorithm)
+	query.Set("X-Amz-Date", date)
+	query.Set("X-Amz-Expires", expires)
+	query.Set("X-Amz-Signature", m.presignSignature(method, bucketName, key, date, expires))
+
+	u := url.URL{
+		Scheme:   "https",
+		Host:     bucketName + s3HostSuffix,
+		Path:     "/" + key,
+		RawQuery: query.Encode(),
+	}
+
+	atomic.AddInt64(&m.stats.PresignCount, 1)
+	return u.String(), nil
+}
+
+// ValidatePresignedURL checks that rawURL was presigned by this service for
+// method and has not expired, returning the bucket and key it grants.
+// Tampered URLs fail with SignatureDoesNotMatch and expired ones with
+// AccessDenied.
+func (m *MockS3Service) ValidatePresignedURL(method, rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", NewPermanentError("AuthorizationQueryParametersError", "Malformed presigned URL")
+	}
+	return m.verifyPresigned(method, u.Host, u)
+}
+
+func (m *MockS3Service) verifyPresigned(method, host string, u *url.URL) (string, string, error) {
+	bucketName, ok := strings.CutSuffix(host, s3HostSuffix)
+	if !ok || bucketName == "" {
+		return "", "", NewPermanentError("AuthorizationQueryParametersError", "Presigned URL must use a virtual-hosted-style host")
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+
+	query := u.Query()
+	date, err := time.Parse(presignDateFormat, query.Get("X-Amz-Date"))
+	if err != nil || query.Get("X-Amz-Algorithm") != presignAlgorithm {
+		return "", "", NewPermanentError("AuthorizationQueryParametersError", "Missing or invalid presign parameters")
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return "", "", NewPermanentError("AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 second and 7 days")
+	}
+
+	want := m.presignSignature(method, bucketName, key, query.Get("X-Amz-Date"), query.Get("X-Amz-Expires"))
+	if !hmac.Equal([]byte(want), []byte(query.Get("X-Amz-Signature"))) {
+		return "", "", NewPermanentError("SignatureDoesNotMatch", "The request signature does not match")
+	}
+	if m.clock.Now().After(date.Add(time.Duration(expires) * time.Second)) {
+		return "", "", NewPermanentError("AccessDenied", "Request has expired")
+	}
+	return bucketName, key, nil
+}
+
+func (m *MockS3Service) presignSignature(method, bucketName, key, date, expires string) string {
+	mac := hmac.New(sha256.New, m.signingKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, bucketName, key, date, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PresignedURLHandler serves GET and PUT requests made with presigned URLs
+// as an S3 endpoint would: the Host header names the bucket, conditional,
+// Content-Type, x-amz-meta-* and encryption headers are honoured, and
+// errors are returned as S3 XML error documents.
+func (m *MockS3Service) PresignedURLHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucketName, key, err := m.verifyPresigned(r.Method, r.Host, r.URL)
+		if err != nil {
+			writeS3Error(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			out, err := m.GetObjectWithInput(r.Context(), bucketName, key, GetObjectInput{
+				IfMatch:     r.Header.Get("If-Match"),
+				IfNoneMatch: r.Header.Get("If-None-Match"),
+			})
+			if err != nil {
+				writeS3Error(w, err)
+				return
+			}
+
+			h := w.Header()
+			h.Set("Content-Type", out.ContentType)
+			h.Set("Content-Length", strconv.Itoa(len(out.Body)))
+			h.Set("ETag", `"`+out.ETag+`"`)
+			h.Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+			h.Set("X-Amz-Server-Side-Encryption", out.ServerSideEncryption)
+			if out.SSEKMSKeyID != "" {
+				h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", out.SSEKMSKeyID)
+			}
+			for k, v := range out.Metadata {
+				h.Set("X-Amz-Meta-"+k, v)
+			}
+			w.Write(out.Body)
+
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeS3Error(w, NewTransientError("IncompleteBody", err.Error()))
+				return
+			}
+
+			metadata := make(map[string]string)
+			for k := range r.Header {
+				if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok {
+					metadata[name] = r.Header.Get(k)
+				}
+			}
+
+			out, err := m.PutObjectWithInput(r.Context(), bucketName, key, body, PutObjectInput{
+				ContentType:          r.Header.Get("Content-Type"),
+				Metadata:             metadata,
+				IfMatch:              r.Header.Get("If-Match"),
+				IfNoneMatch:          r.Header.Get("If-None-Match"),
+				ServerSideEncryption: r.Header.Get("X-Amz-Server-Side-Encryption"),
+				SSEKMSKeyID:          r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+			})
+			if err != nil {
+				writeS3Error(w, err)
+				return
+			}
+			w.Header().Set("ETag", `"`+out.ETag+`"`)
+
+		default:
+			writeS3Error(w, NewPermanentError("MethodNotAllowed", "Presigned URLs support GET and PUT"))
+		}
+	})
+}
+
+// s3ErrorStatus maps error codes to the HTTP status S3 returns for them.
+// Other permanent errors are 400 and transient ones 503.
+var s3ErrorStatus = map[string]int{
+	"NotModified":           http.StatusNotModified,
+	"AccessDenied":          http.StatusForbidden,
+	"SignatureDoesNotMatch": http.StatusForbidden,
+	"NoSuchBucket":          http.StatusNotFound,
+	"NoSuchKey":             http.StatusNotFound,
+	"MethodNotAllowed":      http.StatusMethodNotAllowed,
+	"PreconditionFailed":    http.StatusPreconditionFailed,
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeS3Error(w http.ResponseWriter, err error) {
+	resp := s3ErrorResponse{Code: "InternalError", Message: err.Error()}
+	status := http.StatusInternalServerError
+	if re, ok := err.(*RetryableError); ok {
+		resp = s3ErrorResponse{Code: re.Code, Message: re.Message}
+		status = http.StatusBadRequest
+		if re.Transient {
+			status = http.StatusServiceUnavailable
+		}
+		if s, ok := s3ErrorStatus[re.Code]; ok {
+			status = s
+		}
+	}
+
+	if status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// ===== 3. S3 Client with Retry Logic =====
+
+type S3Client struct {
+	service    *MockS3Service
+	rp         *RetryPolicy
+	budget     *RetryBudget
+	breaker    *CircuitBreaker
+	middleware []ObjectMiddleware
+	stats      *RetryStats
+}
+
+type RetryStats struct {
+	Attempts  int64
+	Successes int64
+	Failures  int64
+	Retries   int64
+	// Throttled counts retries that used the throttling backoff.
+	Throttled int64
+	// BudgetExhausted counts calls that gave up because the retry budget
+	// was empty.
+	BudgetExhausted int64
+	// CircuitRejections counts attempts refused by an open circuit.
+	CircuitRejections int64
+	TotalTime         time.Duration
+}
+
+func NewS3Client(service *MockS3Service) *S3Client {
+	return &S3Client{
+		service: service,
+		rp:      NewRetryPolicy(),
+		budget:  NewRetryBudget(defaultRetryBudget),
+		stats:   &RetryStats{},
+	}
+}
+
+// SetRetryBudget replaces the client's retry budget. Share one budget
+// between clients to cap their combined retries; nil removes the cap.
+func (c *S3Client) SetRetryBudget(budget *RetryBudget) {
+	c.budget = budget
+}
+
+// SetCircuitBreaker makes the client fail fast while cb is open.
+func (c *S3Client) SetCircuitBreaker(cb *CircuitBreaker) {
+	c.breaker = cb
+}
+
+// Use adds middleware that transforms object bodies. Puts run it in the
+// order given and gets in reverse, so Use(NewGzipMiddleware(),
+// NewEncryptionMiddleware(kp)) compresses before encrypting.
+func (c *S3Client) Use(middleware ...ObjectMiddleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+func (c *S3Client) PutObjectWithRetry(ctx context.Context, bucketName, key string, data []byte) error {
+	obj := &ObjectPayload{Bucket: bucketName, Key: key, Data: data, Metadata: make(map[string]string)}
+	for _, mw := range c.middleware {
+		if err := mw.Wrap(ctx, obj); err != nil {
+			return err
+		}
+	}
+
+	return c.withRetry(ctx, func() error {
+		_, err := c.service.PutObjectWithInput(ctx, bucketName, key, obj.Data, PutObjectInput{Metadata: obj.Metadata})
+		return err
+	})
+}
+
+func (c *S3Client) GetObjectWithRetry(ctx context.Context, bucketName, key string) ([]byte, error) {
+	var out *GetObjectOutput
+	err := c.withRetry(ctx, func() error {
+		var err error
+		out, err = c.service.GetObjectWithInput(ctx, bucketName, key, GetObjectInput{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &ObjectPayload{Bucket: bucketName, Key: key, Data: out.Body, Metadata: out.Metadata}
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		if err := c.middleware[i].Unwrap(ctx, obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj.Data, nil
+}
+
+// withRetry runs call until it succeeds, fails permanently or runs out of
+// attempts. Each retry spends tokens from the retry budget, so a burst of
+// failures cannot multiply load indefinitely, and throttling errors back
+// off from a longer base delay.
+func (c *S3Client) withRetry(ctx context.Context, call func() error) error {
+	atomic.AddInt64(&c.stats.Attempts, 1)
+	start := time.Now()
+	defer func() { atomic.AddInt64((*int64)(&c.stats.TotalTime), int64(time.Since(start))) }()
+
+	cost := 0
+	for attempt := 0; attempt <= c.rp.maxRetries; attempt++ {
+		if err := c.breaker.Allow(); err != nil {
+			atomic.AddInt64(&c.stats.CircuitRejections, 1)
+			atomic.AddInt64(&c.stats.Failures, 1)
+			return err
+		}
+
+		err := call()
+		c.breaker.Record(err)
+		if err == nil {
+			c.budget.Refund(cost)
+			atomic.AddInt64(&c.stats.Successes, 1)
+			return nil
+		}
+
+		retErr, ok := err.(*RetryableError)
+		if ok && !retErr.Transient {
+			atomic.AddInt64(&c.stats.Failures, 1)
+			return err
+		}
+
+		if attempt < c.rp.maxRetries {
+			throttled := ok && isThrottlingError(retErr.Code)
+			if cost, ok = c.budget.Acquire(throttled); !ok {
+				atomic.AddInt64(&c.stats.BudgetExhausted, 1)
+				atomic.AddInt64(&c.stats.Failures, 1)
+				return err
+			}
+
+			atomic.AddInt64(&c.stats.Retries, 1)
+			backoff := c.rp.GetBackoffDuration(attempt)
+			if throttled {
+				atomic.AddInt64(&c.stats.Throttled, 1)
+				backoff = c.rp.GetThrottleBackoffDuration(attempt)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	atomic.AddInt64(&c.stats.Failures, 1)
+	return NewTransientError("MaxRetriesExceeded", "Maximum retries exceeded")
+}
+
+var throttlingErrorCodes = []string{
+	"SlowDown",
+	"Throttling",
+	"ThrottlingException",
+	"TooManyRequestsException",
+	"RequestLimitExceeded",
+	"RequestThrottled",
+	"ProvisionedThroughputExceededException",
+}
+
+func isThrottlingError(code string) bool {
+	return slices.Contains(throttlingErrorCodes, code)
+}
+
+// ===== 3a. Retry Budget & Circuit Breaker =====
+
+const (
+	defaultRetryBudget = 500
+	retryCost          = 5
+	throttleRetryCost  = 10
+	successRefund      = 1
+)
+
+// RetryBudget is a token bucket shared by callers, modelled on the AWS SDK
+// retry quota: a retry costs 5 tokens (10 after throttling), a successful
+// retry refunds its cost, and a first-try success adds 1 token back.
+type RetryBudget struct {
+	mu       sync.Mutex
+	capacity int
+	tokens   int
+}
+
+func NewRetryBudget(capacity int) *RetryBudget {
+	return &RetryBudget{capacity: capacity, tokens: capacity}
+}
+
+// Acquire takes the tokens for one retry, returning the cost and whether
+// the retry may proceed. A nil budget always allows retries.
+func (b *RetryBudget) Acquire(throttled bool) (int, bool) {
+	if b == nil {
+		return 0, true
+	}
+
+	cost := retryCost
+	if throttled {
+		cost = throttleRetryCost
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < cost {
+		return 0, false
+	}
+	b.tokens -= cost
+	return cost, true
+}
+
+// Refund returns cost tokens after a retry succeeds, or successRefund when
+// the call succeeded without retrying.
+func (b *RetryBudget) Refund(cost int) {
+	if b == nil {
+		return
+	}
+	if cost == 0 {
+		cost = successRefund
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+cost, b.capacity)
+}
+
+func (b *RetryBudget) Tokens() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker opens after failureThreshold consecutive transient
+// failures and rejects calls until openTimeout has passed. It then lets a
+// single probe through: success closes the circuit, failure reopens it.
+// Permanent errors such as NoSuchKey do not count as failures.
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	clock            Clock
+	state            CircuitState
+	failures         int
+	openedAt         time.Time
+	probing          bool
+}
+
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		clock:            realClock{},
+	}
+}
+
+// SetClock replaces the clock used for the open timeout. Call it before
+// the breaker is in use.
+func (cb *CircuitBreaker) SetClock(clock Clock) {
+	cb.clock = clock
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Allow reports whether a call may proceed. A nil breaker allows every
+// call.
+func (cb *CircuitBreaker) Allow() error {
+	if cb == nil {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && !cb.clock.Now().Before(cb.openedAt.Add(cb.openTimeout)) {
+		cb.state = CircuitHalfOpen
+	}
+
+	switch {
+	case cb.state == CircuitOpen, cb.state == CircuitHalfOpen && cb.probing:
+		return NewTransientError("CircuitOpen", "Circuit breaker is open")
+	case cb.state == CircuitHalfOpen:
+		cb.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call.
+func (cb *CircuitBreaker) Record(err error) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+
+	retErr, ok := err.(*RetryableError)
+	switch {
+	case ok && retErr.Transient:
+		cb.failures++
+		if cb.state == CircuitHalfOpen || cb.failures >= cb.failureThreshold {
+			cb.state = CircuitOpen
+			cb.openedAt = cb.clock.Now()
+		}
+	case err == nil || ok:
+		cb.failures = 0
+		cb.state = CircuitClosed
+	}
+}
+
+// ===== 3b. Client-Side Encryption & Compression =====
+
+// ObjectPayload is an object body on its way to or from S3, with the user
+// metadata stored alongside it.
+type ObjectPayload struct {
+	Bucket   string
+	Key      string
+	Data     []byte
+	Metadata map[string]string
+}
+
+// ObjectMiddleware transforms object bodies in S3Client. Wrap runs before
+// a put and records in the metadata what it did; Unwrap reverses it after
+// a get and must pass through objects it did not wrap.
+type ObjectMiddleware interface {
+	Wrap(ctx context.Context, obj *ObjectPayload) error
+	Unwrap(ctx context.Context, obj *ObjectPayload) error
+}
+
+// Metadata keys written by the built-in middleware.
+const (
+	metaCompression = "client-compression"
+	metaEncryption  = "client-encryption"
+	metaKeyID       = "client-key-id"
+)
+
+type gzipMiddleware struct{}
+
+func NewGzipMiddleware() ObjectMiddleware {
+	return gzipMiddleware{}
+}
+
+func (gzipMiddleware) Wrap(ctx context.Context, obj *ObjectPayload) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(obj.Data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	obj.Data = buf.Bytes()
+	obj.Metadata[metaCompression] = "gzip"
+	return nil
+}
+
+func (gzipMiddleware) Unwrap(ctx context.Context, obj *ObjectPayload) error {
+	if obj.Metadata[metaCompression] != "gzip" {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(obj.Data))
+	if err != nil {
+		return NewPermanentError("DecompressionFailed", err.Error())
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return NewPermanentError("DecompressionFailed", err.Error())
+	}
+
+	obj.Data = data
+	return nil
+}
+
+// KeyProvider supplies AES keys for client-side encryption. CurrentKey is
+// used to encrypt; Key looks up the key an object was encrypted with, so
+// keys can be rotated without re-encrypting existing objects.
+type KeyProvider interface {
+	CurrentKey(ctx context.Context) (keyID string, key []byte, err error)
+	Key(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// StaticKeyProvider is an in-memory KeyProvider.
+type StaticKeyProvider struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeyProvider(keyID string, key []byte) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{keys: make(map[string][]byte)}
+	if err := p.AddKey(keyID, key); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddKey stores key and makes it the current one. The key must be 16, 24
+// or 32 bytes long, for AES-128, AES-192 or AES-256.
+func (p *StaticKeyProvider) AddKey(keyID string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return NewPermanentError("InvalidKey", err.Error())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[keyID] = bytes.Clone(key)
+	p.current = keyID
+	return nil
+}
+
+func (p *StaticKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *StaticKeyProvider) Key(ctx context.Context, keyID string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	key, exists := p.keys[keyID]
+	if !exists {
+		return nil, NewPermanentError("KeyNotFound", fmt.Sprintf("No key with ID %q", keyID))
+	}
+	return key, nil
+}
+
+type encryptionMiddleware struct {
+	keys KeyProvider
+}
+
+// NewEncryptionMiddleware encrypts bodies with AES-GCM. The nonce is
+// prepended to the ciphertext, the key ID is stored in the metadata, and
+// the bucket and key are authenticated, so a ciphertext copied to another
+// object fails to decrypt.
+func NewEncryptionMiddleware(keys KeyProvider) ObjectMiddleware {
+	return &encryptionMiddleware{keys: keys}
+}
+
+func (e *encryptionMiddleware) Wrap(ctx context.Context, obj *ObjectPayload) error {
+	keyID, key, err := e.keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return err
+	}
+
+	obj.Data = gcm.Seal(nonce, nonce, obj.Data, objectAAD(obj))
+	obj.Metadata[metaEncryption] = "AES-GCM"
+	obj.Metadata[metaKeyID] = keyID
+	return nil
+}
+
+func (e *encryptionMiddleware) Unwrap(ctx context.Context, obj *ObjectPayload) error {
+	switch obj.Metadata[metaEncryption] {
+	case "":
+		return nil
+	case "AES-GCM":
+	default:
+		return NewPermanentError("DecryptionFailed", fmt.Sprintf("Unsupported algorithm %q", obj.Metadata[metaEncryption]))
+	}
+
+	key, err := e.keys.Key(ctx, obj.Metadata[metaKeyID])
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	if len(obj.Data) < gcm.NonceSize() {
+		return NewPermanentError("DecryptionFailed", "Ciphertext is too short")
+	}
+	nonce, ciphertext := obj.Data[:gcm.NonceSize()], obj.Data[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, objectAAD(obj))
+	if err != nil {
+		return NewPermanentError("DecryptionFailed", "Message authentication failed")
+	}
+
+	obj.Data = data
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, NewPermanentError("InvalidKey", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+func objectAAD(obj *ObjectPayload) []byte {
+	return []byte(obj.Bucket + "/" + obj.Key)
+}
+
+// ===== 4. Mock SQS Service =====
+
+const maxVisibilityTimeout = 12 * time.Hour
 
 type SQSMessage struct {
-	MessageID     string
-	Body          string
-	Attributes    map[string]string
+	MessageID  string
+	Body       string
+	Attributes map[string]string
+	// ReceiptHandle changes on every receive; only the latest one can
+	// delete the message or change its visibility.
+	ReceiptHandle string
+	Timestamp     time.Time
+	ReceiveCount  int
+	// FIFO queues only
+	MessageGroupID  string
+	DeduplicationID string
+	SequenceNumber  string
+	visibleAt       time.Time
+	sourceQueue     string // queue a dead-lettered message came from
+}
+
+type SQSQueue struct {
+	Name string
+	// Messages holds every undeleted message, including ones that are
+	// currently in flight.
+	Messages            []*SQSMessage
+	DeadLetterQueueName string
+	// MaxReceiveCount is how many times a message can be received before
+	// it is moved to the dead-letter queue.
+	MaxReceiveCount   int
+	VisibilityTimeout time.Duration
+	// FIFO is set for queues whose name ends in ".fifo".
+	FIFO                      bool
+	ContentBasedDeduplication bool
+	dedup                     map[string]fifoDedupEntry
+	sequence                  uint64
+	wake                      chan struct{} // closed when messages may have become receivable
+	sent, received, deleted   int64
+	mu                        sync.RWMutex
+}
+
+type MockSQSService struct {
+	Queues   map[string]*SQSQueue
+	clock    Clock
+	faults   *FaultInjector
+	recorder *Recorder
+	mu       sync.RWMutex
+	stats    *SQSStats
+}
+
+type SQSStats struct {
+	PublishCount int64
+	ConsumeCount int64
+	DeleteCount  int64
+	ReceiveCount int64
+	DLQCount     int64
+	RedriveCount int64
+}
+
+func NewMockSQSService() *MockSQSService {
+	return &MockSQSService{
+		Queues: make(map[string]*SQSQueue),
+		clock:  realClock{},
+		stats:  &SQSStats{},
+	}
+}
+
+// SetClock replaces the clock used for timestamps and visibility timeouts.
+// Call it before the service is in use.
+func (m *MockSQSService) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+// SetFaultInjector makes the service consult fi before each operation.
+// Call it before the service is in use.
+func (m *MockSQSService) SetFaultInjector(fi *FaultInjector) {
+	m.faults = fi
+}
+
+// SetRecorder makes the service record every call in r. Call it before the
+// service is in use.
+func (m *MockSQSService) SetRecorder(r *Recorder) {
+	m.recorder = r
+}
+
+func (m *MockSQSService) CreateQueue(queueName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.Queues[queueName]; exists {
+		return NewPermanentError("QueueAlreadyExists", "Queue already exists")
+	}
+
+	m.Queues[queueName] = &SQSQueue{
+		Name:              queueName,
+		Messages:          make([]*SQSMessage, 0),
+		VisibilityTimeout: 30 * time.Second,
+		FIFO:              strings.HasSuffix(queueName, fifoSuffix),
+		dedup:             make(map[string]fifoDedupEntry),
+		wake:              make(chan struct{}),
+	}
+	return nil
+}
+
+func (m *MockSQSService) queueExists(queueName string) bool {
+	_, err := m.getQueue(queueName)
+	return err == nil
+}
+
+func (m *MockSQSService) getQueue(queueName string) (*SQSQueue, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	queue, exists := m.Queues[queueName]
+	if !exists {
+		return nil, NewPermanentError("QueueDoesNotExist", "Queue does not exist")
+	}
+	return queue, nil
+}
+
+// SetVisibilityTimeout sets how long received messages stay hidden from
+// other consumers before they are redelivered.
+func (m *MockSQSService) SetVisibilityTimeout(queueName string, timeout time.Duration) error {
+	if timeout < 0 || timeout > maxVisibilityTimeout {
+		return NewPermanentError("InvalidParameterValue", "Visibility timeout must be between 0 and 12 hours")
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	queue.mu.Lock()
+	queue.VisibilityTimeout = timeout
+	queue.mu.Unlock()
+	return nil
+}
+
+func (m *MockSQSService) PublishMessage(ctx context.Context, queueName, body string, attributes map[string]string) (string, error) {
+	m.recorder.Record("sqs", "SendMessage", queueName, map[string]string{"MessageBody": body})
+	if err := m.faults.Inject(ctx, "sqs", "SendMessage", queueName); err != nil {
+		return "", err
+	}
+
+	m.mu.RLock()
+	queue, exists := m.Queues[queueName]
+	m.mu.RUnlock()
+
+	if !exists {
+		return "", NewPermanentError("QueueDoesNotExist", "Queue does not exist")
+	}
+	if queue.FIFO {
+		return "", NewPermanentError("MissingParameter", "MessageGroupId is required for FIFO queues")
+	}
+
+	messageID := generateMessageID()
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	msg := &SQSMessage{
+		MessageID:  messageID,
+		Body:       body,
+		Attributes: attributes,
+		Timestamp:  m.clock.Now(),
+	}
+
+	queue.Messages = append(queue.Messages, msg)
+	queue.sent++
+	queue.signal()
+	atomic.AddInt64(&m.stats.PublishCount, 1)
+
+	return messageID, nil
+}
+
+func (m *MockSQSService) ReceiveMessages(ctx context.Context, queueName string, maxMessages int) ([]*SQSMessage, error) {
+	m.recorder.Record("sqs", "ReceiveMessage", queueName, map[string]string{"MaxNumberOfMessages": strconv.Itoa(maxMessages)})
+	if err := m.faults.Inject(ctx, "sqs", "ReceiveMessage", queueName); err != nil {
+		return nil, err
+	}
+
+	messages, _, err := m.receive(queueName, maxMessages)
+	return messages, err
+}
+
+const maxWaitTime = 20 * time.Second
+
+// ReceiveMessagesWait long-polls: when no message is available it waits up
+// to waitTime (at most 20 seconds) for one to arrive or become visible
+// again, returning as soon as there is something to deliver. The wait is
+// measured in real time, not on the service's clock.
+func (m *MockSQSService) ReceiveMessagesWait(ctx context.Context, queueName string, maxMessages int, waitTime time.Duration) ([]*SQSMessage, error) {
+	m.recorder.Record("sqs", "ReceiveMessage", queueName, map[string]string{"MaxNumberOfMessages": strconv.Itoa(maxMessages), "WaitTimeSeconds": strconv.Itoa(int(waitTime / time.Second))})
+	if err := m.faults.Inject(ctx, "sqs", "ReceiveMessage", queueName); err != nil {
+		return nil, err
+	}
+
+	if waitTime < 0 || waitTime > maxWaitTime {
+		return nil, NewPermanentError("InvalidParameterValue", "WaitTimeSeconds must be between 0 and 20")
+	}
+
+	deadline := time.NewTimer(waitTime)
+	defer deadline.Stop()
+
+	for {
+		messages, queue, err := m.receive(queueName, maxMessages)
+		if err != nil || len(messages) > 0 || waitTime == 0 {
+			return messages, err
+		}
+
+		now := m.clock.Now()
+		queue.mu.RLock()
+		wake := queue.wake
+		next := queue.nextVisible(now)
+		queue.mu.RUnlock()
+
+		var visible <-chan time.Time
+		if !next.IsZero() {
+			visible = time.After(next.Sub(now))
+		}
+
+		select {
+		case <-ctx.Done():
+			return messages, ctx.Err()
+		case <-deadline.C:
+			return messages, nil
+		case <-wake:
+		case <-visible:
+		}
+	}
+}
+
+// signal wakes long-polling receivers. Must be called with q.mu held.
+func (q *SQSQueue) signal() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// nextVisible returns when the next in-flight message becomes visible, or
+// the zero time if none is in flight. Must be called with q.mu held.
+func (q *SQSQueue) nextVisible(now time.Time) time.Time {
+	var next time.Time
+	for _, msg := range q.Messages {
+		if msg.visibleAt.After(now) && (next.IsZero() || msg.visibleAt.Before(next)) {
+			next = msg.visibleAt
+		}
+	}
+	return next
+}
+
+func (m *MockSQSService) receive(queueName string, maxMessages int) ([]*SQSMessage, *SQSQueue, error) {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	queue.mu.Lock()
+
+	// Received messages stay in the queue but are hidden until their
+	// visibility timeout passes, after which they are delivered again
+	now := m.clock.Now()
+	messages := []*SQSMessage{}
+	var deadLetters []*SQSMessage
+
+	// In a FIFO queue, a group with a message in flight is blocked so its
+	// messages are processed strictly in order
+	blocked := make(map[string]bool)
+	if queue.FIFO {
+		for _, msg := range queue.Messages {
+			if now.Before(msg.visibleAt) {
+				blocked[msg.MessageGroupID] = true
+			}
+		}
+	}
+
+	kept := queue.Messages[:0:0]
+	for _, msg := range queue.Messages {
+		if len(messages) == maxMessages || now.Before(msg.visibleAt) || blocked[msg.MessageGroupID] {
+			kept = append(kept, msg)
+			continue
+		}
+
+		// A message that reappears after maxReceiveCount receives goes to
+		// the dead-letter queue instead of being delivered again
+		if queue.DeadLetterQueueName != "" && msg.ReceiveCount >= queue.MaxReceiveCount {
+			deadLetters = append(deadLetters, msg)
+			continue
+		}
+
+		msg.ReceiveCount++
+		msg.ReceiptHandle = generateReceiptHandle()
+		msg.visibleAt = now.Add(queue.VisibilityTimeout)
+
+		received := *msg
+		messages = append(messages, &received)
+		kept = append(kept, msg)
+	}
+	queue.Messages = kept
+	queue.received += int64(len(messages))
+	dlqName := queue.DeadLetterQueueName
+	queue.mu.Unlock()
+
+	if len(deadLetters) > 0 {
+		m.moveMessages(deadLetters, dlqName, queueName)
+		atomic.AddInt64(&m.stats.DLQCount, int64(len(deadLetters)))
+	}
+
+	if len(messages) > 0 {
+		atomic.AddInt64(&m.stats.ReceiveCount, 1)
+	}
+	return messages, queue, nil
+}
+
+// SetRedrivePolicy makes messages received more than maxReceiveCount times
+// move to the dead-letter queue dlqName. An empty dlqName removes the
+// policy.
+func (m *MockSQSService) SetRedrivePolicy(queueName, dlqName string, maxReceiveCount int) error {
+	if dlqName != "" {
+		if dlqName == queueName {
+			return NewPermanentError("InvalidParameterValue", "A queue cannot be its own dead-letter queue")
+		}
+		if maxReceiveCount < 1 || maxReceiveCount > 1000 {
+			return NewPermanentError("InvalidParameterValue", "maxReceiveCount must be between 1 and 1000")
+		}
+		if !m.queueExists(dlqName) {
+			return NewPermanentError("QueueDoesNotExist", "Dead-letter queue does not exist")
+		}
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+	if dlqName != "" && queue.FIFO != strings.HasSuffix(dlqName, fifoSuffix) {
+		return NewPermanentError("InvalidParameterValue", "The dead-letter queue must be the same type as the source queue")
+	}
+
+	queue.mu.Lock()
+	queue.DeadLetterQueueName = dlqName
+	queue.MaxReceiveCount = maxReceiveCount
+	queue.mu.Unlock()
+	return nil
+}
+
+// StartRedrive moves every message that is not in flight out of a
+// dead-letter queue, back to the queue it came from or, if destination is
+// set, to that queue. It returns the number of messages moved.
+func (m *MockSQSService) StartRedrive(ctx context.Context, dlqName, destination string) (int, error) {
+	dlq, err := m.getQueue(dlqName)
+	if err != nil {
+		return 0, err
+	}
+	if destination != "" && !m.queueExists(destination) {
+		return 0, NewPermanentError("QueueDoesNotExist", "Destination queue does not exist")
+	}
+
+	now := m.clock.Now()
+	bySource := make(map[string][]*SQSMessage)
+	var sources []string
+
+	dlq.mu.Lock()
+	kept := dlq.Messages[:0:0]
+	for _, msg := range dlq.Messages {
+		target := destination
+		if target == "" {
+			target = msg.sourceQueue
+		}
+		if now.Before(msg.visibleAt) || target == "" || !m.queueExists(target) {
+			kept = append(kept, msg)
+			continue
+		}
+		if _, seen := bySource[target]; !seen {
+			sources = append(sources, target)
+		}
+		bySource[target] = append(bySource[target], msg)
+	}
+	dlq.Messages = kept
+	dlq.mu.Unlock()
+
+	moved := 0
+	for _, target := range sources {
+		m.moveMessages(bySource[target], target, "")
+		moved += len(bySource[target])
+	}
+
+	atomic.AddInt64(&m.stats.RedriveCount, int64(moved))
+	return moved, nil
+}
+
+// moveMessages appends messages to queueName as fresh, unreceived
+// messages, recording source as where they came from.
+func (m *MockSQSService) moveMessages(messages []*SQSMessage, queueName, source string) {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for _, msg := range messages {
+		msg.ReceiveCount = 0
+		msg.ReceiptHandle = ""
+		msg.visibleAt = time.Time{}
+		msg.sourceQueue = source
+		queue.Messages = append(queue.Messages, msg)
+	}
+	queue.signal()
+}
+
+func (m *MockSQSService) DeleteMessage(ctx context.Context, queueName, receiptHandle string) error {
+	m.recorder.Record("sqs", "DeleteMessage", queueName, map[string]string{"ReceiptHandle": receiptHandle})
+	if err := m.faults.Inject(ctx, "sqs", "DeleteMessage", queueName); err != nil {
+		return err
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if err := queue.deleteReceipt(receiptHandle); err != nil {
+		return err
+	}
+	queue.signal()
+
+	atomic.AddInt64(&m.stats.DeleteCount, 1)
+	return nil
+}
+
+const maxBatchEntries = 10
+
+// BatchResultError reports one entry of a batch request that failed.
+type BatchResultError struct {
 	ReceiptHandle string
-	Timestamp     time.Time
+	Code          string
+	Message       string
+}
+
+// DeleteMessageBatch deletes up to 10 messages at once. Entries that fail
+// are reported individually; the returned error covers only problems with
+// the request as a whole.
+func (m *MockSQSService) DeleteMessageBatch(ctx context.Context, queueName string, receiptHandles []string) ([]BatchResultError, error) {
+	m.recorder.Record("sqs", "DeleteMessageBatch", queueName, map[string]string{"Entries": strconv.Itoa(len(receiptHandles))})
+	if err := m.faults.Inject(ctx, "sqs", "DeleteMessageBatch", queueName); err != nil {
+		return nil, err
+	}
+
+	if len(receiptHandles) == 0 {
+		return nil, NewPermanentError("EmptyBatchRequest", "The batch request does not contain any entries")
+	}
+	if len(receiptHandles) > maxBatchEntries {
+		return nil, NewPermanentError("TooManyEntriesInBatchRequest", "A batch request can contain at most 10 entries")
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	var failed []BatchResultError
+	for _, handle := range receiptHandles {
+		if err := queue.deleteReceipt(handle); err != nil {
+			re := err.(*RetryableError)
+			failed = append(failed, BatchResultError{ReceiptHandle: handle, Code: re.Code, Message: re.Message})
+			continue
+		}
+		atomic.AddInt64(&m.stats.DeleteCount, 1)
+	}
+	queue.signal()
+	return failed, nil
+}
+
+// deleteReceipt must be called with q.mu held.
+func (q *SQSQueue) deleteReceipt(receiptHandle string) error {
+	i := q.findReceipt(receiptHandle)
+	if i < 0 {
+		return NewPermanentError("ReceiptHandleIsInvalid", "The receipt handle is not valid for any in-flight message")
+	}
+	q.Messages = append(q.Messages[:i:i], q.Messages[i+1:]...)
+	q.deleted++
+	return nil
+}
+
+// ChangeMessageVisibility resets an in-flight message's visibility timeout,
+// counted from now. A timeout of 0 makes it visible again immediately.
+func (m *MockSQSService) ChangeMessageVisibility(ctx context.Context, queueName, receiptHandle string, timeout time.Duration) error {
+	m.recorder.Record("sqs", "ChangeMessageVisibility", queueName, map[string]string{"ReceiptHandle": receiptHandle, "VisibilityTimeout": strconv.Itoa(int(timeout / time.Second))})
+	if err := m.faults.Inject(ctx, "sqs", "ChangeMessageVisibility", queueName); err != nil {
+		return err
+	}
+
+	if timeout < 0 || timeout > maxVisibilityTimeout {
+		return NewPermanentError("InvalidParameterValue", "Visibility timeout must be between 0 and 12 hours")
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	i := queue.findReceipt(receiptHandle)
+	if i < 0 || !m.clock.Now().Before(queue.Messages[i].visibleAt) {
+		return NewPermanentError("MessageNotInflight", "The message is not in flight")
+	}
+	queue.Messages[i].visibleAt = m.clock.Now().Add(timeout)
+	queue.signal()
+	return nil
+}
+
+// findReceipt must be called with q.mu held.
+func (q *SQSQueue) findReceipt(receiptHandle string) int {
+	for i, msg := range q.Messages {
+		if msg.ReceiptHandle != "" && msg.ReceiptHandle == receiptHandle {
+			return i
+		}
+	}
+	return -1
+}
+
+// ===== 4a. SQS FIFO Queues =====
+
+const (
+	fifoSuffix          = ".fifo"
+	fifoDedupWindow     = 5 * time.Minute
+	maxMessageGroupSize = 128
+)
+
+type fifoDedupEntry struct {
+	messageID string
+	expires   time.Time
+}
+
+// SetContentBasedDeduplication makes a FIFO queue derive deduplication IDs
+// from the message body when the sender does not supply one.
+func (m *MockSQSService) SetContentBasedDeduplication(queueName string, enabled bool) error {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+	if !queue.FIFO {
+		return NewPermanentError("InvalidAttributeName", "ContentBasedDeduplication is only valid for FIFO queues")
+	}
+
+	queue.mu.Lock()
+	queue.ContentBasedDeduplication = enabled
+	queue.mu.Unlock()
+	return nil
+}
+
+// PublishFIFOMessage sends a message to a FIFO queue. Messages with the same
+// groupID are delivered in order, one batch at a time. A message whose
+// deduplication ID was already seen in the last five minutes is accepted
+// but not enqueued again, and the original message ID is returned.
+func (m *MockSQSService) PublishFIFOMessage(ctx context.Context, queueName, body, groupID, deduplicationID string, attributes map[string]string) (string, error) {
+	m.recorder.Record("sqs", "SendMessage", queueName, map[string]string{"MessageBody": body, "MessageGroupId": groupID, "MessageDeduplicationId": deduplicationID})
+	if err := m.faults.Inject(ctx, "sqs", "SendMessage", queueName); err != nil {
+		return "", err
+	}
+
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return "", err
+	}
+	if !queue.FIFO {
+		return "", NewPermanentError("InvalidParameterValue", "MessageGroupId is only valid for FIFO queues")
+	}
+	if groupID == "" || len(groupID) > maxMessageGroupSize {
+		return "", NewPermanentError("MissingParameter", "MessageGroupId must be 1 to 128 characters")
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if deduplicationID == "" {
+		if !queue.ContentBasedDeduplication {
+			return "", NewPermanentError("InvalidParameterValue", "The queue requires a MessageDeduplicationId or content-based deduplication")
+		}
+		deduplicationID = fmt.Sprintf("%x", generateETag([]byte(body)))
+	}
+
+	now := m.clock.Now()
+	for id, entry := range queue.dedup {
+		if !now.Before(entry.expires) {
+			delete(queue.dedup, id)
+		}
+	}
+	if entry, seen := queue.dedup[deduplicationID]; seen {
+		return entry.messageID, nil
+	}
+
+	messageID := generateMessageID()
+	queue.sequence++
+	queue.Messages = append(queue.Messages, &SQSMessage{
+		MessageID:       messageID,
+		Body:            body,
+		Attributes:      attributes,
+		Timestamp:       now,
+		MessageGroupID:  groupID,
+		DeduplicationID: deduplicationID,
+		SequenceNumber:  fmt.Sprintf("%020d", queue.sequence),
+	})
+	queue.dedup[deduplicationID] = fifoDedupEntry{messageID: messageID, expires: now.Add(fifoDedupWindow)}
+	queue.sent++
+	queue.signal()
+
+	atomic.AddInt64(&m.stats.PublishCount, 1)
+	return messageID, nil
+}
+
+// ===== 4b. Queue Metrics =====
+
+// QueueMetrics is a point-in-time view of a queue, named after the SQS
+// attributes and CloudWatch metrics an autoscaler would watch. The gauges
+// describe the queue at Timestamp; the NumberOfMessages counters are
+// totals since the queue was created.
+type QueueMetrics struct {
+	QueueName string
+	Timestamp time.Time
+	// ApproximateNumberOfMessages counts messages available to receive and
+	// ApproximateNumberOfMessagesNotVisible those in flight.
+	ApproximateNumberOfMessages           int
+	ApproximateNumberOfMessagesNotVisible int
+	// ApproximateAgeOfOldestMessage is how long the oldest undeleted
+	// message has been in the queue, or 0 if it is empty.
+	ApproximateAgeOfOldestMessage time.Duration
+	NumberOfMessagesSent          int64
+	NumberOfMessagesReceived      int64
+	NumberOfMessagesDeleted       int64
+}
+
+func (m *MockSQSService) GetQueueMetrics(queueName string) (QueueMetrics, error) {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return QueueMetrics{}, err
+	}
+	return queue.metrics(m.clock.Now()), nil
+}
+
+// MetricsSnapshot returns the metrics of every queue, sorted by name, all
+// taken at the same instant.
+func (m *MockSQSService) MetricsSnapshot() []QueueMetrics {
+	m.mu.RLock()
+	queues := make([]*SQSQueue, 0, len(m.Queues))
+	for _, queue := range m.Queues {
+		queues = append(queues, queue)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+
+	now := m.clock.Now()
+	snapshot := make([]QueueMetrics, len(queues))
+	for i, queue := range queues {
+		snapshot[i] = queue.metrics(now)
+	}
+	return snapshot
+}
+
+func (q *SQSQueue) metrics(now time.Time) QueueMetrics {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	qm := QueueMetrics{
+		QueueName:                q.Name,
+		Timestamp:                now,
+		NumberOfMessagesSent:     q.sent,
+		NumberOfMessagesReceived: q.received,
+		NumberOfMessagesDeleted:  q.deleted,
+	}
+
+	var oldest time.Time
+	for _, msg := range q.Messages {
+		if now.Before(msg.visibleAt) {
+			qm.ApproximateNumberOfMessagesNotVisible++
+		} else {
+			qm.ApproximateNumberOfMessages++
+		}
+		if oldest.IsZero() || msg.Timestamp.Before(oldest) {
+			oldest = msg.Timestamp
+		}
+	}
+	if !oldest.IsZero() {
+		qm.ApproximateAgeOfOldestMessage = now.Sub(oldest)
+	}
+	return qm
+}
+
+// ===== 5. SQS Producer/Consumer =====
+
+type SQSProducer struct {
+	service *MockSQSService
+	queue   string
+}
+
+type SQSConsumer struct {
+	service *MockSQSService
+	queue   string
+	handler func(*SQSMessage) error
+
+	mu       sync.Mutex
+	stopped  bool
+	stop     chan struct{}       // closed by Stop
+	inFlight map[string]struct{} // receipt handles received but not yet handled
+	workers  sync.WaitGroup
+}
+
+func NewSQSProducer(service *MockSQSService, queue string) *SQSProducer {
+	return &SQSProducer{
+		service: service,
+		queue:   queue,
+	}
+}
+
+func (p *SQSProducer) PublishBatch(ctx context.Context, messages []string) error {
+	for _, msg := range messages {
+		_, err := p.service.PublishMessage(ctx, p.queue, msg, make(map[string]string))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewSQSConsumer(service *MockSQSService, queue string, handler func(*SQSMessage) error) *SQSConsumer {
+	return &SQSConsumer{
+		service:  service,
+		queue:    queue,
+		handler:  handler,
+		stop:     make(chan struct{}),
+		inFlight: make(map[string]struct{}),
+	}
+}
+
+// Start polls with concurrency workers until ctx is cancelled or Stop is
+// called, and returns once every worker has exited.
+func (c *SQSConsumer) Start(ctx context.Context, concurrency int) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.workers.Add(concurrency)
+	c.mu.Unlock()
+
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer c.workers.Done()
+			c.pollMessages(ctx)
+		}()
+	}
+	c.workers.Wait()
+}
+
+// Stop stops polling and waits until in-flight handlers finish or ctx is
+// done. Messages received but not yet handled are left in the queue, and
+// their receipt handles are returned so the caller can release them with
+// ChangeMessageVisibility. Handlers still running when ctx is done keep
+// running; their messages are included and the error is ctx.Err().
+func (c *SQSConsumer) Stop(ctx context.Context) ([]string, error) {
+	c.mu.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+	}
+	c.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Sorted(maps.Keys(c.inFlight)), err
+}
+
+func (c *SQSConsumer) setInFlight(receiptHandle string, inFlight bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if inFlight {
+		c.inFlight[receiptHandle] = struct{}{}
+	} else {
+		delete(c.inFlight, receiptHandle)
+	}
+}
+
+func (c *SQSConsumer) pollMessages(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := c.service.ReceiveMessagesWait(ctx, c.queue, maxBatchEntries, maxWaitTime)
+		if err != nil {
+			// Back off instead of spinning on a persistent error
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			c.setInFlight(msg.ReceiptHandle, true)
+		}
+
+		// Once stopping, the rest of the batch is left unprocessed, but
+		// messages already handled are still deleted
+		var handled []string
+		for _, msg := range messages {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := c.handler(msg); err == nil {
+				handled = append(handled, msg.ReceiptHandle)
+			}
+			c.setInFlight(msg.ReceiptHandle, false)
+		}
+		if len(handled) > 0 {
+			c.service.DeleteMessageBatch(context.WithoutCancel(ctx), c.queue, handled)
+		}
+	}
+}
+
+// ===== 6. Lambda Invocation Handler =====
+
+type LambdaInvoker struct {
+	functions map[string]*lambdaFunction
+	faults    *FaultInjector
+	recorder  *Recorder
+	mu        sync.RWMutex
+	stats     *LambdaStats
+}
+
+type LambdaStats struct {
+	Invocations int64
+	Successes   int64
+	Errors      int64
+	Throttles   int64
+	TotalTime   time.Duration
+}
+
+const defaultLambdaMemoryMB = 128
+
+// LambdaFunctionConfig controls how a registered function is run.
+type LambdaFunctionConfig struct {
+	// ReservedConcurrency caps concurrent invocations; further calls fail
+	// with TooManyRequestsException. 0 means unlimited.
+	ReservedConcurrency int
+	// ColdStartLatency is added to an invocation that has no warm
+	// execution environment to reuse.
+	ColdStartLatency time.Duration
+	// MemoryMB is used for GB-second accounting; 0 means 128.
+	MemoryMB int
+}
+
+// LambdaFunctionStats is a snapshot of one function's invocation metrics.
+type LambdaFunctionStats struct {
+	Invocations    int64
+	Errors         int64
+	Throttles      int64
+	ColdStarts     int64
+	ConcurrentPeak int
+	TotalDuration  time.Duration
+	MaxDuration    time.Duration
+	// BilledDuration rounds each invocation up to the next millisecond.
+	BilledDuration time.Duration
+	GBSeconds      float64
+}
+
+type lambdaFunction struct {
+	handler  func(context.Context, []byte) ([]byte, error)
+	config   LambdaFunctionConfig
+	mu       sync.Mutex
+	inFlight int
+	warm     int // idle execution environments
+	stats    LambdaFunctionStats
+}
+
+func NewLambdaInvoker() *LambdaInvoker {
+	return &LambdaInvoker{
+		functions: make(map[string]*lambdaFunction),
+		stats:     &LambdaStats{},
+	}
+}
+
+// SetFaultInjector makes the invoker consult fi before each invocation.
+// Call it before the invoker is in use.
+func (li *LambdaInvoker) SetFaultInjector(fi *FaultInjector) {
+	li.faults = fi
+}
+
+// SetRecorder makes the invoker record every call in r. Call it before the
+// invoker is in use.
+func (li *LambdaInvoker) SetRecorder(r *Recorder) {
+	li.recorder = r
+}
+
+func (li *LambdaInvoker) RegisterFunction(name string, fn func(context.Context, []byte) ([]byte, error)) {
+	li.RegisterFunctionWithConfig(name, fn, LambdaFunctionConfig{})
+}
+
+// RegisterFunctionWithConfig registers or replaces a function. Replacing
+// a function discards its warm environments and stats.
+func (li *LambdaInvoker) RegisterFunctionWithConfig(name string, fn func(context.Context, []byte) ([]byte, error), config LambdaFunctionConfig) {
+	if config.MemoryMB <= 0 {
+		config.MemoryMB = defaultLambdaMemoryMB
+	}
+
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.functions[name] = &lambdaFunction{handler: fn, config: config}
+}
+
+// FunctionStats returns a snapshot of a function's metrics.
+func (li *LambdaInvoker) FunctionStats(name string) (LambdaFunctionStats, bool) {
+	li.mu.RLock()
+	fn, exists := li.functions[name]
+	li.mu.RUnlock()
+
+	if !exists {
+		return LambdaFunctionStats{}, false
+	}
+
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	return fn.stats, true
+}
+
+func (li *LambdaInvoker) InvokSync(ctx context.Context, functionName string, payload []byte) ([]byte, error) {
+	li.recorder.Record("lambda", "Invoke", functionName, map[string]string{"Payload": string(payload)})
+	if err := li.faults.Inject(ctx, "lambda", "Invoke", functionName); err != nil {
+		return nil, err
+	}
+
+	li.mu.RLock()
+	fn, exists := li.functions[functionName]
+	li.mu.RUnlock()
+
+	if !exists {
+		atomic.AddInt64(&li.stats.Invocations, 1)
+		atomic.AddInt64(&li.stats.Errors, 1)
+		return nil, NewPermanentError("FunctionNotFound", "Function not found")
+	}
+
+	// Throttled calls never reach the function, so they are not counted as
+	// invocations, matching the Lambda metrics
+	cold, err := fn.acquire()
+	if err != nil {
+		atomic.AddInt64(&li.stats.Throttles, 1)
+		return nil, err
+	}
+
+	atomic.AddInt64(&li.stats.Invocations, 1)
+	start := time.Now()
+	defer func() { atomic.AddInt64((*int64)(&li.stats.TotalTime), int64(time.Since(start))) }()
+
+	if cold && fn.config.ColdStartLatency > 0 {
+		select {
+		case <-time.After(fn.config.ColdStartLatency):
+		case <-ctx.Done():
+			// The environment never finished initializing
+			fn.release(time.Since(start), false, false)
+			atomic.AddInt64(&li.stats.Errors, 1)
+			return nil, ctx.Err()
+		}
+	}
+
+	invokeStart := time.Now()
+	result, err := fn.handler(ctx, payload)
+	fn.release(time.Since(invokeStart), err != nil, true)
+
+	if err != nil {
+		atomic.AddInt64(&li.stats.Errors, 1)
+		return nil, err
+	}
+
+	atomic.AddInt64(&li.stats.Successes, 1)
+	return result, nil
+}
+
+// acquire reserves an execution environment, reporting whether it has to
+// be cold started.
+func (fn *lambdaFunction) acquire() (bool, error) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	if fn.config.ReservedConcurrency > 0 && fn.inFlight >= fn.config.ReservedConcurrency {
+		fn.stats.Throttles++
+		return false, NewTransientError("TooManyRequestsException", "Rate exceeded: reserved concurrency limit reached")
+	}
+
+	fn.inFlight++
+	fn.stats.Invocations++
+	fn.stats.ConcurrentPeak = max(fn.stats.ConcurrentPeak, fn.inFlight)
+
+	if fn.warm > 0 {
+		fn.warm--
+		return false, nil
+	}
+	fn.stats.ColdStarts++
+	return true, nil
+}
+
+// release returns the environment, keeping it warm when it initialized
+// successfully, and records the invocation's duration.
+func (fn *lambdaFunction) release(duration time.Duration, failed, keepWarm bool) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	fn.inFlight--
+	if keepWarm {
+		fn.warm++
+	}
+	if failed || !keepWarm {
+		fn.stats.Errors++
+	}
+
+	billed := duration.Truncate(time.Millisecond)
+	if billed < duration {
+		billed += time.Millisecond
+	}
+	fn.stats.TotalDuration += duration
+	fn.stats.MaxDuration = max(fn.stats.MaxDuration, duration)
+	fn.stats.BilledDuration += billed
+	fn.stats.GBSeconds += float64(fn.config.MemoryMB) / 1024 * billed.Seconds()
+}
+
+// InvokeWithRetry invokes a function, retrying transient errors such as
+// throttling with the policy's backoff.
+func (li *LambdaInvoker) InvokeWithRetry(ctx context.Context, rp *RetryPolicy, functionName string, payload []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := li.InvokSync(ctx, functionName, payload)
+		if err == nil {
+			return result, nil
+		}
+
+		retErr, ok := err.(*RetryableError)
+		if !ok || !retErr.Transient || attempt >= rp.maxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(rp.GetBackoffDuration(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (li *LambdaInvoker) InvokeAsync(ctx context.Context, functionName string, payload []byte, callback func([]byte, error)) error {
+	go func() {
+		result, err := li.InvokSync(ctx, functionName, payload)
+		callback(result, err)
+	}()
+	return nil
+}
+
+// ===== 6a. Lambda Event Source Mappings =====
+
+const mockAccountID = "123456789012"
+
+// SQSEvent is the payload Lambda passes to functions triggered by SQS.
+type SQSEvent struct {
+	Records []SQSEventRecord `json:"Records"`
+}
+
+type SQSEventRecord struct {
+	MessageID         string                              `json:"messageId"`
+	ReceiptHandle     string                              `json:"receiptHandle"`
+	Body              string                              `json:"body"`
+	Attributes        map[string]string                   `json:"attributes"`
+	MessageAttributes map[string]SQSEventMessageAttribute `json:"messageAttributes"`
+	MD5OfBody         string                              `json:"md5OfBody"`
+	EventSource       string                              `json:"eventSource"`
+	EventSourceARN    string                              `json:"eventSourceARN"`
+	AWSRegion         string                              `json:"awsRegion"`
+}
+
+type SQSEventMessageAttribute struct {
+	StringValue string `json:"stringValue"`
+	DataType    string `json:"dataType"`
+}
+
+// SQSBatchResponse is what a function returns to report which records
+// failed when ReportBatchItemFailures is enabled.
+type SQSBatchResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+type EventSourceMappingConfig struct {
+	// BatchSize is the most records per invocation, 1 to 10; 0 means 10.
+	BatchSize int
+	// MaxConcurrency is the number of pollers; 0 means 2.
+	MaxConcurrency int
+	// WaitTime is the long-poll wait per receive; 0 means 20 seconds.
+	WaitTime time.Duration
+	// ReportBatchItemFailures lets the function return an SQSBatchResponse
+	// so only the failed records are retried.
+	ReportBatchItemFailures bool
+}
+
+type EventSourceMappingStats struct {
+	Batches      int64
+	Records      int64
+	Succeeded    int64
+	Failed       int64
+	InvokeErrors int64
+}
+
+// EventSourceMapping polls an SQS queue and invokes a function with batches
+// of records. Records of a successful invocation are deleted; the rest stay
+// in the queue and are retried once their visibility timeout expires.
+type EventSourceMapping struct {
+	invoker  *LambdaInvoker
+	sqs      *MockSQSService
+	queue    string
+	function string
+	config   EventSourceMappingConfig
+	stats    *EventSourceMappingStats
+}
+
+func NewEventSourceMapping(invoker *LambdaInvoker, sqs *MockSQSService, queue, function string, config EventSourceMappingConfig) *EventSourceMapping {
+	if config.BatchSize <= 0 || config.BatchSize > maxBatchEntries {
+		config.BatchSize = maxBatchEntries
+	}
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = 2
+	}
+	if config.WaitTime <= 0 || config.WaitTime > maxWaitTime {
+		config.WaitTime = maxWaitTime
+	}
+
+	return &EventSourceMapping{
+		invoker:  invoker,
+		sqs:      sqs,
+		queue:    queue,
+		function: function,
+		config:   config,
+		stats:    &EventSourceMappingStats{},
+	}
+}
+
+// Start runs the pollers until ctx is done.
+func (esm *EventSourceMapping) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < esm.config.MaxConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if _, err := esm.Poll(ctx); err != nil {
+					select {
+					case <-ctx.Done():
+					case <-time.After(100 * time.Millisecond):
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Poll receives one batch, waiting up to WaitTime for messages, and
+// processes it. It returns the number of records delivered to the function.
+func (esm *EventSourceMapping) Poll(ctx context.Context) (int, error) {
+	messages, err := esm.sqs.ReceiveMessagesWait(ctx, esm.queue, esm.config.BatchSize, esm.config.WaitTime)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	atomic.AddInt64(&esm.stats.Batches, 1)
+	atomic.AddInt64(&esm.stats.Records, int64(len(messages)))
+
+	event := SQSEvent{Records: make([]SQSEventRecord, len(messages))}
+	for i, msg := range messages {
+		event.Records[i] = esm.record(msg)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := esm.invoker.InvokSync(ctx, esm.function, payload)
+	if err != nil {
+		// The whole batch becomes visible again after the timeout
+		atomic.AddInt64(&esm.stats.InvokeErrors, 1)
+		atomic.AddInt64(&esm.stats.Failed, int64(len(messages)))
+		return len(messages), err
+	}
+
+	failed := esm.batchItemFailures(result, messages)
+
+	var handles []string
+	for _, msg := range messages {
+		if !failed[msg.MessageID] {
+			handles = append(handles, msg.ReceiptHandle)
+		}
+	}
+	if len(handles) > 0 {
+		esm.sqs.DeleteMessageBatch(ctx, esm.queue, handles)
+	}
+
+	atomic.AddInt64(&esm.stats.Succeeded, int64(len(handles)))
+	atomic.AddInt64(&esm.stats.Failed, int64(len(messages)-len(handles)))
+	return len(messages), nil
 }
 
-type SQSQueue struct {
-	Name           string
-	Messages       []*SQSMessage
-	DeadLetterQueueName string
-	VisibilityTimeout   time.Duration
-	mu             sync.RWMutex
+// batchItemFailures returns the IDs of the records to retry. As in Lambda,
+// an empty response means success, while an unparseable response or one
+// naming an unknown record fails the whole batch.
+func (esm *EventSourceMapping) batchItemFailures(result []byte, messages []*SQSMessage) map[string]bool {
+	failed := make(map[string]bool)
+	if !esm.config.ReportBatchItemFailures || len(bytes.TrimSpace(result)) == 0 {
+		return failed
+	}
+
+	all := func() map[string]bool {
+		for _, msg := range messages {
+			failed[msg.MessageID] = true
+		}
+		return failed
+	}
+
+	var resp SQSBatchResponse
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return all()
+	}
+	for _, item := range resp.BatchItemFailures {
+		if !slices.ContainsFunc(messages, func(msg *SQSMessage) bool { return msg.MessageID == item.ItemIdentifier }) {
+			return all()
+		}
+		failed[item.ItemIdentifier] = true
+	}
+	return failed
 }
 
-type MockSQSService struct {
-	Queues map[string]*SQSQueue
-	mu     sync.RWMutex
-	stats  *SQSStats
+func (esm *EventSourceMapping) record(msg *SQSMessage) SQSEventRecord {
+	attributes := map[string]string{
+		"ApproximateReceiveCount": strconv.Itoa(msg.ReceiveCount),
+		"SentTimestamp":           strconv.FormatInt(msg.Timestamp.UnixMilli(), 10),
+		"SenderId":                mockAccountID,
+	}
+	if msg.MessageGroupID != "" {
+		attributes["MessageGroupId"] = msg.MessageGroupID
+		attributes["MessageDeduplicationId"] = msg.DeduplicationID
+		attributes["SequenceNumber"] = msg.SequenceNumber
+	}
+
+	messageAttributes := make(map[string]SQSEventMessageAttribute, len(msg.Attributes))
+	for name, value := range msg.Attributes {
+		messageAttributes[name] = SQSEventMessageAttribute{StringValue: value, DataType: "String"}
+	}
+
+	return SQSEventRecord{
+		MessageID:         msg.MessageID,
+		ReceiptHandle:     msg.ReceiptHandle,
+		Body:              msg.Body,
+		Attributes:        attributes,
+		MessageAttributes: messageAttributes,
+		MD5OfBody:         fmt.Sprintf("%x", md5.Sum([]byte(msg.Body))),
+		EventSource:       "aws:sqs",
+		EventSourceARN:    fmt.Sprintf("arn:aws:sqs:%s:%s:%s", mockRegion, mockAccountID, esm.queue),
+		AWSRegion:         mockRegion,
+	}
 }
 
-type SQSStats struct {
-	PublishCount   int64
-	ConsumeCount   int64
-	DeleteCount    int64
-	ReceiveCount   int64
-	DLQCount       int64
+// ===== 7. Mock DynamoDB Service =====
+
+// Item is a DynamoDB item. Key attributes must be strings or numbers; other
+// attributes can hold any value.
+type Item map[string]any
+
+// TableSchema describes a table's primary key. RangeKey is optional. When
+// VersionAttribute is set, writes use optimistic locking: the version an
+// item is written with must match the stored one (or be absent for a new
+// item), and every successful write increments it.
+type TableSchema struct {
+	HashKey          string
+	RangeKey         string
+	VersionAttribute string
 }
 
-func NewMockSQSService() *MockSQSService {
-	return &MockSQSService{
-		Queues: make(map[string]*SQSQueue),
-		stats:  &SQSStats{},
+type ConditionOp string
+
+const (
+	CondAttributeExists    ConditionOp = "attribute_exists"
+	CondAttributeNotExists ConditionOp = "attribute_not_exists"
+	CondEquals             ConditionOp = "="
+	CondNotEquals          ConditionOp = "<>"
+)
+
+// Condition is one clause of a condition expression, evaluated against the
+// stored item before a write. All conditions of a write must hold.
+type Condition struct {
+	Op        ConditionOp
+	Attribute string
+	Value     any
+}
+
+type PutItemInput struct {
+	TableName  string
+	Item       Item
+	Conditions []Condition
+}
+
+// UpdateItemInput sets and removes attributes of the item with Key,
+// creating it if it does not exist. On a versioned table, setting the
+// version attribute means "expect this version", as with PutItem.
+type UpdateItemInput struct {
+	TableName  string
+	Key        Item
+	Set        map[string]any
+	Remove     []string
+	Conditions []Condition
+}
+
+type KeyConditionOp string
+
+const (
+	KeyEquals       KeyConditionOp = "="
+	KeyLess         KeyConditionOp = "<"
+	KeyLessEqual    KeyConditionOp = "<="
+	KeyGreater      KeyConditionOp = ">"
+	KeyGreaterEqual KeyConditionOp = ">="
+	KeyBetween      KeyConditionOp = "BETWEEN"
+	KeyBeginsWith   KeyConditionOp = "begins_with"
+)
+
+// KeyCondition restricts the range key of a query. Value2 is the upper
+// bound for KeyBetween.
+type KeyCondition struct {
+	Op     KeyConditionOp
+	Value  any
+	Value2 any
+}
+
+type QueryInput struct {
+	TableName      string
+	HashKey        any
+	RangeCondition *KeyCondition
+	// Descending returns items in reverse range key order, like
+	// ScanIndexForward=false.
+	Descending        bool
+	Limit             int
+	ExclusiveStartKey Item
+}
+
+// QueryOutput holds one page of results. LastEvaluatedKey is set when the
+// Limit cut the page short; pass it as ExclusiveStartKey to continue.
+type QueryOutput struct {
+	Items            []Item
+	Count            int
+	LastEvaluatedKey Item
+}
+
+type dynamoTable struct {
+	name   string
+	schema TableSchema
+	// partitions maps an encoded hash key to its items, sorted by range key
+	partitions map[string][]Item
+	mu         sync.RWMutex
+}
+
+type MockDynamoService struct {
+	Tables   map[string]*dynamoTable
+	faults   *FaultInjector
+	recorder *Recorder
+	mu       sync.RWMutex
+	stats    *DynamoStats
+}
+
+type DynamoStats struct {
+	PutCount            int64
+	GetCount            int64
+	QueryCount          int64
+	UpdateCount         int64
+	ConditionalFailures int64
+}
+
+func NewMockDynamoService() *MockDynamoService {
+	return &MockDynamoService{
+		Tables: make(map[string]*dynamoTable),
+		stats:  &DynamoStats{},
 	}
 }
 
-func (m *MockSQSService) CreateQueue(queueName string) error {
+// SetFaultInjector makes the service consult fi before each operation.
+// Call it before the service is in use.
+func (m *MockDynamoService) SetFaultInjector(fi *FaultInjector) {
+	m.faults = fi
+}
+
+// SetRecorder makes the service record every call in r. Call it before the
+// service is in use.
+func (m *MockDynamoService) SetRecorder(r *Recorder) {
+	m.recorder = r
+}
+
+func (m *MockDynamoService) CreateTable(tableName string, schema TableSchema) error {
+	if schema.HashKey == "" {
+		return NewPermanentError("ValidationException", "A table requires a hash key")
+	}
+	if schema.VersionAttribute != "" && (schema.VersionAttribute == schema.HashKey || schema.VersionAttribute == schema.RangeKey) {
+		return NewPermanentError("ValidationException", "The version attribute cannot be part of the key")
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.Queues[queueName]; exists {
-		return NewPermanentError("QueueAlreadyExists", "Queue already exists")
+	if _, exists := m.Tables[tableName]; exists {
+		return NewPermanentError("ResourceInUseException", "Table already exists")
 	}
 
-	m.Queues[queueName] = &SQSQueue{
-		Name:              queueName,
-		Messages:          make([]*SQSMessage, 0),
-		VisibilityTimeout: 30 * time.Second,
+	m.Tables[tableName] = &dynamoTable{
+		name:       tableName,
+		schema:     schema,
+		partitions: make(map[string][]Item),
 	}
 	return nil
 }
 
-func (m *MockSQSService) PublishMessage(ctx context.Context, queueName, body string, attributes map[string]string) (string, error) {
+func (m *MockDynamoService) getTable(tableName string) (*dynamoTable, error) {
 	m.mu.RLock()
-	queue, exists := m.Queues[queueName]
-	m.mu.RUnlock()
+	defer m.mu.RUnlock()
 
+	table, exists := m.Tables[tableName]
 	if !exists {
-		return "", NewPermanentError("QueueDoesNotExist", "Queue does not exist")
+		return nil, NewPermanentError("ResourceNotFoundException", "Table does not exist")
 	}
+	return table, nil
+}
 
-	messageID := generateMessageID()
+// PutItem replaces the whole item with the same key and returns the item
+// as stored, including its new version on a versioned table.
+func (m *MockDynamoService) PutItem(ctx context.Context, input PutItemInput) (Item, error) {
+	m.recorder.Record("dynamodb", "PutItem", input.TableName, nil)
+	if err := m.faults.Inject(ctx, "dynamodb", "PutItem", input.TableName); err != nil {
+		return nil, err
+	}
 
-	queue.mu.Lock()
-	defer queue.mu.Unlock()
+	table, err := m.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
 
-	msg := &SQSMessage{
-		MessageID:     messageID,
-		Body:          body,
-		Attributes:    attributes,
-		ReceiptHandle: generateReceiptHandle(),
-		Timestamp:     time.Now(),
+	hash, rangeKey, err := table.key(input.Item)
+	if err != nil {
+		return nil, err
 	}
 
-	queue.Messages = append(queue.Messages, msg)
-	atomic.AddInt64(&m.stats.PublishCount, 1)
+	table.mu.Lock()
+	defer table.mu.Unlock()
 
-	return messageID, nil
+	current, _ := table.find(hash, rangeKey)
+	item := maps.Clone(input.Item)
+	if err := m.checkWrite(table, current, item, input.Conditions); err != nil {
+		return nil, err
+	}
+
+	table.store(hash, item)
+	atomic.AddInt64(&m.stats.PutCount, 1)
+	return maps.Clone(item), nil
 }
 
-func (m *MockSQSService) ReceiveMessages(ctx context.Context, queueName string, maxMessages int) ([]*SQSMessage, error) {
-	m.mu.RLock()
-	queue, exists := m.Queues[queueName]
-	m.mu.RUnlock()
+// GetItem returns the item with key, or nil if there is none.
+func (m *MockDynamoService) GetItem(ctx context.Context, tableName string, key Item) (Item, error) {
+	m.recorder.Record("dynamodb", "GetItem", tableName, nil)
+	if err := m.faults.Inject(ctx, "dynamodb", "GetItem", tableName); err != nil {
+		return nil, err
+	}
 
-	if !exists {
-		return nil, NewPermanentError("QueueDoesNotExist", "Queue does not exist")
+	table, err := m.getTable(tableName)
+	if err != nil {
+		return nil, err
 	}
 
-	queue.mu.Lock()
-	defer queue.mu.Unlock()
+	hash, rangeKey, err := table.key(key)
+	if err != nil {
+		return nil, err
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	atomic.AddInt64(&m.stats.GetCount, 1)
+	item, _ := table.find(hash, rangeKey)
+	return maps.Clone(item), nil
+}
 
-	if len(queue.Messages) == 0 {
-		return []*SQSMessage{}, nil
+// UpdateItem applies input to the stored item, or to a new item holding
+// just the key, and returns the result.
+func (m *MockDynamoService) UpdateItem(ctx context.Context, input UpdateItemInput) (Item, error) {
+	m.recorder.Record("dynamodb", "UpdateItem", input.TableName, nil)
+	if err := m.faults.Inject(ctx, "dynamodb", "UpdateItem", input.TableName); err != nil {
+		return nil, err
 	}
 
-	count := maxMessages
-	if count > len(queue.Messages) {
-		count = len(queue.Messages)
+	table, err := m.getTable(input.TableName)
+	if err != nil {
+		return nil, err
 	}
 
-	messages := queue.Messages[:count]
-	queue.Messages = queue.Messages[count:]
+	hash, rangeKey, err := table.key(input.Key)
+	if err != nil {
+		return nil, err
+	}
 
-	atomic.AddInt64(&m.stats.ReceiveCount, 1)
-	return messages, nil
-}
+	for _, name := range append(slices.Collect(maps.Keys(input.Set)), input.Remove...) {
+		if name == table.schema.HashKey || name == table.schema.RangeKey {
+			return nil, NewPermanentError("ValidationException", fmt.Sprintf("Cannot update attribute %s. This attribute is part of the key", name))
+		}
+	}
 
-func (m *MockSQSService) DeleteMessage(ctx context.Context, queueName, receiptHandle string) error {
-	atomic.AddInt64(&m.stats.DeleteCount, 1)
-	return nil
-}
+	table.mu.Lock()
+	defer table.mu.Unlock()
 
-// ===== 5. SQS Producer/Consumer =====
+	current, _ := table.find(hash, rangeKey)
+	item := maps.Clone(current)
+	if item == nil {
+		item = Item{table.schema.HashKey: input.Key[table.schema.HashKey]}
+		if table.schema.RangeKey != "" {
+			item[table.schema.RangeKey] = input.Key[table.schema.RangeKey]
+		}
+	}
+	// Without an expected version in Set, the item keeps the stored
+	// version, so the update applies to whatever version is current
+	for name, value := range input.Set {
+		item[name] = value
+	}
+	for _, name := range input.Remove {
+		delete(item, name)
+	}
 
-type SQSProducer struct {
-	service *MockSQSService
-	queue   string
-}
+	if err := m.checkWrite(table, current, item, input.Conditions); err != nil {
+		return nil, err
+	}
 
-type SQSConsumer struct {
-	service *MockSQSService
-	queue   string
-	handler func(*SQSMessage) error
+	table.store(hash, item)
+	atomic.AddInt64(&m.stats.UpdateCount, 1)
+	return maps.Clone(item), nil
 }
 
-func NewSQSProducer(service *MockSQSService, queue string) *SQSProducer {
-	return &SQSProducer{
-		service: service,
-		queue:   queue,
+// Query returns the items with the given hash key, in range key order,
+// whose range key satisfies the condition.
+func (m *MockDynamoService) Query(ctx context.Context, input QueryInput) (*QueryOutput, error) {
+	m.recorder.Record("dynamodb", "Query", input.TableName, map[string]string{"HashKey": fmt.Sprint(input.HashKey)})
+	if err := m.faults.Inject(ctx, "dynamodb", "Query", input.TableName); err != nil {
+		return nil, err
+	}
+
+	table, err := m.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := encodeKeyValue(table.schema.HashKey, input.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	if input.RangeCondition != nil && table.schema.RangeKey == "" {
+		return nil, NewPermanentError("ValidationException", "The table has no range key to query on")
+	}
+	if input.Limit < 0 {
+		return nil, NewPermanentError("ValidationException", "Limit must be positive")
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	items := table.partitions[hash]
+	if input.Descending {
+		items = slices.Clone(items)
+		slices.Reverse(items)
+	}
+
+	start := 0
+	if input.ExclusiveStartKey != nil && table.schema.RangeKey != "" {
+		after := input.ExclusiveStartKey[table.schema.RangeKey]
+		start = len(items)
+		for i, item := range items {
+			c := compareKeyValues(item[table.schema.RangeKey], after)
+			if (input.Descending && c < 0) || (!input.Descending && c > 0) {
+				start = i
+				break
+			}
+		}
+	} else if input.ExclusiveStartKey != nil {
+		start = len(items)
+	}
+
+	out := &QueryOutput{Items: []Item{}}
+	for _, item := range items[start:] {
+		if input.RangeCondition != nil && !input.RangeCondition.matches(item[table.schema.RangeKey]) {
+			continue
+		}
+		if input.Limit > 0 && len(out.Items) == input.Limit {
+			out.LastEvaluatedKey = table.keyOf(out.Items[len(out.Items)-1])
+			break
+		}
+		out.Items = append(out.Items, maps.Clone(item))
 	}
+	out.Count = len(out.Items)
+
+	atomic.AddInt64(&m.stats.QueryCount, 1)
+	return out, nil
 }
 
-func (p *SQSProducer) PublishBatch(ctx context.Context, messages []string) error {
-	for _, msg := range messages {
-		_, err := p.service.PublishMessage(ctx, p.queue, msg, make(map[string]string))
-		if err != nil {
-			return err
+// checkWrite evaluates the write's conditions and, on a versioned table,
+// the optimistic lock, then sets item's new version. Must be called with
+// t.mu held.
+func (m *MockDynamoService) checkWrite(t *dynamoTable, current, item Item, conditions []Condition) error {
+	for _, cond := range conditions {
+		if !cond.holds(current) {
+			atomic.AddInt64(&m.stats.ConditionalFailures, 1)
+			return NewPermanentError("ConditionalCheckFailedException", "The conditional request failed")
 		}
 	}
+
+	v := t.schema.VersionAttribute
+	if v == "" {
+		return nil
+	}
+
+	expected, hasExpected := toNumber(item[v])
+	stored, hasStored := toNumber(current[v])
+	if hasExpected != hasStored || expected != stored {
+		atomic.AddInt64(&m.stats.ConditionalFailures, 1)
+		return NewPermanentError("ConditionalCheckFailedException", fmt.Sprintf("Version conflict on attribute %s", v))
+	}
+	item[v] = int64(stored) + 1
 	return nil
 }
 
-func NewSQSConsumer(service *MockSQSService, queue string, handler func(*SQSMessage) error) *SQSConsumer {
-	return &SQSConsumer{
-		service: service,
-		queue:   queue,
-		handler: handler,
+func (c Condition) holds(item Item) bool {
+	value, exists := item[c.Attribute]
+	switch c.Op {
+	case CondAttributeExists:
+		return exists
+	case CondAttributeNotExists:
+		return !exists
+	case CondEquals:
+		return exists && valuesEqual(value, c.Value)
+	case CondNotEquals:
+		return !exists || !valuesEqual(value, c.Value)
+	default:
+		return false
 	}
 }
 
-func (c *SQSConsumer) Start(ctx context.Context, concurrency int) {
-	var wg sync.WaitGroup
-	for i := 0; i < concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c.pollMessages(ctx)
-		}()
+func (kc *KeyCondition) matches(value any) bool {
+	c := compareKeyValues(value, kc.Value)
+	switch kc.Op {
+	case KeyEquals:
+		return c == 0
+	case KeyLess:
+		return c < 0
+	case KeyLessEqual:
+		return c <= 0
+	case KeyGreater:
+		return c > 0
+	case KeyGreaterEqual:
+		return c >= 0
+	case KeyBetween:
+		return c >= 0 && compareKeyValues(value, kc.Value2) <= 0
+	case KeyBeginsWith:
+		s, ok := value.(string)
+		prefix, okPrefix := kc.Value.(string)
+		return ok && okPrefix && strings.HasPrefix(s, prefix)
+	default:
+		return false
 	}
-	wg.Wait()
 }
 
-func (c *SQSConsumer) pollMessages(ctx context.Context) {
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+// key validates the key attributes of item and returns its encoded hash
+// key and raw range key.
+func (t *dynamoTable) key(item Item) (string, any, error) {
+	hash, err := encodeKeyValue(t.schema.HashKey, item[t.schema.HashKey])
+	if err != nil {
+		return "", nil, err
+	}
+	if t.schema.RangeKey == "" {
+		return hash, nil, nil
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			messages, err := c.service.ReceiveMessages(ctx, c.queue, 10)
-			if err != nil {
-				continue
-			}
+	rangeKey := item[t.schema.RangeKey]
+	if _, err := encodeKeyValue(t.schema.RangeKey, rangeKey); err != nil {
+		return "", nil, err
+	}
+	return hash, rangeKey, nil
+}
 
-			for _, msg := range messages {
-				if err := c.handler(msg); err == nil {
-					c.service.DeleteMessage(ctx, c.queue, msg.ReceiptHandle)
-				}
-			}
+func (t *dynamoTable) keyOf(item Item) Item {
+	key := Item{t.schema.HashKey: item[t.schema.HashKey]}
+	if t.schema.RangeKey != "" {
+		key[t.schema.RangeKey] = item[t.schema.RangeKey]
+	}
+	return key
+}
+
+// find must be called with t.mu held.
+func (t *dynamoTable) find(hash string, rangeKey any) (Item, int) {
+	items := t.partitions[hash]
+	if t.schema.RangeKey == "" {
+		if len(items) == 0 {
+			return nil, 0
 		}
+		return items[0], 0
+	}
+
+	i, found := slices.BinarySearchFunc(items, rangeKey, func(item Item, target any) int {
+		return compareKeyValues(item[t.schema.RangeKey], target)
+	})
+	if !found {
+		return nil, i
 	}
+	return items[i], i
 }
 
-// ===== 6. Lambda Invocation Handler =====
+// store inserts or replaces item in its partition. Must be called with
+// t.mu held.
+func (t *dynamoTable) store(hash string, item Item) {
+	current, i := t.find(hash, item[t.schema.RangeKey])
+	if current != nil {
+		t.partitions[hash][i] = item
+		return
+	}
+	t.partitions[hash] = slices.Insert(t.partitions[hash], i, item)
+}
 
-type LambdaInvoker struct {
-	functions map[string]func(context.Context, []byte) ([]byte, error)
-	mu        sync.RWMutex
-	stats     *LambdaStats
+// encodeKeyValue checks that a key attribute is a string or a number and
+// returns a form that can be used as a map key.
+func encodeKeyValue(name string, value any) (string, error) {
+	if s, ok := value.(string); ok && s != "" {
+		return "S:" + s, nil
+	}
+	if n, ok := toNumber(value); ok {
+		return "N:" + strconv.FormatFloat(n, 'g', -1, 64), nil
+	}
+	return "", NewPermanentError("ValidationException", fmt.Sprintf("Key attribute %s must be a non-empty string or a number", name))
 }
 
-type LambdaStats struct {
-	Invocations int64
-	Successes   int64
-	Errors      int64
-	TotalTime   time.Duration
+// compareKeyValues orders numbers numerically and strings lexically, with
+// all numbers before all strings.
+func compareKeyValues(a, b any) int {
+	na, aNum := toNumber(a)
+	nb, bNum := toNumber(b)
+	switch {
+	case aNum && bNum:
+		return cmp.Compare(na, nb)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	sa, _ := a.(string)
+	sb, _ := b.(string)
+	return strings.Compare(sa, sb)
 }
 
-func NewLambdaInvoker() *LambdaInvoker {
-	return &LambdaInvoker{
-		functions: make(map[string]func(context.Context, []byte) ([]byte, error)),
-		stats:     &LambdaStats{},
+func valuesEqual(a, b any) bool {
+	na, aNum := toNumber(a)
+	nb, bNum := toNumber(b)
+	if aNum || bNum {
+		return aNum && bNum && na == nb
 	}
+	return reflect.DeepEqual(a, b)
 }
 
-func (li *LambdaInvoker) RegisterFunction(name string, fn func(context.Context, []byte) ([]byte, error)) {
-	li.mu.Lock()
-	defer li.mu.Unlock()
-	li.functions[name] = fn
+func toNumber(value any) (float64, bool) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
 }
 
-func (li *LambdaInvoker) InvokSync(ctx context.Context, functionName string, payload []byte) ([]byte, error) {
-	atomic.AddInt64(&li.stats.Invocations, 1)
-	start := time.Now()
-	defer func() { li.stats.TotalTime += time.Since(start) }()
+// ===== 8. Helper Functions =====
 
-	li.mu.RLock()
-	fn, exists := li.functions[functionName]
-	li.mu.RUnlock()
+// Clock lets tests control time in the mocks.
+type Clock interface {
+	Now() time.Time
+}
 
-	if !exists {
-		atomic.AddInt64(&li.stats.Errors, 1)
-		return nil, NewPermanentError("FunctionNotFound", "Function not found")
-	}
+type realClock struct{}
 
-	result, err := fn(ctx, payload)
-	if err != nil {
-		atomic.AddInt64(&li.stats.Errors, 1)
-		return nil, err
-	}
+func (realClock) Now() time.Time { return time.Now() }
 
-	atomic.AddInt64(&li.stats.Successes, 1)
-	return result, nil
+// ManualClock is a Clock that only moves when advanced.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
 }
 
-func (li *LambdaInvoker) InvokeAsync(ctx context.Context, functionName string, payload []byte, callback func([]byte, error)) error {
-	go func() {
-		result, err := li.InvokSync(ctx, functionName, payload)
-		callback(result, err)
-	}()
-	return nil
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
 }
 
-// ===== 7. Helper Functions =====
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
 
 func generateETag(data []byte) []byte {
 	hash := sha256.Sum256(data)
@@ -592,10 +4268,19 @@ func generateReceiptHandle() string {
 	return fmt.Sprintf("receipt-%d", rand.Int63())
 }
 
+func generateVersionID() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+func generateUploadID() string {
+	return fmt.Sprintf("upload-%d", rand.Int63())
+}
+
 // ===== Main Demo =====
 
 func main() {
-	fmt.Println("=== AWS SDK Integration ===\n")
+	fmt.Println("=== AWS SDK Integration ===")
+	fmt.Println()
 
 	// 1. S3 Operations
 	fmt.Println("1. S3 Operations with Retry")
@@ -2,16 +2,35 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+	"unicode"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+	"gopkg.in/yaml.v3"
 )
 
 // Challenge 169: Code Generation with AST
@@ -28,13 +47,15 @@ type CodeAnalyzer struct {
 }
 
 type FunctionInfo struct {
-	Name      string
-	Receiver  string
-	Params    []*ParamInfo
-	Returns   []*ParamInfo
-	Lines     int
+	Name       string
+	Receiver   string
+	Params     []*ParamInfo
+	Returns    []*ParamInfo
+	Lines      int
 	Cyclomatic int
-	IsPublic  bool
+	Cognitive  int
+	Halstead   HalsteadMetrics
+	IsPublic   bool
 }
 
 type ParamInfo struct {
@@ -101,8 +122,9 @@ func (ca *CodeAnalyzer) AnalyzeCode(sourceCode string) error {
 }
 
 type analyzerVisitor struct {
-	analyzer *CodeAnalyzer
-	fset     *token.FileSet
+	analyzer  *CodeAnalyzer
+	fset      *token.FileSet
+	functions []*FunctionInfo // in visiting order
 }
 
 func (v *analyzerVisitor) Visit(node ast.Node) ast.Visitor {
@@ -165,10 +187,13 @@ func (v *analyzerVisitor) analyzeFunctionDecl(fn *ast.FuncDecl) {
 
 	// Calculate cyclomatic complexity
 	info.Cyclomatic = v.calculateCyclomaticComplexity(fn.Body)
+	info.Cognitive = cognitiveComplexity(fn)
+	info.Halstead = halsteadMetrics(fn.Body)
 
 	v.analyzer.mu.Lock()
 	v.analyzer.Functions[fn.Name.Name] = info
 	v.analyzer.mu.Unlock()
+	v.functions = append(v.functions, info)
 
 	atomic.AddInt64(&v.analyzer.Statistics.TotalFunctions, 1)
 	atomic.AddInt64(&v.analyzer.Statistics.TotalLines, int64(info.Lines))
@@ -194,6 +219,7 @@ func (v *analyzerVisitor) analyzeTypeSpec(spec *ast.TypeSpec) {
 		}
 	case *ast.InterfaceType:
 		info.Kind = "interface"
+		v.analyzeInterfaceMethods(spec.Name.Name, t)
 	default:
 		info.Kind = "alias"
 	}
@@ -209,6 +235,51 @@ func (v *analyzerVisitor) analyzeInterfaceType(iface *ast.InterfaceType) {
 	// Interface analysis handled during type spec analysis
 }
 
+// analyzeInterfaceMethods records the explicit methods of a named interface.
+// Embedded interfaces are skipped.
+func (v *analyzerVisitor) analyzeInterfaceMethods(name string, iface *ast.InterfaceType) {
+	info := &InterfaceInfo{
+		Name:     name,
+		IsPublic: ast.IsExported(name),
+	}
+
+	for _, field := range iface.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			continue
+		}
+		info.Methods = append(info.Methods, &MethodSignature{
+			Name:    field.Names[0].Name,
+			Params:  v.extractParams(fn.Params),
+			Returns: v.extractParams(fn.Results),
+		})
+	}
+
+	v.analyzer.mu.Lock()
+	v.analyzer.Interfaces[name] = info
+	v.analyzer.mu.Unlock()
+}
+
+// extractParams flattens a parameter or result list, one entry per name
+func (v *analyzerVisitor) extractParams(list *ast.FieldList) []*ParamInfo {
+	if list == nil {
+		return nil
+	}
+
+	var params []*ParamInfo
+	for _, field := range list.List {
+		typeName := v.extractTypeName(field.Type)
+		if len(field.Names) == 0 {
+			params = append(params, &ParamInfo{Type: typeName})
+			continue
+		}
+		for _, name := range field.Names {
+			params = append(params, &ParamInfo{Name: name.Name, Type: typeName})
+		}
+	}
+	return params
+}
+
 func (v *analyzerVisitor) extractTypeName(expr ast.Expr) string {
 	switch t := expr.(type) {
 	case *ast.Ident:
@@ -218,11 +289,14 @@ func (v *analyzerVisitor) extractTypeName(expr ast.Expr) string {
 	case *ast.StarExpr:
 		return "*" + v.extractTypeName(t.X)
 	case *ast.ArrayType:
+		if t.Len != nil {
+			return types.ExprString(t)
+		}
 		return "[]" + v.extractTypeName(t.Elt)
 	case *ast.MapType:
 		return fmt.Sprintf("map[%s]%s", v.extractTypeName(t.Key), v.extractTypeName(t.Value))
 	default:
-		return "unknown"
+		return types.ExprString(expr)
 	}
 }
 
@@ -246,7 +320,6 @@ func (v *analyzerVisitor) calculateCyclomaticComplexity(body *ast.BlockStmt) int
 func (ca *CodeAnalyzer) updateStatistics() {
 	ca.mu.RLock()
 	totalFuncs := int64(len(ca.Functions))
-	totalTypes := int64(len(ca.Types))
 	totalLines := atomic.LoadInt64(&ca.Statistics.TotalLines)
 	ca.mu.RUnlock()
 
@@ -276,6 +349,7 @@ func (ca *CodeAnalyzer) GetReport() map[string]interface{} {
 type CodeGenerator struct {
 	Package string
 	Imports []string
+	Schema  SchemaOptions
 	code    strings.Builder
 	mu      sync.Mutex
 }
@@ -439,7 +513,11 @@ func (cg *CodeGenerator) GenerateCompleteFile() (string, error) {
 
 	buf.WriteString(cg.code.String())
 
-	return buf.String(), nil
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(code), nil
 }
 
 // ===== 3. Code Transformer =====
@@ -521,6 +599,8 @@ func (ct *CodeTransformer) GetStats() map[string]int64 {
 
 type CustomLinter struct {
 	rules      map[string]*LintRule
+	analyzers  []*LintAnalyzer
+	policy     *lintPolicy // from ApplyRulePack
 	violations []*LintViolation
 	mu         sync.RWMutex
 }
@@ -536,11 +616,13 @@ type LintRule struct {
 }
 
 type LintViolation struct {
-	Rule    string
-	Line    int
-	Column  int
-	Message string
-	Code    string
+	Rule     string
+	Line     int
+	Column   int
+	Message  string
+	Code     string
+	Severity string
+	Fixes    []*SuggestedFix // machine-applicable fixes, from AST analyzers
 }
 
 func NewCustomLinter() *CustomLinter {
@@ -572,29 +654,55 @@ func (cl *CustomLinter) AddRule(id, name, description, pattern, severity string)
 }
 
 func (cl *CustomLinter) Lint(code string) []*LintViolation {
+	return cl.LintFile("", code)
+}
+
+// LintFile lints the code of file with the rules an applied rule pack
+// enables for its directory and the pack's severity overrides
+func (cl *CustomLinter) LintFile(file, code string) []*LintViolation {
 	cl.mu.RLock()
 	rules := cl.rules
+	var analyzers []*LintAnalyzer
+	disabled, severity := cl.policy.resolve(file)
+	for _, analyzer := range cl.analyzers {
+		if !disabled[analyzer.ID] {
+			analyzers = append(analyzers, analyzer)
+		}
+	}
 	cl.mu.RUnlock()
 
 	violations := make([]*LintViolation, 0)
 	lines := strings.Split(code, "\n")
 
 	for ruleID, rule := range rules {
+		if disabled[ruleID] {
+			continue
+		}
 		for lineNum, line := range lines {
 			matches := rule.regex.FindAllStringIndex(line, -1)
 			for _, match := range matches {
 				violations = append(violations, &LintViolation{
-					Rule:    ruleID,
-					Line:    lineNum + 1,
-					Column:  match[0] + 1,
-					Message: rule.Description,
-					Code:    line,
+					Rule:     ruleID,
+					Line:     lineNum + 1,
+					Column:   match[0] + 1,
+					Message:  rule.Description,
+					Code:     line,
+					Severity: rule.Severity,
 				})
 				atomic.AddInt64(&rule.Hits, 1)
 			}
 		}
 	}
 
+	if len(analyzers) > 0 {
+		violations = append(violations, cl.runAnalyzers(code, analyzers)...)
+	}
+	for _, v := range violations {
+		if level, ok := severity[v.Rule]; ok {
+			v.Severity = level
+		}
+	}
+
 	cl.mu.Lock()
 	cl.violations = violations
 	cl.mu.Unlock()
@@ -614,6 +722,11 @@ func (cl *CustomLinter) GetReport() map[string]interface{} {
 		totalViolations += hits
 		violationsByRule[rule.ID] = hits
 	}
+	for _, analyzer := range cl.analyzers {
+		hits := atomic.LoadInt64(&analyzer.Hits)
+		totalViolations += hits
+		violationsByRule[analyzer.ID] = hits
+	}
 
 	return map[string]interface{}{
 		"total_violations":    totalViolations,
@@ -622,10 +735,3763 @@ func (cl *CustomLinter) GetReport() map[string]interface{} {
 	}
 }
 
+// ===== 5. Package Analysis =====
+
+type PackageAnalysis struct {
+	Path            string
+	Name            string
+	Files           []string
+	Implementations map[string][]string // interface -> implementing types, "*T" when only the pointer does
+	CallGraph       map[string][]string // caller -> callees within the package
+	UnusedExported  []string
+	Complexity      ComplexityAggregate // over the package's functions
+	DeadCode        []*DeadCodeFinding
+}
+
+// AnalyzePackage loads the package in dir with go/packages, records its
+// functions and types like AnalyzeCode, and adds the cross-file views that a
+// single source string cannot give: interface implementations, a static call
+// graph and exported symbols nothing in the package refers to.
+func (ca *CodeAnalyzer) AnalyzePackage(dir string) (*PackageAnalysis, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+			packages.NeedTypes | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	pkg := pkgs[0]
+	if len(pkg.Errors) > 0 {
+		return nil, pkg.Errors[0]
+	}
+
+	v := &analyzerVisitor{analyzer: ca, fset: pkg.Fset}
+	for _, file := range pkg.Syntax {
+		ast.Walk(v, file)
+	}
+	ca.updateStatistics()
+
+	analysis := &PackageAnalysis{
+		Path:            pkg.PkgPath,
+		Name:            pkg.Name,
+		Files:           pkg.GoFiles,
+		Implementations: findImplementations(pkg.Types),
+		CallGraph:       buildCallGraph(pkg),
+		Complexity:      aggregateComplexity(v.functions),
+	}
+	analysis.UnusedExported = findUnusedExported(pkg, analysis.Implementations)
+	analysis.DeadCode = findDeadCode(pkg, analysis.Implementations)
+
+	return analysis, nil
+}
+
+// findImplementations pairs every named interface in the package with the
+// package's concrete types that satisfy it
+func findImplementations(pkg *types.Package) map[string][]string {
+	scope := pkg.Scope()
+	var ifaces, concrete []*types.TypeName
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || tn.IsAlias() {
+			continue
+		}
+		if iface, ok := tn.Type().Underlying().(*types.Interface); ok {
+			if iface.NumMethods() > 0 {
+				ifaces = append(ifaces, tn)
+			}
+		} else {
+			concrete = append(concrete, tn)
+		}
+	}
+
+	impls := make(map[string][]string)
+	for _, iface := range ifaces {
+		it := iface.Type().Underlying().(*types.Interface)
+		for _, tn := range concrete {
+			switch {
+			case types.Implements(tn.Type(), it):
+				impls[iface.Name()] = append(impls[iface.Name()], tn.Name())
+			case types.Implements(types.NewPointer(tn.Type()), it):
+				impls[iface.Name()] = append(impls[iface.Name()], "*"+tn.Name())
+			}
+		}
+	}
+	return impls
+}
+
+// buildCallGraph records the statically resolvable calls between functions
+// and methods of the package. Calls through an interface point at the
+// interface method.
+func buildCallGraph(pkg *packages.Package) map[string][]string {
+	graph := make(map[string][]string)
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			caller, ok := pkg.TypesInfo.Defs[fn.Name].(*types.Func)
+			if !ok {
+				continue
+			}
+
+			seen := make(map[string]bool)
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				var ident *ast.Ident
+				switch f := ast.Unparen(call.Fun).(type) {
+				case *ast.Ident:
+					ident = f
+				case *ast.SelectorExpr:
+					ident = f.Sel
+				default:
+					return true
+				}
+				callee, ok := pkg.TypesInfo.Uses[ident].(*types.Func)
+				if !ok || callee.Pkg() != pkg.Types {
+					return true
+				}
+				if name := funcName(callee); !seen[name] {
+					seen[name] = true
+					graph[funcName(caller)] = append(graph[funcName(caller)], name)
+				}
+				return true
+			})
+			sort.Strings(graph[funcName(caller)])
+		}
+	}
+	return graph
+}
+
+// findUnusedExported lists exported package-level symbols and methods that
+// are never referenced inside the package. Methods that let a type satisfy
+// one of the package's interfaces count as used.
+func findUnusedExported(pkg *packages.Package, impls map[string][]string) []string {
+	used := make(map[types.Object]bool)
+	for _, obj := range pkg.TypesInfo.Uses {
+		used[obj] = true
+	}
+	for _, sel := range pkg.TypesInfo.Selections {
+		used[sel.Obj()] = true
+	}
+
+	scope := pkg.Types.Scope()
+	satisfies := satisfyingMethods(scope, impls)
+
+	var unused []string
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		if obj.Exported() && !used[obj] {
+			unused = append(unused, name)
+		}
+
+		tn, ok := obj.(*types.TypeName)
+		if !ok {
+			continue
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok {
+			continue
+		}
+		for i := 0; i < named.NumMethods(); i++ {
+			m := named.Method(i)
+			key := funcName(m)
+			if m.Exported() && !used[m] && !satisfies[key] {
+				unused = append(unused, key)
+			}
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// satisfyingMethods lists, as "T.Method", the methods that let a type
+// satisfy one of the package's interfaces
+func satisfyingMethods(scope *types.Scope, impls map[string][]string) map[string]bool {
+	satisfies := make(map[string]bool)
+	for ifaceName, typeNames := range impls {
+		iface := scope.Lookup(ifaceName).Type().Underlying().(*types.Interface)
+		for _, typeName := range typeNames {
+			for i := 0; i < iface.NumMethods(); i++ {
+				satisfies[strings.TrimPrefix(typeName, "*")+"."+iface.Method(i).Name()] = true
+			}
+		}
+	}
+	return satisfies
+}
+
+// funcName names a function "F" and a method "T.M"
+func funcName(fn *types.Func) string {
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return fn.Name()
+	}
+	recv := sig.Recv().Type()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	if named, ok := recv.(*types.Named); ok {
+		return named.Obj().Name() + "." + fn.Name()
+	}
+	return fn.Name()
+}
+
+// ===== 6. Accessor Generation =====
+
+// GenerateAccessors emits, for a struct analyzed by CodeAnalyzer, a
+// New<Type> constructor taking functional options, a getter and setter per
+// field and a String method. The code is gofmt'd, added to the generator's
+// file and returned. Getters of exported fields are named Get<Field> so they
+// do not clash with the field. Packages used by field types must be added
+// with AddImport.
+func (cg *CodeGenerator) GenerateAccessors(info *TypeInfo) (string, error) {
+	if info.Kind != "struct" {
+		return "", fmt.Errorf("%s is a %s, not a struct", info.Name, info.Kind)
+	}
+
+	name := info.Name
+	recv := strings.ToLower(name[:1])
+	option := name + "Option"
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %s configures a %s built by New%s\n", option, name, name)
+	fmt.Fprintf(&buf, "type %s func(*%s)\n\n", option, name)
+
+	for _, field := range info.Fields {
+		fmt.Fprintf(&buf, "// With%s%s sets %s\n", name, exportName(field.Name), field.Name)
+		fmt.Fprintf(&buf, "func With%s%s(value %s) %s {\n", name, exportName(field.Name), field.Type, option)
+		fmt.Fprintf(&buf, "return func(%s *%s) { %s.%s = value }\n}\n\n", recv, name, recv, field.Name)
+	}
+
+	fmt.Fprintf(&buf, "// New%s creates a %s with the given options applied\n", name, name)
+	fmt.Fprintf(&buf, "func New%s(opts ...%s) *%s {\n", name, option, name)
+	fmt.Fprintf(&buf, "%s := &%s{}\nfor _, opt := range opts {\nopt(%s)\n}\nreturn %s\n}\n\n", recv, name, recv, recv)
+
+	for _, field := range info.Fields {
+		getter := exportName(field.Name)
+		if ast.IsExported(field.Name) {
+			getter = "Get" + getter
+		}
+		fmt.Fprintf(&buf, "// %s returns %s\n", getter, field.Name)
+		fmt.Fprintf(&buf, "func (%s *%s) %s() %s {\nreturn %s.%s\n}\n\n", recv, name, getter, field.Type, recv, field.Name)
+
+		setter := "Set" + exportName(field.Name)
+		fmt.Fprintf(&buf, "// %s sets %s\n", setter, field.Name)
+		fmt.Fprintf(&buf, "func (%s *%s) %s(value %s) {\n%s.%s = value\n}\n\n", recv, name, setter, field.Type, recv, field.Name)
+	}
+
+	verbs := make([]string, len(info.Fields))
+	args := make([]string, len(info.Fields))
+	for i, field := range info.Fields {
+		verbs[i] = field.Name + ": %v"
+		args[i] = ", " + recv + "." + field.Name
+	}
+	fmt.Fprintf(&buf, "// String describes the %s and its fields\n", name)
+	fmt.Fprintf(&buf, "func (%s *%s) String() string {\n", recv, name)
+	fmt.Fprintf(&buf, "return fmt.Sprintf(%q%s)\n}\n", name+"{"+strings.Join(verbs, ", ")+"}", strings.Join(args, ""))
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	cg.AddImport("fmt")
+	cg.mu.Lock()
+	cg.code.Write(code)
+	cg.code.WriteString("\n")
+	cg.mu.Unlock()
+
+	return string(code), nil
+}
+
+// exportName upper-cases the first letter of name
+func exportName(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// ===== 7. Mock Generation =====
+
+// mockReserved are the names the generated method bodies use for locals
+var mockReserved = map[string]bool{"m": true, "fn": true, "ret": true, "t": true}
+
+// GenerateMock emits Mock<Interface> for an analyzed interface. Each method
+// records its calls, returns the values set with <Method>Returns or defers
+// to an optional <Method>Func, and has <Method>CallCount,
+// Assert<Method>Called and Assert<Method>CalledWith helpers. The assertions
+// take any value with Helper and Errorf, such as *testing.T. Packages used by
+// the method signatures must be added with AddImport.
+func (cg *CodeGenerator) GenerateMock(info *InterfaceInfo) (string, error) {
+	mock := "Mock" + info.Name
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %s is a mock implementation of %s\n", mock, info.Name)
+	fmt.Fprintf(&buf, "type %s struct {\nmu sync.Mutex\n", mock)
+	for _, method := range info.Methods {
+		params, _, _ := mockParams(method.Params)
+		fmt.Fprintf(&buf, "%sFunc func(%s) %s\n", method.Name, strings.Join(params, ", "), mockResults(method.Returns))
+		fmt.Fprintf(&buf, "%sCalls []%s%sCall\n", method.Name, mock, method.Name)
+		if len(method.Returns) > 0 {
+			fmt.Fprintf(&buf, "%sReturns struct {\n", lowerFirst(method.Name))
+			for i, ret := range method.Returns {
+				fmt.Fprintf(&buf, "r%d %s\n", i, ret.Type)
+			}
+			buf.WriteString("}\n")
+		}
+	}
+	buf.WriteString("}\n\n")
+
+	fmt.Fprintf(&buf, "// %sT is the part of testing.TB the assertions use\n", mock)
+	fmt.Fprintf(&buf, "type %sT interface {\nHelper()\nErrorf(format string, args ...any)\n}\n\n", mock)
+
+	for _, method := range info.Methods {
+		writeMockMethod(&buf, mock, method)
+	}
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	cg.AddImport("reflect")
+	cg.AddImport("sync")
+	cg.mu.Lock()
+	cg.code.Write(code)
+	cg.code.WriteString("\n")
+	cg.mu.Unlock()
+
+	return string(code), nil
+}
+
+func writeMockMethod(buf *bytes.Buffer, mock string, method *MethodSignature) {
+	name := method.Name
+	call := mock + name + "Call"
+	params, names, fields := mockParams(method.Params)
+	results := mockResults(method.Returns)
+
+	fmt.Fprintf(buf, "// %s records a call to %s\n", call, name)
+	fmt.Fprintf(buf, "type %s struct {\n", call)
+	for i, field := range fields {
+		fmt.Fprintf(buf, "%s %s\n", field, callFieldType(method.Params[i].Type))
+	}
+	buf.WriteString("}\n\n")
+
+	args := make([]string, len(names))
+	values := make([]string, len(names))
+	for i, param := range method.Params {
+		args[i] = names[i]
+		if strings.HasPrefix(param.Type, "...") {
+			args[i] += "..."
+		}
+		values[i] = fields[i] + ": " + names[i]
+	}
+
+	fmt.Fprintf(buf, "// %s implements the interface method\n", name)
+	fmt.Fprintf(buf, "func (m *%s) %s(%s) %s {\n", mock, name, strings.Join(params, ", "), results)
+	fmt.Fprintf(buf, "m.mu.Lock()\nm.%sCalls = append(m.%sCalls, %s{%s})\nfn := m.%sFunc\n", name, name, call, strings.Join(values, ", "), name)
+	if len(method.Returns) > 0 {
+		fmt.Fprintf(buf, "ret := m.%sReturns\n", lowerFirst(name))
+	}
+	buf.WriteString("m.mu.Unlock()\n\n")
+
+	if len(method.Returns) > 0 {
+		fmt.Fprintf(buf, "if fn != nil {\nreturn fn(%s)\n}\n", strings.Join(args, ", "))
+		rets := make([]string, len(method.Returns))
+		for i := range method.Returns {
+			rets[i] = fmt.Sprintf("ret.r%d", i)
+		}
+		fmt.Fprintf(buf, "return %s\n}\n\n", strings.Join(rets, ", "))
+
+		retParams := make([]string, len(method.Returns))
+		for i, ret := range method.Returns {
+			retParams[i] = fmt.Sprintf("r%d %s", i, ret.Type)
+		}
+		fmt.Fprintf(buf, "// %sReturns sets the values %s returns when %sFunc is nil\n", name, name, name)
+		fmt.Fprintf(buf, "func (m *%s) %sReturns(%s) {\n", mock, name, strings.Join(retParams, ", "))
+		fmt.Fprintf(buf, "m.mu.Lock()\ndefer m.mu.Unlock()\n")
+		for i := range method.Returns {
+			fmt.Fprintf(buf, "m.%sReturns.r%d = r%d\n", lowerFirst(name), i, i)
+		}
+		buf.WriteString("}\n\n")
+	} else {
+		fmt.Fprintf(buf, "if fn != nil {\nfn(%s)\n}\n}\n\n", strings.Join(args, ", "))
+	}
+
+	fmt.Fprintf(buf, "// %sCallCount returns how many times %s was called\n", name, name)
+	fmt.Fprintf(buf, "func (m *%s) %sCallCount() int {\nm.mu.Lock()\ndefer m.mu.Unlock()\nreturn len(m.%sCalls)\n}\n\n", mock, name, name)
+
+	fmt.Fprintf(buf, "// Assert%sCalled fails t unless %s was called exactly times times\n", name, name)
+	fmt.Fprintf(buf, "func (m *%s) Assert%sCalled(t %sT, times int) {\nt.Helper()\n", mock, name, mock)
+	fmt.Fprintf(buf, "if got := m.%sCallCount(); got != times {\n", name)
+	fmt.Fprintf(buf, "t.Errorf(\"expected %s to be called %%d times, got %%d\", times, got)\n}\n}\n\n", name)
+
+	fmt.Fprintf(buf, "// Assert%sCalledWith fails t unless some call to %s had these arguments\n", name, name)
+	fmt.Fprintf(buf, "func (m *%s) Assert%sCalledWith(t %sT, want %s) {\nt.Helper()\n", mock, name, mock, call)
+	fmt.Fprintf(buf, "m.mu.Lock()\ndefer m.mu.Unlock()\nfor _, call := range m.%sCalls {\n", name)
+	buf.WriteString("if reflect.DeepEqual(call, want) {\nreturn\n}\n}\n")
+	fmt.Fprintf(buf, "t.Errorf(\"expected a call to %s with %%+v, got %%+v\", want, m.%sCalls)\n}\n\n", name, name)
+}
+
+// mockParams names every parameter, avoiding the generated locals, and
+// returns the parameter list, the names and the matching call fields
+func mockParams(params []*ParamInfo) (decls, names, fields []string) {
+	for i, param := range params {
+		name := param.Name
+		if name == "" || name == "_" {
+			name = fmt.Sprintf("arg%d", i)
+		} else if mockReserved[name] {
+			name += "Arg"
+		}
+		decls = append(decls, name+" "+param.Type)
+		names = append(names, name)
+		fields = append(fields, exportName(name))
+	}
+	return decls, names, fields
+}
+
+// mockResults formats a result list for a signature
+func mockResults(returns []*ParamInfo) string {
+	switch len(returns) {
+	case 0:
+		return ""
+	case 1:
+		return returns[0].Type
+	}
+	list := make([]string, len(returns))
+	for i, ret := range returns {
+		list[i] = ret.Type
+	}
+	return "(" + strings.Join(list, ", ") + ")"
+}
+
+// callFieldType is the type a recorded argument is stored as; variadic
+// arguments become slices
+func callFieldType(paramType string) string {
+	if rest, ok := strings.CutPrefix(paramType, "..."); ok {
+		return "[]" + rest
+	}
+	return paramType
+}
+
+// lowerFirst lower-cases the first letter of name
+func lowerFirst(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// ===== 8. AST Transformer =====
+
+// ASTTransform rewrites a parsed file and returns how many places it changed.
+// Working on the syntax tree leaves string literals and comments alone,
+// unlike the regex patterns of CodeTransformer.
+type ASTTransform struct {
+	Name        string
+	Description string
+	Apply       func(fset *token.FileSet, file *ast.File) int
+}
+
+type ASTTransformer struct {
+	transforms []*ASTTransform
+	counts     map[string]int64
+	mu         sync.RWMutex
+}
+
+func NewASTTransformer() *ASTTransformer {
+	return &ASTTransformer{
+		counts: make(map[string]int64),
+	}
+}
+
+// Register adds a transform. Transforms run in registration order.
+func (at *ASTTransformer) Register(transform *ASTTransform) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.transforms = append(at.transforms, transform)
+}
+
+// Transform parses code, applies every registered transform and returns the
+// gofmt'd result with the number of changes per transform
+func (at *ASTTransformer) Transform(code string) (string, map[string]int64, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "src.go", code, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+
+	at.mu.RLock()
+	transforms := append([]*ASTTransform(nil), at.transforms...)
+	at.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, transform := range transforms {
+		if n := transform.Apply(fset, file); n > 0 {
+			counts[transform.Name] = int64(n)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return "", nil, err
+	}
+
+	at.mu.Lock()
+	for name, n := range counts {
+		at.counts[name] += n
+	}
+	at.mu.Unlock()
+
+	return buf.String(), counts, nil
+}
+
+func (at *ASTTransformer) GetStats() map[string]int64 {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	stats := make(map[string]int64, len(at.counts))
+	for name, n := range at.counts {
+		stats[name] = n
+	}
+	return stats
+}
+
+// InterfaceToAny replaces the empty interface{} with any
+func InterfaceToAny() *ASTTransform {
+	return &ASTTransform{
+		Name:        "interface_to_any",
+		Description: "Replace interface{} with any",
+		Apply: func(fset *token.FileSet, file *ast.File) int {
+			count := 0
+			astutil.Apply(file, nil, func(c *astutil.Cursor) bool {
+				iface, ok := c.Node().(*ast.InterfaceType)
+				if ok && len(iface.Methods.List) == 0 {
+					c.Replace(&ast.Ident{NamePos: iface.Pos(), Name: "any"})
+					count++
+				}
+				return true
+			})
+			return count
+		},
+	}
+}
+
+// AddContextParam adds ctx context.Context as the first parameter of the
+// functions selected by include, which defaults to every top-level function
+// except main and init. Calls to those functions in the file pass ctx when
+// the caller has one and context.TODO() otherwise. Calls to rewritten
+// methods are not updated.
+func AddContextParam(include func(fn *ast.FuncDecl) bool) *ASTTransform {
+	if include == nil {
+		include = func(fn *ast.FuncDecl) bool {
+			return fn.Recv == nil && fn.Name.Name != "main" && fn.Name.Name != "init"
+		}
+	}
+
+	return &ASTTransform{
+		Name:        "add_context",
+		Description: "Add context.Context as the first parameter",
+		Apply: func(fset *token.FileSet, file *ast.File) int {
+			changed := make(map[string]bool)       // rewritten top-level functions
+			hasCtx := make(map[*ast.FuncDecl]bool) // functions with ctx in scope
+			count := 0
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok {
+					continue
+				}
+				if takesContext(fn) {
+					hasCtx[fn] = true
+					continue
+				}
+				if !include(fn) {
+					continue
+				}
+
+				ctxParam := &ast.Field{
+					Names: []*ast.Ident{ast.NewIdent("ctx")},
+					Type:  &ast.SelectorExpr{X: ast.NewIdent("context"), Sel: ast.NewIdent("Context")},
+				}
+				fn.Type.Params.List = append([]*ast.Field{ctxParam}, fn.Type.Params.List...)
+				hasCtx[fn] = true
+				if fn.Recv == nil {
+					changed[fn.Name.Name] = true
+				}
+				count++
+			}
+			if count == 0 {
+				return 0
+			}
+
+			var current *ast.FuncDecl
+			astutil.Apply(file, func(c *astutil.Cursor) bool {
+				switch n := c.Node().(type) {
+				case *ast.FuncDecl:
+					current = n
+				case *ast.CallExpr:
+					ident, ok := n.Fun.(*ast.Ident)
+					if !ok || !changed[ident.Name] {
+						return true
+					}
+					var arg ast.Expr = &ast.CallExpr{
+						Fun: &ast.SelectorExpr{X: ast.NewIdent("context"), Sel: ast.NewIdent("TODO")},
+					}
+					if current != nil && hasCtx[current] {
+						arg = ast.NewIdent("ctx")
+					}
+					n.Args = append([]ast.Expr{arg}, n.Args...)
+				}
+				return true
+			}, func(c *astutil.Cursor) bool {
+				if _, ok := c.Node().(*ast.FuncDecl); ok {
+					current = nil
+				}
+				return true
+			})
+
+			astutil.AddImport(fset, file, "context")
+			return count
+		},
+	}
+}
+
+// WrapReturnedErrors wraps errors returned from inside an `if err != nil`
+// block as fmt.Errorf("<func>: %w", err). Returns elsewhere are left alone
+// because the error there may be nil.
+func WrapReturnedErrors() *ASTTransform {
+	return &ASTTransform{
+		Name:        "wrap_errors",
+		Description: "Wrap returned errors with fmt.Errorf and %w",
+		Apply: func(fset *token.FileSet, file *ast.File) int {
+			count := 0
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Body == nil || !returnsError(fn.Type) {
+					continue
+				}
+				count += wrapErrorReturns(fn.Body, fn.Name.Name)
+			}
+			if count > 0 {
+				astutil.AddImport(fset, file, "fmt")
+			}
+			return count
+		},
+	}
+}
+
+// wrapErrorReturns rewrites returns of a checked error variable inside body.
+// Function literals are skipped since their results differ.
+func wrapErrorReturns(body *ast.BlockStmt, funcName string) int {
+	count := 0
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt:
+			name := nonNilCheck(n.Cond)
+			if name == "" {
+				return true
+			}
+			astutil.Apply(n.Body, func(c *astutil.Cursor) bool {
+				switch r := c.Node().(type) {
+				case *ast.FuncLit:
+					return false
+				case *ast.ReturnStmt:
+					if len(r.Results) == 0 {
+						return true
+					}
+					last := len(r.Results) - 1
+					if ident, ok := r.Results[last].(*ast.Ident); ok && ident.Name == name {
+						r.Results[last] = &ast.CallExpr{
+							Fun: &ast.SelectorExpr{X: ast.NewIdent("fmt"), Sel: ast.NewIdent("Errorf")},
+							Args: []ast.Expr{
+								&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(funcName + ": %w")},
+								ident,
+							},
+						}
+						count++
+					}
+				}
+				return true
+			}, nil)
+		}
+		return true
+	}, nil)
+	return count
+}
+
+// nonNilCheck returns x for a condition of the form `x != nil`
+func nonNilCheck(cond ast.Expr) string {
+	bin, ok := cond.(*ast.BinaryExpr)
+	if !ok || bin.Op != token.NEQ {
+		return ""
+	}
+	x, ok := bin.X.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	if y, ok := bin.Y.(*ast.Ident); !ok || y.Name != "nil" {
+		return ""
+	}
+	return x.Name
+}
+
+// takesContext reports whether fn's first parameter is a context.Context
+func takesContext(fn *ast.FuncDecl) bool {
+	params := fn.Type.Params.List
+	if len(params) == 0 {
+		return false
+	}
+	sel, ok := params[0].Type.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "context" && sel.Sel.Name == "Context"
+}
+
+// returnsError reports whether a function's last result is error
+func returnsError(fn *ast.FuncType) bool {
+	if fn.Results == nil || len(fn.Results.List) == 0 {
+		return false
+	}
+	last, ok := fn.Results.List[len(fn.Results.List)-1].Type.(*ast.Ident)
+	return ok && last.Name == "error"
+}
+
+// ===== 9. AST Lint Analyzers =====
+
+// TextEdit replaces the source bytes in [Start, End) with NewText
+type TextEdit struct {
+	Start   int
+	End     int
+	NewText string
+}
+
+// SuggestedFix is a set of edits that resolves a violation
+type SuggestedFix struct {
+	Message string
+	Edits   []TextEdit
+}
+
+// LintAnalyzer is a rule that inspects the type-checked syntax tree instead
+// of matching lines
+type LintAnalyzer struct {
+	ID          string
+	Name        string
+	Description string
+	Severity    string // error, warning, info
+	Run         func(pass *LintPass)
+	Hits        int64
+}
+
+// LintPass is what an analyzer sees of one source file
+type LintPass struct {
+	Fset     *token.FileSet
+	File     *ast.File
+	Info     *types.Info
+	Src      []byte
+	analyzer *LintAnalyzer
+	found    []*LintViolation
+}
+
+// Report records a violation at node with optional fixes
+func (p *LintPass) Report(node ast.Node, message string, fixes ...*SuggestedFix) {
+	pos := p.Fset.Position(node.Pos())
+	line := ""
+	if lines := strings.Split(string(p.Src), "\n"); pos.Line-1 < len(lines) {
+		line = lines[pos.Line-1]
+	}
+
+	p.found = append(p.found, &LintViolation{
+		Rule:     p.analyzer.ID,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Message:  message,
+		Code:     line,
+		Severity: p.analyzer.Severity,
+		Fixes:    fixes,
+	})
+	atomic.AddInt64(&p.analyzer.Hits, 1)
+}
+
+// Offset converts a position to a byte offset for TextEdit
+func (p *LintPass) Offset(pos token.Pos) int {
+	return p.Fset.Position(pos).Offset
+}
+
+// AddAnalyzer registers an AST analyzer. Lint runs analyzers on code that
+// parses as a Go file.
+func (cl *CustomLinter) AddAnalyzer(analyzer *LintAnalyzer) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.analyzers = append(cl.analyzers, analyzer)
+}
+
+// runAnalyzers parses and type-checks code and runs every analyzer on it.
+// Type errors do not stop the analyzers; they work with what was resolved.
+func (cl *CustomLinter) runAnalyzers(code string, analyzers []*LintAnalyzer) []*LintViolation {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "src.go", code, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	conf.Check(file.Name.Name, fset, []*ast.File{file}, info)
+
+	var violations []*LintViolation
+	for _, analyzer := range analyzers {
+		pass := &LintPass{Fset: fset, File: file, Info: info, Src: []byte(code), analyzer: analyzer}
+		analyzer.Run(pass)
+		violations = append(violations, pass.found...)
+	}
+	return violations
+}
+
+// ApplyFixes applies the first fix of each violation to code. Edits that
+// overlap an edit already applied are skipped.
+func ApplyFixes(code string, violations []*LintViolation) (string, error) {
+	var edits []TextEdit
+	for _, v := range violations {
+		if len(v.Fixes) > 0 {
+			edits = append(edits, v.Fixes[0].Edits...)
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Start < edits[j].Start })
+
+	var buf strings.Builder
+	last := 0
+	for _, edit := range edits {
+		if edit.Start < last {
+			continue
+		}
+		if edit.End < edit.Start || edit.End > len(code) {
+			return "", fmt.Errorf("edit [%d, %d) is outside the source", edit.Start, edit.End)
+		}
+		buf.WriteString(code[last:edit.Start])
+		buf.WriteString(edit.NewText)
+		last = edit.End
+	}
+	buf.WriteString(code[last:])
+	return buf.String(), nil
+}
+
+// DefaultAnalyzers returns the built-in AST analyzers
+func DefaultAnalyzers() []*LintAnalyzer {
+	return []*LintAnalyzer{UncheckedErrorAnalyzer(), MutexCopyAnalyzer(), ExportedDocAnalyzer()}
+}
+
+// uncheckedErrorExempt are calls whose errors are conventionally ignored
+var uncheckedErrorExempt = map[string]bool{"fmt.Print": true, "fmt.Println": true, "fmt.Printf": true}
+
+// UncheckedErrorAnalyzer flags calls used as statements that return an
+// error. The fix discards the results explicitly with blank assignments.
+func UncheckedErrorAnalyzer() *LintAnalyzer {
+	return &LintAnalyzer{
+		ID:          "unchecked_error",
+		Name:        "Unchecked error",
+		Description: "Returned errors should be checked",
+		Severity:    "error",
+		Run: func(pass *LintPass) {
+			ast.Inspect(pass.File, func(n ast.Node) bool {
+				stmt, ok := n.(*ast.ExprStmt)
+				if !ok {
+					return true
+				}
+				call, ok := stmt.X.(*ast.CallExpr)
+				if !ok || uncheckedErrorExempt[types.ExprString(call.Fun)] {
+					return true
+				}
+
+				results := resultTypes(pass.Info.TypeOf(call))
+				if len(results) == 0 || !isErrorType(results[len(results)-1]) {
+					return true
+				}
+
+				blanks := strings.TrimSuffix(strings.Repeat("_, ", len(results)), ", ")
+				pass.Report(call, fmt.Sprintf("error returned by %s is not checked", types.ExprString(call.Fun)), &SuggestedFix{
+					Message: "Discard the results explicitly",
+					Edits:   []TextEdit{{Start: pass.Offset(call.Pos()), End: pass.Offset(call.Pos()), NewText: blanks + " = "}},
+				})
+				return true
+			})
+		},
+	}
+}
+
+// MutexCopyAnalyzer flags receivers, parameters and assignments that copy a
+// value containing a sync lock. The fix for receivers and parameters makes
+// them pointers.
+func MutexCopyAnalyzer() *LintAnalyzer {
+	return &LintAnalyzer{
+		ID:          "mutex_copy",
+		Name:        "Mutex copied by value",
+		Description: "Values containing locks must not be copied",
+		Severity:    "error",
+		Run: func(pass *LintPass) {
+			checkFields := func(fields *ast.FieldList, what string) {
+				if fields == nil {
+					return
+				}
+				for _, field := range fields.List {
+					lock := containedLock(pass.Info.TypeOf(field.Type))
+					if lock == "" {
+						continue
+					}
+					pass.Report(field.Type, fmt.Sprintf("%s passes a value containing %s by value", what, lock), &SuggestedFix{
+						Message: "Use a pointer",
+						Edits:   []TextEdit{{Start: pass.Offset(field.Type.Pos()), End: pass.Offset(field.Type.Pos()), NewText: "*"}},
+					})
+				}
+			}
+
+			ast.Inspect(pass.File, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.FuncDecl:
+					checkFields(n.Recv, "receiver")
+					checkFields(n.Type.Params, "parameter")
+				case *ast.AssignStmt:
+					for _, rhs := range n.Rhs {
+						switch ast.Unparen(rhs).(type) {
+						case *ast.Ident, *ast.SelectorExpr, *ast.StarExpr, *ast.IndexExpr:
+						default:
+							continue // literals and calls produce fresh values
+						}
+						if lock := containedLock(pass.Info.TypeOf(rhs)); lock != "" {
+							pass.Report(rhs, fmt.Sprintf("assignment copies a value containing %s", lock))
+						}
+					}
+				}
+				return true
+			})
+		},
+	}
+}
+
+// ExportedDocAnalyzer flags exported functions and methods without a doc
+// comment. The fix inserts a comment stub to fill in.
+func ExportedDocAnalyzer() *LintAnalyzer {
+	return &LintAnalyzer{
+		ID:          "exported_doc",
+		Name:        "Missing doc comment",
+		Description: "Exported functions should have a doc comment",
+		Severity:    "warning",
+		Run: func(pass *LintPass) {
+			for _, decl := range pass.File.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || !fn.Name.IsExported() || fn.Doc != nil {
+					continue
+				}
+				if fn.Recv != nil && len(fn.Recv.List) > 0 && !ast.IsExported(receiverTypeName(fn.Recv.List[0].Type)) {
+					continue
+				}
+
+				start := pass.Offset(fn.Pos())
+				pass.Report(fn.Name, fmt.Sprintf("exported function %s should have a doc comment", fn.Name.Name), &SuggestedFix{
+					Message: "Add a doc comment",
+					Edits:   []TextEdit{{Start: start, End: start, NewText: fmt.Sprintf("// %s ...\n", fn.Name.Name)}},
+				})
+			}
+		},
+	}
+}
+
+// resultTypes lists the types a call produces
+func resultTypes(t types.Type) []types.Type {
+	switch t := t.(type) {
+	case nil:
+		return nil
+	case *types.Tuple:
+		list := make([]types.Type, t.Len())
+		for i := range list {
+			list[i] = t.At(i).Type()
+		}
+		return list
+	}
+	return []types.Type{t}
+}
+
+func isErrorType(t types.Type) bool {
+	return types.Identical(t, types.Universe.Lookup("error").Type())
+}
+
+// containedLock names the sync lock held by value in t, if any
+func containedLock(t types.Type) string {
+	return findLock(t, make(map[types.Type]bool))
+}
+
+func findLock(t types.Type, seen map[types.Type]bool) string {
+	if t == nil || seen[t] {
+		return ""
+	}
+	seen[t] = true
+
+	if named, ok := t.(*types.Named); ok {
+		obj := named.Obj()
+		if obj.Pkg() != nil && obj.Pkg().Path() == "sync" {
+			switch obj.Name() {
+			case "Mutex", "RWMutex", "WaitGroup", "Once", "Cond":
+				return "sync." + obj.Name()
+			}
+		}
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			if lock := findLock(u.Field(i).Type(), seen); lock != "" {
+				return lock
+			}
+		}
+	case *types.Array:
+		return findLock(u.Elem(), seen)
+	}
+	return ""
+}
+
+// receiverTypeName strips pointers and type parameters from a receiver type
+func receiverTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(t.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// ===== 10. Report Rendering =====
+
+// ComplexityThreshold marks functions as hard to maintain in reports
+const ComplexityThreshold = 10
+
+// AnalysisReport combines analysis and lint results for rendering
+type AnalysisReport struct {
+	URI        string // file the results refer to
+	Statistics map[string]interface{}
+	Functions  []*FunctionInfo // most complex first
+	Rules      []*ReportRule
+	Violations []*LintViolation
+}
+
+// ReportRule describes a lint rule or analyzer in a report
+type ReportRule struct {
+	ID          string
+	Name        string
+	Description string
+	Severity    string
+}
+
+// NewAnalysisReport snapshots the analyzer and the linter's last results.
+// Either may be nil.
+func NewAnalysisReport(uri string, ca *CodeAnalyzer, cl *CustomLinter) *AnalysisReport {
+	report := &AnalysisReport{URI: uri, Statistics: map[string]interface{}{}}
+
+	if ca != nil {
+		report.Statistics = ca.GetReport()
+		ca.mu.RLock()
+		for _, fn := range ca.Functions {
+			report.Functions = append(report.Functions, fn)
+		}
+		ca.mu.RUnlock()
+		sort.Slice(report.Functions, func(i, j int) bool {
+			a, b := report.Functions[i], report.Functions[j]
+			if a.Cyclomatic != b.Cyclomatic {
+				return a.Cyclomatic > b.Cyclomatic
+			}
+			return a.Name < b.Name
+		})
+	}
+
+	if cl != nil {
+		cl.mu.RLock()
+		for _, rule := range cl.rules {
+			report.Rules = append(report.Rules, &ReportRule{ID: rule.ID, Name: rule.Name, Description: rule.Description, Severity: rule.Severity})
+		}
+		for _, analyzer := range cl.analyzers {
+			report.Rules = append(report.Rules, &ReportRule{ID: analyzer.ID, Name: analyzer.Name, Description: analyzer.Description, Severity: analyzer.Severity})
+		}
+		report.Violations = append(report.Violations, cl.violations...)
+		cl.mu.RUnlock()
+		sort.Slice(report.Rules, func(i, j int) bool { return report.Rules[i].ID < report.Rules[j].ID })
+	}
+
+	return report
+}
+
+// SARIF 2.1.0 log, limited to the properties the report fills in
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool              `json:"tool"`
+	Results    []sarifResult          `json:"results"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	Name                 string       `json:"name,omitempty"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+	Fixes     []sarifFix      `json:"fixes,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation sarifArtifact `json:"artifactLocation"`
+		Region           struct {
+			StartLine   int `json:"startLine"`
+			StartColumn int `json:"startColumn,omitempty"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifFix struct {
+	Description     sarifMessage          `json:"description"`
+	ArtifactChanges []sarifArtifactChange `json:"artifactChanges"`
+}
+
+type sarifArtifactChange struct {
+	ArtifactLocation sarifArtifact      `json:"artifactLocation"`
+	Replacements     []sarifReplacement `json:"replacements"`
+}
+
+type sarifReplacement struct {
+	DeletedRegion struct {
+		ByteOffset int `json:"byteOffset"`
+		ByteLength int `json:"byteLength"`
+	} `json:"deletedRegion"`
+	InsertedContent *sarifMessage `json:"insertedContent,omitempty"`
+}
+
+// sarifLevel maps linter severities to SARIF levels
+func sarifLevel(severity string) string {
+	switch severity {
+	case "error", "warning":
+		return severity
+	case "info":
+		return "note"
+	}
+	return "warning"
+}
+
+// SARIF renders the report as a SARIF 2.1.0 log for code-scanning tools.
+// Function metrics go in the run's property bag.
+func (r *AnalysisReport) SARIF() ([]byte, error) {
+	run := sarifRun{
+		Tool:       sarifTool{Driver: sarifDriver{Name: "challenge-169-linter", Rules: []sarifRule{}}},
+		Results:    []sarifResult{},
+		Properties: map[string]interface{}{"statistics": r.Statistics},
+	}
+
+	for _, rule := range r.Rules {
+		sr := sarifRule{ID: rule.ID, Name: rule.Name, ShortDescription: sarifMessage{Text: rule.Description}}
+		sr.DefaultConfiguration.Level = sarifLevel(rule.Severity)
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sr)
+	}
+
+	for _, v := range r.Violations {
+		result := sarifResult{RuleID: v.Rule, Level: sarifLevel(v.Severity), Message: sarifMessage{Text: v.Message}}
+		var loc sarifLocation
+		loc.PhysicalLocation.ArtifactLocation.URI = r.URI
+		loc.PhysicalLocation.Region.StartLine = v.Line
+		loc.PhysicalLocation.Region.StartColumn = v.Column
+		result.Locations = []sarifLocation{loc}
+
+		for _, fix := range v.Fixes {
+			change := sarifArtifactChange{ArtifactLocation: sarifArtifact{URI: r.URI}}
+			for _, edit := range fix.Edits {
+				var rep sarifReplacement
+				rep.DeletedRegion.ByteOffset = edit.Start
+				rep.DeletedRegion.ByteLength = edit.End - edit.Start
+				if edit.NewText != "" {
+					rep.InsertedContent = &sarifMessage{Text: edit.NewText}
+				}
+				change.Replacements = append(change.Replacements, rep)
+			}
+			result.Fixes = append(result.Fixes, sarifFix{Description: sarifMessage{Text: fix.Message}, ArtifactChanges: []sarifArtifactChange{change}})
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	if len(r.Functions) > 0 {
+		metrics := make(map[string]interface{}, len(r.Functions))
+		for _, fn := range r.Functions {
+			metrics[reportFuncName(fn)] = map[string]interface{}{
+				"lines":           fn.Lines,
+				"cyclomatic":      fn.Cyclomatic,
+				"cognitive":       fn.Cognitive,
+				"halstead_volume": fn.Halstead.Volume,
+			}
+		}
+		run.Properties["functions"] = metrics
+	}
+
+	return json.MarshalIndent(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"funcName": reportFuncName,
+	"complex":  func(fn *FunctionInfo) bool { return fn.Cyclomatic > ComplexityThreshold },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Code report: {{.URI}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f0f0f0; }
+.stats span { display: inline-block; margin-right: 2em; }
+.complex td { background: #fde2e2; }
+.error { color: #b00020; }
+.warning { color: #a15c00; }
+.info { color: #005a9c; }
+</style>
+</head>
+<body>
+<h1>Code report: {{.URI}}</h1>
+<div class="stats">
+<span>Functions: {{index .Statistics "total_functions"}}</span>
+<span>Types: {{index .Statistics "total_types"}}</span>
+<span>Lines: {{index .Statistics "total_lines"}}</span>
+<span>Average function size: {{index .Statistics "avg_function_size"}}</span>
+<span>Violations: {{len .Violations}}</span>
+</div>
+<h2>Functions</h2>
+<table>
+<tr><th>Function</th><th>Params</th><th>Returns</th><th>Lines</th><th>Cyclomatic</th><th>Cognitive</th><th>Halstead volume</th></tr>
+{{- range .Functions}}
+<tr{{if complex .}} class="complex"{{end}}><td>{{funcName .}}</td><td>{{len .Params}}</td><td>{{len .Returns}}</td><td>{{.Lines}}</td><td>{{.Cyclomatic}}</td><td>{{.Cognitive}}</td><td>{{printf "%.1f" .Halstead.Volume}}</td></tr>
+{{- end}}
+</table>
+<h2>Violations</h2>
+<table>
+<tr><th>Line</th><th>Column</th><th>Rule</th><th>Severity</th><th>Message</th><th>Code</th><th>Fix</th></tr>
+{{- range .Violations}}
+<tr><td>{{.Line}}</td><td>{{.Column}}</td><td>{{.Rule}}</td><td class="{{.Severity}}">{{.Severity}}</td><td>{{.Message}}</td><td><code>{{.Code}}</code></td><td>{{range .Fixes}}{{.Message}}{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// HTML renders the report as a self-contained HTML page. Functions above
+// ComplexityThreshold are highlighted.
+func (r *AnalysisReport) HTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reportFuncName qualifies methods with their receiver type
+func reportFuncName(fn *FunctionInfo) string {
+	if fn.Receiver != "" {
+		return strings.TrimPrefix(fn.Receiver, "*") + "." + fn.Name
+	}
+	return fn.Name
+}
+
+// ===== 11. Schema Structs =====
+
+// SchemaOptions controls GenerateStructFromJSON and GenerateStructFromSQL
+type SchemaOptions struct {
+	RootName       string // struct generated for a JSON sample, "Root" if empty
+	ValidationTags bool   // add validate tags for required fields and lengths
+}
+
+// schemaStruct is a struct inferred from a schema
+type schemaStruct struct {
+	name   string
+	doc    string
+	fields []*schemaField
+}
+
+type schemaField struct {
+	name     string
+	key      string
+	typ      string
+	required bool
+	maxLen   int
+	dbTag    bool
+}
+
+// jsonNode is a decoded JSON value that keeps object keys in order
+type jsonNode struct {
+	kind   string // object, array, string, int, float, bool, null
+	keys   []string
+	fields map[string]*jsonNode
+	elems  []*jsonNode
+	str    string
+}
+
+// GenerateStructFromJSON infers structs from a JSON sample. The sample is
+// an object or an array of objects; nested objects become their own
+// structs. Fields missing or null in some elements get omitempty; the
+// others are required. The code is gofmt'd, added to the generator's file
+// and returned.
+func (cg *CodeGenerator) GenerateStructFromJSON(sample []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(sample))
+	dec.UseNumber()
+	root, err := decodeJSONNode(dec)
+	if err != nil {
+		return "", fmt.Errorf("invalid JSON sample: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return "", fmt.Errorf("invalid JSON sample: trailing data")
+	}
+
+	objects := []*jsonNode{root}
+	if root.kind == "array" {
+		objects = root.elems
+	}
+	for _, obj := range objects {
+		if obj.kind != "object" {
+			return "", fmt.Errorf("JSON sample must be an object or an array of objects, found %s", obj.kind)
+		}
+	}
+	if len(objects) == 0 {
+		return "", fmt.Errorf("JSON sample has no objects")
+	}
+
+	name := cg.Schema.RootName
+	if name == "" {
+		name = "Root"
+	}
+	inf := &jsonInference{names: make(map[string]bool)}
+	inf.inferStruct(name, objects)
+
+	return cg.writeSchemaStructs(inf.structs, inf.imports)
+}
+
+// decodeJSONNode reads the next value from dec
+func decodeJSONNode(dec *json.Decoder) (*jsonNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			node := &jsonNode{kind: "array"}
+			for dec.More() {
+				elem, err := decodeJSONNode(dec)
+				if err != nil {
+					return nil, err
+				}
+				node.elems = append(node.elems, elem)
+			}
+			_, err := dec.Token()
+			return node, err
+		}
+
+		node := &jsonNode{kind: "object", fields: make(map[string]*jsonNode)}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string)
+			value, err := decodeJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := node.fields[key]; !dup {
+				node.keys = append(node.keys, key)
+			}
+			node.fields[key] = value
+		}
+		_, err := dec.Token()
+		return node, err
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return &jsonNode{kind: "int"}, nil
+		}
+		return &jsonNode{kind: "float"}, nil
+	case string:
+		return &jsonNode{kind: "string", str: t}, nil
+	case bool:
+		return &jsonNode{kind: "bool"}, nil
+	}
+	return &jsonNode{kind: "null"}, nil
+}
+
+type jsonInference struct {
+	structs []*schemaStruct
+	names   map[string]bool
+	imports []string
+}
+
+// inferStruct merges the objects into one struct and returns its name
+func (inf *jsonInference) inferStruct(name string, objects []*jsonNode) string {
+	for base, n := name, 2; inf.names[name]; n++ {
+		name = fmt.Sprintf("%s%d", base, n)
+	}
+	inf.names[name] = true
+	st := &schemaStruct{name: name, doc: fmt.Sprintf("%s is generated from a JSON sample", name)}
+	inf.structs = append(inf.structs, st)
+
+	var keys []string
+	values := make(map[string][]*jsonNode)
+	for _, obj := range objects {
+		for _, key := range obj.keys {
+			if _, seen := values[key]; !seen {
+				keys = append(keys, key)
+			}
+			if value := obj.fields[key]; value.kind != "null" {
+				values[key] = append(values[key], value)
+			} else if values[key] == nil {
+				values[key] = []*jsonNode{}
+			}
+		}
+	}
+
+	for _, key := range keys {
+		fieldName := goFieldName(key)
+		st.fields = append(st.fields, &schemaField{
+			name:     fieldName,
+			key:      key,
+			typ:      inf.inferType(fieldName, values[key]),
+			required: len(values[key]) == len(objects),
+		})
+	}
+	return name
+}
+
+// inferType finds a Go type that holds every value
+func (inf *jsonInference) inferType(name string, values []*jsonNode) string {
+	if len(values) == 0 {
+		return "interface{}"
+	}
+
+	kinds := make(map[string]bool)
+	for _, v := range values {
+		kinds[v.kind] = true
+	}
+
+	switch {
+	case len(kinds) == 1 && kinds["object"]:
+		return inf.inferStruct(name, values)
+	case len(kinds) == 1 && kinds["array"]:
+		var elems []*jsonNode
+		for _, v := range values {
+			for _, elem := range v.elems {
+				if elem.kind != "null" {
+					elems = append(elems, elem)
+				}
+			}
+		}
+		return "[]" + inf.inferType(singular(name), elems)
+	case len(kinds) == 1 && kinds["string"]:
+		for _, v := range values {
+			if _, err := time.Parse(time.RFC3339, v.str); err != nil {
+				return "string"
+			}
+		}
+		inf.imports = append(inf.imports, "time")
+		return "time.Time"
+	case len(kinds) == 1 && kinds["int"]:
+		return "int64"
+	case len(kinds) <= 2 && (kinds["int"] || kinds["float"]) && !kinds["string"] && !kinds["bool"] && !kinds["object"] && !kinds["array"]:
+		return "float64"
+	case len(kinds) == 1 && kinds["bool"]:
+		return "bool"
+	}
+	return "interface{}"
+}
+
+var createTablePattern = regexp.MustCompile("(?is)create\\s+(?:temp\\s+|temporary\\s+)?table\\s+(?:if\\s+not\\s+exists\\s+)?([\\w.\"`]+)\\s*\\(")
+
+// columnKeywords end the type part of a column definition
+var columnKeywords = map[string]bool{
+	"not": true, "null": true, "primary": true, "default": true, "unique": true, "references": true,
+	"check": true, "auto_increment": true, "generated": true, "collate": true, "constraint": true,
+}
+
+// GenerateStructFromSQL generates a struct with db and json tags for every
+// CREATE TABLE statement in ddl. Nullable columns become pointers, except
+// for slices. The code is gofmt'd, added to the generator's file and
+// returned.
+func (cg *CodeGenerator) GenerateStructFromSQL(ddl string) (string, error) {
+	var structs []*schemaStruct
+	var imports []string
+
+	for _, loc := range createTablePattern.FindAllStringSubmatchIndex(ddl, -1) {
+		table := unquoteIdent(ddl[loc[2]:loc[3]])
+		if dot := strings.LastIndex(table, "."); dot >= 0 {
+			table = unquoteIdent(table[dot+1:])
+		}
+
+		body, ok := parenBody(ddl[loc[1]:])
+		if !ok {
+			return "", fmt.Errorf("table %s: unbalanced parentheses", table)
+		}
+
+		st := &schemaStruct{name: singular(goFieldName(table)), doc: fmt.Sprintf("%s is generated from table %s", singular(goFieldName(table)), table)}
+		byColumn := make(map[string]*schemaField)
+		var primaryKey []string
+
+		for _, def := range splitTopLevel(body) {
+			words := strings.Fields(def)
+			if len(words) == 0 {
+				continue
+			}
+			switch strings.ToLower(words[0]) {
+			case "primary":
+				if cols, ok := parenBody(def[strings.Index(def, "(")+1:]); ok {
+					primaryKey = append(primaryKey, splitTopLevel(cols)...)
+				}
+				continue
+			case "constraint", "unique", "key", "index", "foreign", "check":
+				continue
+			}
+
+			column := unquoteIdent(words[0])
+			var typeWords []string
+			for _, w := range words[1:] {
+				if columnKeywords[strings.ToLower(w)] {
+					break
+				}
+				typeWords = append(typeWords, w)
+			}
+			sqlType := strings.ToLower(strings.Join(typeWords, " "))
+			upper := strings.ToUpper(def)
+
+			typ, imp := sqlGoType(sqlType)
+			if imp != "" {
+				imports = append(imports, imp)
+			}
+			field := &schemaField{
+				name:     goFieldName(column),
+				key:      column,
+				typ:      typ,
+				required: strings.Contains(upper, "NOT NULL") || strings.Contains(upper, "PRIMARY KEY"),
+				maxLen:   sqlLength(sqlType),
+				dbTag:    true,
+			}
+			st.fields = append(st.fields, field)
+			byColumn[column] = field
+		}
+
+		for _, column := range primaryKey {
+			if field := byColumn[unquoteIdent(strings.TrimSpace(column))]; field != nil {
+				field.required = true
+			}
+		}
+		for _, field := range st.fields {
+			if !field.required && !strings.HasPrefix(field.typ, "[]") && field.typ != "json.RawMessage" {
+				field.typ = "*" + field.typ
+			}
+		}
+		structs = append(structs, st)
+	}
+
+	if len(structs) == 0 {
+		return "", fmt.Errorf("no CREATE TABLE statement found")
+	}
+	return cg.writeSchemaStructs(structs, imports)
+}
+
+// sqlGoType maps a column type to a Go type and the import it needs
+func sqlGoType(sqlType string) (string, string) {
+	if strings.HasSuffix(sqlType, "[]") {
+		elem, imp := sqlGoType(strings.TrimSuffix(sqlType, "[]"))
+		return "[]" + elem, imp
+	}
+
+	base := sqlType
+	if i := strings.Index(base, "("); i >= 0 {
+		if base[:i] == "tinyint" && strings.HasPrefix(base[i:], "(1)") {
+			return "bool", ""
+		}
+		base = base[:i]
+	}
+	base = strings.TrimSpace(strings.TrimSuffix(base, " unsigned"))
+
+	switch {
+	case base == "bool" || base == "boolean":
+		return "bool", ""
+	case base == "tinyint":
+		return "int8", ""
+	case base == "smallint" || base == "int2" || base == "smallserial":
+		return "int16", ""
+	case base == "int" || base == "integer" || base == "int4" || base == "mediumint" || base == "serial":
+		return "int32", ""
+	case base == "bigint" || base == "int8" || base == "bigserial":
+		return "int64", ""
+	case base == "real" || base == "float4":
+		return "float32", ""
+	case base == "float" || base == "float8" || base == "double" || base == "double precision" || base == "decimal" || base == "numeric":
+		return "float64", ""
+	case strings.HasPrefix(base, "timestamp") || base == "date" || base == "datetime" || strings.HasPrefix(base, "time"):
+		return "time.Time", "time"
+	case base == "bytea" || strings.HasSuffix(base, "blob") || base == "binary" || base == "varbinary":
+		return "[]byte", ""
+	case base == "json" || base == "jsonb":
+		return "json.RawMessage", "encoding/json"
+	}
+	return "string", ""
+}
+
+var sqlLengthPattern = regexp.MustCompile(`^(?:varchar|char|character|character varying|nvarchar|nchar)\s*\((\d+)\)`)
+
+// sqlLength returns the declared length of a character column
+func sqlLength(sqlType string) int {
+	m := sqlLengthPattern.FindStringSubmatch(sqlType)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// parenBody returns s up to the parenthesis closing an already opened one
+func parenBody(s string) (string, bool) {
+	depth := 1
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s[:i], true
+			}
+		}
+	}
+	return "", false
+}
+
+// splitTopLevel splits s on commas outside parentheses
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		parts = append(parts, rest)
+	}
+	return parts
+}
+
+func unquoteIdent(name string) string {
+	return strings.Trim(name, "\"`[]")
+}
+
+// commonInitialisms are spelled in upper case in Go names
+var commonInitialisms = map[string]bool{
+	"ID": true, "URL": true, "URI": true, "API": true, "HTTP": true, "JSON": true,
+	"SQL": true, "UUID": true, "IP": true, "HTML": true, "XML": true,
+}
+
+// goFieldName converts a snake, kebab or camel case key to an exported name
+func goFieldName(key string) string {
+	parts := strings.FieldsFunc(key, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var buf strings.Builder
+	for _, part := range parts {
+		if upper := strings.ToUpper(part); commonInitialisms[upper] {
+			buf.WriteString(upper)
+		} else {
+			buf.WriteString(exportName(part))
+		}
+	}
+
+	name := buf.String()
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "F" + name
+	}
+	return name
+}
+
+// singular strips a plural suffix from an exported name
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "xes"), strings.HasSuffix(name, "ches"), strings.HasSuffix(name, "shes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "ss"):
+		return name
+	case strings.HasSuffix(name, "s") && len(name) > 1:
+		return strings.TrimSuffix(name, "s")
+	}
+	return name + "Item"
+}
+
+// writeSchemaStructs renders the structs with their tags and adds them to
+// the generator's file
+func (cg *CodeGenerator) writeSchemaStructs(structs []*schemaStruct, imports []string) (string, error) {
+	var buf bytes.Buffer
+	for i, st := range structs {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		if st.doc != "" {
+			fmt.Fprintf(&buf, "// %s\n", st.doc)
+		}
+		fmt.Fprintf(&buf, "type %s struct {\n", st.name)
+		for _, field := range st.fields {
+			fmt.Fprintf(&buf, "%s %s `%s`\n", field.name, field.typ, cg.schemaTags(field))
+		}
+		buf.WriteString("}\n")
+	}
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	for _, imp := range imports {
+		cg.AddImport(imp)
+	}
+	cg.mu.Lock()
+	cg.code.Write(code)
+	cg.code.WriteString("\n")
+	cg.mu.Unlock()
+
+	return string(code), nil
+}
+
+// schemaTags builds the struct tag of a field
+func (cg *CodeGenerator) schemaTags(field *schemaField) string {
+	jsonTag := field.key
+	if !field.required {
+		jsonTag += ",omitempty"
+	}
+
+	tags := []string{fmt.Sprintf("json:%q", jsonTag)}
+	if field.dbTag {
+		tags = append(tags, fmt.Sprintf("db:%q", field.key))
+	}
+
+	if cg.Schema.ValidationTags {
+		var rules []string
+		if field.required {
+			rules = append(rules, "required")
+		} else {
+			rules = append(rules, "omitempty")
+		}
+		if field.maxLen > 0 {
+			rules = append(rules, fmt.Sprintf("max=%d", field.maxLen))
+		}
+		if len(rules) > 1 || field.required {
+			tags = append(tags, fmt.Sprintf("validate:%q", strings.Join(rules, ",")))
+		}
+	}
+	return strings.Join(tags, " ")
+}
+
+// ===== 12. Complexity Metrics =====
+
+// HalsteadMetrics are computed from the operators and operands of a
+// function body
+type HalsteadMetrics struct {
+	DistinctOperators int
+	DistinctOperands  int
+	TotalOperators    int
+	TotalOperands     int
+	Vocabulary        int
+	Length            int
+	Volume            float64
+	Difficulty        float64
+	Effort            float64
+}
+
+// ComplexityAggregate summarizes the metrics of a set of functions
+type ComplexityAggregate struct {
+	Functions       int
+	TotalLines      int
+	TotalCyclomatic int
+	MaxCyclomatic   int
+	AvgCyclomatic   float64
+	TotalCognitive  int
+	MaxCognitive    int
+	AvgCognitive    float64
+	TotalVolume     float64
+	MaxVolume       float64
+	AvgVolume       float64
+}
+
+// ComplexityLimits configure Gate. Zero disables a limit.
+type ComplexityLimits struct {
+	MaxCyclomatic     int
+	MaxCognitive      int
+	MaxHalsteadVolume float64
+	MaxLines          int
+}
+
+// GateViolation is a function metric above its limit
+type GateViolation struct {
+	Function string
+	Metric   string
+	Value    float64
+	Limit    float64
+}
+
+// GateError lists every limit a gate check found exceeded
+type GateError struct {
+	Violations []GateViolation
+}
+
+func (e *GateError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = fmt.Sprintf("%s %s %g > %g", v.Function, v.Metric, v.Value, v.Limit)
+	}
+	return fmt.Sprintf("complexity gate failed: %s", strings.Join(parts, "; "))
+}
+
+// Aggregates summarizes the metrics of every function analyzed so far
+func (ca *CodeAnalyzer) Aggregates() ComplexityAggregate {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	functions := make([]*FunctionInfo, 0, len(ca.Functions))
+	for _, fn := range ca.Functions {
+		functions = append(functions, fn)
+	}
+	return aggregateComplexity(functions)
+}
+
+// Gate checks every analyzed function against limits and returns a
+// *GateError listing the functions that exceed them
+func (ca *CodeAnalyzer) Gate(limits ComplexityLimits) error {
+	ca.mu.RLock()
+	functions := make([]*FunctionInfo, 0, len(ca.Functions))
+	for _, fn := range ca.Functions {
+		functions = append(functions, fn)
+	}
+	ca.mu.RUnlock()
+	sort.Slice(functions, func(i, j int) bool { return reportFuncName(functions[i]) < reportFuncName(functions[j]) })
+
+	var gateErr GateError
+	check := func(fn *FunctionInfo, metric string, value, limit float64) {
+		if limit > 0 && value > limit {
+			gateErr.Violations = append(gateErr.Violations, GateViolation{Function: reportFuncName(fn), Metric: metric, Value: value, Limit: limit})
+		}
+	}
+	for _, fn := range functions {
+		check(fn, "cyclomatic", float64(fn.Cyclomatic), float64(limits.MaxCyclomatic))
+		check(fn, "cognitive", float64(fn.Cognitive), float64(limits.MaxCognitive))
+		check(fn, "halstead_volume", fn.Halstead.Volume, limits.MaxHalsteadVolume)
+		check(fn, "lines", float64(fn.Lines), float64(limits.MaxLines))
+	}
+
+	if len(gateErr.Violations) > 0 {
+		return &gateErr
+	}
+	return nil
+}
+
+func aggregateComplexity(functions []*FunctionInfo) ComplexityAggregate {
+	agg := ComplexityAggregate{Functions: len(functions)}
+	for _, fn := range functions {
+		agg.TotalLines += fn.Lines
+		agg.TotalCyclomatic += fn.Cyclomatic
+		agg.TotalCognitive += fn.Cognitive
+		agg.TotalVolume += fn.Halstead.Volume
+		if fn.Cyclomatic > agg.MaxCyclomatic {
+			agg.MaxCyclomatic = fn.Cyclomatic
+		}
+		if fn.Cognitive > agg.MaxCognitive {
+			agg.MaxCognitive = fn.Cognitive
+		}
+		if fn.Halstead.Volume > agg.MaxVolume {
+			agg.MaxVolume = fn.Halstead.Volume
+		}
+	}
+	if agg.Functions > 0 {
+		n := float64(agg.Functions)
+		agg.AvgCyclomatic = float64(agg.TotalCyclomatic) / n
+		agg.AvgCognitive = float64(agg.TotalCognitive) / n
+		agg.AvgVolume = agg.TotalVolume / n
+	}
+	return agg
+}
+
+// cognitiveComplexity scores how hard fn is to follow, after SonarSource's
+// cognitive complexity: breaks in linear flow add one, plus their nesting
+// depth for if, switch, select and loops. Each run of like boolean
+// operators, labelled jump and recursive call adds one.
+func cognitiveComplexity(fn *ast.FuncDecl) int {
+	if fn.Body == nil {
+		return 0
+	}
+	c := &cognitiveCounter{name: fn.Name.Name}
+	if fn.Recv != nil && len(fn.Recv.List) > 0 && len(fn.Recv.List[0].Names) > 0 {
+		c.recv = fn.Recv.List[0].Names[0].Name
+	}
+	c.walk(fn.Body, 0)
+	return c.score
+}
+
+type cognitiveCounter struct {
+	name  string
+	recv  string
+	score int
+}
+
+func (c *cognitiveCounter) walk(node ast.Node, nesting int) {
+	if node == nil {
+		return
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt:
+			c.ifStmt(n, nesting, false)
+			return false
+		case *ast.ForStmt:
+			c.score += 1 + nesting
+			c.walk(n.Init, nesting)
+			c.walk(n.Cond, nesting)
+			c.walk(n.Post, nesting)
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.RangeStmt:
+			c.score += 1 + nesting
+			c.walk(n.X, nesting)
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.SwitchStmt:
+			c.score += 1 + nesting
+			c.walk(n.Init, nesting)
+			c.walk(n.Tag, nesting)
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.TypeSwitchStmt:
+			c.score += 1 + nesting
+			c.walk(n.Init, nesting)
+			c.walk(n.Assign, nesting)
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.SelectStmt:
+			c.score += 1 + nesting
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.FuncLit:
+			c.walk(n.Body, nesting+1)
+			return false
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				c.logical(n, nesting)
+				return false
+			}
+		case *ast.BranchStmt:
+			if n.Label != nil || n.Tok == token.GOTO {
+				c.score++
+			}
+		case *ast.CallExpr:
+			if c.isRecursive(n) {
+				c.score++
+			}
+		}
+		return true
+	})
+}
+
+func (c *cognitiveCounter) ifStmt(n *ast.IfStmt, nesting int, elseIf bool) {
+	if elseIf {
+		c.score++
+	} else {
+		c.score += 1 + nesting
+	}
+	c.walk(n.Init, nesting)
+	c.walk(n.Cond, nesting)
+	c.walk(n.Body, nesting+1)
+
+	switch e := n.Else.(type) {
+	case *ast.IfStmt:
+		c.ifStmt(e, nesting, true)
+	case *ast.BlockStmt:
+		c.score++
+		c.walk(e, nesting+1)
+	}
+}
+
+// logical adds one per run of like operators in a boolean expression
+func (c *cognitiveCounter) logical(expr *ast.BinaryExpr, nesting int) {
+	var ops []token.Token
+	var operands []ast.Expr
+	var flatten func(e ast.Expr)
+	flatten = func(e ast.Expr) {
+		inner := ast.Unparen(e)
+		if bin, ok := inner.(*ast.BinaryExpr); ok && (bin.Op == token.LAND || bin.Op == token.LOR) {
+			flatten(bin.X)
+			ops = append(ops, bin.Op)
+			flatten(bin.Y)
+			return
+		}
+		operands = append(operands, e)
+	}
+	flatten(expr)
+
+	for i, op := range ops {
+		if i == 0 || op != ops[i-1] {
+			c.score++
+		}
+	}
+	for _, operand := range operands {
+		c.walk(operand, nesting)
+	}
+}
+
+func (c *cognitiveCounter) isRecursive(call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return c.recv == "" && fun.Name == c.name
+	case *ast.SelectorExpr:
+		x, ok := fun.X.(*ast.Ident)
+		return ok && c.recv != "" && x.Name == c.recv && fun.Sel.Name == c.name
+	}
+	return false
+}
+
+// halsteadMetrics counts identifiers and literals as operands, and
+// operators, keywords and brackets as operators
+func halsteadMetrics(body *ast.BlockStmt) HalsteadMetrics {
+	if body == nil {
+		return HalsteadMetrics{}
+	}
+
+	operators := make(map[string]int)
+	operands := make(map[string]int)
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			operands[n.Name]++
+		case *ast.BasicLit:
+			operands[n.Value]++
+		case *ast.BinaryExpr:
+			operators[n.Op.String()]++
+		case *ast.UnaryExpr:
+			operators[n.Op.String()]++
+		case *ast.StarExpr:
+			operators["*"]++
+		case *ast.AssignStmt:
+			operators[n.Tok.String()]++
+		case *ast.IncDecStmt:
+			operators[n.Tok.String()]++
+		case *ast.SendStmt:
+			operators["<-"]++
+		case *ast.CallExpr:
+			operators["()"]++
+		case *ast.IndexExpr, *ast.IndexListExpr:
+			operators["[]"]++
+		case *ast.SliceExpr:
+			operators["[:]"]++
+		case *ast.SelectorExpr:
+			operators["."]++
+		case *ast.TypeAssertExpr:
+			operators[".()"]++
+		case *ast.CompositeLit:
+			operators["{}"]++
+		case *ast.KeyValueExpr:
+			operators[":"]++
+		case *ast.IfStmt:
+			operators["if"]++
+			if n.Else != nil {
+				operators["else"]++
+			}
+		case *ast.ForStmt:
+			operators["for"]++
+		case *ast.RangeStmt:
+			operators["range"]++
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt:
+			operators["switch"]++
+		case *ast.SelectStmt:
+			operators["select"]++
+		case *ast.CaseClause:
+			operators["case"]++
+		case *ast.CommClause:
+			operators["case"]++
+		case *ast.ReturnStmt:
+			operators["return"]++
+		case *ast.BranchStmt:
+			operators[n.Tok.String()]++
+		case *ast.GoStmt:
+			operators["go"]++
+		case *ast.DeferStmt:
+			operators["defer"]++
+		case *ast.FuncLit:
+			operators["func"]++
+		case *ast.GenDecl:
+			operators[n.Tok.String()]++
+		}
+		return true
+	})
+
+	h := HalsteadMetrics{DistinctOperators: len(operators), DistinctOperands: len(operands)}
+	for _, count := range operators {
+		h.TotalOperators += count
+	}
+	for _, count := range operands {
+		h.TotalOperands += count
+	}
+	h.Vocabulary = h.DistinctOperators + h.DistinctOperands
+	h.Length = h.TotalOperators + h.TotalOperands
+	if h.Vocabulary > 0 {
+		h.Volume = float64(h.Length) * math.Log2(float64(h.Vocabulary))
+	}
+	if h.DistinctOperands > 0 {
+		h.Difficulty = float64(h.DistinctOperators) / 2 * float64(h.TotalOperands) / float64(h.DistinctOperands)
+	}
+	h.Effort = h.Difficulty * h.Volume
+	return h
+}
+
+// ===== 13. Template Engine =====
+
+// TemplateEngine renders registered text/template snippets into gofmt'd Go
+// files. Each template declares a parameter struct; fields tagged
+// `template:"required"` must be set.
+type TemplateEngine struct {
+	templates map[string]*registeredTemplate
+	mu        sync.RWMutex
+}
+
+type registeredTemplate struct {
+	tmpl   *texttemplate.Template
+	params reflect.Type
+}
+
+// TemplateJob renders one template into one file
+type TemplateJob struct {
+	Template string
+	File     string // relative to the output directory
+	Params   interface{}
+}
+
+// CRUDHandlerParams configure the crud_handler template: an HTTP handler
+// serving a resource from a <Resource>Store
+type CRUDHandlerParams struct {
+	Package  string `template:"required"`
+	Resource string `template:"required"` // Go type of the resource, such as User
+	Path     string // route prefix, "/<resource>s" if empty
+}
+
+// RepositoryParams configure the repository template: a database/sql
+// repository for an entity stored in one table
+type RepositoryParams struct {
+	Package string   `template:"required"`
+	Entity  string   `template:"required"`
+	Table   string   `template:"required"`
+	Columns []string `template:"required"` // the first column is the key
+}
+
+// TableTestParams configure the table_test template: a table-driven test
+// skeleton for an analyzed function
+type TableTestParams struct {
+	Package  string        `template:"required"`
+	Function *FunctionInfo `template:"required"`
+}
+
+// NewTemplateEngine creates an engine with the built-in crud_handler,
+// repository and table_test templates registered
+func NewTemplateEngine() *TemplateEngine {
+	te := &TemplateEngine{templates: make(map[string]*registeredTemplate)}
+	te.mustRegister("crud_handler", crudHandlerTemplate, CRUDHandlerParams{})
+	te.mustRegister("repository", repositoryTemplate, RepositoryParams{})
+	te.mustRegister("table_test", tableTestTemplate, TableTestParams{})
+	return te
+}
+
+// Register parses text and registers it under name. params is a value of
+// the struct type the template is rendered with.
+func (te *TemplateEngine) Register(name, text string, params interface{}) error {
+	paramsType := reflect.TypeOf(params)
+	if paramsType == nil || paramsType.Kind() != reflect.Struct {
+		return fmt.Errorf("template %s: parameters must be a struct, got %T", name, params)
+	}
+
+	tmpl, err := texttemplate.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("template %s: %w", name, err)
+	}
+
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if _, exists := te.templates[name]; exists {
+		return fmt.Errorf("template %s already registered", name)
+	}
+	te.templates[name] = &registeredTemplate{tmpl: tmpl, params: paramsType}
+	return nil
+}
+
+func (te *TemplateEngine) mustRegister(name, text string, params interface{}) {
+	if err := te.Register(name, text, params); err != nil {
+		panic(err)
+	}
+}
+
+// Names lists the registered templates in order
+func (te *TemplateEngine) Names() []string {
+	te.mu.RLock()
+	defer te.mu.RUnlock()
+
+	names := make([]string, 0, len(te.templates))
+	for name := range te.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render validates params against the template's parameter struct, executes
+// the template and gofmt's the result. params may be the struct or a
+// pointer to it.
+func (te *TemplateEngine) Render(name string, params interface{}) (string, error) {
+	te.mu.RLock()
+	registered, ok := te.templates[name]
+	te.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("template %s not registered", name)
+	}
+
+	value := reflect.ValueOf(params)
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if !value.IsValid() || value.Type() != registered.params {
+		return "", fmt.Errorf("template %s: parameters must be %s, got %T", name, registered.params, params)
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := registered.params.Field(i)
+		if field.Tag.Get("template") == "required" && isEmptyValue(value.Field(i)) {
+			return "", fmt.Errorf("template %s: missing required parameter %s", name, field.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := registered.tmpl.Execute(&buf, value.Interface()); err != nil {
+		return "", fmt.Errorf("template %s: %w", name, err)
+	}
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("template %s produced invalid Go: %w", name, err)
+	}
+	return string(code), nil
+}
+
+// Generate renders every job and, only if all succeed, writes the files
+// under dir in file name order. It returns the written paths.
+func (te *TemplateEngine) Generate(dir string, jobs []TemplateJob) ([]string, error) {
+	outputs := make(map[string]string, len(jobs))
+	for _, job := range jobs {
+		if _, dup := outputs[job.File]; dup {
+			return nil, fmt.Errorf("file %s generated twice", job.File)
+		}
+		code, err := te.Render(job.Template, job.Params)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", job.File, err)
+		}
+		outputs[job.File] = code
+	}
+
+	files := make([]string, 0, len(outputs))
+	for file := range outputs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return paths, err
+		}
+		if err := os.WriteFile(path, []byte(outputs[file]), 0o644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// isEmptyValue treats zero values and empty slices and maps as unset
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// templateFuncs are available to every registered template
+var templateFuncs = texttemplate.FuncMap{
+	"field": goFieldName,
+	"lower": lowerFirst,
+	"join":  strings.Join,
+	"add":   func(a, b int) int { return a + b },
+	"path": func(p CRUDHandlerParams) string {
+		if p.Path != "" {
+			return strings.TrimSuffix(p.Path, "/")
+		}
+		return "/" + strings.ToLower(p.Resource) + "s"
+	},
+	"testArgs": func(fn *FunctionInfo) []*ParamInfo {
+		args := make([]*ParamInfo, len(fn.Params))
+		for i, p := range fn.Params {
+			name := p.Name
+			if name == "" || name == "_" {
+				name = fmt.Sprintf("arg%d", i)
+			}
+			args[i] = &ParamInfo{Name: name, Type: strings.Replace(p.Type, "...", "[]", 1)}
+		}
+		return args
+	},
+	"testWants": func(fn *FunctionInfo) []*ParamInfo {
+		var wants []*ParamInfo
+		for _, r := range fn.Returns {
+			if r.Type == "error" {
+				continue
+			}
+			name := "want"
+			if len(wants) > 0 {
+				name = fmt.Sprintf("want%d", len(wants))
+			}
+			wants = append(wants, &ParamInfo{Name: name, Type: r.Type})
+		}
+		return wants
+	},
+	"returnsError": func(fn *FunctionInfo) bool {
+		return len(fn.Returns) > 0 && fn.Returns[len(fn.Returns)-1].Type == "error"
+	},
+	"callArgs": func(fn *FunctionInfo, args []*ParamInfo) string {
+		names := make([]string, len(args))
+		for i, a := range args {
+			names[i] = "tt." + a.Name
+			if strings.HasPrefix(fn.Params[i].Type, "...") {
+				names[i] += "..."
+			}
+		}
+		return strings.Join(names, ", ")
+	},
+}
+
+const crudHandlerTemplate = `// Code generated by TemplateEngine (crud_handler). DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+{{$r := .Resource}}{{$path := path .}}
+// {{$r}}Store persists {{$r}} values for {{$r}}Handler
+type {{$r}}Store interface {
+	List(ctx context.Context) ([]{{$r}}, error)
+	Get(ctx context.Context, id string) ({{$r}}, error)
+	Create(ctx context.Context, value {{$r}}) ({{$r}}, error)
+	Update(ctx context.Context, id string, value {{$r}}) ({{$r}}, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// {{$r}}Handler serves {{$path}} (list, create) and {{$path}}/{id} (get, update, delete)
+type {{$r}}Handler struct {
+	Store {{$r}}Store
+}
+
+// Register routes {{$path}} to the handler
+func (h *{{$r}}Handler) Register(mux *http.ServeMux) {
+	mux.Handle("{{$path}}", h)
+	mux.Handle("{{$path}}/", h)
+}
+
+func (h *{{$r}}Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "{{$path}}"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		values, err := h.Store.List(r.Context())
+		h.respond(w, http.StatusOK, values, err)
+	case id == "" && r.Method == http.MethodPost:
+		var value {{$r}}
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := h.Store.Create(r.Context(), value)
+		h.respond(w, http.StatusCreated, created, err)
+	case id != "" && r.Method == http.MethodGet:
+		value, err := h.Store.Get(r.Context(), id)
+		h.respond(w, http.StatusOK, value, err)
+	case id != "" && r.Method == http.MethodPut:
+		var value {{$r}}
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := h.Store.Update(r.Context(), id, value)
+		h.respond(w, http.StatusOK, updated, err)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := h.Store.Delete(r.Context(), id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *{{$r}}Handler) respond(w http.ResponseWriter, status int, body interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+`
+
+const repositoryTemplate = `// Code generated by TemplateEngine (repository). DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"database/sql"
+)
+
+{{$e := .Entity}}{{$key := index .Columns 0}}
+const {{lower $e}}Columns = "{{join .Columns ", "}}"
+
+// {{$e}}Repository stores {{$e}} values in the {{.Table}} table
+type {{$e}}Repository struct {
+	db *sql.DB
+}
+
+// New{{$e}}Repository creates a repository using db
+func New{{$e}}Repository(db *sql.DB) *{{$e}}Repository {
+	return &{{$e}}Repository{db: db}
+}
+
+func scan{{$e}}(row interface{ Scan(...interface{}) error }) (*{{$e}}, error) {
+	var value {{$e}}
+	if err := row.Scan({{range $i, $c := .Columns}}{{if $i}}, {{end}}&value.{{field $c}}{{end}}); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// Get loads the {{$e}} with the given {{$key}}
+func (r *{{$e}}Repository) Get(ctx context.Context, key interface{}) (*{{$e}}, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+{{lower $e}}Columns+" FROM {{.Table}} WHERE {{$key}} = $1", key)
+	return scan{{$e}}(row)
+}
+
+// List loads every {{$e}}
+func (r *{{$e}}Repository) List(ctx context.Context) ([]*{{$e}}, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+{{lower $e}}Columns+" FROM {{.Table}} ORDER BY {{$key}}")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []*{{$e}}
+	for rows.Next() {
+		value, err := scan{{$e}}(rows)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Insert stores a new {{$e}}
+func (r *{{$e}}Repository) Insert(ctx context.Context, value *{{$e}}) error {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO {{.Table}} ("+{{lower $e}}Columns+") VALUES ({{range $i, $c := .Columns}}{{if $i}}, {{end}}${{add $i 1}}{{end}})",
+		{{range $i, $c := .Columns}}{{if $i}}, {{end}}value.{{field $c}}{{end}})
+	return err
+}
+
+// Delete removes the {{$e}} with the given {{$key}}
+func (r *{{$e}}Repository) Delete(ctx context.Context, key interface{}) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM {{.Table}} WHERE {{$key}} = $1", key)
+	return err
+}
+`
+
+const tableTestTemplate = `{{$fn := .Function}}{{$args := testArgs $fn}}{{$wants := testWants $fn}}{{$err := returnsError $fn}}
+package {{.Package}}
+
+import (
+	{{- if $wants}}
+	"reflect"
+	{{- end}}
+	"testing"
+)
+
+func Test{{with $fn.Receiver}}{{field .}}{{end}}{{field $fn.Name}}(t *testing.T) {
+	tests := []struct {
+		name string
+		{{- with $fn.Receiver}}
+		recv {{.}}
+		{{- end}}
+		{{- range $args}}
+		{{.Name}} {{.Type}}
+		{{- end}}
+		{{- range $wants}}
+		{{.Name}} {{.Type}}
+		{{- end}}
+		{{- if $err}}
+		wantErr bool
+		{{- end}}
+	}{
+		// TODO: add test cases
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			{{range $i, $w := $wants}}{{if $i}}, {{end}}got{{if $i}}{{$i}}{{end}}{{end}}{{if $err}}{{if $wants}}, {{end}}err{{end}}{{if or $wants $err}} := {{end}}{{if $fn.Receiver}}tt.recv.{{end}}{{$fn.Name}}({{callArgs $fn $args}})
+			{{- if $err}}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("{{$fn.Name}}() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			{{- end}}
+			{{- range $i, $w := $wants}}
+			if !reflect.DeepEqual(got{{if $i}}{{$i}}{{end}}, tt.{{$w.Name}}) {
+				t.Errorf("{{$fn.Name}}() got{{if $i}}{{$i}}{{end}} = %v, want %v", got{{if $i}}{{$i}}{{end}}, tt.{{$w.Name}})
+			}
+			{{- end}}
+		})
+	}
+}
+`
+
+// ===== 14. Dead Code =====
+
+// DeadCodeFinding is an unreachable function, unused field or unused
+// parameter found by AnalyzePackage
+type DeadCodeFinding struct {
+	Check   string // dead_code, unused_field or unused_param
+	Name    string // "F", "T.M", "T.field" or "F.param"
+	Pos     token.Position
+	Message string
+}
+
+// findDeadCode reports package functions unreachable from the package's
+// entry points, unexported struct fields never accessed and function
+// parameters never read. Entry points are main and init, exported
+// functions of a library package, exported methods of used types and
+// methods that satisfy one of the package's interfaces. Findings on the
+// line of, or below, a `//lint:ignore <check>[,<check>] reason` comment are
+// dropped.
+func findDeadCode(pkg *packages.Package, impls map[string][]string) []*DeadCodeFinding {
+	info := pkg.TypesInfo
+	isMain := pkg.Name == "main"
+
+	scope := pkg.Types.Scope()
+	satisfies := satisfyingMethods(scope, impls)
+
+	// References from each function, and from outside any function
+	refs := make(map[*types.Func][]*types.Func)
+	var roots []*types.Func
+	usedTypes := make(map[types.Object]bool)
+	asValue := make(map[*types.Func]bool)
+	decls := make(map[*types.Func]*ast.FuncDecl)
+
+	for _, file := range pkg.Syntax {
+		var current *types.Func
+		var calls map[*ast.Ident]bool
+		for _, decl := range file.Decls {
+			current = nil
+			calls = make(map[*ast.Ident]bool)
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				current, _ = info.Defs[fn.Name].(*types.Func)
+				if current != nil {
+					decls[current] = fn
+				}
+			}
+
+			ast.Inspect(decl, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CallExpr:
+					switch f := ast.Unparen(n.Fun).(type) {
+					case *ast.Ident:
+						calls[f] = true
+					case *ast.SelectorExpr:
+						calls[f.Sel] = true
+					}
+				case *ast.Ident:
+					obj := info.Uses[n]
+					if tn, ok := obj.(*types.TypeName); ok {
+						usedTypes[tn] = true
+					}
+					fn, ok := obj.(*types.Func)
+					if !ok || fn.Pkg() != pkg.Types {
+						return true
+					}
+					if !calls[n] {
+						asValue[fn] = true
+					}
+					if current == nil {
+						roots = append(roots, fn)
+					} else {
+						refs[current] = append(refs[current], fn)
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	for fn := range decls {
+		name := fn.Name()
+		sig := fn.Type().(*types.Signature)
+		if sig.Recv() == nil {
+			if name == "init" || (isMain && name == "main") || (!isMain && fn.Exported()) {
+				roots = append(roots, fn)
+			}
+			continue
+		}
+		if satisfies[funcName(fn)] {
+			roots = append(roots, fn)
+			continue
+		}
+		recv := sig.Recv().Type()
+		if ptr, ok := recv.(*types.Pointer); ok {
+			recv = ptr.Elem()
+		}
+		if named, ok := recv.(*types.Named); ok && fn.Exported() && (!isMain || usedTypes[named.Obj()]) {
+			roots = append(roots, fn)
+		}
+	}
+
+	reachable := make(map[*types.Func]bool)
+	for len(roots) > 0 {
+		fn := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if reachable[fn] {
+			continue
+		}
+		reachable[fn] = true
+		roots = append(roots, refs[fn]...)
+	}
+
+	var findings []*DeadCodeFinding
+	report := func(check, name string, pos token.Pos, format string, args ...interface{}) {
+		findings = append(findings, &DeadCodeFinding{Check: check, Name: name, Pos: pkg.Fset.Position(pos), Message: fmt.Sprintf(format, args...)})
+	}
+
+	for fn, decl := range decls {
+		if fn.Name() == "_" {
+			continue
+		}
+		if !reachable[fn] {
+			report("dead_code", funcName(fn), decl.Name.Pos(), "%s is unreachable", funcName(fn))
+		}
+		if decl.Recv != nil || asValue[fn] || decl.Body == nil || len(decl.Body.List) == 0 {
+			continue // the signature may be dictated by an interface or callback
+		}
+
+		read := make(map[types.Object]bool)
+		ast.Inspect(decl.Body, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok {
+				read[info.Uses[ident]] = true
+			}
+			return true
+		})
+		for _, field := range decl.Type.Params.List {
+			for _, name := range field.Names {
+				if obj := info.Defs[name]; name.Name != "_" && obj != nil && !read[obj] {
+					report("unused_param", fn.Name()+"."+name.Name, name.Pos(), "parameter %s of %s is never used", name.Name, fn.Name())
+				}
+			}
+		}
+	}
+
+	usedFields := make(map[types.Object]bool)
+	for _, obj := range info.Uses {
+		usedFields[obj] = true
+	}
+	for _, sel := range info.Selections {
+		usedFields[sel.Obj()] = true
+	}
+	for expr, tv := range info.Types {
+		// Unkeyed literals set every field
+		lit, ok := expr.(*ast.CompositeLit)
+		if !ok || len(lit.Elts) == 0 {
+			continue
+		}
+		if _, keyed := lit.Elts[0].(*ast.KeyValueExpr); keyed {
+			continue
+		}
+		if st, ok := tv.Type.Underlying().(*types.Struct); ok {
+			for i := 0; i < st.NumFields(); i++ {
+				usedFields[st.Field(i)] = true
+			}
+		}
+	}
+
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || tn.IsAlias() {
+			continue
+		}
+		st, ok := tn.Type().Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+		for i := 0; i < st.NumFields(); i++ {
+			field := st.Field(i)
+			if field.Exported() || field.Embedded() || field.Name() == "_" || usedFields[field] {
+				continue
+			}
+			report("unused_field", name+"."+field.Name(), field.Pos(), "field %s of %s is never used", field.Name(), name)
+		}
+	}
+
+	findings = suppressFindings(pkg, findings, decls)
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i].Pos, findings[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return findings
+}
+
+// suppressFindings drops findings covered by //lint:ignore comments on
+// their line or the line above. Parameters are also covered by a comment on
+// their function.
+func suppressFindings(pkg *packages.Package, findings []*DeadCodeFinding, decls map[*types.Func]*ast.FuncDecl) []*DeadCodeFinding {
+	type line struct {
+		file string
+		line int
+	}
+	ignored := make(map[line]map[string]bool)
+	for _, file := range pkg.Syntax {
+		for _, group := range file.Comments {
+			for _, c := range group.List {
+				fields := strings.Fields(strings.TrimPrefix(c.Text, "//lint:ignore"))
+				if !strings.HasPrefix(c.Text, "//lint:ignore ") || len(fields) == 0 {
+					continue
+				}
+				pos := pkg.Fset.Position(c.Pos())
+				checks := make(map[string]bool)
+				for _, check := range strings.Split(fields[0], ",") {
+					checks[check] = true
+				}
+				ignored[line{pos.Filename, pos.Line}] = checks
+			}
+		}
+	}
+
+	funcLines := make(map[string]token.Position) // function name -> position
+	for fn, decl := range decls {
+		if decl.Recv == nil {
+			funcLines[fn.Name()] = pkg.Fset.Position(decl.Pos())
+		}
+	}
+
+	isIgnored := func(check string, pos token.Position) bool {
+		return ignored[line{pos.Filename, pos.Line}][check] || ignored[line{pos.Filename, pos.Line - 1}][check]
+	}
+
+	kept := findings[:0]
+	for _, f := range findings {
+		if isIgnored(f.Check, f.Pos) {
+			continue
+		}
+		if f.Check == "unused_param" {
+			if pos, ok := funcLines[strings.SplitN(f.Name, ".", 2)[0]]; ok && isIgnored(f.Check, pos) {
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// ===== 15. Enum Generation =====
+
+// enumConst is one constant of an enum type
+type enumConst struct {
+	name  string
+	value constant.Value
+}
+
+// GenerateEnum finds the constants of typeName in source and emits, in the
+// style of stringer, a String method, MarshalJSON and UnmarshalJSON using
+// the string form and a Parse<Type> function matching it case-insensitively.
+// Integer enums use the constant names; string enums use the values and
+// also parse the names. The code is gofmt'd, added to the generator's file
+// and returned.
+func (cg *CodeGenerator) GenerateEnum(source, typeName string) (string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "enum.go", source, 0)
+	if err != nil {
+		return "", err
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	tn, ok := pkg.Scope().Lookup(typeName).(*types.TypeName)
+	if !ok {
+		return "", fmt.Errorf("type %s not found", typeName)
+	}
+	basic, ok := tn.Type().Underlying().(*types.Basic)
+	if !ok || basic.Info()&(types.IsInteger|types.IsString) == 0 {
+		return "", fmt.Errorf("%s must have an integer or string underlying type", typeName)
+	}
+	isString := basic.Info()&types.IsString != 0
+
+	var consts []enumConst
+	for _, name := range pkg.Scope().Names() {
+		c, ok := pkg.Scope().Lookup(name).(*types.Const)
+		if ok && name != "_" && types.Identical(c.Type(), tn.Type()) {
+			consts = append(consts, enumConst{name: name, value: c.Val()})
+		}
+	}
+	if len(consts) == 0 {
+		return "", fmt.Errorf("no constants of type %s", typeName)
+	}
+	sort.Slice(consts, func(i, j int) bool {
+		return pkg.Scope().Lookup(consts[i].name).Pos() < pkg.Scope().Lookup(consts[j].name).Pos()
+	})
+
+	recv := strings.ToLower(typeName[:1])
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "// String returns the name of the %s constant\n", typeName)
+	if isString {
+		fmt.Fprintf(&buf, "func (%s %s) String() string {\nreturn string(%s)\n}\n\n", recv, typeName, recv)
+	} else {
+		fmt.Fprintf(&buf, "func (%s %s) String() string {\nswitch %s {\n", recv, typeName, recv)
+		seen := make(map[string]bool)
+		for _, c := range consts {
+			if key := c.value.ExactString(); !seen[key] {
+				seen[key] = true
+				fmt.Fprintf(&buf, "case %s:\nreturn %q\n", c.name, c.name)
+			}
+		}
+		fmt.Fprintf(&buf, "}\nreturn fmt.Sprintf(\"%s(%%d)\", %s)\n}\n\n", typeName, recv)
+	}
+
+	fmt.Fprintf(&buf, "// MarshalJSON encodes the %s as its string form\n", typeName)
+	fmt.Fprintf(&buf, "func (%s %s) MarshalJSON() ([]byte, error) {\nreturn json.Marshal(%s.String())\n}\n\n", recv, typeName, recv)
+
+	fmt.Fprintf(&buf, "// UnmarshalJSON decodes a %s from its string form\n", typeName)
+	fmt.Fprintf(&buf, "func (%s *%s) UnmarshalJSON(data []byte) error {\n", recv, typeName)
+	fmt.Fprintf(&buf, "var s string\nif err := json.Unmarshal(data, &s); err != nil {\nreturn err\n}\n")
+	fmt.Fprintf(&buf, "value, err := Parse%s(s)\nif err != nil {\nreturn err\n}\n*%s = value\nreturn nil\n}\n\n", typeName, recv)
+
+	zero := "0"
+	if isString {
+		zero = `""`
+	}
+	fmt.Fprintf(&buf, "// Parse%s returns the %s for s, ignoring case\n", typeName, typeName)
+	fmt.Fprintf(&buf, "func Parse%s(s string) (%s, error) {\nswitch strings.ToLower(s) {\n", typeName, typeName)
+	seen := make(map[string]bool)
+	for _, c := range consts {
+		keys := []string{strings.ToLower(c.name)}
+		if isString {
+			keys = []string{strings.ToLower(constant.StringVal(c.value)), strings.ToLower(c.name)}
+		}
+		var cases []string
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				cases = append(cases, strconv.Quote(key))
+			}
+		}
+		if len(cases) > 0 {
+			fmt.Fprintf(&buf, "case %s:\nreturn %s, nil\n", strings.Join(cases, ", "), c.name)
+		}
+	}
+	fmt.Fprintf(&buf, "}\nreturn %s, fmt.Errorf(\"invalid %s %%q\", s)\n}\n", zero, typeName)
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	for _, imp := range []string{"encoding/json", "fmt", "strings"} {
+		cg.AddImport(imp)
+	}
+	cg.mu.Lock()
+	cg.code.Write(code)
+	cg.code.WriteString("\n")
+	cg.mu.Unlock()
+
+	return string(code), nil
+}
+
+// ===== 16. Rule Packs =====
+
+// RulePack is a lint policy loaded at runtime, typically shared as YAML:
+//
+//	rules:
+//	  - id: no_todo
+//	    pattern: "TODO"
+//	    severity: warning
+//	    message: TODO comments present
+//	  - id: errors
+//	    analyzer: unchecked_error
+//	directories:
+//	  - path: internal/legacy
+//	    disable: [errors]
+//	  - path: cmd
+//	    severity: {no_todo: error}
+type RulePack struct {
+	Rules       []RuleConfig      `yaml:"rules"`
+	Directories []DirectoryConfig `yaml:"directories"`
+}
+
+// RuleConfig defines a regex rule (Pattern) or a built-in AST analyzer
+// (Analyzer) under ID
+type RuleConfig struct {
+	ID       string `yaml:"id"`
+	Name     string `yaml:"name"`
+	Pattern  string `yaml:"pattern"`
+	Analyzer string `yaml:"analyzer"`
+	Severity string `yaml:"severity"`
+	Message  string `yaml:"message"`
+	Disabled bool   `yaml:"disabled"` // off unless a directory enables it
+}
+
+// DirectoryConfig adjusts the rules for files under Path. Deeper
+// directories are applied after their parents.
+type DirectoryConfig struct {
+	Path     string            `yaml:"path"`
+	Enable   []string          `yaml:"enable"`
+	Disable  []string          `yaml:"disable"`
+	Severity map[string]string `yaml:"severity"` // rule ID -> severity
+}
+
+// builtinAnalyzers are the analyzers a rule pack can refer to by name
+var builtinAnalyzers = map[string]func() *LintAnalyzer{
+	"unchecked_error": UncheckedErrorAnalyzer,
+	"mutex_copy":      MutexCopyAnalyzer,
+	"exported_doc":    ExportedDocAnalyzer,
+}
+
+var validSeverities = map[string]bool{"error": true, "warning": true, "info": true}
+
+// ParseRulePack decodes and validates a YAML rule pack
+func ParseRulePack(data []byte) (*RulePack, error) {
+	var pack RulePack
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&pack); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid rule pack: %w", err)
+	}
+
+	ids := make(map[string]bool)
+	for i, rule := range pack.Rules {
+		switch {
+		case rule.ID == "":
+			return nil, fmt.Errorf("rule %d: missing id", i+1)
+		case ids[rule.ID]:
+			return nil, fmt.Errorf("rule %s: duplicate id", rule.ID)
+		case (rule.Pattern == "") == (rule.Analyzer == ""):
+			return nil, fmt.Errorf("rule %s: needs exactly one of pattern and analyzer", rule.ID)
+		case rule.Analyzer != "" && builtinAnalyzers[rule.Analyzer] == nil:
+			return nil, fmt.Errorf("rule %s: unknown analyzer %q", rule.ID, rule.Analyzer)
+		case rule.Severity != "" && !validSeverities[rule.Severity]:
+			return nil, fmt.Errorf("rule %s: invalid severity %q", rule.ID, rule.Severity)
+		}
+		if rule.Pattern != "" {
+			if _, err := regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.ID, err)
+			}
+		}
+		ids[rule.ID] = true
+	}
+
+	for _, dir := range pack.Directories {
+		for _, id := range append(append([]string{}, dir.Enable...), dir.Disable...) {
+			if !ids[id] {
+				return nil, fmt.Errorf("directory %s: unknown rule %s", dir.Path, id)
+			}
+		}
+		for id, severity := range dir.Severity {
+			if !ids[id] {
+				return nil, fmt.Errorf("directory %s: unknown rule %s", dir.Path, id)
+			}
+			if !validSeverities[severity] {
+				return nil, fmt.Errorf("directory %s: invalid severity %q for %s", dir.Path, severity, id)
+			}
+		}
+	}
+	return &pack, nil
+}
+
+// LoadRulePack reads a rule pack from a YAML file
+func LoadRulePack(path string) (*RulePack, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pack, err := ParseRulePack(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pack, nil
+}
+
+// ApplyRulePack registers the pack's rules and analyzers, replacing any
+// with the same ID, and makes its directory settings apply to LintFile
+func (cl *CustomLinter) ApplyRulePack(pack *RulePack) error {
+	for _, rule := range pack.Rules {
+		severity := rule.Severity
+		if rule.Pattern == "" {
+			analyzer := builtinAnalyzers[rule.Analyzer]()
+			analyzer.ID = rule.ID
+			if rule.Name != "" {
+				analyzer.Name = rule.Name
+			}
+			if rule.Message != "" {
+				analyzer.Description = rule.Message
+			}
+			if severity != "" {
+				analyzer.Severity = severity
+			}
+			cl.mu.Lock()
+			cl.removeAnalyzer(rule.ID)
+			cl.analyzers = append(cl.analyzers, analyzer)
+			cl.mu.Unlock()
+			continue
+		}
+
+		if severity == "" {
+			severity = "warning"
+		}
+		message := rule.Message
+		if message == "" {
+			message = rule.Name
+		}
+		if err := cl.AddRule(rule.ID, rule.Name, message, rule.Pattern, severity); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+	}
+
+	disabled := make(map[string]bool)
+	for _, rule := range pack.Rules {
+		if rule.Disabled {
+			disabled[rule.ID] = true
+		}
+	}
+	dirs := append([]DirectoryConfig{}, pack.Directories...)
+	sort.SliceStable(dirs, func(i, j int) bool { return dirDepth(dirs[i].Path) < dirDepth(dirs[j].Path) })
+
+	cl.mu.Lock()
+	cl.policy = &lintPolicy{disabled: disabled, dirs: dirs}
+	cl.mu.Unlock()
+	return nil
+}
+
+func (cl *CustomLinter) removeAnalyzer(id string) {
+	kept := cl.analyzers[:0]
+	for _, a := range cl.analyzers {
+		if a.ID != id {
+			kept = append(kept, a)
+		}
+	}
+	cl.analyzers = kept
+}
+
+// lintPolicy is the directory-dependent part of an applied rule pack
+type lintPolicy struct {
+	disabled map[string]bool
+	dirs     []DirectoryConfig // parents first
+}
+
+// resolve returns the rules disabled for file and its severity overrides
+func (p *lintPolicy) resolve(file string) (map[string]bool, map[string]string) {
+	disabled := make(map[string]bool)
+	severity := make(map[string]string)
+	if p == nil {
+		return disabled, severity
+	}
+	for id := range p.disabled {
+		disabled[id] = true
+	}
+
+	file = path.Clean(filepath.ToSlash(file))
+	for _, dir := range p.dirs {
+		dirPath := path.Clean(filepath.ToSlash(dir.Path))
+		if dirPath != "." && file != dirPath && !strings.HasPrefix(file, dirPath+"/") {
+			continue
+		}
+		for _, id := range dir.Disable {
+			disabled[id] = true
+		}
+		for _, id := range dir.Enable {
+			delete(disabled, id)
+		}
+		for id, level := range dir.Severity {
+			severity[id] = level
+		}
+	}
+	return disabled, severity
+}
+
+func dirDepth(dir string) int {
+	dir = path.Clean(filepath.ToSlash(dir))
+	if dir == "." {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// ===== 17. API Compatibility =====
+
+// APIChange is one difference between two versions of a package's
+// exported API
+type APIChange struct {
+	Kind     string // removed, changed, added
+	Object   string // "F", "T", "T.Method" or "T.Field"
+	Old      string
+	New      string
+	Breaking bool
+	Message  string
+}
+
+// APIDiff lists the changes between two versions, sorted by object
+type APIDiff struct {
+	Changes []APIChange
+}
+
+// Breaking returns the changes that can break existing users
+func (d *APIDiff) Breaking() []APIChange {
+	var breaking []APIChange
+	for _, c := range d.Changes {
+		if c.Breaking {
+			breaking = append(breaking, c)
+		}
+	}
+	return breaking
+}
+
+// Err returns an error describing the breaking changes, or nil, for use as
+// a release gate
+func (d *APIDiff) Err() error {
+	breaking := d.Breaking()
+	if len(breaking) == 0 {
+		return nil
+	}
+	messages := make([]string, len(breaking))
+	for i, c := range breaking {
+		messages[i] = c.Message
+	}
+	return fmt.Errorf("%d breaking API changes: %s", len(breaking), strings.Join(messages, "; "))
+}
+
+// CompareAPIs type-checks two versions of a package's source and reports
+// how its exported API changed: removed, added and changed functions,
+// types, variables, constants, methods and struct fields, changed and
+// narrowed interfaces, and types that stop implementing an interface.
+func CompareAPIs(oldSrc, newSrc string) (*APIDiff, error) {
+	oldPkg, err := checkAPISource(oldSrc)
+	if err != nil {
+		return nil, fmt.Errorf("old version: %w", err)
+	}
+	newPkg, err := checkAPISource(newSrc)
+	if err != nil {
+		return nil, fmt.Errorf("new version: %w", err)
+	}
+
+	c := &apiComparer{oldPkg: oldPkg, newPkg: newPkg}
+	for _, name := range oldPkg.Scope().Names() {
+		oldObj := oldPkg.Scope().Lookup(name)
+		if !oldObj.Exported() {
+			continue
+		}
+		newObj := newPkg.Scope().Lookup(name)
+		if newObj == nil || !newObj.Exported() {
+			c.add("removed", name, c.describe(oldObj, oldPkg), "", true, "%s was removed", name)
+			continue
+		}
+		c.compareObjects(name, oldObj, newObj)
+	}
+	for _, name := range newPkg.Scope().Names() {
+		if obj := newPkg.Scope().Lookup(name); obj.Exported() && oldPkg.Scope().Lookup(name) == nil {
+			c.add("added", name, "", c.describe(obj, newPkg), false, "%s was added", name)
+		}
+	}
+	c.compareSatisfaction()
+
+	sort.Slice(c.diff.Changes, func(i, j int) bool {
+		a, b := c.diff.Changes[i], c.diff.Changes[j]
+		if a.Object != b.Object {
+			return a.Object < b.Object
+		}
+		return a.Message < b.Message
+	})
+	return &c.diff, nil
+}
+
+func checkAPISource(src string) (*types.Package, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "api.go", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	return conf.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+}
+
+type apiComparer struct {
+	oldPkg, newPkg *types.Package
+	diff           APIDiff
+}
+
+func (c *apiComparer) add(kind, object, oldDesc, newDesc string, breaking bool, format string, args ...interface{}) {
+	c.diff.Changes = append(c.diff.Changes, APIChange{
+		Kind: kind, Object: object, Old: oldDesc, New: newDesc, Breaking: breaking,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// describe prints an object the way both versions can be compared: types
+// of the package itself are unqualified and constants include their value
+func (c *apiComparer) describe(obj types.Object, pkg *types.Package) string {
+	desc := types.ObjectString(obj, apiQualifier(pkg))
+	if k, ok := obj.(*types.Const); ok {
+		desc += " = " + k.Val().ExactString()
+	}
+	return desc
+}
+
+func apiQualifier(pkg *types.Package) types.Qualifier {
+	return func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		return p.Name()
+	}
+}
+
+func (c *apiComparer) typeString(t types.Type, pkg *types.Package) string {
+	return types.TypeString(t, apiQualifier(pkg))
+}
+
+func (c *apiComparer) compareObjects(name string, oldObj, newObj types.Object) {
+	oldDesc, newDesc := c.describe(oldObj, c.oldPkg), c.describe(newObj, c.newPkg)
+
+	switch oldObj := oldObj.(type) {
+	case *types.Func, *types.Var:
+		if oldDesc != newDesc {
+			c.add("changed", name, oldDesc, newDesc, true, "%s changed from %q to %q", name, oldDesc, newDesc)
+		}
+	case *types.Const:
+		if _, ok := newObj.(*types.Const); !ok || oldDesc != newDesc {
+			c.add("changed", name, oldDesc, newDesc, true, "%s changed from %q to %q", name, oldDesc, newDesc)
+		}
+	case *types.TypeName:
+		newType, ok := newObj.(*types.TypeName)
+		if !ok {
+			c.add("changed", name, oldDesc, newDesc, true, "%s is no longer a type", name)
+			return
+		}
+		c.compareTypes(name, oldObj, newType)
+	}
+}
+
+func (c *apiComparer) compareTypes(name string, oldType, newType *types.TypeName) {
+	oldUnder, newUnder := oldType.Type().Underlying(), newType.Type().Underlying()
+
+	oldIface, oldIsIface := oldUnder.(*types.Interface)
+	newIface, newIsIface := newUnder.(*types.Interface)
+	oldStruct, oldIsStruct := oldUnder.(*types.Struct)
+	newStruct, newIsStruct := newUnder.(*types.Struct)
+
+	switch {
+	case oldIsIface && newIsIface:
+		c.compareInterfaces(name, oldIface, newIface)
+	case oldIsStruct && newIsStruct:
+		c.compareStructs(name, oldStruct, newStruct)
+	default:
+		oldDesc, newDesc := c.typeString(oldUnder, c.oldPkg), c.typeString(newUnder, c.newPkg)
+		if oldDesc != newDesc {
+			c.add("changed", name, oldDesc, newDesc, true, "type %s changed from %s to %s", name, oldDesc, newDesc)
+		}
+	}
+
+	if !oldIsIface && !newIsIface {
+		c.compareMethods(name, oldType.Type(), newType.Type())
+	}
+}
+
+func (c *apiComparer) compareInterfaces(name string, oldIface, newIface *types.Interface) {
+	oldMethods, newMethods := interfaceMethods(oldIface), interfaceMethods(newIface)
+	for method, oldFn := range oldMethods {
+		object := name + "." + method
+		oldDesc := c.typeString(oldFn.Type(), c.oldPkg)
+		newFn, ok := newMethods[method]
+		if !ok {
+			c.add("removed", object, oldDesc, "", true, "method %s was removed from interface %s", method, name)
+			continue
+		}
+		if newDesc := c.typeString(newFn.Type(), c.newPkg); oldDesc != newDesc {
+			c.add("changed", object, oldDesc, newDesc, true, "interface method %s changed from %s to %s", object, oldDesc, newDesc)
+		}
+	}
+	for method, newFn := range newMethods {
+		if _, ok := oldMethods[method]; !ok {
+			c.add("added", name+"."+method, "", c.typeString(newFn.Type(), c.newPkg), true,
+				"interface %s was narrowed: implementations must add %s", name, method)
+		}
+	}
+}
+
+func interfaceMethods(iface *types.Interface) map[string]*types.Func {
+	methods := make(map[string]*types.Func)
+	for i := 0; i < iface.NumMethods(); i++ {
+		if m := iface.Method(i); m.Exported() {
+			methods[m.Name()] = m
+		}
+	}
+	return methods
+}
+
+func (c *apiComparer) compareStructs(name string, oldStruct, newStruct *types.Struct) {
+	newFields := make(map[string]*types.Var)
+	for i := 0; i < newStruct.NumFields(); i++ {
+		newFields[newStruct.Field(i).Name()] = newStruct.Field(i)
+	}
+
+	oldFields := make(map[string]bool)
+	for i := 0; i < oldStruct.NumFields(); i++ {
+		field := oldStruct.Field(i)
+		if !field.Exported() {
+			continue
+		}
+		oldFields[field.Name()] = true
+		object := name + "." + field.Name()
+		oldDesc := c.typeString(field.Type(), c.oldPkg)
+		newField, ok := newFields[field.Name()]
+		if !ok || !newField.Exported() {
+			c.add("removed", object, oldDesc, "", true, "field %s was removed", object)
+			continue
+		}
+		if newDesc := c.typeString(newField.Type(), c.newPkg); oldDesc != newDesc {
+			c.add("changed", object, oldDesc, newDesc, true, "field %s changed from %s to %s", object, oldDesc, newDesc)
+		}
+	}
+	for i := 0; i < newStruct.NumFields(); i++ {
+		field := newStruct.Field(i)
+		if field.Exported() && !oldFields[field.Name()] {
+			c.add("added", name+"."+field.Name(), "", c.typeString(field.Type(), c.newPkg), false, "field %s.%s was added", name, field.Name())
+		}
+	}
+}
+
+// compareMethods compares the method sets of T and *T, so moving a method
+// to a pointer receiver counts as removing it from T
+func (c *apiComparer) compareMethods(name string, oldType, newType types.Type) {
+	oldValue, newValue := exportedMethods(oldType), exportedMethods(newType)
+	oldPtr, newPtr := exportedMethods(types.NewPointer(oldType)), exportedMethods(types.NewPointer(newType))
+
+	for method, oldFn := range oldPtr {
+		object := name + "." + method
+		oldDesc := c.typeString(oldFn.Type(), c.oldPkg)
+		newFn, ok := newPtr[method]
+		switch {
+		case !ok:
+			c.add("removed", object, oldDesc, "", true, "method %s was removed", object)
+		case c.typeString(newFn.Type(), c.newPkg) != oldDesc:
+			newDesc := c.typeString(newFn.Type(), c.newPkg)
+			c.add("changed", object, oldDesc, newDesc, true, "method %s changed from %s to %s", object, oldDesc, newDesc)
+		case oldValue[method] != nil && newValue[method] == nil:
+			c.add("changed", object, oldDesc, oldDesc, true, "method %s now has a pointer receiver", object)
+		}
+	}
+	for method, newFn := range newPtr {
+		if oldPtr[method] == nil {
+			c.add("added", name+"."+method, "", c.typeString(newFn.Type(), c.newPkg), false, "method %s.%s was added", name, method)
+		}
+	}
+}
+
+func exportedMethods(t types.Type) map[string]*types.Func {
+	methods := make(map[string]*types.Func)
+	set := types.NewMethodSet(t)
+	for i := 0; i < set.Len(); i++ {
+		if fn, ok := set.At(i).Obj().(*types.Func); ok && fn.Exported() {
+			methods[fn.Name()] = fn
+		}
+	}
+	return methods
+}
+
+// compareSatisfaction reports exported types that implemented one of the
+// package's exported interfaces and no longer do
+func (c *apiComparer) compareSatisfaction() {
+	oldScope, newScope := c.oldPkg.Scope(), c.newPkg.Scope()
+	for _, ifaceName := range oldScope.Names() {
+		oldIface, ok := exportedInterface(oldScope, ifaceName)
+		if !ok {
+			continue
+		}
+		newIface, ok := exportedInterface(newScope, ifaceName)
+		if !ok {
+			continue
+		}
+
+		for _, typeName := range oldScope.Names() {
+			oldT, ok := oldScope.Lookup(typeName).(*types.TypeName)
+			if !ok || !oldT.Exported() || types.IsInterface(oldT.Type()) {
+				continue
+			}
+			newT, ok := newScope.Lookup(typeName).(*types.TypeName)
+			if !ok || types.IsInterface(newT.Type()) {
+				continue
+			}
+
+			for _, t := range []struct {
+				name     string
+				old, new types.Type
+			}{
+				{typeName, oldT.Type(), newT.Type()},
+				{"*" + typeName, types.NewPointer(oldT.Type()), types.NewPointer(newT.Type())},
+			} {
+				if types.Implements(t.old, oldIface) && !types.Implements(t.new, newIface) {
+					c.add("changed", typeName, "implements "+ifaceName, "", true, "%s no longer implements %s", t.name, ifaceName)
+					break
+				}
+			}
+		}
+	}
+}
+
+func exportedInterface(scope *types.Scope, name string) (*types.Interface, bool) {
+	tn, ok := scope.Lookup(name).(*types.TypeName)
+	if !ok || !tn.Exported() {
+		return nil, false
+	}
+	iface, ok := tn.Type().Underlying().(*types.Interface)
+	return iface, ok && !iface.Empty()
+}
+
+// ===== 18. HTTP Stubs =====
+
+// stubReserved are the names the generated client methods use for locals
+var stubReserved = map[string]bool{"c": true, "out": true, "err": true}
+
+// stubParam is a method parameter carried in a request struct, or the
+// context taken from the request
+type stubParam struct {
+	name    string
+	field   string
+	typ     string
+	context bool
+}
+
+// GenerateHTTPStubs emits, for an analyzed interface, an HTTP binding in
+// the style of the challenge-135 REST server: a <Interface>Handler serving
+// each method as POST <prefix>/<method-name> with JSON
+// <Interface><Method>Request and Response structs, and a <Interface>Client
+// that implements the interface over HTTP. context.Context parameters come
+// from the request. Every method must return an error as its last result
+// so the client can report transport failures. Packages used by the method
+// signatures must be added with AddImport.
+func (cg *CodeGenerator) GenerateHTTPStubs(info *InterfaceInfo) (string, error) {
+	name := info.Name
+	for _, method := range info.Methods {
+		if n := len(method.Returns); n == 0 || method.Returns[n-1].Type != "error" {
+			return "", fmt.Errorf("%s.%s must return an error to be served over HTTP", name, method.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %sErrorResponse is the body of a failed %s call\n", name, name)
+	fmt.Fprintf(&buf, "type %sErrorResponse struct {\nError string `json:\"error\"`\nMessage string `json:\"message,omitempty\"`\n}\n\n", name)
+
+	for _, method := range info.Methods {
+		route := kebabCase(method.Name)
+		fmt.Fprintf(&buf, "// %s%sRequest is the body of POST /%s\n", name, method.Name, route)
+		fmt.Fprintf(&buf, "type %s%sRequest struct {\n", name, method.Name)
+		for _, p := range stubParams(method.Params) {
+			if !p.context {
+				fmt.Fprintf(&buf, "%s %s `json:%q`\n", p.field, callFieldType(p.typ), lowerFirst(p.field))
+			}
+		}
+		buf.WriteString("}\n\n")
+
+		fmt.Fprintf(&buf, "// %s%sResponse is the result of POST /%s\n", name, method.Name, route)
+		fmt.Fprintf(&buf, "type %s%sResponse struct {\n", name, method.Name)
+		for i, field := range stubResults(method.Returns) {
+			fmt.Fprintf(&buf, "%s %s `json:%q`\n", field, method.Returns[i].Type, lowerFirst(field))
+		}
+		buf.WriteString("}\n\n")
+	}
+
+	fmt.Fprintf(&buf, "// %sHandler serves a %s over HTTP, one POST route per method\n", name, name)
+	fmt.Fprintf(&buf, "type %sHandler struct {\nService %s\n}\n\n", name, name)
+	fmt.Fprintf(&buf, "// New%sHandler creates a handler calling svc\n", name)
+	fmt.Fprintf(&buf, "func New%sHandler(svc %s) *%sHandler {\nreturn &%sHandler{Service: svc}\n}\n\n", name, name, name, name)
+
+	fmt.Fprintf(&buf, "// Register routes the methods under prefix, such as \"/api\"\n")
+	fmt.Fprintf(&buf, "func (h *%sHandler) Register(mux *http.ServeMux, prefix string) {\nprefix = strings.TrimSuffix(prefix, \"/\")\n", name)
+	for _, method := range info.Methods {
+		fmt.Fprintf(&buf, "mux.HandleFunc(prefix+\"/%s\", h.handle%s)\n", kebabCase(method.Name), method.Name)
+	}
+	buf.WriteString("}\n\n")
+
+	for _, method := range info.Methods {
+		writeStubHandler(&buf, name, method)
+	}
+
+	fmt.Fprintf(&buf, "func (h *%sHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {\n", name)
+	buf.WriteString("w.Header().Set(\"Content-Type\", \"application/json\")\nw.WriteHeader(status)\njson.NewEncoder(w).Encode(data)\n}\n\n")
+	fmt.Fprintf(&buf, "func (h *%sHandler) respondError(w http.ResponseWriter, status int, message string) {\n", name)
+	fmt.Fprintf(&buf, "h.respondJSON(w, status, %sErrorResponse{\nError: http.StatusText(status),\nMessage: message,\n})\n}\n\n", name)
+
+	fmt.Fprintf(&buf, "// %sClient calls a %sHandler; it implements %s\n", name, name, name)
+	fmt.Fprintf(&buf, "type %sClient struct {\nBaseURL string\nHTTPClient *http.Client\n}\n\n", name)
+	fmt.Fprintf(&buf, "var _ %s = (*%sClient)(nil)\n\n", name, name)
+	fmt.Fprintf(&buf, "// New%sClient creates a client for the handler registered at baseURL, including its prefix\n", name)
+	fmt.Fprintf(&buf, "func New%sClient(baseURL string) *%sClient {\nreturn &%sClient{BaseURL: strings.TrimSuffix(baseURL, \"/\"), HTTPClient: http.DefaultClient}\n}\n\n", name, name, name)
+
+	for _, method := range info.Methods {
+		writeStubClientMethod(&buf, name, method)
+	}
+
+	fmt.Fprintf(&buf, "func (c *%sClient) call(ctx context.Context, route string, in, out interface{}) error {\n", name)
+	buf.WriteString(`body, err := json.Marshal(in)
+if err != nil {
+return err
+}
+req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+route, bytes.NewReader(body))
+if err != nil {
+return err
+}
+req.Header.Set("Content-Type", "application/json")
+resp, err := c.HTTPClient.Do(req)
+if err != nil {
+return err
+}
+defer resp.Body.Close()
+if resp.StatusCode != http.StatusOK {
+`)
+	fmt.Fprintf(&buf, "var failure %sErrorResponse\n", name)
+	buf.WriteString(`if json.NewDecoder(resp.Body).Decode(&failure) == nil && failure.Message != "" {
+return fmt.Errorf("%s: %s", resp.Status, failure.Message)
+}
+return fmt.Errorf("request failed: %s", resp.Status)
+}
+return json.NewDecoder(resp.Body).Decode(out)
+}
+`)
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	for _, imp := range []string{"bytes", "context", "encoding/json", "fmt", "net/http", "strings"} {
+		cg.AddImport(imp)
+	}
+	cg.mu.Lock()
+	cg.code.Write(code)
+	cg.code.WriteString("\n")
+	cg.mu.Unlock()
+
+	return string(code), nil
+}
+
+func writeStubHandler(buf *bytes.Buffer, iface string, method *MethodSignature) {
+	params := stubParams(method.Params)
+	results := stubResults(method.Returns)
+
+	fmt.Fprintf(buf, "func (h *%sHandler) handle%s(w http.ResponseWriter, r *http.Request) {\n", iface, method.Name)
+	buf.WriteString("if r.Method != http.MethodPost {\nh.respondError(w, http.StatusMethodNotAllowed, \"use POST\")\nreturn\n}\n")
+	fmt.Fprintf(buf, "var req %s%sRequest\n", iface, method.Name)
+	buf.WriteString("if err := json.NewDecoder(r.Body).Decode(&req); err != nil {\nh.respondError(w, http.StatusBadRequest, err.Error())\nreturn\n}\n")
+
+	args := make([]string, len(params))
+	for i, p := range params {
+		switch {
+		case p.context:
+			args[i] = "r.Context()"
+		case strings.HasPrefix(p.typ, "..."):
+			args[i] = "req." + p.field + "..."
+		default:
+			args[i] = "req." + p.field
+		}
+	}
+	vars := make([]string, 0, len(results)+1)
+	for i := range results {
+		vars = append(vars, fmt.Sprintf("r%d", i))
+	}
+	vars = append(vars, "err")
+
+	fmt.Fprintf(buf, "%s := h.Service.%s(%s)\n", strings.Join(vars, ", "), method.Name, strings.Join(args, ", "))
+	buf.WriteString("if err != nil {\nh.respondError(w, http.StatusInternalServerError, err.Error())\nreturn\n}\n")
+	fmt.Fprintf(buf, "h.respondJSON(w, http.StatusOK, %s%sResponse{", iface, method.Name)
+	for i, field := range results {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, "%s: r%d", field, i)
+	}
+	buf.WriteString("})\n}\n\n")
+}
+
+func writeStubClientMethod(buf *bytes.Buffer, iface string, method *MethodSignature) {
+	params := stubParams(method.Params)
+	results := stubResults(method.Returns)
+
+	decls := make([]string, len(params))
+	var fields []string
+	ctx := "context.Background()"
+	for i, p := range params {
+		decls[i] = p.name + " " + p.typ
+		if p.context {
+			ctx = p.name
+		} else {
+			fields = append(fields, p.field+": "+p.name)
+		}
+	}
+
+	fmt.Fprintf(buf, "// %s calls POST /%s\n", method.Name, kebabCase(method.Name))
+	fmt.Fprintf(buf, "func (c *%sClient) %s(%s) %s {\n", iface, method.Name, strings.Join(decls, ", "), mockResults(method.Returns))
+	fmt.Fprintf(buf, "var out %s%sResponse\n", iface, method.Name)
+	fmt.Fprintf(buf, "err := c.call(%s, \"/%s\", %s%sRequest{%s}, &out)\n", ctx, kebabCase(method.Name), iface, method.Name, strings.Join(fields, ", "))
+
+	rets := make([]string, 0, len(results)+1)
+	for _, field := range results {
+		rets = append(rets, "out."+field)
+	}
+	rets = append(rets, "err")
+	fmt.Fprintf(buf, "return %s\n}\n\n", strings.Join(rets, ", "))
+}
+
+// stubParams names the parameters of a method for the generated code
+func stubParams(params []*ParamInfo) []stubParam {
+	out := make([]stubParam, len(params))
+	for i, param := range params {
+		name := param.Name
+		if name == "" || name == "_" {
+			name = fmt.Sprintf("arg%d", i)
+		} else if stubReserved[name] {
+			name += "Arg"
+		}
+		out[i] = stubParam{name: name, field: exportName(name), typ: param.Type, context: param.Type == "context.Context"}
+	}
+	return out
+}
+
+// stubResults names the response fields for every result but the final
+// error
+func stubResults(returns []*ParamInfo) []string {
+	results := returns[:len(returns)-1]
+	fields := make([]string, len(results))
+	for i, ret := range results {
+		switch {
+		case ret.Name != "" && ret.Name != "_" && ret.Name != "err":
+			fields[i] = exportName(ret.Name)
+		case len(results) == 1:
+			fields[i] = "Result"
+		default:
+			fields[i] = fmt.Sprintf("Result%d", i)
+		}
+	}
+	return fields
+}
+
+// kebabCase turns a method name such as GetUserByID into get-user-by-id
+func kebabCase(name string) string {
+	var buf strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			buf.WriteByte('-')
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}
+
 // ===== Main Demo =====
 
 func main() {
-	fmt.Println("=== Code Generation with AST ===\n")
+	fmt.Println("=== Code Generation with AST ===")
+	fmt.Println()
 
 	// 1. Code Analyzer
 	fmt.Println("1. Code Analyzer")
@@ -1,7 +1,13 @@
 package main
 
 import (
-	"sync/atomic"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -71,6 +77,87 @@ func Sub(a int, b int) int {
 	}
 }
 
+// TestAnalyzePackage tests multi-file package analysis
+func TestAnalyzePackage(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"shapes.go": `package shapes
+
+type Shape interface {
+	Area() float64
+}
+
+type Square struct{ Side float64 }
+
+func (s Square) Area() float64 { return s.Side * s.Side }
+
+type Circle struct{ R float64 }
+
+func (c *Circle) Area() float64 { return 3 * c.R * c.R }
+
+func (c *Circle) Scale(f float64) { c.R *= f }
+`,
+		"sum.go": `package shapes
+
+func Total(shapes []Shape) float64 {
+	total := 0.0
+	for _, s := range shapes {
+		total += s.Area()
+	}
+	return total
+}
+
+func Report() float64 {
+	return Total([]Shape{Square{1}, &Circle{1}}) + helper()
+}
+
+func helper() float64 { return 0 }
+`,
+	})
+
+	analyzer := NewCodeAnalyzer()
+	analysis, err := analyzer.AnalyzePackage(dir)
+	if err != nil {
+		t.Fatalf("Expected successful analysis, got error: %v", err)
+	}
+
+	if analysis.Name != "shapes" || len(analysis.Files) != 2 {
+		t.Errorf("Expected package shapes with 2 files, got %s with %d", analysis.Name, len(analysis.Files))
+	}
+
+	impls := strings.Join(analysis.Implementations["Shape"], ",")
+	if impls != "*Circle,Square" {
+		t.Errorf("Expected Shape implemented by *Circle and Square, got %s", impls)
+	}
+
+	if callees := strings.Join(analysis.CallGraph["Report"], ","); callees != "Total,helper" {
+		t.Errorf("Expected Report to call Total and helper, got %s", callees)
+	}
+	if callees := strings.Join(analysis.CallGraph["Total"], ","); callees != "Shape.Area" {
+		t.Errorf("Expected Total to call Shape.Area, got %s", callees)
+	}
+
+	if unused := strings.Join(analysis.UnusedExported, ","); unused != "Circle.Scale,Report" {
+		t.Errorf("Expected Circle.Scale and Report unused, got %s", unused)
+	}
+
+	if _, ok := analyzer.Interfaces["Shape"]; !ok {
+		t.Errorf("Expected Shape to be recorded as an interface")
+	}
+	if len(analyzer.Functions) == 0 {
+		t.Errorf("Expected functions from every file to be recorded")
+	}
+}
+
+func TestAnalyzePackageTypeErrors(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"bad.go": "package bad\n\nfunc F() int { return \"x\" }\n",
+	})
+
+	if _, err := NewCodeAnalyzer().AnalyzePackage(dir); err == nil {
+		t.Errorf("Expected type error to be reported")
+	}
+}
+
 // TestCodeGenerator tests code generation
 func TestCodeGeneratorStruct(t *testing.T) {
 	gen := NewCodeGenerator("main")
@@ -148,6 +235,162 @@ func TestCodeGeneratorImports(t *testing.T) {
 	}
 }
 
+func TestGenerateAccessorsCompiles(t *testing.T) {
+	source := `package model
+
+import "time"
+
+type User struct {
+	Name    string
+	age     int
+	Tags    []string
+	Limits  map[string]int
+	Created time.Time
+	Notify  func(string) error
+}
+`
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(source); err != nil {
+		t.Fatalf("Expected successful analysis, got error: %v", err)
+	}
+
+	gen := NewCodeGenerator("model")
+	gen.AddImport("time")
+	code, err := gen.GenerateAccessors(analyzer.Types["User"])
+	if err != nil {
+		t.Fatalf("Expected successful generation, got error: %v", err)
+	}
+
+	for _, want := range []string{
+		"type UserOption func(*User)",
+		"func WithUserAge(value int) UserOption",
+		"func NewUser(opts ...UserOption) *User",
+		"func (u *User) GetName() string",
+		"func (u *User) Age() int",
+		"func (u *User) SetNotify(value func(string) error)",
+		"func (u *User) String() string",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("Expected generated code to contain %q", want)
+		}
+	}
+
+	file, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("Expected formatted file, got error: %v", err)
+	}
+	usage := `package model
+
+func example() string {
+	u := NewUser(WithUserName("ada"), WithUserAge(36))
+	u.SetTags([]string{"admin"})
+	return u.String() + u.GetName()
+}
+`
+	dir := writePackage(t, map[string]string{
+		"user.go":      source,
+		"accessors.go": file,
+		"usage.go":     usage,
+	})
+	buildPackage(t, dir)
+}
+
+func TestGenerateAccessorsRejectsNonStruct(t *testing.T) {
+	gen := NewCodeGenerator("main")
+	if _, err := gen.GenerateAccessors(&TypeInfo{Name: "Reader", Kind: "interface"}); err == nil {
+		t.Errorf("Expected error for non-struct type")
+	}
+}
+
+func TestGenerateMockForETLInterfaces(t *testing.T) {
+	// The extractor and loader interfaces of the ETL pipeline in challenge-177
+	source := `package etl
+
+import "context"
+
+type DataExtractor interface {
+	Extract(ctx context.Context) ([]interface{}, error)
+}
+
+type Loader interface {
+	Load(items []interface{}) error
+}
+
+type Notifier interface {
+	Notify(t string, tags ...string)
+}
+`
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(source); err != nil {
+		t.Fatalf("Expected successful analysis, got error: %v", err)
+	}
+
+	gen := NewCodeGenerator("etl")
+	gen.AddImport("context")
+	for _, name := range []string{"DataExtractor", "Loader", "Notifier"} {
+		if _, err := gen.GenerateMock(analyzer.Interfaces[name]); err != nil {
+			t.Fatalf("Expected mock for %s, got error: %v", name, err)
+		}
+	}
+	mocks, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("Expected formatted file, got error: %v", err)
+	}
+
+	usage := `package etl
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+var (
+	_ DataExtractor = (*MockDataExtractor)(nil)
+	_ Loader        = (*MockLoader)(nil)
+	_ Notifier      = (*MockNotifier)(nil)
+)
+
+type recorder struct{ failures int }
+
+func (r *recorder) Helper()               {}
+func (r *recorder) Errorf(string, ...any) { r.failures++ }
+
+func TestMocks(t *testing.T) {
+	extractor := &MockDataExtractor{}
+	extractor.ExtractReturns([]interface{}{1, 2}, nil)
+	items, err := extractor.Extract(context.Background())
+	if len(items) != 2 || err != nil {
+		t.Fatalf("unexpected results %v %v", items, err)
+	}
+	extractor.AssertExtractCalled(t, 1)
+
+	loader := &MockLoader{LoadFunc: func(items []interface{}) error { return errors.New("full") }}
+	if err := loader.Load(items); err == nil {
+		t.Fatal("expected LoadFunc to be used")
+	}
+	loader.AssertLoadCalledWith(t, MockLoaderLoadCall{Items: []interface{}{1, 2}})
+
+	notifier := &MockNotifier{}
+	notifier.Notify("deploy", "a", "b")
+	notifier.AssertNotifyCalledWith(t, MockNotifierNotifyCall{TArg: "deploy", Tags: []string{"a", "b"}})
+
+	r := &recorder{}
+	loader.AssertLoadCalled(r, 2)
+	loader.AssertLoadCalledWith(r, MockLoaderLoadCall{})
+	if r.failures != 2 {
+		t.Fatalf("expected both assertions to fail, got %d failures", r.failures)
+	}
+}
+`
+	dir := writePackage(t, map[string]string{
+		"etl.go":      source,
+		"mocks.go":    mocks,
+		"etl_test.go": usage,
+	})
+	runGo(t, dir, "test", "./...")
+}
+
 // TestCodeTransformer tests code transformation
 func TestCodeTransformerBasic(t *testing.T) {
 	transformer := NewCodeTransformer()
@@ -193,6 +436,131 @@ func TestCodeTransformerMultiplePatterns(t *testing.T) {
 	}
 }
 
+func TestASTTransformInterfaceToAny(t *testing.T) {
+	transformer := NewASTTransformer()
+	transformer.Register(InterfaceToAny())
+
+	code := `package main
+
+// Store maps keys to interface{} values
+var store map[string]interface{}
+
+func Describe(v interface{ String() string }) string {
+	return "interface{}: " + v.String()
+}
+`
+	out, counts, err := transformer.Transform(code)
+	if err != nil {
+		t.Fatalf("Expected successful transform, got error: %v", err)
+	}
+	if counts["interface_to_any"] != 1 {
+		t.Errorf("Expected 1 replacement, got %d", counts["interface_to_any"])
+	}
+	if !strings.Contains(out, "map[string]any") {
+		t.Errorf("Expected interface{} to become any:\n%s", out)
+	}
+	for _, kept := range []string{"// Store maps keys to interface{} values", `"interface{}: "`, "interface{ String() string }"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("Expected %q to be left alone:\n%s", kept, out)
+		}
+	}
+}
+
+func TestASTTransformAddContextParam(t *testing.T) {
+	transformer := NewASTTransformer()
+	transformer.Register(AddContextParam(nil))
+
+	code := `package main
+
+import "fmt"
+
+func Fetch(id int) string {
+	return fmt.Sprint(id)
+}
+
+func Handle(id int) string {
+	return Fetch(id)
+}
+
+func main() {
+	fmt.Println(Handle(1))
+}
+`
+	out, counts, err := transformer.Transform(code)
+	if err != nil {
+		t.Fatalf("Expected successful transform, got error: %v", err)
+	}
+	if counts["add_context"] != 2 {
+		t.Errorf("Expected 2 functions changed, got %d", counts["add_context"])
+	}
+	for _, want := range []string{
+		`"context"`,
+		"func Fetch(ctx context.Context, id int) string",
+		"return Fetch(ctx, id)",
+		"fmt.Println(Handle(context.TODO(), 1))",
+		"func main() {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output:\n%s", want, out)
+		}
+	}
+
+	buildPackage(t, writePackage(t, map[string]string{"main.go": out}))
+
+	again, counts, _ := transformer.Transform(out)
+	if len(counts) != 0 || again != out {
+		t.Errorf("Expected transform to be idempotent, got %v", counts)
+	}
+}
+
+func TestASTTransformWrapErrors(t *testing.T) {
+	transformer := NewASTTransformer()
+	transformer.Register(WrapReturnedErrors())
+
+	code := `package main
+
+import "os"
+
+func Load(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return data, err
+}
+
+func Save(path string) error {
+	err := os.WriteFile(path, nil, 0o644)
+	return err
+}
+`
+	out, counts, err := transformer.Transform(code)
+	if err != nil {
+		t.Fatalf("Expected successful transform, got error: %v", err)
+	}
+	if counts["wrap_errors"] != 1 {
+		t.Errorf("Expected 1 wrapped return, got %d", counts["wrap_errors"])
+	}
+	if !strings.Contains(out, `return nil, fmt.Errorf("Load: %w", err)`) || !strings.Contains(out, `"fmt"`) {
+		t.Errorf("Expected checked error to be wrapped:\n%s", out)
+	}
+	if !strings.Contains(out, "return data, err") || !strings.Contains(out, "\treturn err\n") {
+		t.Errorf("Expected unchecked returns to be left alone:\n%s", out)
+	}
+
+	buildPackage(t, writePackage(t, map[string]string{"main.go": out + "\nfunc main() {}\n"}))
+
+	if stats := transformer.GetStats(); stats["wrap_errors"] != 1 {
+		t.Errorf("Expected stats to record 1 change, got %v", stats)
+	}
+}
+
+func TestASTTransformInvalidSource(t *testing.T) {
+	if _, _, err := NewASTTransformer().Transform("not go"); err == nil {
+		t.Errorf("Expected parse error")
+	}
+}
+
 // TestCustomLinter tests linting
 func TestCustomLinterBasic(t *testing.T) {
 	linter := NewCustomLinter()
@@ -263,108 +631,1657 @@ func TestLintRuleStats(t *testing.T) {
 	}
 }
 
-// TestParamInfo tests parameter information
-func TestParamInfo(t *testing.T) {
-	param := &ParamInfo{
-		Name: "x",
-		Type: "int",
-	}
+func lintAST(t *testing.T, code string, analyzer *LintAnalyzer) []*LintViolation {
+	t.Helper()
+	linter := NewCustomLinter()
+	linter.AddAnalyzer(analyzer)
+	return linter.Lint(code)
+}
 
-	if param.Name != "x" {
-		t.Errorf("Expected Name='x'")
-	}
+func TestUncheckedErrorAnalyzer(t *testing.T) {
+	code := `package p
 
-	if param.Type != "int" {
-		t.Errorf("Expected Type='int'")
+import (
+	"fmt"
+	"os"
+)
+
+func clean() error {
+	os.Remove("a")
+	os.Open("b")
+	fmt.Println("done")
+	if err := os.Remove("c"); err != nil {
+		return err
 	}
+	return nil
 }
-
-// TestFunctionInfo tests function information
-func TestFunctionInfo(t *testing.T) {
-	fn := &FunctionInfo{
-		Name:      "Add",
-		Lines:     5,
-		Cyclomatic: 1,
-		IsPublic:  true,
+`
+	violations := lintAST(t, code, UncheckedErrorAnalyzer())
+	if len(violations) != 2 {
+		t.Fatalf("Expected 2 violations, got %d: %+v", len(violations), violations)
 	}
-
-	if fn.Name != "Add" {
-		t.Errorf("Expected Name='Add'")
+	if violations[0].Line != 9 || violations[0].Column != 2 || violations[0].Severity != "error" {
+		t.Errorf("Unexpected violation %+v", violations[0])
 	}
 
-	if fn.Cyclomatic != 1 {
-		t.Errorf("Expected Cyclomatic=1")
+	fixed, err := ApplyFixes(code, violations)
+	if err != nil {
+		t.Fatalf("ApplyFixes failed: %v", err)
+	}
+	for _, want := range []string{`_ = os.Remove("a")`, `_, _ = os.Open("b")`} {
+		if !strings.Contains(fixed, want) {
+			t.Errorf("Expected %q in:\n%s", want, fixed)
+		}
+	}
+	if again := lintAST(t, fixed, UncheckedErrorAnalyzer()); len(again) != 0 {
+		t.Errorf("Expected fixed code to be clean, got %+v", again)
 	}
 }
 
-// TestTypeInfo tests type information
-func TestTypeInfo(t *testing.T) {
-	ti := &TypeInfo{
-		Name:     "User",
-		Kind:     "struct",
-		IsPublic: true,
-	}
+func TestMutexCopyAnalyzer(t *testing.T) {
+	code := `package p
 
-	if ti.Name != "User" {
-		t.Errorf("Expected Name='User'")
-	}
+import "sync"
 
-	if ti.Kind != "struct" {
-		t.Errorf("Expected Kind='struct'")
-	}
+type Counter struct {
+	mu sync.Mutex
+	n  int
 }
 
-// Benchmark tests
+type Wrapper struct{ c Counter }
 
-func BenchmarkCodeAnalyzer(b *testing.B) {
-	analyzer := NewCodeAnalyzer()
-	code := `
-package main
+func (c Counter) Value() int { return c.n }
 
-func Test(x int) int {
-	return x * 2
+func (c *Counter) Inc() { c.mu.Lock(); c.n++; c.mu.Unlock() }
+
+func report(w Wrapper, n int) {}
+
+func copyIt(c *Counter) int {
+	snapshot := *c
+	fresh := Counter{}
+	return snapshot.n + fresh.n
 }
 `
+	violations := lintAST(t, code, MutexCopyAnalyzer())
+	if len(violations) != 3 {
+		t.Fatalf("Expected 3 violations, got %d: %+v", len(violations), violations)
+	}
+	if !strings.Contains(violations[0].Message, "sync.Mutex") {
+		t.Errorf("Expected lock type in message, got %q", violations[0].Message)
+	}
+	if len(violations[2].Fixes) != 0 {
+		t.Errorf("Expected no fix for the assignment")
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		analyzer.AnalyzeCode(code)
+	fixed, err := ApplyFixes(code, violations)
+	if err != nil {
+		t.Fatalf("ApplyFixes failed: %v", err)
+	}
+	if !strings.Contains(fixed, "func (c *Counter) Value()") || !strings.Contains(fixed, "func report(w *Wrapper, n int)") {
+		t.Errorf("Expected pointer receivers and parameters, got:\n%s", fixed)
 	}
 }
 
-func BenchmarkCodeGenerator(b *testing.B) {
-	gen := NewCodeGenerator("main")
-	fields := []*ParamInfo{{Name: "x", Type: "int"}}
+func TestExportedDocAnalyzer(t *testing.T) {
+	code := `package p
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		gen.GenerateStructCode("Test", fields)
-	}
-}
+type Service struct{}
 
-func BenchmarkCodeTransformer(b *testing.B) {
-	transformer := NewCodeTransformer()
-	transformer.AddPattern("test", "var", "const", "test")
-	code := "var x = 5"
+type helper struct{}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		transformer.Transform(code)
+// Documented does things
+func Documented() {}
+
+func Undocumented() {}
+
+func (s *Service) Run() {}
+
+func (h helper) Run() {}
+
+func internal() {}
+`
+	violations := lintAST(t, code, ExportedDocAnalyzer())
+	if len(violations) != 2 {
+		t.Fatalf("Expected 2 violations, got %d: %+v", len(violations), violations)
+	}
+
+	fixed, err := ApplyFixes(code, violations)
+	if err != nil {
+		t.Fatalf("ApplyFixes failed: %v", err)
+	}
+	if !strings.Contains(fixed, "// Undocumented ...\nfunc Undocumented()") || !strings.Contains(fixed, "// Run ...\nfunc (s *Service) Run()") {
+		t.Errorf("Expected doc comment stubs, got:\n%s", fixed)
 	}
 }
 
-func BenchmarkCustomLinter(b *testing.B) {
+func TestCustomLinterRulesAndAnalyzers(t *testing.T) {
 	linter := NewCustomLinter()
-	linter.AddRule("test", "Test", "Test", "var", "warning")
-	code := "var x = 5"
+	linter.AddRule("no_todo", "TODO found", "TODO comments present", "TODO", "warning")
+	for _, analyzer := range DefaultAnalyzers() {
+		linter.AddAnalyzer(analyzer)
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		linter.Lint(code)
+	violations := linter.Lint("package p\n\nfunc Exported() {} // TODO: document\n")
+	if len(violations) != 2 {
+		t.Fatalf("Expected a rule and an analyzer violation, got %+v", violations)
+	}
+
+	// Analyzers skip code that does not parse
+	if violations := linter.Lint("// TODO: fix this\nvar x = 5"); len(violations) != 1 {
+		t.Errorf("Expected only the rule violation, got %+v", violations)
+	}
+
+	report := linter.GetReport()
+	byRule := report["violations_by_rule"].(map[string]int64)
+	if byRule["exported_doc"] != 1 || byRule["no_todo"] != 2 {
+		t.Errorf("Unexpected report %v", report)
 	}
 }
 
-// Helper functions
+func TestApplyFixesRejectsBadEdit(t *testing.T) {
+	violations := []*LintViolation{{Fixes: []*SuggestedFix{{Edits: []TextEdit{{Start: 2, End: 10}}}}}}
+	if _, err := ApplyFixes("abc", violations); err == nil {
+		t.Errorf("Expected error for edit outside the source")
+	}
+}
+
+const reportSource = `package p
+
+import "os"
+
+type Store struct{}
+
+func (s *Store) Load(n int) int {
+	for i := 0; i < n; i++ {
+		if i > 2 && n < 10 {
+			return i
+		}
+	}
+	return 0
+}
+
+func cleanup() {
+	os.Remove("<tmp>")
+}
+`
+
+func newTestReport(t *testing.T) *AnalysisReport {
+	t.Helper()
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(reportSource); err != nil {
+		t.Fatalf("AnalyzeCode failed: %v", err)
+	}
+
+	linter := NewCustomLinter()
+	linter.AddRule("no_os", "os usage", "Direct os calls", `os\.`, "info")
+	linter.AddAnalyzer(UncheckedErrorAnalyzer())
+	linter.Lint(reportSource)
+
+	return NewAnalysisReport("p/store.go", analyzer, linter)
+}
+
+func TestAnalysisReportContents(t *testing.T) {
+	report := newTestReport(t)
+
+	if len(report.Functions) != 2 || report.Functions[0].Name != "Load" {
+		t.Fatalf("Expected functions sorted by complexity, got %+v", report.Functions)
+	}
+	if len(report.Rules) != 2 || report.Rules[0].ID != "no_os" || report.Rules[1].ID != "unchecked_error" {
+		t.Errorf("Expected rules sorted by ID, got %+v", report.Rules)
+	}
+	if len(report.Violations) != 2 {
+		t.Errorf("Expected 2 violations, got %d", len(report.Violations))
+	}
+
+	empty := NewAnalysisReport("x.go", nil, nil)
+	if _, err := empty.SARIF(); err != nil {
+		t.Errorf("Expected empty report to render, got %v", err)
+	}
+}
+
+func TestAnalysisReportSARIF(t *testing.T) {
+	data, err := newTestReport(t).SARIF()
+	if err != nil {
+		t.Fatalf("SARIF failed: %v", err)
+	}
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct {
+						ID                   string `json:"id"`
+						DefaultConfiguration struct {
+							Level string `json:"level"`
+						} `json:"defaultConfiguration"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine int `json:"startLine"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+				Fixes []struct {
+					ArtifactChanges []struct {
+						Replacements []struct {
+							DeletedRegion struct {
+								ByteOffset int `json:"byteOffset"`
+								ByteLength int `json:"byteLength"`
+							} `json:"deletedRegion"`
+							InsertedContent struct {
+								Text string `json:"text"`
+							} `json:"insertedContent"`
+						} `json:"replacements"`
+					} `json:"artifactChanges"`
+				} `json:"fixes"`
+			} `json:"results"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatalf("Invalid SARIF JSON: %v", err)
+	}
+
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("Unexpected SARIF log %s", data)
+	}
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != 2 || run.Tool.Driver.Rules[0].DefaultConfiguration.Level != "note" {
+		t.Errorf("Unexpected rules %+v", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(run.Results))
+	}
+
+	unchecked := run.Results[1]
+	if unchecked.RuleID != "unchecked_error" || unchecked.Level != "error" {
+		t.Errorf("Unexpected result %+v", unchecked)
+	}
+	if loc := unchecked.Locations[0].PhysicalLocation; loc.ArtifactLocation.URI != "p/store.go" || loc.Region.StartLine != 17 {
+		t.Errorf("Unexpected location %+v", loc)
+	}
+	if len(unchecked.Fixes) != 1 {
+		t.Fatalf("Expected a fix, got %+v", unchecked.Fixes)
+	}
+	replacement := unchecked.Fixes[0].ArtifactChanges[0].Replacements[0]
+	if replacement.InsertedContent.Text != "_ = " || replacement.DeletedRegion.ByteLength != 0 ||
+		!strings.HasPrefix(reportSource[replacement.DeletedRegion.ByteOffset:], "os.Remove") {
+		t.Errorf("Unexpected replacement %+v", replacement)
+	}
+
+	functions, ok := run.Properties["functions"].(map[string]interface{})
+	if !ok || functions["Store.Load"] == nil {
+		t.Errorf("Expected function metrics in properties, got %v", run.Properties)
+	}
+}
+
+func TestAnalysisReportHTML(t *testing.T) {
+	page, err := newTestReport(t).HTML()
+	if err != nil {
+		t.Fatalf("HTML failed: %v", err)
+	}
+	html := string(page)
+
+	for _, want := range []string{"<title>Code report: p/store.go</title>", "<td>Store.Load</td>", "<td>cleanup</td>", "unchecked_error", "Discard the results explicitly"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("Expected %q in HTML", want)
+		}
+	}
+	if strings.Contains(html, `"<tmp>"`) || !strings.Contains(html, "&lt;tmp&gt;") {
+		t.Errorf("Expected source code to be escaped")
+	}
+	if strings.Contains(html, `class="complex"`) {
+		t.Errorf("Expected no function above the complexity threshold")
+	}
+}
+
+func TestGenerateStructFromJSON(t *testing.T) {
+	sample := `[
+		{"id": 1, "user_name": "ada", "score": 9.5, "active": true, "created_at": "2024-01-02T15:04:05Z",
+		 "address": {"city": "London", "zip": "N1"}, "tags": ["a"], "orders": [{"order_id": 7, "total": 10}]},
+		{"id": 2, "user_name": "bob", "score": 7, "active": false, "created_at": "2024-02-03T15:04:05Z",
+		 "address": {"city": "Paris"}, "tags": [], "orders": [{"order_id": 8, "total": 12.5}], "nickname": null}
+	]`
+
+	gen := NewCodeGenerator("models")
+	gen.Schema = SchemaOptions{RootName: "User", ValidationTags: true}
+	code, err := gen.GenerateStructFromJSON([]byte(sample))
+	if err != nil {
+		t.Fatalf("GenerateStructFromJSON failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"// User is generated from a JSON sample\ntype User struct {",
+		"ID        int64     `json:\"id\" validate:\"required\"`",
+		"UserName  string    `json:\"user_name\" validate:\"required\"`",
+		"Score     float64   `json:\"score\" validate:\"required\"`",
+		"Active    bool      `json:\"active\" validate:\"required\"`",
+		"CreatedAt time.Time `json:\"created_at\" validate:\"required\"`",
+		"Address   Address   `json:\"address\" validate:\"required\"`",
+		"Tags      []string  `json:\"tags\" validate:\"required\"`",
+		"Orders    []Order   `json:\"orders\" validate:\"required\"`",
+		"Nickname  interface{} `json:\"nickname,omitempty\"`",
+		"Zip  string `json:\"zip,omitempty\"`",
+		"Total   float64 `json:\"total\" validate:\"required\"`",
+	} {
+		if !strings.Contains(collapseSpace(code), collapseSpace(want)) {
+			t.Errorf("Expected %q in:\n%s", want, code)
+		}
+	}
+
+	file, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("GenerateCompleteFile failed: %v", err)
+	}
+	buildPackage(t, writePackage(t, map[string]string{"models.go": file}))
+}
+
+func TestGenerateStructFromJSONDefaults(t *testing.T) {
+	gen := NewCodeGenerator("models")
+	code, err := gen.GenerateStructFromJSON([]byte(`{"item": {"name": "x"}, "Item": {"id": "y"}}`))
+	if err != nil {
+		t.Fatalf("GenerateStructFromJSON failed: %v", err)
+	}
+	if !strings.Contains(code, "type Root struct") || !strings.Contains(collapseSpace(code), "Item Item2 `json:\"Item\"`") {
+		t.Errorf("Expected default root name and unique struct names, got:\n%s", code)
+	}
+	if strings.Contains(code, "validate:") {
+		t.Errorf("Expected no validation tags by default")
+	}
+
+	for _, bad := range []string{`{"a": `, `[1, 2]`, `[]`, `{} {}`} {
+		if _, err := gen.GenerateStructFromJSON([]byte(bad)); err == nil {
+			t.Errorf("Expected error for sample %q", bad)
+		}
+	}
+}
+
+func TestGenerateStructFromSQL(t *testing.T) {
+	ddl := `
+CREATE TABLE IF NOT EXISTS public.user_accounts (
+	id BIGSERIAL,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	display_name varchar(64),
+	balance NUMERIC(10, 2) NOT NULL DEFAULT 0,
+	is_admin BOOLEAN NOT NULL DEFAULT false,
+	avatar BYTEA,
+	settings JSONB,
+	labels TEXT[],
+	last_login TIMESTAMP WITH TIME ZONE,
+	PRIMARY KEY (id)
+);
+
+create table ` + "`categories`" + ` (
+	` + "`category_id`" + ` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	visible tinyint(1) NOT NULL,
+	CONSTRAINT uq_name UNIQUE (category_id)
+);`
+
+	gen := NewCodeGenerator("models")
+	gen.Schema.ValidationTags = true
+	code, err := gen.GenerateStructFromSQL(ddl)
+	if err != nil {
+		t.Fatalf("GenerateStructFromSQL failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"// UserAccount is generated from table user_accounts\ntype UserAccount struct {",
+		"ID          int64           `json:\"id\" db:\"id\" validate:\"required\"`",
+		"Email       string          `json:\"email\" db:\"email\" validate:\"required,max=255\"`",
+		"DisplayName *string         `json:\"display_name,omitempty\" db:\"display_name\" validate:\"omitempty,max=64\"`",
+		"Balance     float64         `json:\"balance\" db:\"balance\" validate:\"required\"`",
+		"Avatar      []byte          `json:\"avatar,omitempty\" db:\"avatar\"`",
+		"Settings    json.RawMessage `json:\"settings,omitempty\" db:\"settings\"`",
+		"Labels      []string        `json:\"labels,omitempty\" db:\"labels\"`",
+		"LastLogin   *time.Time      `json:\"last_login,omitempty\" db:\"last_login\"`",
+		"type Category struct {",
+		"CategoryID int32 `json:\"category_id\" db:\"category_id\" validate:\"required\"`",
+		"Visible    bool  `json:\"visible\" db:\"visible\" validate:\"required\"`",
+	} {
+		if !strings.Contains(collapseSpace(code), collapseSpace(want)) {
+			t.Errorf("Expected %q in:\n%s", want, code)
+		}
+	}
+
+	file, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("GenerateCompleteFile failed: %v", err)
+	}
+	buildPackage(t, writePackage(t, map[string]string{"models.go": file}))
+
+	if _, err := gen.GenerateStructFromSQL("SELECT 1"); err == nil {
+		t.Errorf("Expected error without CREATE TABLE")
+	}
+	if _, err := gen.GenerateStructFromSQL("CREATE TABLE t (id int"); err == nil {
+		t.Errorf("Expected error for unbalanced parentheses")
+	}
+}
+
+func TestGoFieldName(t *testing.T) {
+	cases := map[string]string{
+		"user_id":    "UserID",
+		"api-key":    "APIKey",
+		"firstName":  "FirstName",
+		"2fa":        "F2fa",
+		"html_url":   "HTMLURL",
+		"created at": "CreatedAt",
+	}
+	for key, want := range cases {
+		if got := goFieldName(key); got != want {
+			t.Errorf("goFieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+const complexitySource = `package p
+
+func sumOfPrimes(max int) int {
+	total := 0
+OUT:
+	for i := 1; i <= max; i++ {
+		for j := 2; j < i; j++ {
+			if i%j == 0 {
+				continue OUT
+			}
+		}
+		total += i
+	}
+	return total
+}
+
+func getWords(n int) string {
+	switch n {
+	case 1:
+		return "one"
+	case 2:
+		return "a couple"
+	default:
+		return "lots"
+	}
+}
+
+func classify(a, b, c, d bool, xs []int) int {
+	n := 0
+	for _, x := range xs {
+		if a && b && c || d {
+			n++
+		} else if x > 0 {
+			n--
+		} else {
+			n = 0
+		}
+	}
+	return n
+}
+
+func fact(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return n * fact(n-1)
+}
+
+func closure(ok bool) func() {
+	return func() {
+		if ok {
+			println("ok")
+		}
+	}
+}
+
+func add(a, b int) int { return a + b }
+`
+
+func analyzeComplexity(t *testing.T) *CodeAnalyzer {
+	t.Helper()
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(complexitySource); err != nil {
+		t.Fatalf("AnalyzeCode failed: %v", err)
+	}
+	return analyzer
+}
+
+func TestCognitiveComplexity(t *testing.T) {
+	analyzer := analyzeComplexity(t)
+
+	cases := map[string]int{
+		"sumOfPrimes": 7, // for +1, nested for +2, nested if +3, labelled continue +1
+		"getWords":    1,
+		"classify":    7, // range +1, if +2, && and || +2, else if +1, else +1
+		"fact":        2, // if +1, recursion +1
+		"closure":     2, // if nested in a function literal +2
+		"add":         0,
+	}
+	for name, want := range cases {
+		if got := analyzer.Functions[name].Cognitive; got != want {
+			t.Errorf("%s: expected cognitive complexity %d, got %d", name, want, got)
+		}
+	}
+
+	if analyzer.Functions["getWords"].Cyclomatic <= analyzer.Functions["getWords"].Cognitive {
+		t.Errorf("Expected a switch to weigh more in cyclomatic than cognitive complexity")
+	}
+}
+
+func TestHalsteadMetrics(t *testing.T) {
+	h := analyzeComplexity(t).Functions["add"].Halstead
+
+	// return and + on operands a and b
+	want := HalsteadMetrics{
+		DistinctOperators: 2, DistinctOperands: 2, TotalOperators: 2, TotalOperands: 2,
+		Vocabulary: 4, Length: 4, Volume: 8, Difficulty: 1, Effort: 8,
+	}
+	if h != want {
+		t.Errorf("Expected %+v, got %+v", want, h)
+	}
+}
+
+func TestComplexityAggregates(t *testing.T) {
+	agg := analyzeComplexity(t).Aggregates()
+
+	if agg.Functions != 6 || agg.TotalCognitive != 19 || agg.MaxCognitive != 7 {
+		t.Errorf("Unexpected aggregates %+v", agg)
+	}
+	if agg.AvgCognitive != 19.0/6 || agg.MaxVolume <= agg.AvgVolume {
+		t.Errorf("Unexpected averages %+v", agg)
+	}
+
+	if empty := NewCodeAnalyzer().Aggregates(); empty.Functions != 0 || empty.AvgCyclomatic != 0 {
+		t.Errorf("Expected empty aggregates, got %+v", empty)
+	}
+}
+
+func TestComplexityGate(t *testing.T) {
+	analyzer := analyzeComplexity(t)
+
+	if err := analyzer.Gate(ComplexityLimits{}); err != nil {
+		t.Errorf("Expected no limits to pass, got %v", err)
+	}
+
+	err := analyzer.Gate(ComplexityLimits{MaxCognitive: 5, MaxCyclomatic: 10})
+	gateErr, ok := err.(*GateError)
+	if !ok {
+		t.Fatalf("Expected *GateError, got %v", err)
+	}
+	if len(gateErr.Violations) != 2 || gateErr.Violations[0].Function != "classify" || gateErr.Violations[1].Function != "sumOfPrimes" {
+		t.Errorf("Unexpected violations %+v", gateErr.Violations)
+	}
+	if !strings.Contains(err.Error(), "sumOfPrimes cognitive 7 > 5") {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+}
+
+func TestAnalyzePackageComplexity(t *testing.T) {
+	dir := writePackage(t, map[string]string{"p.go": complexitySource})
+
+	analysis, err := NewCodeAnalyzer().AnalyzePackage(dir)
+	if err != nil {
+		t.Fatalf("AnalyzePackage failed: %v", err)
+	}
+	if analysis.Complexity.Functions != 6 || analysis.Complexity.MaxCognitive != 7 {
+		t.Errorf("Unexpected package aggregates %+v", analysis.Complexity)
+	}
+}
+
+func TestTemplateEngineNames(t *testing.T) {
+	names := NewTemplateEngine().Names()
+	if strings.Join(names, ",") != "crud_handler,repository,table_test" {
+		t.Errorf("Unexpected built-in templates %v", names)
+	}
+}
+
+func TestTemplateEngineCRUDHandler(t *testing.T) {
+	engine := NewTemplateEngine()
+	code, err := engine.Render("crud_handler", CRUDHandlerParams{Package: "api", Resource: "User"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if !strings.Contains(code, `mux.Handle("/users/", h)`) || !strings.Contains(code, "type UserStore interface") {
+		t.Errorf("Unexpected handler:\n%s", code)
+	}
+
+	dir := writePackage(t, map[string]string{
+		"handler.go": code,
+		"user.go":    "package api\n\ntype User struct {\n\tID   string `json:\"id\"`\n\tName string `json:\"name\"`\n}\n",
+		"handler_test.go": `package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type memStore struct{ users map[string]User }
+
+func (m *memStore) List(ctx context.Context) ([]User, error) {
+	var out []User
+	for _, u := range m.users {
+		out = append(out, u)
+	}
+	return out, nil
+}
+func (m *memStore) Get(ctx context.Context, id string) (User, error) {
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, errors.New("not found")
+	}
+	return u, nil
+}
+func (m *memStore) Create(ctx context.Context, u User) (User, error) { m.users[u.ID] = u; return u, nil }
+func (m *memStore) Update(ctx context.Context, id string, u User) (User, error) {
+	m.users[id] = u
+	return u, nil
+}
+func (m *memStore) Delete(ctx context.Context, id string) error { delete(m.users, id); return nil }
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	(&UserHandler{Store: &memStore{users: map[string]User{}}}).Register(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	if rec := do("POST", "/users", ` + "`" + `{"id":"1","name":"ada"}` + "`" + `); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d", rec.Code)
+	}
+	if rec := do("GET", "/users/1", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "ada") {
+		t.Fatalf("get: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("DELETE", "/users/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if rec := do("PATCH", "/users/1", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("patch: %d", rec.Code)
+	}
+}
+`,
+	})
+	runGo(t, dir, "test", "./...")
+}
+
+func TestTemplateEngineRepository(t *testing.T) {
+	gen := NewCodeGenerator("store")
+	if _, err := gen.GenerateStructFromSQL("CREATE TABLE accounts (id BIGINT PRIMARY KEY, email TEXT NOT NULL, display_name TEXT);"); err != nil {
+		t.Fatalf("GenerateStructFromSQL failed: %v", err)
+	}
+	models, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("GenerateCompleteFile failed: %v", err)
+	}
+
+	code, err := NewTemplateEngine().Render("repository", &RepositoryParams{
+		Package: "store",
+		Entity:  "Account",
+		Table:   "accounts",
+		Columns: []string{"id", "email", "display_name"},
+	})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	for _, want := range []string{
+		`const accountColumns = "id, email, display_name"`,
+		"row.Scan(&value.ID, &value.Email, &value.DisplayName)",
+		`VALUES ($1, $2, $3)`,
+		`WHERE id = $1`,
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("Expected %q in:\n%s", want, code)
+		}
+	}
+	buildPackage(t, writePackage(t, map[string]string{"models.go": models, "repository.go": code}))
+}
+
+func TestTemplateEngineTableTest(t *testing.T) {
+	source := `package calc
+
+import "errors"
+
+type Calc struct{}
+
+func Divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func (c *Calc) Sum(xs ...int) int {
+	total := 0
+	for _, x := range xs {
+		total += x
+	}
+	return total
+}
+
+func Reset(string) {}
+`
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(source); err != nil {
+		t.Fatalf("AnalyzeCode failed: %v", err)
+	}
+
+	engine := NewTemplateEngine()
+	files := map[string]string{"calc.go": source}
+	for _, name := range []string{"Divide", "Sum", "Reset"} {
+		code, err := engine.Render("table_test", TableTestParams{Package: "calc", Function: analyzer.Functions[name]})
+		if err != nil {
+			t.Fatalf("Render %s failed: %v", name, err)
+		}
+		files[strings.ToLower(name)+"_test.go"] = code
+	}
+
+	for file, want := range map[string]string{
+		"divide_test.go": "got, err := Divide(tt.a, tt.b)",
+		"sum_test.go":    "got := tt.recv.Sum(tt.xs...)",
+		"reset_test.go":  "Reset(tt.arg0)",
+	} {
+		if !strings.Contains(files[file], want) {
+			t.Errorf("Expected %q in %s:\n%s", want, file, files[file])
+		}
+	}
+	if !strings.Contains(files["sum_test.go"], "func TestCalcSum(t *testing.T)") {
+		t.Errorf("Expected receiver in test name:\n%s", files["sum_test.go"])
+	}
+	runGo(t, writePackage(t, files), "test", "./...")
+}
+
+func TestTemplateEngineValidation(t *testing.T) {
+	engine := NewTemplateEngine()
+
+	if _, err := engine.Render("missing", CRUDHandlerParams{}); err == nil {
+		t.Errorf("Expected error for unknown template")
+	}
+	if _, err := engine.Render("crud_handler", RepositoryParams{}); err == nil || !strings.Contains(err.Error(), "must be main.CRUDHandlerParams") {
+		t.Errorf("Expected parameter type error, got %v", err)
+	}
+	if _, err := engine.Render("crud_handler", CRUDHandlerParams{Package: "api"}); err == nil || !strings.Contains(err.Error(), "missing required parameter Resource") {
+		t.Errorf("Expected missing parameter error, got %v", err)
+	}
+	if _, err := engine.Render("repository", RepositoryParams{Package: "p", Entity: "E", Table: "t", Columns: []string{}}); err == nil {
+		t.Errorf("Expected empty Columns to count as missing")
+	}
+
+	if err := engine.Register("crud_handler", "package x", struct{}{}); err == nil {
+		t.Errorf("Expected duplicate registration error")
+	}
+	if err := engine.Register("bad", "package x", "not a struct"); err == nil {
+		t.Errorf("Expected error for non-struct parameters")
+	}
+	if err := engine.Register("broken", "{{.Name", struct{ Name string }{}); err == nil {
+		t.Errorf("Expected parse error")
+	}
+
+	type constParams struct {
+		Name  string `template:"required"`
+		Value int
+	}
+	if err := engine.Register("const", "package p\nconst {{.Name}} = {{.Value}}\n", constParams{}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	code, err := engine.Render("const", constParams{Name: "Answer", Value: 42})
+	if err != nil || code != "package p\n\nconst Answer = 42\n" {
+		t.Errorf("Unexpected custom template output %q, %v", code, err)
+	}
+	if _, err := engine.Render("const", constParams{Name: "9lives"}); err == nil || !strings.Contains(err.Error(), "invalid Go") {
+		t.Errorf("Expected invalid Go error, got %v", err)
+	}
+}
+
+func TestTemplateEngineGenerate(t *testing.T) {
+	engine := NewTemplateEngine()
+	jobs := []TemplateJob{
+		{Template: "crud_handler", File: "api/user_handler.go", Params: CRUDHandlerParams{Package: "api", Resource: "User", Path: "/v1/users/"}},
+		{Template: "repository", File: "api/user_repository.go", Params: RepositoryParams{Package: "api", Entity: "User", Table: "users", Columns: []string{"id"}}},
+	}
+
+	dir := t.TempDir()
+	paths, err := engine.Generate(dir, jobs)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != filepath.Join(dir, "api", "user_handler.go") {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+	first, _ := os.ReadFile(paths[0])
+	if !strings.Contains(string(first), `mux.Handle("/v1/users", h)`) {
+		t.Errorf("Expected custom path without trailing slash:\n%s", first)
+	}
+
+	again := t.TempDir()
+	if _, err := engine.Generate(again, jobs); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	second, _ := os.ReadFile(filepath.Join(again, "api", "user_handler.go"))
+	if string(first) != string(second) {
+		t.Errorf("Expected deterministic output")
+	}
+
+	failing := t.TempDir()
+	jobs = append(jobs, TemplateJob{Template: "table_test", File: "api/x_test.go", Params: TableTestParams{Package: "api"}})
+	if _, err := engine.Generate(failing, jobs); err == nil {
+		t.Errorf("Expected error for invalid job")
+	}
+	if entries, _ := os.ReadDir(failing); len(entries) != 0 {
+		t.Errorf("Expected nothing written when a job fails")
+	}
+}
+
+func deadCodeSummary(findings []*DeadCodeFinding) []string {
+	out := make([]string, len(findings))
+	for i, f := range findings {
+		out[i] = fmt.Sprintf("%s %s:%d", f.Check, f.Name, f.Pos.Line)
+	}
+	return out
+}
+
+func TestAnalyzePackageDeadCode(t *testing.T) {
+	dir := writePackage(t, map[string]string{"main.go": `package main
+
+import "fmt"
+
+type shape interface{ area() float64 }
+
+type square struct {
+	side, unusedWidth float64
+	label             string
+}
+
+type point struct{ x, y int }
+
+func (s square) area() float64 { return s.side * s.side }
+
+func (s square) perimeter() float64 { return 4 * s.side }
+
+func (s square) String() string { return s.label }
+
+func helper(a, b int) int { return a }
+
+func orphan() { orphanHelper() }
+
+func orphanHelper() {}
+
+func selfRecursive(n int) int {
+	if n == 0 {
+		return 0
+	}
+	return selfRecursive(n - 1)
+}
+
+func callback(n int, extra string) { fmt.Println(n) }
+
+var handlers = map[string]func(int, string){"cb": callback}
+
+//lint:ignore dead_code kept for debugging
+func debugDump() {}
+
+func ignoredParam(a int, b int) int { //lint:ignore unused_param b is reserved
+	return a
+}
+
+//lint:ignore unused_param,dead_code legacy entry point
+func legacy(a int) { fmt.Println() }
+
+func main() {
+	var sh shape = square{side: 2}
+	p := point{1, 2}
+	fmt.Println(sh.area(), helper(1, 2), ignoredParam(1, 2), p, handlers)
+}
+`})
+
+	analysis, err := NewCodeAnalyzer().AnalyzePackage(dir)
+	if err != nil {
+		t.Fatalf("AnalyzePackage failed: %v", err)
+	}
+
+	want := []string{
+		"unused_field square.unusedWidth:8",
+		"dead_code square.perimeter:16",
+		"unused_param helper.b:20",
+		"dead_code orphan:22",
+		"dead_code orphanHelper:24",
+		"dead_code selfRecursive:26",
+	}
+	if got := deadCodeSummary(analysis.DeadCode); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected findings:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if f := analysis.DeadCode[0]; !strings.HasSuffix(f.Pos.Filename, "main.go") || f.Message != "field unusedWidth of square is never used" {
+		t.Errorf("Unexpected finding %+v", f)
+	}
+}
+
+func TestAnalyzePackageDeadCodeLibrary(t *testing.T) {
+	dir := writePackage(t, map[string]string{"lib.go": `package lib
+
+type Client struct {
+	name   string
+	secret string
+}
+
+func New(name string) *Client { return &Client{name: name} }
+
+func (c *Client) Name() string { return c.name }
+
+func (c *Client) reset() {}
+
+func unusedHelper() {}
+`})
+
+	analysis, err := NewCodeAnalyzer().AnalyzePackage(dir)
+	if err != nil {
+		t.Fatalf("AnalyzePackage failed: %v", err)
+	}
+
+	want := "unused_field Client.secret:5,dead_code Client.reset:12,dead_code unusedHelper:14"
+	if got := strings.Join(deadCodeSummary(analysis.DeadCode), ","); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+const enumSource = `package tenants
+
+type TenantStatus string
+
+const (
+	TenantActive    TenantStatus = "active"
+	TenantSuspended TenantStatus = "suspended"
+	TenantDeleted   TenantStatus = "deleted"
+)
+
+type Priority int
+
+const (
+	Low Priority = iota
+	Medium
+	High
+	_
+	Critical
+	Urgent = High
+)
+
+const unrelated = 1
+`
+
+func TestGenerateEnum(t *testing.T) {
+	gen := NewCodeGenerator("tenants")
+
+	priority, err := gen.GenerateEnum(enumSource, "Priority")
+	if err != nil {
+		t.Fatalf("GenerateEnum failed: %v", err)
+	}
+	if strings.Contains(priority, `return "Urgent"`) || !strings.Contains(priority, `case "urgent":`) {
+		t.Errorf("Expected duplicate values to print the first name but parse every name:\n%s", priority)
+	}
+
+	status, err := gen.GenerateEnum(enumSource, "TenantStatus")
+	if err != nil {
+		t.Fatalf("GenerateEnum failed: %v", err)
+	}
+	if !strings.Contains(status, `case "active", "tenantactive":`) {
+		t.Errorf("Expected string enums to parse values and names:\n%s", status)
+	}
+
+	code, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("GenerateCompleteFile failed: %v", err)
+	}
+
+	dir := writePackage(t, map[string]string{
+		"tenants.go":      enumSource,
+		"tenants_enum.go": code,
+		"enum_test.go": `package tenants
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEnums(t *testing.T) {
+	if High.String() != "High" || Critical.String() != "Critical" || Priority(42).String() != "Priority(42)" {
+		t.Errorf("unexpected names %s %s %s", High, Critical, Priority(42))
+	}
+	if p, err := ParsePriority("cRiTiCaL"); err != nil || p != Critical {
+		t.Errorf("ParsePriority: %v %v", p, err)
+	}
+	if p, err := ParsePriority("urgent"); err != nil || p != High {
+		t.Errorf("ParsePriority(urgent): %v %v", p, err)
+	}
+	if _, err := ParsePriority("none"); err == nil || err.Error() != ` + "`" + `invalid Priority "none"` + "`" + ` {
+		t.Errorf("expected parse error, got %v", err)
+	}
+	if s, err := ParseTenantStatus("TenantSuspended"); err != nil || s != TenantSuspended {
+		t.Errorf("ParseTenantStatus: %v %v", s, err)
+	}
+
+	type record struct {
+		Status   TenantStatus
+		Priority Priority
+	}
+	data, err := json.Marshal(record{TenantDeleted, Medium})
+	if err != nil || string(data) != ` + "`" + `{"Status":"deleted","Priority":"Medium"}` + "`" + ` {
+		t.Fatalf("Marshal: %s %v", data, err)
+	}
+	var back record
+	if err := json.Unmarshal([]byte(` + "`" + `{"Status":"DELETED","Priority":"medium"}` + "`" + `), &back); err != nil || back != (record{TenantDeleted, Medium}) {
+		t.Errorf("Unmarshal: %+v %v", back, err)
+	}
+	if err := json.Unmarshal([]byte(` + "`" + `{"Priority":"bogus"}` + "`" + `), &back); err == nil {
+		t.Errorf("expected error for unknown value")
+	}
+}
+`,
+	})
+	runGo(t, dir, "test", "./...")
+}
+
+func TestGenerateEnumErrors(t *testing.T) {
+	gen := NewCodeGenerator("p")
+	cases := map[string]string{
+		"Missing":  enumSource,
+		"Floaty":   "package p\n\ntype Floaty float64\n\nconst A Floaty = 1\n",
+		"Empty":    "package p\n\ntype Empty int\n",
+		"Priority": "package p\n\ntype Priority int\n\nconst A Priority = undefined\n",
+	}
+	for typeName, source := range cases {
+		if _, err := gen.GenerateEnum(source, typeName); err == nil {
+			t.Errorf("Expected error for %s", typeName)
+		}
+	}
+}
+
+const testRulePack = `
+rules:
+  - id: no_todo
+    name: TODO found
+    pattern: TODO
+    message: TODO comments present
+  - id: no_panic
+    pattern: 'panic\('
+    severity: error
+    message: Do not panic
+    disabled: true
+  - id: errors
+    analyzer: unchecked_error
+    severity: warning
+directories:
+  - path: internal/legacy/new/
+    enable: [errors]
+  - path: internal/legacy
+    disable: [errors, no_todo]
+  - path: cmd
+    enable: [no_panic]
+    severity: {no_todo: error}
+`
+
+const rulePackSource = `package p
+
+import "os"
+
+// TODO: remove
+func run() {
+	os.Remove("x")
+	panic("boom")
+}
+`
+
+func lintedRules(violations []*LintViolation) string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Rule+"/"+v.Severity)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+func TestRulePackDirectories(t *testing.T) {
+	pack, err := ParseRulePack([]byte(testRulePack))
+	if err != nil {
+		t.Fatalf("ParseRulePack failed: %v", err)
+	}
+	linter := NewCustomLinter()
+	if err := linter.ApplyRulePack(pack); err != nil {
+		t.Fatalf("ApplyRulePack failed: %v", err)
+	}
+
+	cases := map[string]string{
+		"main.go":                      "errors/warning,no_todo/warning",
+		"internal/legacy/old.go":       "",
+		"internal/legacy/new/x/new.go": "errors/warning",
+		"internal/legacyish/a.go":      "errors/warning,no_todo/warning",
+		"cmd/tool/main.go":             "errors/warning,no_panic/error,no_todo/error",
+	}
+	for file, want := range cases {
+		if got := lintedRules(linter.LintFile(file, rulePackSource)); got != want {
+			t.Errorf("%s: expected %q, got %q", file, want, got)
+		}
+	}
+
+	if got := lintedRules(linter.Lint(rulePackSource)); got != "errors/warning,no_todo/warning" {
+		t.Errorf("Expected Lint to use the root policy, got %q", got)
+	}
+	for _, v := range linter.LintFile("main.go", rulePackSource) {
+		if v.Rule == "no_todo" && v.Message != "TODO comments present" {
+			t.Errorf("Expected configured message, got %q", v.Message)
+		}
+	}
+}
+
+func TestRulePackReplacesAnalyzers(t *testing.T) {
+	linter := NewCustomLinter()
+	linter.AddAnalyzer(UncheckedErrorAnalyzer())
+
+	pack, err := ParseRulePack([]byte("rules:\n  - id: unchecked_error\n    analyzer: unchecked_error\n    severity: info\n"))
+	if err != nil {
+		t.Fatalf("ParseRulePack failed: %v", err)
+	}
+	if err := linter.ApplyRulePack(pack); err != nil {
+		t.Fatalf("ApplyRulePack failed: %v", err)
+	}
+	if got := lintedRules(linter.Lint(rulePackSource)); got != "unchecked_error/info" {
+		t.Errorf("Expected the configured analyzer only, got %q", got)
+	}
+}
+
+func TestLoadRulePack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lint.yaml")
+	if err := os.WriteFile(path, []byte(testRulePack), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pack, err := LoadRulePack(path)
+	if err != nil {
+		t.Fatalf("LoadRulePack failed: %v", err)
+	}
+	if len(pack.Rules) != 3 || len(pack.Directories) != 3 || pack.Directories[2].Severity["no_todo"] != "error" {
+		t.Errorf("Unexpected pack %+v", pack)
+	}
+
+	if _, err := LoadRulePack(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestParseRulePackValidation(t *testing.T) {
+	cases := map[string]string{
+		"missing id":       "rules:\n  - pattern: x\n",
+		"duplicate id":     "rules:\n  - id: a\n    pattern: x\n  - id: a\n    pattern: y\n",
+		"pattern and AST":  "rules:\n  - id: a\n    pattern: x\n    analyzer: mutex_copy\n",
+		"neither":          "rules:\n  - id: a\n",
+		"unknown analyzer": "rules:\n  - id: a\n    analyzer: nope\n",
+		"bad severity":     "rules:\n  - id: a\n    pattern: x\n    severity: fatal\n",
+		"bad pattern":      "rules:\n  - id: a\n    pattern: '('\n",
+		"unknown field":    "rules:\n  - id: a\n    pattern: x\n    level: error\n",
+		"unknown dir rule": "rules:\n  - id: a\n    pattern: x\ndirectories:\n  - path: b\n    disable: [c]\n",
+		"bad dir severity": "rules:\n  - id: a\n    pattern: x\ndirectories:\n  - path: b\n    severity: {a: loud}\n",
+		"not yaml":         "rules: [",
+	}
+	for name, data := range cases {
+		if _, err := ParseRulePack([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if pack, err := ParseRulePack(nil); err != nil || len(pack.Rules) != 0 {
+		t.Errorf("Expected an empty pack to be valid, got %v", err)
+	}
+}
+
+const apiV1 = `package store
+
+import "context"
+
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+type Memory struct {
+	Name  string
+	Limit int
+	items map[string][]byte
+}
+
+func (m Memory) Get(ctx context.Context, key string) ([]byte, error) { return m.items[key], nil }
+
+func (m Memory) Put(ctx context.Context, key string, value []byte) error { return nil }
+
+func (m *Memory) Reset() {}
+
+func (m Memory) Len() int { return len(m.items) }
+
+func New(limit int) *Memory { return &Memory{Limit: limit} }
+
+func Open(path string) (Store, error) { return nil, nil }
+
+const Version = "1.0"
+
+const MaxKeys = 100
+
+var DefaultLimit = 10
+
+type Mode int
+
+func helper() {}
+`
+
+const apiV2 = `package store
+
+import "context"
+
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+type Memory struct {
+	Name  string
+	Limit int64
+	TTL   int
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) { return nil, nil }
+
+func (m *Memory) Put(ctx context.Context, key string, value []byte) error { return nil }
+
+func (m *Memory) Reset() {}
+
+func (m *Memory) Stats() string { return "" }
+
+func New(limit int, name string) *Memory { return &Memory{Name: name} }
+
+const Version = "2.0"
+
+const MaxKeys = 100
+
+var DefaultLimit = 10
+
+type Mode string
+
+func Ping() {}
+`
+
+func TestCompareAPIs(t *testing.T) {
+	diff, err := CompareAPIs(apiV1, apiV2)
+	if err != nil {
+		t.Fatalf("CompareAPIs failed: %v", err)
+	}
+
+	var got []string
+	for _, c := range diff.Changes {
+		got = append(got, fmt.Sprintf("%s %s %v: %s", c.Kind, c.Object, c.Breaking, c.Message))
+	}
+	want := []string{
+		"changed Memory true: Memory no longer implements Cache",
+		"changed Memory true: Memory no longer implements Store",
+		"changed Memory.Get true: method Memory.Get now has a pointer receiver",
+		"removed Memory.Len true: method Memory.Len was removed",
+		"changed Memory.Limit true: field Memory.Limit changed from int to int64",
+		"changed Memory.Put true: method Memory.Put now has a pointer receiver",
+		"added Memory.Stats false: method Memory.Stats was added",
+		"added Memory.TTL false: field Memory.TTL was added",
+		"changed Mode true: type Mode changed from int to string",
+		"changed New true: New changed from \"func New(limit int) *Memory\" to \"func New(limit int, name string) *Memory\"",
+		"removed Open true: Open was removed",
+		"added Ping false: Ping was added",
+		"added Store.Delete true: interface Store was narrowed: implementations must add Delete",
+		`changed Version true: Version changed from "const Version untyped string = \"1.0\"" to "const Version untyped string = \"2.0\""`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if n := len(diff.Breaking()); n != 11 {
+		t.Errorf("Expected 11 breaking changes, got %d", n)
+	}
+	if err := diff.Err(); err == nil || !strings.HasPrefix(err.Error(), "11 breaking API changes: ") {
+		t.Errorf("Unexpected gate error %v", err)
+	}
+}
+
+func TestCompareAPIsCompatible(t *testing.T) {
+	newer := apiV1 + "\nfunc Extra() {}\n\ntype Options struct{ Debug bool }\n"
+	diff, err := CompareAPIs(apiV1, newer)
+	if err != nil {
+		t.Fatalf("CompareAPIs failed: %v", err)
+	}
+	if err := diff.Err(); err != nil {
+		t.Errorf("Expected additions to be compatible, got %v", err)
+	}
+	if len(diff.Changes) != 2 {
+		t.Errorf("Expected 2 additions, got %+v", diff.Changes)
+	}
+
+	if same, _ := CompareAPIs(apiV1, apiV1); len(same.Changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", same.Changes)
+	}
+	if _, err := CompareAPIs(apiV1, "package store\n\nvar X = undefined\n"); err == nil {
+		t.Errorf("Expected type error for the new version")
+	}
+}
+
+func TestGenerateHTTPStubs(t *testing.T) {
+	// An article service modelled on the REST server in challenge-135
+	source := `package articles
+
+import "context"
+
+type Article struct {
+	ID    int    ` + "`json:\"id\"`" + `
+	Title string ` + "`json:\"title\"`" + `
+}
+
+type CreateArticleRequest struct {
+	Title string ` + "`json:\"title\"`" + `
+}
+
+type ArticleService interface {
+	GetArticle(ctx context.Context, id int) (*Article, error)
+	ListArticles(ctx context.Context, page, limit int) (articles []Article, total int, err error)
+	CreateArticle(ctx context.Context, req CreateArticleRequest) (*Article, error)
+	DeleteArticle(ctx context.Context, id int) error
+	Tag(out int, tags ...string) error
+}
+`
+	analyzer := NewCodeAnalyzer()
+	if err := analyzer.AnalyzeCode(source); err != nil {
+		t.Fatalf("AnalyzeCode failed: %v", err)
+	}
+
+	gen := NewCodeGenerator("articles")
+	stubs, err := gen.GenerateHTTPStubs(analyzer.Interfaces["ArticleService"])
+	if err != nil {
+		t.Fatalf("GenerateHTTPStubs failed: %v", err)
+	}
+	for _, want := range []string{
+		`mux.HandleFunc(prefix+"/list-articles", h.handleListArticles)`,
+		"Articles []Article `json:\"articles\"`",
+		"Tags []string `json:\"tags\"`",
+		"func (c *ArticleServiceClient) Tag(outArg int, tags ...string) error {",
+		`err := c.call(context.Background(), "/tag", ArticleServiceTagRequest{OutArg: outArg, Tags: tags}, &out)`,
+		"r0, r1, err := h.Service.ListArticles(r.Context(), req.Page, req.Limit)",
+	} {
+		if !strings.Contains(collapseSpace(stubs), collapseSpace(want)) {
+			t.Errorf("Expected %q in:\n%s", want, stubs)
+		}
+	}
+
+	file, err := gen.GenerateCompleteFile()
+	if err != nil {
+		t.Fatalf("GenerateCompleteFile failed: %v", err)
+	}
+
+	dir := writePackage(t, map[string]string{
+		"service.go": source,
+		"stubs.go":   file,
+		"stubs_test.go": `package articles
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeService struct {
+	articles map[int]*Article
+	tags     []string
+}
+
+func (f *fakeService) GetArticle(ctx context.Context, id int) (*Article, error) {
+	if a, ok := f.articles[id]; ok {
+		return a, nil
+	}
+	return nil, errors.New("article not found")
+}
+
+func (f *fakeService) ListArticles(ctx context.Context, page, limit int) ([]Article, int, error) {
+	var out []Article
+	for _, a := range f.articles {
+		out = append(out, *a)
+	}
+	return out, len(f.articles) * page, nil
+}
+
+func (f *fakeService) CreateArticle(ctx context.Context, req CreateArticleRequest) (*Article, error) {
+	a := &Article{ID: len(f.articles) + 1, Title: req.Title}
+	f.articles[a.ID] = a
+	return a, nil
+}
+
+func (f *fakeService) DeleteArticle(ctx context.Context, id int) error {
+	delete(f.articles, id)
+	return nil
+}
+
+func (f *fakeService) Tag(id int, tags ...string) error {
+	f.tags = append(f.tags, tags...)
+	return nil
+}
+
+func TestStubs(t *testing.T) {
+	svc := &fakeService{articles: map[int]*Article{}}
+	mux := http.NewServeMux()
+	NewArticleServiceHandler(svc).Register(mux, "/api/")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var client ArticleService = NewArticleServiceClient(server.URL + "/api")
+	ctx := context.Background()
+
+	created, err := client.CreateArticle(ctx, CreateArticleRequest{Title: "Hello"})
+	if err != nil || created.ID != 1 {
+		t.Fatalf("CreateArticle: %+v %v", created, err)
+	}
+	got, err := client.GetArticle(ctx, 1)
+	if err != nil || got.Title != "Hello" {
+		t.Fatalf("GetArticle: %+v %v", got, err)
+	}
+	list, total, err := client.ListArticles(ctx, 3, 10)
+	if err != nil || len(list) != 1 || total != 3 {
+		t.Fatalf("ListArticles: %v %d %v", list, total, err)
+	}
+	if err := client.Tag(1, "go", "http"); err != nil || strings.Join(svc.tags, ",") != "go,http" {
+		t.Fatalf("Tag: %v %v", svc.tags, err)
+	}
+	if err := client.DeleteArticle(ctx, 1); err != nil {
+		t.Fatalf("DeleteArticle: %v", err)
+	}
+	if _, err := client.GetArticle(ctx, 1); err == nil || !strings.Contains(err.Error(), "500 Internal Server Error: article not found") {
+		t.Fatalf("expected service error, got %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/api/get-article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", resp.StatusCode)
+	}
+}
+`,
+	})
+	runGo(t, dir, "test", "./...")
+}
+
+func TestGenerateHTTPStubsRequiresErrors(t *testing.T) {
+	info := &InterfaceInfo{Name: "Counter", Methods: []*MethodSignature{{Name: "Count", Returns: []*ParamInfo{{Type: "int"}}}}}
+	if _, err := NewCodeGenerator("p").GenerateHTTPStubs(info); err == nil || !strings.Contains(err.Error(), "Counter.Count must return an error") {
+		t.Errorf("Expected error for method without error result, got %v", err)
+	}
+}
+
+func TestKebabCase(t *testing.T) {
+	cases := map[string]string{"GetUserByID": "get-user-by-id", "Ping": "ping", "HTTPStatus": "http-status", "ListV2": "list-v2"}
+	for name, want := range cases {
+		if got := kebabCase(name); got != want {
+			t.Errorf("kebabCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestParamInfo tests parameter information
+func TestParamInfo(t *testing.T) {
+	param := &ParamInfo{
+		Name: "x",
+		Type: "int",
+	}
+
+	if param.Name != "x" {
+		t.Errorf("Expected Name='x'")
+	}
+
+	if param.Type != "int" {
+		t.Errorf("Expected Type='int'")
+	}
+}
+
+// TestFunctionInfo tests function information
+func TestFunctionInfo(t *testing.T) {
+	fn := &FunctionInfo{
+		Name:      "Add",
+		Lines:     5,
+		Cyclomatic: 1,
+		IsPublic:  true,
+	}
+
+	if fn.Name != "Add" {
+		t.Errorf("Expected Name='Add'")
+	}
+
+	if fn.Cyclomatic != 1 {
+		t.Errorf("Expected Cyclomatic=1")
+	}
+}
+
+// TestTypeInfo tests type information
+func TestTypeInfo(t *testing.T) {
+	ti := &TypeInfo{
+		Name:     "User",
+		Kind:     "struct",
+		IsPublic: true,
+	}
+
+	if ti.Name != "User" {
+		t.Errorf("Expected Name='User'")
+	}
+
+	if ti.Kind != "struct" {
+		t.Errorf("Expected Kind='struct'")
+	}
+}
+
+// Benchmark tests
+
+func BenchmarkCodeAnalyzer(b *testing.B) {
+	analyzer := NewCodeAnalyzer()
+	code := `
+package main
+
+func Test(x int) int {
+	return x * 2
+}
+`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		analyzer.AnalyzeCode(code)
+	}
+}
+
+func BenchmarkCodeGenerator(b *testing.B) {
+	gen := NewCodeGenerator("main")
+	fields := []*ParamInfo{{Name: "x", Type: "int"}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gen.GenerateStructCode("Test", fields)
+	}
+}
+
+func BenchmarkCodeTransformer(b *testing.B) {
+	transformer := NewCodeTransformer()
+	transformer.AddPattern("test", "var", "const", "test")
+	code := "var x = 5"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transformer.Transform(code)
+	}
+}
+
+func BenchmarkCustomLinter(b *testing.B) {
+	linter := NewCustomLinter()
+	linter.AddRule("test", "Test", "Test", "var", "warning")
+	code := "var x = 5"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linter.Lint(code)
+	}
+}
+
+// Helper functions
+
+// writePackage writes files into a fresh module and returns its directory
+func writePackage(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/pkg\n\ngo 1.21\n"
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// buildPackage compiles the package in dir
+func buildPackage(t *testing.T, dir string) {
+	t.Helper()
+	runGo(t, dir, "build", "./...")
+}
+
+// runGo runs a go command in dir and fails the test if it fails
+func runGo(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go %s failed on generated code: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// collapseSpace replaces runs of whitespace with one space, so comparisons
+// ignore gofmt alignment
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
 func contains(s, substr string) bool {
 	for i := 0; i < len(s)-len(substr)+1; i++ {
 		if s[i:i+len(substr)] == substr {
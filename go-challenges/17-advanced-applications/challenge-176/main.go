@@ -1,45 +1,231 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
 )
 
 // APIGateway is the main gateway component
 type APIGateway struct {
 	routes           map[string]*Route
+	router           *router
 	rateLimiters     map[string]*RateLimiter
+	rateLimitStore   RateLimitStore
+	idempotency      IdempotencyStore
 	authenticator    *Authenticator
 	cache            *ResponseCache
-	circuitBreakers  map[string]*CircuitBreaker
+	circuitBreakers  map[string]*CircuitBreaker // by backend URL
+	circuitConfig    CircuitBreakerConfig
 	loadBalancers    map[string]*LoadBalancer
 	healthChecker    *HealthChecker
 	metrics          *Metrics
+	accessLog        *AccessLogger
+	accessLogConfig  AccessLogConfig               // what accessLog was built from, if a config file
+	canaryShifts     map[string]context.CancelFunc // gradual shifts started by the admin API
 	mu               sync.RWMutex
 	requestIDCounter atomic.Int64
 }
 
 // Route represents a route configuration
 type Route struct {
-	Pattern          string
-	Methods          []string
-	Backends         []*Backend
-	RateLimitPerMin  int
-	RequireAuth      bool
-	CacheTTL         time.Duration
-	Transform        RequestTransformer
-	ResponseHandler  ResponseTransformer
-	CircuitBreaker   *CircuitBreaker
-	LoadBalancer     *LoadBalancer
+	Pattern         string
+	Methods         []string
+	Backends        []*Backend
+	RateLimitPerMin int
+	RequireAuth     bool
+	CacheTTL        time.Duration
+	Transform       RequestTransformer  // use a RequestChain for several steps
+	ResponseHandler ResponseTransformer // use a ResponseChain for several steps
+	LoadBalancer    *LoadBalancer
+
+	// LoadBalancing picks the strategy, round-robin by default. With
+	// consistent-hash, requests are keyed by the HashHeader value, falling
+	// back to the client ID (API key or client IP).
+	LoadBalancing string
+	HashHeader    string
+	// RouteRateLimitPerMin caps requests from all clients together, on top
+	// of the per-client RateLimitPerMin
+	RouteRateLimitPerMin int
+	// Stream copies backend responses to the client as they arrive and
+	// never caches them; use it for large downloads and event streams
+	Stream bool
+	// WebSocket tunnels Upgrade: websocket requests to the backend
+	WebSocket bool
+	// EventStream accepts Accept: text/event-stream requests and streams
+	// the server-sent events through unbuffered
+	EventStream bool
+	// Retry re-sends failed idempotent requests to other backends
+	Retry *RetryPolicy
+	// MaxCacheBodyBytes caps how much of a response is kept for caching.
+	// Larger responses are still proxied, just not cached.
+	MaxCacheBodyBytes int64
+	// StaleWhileRevalidate serves expired cache entries for this long
+	// while a background request refreshes them
+	StaleWhileRevalidate time.Duration
+	// MaxBodyBytes rejects request bodies larger than this with a 413
+	MaxBodyBytes int64
+	// Timeout is the end-to-end budget for the backend exchange: dial,
+	// TLS handshake and the full response, retries included. Streaming
+	// routes only spend it until the response headers arrive.
+	Timeout time.Duration
+	// Canary sends a share of clients to a second backend pool
+	Canary *Canary
+	// RequireClientCert rejects requests without a client certificate
+	// that verified against the listener's ClientCAFile
+	RequireClientCert bool
+	// IdempotencyTTL, when set, remembers the responses to POST, PUT and
+	// PATCH requests carrying an Idempotency-Key for this long and
+	// replays them to duplicates
+	IdempotencyTTL time.Duration
+	// AuthMethods limits RequireAuth to these methods; empty means all
+	AuthMethods []string
+	// Validator rejects requests the backend would not accept with a 400
+	// before anything is proxied
+	Validator RequestValidator
+}
+
+// RequestValidator checks an incoming request, such as against an API spec
+type RequestValidator interface {
+	Validate(r *http.Request) error
+}
+
+// requiresAuth reports whether requests with method must authenticate
+func (route *Route) requiresAuth(method string) bool {
+	if !route.RequireAuth {
+		return false
+	}
+	if len(route.AuthMethods) == 0 {
+		return true
+	}
+	for _, m := range route.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Canary is a second backend pool taking Percent of a route's clients.
+// Clients are assigned by a hash of their client ID, so each one sticks
+// to a pool, and raising Percent only ever moves clients onto the canary.
+type Canary struct {
+	Backends     []*Backend
+	Percent      float64 // 0 to 100
+	LoadBalancer *LoadBalancer
+}
+
+// takes reports whether the client with key belongs to the canary pool
+func (c *Canary) takes(key string) bool {
+	return hashKey(key)%10000 < uint64(math.Round(c.Percent*100))
+}
+
+// allBackends returns the route's backends, canary pool included
+func (route *Route) allBackends() []*Backend {
+	if route.Canary == nil {
+		return route.Backends
+	}
+	return append(append([]*Backend(nil), route.Backends...), route.Canary.Backends...)
+}
+
+// timeoutHeader carries the remaining budget in milliseconds, so that
+// backends and further gateways can stop work the client gave up on
+const timeoutHeader = "X-Timeout-Remaining"
+
+// errTimeoutBudget is the cancellation cause once a route's budget runs out
+var errTimeoutBudget = errors.New("timeout budget exhausted")
+
+// budgetDeadlineKey holds the budget deadline of a streaming request,
+// whose context is cancelled by a timer rather than carrying a deadline
+type budgetDeadlineKey struct{}
+
+// defaultMaxCacheBodyBytes applies when a cached route sets no limit
+const defaultMaxCacheBodyBytes = 1 << 20
+
+// RetryPolicy controls how a route retries failed backend responses.
+// Responses on retrying routes are buffered until an attempt wins, so
+// streaming routes never retry.
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts including the first; 0 means 3
+	RetryOn     []int         // status codes worth retrying; default 502, 503, 504
+	Backoff     time.Duration // delay before the first retry, doubled after each
+	MaxBackoff  time.Duration // cap on the delay; 0 means no cap
+	// HedgeAfter, when set, sends another attempt to a different backend
+	// if none has answered within this long, and uses the first answer
+	HedgeAfter time.Duration
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(status int) bool {
+	codes := p.RetryOn
+	if len(codes) == 0 {
+		codes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before retry number n (1-based)
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < n && delay > 0; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
 }
 
 // Backend represents a backend service
@@ -50,70 +236,224 @@ type Backend struct {
 	Timeout       time.Duration
 	TotalRequests atomic.Int64
 	Errors        atomic.Int64
+	breaker       atomic.Pointer[CircuitBreaker] // shared by every backend with this URL
 }
 
-// RateLimiter implements token bucket rate limiting
+// RateLimiter implements sliding-window rate limiting for one route, per
+// client and across all clients, with counters kept in a RateLimitStore
 type RateLimiter struct {
-	clientBuckets map[string]*TokenBucket
-	perMinute     int
-	mu            sync.RWMutex
+	perMinute      int // per client; 0 means unlimited
+	routePerMinute int // all clients together; 0 means unlimited
+	window         time.Duration
+	store          RateLimitStore
+	prefix         string
+	now            func() time.Time
+	mu             sync.Mutex
+}
+
+// RateLimitStore holds fixed-window hit counters. Sharing one store (e.g.
+// Redis) between gateway instances makes their limits global.
+type RateLimitStore interface {
+	// Count returns the hits recorded under key, 0 if there are none
+	Count(ctx context.Context, key string) (int64, error)
+	// Increment adds a hit under key, expiring the counter after ttl
+	Increment(ctx context.Context, key string, ttl time.Duration) (int64, error)
 }
 
-// TokenBucket represents a token bucket for a client
-type TokenBucket struct {
-	tokens    atomic.Int64
-	maxTokens int64
-	refillAt  atomic.Int64
+// RateLimitDecision describes the outcome of a rate limit check
+type RateLimitDecision struct {
+	Allowed    bool
+	Scope      string // "client" or "route": the limit that applied
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
 }
 
 // Authenticator handles authentication
 type Authenticator struct {
-	apiKeys   map[string]bool
-	jwtSecret string
-	mu        sync.RWMutex
+	apiKeys      map[string]bool
+	jwtSecret    string
+	jwks         *JWKSCache
+	issuer       string
+	audience     string
+	claimHeaders map[string]string
+	leeway       time.Duration
+	now          func() time.Time
+	mu           sync.RWMutex
+}
+
+// JWTConfig configures bearer token validation. HS256 tokens are checked
+// against Secret, RS256 tokens against the keys published at JWKSURL.
+type JWTConfig struct {
+	Secret       string
+	JWKSURL      string
+	JWKSCacheTTL time.Duration // default 10 minutes
+	Issuer       string        // required iss, if set
+	Audience     string        // required aud entry, if set
+	Leeway       time.Duration // clock skew allowed on exp and nbf
+	// ClaimHeaders maps claim names to the request headers they are
+	// forwarded to backends in. Clients cannot set these headers.
+	ClaimHeaders map[string]string
+}
+
+// Claims are the decoded payload of a validated JWT
+type Claims map[string]interface{}
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidAPIKey      = errors.New("invalid api key")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrTokenExpired       = errors.New("token expired")
+)
+
+var defaultClaimHeaders = map[string]string{
+	"sub":   "X-Auth-Subject",
+	"scope": "X-Auth-Scope",
 }
 
-// ResponseCache caches responses with TTL
+// ResponseCache caches responses with TTL, evicting the least recently
+// used entries beyond its entry and byte limits
 type ResponseCache struct {
-	entries map[string]*CacheEntry
-	mu      sync.RWMutex
+	entries      map[string]*list.Element // of *CacheEntry
+	lru          *list.List
+	vary         map[string][]string // base key -> request headers responses vary on
+	revalidating map[string]bool
+	maxEntries   int
+	maxBytes     int64
+	bytes        int64
+	mu           sync.RWMutex
 }
 
 // CacheEntry represents a cached response
 type CacheEntry struct {
-	Data      []byte
-	ExpiresAt time.Time
-	etag      string
+	Data       []byte
+	Header     http.Header
+	ExpiresAt  time.Time
+	StaleUntil time.Time // may be served stale while revalidating until then
+	etag       string
+	key        string
+	path       string // request path, for purging by prefix
 }
 
-// CircuitBreaker implements circuit breaker pattern
+type cacheState int
+
+const (
+	cacheMiss    cacheState = iota
+	cacheFresh              // within TTL
+	cacheStale              // past TTL, within stale-while-revalidate
+	cacheExpired            // past both, kept only for conditional revalidation
+)
+
+// Default cache bounds
+const (
+	defaultCacheMaxEntries = 10000
+	defaultCacheMaxBytes   = 64 << 20
+)
+
+// CircuitBreaker guards one backend. It opens when the error rate over a
+// rolling window reaches ErrorPercent with at least MinRequests in the
+// window, then lets single probe requests through once OpenTimeout passes.
 type CircuitBreaker struct {
-	failureThreshold int
-	successThreshold int
-	timeout          time.Duration
-	state            atomic.Value // string: "closed", "open", "half-open"
-	failures         atomic.Int32
-	successes        atomic.Int32
-	lastFailTime     atomic.Value // time.Time
+	name       string
+	cfg        CircuitBreakerConfig
+	mu         sync.Mutex
+	state      string // "closed", "open", "half-open"
+	buckets    []cbBucket
+	openedAt   time.Time
+	probeUntil time.Time // while set, a half-open probe is in flight
+	probesOK   int
+	tripped    bool // held open by Trip until Reset
+	now        func() time.Time
+}
+
+// cbBucket counts results for one slice of the rolling window
+type cbBucket struct {
+	epoch     int64 // which slice of time the counts belong to
+	successes int
+	failures  int
+}
+
+// CircuitBreakerConfig tunes circuit breakers; zero fields take defaults
+type CircuitBreakerConfig struct {
+	Window            time.Duration // how far back the error rate looks; 10s
+	Buckets           int           // window resolution; 10
+	ErrorPercent      float64       // error rate that opens the circuit; 50
+	MinRequests       int           // requests in the window before it may open; 20
+	OpenTimeout       time.Duration // time open before probing; 10s
+	HalfOpenSuccesses int           // passing probes that close it again; 2
+	// OnStateChange is called after every transition. It runs on the
+	// request path and must not block.
+	OnStateChange func(CircuitEvent)
+}
+
+// CircuitEvent describes a circuit breaker state transition
+type CircuitEvent struct {
+	Name         string // the backend URL
+	From, To     string
+	ErrorPercent float64 // error rate in the window when the circuit opened
+	Requests     int     // requests in the window when the circuit opened
+	Time         time.Time
 }
 
 // LoadBalancer implements load balancing strategies
 type LoadBalancer struct {
-	backends       []*Backend
-	strategy       string // "round-robin", "least-connections"
-	roundRobinIdx  atomic.Int32
-	mu             sync.RWMutex
+	backends      []*Backend
+	strategy      string         // one of the strategies in loadBalancingStrategies
+	health        *HealthChecker // unhealthy backends are skipped when set
+	roundRobinIdx atomic.Int32
+	mu            sync.RWMutex
+	current       []int      // smooth weighted round-robin state, guarded by mu
+	ring          []ringNode // consistent-hash ring sorted by hash
+}
+
+// ringNode is one virtual node of a backend on the hash ring
+type ringNode struct {
+	hash    uint64
+	backend *Backend
+}
+
+// Load balancing strategies
+const (
+	RoundRobin         = "round-robin"
+	LeastConnections   = "least-connections"
+	WeightedRoundRobin = "weighted-round-robin"
+	ConsistentHash     = "consistent-hash"
+)
+
+var loadBalancingStrategies = map[string]bool{
+	RoundRobin:         true,
+	LeastConnections:   true,
+	WeightedRoundRobin: true,
+	ConsistentHash:     true,
 }
 
-// HealthChecker performs health checks on backends
+// ringReplicas is how many virtual nodes each unit of weight gets
+const ringReplicas = 160
+
+// HealthChecker performs health checks on backends. Backends go down
+// after failThreshold consecutive failures, from probes or from live
+// traffic answering 5xx, and come back after recoverThreshold passing
+// probes in a row.
 type HealthChecker struct {
-	backends  []*Backend
-	interval  time.Duration
-	mu        sync.RWMutex
-	healthy   map[string]bool
-	lastCheck map[string]time.Time
+	backends         []*Backend
+	interval         time.Duration
+	mu               sync.RWMutex
+	healthy          map[string]bool
+	lastCheck        map[string]time.Time
+	failures         map[string]int
+	recoveries       map[string]int
+	failThreshold    int
+	recoverThreshold int
+	client           *http.Client
+	stop             chan struct{}
 }
 
+// Default health thresholds
+const (
+	defaultFailThreshold    = 3
+	defaultRecoverThreshold = 2
+)
+
 // RequestTransformer transforms requests
 type RequestTransformer interface {
 	Transform(req *http.Request) error
@@ -130,26 +470,69 @@ type Metrics struct {
 	totalErrors    atomic.Int64
 	totalLatency   atomic.Int64
 	activeRequests atomic.Int32
-	requestsByCode map[int]atomic.Int64
+	requestsByCode map[int]int64
+	requests       map[requestSeries]int64
+	latencies      map[latencySeries]*histogram
 	mu             sync.RWMutex
 }
 
+// requestSeries labels gateway_requests_total
+type requestSeries struct {
+	route, method, class string
+}
+
+// latencySeries labels gateway_request_duration_seconds
+type latencySeries struct {
+	route, method string
+}
+
+// latencyBuckets are the histogram's upper bounds in seconds, matching the
+// Prometheus client defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
 // NewAPIGateway creates a new API gateway
 func NewAPIGateway() *APIGateway {
-	return &APIGateway{
+	ag := &APIGateway{
 		routes:          make(map[string]*Route),
+		router:          newRouter(),
 		rateLimiters:    make(map[string]*RateLimiter),
+		rateLimitStore:  NewMemoryRateLimitStore(),
+		idempotency:     NewMemoryIdempotencyStore(),
 		authenticator:   NewAuthenticator(),
 		cache:           NewResponseCache(),
 		circuitBreakers: make(map[string]*CircuitBreaker),
 		loadBalancers:   make(map[string]*LoadBalancer),
 		healthChecker:   NewHealthChecker(5 * time.Second),
 		metrics:         NewMetrics(),
+		canaryShifts:    make(map[string]context.CancelFunc),
 	}
+	ag.healthChecker.Start()
+	return ag
 }
 
 // RegisterRoute registers a new route
 func (ag *APIGateway) RegisterRoute(pattern string, route *Route) error {
+	if err := validateRoute(pattern, route); err != nil {
+		return err
+	}
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	if err := ag.router.Insert(pattern, route); err != nil {
+		return err
+	}
+	ag.addRoute(pattern, route, ag.routes, ag.rateLimiters, ag.circuitBreakers, ag.loadBalancers)
+	return nil
+}
+
+func validateRoute(pattern string, route *Route) error {
 	if pattern == "" {
 		return errors.New("pattern cannot be empty")
 	}
@@ -159,28 +542,299 @@ func (ag *APIGateway) RegisterRoute(pattern string, route *Route) error {
 	if len(route.Backends) == 0 {
 		return errors.New("at least one backend must be specified")
 	}
+	if route.LoadBalancing != "" && !loadBalancingStrategies[route.LoadBalancing] {
+		return fmt.Errorf("unknown load balancing strategy %q", route.LoadBalancing)
+	}
+	if route.Canary != nil {
+		if len(route.Canary.Backends) == 0 {
+			return errors.New("canary needs at least one backend")
+		}
+		if err := validCanaryPercent(route.Canary.Percent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	ag.mu.Lock()
-	defer ag.mu.Unlock()
+func validCanaryPercent(percent float64) error {
+	if percent < 0 || percent > 100 || math.IsNaN(percent) {
+		return fmt.Errorf("canary percent %v is outside 0-100", percent)
+	}
+	return nil
+}
 
-	ag.routes[pattern] = route
+// addRoute wires a route's per-route components into the given tables
+func (ag *APIGateway) addRoute(pattern string, route *Route, routes map[string]*Route, rateLimiters map[string]*RateLimiter, circuitBreakers map[string]*CircuitBreaker, loadBalancers map[string]*LoadBalancer) {
+	routes[pattern] = route
 
-	// Initialize rate limiter
-	ag.rateLimiters[pattern] = NewRateLimiter(route.RateLimitPerMin)
+	// Initialize rate limiter. A route whose limits didn't change keeps its
+	// limiter, so a config reload doesn't hand every client a fresh window.
+	if rl := ag.rateLimiters[pattern]; rl != nil && rl.sameLimits(route, ag.rateLimitStore) {
+		rateLimiters[pattern] = rl
+	} else {
+		rateLimiters[pattern] = NewRateLimiterWithStore(route.RateLimitPerMin, route.RouteRateLimitPerMin, ag.rateLimitStore, pattern+"|")
+	}
 
-	// Initialize circuit breaker
-	cb := NewCircuitBreaker(5, 2, 10*time.Second)
-	ag.circuitBreakers[pattern] = cb
-	route.CircuitBreaker = cb
+	// Attach each backend's circuit breaker
+	for _, backend := range route.allBackends() {
+		backend.breaker.Store(ag.breakerFor(backend, circuitBreakers))
+	}
 
 	// Initialize load balancer
-	lb := NewLoadBalancer(route.Backends, "round-robin")
-	ag.loadBalancers[pattern] = lb
+	strategy := route.LoadBalancing
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	lb := NewLoadBalancer(route.Backends, strategy)
+	lb.health = ag.healthChecker
+	loadBalancers[pattern] = lb
 	route.LoadBalancer = lb
+	if route.Canary != nil {
+		route.Canary.LoadBalancer = NewLoadBalancer(route.Canary.Backends, strategy)
+		route.Canary.LoadBalancer.health = ag.healthChecker
+	}
 
 	// Register health check
-	ag.healthChecker.Register(route.Backends)
+	ag.healthChecker.Register(route.allBackends())
+}
+
+// breakerFor returns the breaker for backend's URL in breakers. A breaker
+// the gateway already has for the URL carries over, so a config reload
+// doesn't forget that a backend is failing.
+func (ag *APIGateway) breakerFor(backend *Backend, breakers map[string]*CircuitBreaker) *CircuitBreaker {
+	key := backend.URL.String()
+	cb := breakers[key]
+	if cb == nil {
+		cb = ag.circuitBreakers[key]
+	}
+	if cb == nil {
+		cb = NewCircuitBreaker(key, ag.circuitConfig)
+	}
+	breakers[key] = cb
+	return cb
+}
+
+// SetCircuitBreakerConfig replaces every backend's circuit breaker with a
+// fresh, closed one using cfg
+func (ag *APIGateway) SetCircuitBreakerConfig(cfg CircuitBreakerConfig) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	ag.circuitConfig = cfg
+	ag.circuitBreakers = make(map[string]*CircuitBreaker)
+	for _, route := range ag.routes {
+		for _, backend := range route.allBackends() {
+			backend.breaker.Store(ag.breakerFor(backend, ag.circuitBreakers))
+		}
+	}
+}
+
+// CircuitBreaker returns the breaker guarding the backend at backendURL
+func (ag *APIGateway) CircuitBreaker(backendURL string) *CircuitBreaker {
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+	return ag.circuitBreakers[backendURL]
+}
+
+// SetIdempotencyStore sets where Idempotency-Key responses are kept
+func (ag *APIGateway) SetIdempotencyStore(store IdempotencyStore) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.idempotency = store
+}
 
+// SetRateLimitStore sets where routes registered from now on keep their
+// rate limit counters
+func (ag *APIGateway) SetRateLimitStore(store RateLimitStore) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.rateLimitStore = store
+}
+
+// ReplaceRoutes swaps the whole routing table in one step. Requests
+// already in flight finish against the routes they matched.
+func (ag *APIGateway) ReplaceRoutes(routes map[string]*Route) error {
+	rt := newRouter()
+	for pattern, route := range routes {
+		if err := validateRoute(pattern, route); err != nil {
+			return fmt.Errorf("route %q: %w", pattern, err)
+		}
+		if err := rt.Insert(pattern, route); err != nil {
+			return err
+		}
+	}
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	newRoutes := make(map[string]*Route, len(routes))
+	rateLimiters := make(map[string]*RateLimiter, len(routes))
+	circuitBreakers := make(map[string]*CircuitBreaker, len(routes))
+	loadBalancers := make(map[string]*LoadBalancer, len(routes))
+	for pattern, route := range routes {
+		ag.addRoute(pattern, route, newRoutes, rateLimiters, circuitBreakers, loadBalancers)
+	}
+	ag.router = rt
+	ag.routes = newRoutes
+	ag.rateLimiters = rateLimiters
+	ag.circuitBreakers = circuitBreakers
+	ag.loadBalancers = loadBalancers
+
+	// Stop probing backends no route uses any more
+	ag.healthChecker.Prune(routeBackends(routes))
+	return nil
+}
+
+// routeBackends lists the backends of every route
+func routeBackends(routes map[string]*Route) []*Backend {
+	var backends []*Backend
+	for _, route := range routes {
+		backends = append(backends, route.allBackends()...)
+	}
+	return backends
+}
+
+// Errors from changing a single route at runtime
+var (
+	ErrRouteNotFound   = errors.New("route not found")
+	ErrBackendNotFound = errors.New("backend not found")
+	ErrBackendExists   = errors.New("backend already exists")
+	ErrLastBackend     = errors.New("cannot remove a route's last backend")
+)
+
+// AddBackend adds a backend to the route registered under pattern
+func (ag *APIGateway) AddBackend(pattern string, backend *Backend) error {
+	return ag.updateRoute(pattern, func(route *Route) error {
+		for _, existing := range route.Backends {
+			if existing.URL.String() == backend.URL.String() {
+				return fmt.Errorf("%w: %s", ErrBackendExists, backend.URL)
+			}
+		}
+		route.Backends = append(route.Backends, backend)
+		return nil
+	})
+}
+
+// RemoveBackend takes the backend at backendURL out of the route
+// registered under pattern. A route keeps at least one backend.
+func (ag *APIGateway) RemoveBackend(pattern, backendURL string) error {
+	return ag.updateRoute(pattern, func(route *Route) error {
+		for i, existing := range route.Backends {
+			if existing.URL.String() == backendURL {
+				if len(route.Backends) == 1 {
+					return ErrLastBackend
+				}
+				route.Backends = append(route.Backends[:i], route.Backends[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrBackendNotFound, backendURL)
+	})
+}
+
+// ErrNoCanary is returned when changing the split of a route without one
+var ErrNoCanary = errors.New("route has no canary")
+
+// SetCanaryPercent changes the share of clients sent to the route's
+// canary pool
+func (ag *APIGateway) SetCanaryPercent(pattern string, percent float64) error {
+	if err := validCanaryPercent(percent); err != nil {
+		return err
+	}
+	return ag.updateRoute(pattern, func(route *Route) error {
+		if route.Canary == nil {
+			return fmt.Errorf("%w: %s", ErrNoCanary, pattern)
+		}
+		route.Canary.Percent = percent
+		return nil
+	})
+}
+
+// CanaryPercent returns the route's current canary share
+func (ag *APIGateway) CanaryPercent(pattern string) (float64, error) {
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+
+	route := ag.routes[pattern]
+	switch {
+	case route == nil:
+		return 0, fmt.Errorf("%w: %s", ErrRouteNotFound, pattern)
+	case route.Canary == nil:
+		return 0, fmt.Errorf("%w: %s", ErrNoCanary, pattern)
+	}
+	return route.Canary.Percent, nil
+}
+
+// ShiftCanary moves the route's canary share toward target by step every
+// interval. It returns once the share reaches target, or early with
+// ctx's error; a deployment coordinator can cancel ctx to stop a rollout
+// and call SetCanaryPercent(pattern, 0) to roll it back.
+func (ag *APIGateway) ShiftCanary(ctx context.Context, pattern string, target, step float64, interval time.Duration) error {
+	if err := validCanaryPercent(target); err != nil {
+		return err
+	}
+	if step <= 0 || interval <= 0 {
+		return errors.New("canary step and interval must be positive")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		current, err := ag.CanaryPercent(pattern)
+		if err != nil {
+			return err
+		}
+		if current == target {
+			return nil
+		}
+		next := min(current+step, target)
+		if current > target {
+			next = max(current-step, target)
+		}
+		if err := ag.SetCanaryPercent(pattern, next); err != nil {
+			return err
+		}
+		if next == target {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateRoute applies update to a copy of the route at pattern and swaps
+// the copy in. Requests in flight keep the route they matched, and the
+// other routes are left untouched.
+func (ag *APIGateway) updateRoute(pattern string, update func(*Route) error) error {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	current := ag.routes[pattern]
+	if current == nil {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, pattern)
+	}
+	route := *current
+	route.Backends = append([]*Backend(nil), current.Backends...)
+	if current.Canary != nil {
+		canary := *current.Canary
+		canary.Backends = append([]*Backend(nil), current.Canary.Backends...)
+		route.Canary = &canary
+	}
+	if err := update(&route); err != nil {
+		return err
+	}
+	if err := validateRoute(pattern, &route); err != nil {
+		return err
+	}
+	if err := ag.router.Insert(pattern, &route); err != nil {
+		return err
+	}
+	ag.addRoute(pattern, &route, ag.routes, ag.rateLimiters, ag.circuitBreakers, ag.loadBalancers)
+	ag.healthChecker.Prune(routeBackends(ag.routes))
 	return nil
 }
 
@@ -193,62 +847,207 @@ func (ag *APIGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ag.metrics.activeRequests.Add(1)
 	defer ag.metrics.activeRequests.Add(-1)
 
+	rec := AccessRecord{
+		Time:      start,
+		RequestID: requestID,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Client:    r.RemoteAddr,
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer func() {
+		if rec.Status == 0 {
+			rec.Status = sw.status
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		latency := time.Since(start)
+		ag.metrics.observe(rec.Route, rec.Method, rec.Status, latency)
+
+		if logger := ag.AccessLog(); logger != nil {
+			if cache := sw.Header().Get("X-Cache"); cache != "" {
+				rec.Cache = cache
+			}
+			rec.Bytes = sw.bytes
+			rec.Latency = Duration(latency)
+			logger.Log(rec)
+		}
+	}()
+
 	// Find matching route
-	route := ag.findRoute(r)
-	if route == nil {
+	match := ag.findRoute(r)
+	if match == nil {
 		ag.metrics.recordError()
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "route not found"})
 		return
 	}
+	route := match.route
+	rec.Route = match.pattern
+	r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, match.params))
+
+	// Check the client certificate. Its details only ever come from the
+	// TLS handshake.
+	forwardClientCert(r)
+	if route.RequireClientCert && !hasClientCert(r) {
+		ag.metrics.recordError()
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "client certificate required"})
+		return
+	}
 
-	// Check authentication
-	if route.RequireAuth {
-		if !ag.authenticator.ValidateRequest(r) {
+	// Check authentication. Claim headers only ever come from a verified token.
+	ag.authenticator.stripClaimHeaders(r)
+	if route.requiresAuth(r.Method) {
+		claims, err := ag.authenticator.Authenticate(r)
+		if err != nil {
 			ag.metrics.recordError()
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
 			return
 		}
+		ag.authenticator.ForwardClaims(r, claims)
 	}
 
-	// Check rate limit
+	// Check rate limit. A broken limit store fails open.
 	clientID := ag.getClientID(r)
-	rl := ag.rateLimiters[findRouteKey(ag.routes, route)]
-	if !rl.AllowRequest(clientID) {
+	decision, err := match.rateLimiter.Allow(r.Context(), clientID)
+	if err != nil {
+		log.Printf("rate limit: %v", err)
+		rec.RateLimit = "error"
+	} else if decision.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(decision.Remaining, 0)))
+		rec.RateLimit = "allowed"
+	}
+	if err == nil && !decision.Allowed {
+		rec.RateLimit = "rejected:" + decision.Scope
 		ag.metrics.recordError()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
 		w.WriteHeader(http.StatusTooManyRequests)
-		json.NewEncoder(w).Encode(map[string]string{"error": "rate limit exceeded"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "rate limit exceeded", "scope": decision.Scope})
 		return
 	}
 
-	// Check cache
-	cacheKey := ag.generateCacheKey(r)
-	if cached := ag.cache.Get(cacheKey); cached != nil {
-		w.Header().Set("X-Cache", "HIT")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(cached)
-		ag.metrics.recordSuccess(time.Since(start), http.StatusOK)
-		return
+	// Check body size. Chunked bodies are cut off once they pass the limit.
+	if route.MaxBodyBytes > 0 && r.Body != nil {
+		if r.ContentLength > route.MaxBodyBytes {
+			ag.metrics.recordError()
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, route.MaxBodyBytes)
 	}
 
-	// Select backend
-	backend := route.LoadBalancer.SelectBackend()
-	if backend == nil {
+	// Validate the request
+	if route.Validator != nil {
+		if err := route.Validator.Validate(r); err != nil {
+			ag.metrics.recordError()
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	// Long-lived connections need the route to opt in
+	wsRequest := isWebSocketRequest(r)
+	sseRequest := acceptsEventStream(r)
+	if wsRequest && !route.WebSocket {
 		ag.metrics.recordError()
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]string{"error": "no available backends"})
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "websocket not enabled for route"})
+		return
+	}
+	if sseRequest && !route.EventStream {
+		ag.metrics.recordError()
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "event streams not enabled for route"})
 		return
 	}
+	streaming := route.Stream || wsRequest || sseRequest
+
+	// Replay the response to a repeated Idempotency-Key, or claim the key.
+	// A claim that never gets a response is released on the way out.
+	var idem *idempotentRequest
+	if key := r.Header.Get(idempotencyHeader); key != "" && route.IdempotencyTTL > 0 && !streaming && idempotencyMethods[r.Method] {
+		var handled bool
+		if idem, handled = ag.beginIdempotent(w, r, route, match.pattern, key); handled {
+			return
+		}
+		defer idem.release()
+	}
+
+	// Check cache
+	baseKey := ag.generateCacheKey(r)
+	cacheKey := ag.cache.VariantKey(baseKey, r)
+	cacheable := !streaming && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+	var revalidating *CacheEntry
+	if cacheable {
+		entry, state := ag.cache.Lookup(cacheKey)
+		switch state {
+		case cacheFresh, cacheStale:
+			if state == cacheStale && ag.cache.beginRevalidate(cacheKey) {
+				go ag.revalidate(route, r.Clone(context.WithoutCancel(r.Context())), cacheKey, entry, requestID)
+			}
+			status := serveCached(w, r, entry, state)
+			ag.metrics.recordSuccess(time.Since(start), status)
+			return
+		case cacheExpired:
+			// Ask the backend whether our copy is still good
+			if entry.etag != "" && r.Header.Get("If-None-Match") == "" {
+				r.Header.Set("If-None-Match", entry.etag)
+				revalidating = entry
+			}
+		}
+		if route.CacheTTL > 0 {
+			rec.Cache = "MISS"
+		}
+	}
+
+	// Start the timeout budget, counted from when the request arrived
+	var stopBudget func() bool
+	if budget := timeoutBudget(route, r); budget > 0 {
+		deadline := start.Add(budget)
+		if !time.Now().Before(deadline) {
+			ag.metrics.recordError()
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(map[string]string{"error": errTimeoutBudget.Error()})
+			return
+		}
+		if streaming {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			timer := time.AfterFunc(time.Until(deadline), func() { cancel(errTimeoutBudget) })
+			defer cancel(nil)
+			stopBudget = timer.Stop
+			r = r.WithContext(context.WithValue(ctx, budgetDeadlineKey{}, deadline))
+		} else {
+			ctx, cancel := context.WithDeadlineCause(r.Context(), deadline, errTimeoutBudget)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+	}
 
-	// Check circuit breaker
-	if !route.CircuitBreaker.AllowRequest() {
+	// Select backend. Canary clients fall back to the stable pool when
+	// none of the canary backends is available.
+	var backend *Backend
+	if route.Canary != nil && route.Canary.takes(ag.clientKey(r)) {
+		backend = route.Canary.LoadBalancer.SelectBackendForKey(ag.balancingKey(route, r))
+	}
+	if backend == nil {
+		backend = route.LoadBalancer.SelectBackendForKey(ag.balancingKey(route, r))
+	}
+	if backend == nil {
 		ag.metrics.recordError()
 		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]string{"error": "circuit breaker open"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "no available backends"})
 		return
 	}
+	rec.Backend = backend.URL.String()
 
 	// Transform request
 	if route.Transform != nil {
@@ -260,55 +1059,498 @@ func (ag *APIGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Proxy request
-	proxy := httputil.NewSingleHostReverseProxy(backend.URL)
-	proxy.Director = func(req *http.Request) {
+	// Check circuit breaker. From here on the result is always recorded,
+	// which a half-open breaker's probe relies on.
+	if !backend.breaker.Load().AllowRequest() {
+		ag.metrics.recordError()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "circuit breaker open"})
+		return
+	}
+
+	if wsRequest {
+		status := ag.tunnelWebSocket(w, r, backend, requestID, stopBudget)
+		ag.recordBackendResult(backend, status, time.Since(start))
+		rec.Status = status
+		return
+	}
+
+	// Proxy request
+	proxy := newBackendProxy(backend, r.RemoteAddr, requestID)
+	modify := responseModifier(route, revalidating)
+	if stopBudget != nil {
+		// Headers are in: a stream may run as long as it likes
+		inner := modify
+		modify = func(resp *http.Response) error {
+			stopBudget()
+			return inner(resp)
+		}
+	}
+	proxy.ModifyResponse = modify
+
+	// Create response writer wrapper. Only capture what could be cached.
+	responseWriter := &responseWriterWrapper{ResponseWriter: w}
+	switch {
+	case streaming:
+		proxy.FlushInterval = -1
+		responseWriter.discard = true
+	case route.CacheTTL <= 0 && idem == nil:
+		responseWriter.discard = true
+	case route.MaxCacheBodyBytes > 0:
+		responseWriter.limit = route.MaxCacheBodyBytes
+	default:
+		responseWriter.limit = defaultMaxCacheBodyBytes
+	}
+	recorded := false
+	if route.Retry != nil && !streaming && isIdempotent(r.Method) {
+		var resp *bufferedResponse
+		resp, backend, recorded = ag.proxyWithRetry(r, route, backend, requestID, modify)
+		rec.Backend = backend.URL.String()
+		resp.writeTo(responseWriter)
+	} else {
+		proxy.ServeHTTP(responseWriter, r)
+	}
+
+	if responseWriter.statusCode == 0 {
+		responseWriter.statusCode = http.StatusOK
+	}
+	if recorded {
+		ag.recordGatewayResult(responseWriter.statusCode, time.Since(start))
+	} else {
+		ag.recordBackendResult(backend, responseWriter.statusCode, time.Since(start))
+	}
+
+	if idem != nil {
+		idem.complete(responseWriter)
+	}
+
+	// Cache successful response
+	if cacheable && route.CacheTTL > 0 && responseWriter.statusCode == http.StatusOK && responseWriter.cacheable() {
+		ag.cache.StoreResponse(baseKey, r, responseWriter.body, responseWriter.header, route.CacheTTL, route.StaleWhileRevalidate)
+	}
+}
+
+// serveCached writes a cached response, answering the client's own
+// If-None-Match with a 304. It returns the status written.
+func serveCached(w http.ResponseWriter, r *http.Request, entry *CacheEntry, state cacheState) int {
+	for key, values := range entry.Header {
+		w.Header()[key] = values
+	}
+	if entry.Header == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if state == cacheStale {
+		w.Header().Set("X-Cache", "STALE")
+	} else {
+		w.Header().Set("X-Cache", "HIT")
+	}
+
+	if entry.etag != "" && etagMatches(r.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return http.StatusNotModified
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Data)
+	}
+	return http.StatusOK
+}
+
+// responseModifier runs the route's response transformers on backend
+// responses. A 304 to the gateway's own conditional request is replaced by
+// the cached entry, which was transformed when it was stored.
+func responseModifier(route *Route, revalidating *CacheEntry) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if revalidating != nil && resp.StatusCode == http.StatusNotModified {
+			revalidatedResponse(resp, revalidating)
+			return nil
+		}
+		if route.ResponseHandler != nil {
+			return route.ResponseHandler.Transform(resp)
+		}
+		return nil
+	}
+}
+
+// revalidatedResponse turns the backend's 304 to our conditional request
+// into the cached 200 the client asked for
+func revalidatedResponse(resp *http.Response, entry *CacheEntry) {
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	for key, values := range entry.Header {
+		if _, set := resp.Header[key]; !set {
+			resp.Header[key] = values
+		}
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(entry.Data)))
+	resp.Header.Set("X-Cache", "REVALIDATED")
+	resp.ContentLength = int64(len(entry.Data))
+	resp.Body = io.NopCloser(bytes.NewReader(entry.Data))
+}
+
+// revalidate refreshes a stale entry in the background
+func (ag *APIGateway) revalidate(route *Route, r *http.Request, key string, entry *CacheEntry, requestID int64) {
+	defer ag.cache.endRevalidate(key)
+
+	backend := route.LoadBalancer.SelectBackend()
+	if backend == nil {
+		return
+	}
+	if entry.etag != "" {
+		r.Header.Set("If-None-Match", entry.etag)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	resp := ag.proxyAttempt(ctx, r, nil, backend, requestID, responseModifier(route, nil))
+
+	switch resp.status {
+	case http.StatusNotModified:
+		ag.cache.Refresh(key, route.CacheTTL, route.StaleWhileRevalidate)
+	case http.StatusOK:
+		r.Header.Del("If-None-Match")
+		ag.cache.StoreResponse(ag.generateCacheKey(r), r, resp.body.Bytes(), resp.header, route.CacheTTL, route.StaleWhileRevalidate)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newBackendProxy builds a reverse proxy that forwards to backend
+func newBackendProxy(backend *Backend, clientAddr string, requestID int64) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(backend.URL)
+	proxy.Director = func(req *http.Request) {
 		req.URL.Scheme = backend.URL.Scheme
 		req.URL.Host = backend.URL.Host
 		req.Host = backend.URL.Host
 		req.RequestURI = ""
-		req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+		req.Header.Set("X-Forwarded-For", clientAddr)
 		req.Header.Set("X-Request-ID", fmt.Sprintf("%d", requestID))
+		setTimeoutRemaining(req)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		status := proxyErrorStatus(req, err)
+		if status == http.StatusBadGateway {
+			log.Printf("proxy error: %v", err)
+		}
+		w.WriteHeader(status)
 	}
+	return proxy
+}
 
-	// Create response writer wrapper
-	responseWriter := &responseWriterWrapper{ResponseWriter: w}
-	proxy.ServeHTTP(responseWriter, r)
+// proxyErrorStatus maps a failed proxy round trip to the status the
+// client sees: 413 for an oversized body, 504 once the budget is spent
+// and 502 for everything else
+func proxyErrorStatus(req *http.Request, err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(context.Cause(req.Context()), errTimeoutBudget):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
 
-	// Record metrics
-	latency := time.Since(start)
-	if responseWriter.statusCode == 0 {
-		responseWriter.statusCode = http.StatusOK
+// timeoutBudget returns how long the backend exchange for r may take:
+// the route's Timeout, lowered by a smaller X-Timeout-Remaining from an
+// upstream caller. Zero means no budget.
+func timeoutBudget(route *Route, r *http.Request) time.Duration {
+	budget := route.Timeout
+	if ms, err := strconv.ParseInt(r.Header.Get(timeoutHeader), 10, 64); err == nil && ms >= 0 {
+		if upstream := time.Duration(ms) * time.Millisecond; budget <= 0 || upstream < budget {
+			budget = upstream
+		}
+		if budget == 0 {
+			// Upstream has already run out
+			budget = time.Nanosecond
+		}
 	}
+	return budget
+}
 
-	if responseWriter.statusCode >= 400 {
-		ag.metrics.recordError()
-		route.CircuitBreaker.RecordFailure()
+// budgetDeadline returns when the request's timeout budget runs out
+func budgetDeadline(ctx context.Context) (time.Time, bool) {
+	if deadline, ok := ctx.Value(budgetDeadlineKey{}).(time.Time); ok {
+		return deadline, true
+	}
+	return ctx.Deadline()
+}
+
+// setTimeoutRemaining tells the backend how much of the budget is left,
+// or drops the header when the request has no budget
+func setTimeoutRemaining(req *http.Request) {
+	deadline, ok := budgetDeadline(req.Context())
+	if !ok {
+		req.Header.Del(timeoutHeader)
+		return
+	}
+	remaining := max(time.Until(deadline).Milliseconds(), 0)
+	req.Header.Set(timeoutHeader, strconv.FormatInt(remaining, 10))
+}
+
+type retryAttempt struct {
+	resp    *bufferedResponse
+	backend *Backend
+}
+
+// proxyWithRetry sends r to first and, while the answers are retryable,
+// to other backends picked by the route's load balancer. With hedging,
+// attempts overlap and the first non-retryable answer wins; the rest are
+// cancelled. recorded reports that the result must not be recorded
+// against the returned backend again: either the retry loop already
+// counted it as a failure, or the gateway produced it itself.
+func (ag *APIGateway) proxyWithRetry(r *http.Request, route *Route, first *Backend, requestID int64, modify func(*http.Response) error) (resp *bufferedResponse, backend *Backend, recorded bool) {
+	policy := route.Retry
+	maxAttempts := policy.maxAttempts()
+
+	// Every attempt needs its own copy of the body
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return newGatewayErrorResponse(http.StatusRequestEntityTooLarge, "request body too large"), first, true
+			}
+			return newGatewayErrorResponse(http.StatusBadRequest, "failed to read request body"), first, true
+		}
+		r.Body.Close()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	results := make(chan retryAttempt, maxAttempts)
+	tried := make(map[*Backend]bool)
+	launched, inflight := 0, 0
+	launch := func(backend *Backend) {
+		tried[backend] = true
+		launched++
+		inflight++
+		go func() {
+			results <- retryAttempt{ag.proxyAttempt(ctx, r, body, backend, requestID, modify), backend}
+		}()
+	}
+
+	launch(first)
+	var next <-chan time.Time
+	if policy.HedgeAfter > 0 && launched < maxAttempts {
+		next = time.After(policy.HedgeAfter)
+	}
+
+	var last retryAttempt
+	for inflight > 0 || next != nil {
+		select {
+		case res := <-results:
+			inflight--
+			if !policy.retryable(res.resp.status) {
+				return res.resp, res.backend, false
+			}
+			res.backend.Errors.Add(1)
+			ag.healthChecker.ReportResult(res.backend, res.resp.status)
+			if res.resp.status >= 500 {
+				res.backend.breaker.Load().RecordFailure()
+			}
+			last = res
+			if next == nil && launched < maxAttempts {
+				next = time.After(policy.backoff(launched))
+			}
+		case <-next:
+			next = nil
+			if launched < maxAttempts {
+				if backend := route.LoadBalancer.SelectBackendExcluding(tried); backend != nil && backend.breaker.Load().AllowRequest() {
+					launch(backend)
+				}
+			}
+			if policy.HedgeAfter > 0 && launched < maxAttempts {
+				next = time.After(policy.HedgeAfter)
+			}
+		case <-ctx.Done():
+			// The gateway gave up, not a backend: nothing to charge
+			if errors.Is(context.Cause(ctx), errTimeoutBudget) {
+				return newGatewayErrorResponse(http.StatusGatewayTimeout, errTimeoutBudget.Error()), first, true
+			}
+			return newGatewayErrorResponse(http.StatusBadGateway, "request cancelled"), first, true
+		}
+	}
+	return last.resp, last.backend, true
+}
+
+// proxyAttempt runs one buffered request against backend
+func (ag *APIGateway) proxyAttempt(ctx context.Context, r *http.Request, body []byte, backend *Backend, requestID int64, modify func(*http.Response) error) *bufferedResponse {
+	out := r.Clone(ctx)
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	proxy := newBackendProxy(backend, r.RemoteAddr, requestID)
+	proxy.ModifyResponse = modify
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(proxyErrorStatus(req, err))
+	}
+
+	resp := newBufferedResponse()
+	proxy.ServeHTTP(resp, out)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp
+}
+
+// recordBackendResult feeds a proxied response into metrics, health
+// checking and the backend's circuit breaker. Only 5xx answers count
+// against the breaker; a 4xx is the client's fault.
+func (ag *APIGateway) recordBackendResult(backend *Backend, status int, latency time.Duration) {
+	ag.healthChecker.ReportResult(backend, status)
+	if status >= 500 {
+		backend.breaker.Load().RecordFailure()
+	} else {
+		backend.breaker.Load().RecordSuccess()
+	}
+	if status >= 400 {
 		backend.Errors.Add(1)
 	} else {
-		route.CircuitBreaker.RecordSuccess()
 		backend.TotalRequests.Add(1)
 	}
 
-	ag.metrics.recordSuccess(latency, responseWriter.statusCode)
+	ag.recordGatewayResult(status, latency)
+}
 
-	// Cache successful response
-	if route.CacheTTL > 0 && responseWriter.statusCode == http.StatusOK {
-		ag.cache.Set(cacheKey, responseWriter.body, route.CacheTTL)
+// recordGatewayResult feeds a response into the gateway-wide metrics only,
+// for results a backend has already been charged for or isn't to blame for
+func (ag *APIGateway) recordGatewayResult(status int, latency time.Duration) {
+	if status >= 400 {
+		ag.metrics.recordError()
+	}
+	ag.metrics.recordSuccess(latency, status)
+}
+
+// tunnelWebSocket forwards an upgrade request to backend and, once the
+// backend switches protocols, splices the two connections together. It
+// returns the backend's status code. A timeout budget covers the dial
+// and the handshake; stopBudget, if set, is called once it succeeds.
+func (ag *APIGateway) tunnelWebSocket(w http.ResponseWriter, r *http.Request, backend *Backend, requestID int64, stopBudget func() bool) int {
+	timeout := backend.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	handshakeDeadline := time.Now().Add(timeout)
+	if deadline, ok := budgetDeadline(r.Context()); ok && deadline.Before(handshakeDeadline) {
+		handshakeDeadline = deadline
+	}
+
+	dialer := &net.Dialer{Deadline: handshakeDeadline}
+	var backendConn net.Conn
+	var err error
+	if backend.URL.Scheme == "https" || backend.URL.Scheme == "wss" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: backend.URL.Hostname()}}
+		backendConn, err = tlsDialer.DialContext(r.Context(), "tcp", hostPort(backend.URL))
+	} else {
+		backendConn, err = dialer.DialContext(r.Context(), "tcp", hostPort(backend.URL))
+	}
+	if err != nil {
+		return writeHandshakeError(w, r, "backend unavailable")
+	}
+	defer backendConn.Close()
+
+	out := r.Clone(r.Context())
+	out.URL.Scheme = backend.URL.Scheme
+	out.URL.Host = backend.URL.Host
+	out.Host = backend.URL.Host
+	out.RequestURI = ""
+	out.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	out.Header.Set("X-Request-ID", fmt.Sprintf("%d", requestID))
+	setTimeoutRemaining(out)
+
+	backendConn.SetDeadline(handshakeDeadline)
+	if err := out.Write(backendConn); err != nil {
+		return writeHandshakeError(w, r, "backend unavailable")
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, out)
+	if err != nil {
+		return writeHandshakeError(w, r, "invalid backend response")
+	}
+	backendConn.SetDeadline(time.Time{})
+	if stopBudget != nil {
+		stopBudget()
 	}
+
+	// The backend refused the upgrade: relay its answer as-is
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return resp.StatusCode
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "connection cannot be upgraded"})
+		return http.StatusInternalServerError
+	}
+	defer clientConn.Close()
+
+	fmt.Fprintf(clientConn, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientConn)
+	io.WriteString(clientConn, "\r\n")
+
+	// Copy both directions until either side hangs up. Buffered readers
+	// may already hold frames read past the handshake.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backendConn, clientBuf.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, backendReader)
+		done <- struct{}{}
+	}()
+	<-done
+	return http.StatusSwitchingProtocols
+}
+
+// writeHandshakeError answers a failed WebSocket handshake: 504 once the
+// timeout budget has run out, 502 otherwise
+func writeHandshakeError(w http.ResponseWriter, r *http.Request, message string) int {
+	status := http.StatusBadGateway
+	if deadline, ok := budgetDeadline(r.Context()); ok && !time.Now().Before(deadline) {
+		status, message = http.StatusGatewayTimeout, errTimeoutBudget.Error()
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	return status
 }
 
 // findRoute finds a matching route for the request
-func (ag *APIGateway) findRoute(r *http.Request) *Route {
+func (ag *APIGateway) findRoute(r *http.Request) *routeMatch {
 	ag.mu.RLock()
 	defer ag.mu.RUnlock()
 
-	for pattern, route := range ag.routes {
-		if matchPath(pattern, r.URL.Path) && methodAllowed(route.Methods, r.Method) {
-			return route
-		}
+	match := ag.router.Lookup(r.Method, r.URL.Path)
+	if match != nil {
+		match.rateLimiter = ag.rateLimiters[match.pattern]
 	}
-	return nil
+	return match
 }
 
 // getClientID extracts client ID from request
@@ -316,389 +1558,3986 @@ func (ag *APIGateway) getClientID(r *http.Request) string {
 	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
 		return apiKey
 	}
-	return r.RemoteAddr
+	return r.RemoteAddr
+}
+
+// balancingKey is the consistent-hash key for a request: the route's hash
+// header when present, else the client ID without the port
+func (ag *APIGateway) balancingKey(route *Route, r *http.Request) string {
+	if route.LoadBalancing != ConsistentHash {
+		return ""
+	}
+	if route.HashHeader != "" {
+		if value := r.Header.Get(route.HashHeader); value != "" {
+			return value
+		}
+	}
+	return ag.clientKey(r)
+}
+
+// clientKey is the client ID without the port of a client address, so
+// that one client's connections share it
+func (ag *APIGateway) clientKey(r *http.Request) string {
+	id := ag.getClientID(r)
+	if host, _, err := net.SplitHostPort(id); err == nil {
+		return host
+	}
+	return id
+}
+
+// generateCacheKey generates a cache key for the request
+func (ag *APIGateway) generateCacheKey(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + ":" + r.URL.String()))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Access logging
+
+// AccessRecord is the access log entry written for every request
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID int64     `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route,omitempty"`
+	Backend   string    `json:"backend,omitempty"` // the one that answered, after retries
+	Client    string    `json:"client"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Latency   Duration  `json:"latency"`
+	Cache     string    `json:"cache,omitempty"`      // HIT, STALE, REVALIDATED or MISS on cached routes
+	RateLimit string    `json:"rate_limit,omitempty"` // allowed, rejected:<scope> or error on limited routes
+}
+
+// AccessLogSink receives access records; Write runs on the request path
+type AccessLogSink interface {
+	Write(rec AccessRecord) error
+}
+
+// AccessLogger samples requests into a sink
+type AccessLogger struct {
+	sink            AccessLogSink
+	sampleRate      float64
+	alwaysLogErrors bool
+	failures        atomic.Int64
+}
+
+// NewAccessLogger logs sampleRate (0 to 1) of requests to sink. With
+// alwaysLogErrors, responses of 400 and above bypass sampling.
+func NewAccessLogger(sink AccessLogSink, sampleRate float64, alwaysLogErrors bool) *AccessLogger {
+	return &AccessLogger{
+		sink:            sink,
+		sampleRate:      sampleRate,
+		alwaysLogErrors: alwaysLogErrors,
+	}
+}
+
+// Log writes rec to the sink unless sampled out
+func (l *AccessLogger) Log(rec AccessRecord) {
+	if !(l.alwaysLogErrors && rec.Status >= 400) && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+	if err := l.sink.Write(rec); err != nil {
+		// Don't flood the error log when the sink is down
+		if l.failures.Add(1) == 1 {
+			log.Printf("access log: %v", err)
+		}
+	}
+}
+
+// Failures returns how many records the sink failed to take
+func (l *AccessLogger) Failures() int64 {
+	return l.failures.Load()
+}
+
+// Close closes the sink if it holds resources
+func (l *AccessLogger) Close() error {
+	if c, ok := l.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// SetAccessLog starts logging every request to logger; nil turns access
+// logging off. The previous logger is closed.
+func (ag *APIGateway) SetAccessLog(logger *AccessLogger) {
+	ag.mu.Lock()
+	prev := ag.accessLog
+	ag.accessLog = logger
+	ag.accessLogConfig = AccessLogConfig{}
+	ag.mu.Unlock()
+
+	if prev != nil && prev != logger {
+		prev.Close()
+	}
+}
+
+// AccessLog returns the current access logger, or nil
+func (ag *APIGateway) AccessLog() *AccessLogger {
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+	return ag.accessLog
+}
+
+// JSONSink writes one JSON object per line, e.g. to os.Stdout
+type JSONSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+func (s *JSONSink) Write(rec AccessRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(rec)
+}
+
+// FileSink writes JSON lines to a file, rotating it to path.1, path.2 and
+// so on once it reaches maxBytes. Only maxBackups old files are kept.
+type FileSink struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens path for appending; maxBytes of 0 never rotates
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(rec AccessRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("file sink closed")
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1, dropping the
+// oldest, and starts a new file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ChannelSink hands records to a consumer without blocking requests;
+// records are dropped while the channel is full
+type ChannelSink chan AccessRecord
+
+var errAccessLogFull = errors.New("access log channel full")
+
+func (c ChannelSink) Write(rec AccessRecord) error {
+	select {
+	case c <- rec:
+		return nil
+	default:
+		return errAccessLogFull
+	}
+}
+
+// statusWriter remembers what was written for metrics and the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(statusCode int) {
+	if sw.status == 0 {
+		sw.status = statusCode
+	}
+	sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(data)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Configuration
+
+// GatewayConfig is the declarative form of a gateway, loaded from JSON or
+// YAML with the same field names:
+//
+//	{
+//	  "api_keys": ["key-1"],
+//	  "auth": {"jwks_url": "https://idp/.well-known/jwks.json", "audience": "api"},
+//	  "routes": [{
+//	    "pattern": "/api/users/{id}",
+//	    "methods": ["GET"],
+//	    "backends": [{"url": "http://users:8080", "timeout": "5s"}],
+//	    "rate_limit_per_min": 100,
+//	    "require_auth": true,
+//	    "cache_ttl": "1m"
+//	  }]
+//	}
+type GatewayConfig struct {
+	APIKeys   []string         `json:"api_keys,omitempty"`
+	Auth      *AuthConfig      `json:"auth,omitempty"`
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+	Routes    []RouteConfig    `json:"routes"`
+}
+
+// AccessLogConfig picks an access log sink. Sink is "stdout" or "file";
+// file sinks need a Path. SampleRate defaults to 1, logging everything.
+type AccessLogConfig struct {
+	Sink            string  `json:"sink"`
+	Path            string  `json:"path,omitempty"`
+	MaxBytes        int64   `json:"max_bytes,omitempty"`
+	MaxBackups      int     `json:"max_backups,omitempty"`
+	SampleRate      float64 `json:"sample_rate,omitempty"`
+	AlwaysLogErrors bool    `json:"always_log_errors,omitempty"`
+}
+
+// NewAccessLogger builds the configured logger
+func (c AccessLogConfig) NewAccessLogger() (*AccessLogger, error) {
+	rate := c.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("access log: sample_rate %v outside 0..1", c.SampleRate)
+	}
+
+	var sink AccessLogSink
+	switch c.Sink {
+	case "stdout":
+		sink = NewJSONSink(os.Stdout)
+	case "file":
+		if c.Path == "" {
+			return nil, errors.New("access log: file sink needs a path")
+		}
+		fs, err := NewFileSink(c.Path, c.MaxBytes, c.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+		sink = fs
+	default:
+		return nil, fmt.Errorf("access log: unknown sink %q", c.Sink)
+	}
+	return NewAccessLogger(sink, rate, c.AlwaysLogErrors), nil
+}
+
+// AuthConfig mirrors JWTConfig
+type AuthConfig struct {
+	Secret       string            `json:"secret,omitempty"`
+	JWKSURL      string            `json:"jwks_url,omitempty"`
+	JWKSCacheTTL Duration          `json:"jwks_cache_ttl,omitempty"`
+	Issuer       string            `json:"issuer,omitempty"`
+	Audience     string            `json:"audience,omitempty"`
+	Leeway       Duration          `json:"leeway,omitempty"`
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+// RouteConfig mirrors the data fields of Route
+type RouteConfig struct {
+	Pattern              string          `json:"pattern"`
+	Methods              []string        `json:"methods"`
+	Backends             []BackendConfig `json:"backends"`
+	RateLimitPerMin      int             `json:"rate_limit_per_min,omitempty"`
+	RouteRateLimitPerMin int             `json:"route_rate_limit_per_min,omitempty"`
+	RequireAuth          bool            `json:"require_auth,omitempty"`
+	CacheTTL             Duration        `json:"cache_ttl,omitempty"`
+	StaleWhileRevalidate Duration        `json:"stale_while_revalidate,omitempty"`
+	MaxCacheBodyBytes    int64           `json:"max_cache_body_bytes,omitempty"`
+	Stream               bool            `json:"stream,omitempty"`
+	WebSocket            bool            `json:"websocket,omitempty"`
+	EventStream          bool            `json:"event_stream,omitempty"`
+	Retry                *RetryConfig    `json:"retry,omitempty"`
+	LoadBalancing        string          `json:"load_balancing,omitempty"`
+	HashHeader           string          `json:"hash_header,omitempty"`
+	MaxBodyBytes         int64           `json:"max_body_bytes,omitempty"`
+	Timeout              Duration        `json:"timeout,omitempty"`
+	Canary               *CanaryConfig   `json:"canary,omitempty"`
+	RequireClientCert    bool            `json:"require_client_cert,omitempty"`
+	IdempotencyTTL       Duration        `json:"idempotency_ttl,omitempty"`
+	// Transforms run in order; request steps before proxying and
+	// response steps on the backend's answer
+	Transforms []TransformConfig `json:"transforms,omitempty"`
+}
+
+// TransformConfig declares one built-in transformer. Type selects it and
+// decides which of the other fields apply:
+//
+//	request_headers, response_headers: set, remove
+//	path_rewrite:                      pattern, replacement
+//	mask_json:                         fields, mask
+//	compress:                          encodings, min_size
+type TransformConfig struct {
+	Type        string            `json:"type"`
+	Set         map[string]string `json:"set,omitempty"`
+	Remove      []string          `json:"remove,omitempty"`
+	Pattern     string            `json:"pattern,omitempty"`
+	Replacement string            `json:"replacement,omitempty"`
+	Fields      []string          `json:"fields,omitempty"`
+	Mask        string            `json:"mask,omitempty"`
+	Encodings   []string          `json:"encodings,omitempty"`
+	MinSize     int64             `json:"min_size,omitempty"`
+}
+
+// BackendConfig mirrors Backend
+type BackendConfig struct {
+	URL       string   `json:"url"`
+	Weight    int      `json:"weight,omitempty"`
+	HealthURL string   `json:"health_url,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+}
+
+func (bc BackendConfig) build() (*Backend, error) {
+	u, err := url.Parse(bc.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid backend url %q", bc.URL)
+	}
+	return &Backend{
+		URL:       u,
+		Weight:    bc.Weight,
+		HealthURL: bc.HealthURL,
+		Timeout:   time.Duration(bc.Timeout),
+	}, nil
+}
+
+// CanaryConfig mirrors Canary
+type CanaryConfig struct {
+	Backends []BackendConfig `json:"backends"`
+	Percent  float64         `json:"percent"`
+}
+
+// RetryConfig mirrors RetryPolicy
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	RetryOn     []int    `json:"retry_on,omitempty"`
+	Backoff     Duration `json:"backoff,omitempty"`
+	MaxBackoff  Duration `json:"max_backoff,omitempty"`
+	HedgeAfter  Duration `json:"hedge_after,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "250ms" or "5m"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads and validates a gateway config file. Files ending in
+// .yaml or .yml are YAML; anything else is JSON.
+func LoadConfig(path string) (*GatewayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(path, data)
+}
+
+func parseConfigFile(path string, data []byte) (*GatewayConfig, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAMLConfig(data)
+	}
+	return parseConfig(data)
+}
+
+// parseYAMLConfig converts YAML to JSON and parses that, so both formats
+// share the field names, duration strings and unknown-field checks
+func parseYAMLConfig(data []byte) (*GatewayConfig, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	converted, err := json.Marshal(yamlToJSON(doc))
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	return parseConfig(converted)
+}
+
+// yamlToJSON turns the maps yaml decodes with non-string keys into ones
+// encoding/json accepts
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = yamlToJSON(value)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = yamlToJSON(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = yamlToJSON(value)
+		}
+		return v
+	}
+	return v
+}
+
+func parseConfig(data []byte) (*GatewayConfig, error) {
+	var cfg GatewayConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	if _, err := cfg.BuildRoutes(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// BuildRoutes turns the route configs into Routes keyed by pattern
+func (cfg *GatewayConfig) BuildRoutes() (map[string]*Route, error) {
+	routes := make(map[string]*Route, len(cfg.Routes))
+	rt := newRouter()
+	for i, rc := range cfg.Routes {
+		if _, dup := routes[rc.Pattern]; dup {
+			return nil, fmt.Errorf("route %d: duplicate pattern %q", i, rc.Pattern)
+		}
+
+		route := &Route{
+			Pattern:              rc.Pattern,
+			Methods:              rc.Methods,
+			RateLimitPerMin:      rc.RateLimitPerMin,
+			RouteRateLimitPerMin: rc.RouteRateLimitPerMin,
+			RequireAuth:          rc.RequireAuth,
+			CacheTTL:             time.Duration(rc.CacheTTL),
+			StaleWhileRevalidate: time.Duration(rc.StaleWhileRevalidate),
+			MaxCacheBodyBytes:    rc.MaxCacheBodyBytes,
+			Stream:               rc.Stream,
+			WebSocket:            rc.WebSocket,
+			EventStream:          rc.EventStream,
+			LoadBalancing:        rc.LoadBalancing,
+			HashHeader:           rc.HashHeader,
+			MaxBodyBytes:         rc.MaxBodyBytes,
+			Timeout:              time.Duration(rc.Timeout),
+			RequireClientCert:    rc.RequireClientCert,
+			IdempotencyTTL:       time.Duration(rc.IdempotencyTTL),
+		}
+		for _, bc := range rc.Backends {
+			backend, err := bc.build()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.Pattern, err)
+			}
+			route.Backends = append(route.Backends, backend)
+		}
+		if rc.Canary != nil {
+			route.Canary = &Canary{Percent: rc.Canary.Percent}
+			for _, bc := range rc.Canary.Backends {
+				backend, err := bc.build()
+				if err != nil {
+					return nil, fmt.Errorf("route %q: canary: %w", rc.Pattern, err)
+				}
+				route.Canary.Backends = append(route.Canary.Backends, backend)
+			}
+		}
+		if len(rc.Transforms) > 0 {
+			var err error
+			route.Transform, route.ResponseHandler, err = buildTransforms(rc.Transforms)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.Pattern, err)
+			}
+		}
+		if rc.Retry != nil {
+			route.Retry = &RetryPolicy{
+				MaxAttempts: rc.Retry.MaxAttempts,
+				RetryOn:     rc.Retry.RetryOn,
+				Backoff:     time.Duration(rc.Retry.Backoff),
+				MaxBackoff:  time.Duration(rc.Retry.MaxBackoff),
+				HedgeAfter:  time.Duration(rc.Retry.HedgeAfter),
+			}
+		}
+
+		if err := validateRoute(rc.Pattern, route); err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		if err := rt.Insert(rc.Pattern, route); err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		routes[rc.Pattern] = route
+	}
+	return routes, nil
+}
+
+// buildTransforms splits the configured steps into request and response
+// chains, keeping their order
+func buildTransforms(cfgs []TransformConfig) (RequestTransformer, ResponseTransformer, error) {
+	var reqChain RequestChain
+	var respChain ResponseChain
+	for i, tc := range cfgs {
+		switch tc.Type {
+		case "request_headers":
+			reqChain = append(reqChain, &RequestHeaders{Set: tc.Set, Remove: tc.Remove})
+		case "response_headers":
+			respChain = append(respChain, &ResponseHeaders{Set: tc.Set, Remove: tc.Remove})
+		case "path_rewrite":
+			rw := &PathRewrite{Replacement: tc.Replacement}
+			if tc.Pattern != "" {
+				re, err := regexp.Compile(tc.Pattern)
+				if err != nil {
+					return nil, nil, fmt.Errorf("transform %d: %w", i, err)
+				}
+				rw.Pattern = re
+			}
+			reqChain = append(reqChain, rw)
+		case "mask_json":
+			if len(tc.Fields) == 0 {
+				return nil, nil, fmt.Errorf("transform %d: mask_json needs fields", i)
+			}
+			respChain = append(respChain, &JSONMask{Fields: tc.Fields, Mask: tc.Mask})
+		case "compress":
+			for _, name := range tc.Encodings {
+				if lookupEncoding(name) == nil {
+					return nil, nil, fmt.Errorf("transform %d: unknown encoding %q", i, name)
+				}
+			}
+			respChain = append(respChain, &Compress{Encodings: tc.Encodings, MinSize: tc.MinSize})
+		default:
+			return nil, nil, fmt.Errorf("transform %d: unknown type %q", i, tc.Type)
+		}
+	}
+
+	var reqT RequestTransformer
+	var respT ResponseTransformer
+	if len(reqChain) > 0 {
+		reqT = reqChain
+	}
+	if len(respChain) > 0 {
+		respT = respChain
+	}
+	return reqT, respT, nil
+}
+
+// ApplyConfig replaces the gateway's routes and, when present in cfg, its
+// API keys, JWT settings and access log
+func (ag *APIGateway) ApplyConfig(cfg *GatewayConfig) error {
+	routes, err := cfg.BuildRoutes()
+	if err != nil {
+		return err
+	}
+
+	// Open a new access log first so a bad sink rejects the whole config.
+	// Reloads with the same settings keep the open sink.
+	var logger *AccessLogger
+	if cfg.AccessLog != nil {
+		ag.mu.RLock()
+		unchanged := ag.accessLog != nil && ag.accessLogConfig == *cfg.AccessLog
+		ag.mu.RUnlock()
+		if !unchanged {
+			if logger, err = cfg.AccessLog.NewAccessLogger(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ag.ReplaceRoutes(routes); err != nil {
+		if logger != nil {
+			logger.Close()
+		}
+		return err
+	}
+	if logger != nil {
+		ag.SetAccessLog(logger)
+		ag.mu.Lock()
+		ag.accessLogConfig = *cfg.AccessLog
+		ag.mu.Unlock()
+	}
+
+	if cfg.APIKeys != nil {
+		ag.authenticator.SetAPIKeys(cfg.APIKeys)
+	}
+	if cfg.Auth != nil {
+		ag.authenticator.ConfigureJWT(JWTConfig{
+			Secret:       cfg.Auth.Secret,
+			JWKSURL:      cfg.Auth.JWKSURL,
+			JWKSCacheTTL: time.Duration(cfg.Auth.JWKSCacheTTL),
+			Issuer:       cfg.Auth.Issuer,
+			Audience:     cfg.Auth.Audience,
+			Leeway:       time.Duration(cfg.Auth.Leeway),
+			ClaimHeaders: cfg.Auth.ClaimHeaders,
+		})
+	}
+	return nil
+}
+
+// configReloadDebounce is how long WatchConfig waits after the last file
+// event before reloading, so an editor's burst of writes is read once
+const configReloadDebounce = 100 * time.Millisecond
+
+// WatchConfig applies the config file and then, in the background,
+// re-applies it whenever its contents change until ctx is done. It
+// watches the file's directory rather than the file, so editors that
+// save by renaming and Kubernetes ConfigMaps that swap a symlink are
+// both seen. A changed file that fails to load is logged and the running
+// config is kept.
+func (ag *APIGateway) WatchConfig(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfigFile(path, data)
+	if err != nil {
+		return err
+	}
+	if err := ag.ApplyConfig(cfg); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go ag.watchConfig(ctx, watcher, path, sha256.Sum256(data))
+	return nil
+}
+
+func (ag *APIGateway) watchConfig(ctx context.Context, watcher *fsnotify.Watcher, path string, applied [sha256.Size]byte) {
+	defer watcher.Close()
+
+	debounce := time.NewTimer(configReloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		// Any event in the directory may be the file changing; the
+		// content hash below skips events that left it as it was
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("config reload: watch: %v", err)
+			continue
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			debounce.Reset(configReloadDebounce)
+			continue
+		case <-debounce.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("config reload: %v", err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if sum == applied {
+			continue
+		}
+
+		cfg, err := parseConfigFile(path, data)
+		if err == nil {
+			err = ag.ApplyConfig(cfg)
+		}
+		if err != nil {
+			log.Printf("config reload: keeping current routes: %v", err)
+		} else {
+			log.Printf("config reload: applied %d routes from %s", len(cfg.Routes), path)
+		}
+		// Don't retry a broken file until it changes again
+		applied = sum
+	}
+}
+
+// Idempotency
+
+// idempotencyHeader names the client's key for an unsafe request
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyMethods are the methods Idempotency-Key applies to
+var idempotencyMethods = map[string]bool{
+	http.MethodPost:  true,
+	http.MethodPut:   true,
+	http.MethodPatch: true,
+}
+
+// IdempotencyRecord is what an IdempotencyStore keeps per key
+type IdempotencyRecord struct {
+	Fingerprint string // hash of the method, URL and body of the first request
+	Done        bool   // false while the first request is in flight
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore remembers responses by Idempotency-Key, after
+// challenge-158's IdempotencyStore: a key is claimed as pending, then
+// holds the response until it expires
+type IdempotencyStore interface {
+	// Begin claims key for a new request. If key is already claimed it
+	// returns the existing record and false.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	// Complete stores the response to a claimed key
+	Complete(ctx context.Context, key string, record *IdempotencyRecord) error
+	// Release drops a claim that got no response, so the client can retry
+	Release(ctx context.Context, key string) error
+}
+
+// MemoryIdempotencyStore keeps records in process memory
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*memoryIdempotencyRecord
+	nextSweep time.Time
+}
+
+type memoryIdempotencyRecord struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]*memoryIdempotencyRecord)}
+}
+
+// Begin claims key unless an unexpired record holds it
+func (ms *MemoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.After(ms.nextSweep) {
+		for k, entry := range ms.records {
+			if now.After(entry.expiresAt) {
+				delete(ms.records, k)
+			}
+		}
+		ms.nextSweep = now.Add(time.Minute)
+	}
+
+	if entry, ok := ms.records[key]; ok && !now.After(entry.expiresAt) {
+		record := entry.record
+		return &record, false, nil
+	}
+	ms.records[key] = &memoryIdempotencyRecord{
+		record:    IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt: now.Add(ttl),
+	}
+	return nil, true, nil
+}
+
+// Complete stores the response, keeping the claim's expiry
+func (ms *MemoryIdempotencyStore) Complete(ctx context.Context, key string, record *IdempotencyRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.records[key]
+	if !ok {
+		return errors.New("idempotency key not claimed")
+	}
+	entry.record = *record
+	entry.record.Done = true
+	return nil
+}
+
+// Release forgets key
+func (ms *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.records, key)
+	return nil
+}
+
+// idempotentRequest is a claimed key waiting for its response
+type idempotentRequest struct {
+	store       IdempotencyStore
+	key         string
+	fingerprint string
+	ctx         context.Context
+	done        bool
+}
+
+// beginIdempotent claims key for r, or answers r itself: with the stored
+// response for a duplicate, 409 while the first request is still in
+// flight and 422 when the key was used for a different request. A store
+// error lets the request through unprotected. handled reports whether a
+// response was written.
+func (ag *APIGateway) beginIdempotent(w http.ResponseWriter, r *http.Request, route *Route, pattern, key string) (idem *idempotentRequest, handled bool) {
+	// The fingerprint covers the body, so read it and hand back a copy
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			ag.metrics.recordError()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "failed to read request body"})
+			}
+			return nil, true
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	fingerprint := fmt.Sprintf("%x", h.Sum(nil))
+
+	// Keys are only unique per client and route
+	storeKey := fmt.Sprintf("%x", sha256.Sum256([]byte(ag.clientKey(r)+"\x00"+pattern+"\x00"+key)))
+
+	ag.mu.RLock()
+	store := ag.idempotency
+	ag.mu.RUnlock()
+	ctx := context.WithoutCancel(r.Context())
+	existing, claimed, err := store.Begin(ctx, storeKey, fingerprint, route.IdempotencyTTL)
+	switch {
+	case err != nil:
+		log.Printf("idempotency: %v", err)
+		return nil, false
+	case claimed:
+		return &idempotentRequest{store: store, key: storeKey, fingerprint: fingerprint, ctx: ctx}, false
+	case existing.Fingerprint != fingerprint:
+		ag.metrics.recordError()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": "idempotency key reused with a different request"})
+	case !existing.Done:
+		ag.metrics.recordError()
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "request with this idempotency key is in progress"})
+	default:
+		for name, values := range existing.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(existing.Status)
+		w.Write(existing.Body)
+		ag.metrics.recordSuccess(0, existing.Status)
+	}
+	return nil, true
+}
+
+// complete stores the response unless it was a server error, which the
+// client should be free to retry, or too large to keep
+func (idem *idempotentRequest) complete(rw *responseWriterWrapper) {
+	if rw.statusCode >= 500 || !rw.cacheable() {
+		return
+	}
+	header := rw.header.Clone()
+	for _, name := range gatewayHeaders {
+		header.Del(name)
+	}
+	record := &IdempotencyRecord{Fingerprint: idem.fingerprint, Status: rw.statusCode, Header: header, Body: rw.body}
+	if err := idem.store.Complete(idem.ctx, idem.key, record); err != nil {
+		log.Printf("idempotency: %v", err)
+		return
+	}
+	idem.done = true
+}
+
+// release drops the claim if no response was stored
+func (idem *idempotentRequest) release() {
+	if idem.done {
+		return
+	}
+	if err := idem.store.Release(idem.ctx, idem.key); err != nil {
+		log.Printf("idempotency: %v", err)
+	}
+}
+
+// TLS termination
+
+// TLSConfig configures a TLS listener
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, asks clients for a certificate and verifies
+	// any they present against these CAs. Routes decide with
+	// RequireClientCert whether one is mandatory.
+	ClientCAFile string
+	// ReloadInterval is how often the certificate files are checked for
+	// changes; default 1 minute
+	ReloadInterval time.Duration
+}
+
+// Headers carrying the verified client certificate to backends
+const (
+	clientCertHeader            = "X-Client-Cert" // URL-escaped PEM
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertIssuerHeader      = "X-Client-Cert-Issuer"
+	clientCertSerialHeader      = "X-Client-Cert-Serial"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint" // SHA-256, hex
+)
+
+var clientCertHeaders = []string{
+	clientCertHeader, clientCertSubjectHeader, clientCertIssuerHeader,
+	clientCertSerialHeader, clientCertFingerprintHeader,
+}
+
+// ListenTLS serves handler over TLS on addr, picking up renewed
+// certificates without a restart. A nil handler means
+// http.DefaultServeMux.
+func ListenTLS(addr string, handler http.Handler, cfg TLSConfig) error {
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	return server.ListenAndServeTLS("", "")
+}
+
+// NewTLSConfig builds the server TLS settings for cfg
+func NewTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	reloader := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile, interval: cfg.ReloadInterval}
+	if reloader.interval <= 0 {
+		reloader.interval = time.Minute
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate from disk, re-reading the files at
+// most once per interval and switching over when they change. A broken
+// renewal is logged and the old certificate stays in use.
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+	mu                sync.Mutex
+	cert              *tls.Certificate
+	certPEM, keyPEM   []byte
+	checked           time.Time
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checked) >= cr.interval {
+		if err := cr.reloadLocked(); err != nil {
+			log.Printf("tls: keeping current certificate: %v", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+func (cr *certReloader) reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.reloadLocked()
+}
+
+func (cr *certReloader) reloadLocked() error {
+	cr.checked = time.Now()
+	certPEM, err := os.ReadFile(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && bytes.Equal(certPEM, cr.certPEM) && bytes.Equal(keyPEM, cr.keyPEM) {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.certPEM, cr.keyPEM = &cert, certPEM, keyPEM
+	return nil
+}
+
+// hasClientCert reports whether the client presented a certificate that
+// verified against the listener's client CAs
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// forwardClientCert replaces any client-supplied certificate headers with
+// the details of the verified client certificate, if there is one
+func forwardClientCert(r *http.Request) {
+	for _, header := range clientCertHeaders {
+		r.Header.Del(header)
+	}
+	if !hasClientCert(r) {
+		return
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	r.Header.Set(clientCertHeader, url.QueryEscape(string(block)))
+	r.Header.Set(clientCertSubjectHeader, cert.Subject.String())
+	r.Header.Set(clientCertIssuerHeader, cert.Issuer.String())
+	r.Header.Set(clientCertSerialHeader, cert.SerialNumber.String())
+	r.Header.Set(clientCertFingerprintHeader, fmt.Sprintf("%x", sha256.Sum256(cert.Raw)))
+}
+
+// Admin API
+
+// AdminHandler serves the admin API under /admin/. Every request needs
+// "Authorization: Bearer <token>"; the gateway's API keys and JWTs don't
+// work here, and an empty token turns the API off. Changes live in
+// memory only: the next config reload replaces them.
+func (ag *APIGateway) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/routes", ag.adminListRoutes)
+	mux.HandleFunc("POST /admin/routes/backends", ag.adminAddBackend)
+	mux.HandleFunc("DELETE /admin/routes/backends", ag.adminRemoveBackend)
+	mux.HandleFunc("POST /admin/routes/canary", ag.adminCanary)
+	mux.HandleFunc("POST /admin/keys", ag.adminAddKey)
+	mux.HandleFunc("DELETE /admin/keys", ag.adminRevokeKey)
+	mux.HandleFunc("POST /admin/keys/rotate", ag.adminRotateKey)
+	mux.HandleFunc("DELETE /admin/cache", ag.adminPurgeCache)
+	mux.HandleFunc("POST /admin/breakers/trip", ag.adminBreaker((*CircuitBreaker).Trip))
+	mux.HandleFunc("POST /admin/breakers/reset", ag.adminBreaker((*CircuitBreaker).Reset))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || !hmac.Equal([]byte(bearer), []byte(token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminRoute is how GET /admin/routes reports a route
+type adminRoute struct {
+	Pattern       string         `json:"pattern"`
+	Methods       []string       `json:"methods"`
+	LoadBalancing string         `json:"load_balancing"`
+	Backends      []adminBackend `json:"backends"`
+	Canary        *adminCanary   `json:"canary,omitempty"`
+}
+
+type adminCanary struct {
+	Percent  float64        `json:"percent"`
+	Backends []adminBackend `json:"backends"`
+}
+
+type adminBackend struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Breaker  string `json:"breaker"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// adminBackendRequest names a route's backend; adding one also takes the
+// backend settings of a config file
+type adminBackendRequest struct {
+	Route string `json:"route"`
+	BackendConfig
+}
+
+func (ag *APIGateway) adminListRoutes(w http.ResponseWriter, r *http.Request) {
+	ag.mu.RLock()
+	routes := make([]adminRoute, 0, len(ag.routes))
+	for pattern, route := range ag.routes {
+		ar := adminRoute{
+			Pattern:       pattern,
+			Methods:       route.Methods,
+			LoadBalancing: route.LoadBalancer.strategy,
+			Backends:      ag.adminBackends(route.Backends),
+		}
+		if route.Canary != nil {
+			ar.Canary = &adminCanary{Percent: route.Canary.Percent, Backends: ag.adminBackends(route.Canary.Backends)}
+		}
+		routes = append(routes, ar)
+	}
+	ag.mu.RUnlock()
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Pattern < routes[j].Pattern })
+	writeAdminJSON(w, http.StatusOK, routes)
+}
+
+func (ag *APIGateway) adminBackends(backends []*Backend) []adminBackend {
+	out := make([]adminBackend, 0, len(backends))
+	for _, backend := range backends {
+		out = append(out, adminBackend{
+			URL:      backend.URL.String(),
+			Weight:   backend.Weight,
+			Healthy:  ag.healthChecker.IsHealthy(backend),
+			Breaker:  backend.breaker.Load().State(),
+			Requests: backend.TotalRequests.Load(),
+			Errors:   backend.Errors.Load(),
+		})
+	}
+	return out
+}
+
+func (ag *APIGateway) adminAddBackend(w http.ResponseWriter, r *http.Request) {
+	var req adminBackendRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	backend, err := req.build()
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := ag.AddBackend(req.Route, backend); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, map[string]string{"route": req.Route, "url": backend.URL.String()})
+}
+
+func (ag *APIGateway) adminRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	var req adminBackendRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if err := ag.RemoveBackend(req.Route, req.URL); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminCanary sets a route's canary share, or with step and interval
+// shifts it there gradually in the background. A new call replaces a
+// shift still in progress.
+func (ag *APIGateway) adminCanary(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Route    string   `json:"route"`
+		Percent  float64  `json:"percent"`
+		Step     float64  `json:"step"`
+		Interval Duration `json:"interval"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if err := validCanaryPercent(req.Percent); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, err := ag.CanaryPercent(req.Route); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ag.mu.Lock()
+	if stop := ag.canaryShifts[req.Route]; stop != nil {
+		stop()
+	}
+	ag.canaryShifts[req.Route] = cancel
+	ag.mu.Unlock()
+
+	if req.Step <= 0 || req.Interval <= 0 {
+		cancel()
+		if err := ag.SetCanaryPercent(req.Route, req.Percent); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"route": req.Route, "percent": req.Percent})
+		return
+	}
+	go func() {
+		defer cancel()
+		if err := ag.ShiftCanary(ctx, req.Route, req.Percent, req.Step, time.Duration(req.Interval)); err != nil && ctx.Err() == nil {
+			log.Printf("canary shift on %s: %v", req.Route, err)
+		}
+	}()
+	writeAdminJSON(w, http.StatusAccepted, map[string]interface{}{"route": req.Route, "target": req.Percent})
+}
+
+func (ag *APIGateway) adminAddKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if req.Key == "" {
+		var err error
+		if req.Key, err = generateAPIKey(); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+	}
+	ag.authenticator.RegisterAPIKey(req.Key)
+	writeAdminJSON(w, http.StatusCreated, map[string]string{"key": req.Key})
+}
+
+func (ag *APIGateway) adminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if !ag.authenticator.RevokeAPIKey(req.Key) {
+		writeAdminError(w, ErrUnknownAPIKey)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ag *APIGateway) adminRotateKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key   string   `json:"key"`
+		Grace Duration `json:"grace"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	key, err := ag.authenticator.RotateAPIKey(req.Key, time.Duration(req.Grace))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"key": key})
+}
+
+func (ag *APIGateway) adminPurgeCache(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]int{"purged": ag.cache.Purge(req.Prefix)})
+}
+
+// adminBreaker applies action to the breaker of the named backend
+func (ag *APIGateway) adminBreaker(action func(*CircuitBreaker)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Backend string `json:"backend"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		cb := ag.CircuitBreaker(req.Backend)
+		if cb == nil {
+			writeAdminError(w, fmt.Errorf("%w: %s", ErrBackendNotFound, req.Backend))
+			return
+		}
+		action(cb)
+		writeAdminJSON(w, http.StatusOK, map[string]string{"backend": req.Backend, "state": cb.State()})
+	}
+}
+
+// decodeAdminRequest reads a JSON body into v, answering 400 if it can't.
+// An empty body leaves v zero.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrRouteNotFound), errors.Is(err, ErrBackendNotFound), errors.Is(err, ErrUnknownAPIKey):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrBackendExists), errors.Is(err, ErrLastBackend), errors.Is(err, ErrNoCanary):
+		status = http.StatusConflict
+	}
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// OpenAPI import
+
+// ImportOpenAPI builds one route per path of an OpenAPI 3 document in
+// JSON. Routes get the document's methods, require auth for operations
+// with a security requirement and validate requests against the declared
+// parameters and request bodies. Requests go to backendURLs, or to the
+// document's first server when none are given; the server's path is kept
+// as a prefix on every pattern.
+func ImportOpenAPI(data []byte, backendURLs ...string) (map[string]*Route, error) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("openapi: unsupported version %q", doc.OpenAPI)
+	}
+
+	var prefix string
+	if len(doc.Servers) > 0 {
+		server, err := url.Parse(doc.Servers[0].URL)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: invalid server url %q", doc.Servers[0].URL)
+		}
+		prefix = strings.TrimSuffix(server.Path, "/")
+		if len(backendURLs) == 0 && server.IsAbs() {
+			backendURLs = []string{server.Scheme + "://" + server.Host}
+		}
+	}
+	if len(backendURLs) == 0 {
+		return nil, errors.New("openapi: no backends given and no absolute server url")
+	}
+
+	routes := make(map[string]*Route, len(doc.Paths))
+	rt := newRouter()
+	for path, item := range doc.Paths {
+		pattern := prefix + path
+		route, err := doc.route(item)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: %s: %w", path, err)
+		}
+		route.Pattern = pattern
+		for _, u := range backendURLs {
+			backend, err := BackendConfig{URL: u}.build()
+			if err != nil {
+				return nil, fmt.Errorf("openapi: %w", err)
+			}
+			route.Backends = append(route.Backends, backend)
+		}
+		if err := validateRoute(pattern, route); err != nil {
+			return nil, fmt.Errorf("openapi: %s: %w", path, err)
+		}
+		if err := rt.Insert(pattern, route); err != nil {
+			return nil, fmt.Errorf("openapi: %w", err)
+		}
+		routes[pattern] = route
+	}
+	return routes, nil
+}
+
+// ImportOpenAPI registers the routes of an OpenAPI 3 document; see the
+// package-level ImportOpenAPI
+func (ag *APIGateway) ImportOpenAPI(data []byte, backendURLs ...string) error {
+	routes, err := ImportOpenAPI(data, backendURLs...)
+	if err != nil {
+		return err
+	}
+	for pattern, route := range routes {
+		if err := ag.RegisterRoute(pattern, route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openAPIDocument is the part of an OpenAPI 3 document the importer reads
+type openAPIDocument struct {
+	OpenAPI string `json:"openapi"`
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Security   []map[string][]string                 `json:"security"`
+	Components struct {
+		Parameters    map[string]*openAPIParameter   `json:"parameters"`
+		RequestBodies map[string]*openAPIRequestBody `json:"requestBodies"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *openAPIRequestBody `json:"requestBody"`
+	// Security overrides the document's requirement; nil inherits it
+	Security *[]map[string][]string `json:"security"`
+}
+
+type openAPIParameter struct {
+	Ref      string `json:"$ref"`
+	Name     string `json:"name"`
+	In       string `json:"in"` // path, query, header or cookie
+	Required bool   `json:"required"`
+	Schema   *struct {
+		Type json.RawMessage `json:"type"` // a string, or a list in 3.1
+	} `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                     `json:"$ref"`
+	Required bool                       `json:"required"`
+	Content  map[string]json.RawMessage `json:"content"`
+}
+
+// openAPIMethods maps path item fields to HTTP methods
+var openAPIMethods = map[string]string{
+	"get": http.MethodGet, "put": http.MethodPut, "post": http.MethodPost,
+	"delete": http.MethodDelete, "options": http.MethodOptions,
+	"head": http.MethodHead, "patch": http.MethodPatch, "trace": http.MethodTrace,
+}
+
+// route builds a route, without backends, for one path item
+func (doc *openAPIDocument) route(item map[string]json.RawMessage) (*Route, error) {
+	var shared []*openAPIParameter
+	if raw, ok := item["parameters"]; ok {
+		if err := json.Unmarshal(raw, &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	route := &Route{}
+	validator := make(openAPIValidator)
+	var authMethods []string
+	for field, raw := range item {
+		method, ok := openAPIMethods[field]
+		if !ok {
+			continue
+		}
+		var op openAPIOperation
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		rules, err := doc.rules(shared, &op)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		validator[method] = rules
+		route.Methods = append(route.Methods, method)
+
+		security := doc.Security
+		if op.Security != nil {
+			security = *op.Security
+		}
+		if requiresCredentials(security) {
+			authMethods = append(authMethods, method)
+		}
+	}
+	sort.Strings(route.Methods)
+	sort.Strings(authMethods)
+
+	route.Validator = validator
+	if len(authMethods) > 0 {
+		route.RequireAuth = true
+		if len(authMethods) < len(route.Methods) {
+			route.AuthMethods = authMethods
+		}
+	}
+	return route, nil
+}
+
+// requiresCredentials reports whether a security requirement list
+// demands credentials. An empty requirement object makes them optional.
+func requiresCredentials(security []map[string][]string) bool {
+	for _, requirement := range security {
+		if len(requirement) == 0 {
+			return false
+		}
+	}
+	return len(security) > 0
+}
+
+// rules merges path-level and operation-level parameters, operations
+// winning, and resolves local references
+func (doc *openAPIDocument) rules(shared []*openAPIParameter, op *openAPIOperation) (*openAPIRules, error) {
+	rules := &openAPIRules{}
+	seen := make(map[string]int)
+	for _, params := range [][]*openAPIParameter{shared, op.Parameters} {
+		for _, param := range params {
+			if param.Ref != "" {
+				name, ok := strings.CutPrefix(param.Ref, "#/components/parameters/")
+				if !ok || doc.Components.Parameters[name] == nil {
+					return nil, fmt.Errorf("unresolved parameter %q", param.Ref)
+				}
+				param = doc.Components.Parameters[name]
+			}
+			rule := openAPIParam{name: param.Name, in: param.In, required: param.Required || param.In == "path"}
+			if param.Schema != nil {
+				rule.typ = schemaType(param.Schema.Type)
+			}
+			if rule.in == "header" {
+				rule.name = http.CanonicalHeaderKey(rule.name)
+			}
+			key := rule.in + ":" + rule.name
+			if i, ok := seen[key]; ok {
+				rules.params[i] = rule
+				continue
+			}
+			seen[key] = len(rules.params)
+			rules.params = append(rules.params, rule)
+		}
+	}
+
+	if body := op.RequestBody; body != nil {
+		if body.Ref != "" {
+			name, ok := strings.CutPrefix(body.Ref, "#/components/requestBodies/")
+			if !ok || doc.Components.RequestBodies[name] == nil {
+				return nil, fmt.Errorf("unresolved request body %q", body.Ref)
+			}
+			body = doc.Components.RequestBodies[name]
+		}
+		rules.bodyRequired = body.Required
+		for mediaType := range body.Content {
+			rules.contentTypes = append(rules.contentTypes, strings.ToLower(mediaType))
+		}
+		sort.Strings(rules.contentTypes)
+	}
+	return rules, nil
+}
+
+// schemaType returns a schema's type, skipping "null" in a 3.1 type list
+func schemaType(raw json.RawMessage) string {
+	var typ string
+	if json.Unmarshal(raw, &typ) == nil {
+		return typ
+	}
+	var types []string
+	json.Unmarshal(raw, &types)
+	for _, t := range types {
+		if t != "null" {
+			return t
+		}
+	}
+	return ""
+}
+
+// openAPIValidator checks requests against the imported operations
+type openAPIValidator map[string]*openAPIRules
+
+// openAPIRules is what one operation requires of a request
+type openAPIRules struct {
+	params       []openAPIParam
+	bodyRequired bool
+	contentTypes []string // accepted media types; empty accepts any
+}
+
+type openAPIParam struct {
+	name, in, typ string
+	required      bool
+}
+
+func (v openAPIValidator) Validate(r *http.Request) error {
+	rules := v[r.Method]
+	if rules == nil {
+		return nil
+	}
+
+	pathParams := PathParams(r)
+	query := r.URL.Query()
+	for _, param := range rules.params {
+		var value string
+		var present bool
+		switch param.in {
+		case "path":
+			value, present = pathParams[param.name]
+		case "query":
+			value, present = query.Get(param.name), query.Has(param.name)
+		case "header":
+			value = r.Header.Get(param.name)
+			present = value != ""
+		case "cookie":
+			if cookie, err := r.Cookie(param.name); err == nil {
+				value, present = cookie.Value, true
+			}
+		}
+		if !present {
+			if param.required {
+				return fmt.Errorf("missing required %s parameter %q", param.in, param.name)
+			}
+			continue
+		}
+		if !matchesSchemaType(value, param.typ) {
+			return fmt.Errorf("%s parameter %q must be of type %s", param.in, param.name, param.typ)
+		}
+	}
+
+	hasBody := r.ContentLength > 0 || (r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody)
+	if !hasBody {
+		if rules.bodyRequired {
+			return errors.New("request body is required")
+		}
+		return nil
+	}
+	if len(rules.contentTypes) > 0 {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !acceptsMediaType(rules.contentTypes, mediaType) {
+			return fmt.Errorf("unsupported content type %q; expected one of %s", r.Header.Get("Content-Type"), strings.Join(rules.contentTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// matchesSchemaType checks a parameter's raw value against a primitive
+// schema type; other types aren't checked
+func matchesSchemaType(value, typ string) bool {
+	switch typ {
+	case "integer":
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case "number":
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case "boolean":
+		return value == "true" || value == "false"
+	}
+	return true
+}
+
+// acceptsMediaType matches mediaType against types, which may use
+// ranges such as "image/*" and "*/*"
+func acceptsMediaType(types []string, mediaType string) bool {
+	for _, t := range types {
+		if t == mediaType || t == "*/*" {
+			return true
+		}
+		if major, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mediaType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Routing
+
+// router is a segment trie over route patterns. Segments are matched
+// static first, then {param}, then a trailing * catch-all, backtracking
+// when a branch has no route for the method.
+type router struct {
+	root *routeNode
+}
+
+type routeNode struct {
+	static   map[string]*routeNode
+	param    *routeNode
+	entries  []*routeEntry // patterns ending at this node
+	catchAll []*routeEntry // patterns whose last segment ends in *
+}
+
+type routeEntry struct {
+	pattern    string
+	route      *Route
+	paramNames []string
+	prefix     string // literal text before * in a catch-all segment
+}
+
+// routeMatch is the result of a successful lookup
+type routeMatch struct {
+	pattern     string
+	route       *Route
+	params      map[string]string
+	rateLimiter *RateLimiter
+}
+
+type pathParamsKey struct{}
+
+// PathParams returns the parameters captured by the matched route pattern,
+// e.g. {"id": "42"} for /api/users/{id} and /api/users/42
+func PathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params
+}
+
+func newRouter() *router {
+	return &router{root: newRouteNode()}
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{static: make(map[string]*routeNode)}
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// Insert adds a pattern, replacing any route registered under the same one
+func (rt *router) Insert(pattern string, route *Route) error {
+	segments := splitPath(pattern)
+	if pattern == "/" {
+		// "/" has always matched every path
+		segments = []string{"*"}
+	}
+
+	node := rt.root
+	var names []string
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch {
+		case last && strings.HasSuffix(seg, "*"):
+			prefix := strings.TrimSuffix(seg, "*")
+			if strings.ContainsAny(prefix, "{}*") {
+				return fmt.Errorf("invalid segment %q in pattern %q", seg, pattern)
+			}
+			node.catchAll = upsertRouteEntry(node.catchAll, &routeEntry{
+				pattern: pattern, route: route, paramNames: names, prefix: prefix,
+			})
+			return nil
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			name := seg[1 : len(seg)-1]
+			if name == "" || strings.ContainsAny(name, "{}*") {
+				return fmt.Errorf("invalid parameter %q in pattern %q", seg, pattern)
+			}
+			for _, existing := range names {
+				if existing == name {
+					return fmt.Errorf("duplicate parameter %q in pattern %q", name, pattern)
+				}
+			}
+			names = append(names, name)
+			if node.param == nil {
+				node.param = newRouteNode()
+			}
+			node = node.param
+		default:
+			if strings.ContainsAny(seg, "{}*") {
+				return fmt.Errorf("invalid segment %q in pattern %q", seg, pattern)
+			}
+			child, exists := node.static[seg]
+			if !exists {
+				child = newRouteNode()
+				node.static[seg] = child
+			}
+			node = child
+		}
+	}
+
+	node.entries = upsertRouteEntry(node.entries, &routeEntry{
+		pattern: pattern, route: route, paramNames: names,
+	})
+	return nil
+}
+
+func upsertRouteEntry(entries []*routeEntry, entry *routeEntry) []*routeEntry {
+	for i, existing := range entries {
+		if existing.pattern == entry.pattern {
+			entries[i] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
+
+// Lookup finds the most specific route for method and path
+func (rt *router) Lookup(method, path string) *routeMatch {
+	entry, values := rt.root.match(splitPath(path), method, nil)
+	if entry == nil {
+		return nil
+	}
+
+	params := make(map[string]string, len(entry.paramNames))
+	for i, name := range entry.paramNames {
+		params[name] = values[i]
+	}
+	return &routeMatch{pattern: entry.pattern, route: entry.route, params: params}
+}
+
+func (n *routeNode) match(segments []string, method string, values []string) (*routeEntry, []string) {
+	if len(segments) == 0 {
+		for _, entry := range n.entries {
+			if methodAllowed(entry.route.Methods, method) {
+				return entry, values
+			}
+		}
+		return nil, nil
+	}
+
+	seg := segments[0]
+	if child, ok := n.static[seg]; ok {
+		if entry, v := child.match(segments[1:], method, values); entry != nil {
+			return entry, v
+		}
+	}
+	if n.param != nil && seg != "" {
+		if entry, v := n.param.match(segments[1:], method, append(values, seg)); entry != nil {
+			return entry, v
+		}
+	}
+	for _, entry := range n.catchAll {
+		if strings.HasPrefix(seg, entry.prefix) && methodAllowed(entry.route.Methods, method) {
+			return entry, values
+		}
+	}
+	return nil, nil
+}
+
+// NewRateLimiter creates a per-client rate limiter backed by local memory
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return NewRateLimiterWithStore(perMinute, 0, NewMemoryRateLimitStore(), "")
+}
+
+// NewRateLimiterWithStore creates a rate limiter whose counters live in
+// store under prefix
+func NewRateLimiterWithStore(perMinute, routePerMinute int, store RateLimitStore, prefix string) *RateLimiter {
+	return &RateLimiter{
+		perMinute:      perMinute,
+		routePerMinute: routePerMinute,
+		window:         time.Minute,
+		store:          store,
+		prefix:         prefix,
+		now:            time.Now,
+	}
+}
+
+// sameLimits reports whether rl enforces route's limits against store
+func (rl *RateLimiter) sameLimits(route *Route, store RateLimitStore) bool {
+	return rl.perMinute == route.RateLimitPerMin && rl.routePerMinute == route.RouteRateLimitPerMin && rl.store == store
+}
+
+// AllowRequest checks if a request is allowed. Store errors fail open.
+func (rl *RateLimiter) AllowRequest(clientID string) bool {
+	decision, err := rl.Allow(context.Background(), clientID)
+	return err != nil || decision.Allowed
+}
+
+// Allow checks the client and route limits and records the hit if both
+// have room. Rejected requests are not counted.
+//
+// Each limit uses a sliding window approximated from two fixed windows:
+// the previous window's count is weighted by how much of it still
+// overlaps the last minute.
+func (rl *RateLimiter) Allow(ctx context.Context, clientID string) (RateLimitDecision, error) {
+	if rl.perMinute <= 0 && rl.routePerMinute <= 0 {
+		return RateLimitDecision{Allowed: true}, nil
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	start := now.Truncate(rl.window)
+	elapsed := now.Sub(start)
+
+	type check struct {
+		scope string
+		limit int
+		key   string
+		usage float64
+	}
+	var checks []check
+	if rl.perMinute > 0 {
+		checks = append(checks, check{scope: "client", limit: rl.perMinute, key: rl.prefix + "client:" + clientID})
+	}
+	if rl.routePerMinute > 0 {
+		checks = append(checks, check{scope: "route", limit: rl.routePerMinute, key: rl.prefix + "route"})
+	}
+
+	decision := RateLimitDecision{Allowed: true}
+	for i := range checks {
+		c := &checks[i]
+		prev, err := rl.store.Count(ctx, windowKey(c.key, start.Add(-rl.window)))
+		if err != nil {
+			return RateLimitDecision{}, err
+		}
+		cur, err := rl.store.Count(ctx, windowKey(c.key, start))
+		if err != nil {
+			return RateLimitDecision{}, err
+		}
+
+		weight := 1 - float64(elapsed)/float64(rl.window)
+		c.usage = float64(prev)*weight + float64(cur)
+		if c.usage+1 > float64(c.limit) {
+			return RateLimitDecision{
+				Scope:      c.scope,
+				Limit:      c.limit,
+				RetryAfter: slidingRetryAfter(float64(prev), float64(cur), float64(c.limit), elapsed, rl.window),
+			}, nil
+		}
+	}
+
+	for i, c := range checks {
+		if _, err := rl.store.Increment(ctx, windowKey(c.key, start), 2*rl.window); err != nil {
+			return RateLimitDecision{}, err
+		}
+		// Report the tightest limit
+		remaining := int(float64(c.limit) - c.usage - 1)
+		if i == 0 || remaining < decision.Remaining {
+			decision.Scope, decision.Limit, decision.Remaining = c.scope, c.limit, remaining
+		}
+	}
+	return decision, nil
+}
+
+func windowKey(key string, start time.Time) string {
+	return fmt.Sprintf("%s:%d", key, start.Unix())
+}
+
+// slidingRetryAfter returns how long until the estimate prev*weight + cur
+// drops below limit, assuming no further hits
+func slidingRetryAfter(prev, cur, limit float64, elapsed, window time.Duration) time.Duration {
+	w := float64(window)
+	var wait float64
+	if cur+1 <= limit && prev > 0 {
+		// The previous window's share decays during this window
+		wait = w*(1-(limit-cur-1)/prev) - float64(elapsed)
+	} else {
+		// Wait for the next window, then for this one's share to decay
+		wait = float64(window-elapsed) + w*(1-(limit-1)/cur)
+	}
+	if wait < float64(time.Second) {
+		wait = float64(time.Second)
+	}
+	return time.Duration(wait)
+}
+
+// MemoryRateLimitStore keeps counters in process memory
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	nextSweep time.Time
+}
+
+type memoryCounter struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: make(map[string]*memoryCounter)}
+}
+
+// Count returns the hits recorded under key
+func (ms *MemoryRateLimitStore) Count(ctx context.Context, key string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	counter, ok := ms.counters[key]
+	if !ok || time.Now().After(counter.expiresAt) {
+		return 0, nil
+	}
+	return counter.count, nil
+}
+
+// Increment adds a hit under key
+func (ms *MemoryRateLimitStore) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.After(ms.nextSweep) {
+		for k, counter := range ms.counters {
+			if now.After(counter.expiresAt) {
+				delete(ms.counters, k)
+			}
+		}
+		ms.nextSweep = now.Add(time.Minute)
+	}
+
+	counter, ok := ms.counters[key]
+	if !ok || now.After(counter.expiresAt) {
+		counter = &memoryCounter{expiresAt: now.Add(ttl)}
+		ms.counters[key] = counter
+	}
+	counter.count++
+	return counter.count, nil
+}
+
+// RedisClient is the subset of Redis commands the rate limiter needs.
+// Adapt a real client (e.g. go-redis) to it.
+type RedisClient interface {
+	Get(ctx context.Context, key string) (int64, error) // 0 for a missing key
+	Incr(ctx context.Context, key string) (int64, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// RedisRateLimitStore keeps counters in Redis so every gateway instance
+// shares them
+type RedisRateLimitStore struct {
+	client RedisClient
+	prefix string
+}
+
+// NewRedisRateLimitStore creates a store that namespaces keys with prefix
+func NewRedisRateLimitStore(client RedisClient, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: prefix}
+}
+
+// Count returns the hits recorded under key
+func (rs *RedisRateLimitStore) Count(ctx context.Context, key string) (int64, error) {
+	return rs.client.Get(ctx, rs.prefix+key)
+}
+
+// Increment adds a hit under key, setting the expiry on the first hit
+func (rs *RedisRateLimitStore) Increment(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	n, err := rs.client.Incr(ctx, rs.prefix+key)
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err := rs.client.Expire(ctx, rs.prefix+key, ttl); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// NewAuthenticator creates a new authenticator
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{
+		apiKeys:      make(map[string]bool),
+		claimHeaders: defaultClaimHeaders,
+		now:          time.Now,
+	}
+}
+
+// ConfigureJWT replaces the token validation settings
+func (a *Authenticator) ConfigureJWT(cfg JWTConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.jwtSecret = cfg.Secret
+	a.issuer = cfg.Issuer
+	a.audience = cfg.Audience
+	a.leeway = cfg.Leeway
+	a.jwks = nil
+	if cfg.JWKSURL != "" {
+		a.jwks = NewJWKSCache(cfg.JWKSURL, cfg.JWKSCacheTTL)
+	}
+	a.claimHeaders = defaultClaimHeaders
+	if cfg.ClaimHeaders != nil {
+		a.claimHeaders = cfg.ClaimHeaders
+	}
+}
+
+// RegisterAPIKey registers an API key
+func (a *Authenticator) RegisterAPIKey(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.apiKeys[key] = true
+}
+
+// SetAPIKeys replaces every registered API key
+func (a *Authenticator) SetAPIKeys(keys []string) {
+	apiKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		apiKeys[key] = true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.apiKeys = apiKeys
+}
+
+// RevokeAPIKey removes an API key, reporting whether it was registered
+func (a *Authenticator) RevokeAPIKey(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.apiKeys[key] {
+		return false
+	}
+	delete(a.apiKeys, key)
+	return true
+}
+
+// RotateAPIKey registers a freshly generated key in place of old, which
+// keeps working for grace so clients can switch over
+func (a *Authenticator) RotateAPIKey(old string, grace time.Duration) (string, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.apiKeys[old] {
+		return "", ErrUnknownAPIKey
+	}
+	a.apiKeys[key] = true
+	if grace <= 0 {
+		delete(a.apiKeys, old)
+	} else {
+		time.AfterFunc(grace, func() { a.RevokeAPIKey(old) })
+	}
+	return key, nil
+}
+
+// ErrUnknownAPIKey is returned when rotating a key that isn't registered
+var ErrUnknownAPIKey = errors.New("unknown api key")
+
+// generateAPIKey returns 32 random bytes, hex encoded
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
+
+// ValidateRequest validates the request authentication
+func (a *Authenticator) ValidateRequest(r *http.Request) bool {
+	_, err := a.Authenticate(r)
+	return err == nil
+}
+
+// Authenticate checks the request's API key or bearer token. Claims are
+// nil for API key requests.
+func (a *Authenticator) Authenticate(r *http.Request) (Claims, error) {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		if !a.apiKeys[apiKey] {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, nil
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, ErrMissingCredentials
+	}
+	return a.ValidateToken(r.Context(), token)
+}
+
+// ValidateToken verifies a compact JWT's signature and registered claims
+func (a *Authenticator) ValidateToken(ctx context.Context, token string) (Claims, error) {
+	a.mu.RLock()
+	secret, jwks, issuer, audience, leeway := a.jwtSecret, a.jwks, a.issuer, a.audience, a.leeway
+	a.mu.RUnlock()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", ErrInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if secret == "" {
+			return nil, fmt.Errorf("%w: HS256 not configured", ErrInvalidToken)
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case "RS256":
+		if jwks == nil {
+			return nil, fmt.Errorf("%w: RS256 not configured", ErrInvalidToken)
+		}
+		key, err := jwks.Key(ctx, header.Kid)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+	}
+
+	var claims Claims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrInvalidToken, err)
+	}
+
+	now := a.now()
+	if exp, ok := claims.time("exp"); ok && !now.Before(exp.Add(leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if issuer != "" && claims["iss"] != issuer {
+		return nil, fmt.Errorf("%w: issuer", ErrInvalidToken)
+	}
+	if audience != "" && !claims.hasAudience(audience) {
+		return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// ForwardClaims copies the configured claims into backend request headers
+func (a *Authenticator) ForwardClaims(r *http.Request, claims Claims) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for claim, header := range a.claimHeaders {
+		switch value := claims[claim].(type) {
+		case nil:
+		case string:
+			r.Header.Set(header, value)
+		case []interface{}:
+			parts := make([]string, 0, len(value))
+			for _, v := range value {
+				parts = append(parts, fmt.Sprint(v))
+			}
+			r.Header.Set(header, strings.Join(parts, " "))
+		default:
+			r.Header.Set(header, fmt.Sprint(value))
+		}
+	}
+}
+
+// stripClaimHeaders removes client-supplied copies of the claim headers
+func (a *Authenticator) stripClaimHeaders(r *http.Request) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, header := range a.claimHeaders {
+		r.Header.Del(header)
+	}
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	seconds, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func (c Claims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JWKSCache fetches and caches RSA signing keys from a JWKS endpoint
+type JWKSCache struct {
+	url       string
+	ttl       time.Duration
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// jwksMinRefresh stops unknown key IDs from hammering the JWKS endpoint
+const jwksMinRefresh = 5 * time.Second
+
+// NewJWKSCache creates a cache for the key set at url
+func NewJWKSCache(url string, ttl time.Duration) *JWKSCache {
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return &JWKSCache{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Key returns the key with the given ID, refetching the set when it is
+// stale or the ID is unknown (keys may have been rotated)
+func (jc *JWKSCache) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	age := time.Since(jc.fetchedAt)
+	key, ok := jc.keys[kid]
+	if ok && age < jc.ttl {
+		return key, nil
+	}
+	if jc.keys == nil || age >= jc.ttl || age >= jwksMinRefresh {
+		if err := jc.refresh(ctx); err != nil {
+			// Keep serving known keys while the endpoint is down
+			if ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		key, ok = jc.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (jc *JWKSCache) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", jc.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	jc.keys = keys
+	jc.fetchedAt = time.Now()
+	return nil
+}
+
+// NewResponseCache creates a new response cache with the default bounds
+func NewResponseCache() *ResponseCache {
+	return NewResponseCacheWithLimits(defaultCacheMaxEntries, defaultCacheMaxBytes)
+}
+
+// NewResponseCacheWithLimits creates a cache holding at most maxEntries
+// responses and maxBytes of bodies; 0 means no limit
+func NewResponseCacheWithLimits(maxEntries int, maxBytes int64) *ResponseCache {
+	cache := &ResponseCache{
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		vary:         make(map[string][]string),
+		revalidating: make(map[string]bool),
+		maxEntries:   maxEntries,
+		maxBytes:     maxBytes,
+	}
+	go cache.cleanup()
+	return cache
+}
+
+// Get retrieves a fresh cached response
+func (rc *ResponseCache) Get(key string) []byte {
+	entry, state := rc.Lookup(key)
+	if state != cacheFresh {
+		return nil
+	}
+	return entry.Data
+}
+
+// Lookup returns the entry under key and how usable it is
+func (rc *ResponseCache) Lookup(key string) (*CacheEntry, cacheState) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, exists := rc.entries[key]
+	if !exists {
+		return nil, cacheMiss
+	}
+	rc.lru.MoveToFront(elem)
+	entry := elem.Value.(*CacheEntry)
+
+	now := time.Now()
+	switch {
+	case !now.After(entry.ExpiresAt):
+		return entry, cacheFresh
+	case !now.After(entry.StaleUntil):
+		return entry, cacheStale
+	default:
+		return entry, cacheExpired
+	}
+}
+
+// Set stores a response in cache
+func (rc *ResponseCache) Set(key string, data []byte, ttl time.Duration) {
+	rc.store(&CacheEntry{key: key, Data: data, ExpiresAt: time.Now().Add(ttl)})
+}
+
+// VariantKey extends a request's base key with the request headers its
+// cached responses vary on
+func (rc *ResponseCache) VariantKey(baseKey string, r *http.Request) string {
+	rc.mu.RLock()
+	names := rc.vary[baseKey]
+	rc.mu.RUnlock()
+	return variantKey(baseKey, names, r)
+}
+
+func variantKey(baseKey string, names []string, r *http.Request) string {
+	if len(names) == 0 {
+		return baseKey
+	}
+	h := sha256.New()
+	h.Write([]byte(baseKey))
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s=%s", name, strings.Join(r.Header.Values(name), ","))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// StoreResponse caches a backend response for r, honouring its Vary and
+// ETag headers. It returns false for responses that can't be shared.
+func (rc *ResponseCache) StoreResponse(baseKey string, r *http.Request, data []byte, header http.Header, ttl, staleWhileRevalidate time.Duration) bool {
+	names, ok := varyHeaders(header)
+	if !ok || !sharedCacheable(header) {
+		return false
+	}
+
+	rc.mu.Lock()
+	rc.vary[baseKey] = names
+	rc.mu.Unlock()
+
+	header = header.Clone()
+	for _, name := range gatewayHeaders {
+		header.Del(name)
+	}
+	now := time.Now()
+	rc.store(&CacheEntry{
+		key:        variantKey(baseKey, names, r),
+		path:       r.URL.Path,
+		Data:       data,
+		Header:     header,
+		ExpiresAt:  now.Add(ttl),
+		StaleUntil: now.Add(ttl + staleWhileRevalidate),
+		etag:       header.Get("ETag"),
+	})
+	return true
+}
+
+// Refresh extends an entry after the backend confirmed it is unchanged
+func (rc *ResponseCache) Refresh(key string, ttl, staleWhileRevalidate time.Duration) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[key]; ok {
+		entry := *elem.Value.(*CacheEntry)
+		now := time.Now()
+		entry.ExpiresAt = now.Add(ttl)
+		entry.StaleUntil = now.Add(ttl + staleWhileRevalidate)
+		elem.Value = &entry
+	}
+}
+
+func (rc *ResponseCache) store(entry *CacheEntry) {
+	size := int64(len(entry.Data))
+	if rc.maxBytes > 0 && size > rc.maxBytes {
+		return
+	}
+	if entry.StaleUntil.Before(entry.ExpiresAt) {
+		entry.StaleUntil = entry.ExpiresAt
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if elem, ok := rc.entries[entry.key]; ok {
+		rc.removeElement(elem)
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	rc.bytes += size
+
+	for (rc.maxEntries > 0 && rc.lru.Len() > rc.maxEntries) || (rc.maxBytes > 0 && rc.bytes > rc.maxBytes) {
+		rc.removeElement(rc.lru.Back())
+	}
+}
+
+func (rc *ResponseCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*CacheEntry)
+	rc.lru.Remove(elem)
+	delete(rc.entries, entry.key)
+	rc.bytes -= int64(len(entry.Data))
+}
+
+// Len returns the number of cached responses
+func (rc *ResponseCache) Len() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.lru.Len()
+}
+
+// Invalidate removes a cache entry
+func (rc *ResponseCache) Invalidate(key string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if elem, ok := rc.entries[key]; ok {
+		rc.removeElement(elem)
+	}
+}
+
+// Purge removes the entries cached for paths starting with prefix, or
+// every entry when prefix is empty. It returns how many were removed.
+func (rc *ResponseCache) Purge(prefix string) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	purged := 0
+	for _, elem := range rc.entries {
+		if strings.HasPrefix(elem.Value.(*CacheEntry).path, prefix) {
+			rc.removeElement(elem)
+			purged++
+		}
+	}
+	if prefix == "" {
+		rc.vary = make(map[string][]string)
+	}
+	return purged
+}
+
+// beginRevalidate claims the background refresh of key, so concurrent
+// stale hits trigger a single backend request
+func (rc *ResponseCache) beginRevalidate(key string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.revalidating[key] {
+		return false
+	}
+	rc.revalidating[key] = true
+	return true
+}
+
+func (rc *ResponseCache) endRevalidate(key string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.revalidating, key)
+}
+
+// cleanup removes entries that can no longer be served. Expired entries
+// with an ETag are kept for conditional revalidation until evicted.
+func (rc *ResponseCache) cleanup() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rc.mu.Lock()
+		now := time.Now()
+		for _, elem := range rc.entries {
+			entry := elem.Value.(*CacheEntry)
+			if now.After(entry.StaleUntil) && entry.etag == "" {
+				rc.removeElement(elem)
+			}
+		}
+		rc.mu.Unlock()
+	}
+}
+
+// gatewayHeaders are set per request by the gateway and never cached
+var gatewayHeaders = []string{"X-Cache", "X-RateLimit-Limit", "X-RateLimit-Remaining", "Retry-After"}
+
+// varyHeaders returns the canonical request header names a response
+// varies on, or false for Vary: *
+func varyHeaders(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// sharedCacheable reports whether a shared cache may store the response
+func sharedCacheable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	return !headerHasToken(header, "Cache-Control", "no-store") &&
+		!headerHasToken(header, "Cache-Control", "private")
+}
+
+// NewCircuitBreaker creates a closed circuit breaker; name identifies it
+// in events
+func NewCircuitBreaker(name string, cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.Buckets <= 0 {
+		cfg.Buckets = 10
+	}
+	if cfg.ErrorPercent <= 0 {
+		cfg.ErrorPercent = 50
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 10 * time.Second
+	}
+	if cfg.HalfOpenSuccesses <= 0 {
+		cfg.HalfOpenSuccesses = 2
+	}
+	return &CircuitBreaker{
+		name:    name,
+		cfg:     cfg,
+		state:   "closed",
+		buckets: make([]cbBucket, cfg.Buckets),
+		now:     time.Now,
+	}
+}
+
+// AllowRequest reports whether a request may go to the backend. In the
+// half-open state it admits one probe at a time; the caller must record
+// the probe's result.
+func (cb *CircuitBreaker) AllowRequest() bool {
+	cb.mu.Lock()
+	now := cb.now()
+	var event *CircuitEvent
+	allowed := false
+
+	switch cb.state {
+	case "closed":
+		allowed = true
+	case "open":
+		if !cb.tripped && !now.Before(cb.openedAt.Add(cb.cfg.OpenTimeout)) {
+			event = cb.transition("half-open", now)
+			cb.probesOK = 0
+			cb.probeUntil = now.Add(cb.cfg.OpenTimeout)
+			allowed = true
+		}
+	case "half-open":
+		// A probe whose result never came back frees its slot after
+		// OpenTimeout
+		if cb.probeUntil.IsZero() || now.After(cb.probeUntil) {
+			cb.probeUntil = now.Add(cb.cfg.OpenTimeout)
+			allowed = true
+		}
+	}
+	cb.mu.Unlock()
+
+	cb.notify(event)
+	return allowed
+}
+
+// Ready is AllowRequest without claiming a probe slot, for load balancers
+// choosing between backends
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	switch cb.state {
+	case "open":
+		return !cb.tripped && !now.Before(cb.openedAt.Add(cb.cfg.OpenTimeout))
+	case "half-open":
+		return cb.probeUntil.IsZero() || now.After(cb.probeUntil)
+	}
+	return true
+}
+
+// RecordSuccess records a successful request
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.record(true)
+}
+
+// RecordFailure records a failed request
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.record(false)
+}
+
+func (cb *CircuitBreaker) record(ok bool) {
+	cb.mu.Lock()
+	now := cb.now()
+	var event *CircuitEvent
+
+	switch cb.state {
+	case "half-open":
+		cb.probeUntil = time.Time{}
+		if !ok {
+			event = cb.transition("open", now)
+			cb.openedAt = now
+			break
+		}
+		cb.probesOK++
+		if cb.probesOK >= cb.cfg.HalfOpenSuccesses {
+			event = cb.transition("closed", now)
+			for i := range cb.buckets {
+				cb.buckets[i] = cbBucket{}
+			}
+		}
+	case "closed":
+		b := cb.bucket(now)
+		if ok {
+			b.successes++
+			break
+		}
+		b.failures++
+		requests, failures := cb.counts(now)
+		percent := 100 * float64(failures) / float64(requests)
+		if requests >= cb.cfg.MinRequests && percent >= cb.cfg.ErrorPercent {
+			event = cb.transition("open", now)
+			event.ErrorPercent, event.Requests = percent, requests
+			cb.openedAt = now
+		}
+	}
+	// Results arriving while open come from requests sent before it
+	// opened; they say nothing new
+	cb.mu.Unlock()
+
+	cb.notify(event)
+}
+
+// bucket returns the current bucket, clearing it if it last held an older
+// slice of time
+func (cb *CircuitBreaker) bucket(now time.Time) *cbBucket {
+	width := cb.cfg.Window / time.Duration(cb.cfg.Buckets)
+	epoch := now.UnixNano() / int64(width)
+	b := &cb.buckets[epoch%int64(len(cb.buckets))]
+	if b.epoch != epoch {
+		*b = cbBucket{epoch: epoch}
+	}
+	return b
+}
+
+// counts sums the buckets still inside the window
+func (cb *CircuitBreaker) counts(now time.Time) (requests, failures int) {
+	width := cb.cfg.Window / time.Duration(cb.cfg.Buckets)
+	current := now.UnixNano() / int64(width)
+	for _, b := range cb.buckets {
+		if current-b.epoch < int64(len(cb.buckets)) {
+			requests += b.successes + b.failures
+			failures += b.failures
+		}
+	}
+	return requests, failures
+}
+
+// Counts returns the requests and failures in the current window
+func (cb *CircuitBreaker) Counts() (requests, failures int) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.counts(cb.now())
+}
+
+// transition changes state under cb.mu and returns the event to deliver
+// once the lock is released
+func (cb *CircuitBreaker) transition(to string, now time.Time) *CircuitEvent {
+	event := &CircuitEvent{Name: cb.name, From: cb.state, To: to, Time: now}
+	cb.state = to
+	return event
+}
+
+func (cb *CircuitBreaker) notify(event *CircuitEvent) {
+	if event != nil && cb.cfg.OnStateChange != nil {
+		cb.cfg.OnStateChange(*event)
+	}
+}
+
+// State returns "closed", "open" or "half-open"
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Trip opens the circuit and keeps it open, without probing, until Reset
+func (cb *CircuitBreaker) Trip() {
+	cb.mu.Lock()
+	now := cb.now()
+	var event *CircuitEvent
+	if cb.state != "open" {
+		event = cb.transition("open", now)
+		cb.openedAt = now
+	}
+	cb.tripped = true
+	cb.probeUntil = time.Time{}
+	cb.mu.Unlock()
+
+	cb.notify(event)
+}
+
+// Reset closes the circuit and forgets the results in the window
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	now := cb.now()
+	var event *CircuitEvent
+	if cb.state != "closed" {
+		event = cb.transition("closed", now)
+	}
+	cb.tripped = false
+	cb.probeUntil = time.Time{}
+	cb.probesOK = 0
+	for i := range cb.buckets {
+		cb.buckets[i] = cbBucket{}
+	}
+	cb.mu.Unlock()
+
+	cb.notify(event)
+}
+
+// NewLoadBalancer creates a new load balancer
+func NewLoadBalancer(backends []*Backend, strategy string) *LoadBalancer {
+	lb := &LoadBalancer{
+		backends: backends,
+		strategy: strategy,
+	}
+	switch strategy {
+	case WeightedRoundRobin:
+		lb.current = make([]int, len(backends))
+	case ConsistentHash:
+		lb.ring = buildRing(backends)
+	}
+	return lb
+}
+
+// SelectBackend selects a healthy backend for the request, or nil when
+// there is none
+func (lb *LoadBalancer) SelectBackend() *Backend {
+	return lb.SelectBackendForKey("")
+}
+
+// SelectBackendForKey is SelectBackend for consistent hashing: requests
+// with the same key go to the same backend while it stays healthy. Other
+// strategies, and an empty key, ignore it.
+func (lb *LoadBalancer) SelectBackendForKey(key string) *Backend {
+	if len(lb.backends) == 0 {
+		return nil
+	}
+
+	switch lb.strategy {
+	case LeastConnections:
+		return lb.selectLeastConnections()
+	case WeightedRoundRobin:
+		return lb.selectWeighted()
+	case ConsistentHash:
+		if key != "" {
+			return lb.selectHashed(key)
+		}
+		return lb.selectRoundRobin()
+	default:
+		return lb.selectRoundRobin()
+	}
+}
+
+// SelectBackendExcluding prefers a backend not in tried, falling back to
+// SelectBackend once every backend has been tried
+func (lb *LoadBalancer) SelectBackendExcluding(tried map[*Backend]bool) *Backend {
+	for i := 0; i < len(lb.backends); i++ {
+		if backend := lb.SelectBackend(); !tried[backend] {
+			return backend
+		}
+	}
+	// The strategy keeps picking tried backends; take any other one
+	for _, backend := range lb.backends {
+		if !tried[backend] && lb.available(backend) {
+			return backend
+		}
+	}
+	return lb.SelectBackend()
+}
+
+// available reports whether backend may receive traffic: it is healthy
+// and its circuit breaker would let a request through
+func (lb *LoadBalancer) available(backend *Backend) bool {
+	if lb.health != nil && !lb.health.IsHealthy(backend) {
+		return false
+	}
+	cb := backend.breaker.Load()
+	return cb == nil || cb.Ready()
+}
+
+// selectRoundRobin selects the next healthy backend in turn
+func (lb *LoadBalancer) selectRoundRobin() *Backend {
+	for i := 0; i < len(lb.backends); i++ {
+		idx := lb.roundRobinIdx.Add(1)
+		if backend := lb.backends[int(idx)%len(lb.backends)]; lb.available(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// selectWeighted is nginx's smooth weighted round-robin: each pick raises
+// every healthy backend's current weight by its weight, then takes the
+// highest and lowers it by the total. Picks follow the weight ratios
+// without bursts to one backend.
+func (lb *LoadBalancer) selectWeighted() *Backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	best, total := -1, 0
+	for i, backend := range lb.backends {
+		if !lb.available(backend) {
+			continue
+		}
+		weight := backendWeight(backend)
+		lb.current[i] += weight
+		total += weight
+		if best < 0 || lb.current[i] > lb.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	lb.current[best] -= total
+	return lb.backends[best]
+}
+
+// selectHashed walks the ring clockwise from key's hash to the first
+// healthy backend, so a backend going down only moves its own keys
+func (lb *LoadBalancer) selectHashed(key string) *Backend {
+	h := hashKey(key)
+	start := sort.Search(len(lb.ring), func(i int) bool { return lb.ring[i].hash >= h })
+	for i := 0; i < len(lb.ring); i++ {
+		node := lb.ring[(start+i)%len(lb.ring)]
+		if lb.available(node.backend) {
+			return node.backend
+		}
+	}
+	return nil
+}
+
+// buildRing places ringReplicas virtual nodes per unit of weight for each
+// backend. Nodes are named after the backend URL, so a backend keeps its
+// place on the ring when others are added or removed.
+func buildRing(backends []*Backend) []ringNode {
+	var ring []ringNode
+	for _, backend := range backends {
+		replicas := ringReplicas * backendWeight(backend)
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ringNode{hashKey(fmt.Sprintf("%s#%d", backend.URL, i)), backend})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV-1a spreads short, similar keys unevenly; a splitmix64 finalizer
+	// scatters them around the ring
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// backendWeight treats unset and invalid weights as 1
+func backendWeight(backend *Backend) int {
+	if backend.Weight > 0 {
+		return backend.Weight
+	}
+	return 1
+}
+
+// selectLeastConnections selects the healthy backend with least connections
+func (lb *LoadBalancer) selectLeastConnections() *Backend {
+	var selected *Backend
+	var minRequests int64
+	for _, backend := range lb.backends {
+		if !lb.available(backend) {
+			continue
+		}
+		if reqs := backend.TotalRequests.Load(); selected == nil || reqs < minRequests {
+			minRequests = reqs
+			selected = backend
+		}
+	}
+	return selected
+}
+
+// NewHealthChecker creates a new health checker
+func NewHealthChecker(interval time.Duration) *HealthChecker {
+	return &HealthChecker{
+		backends:         make([]*Backend, 0),
+		interval:         interval,
+		healthy:          make(map[string]bool),
+		lastCheck:        make(map[string]time.Time),
+		failures:         make(map[string]int),
+		recoveries:       make(map[string]int),
+		failThreshold:    defaultFailThreshold,
+		recoverThreshold: defaultRecoverThreshold,
+		client:           &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// SetThresholds changes how many consecutive failures mark a backend down
+// and how many passing probes bring it back
+func (hc *HealthChecker) SetThresholds(fail, recover int) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if fail > 0 {
+		hc.failThreshold = fail
+	}
+	if recover > 0 {
+		hc.recoverThreshold = recover
+	}
+}
+
+// Register registers backends for health checking. A backend whose URL is
+// already known keeps its health but takes over probing, so a reloaded
+// HealthURL applies.
+func (hc *HealthChecker) Register(backends []*Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for _, backend := range backends {
+		key := backend.URL.String()
+		if _, exists := hc.healthy[key]; exists {
+			for i, known := range hc.backends {
+				if known.URL.String() == key {
+					hc.backends[i] = backend
+				}
+			}
+			continue
+		}
+		hc.backends = append(hc.backends, backend)
+		hc.healthy[key] = true
+	}
+}
+
+// Prune forgets every backend whose URL is not among keep
+func (hc *HealthChecker) Prune(keep []*Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	live := make(map[string]bool, len(keep))
+	for _, backend := range keep {
+		live[backend.URL.String()] = true
+	}
+	kept := hc.backends[:0]
+	for _, backend := range hc.backends {
+		key := backend.URL.String()
+		if live[key] {
+			kept = append(kept, backend)
+			continue
+		}
+		delete(hc.healthy, key)
+		delete(hc.lastCheck, key)
+		delete(hc.failures, key)
+		delete(hc.recoveries, key)
+	}
+	hc.backends = kept
+}
+
+// Start runs health checks every interval until Stop is called
+func (hc *HealthChecker) Start() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.stop != nil {
+		return
+	}
+	hc.stop = make(chan struct{})
+	go hc.run(hc.stop)
+}
+
+// Stop ends the health check loop
+func (hc *HealthChecker) Stop() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.stop != nil {
+		close(hc.stop)
+		hc.stop = nil
+	}
+}
+
+func (hc *HealthChecker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			hc.CheckAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// CheckAll probes every backend with a HealthURL, and every backend that
+// is down so it can recover. Healthy backends without a HealthURL rely on
+// passive checks alone.
+func (hc *HealthChecker) CheckAll() {
+	hc.mu.RLock()
+	var due []*Backend
+	for _, backend := range hc.backends {
+		if backend.HealthURL != "" || !hc.healthy[backend.URL.String()] {
+			due = append(due, backend)
+		}
+	}
+	hc.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, backend := range due {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			hc.record(backend, hc.Check(backend))
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// Check performs a health check. Without a HealthURL the backend itself
+// is probed and any answer below 500 counts as passing.
+func (hc *HealthChecker) Check(backend *Backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	target := backend.HealthURL
+	if target == "" {
+		target = backend.URL.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if backend.HealthURL == "" {
+		return resp.StatusCode < http.StatusInternalServerError
+	}
+	return resp.StatusCode == http.StatusOK
+}
+
+// ReportResult feeds the status of a proxied request into passive health
+// checking: consecutive 5xx answers mark the backend down
+func (hc *HealthChecker) ReportResult(backend *Backend, status int) {
+	if status < http.StatusInternalServerError {
+		hc.mu.Lock()
+		if hc.healthy[backend.URL.String()] {
+			hc.failures[backend.URL.String()] = 0
+		}
+		hc.mu.Unlock()
+		return
+	}
+	hc.record(backend, false)
+}
+
+// record applies one check result to the backend's health
+func (hc *HealthChecker) record(backend *Backend, ok bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	key := backend.URL.String()
+	healthy, known := hc.healthy[key]
+	if !known {
+		return
+	}
+	hc.lastCheck[key] = time.Now()
+
+	switch {
+	case ok && healthy:
+		hc.failures[key] = 0
+	case ok:
+		hc.recoveries[key]++
+		if hc.recoveries[key] >= hc.recoverThreshold {
+			hc.healthy[key] = true
+			hc.failures[key] = 0
+			hc.recoveries[key] = 0
+		}
+	case healthy:
+		hc.failures[key]++
+		if hc.failures[key] >= hc.failThreshold {
+			hc.healthy[key] = false
+			hc.recoveries[key] = 0
+		}
+	default:
+		hc.recoveries[key] = 0
+	}
+}
+
+// IsHealthy returns the health status of a backend. Backends the checker
+// doesn't know about are assumed healthy.
+func (hc *HealthChecker) IsHealthy(backend *Backend) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	healthy, known := hc.healthy[backend.URL.String()]
+	return healthy || !known
+}
+
+// NewMetrics creates a new metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requestsByCode: make(map[int]int64),
+		requests:       make(map[requestSeries]int64),
+		latencies:      make(map[latencySeries]*histogram),
+	}
+}
+
+// observe records one finished request in the labeled series. route is
+// the matched pattern, empty when no route matched.
+func (m *Metrics) observe(route, method string, status int, latency time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	method = metricMethod(method)
+	seconds := latency.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requestsByCode[status]++
+	m.requests[requestSeries{route, method, fmt.Sprintf("%dxx", status/100)}]++
+
+	key := latencySeries{route, method}
+	h := m.latencies[key]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latencies[key] = h
+	}
+	h.counts[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	h.sum += seconds
+	h.count++
+}
+
+// metricMethod folds unknown methods into one label value, so clients
+// can't create series at will
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// recordSuccess records a successful request
+func (m *Metrics) recordSuccess(latency time.Duration, code int) {
+	m.totalRequests.Add(1)
+	m.totalLatency.Add(latency.Milliseconds())
+}
+
+// recordError records a failed request
+func (m *Metrics) recordError() {
+	m.totalErrors.Add(1)
+	m.totalRequests.Add(1)
+}
+
+// GetMetrics returns current metrics
+func (m *Metrics) GetMetrics() map[string]interface{} {
+	total := m.totalRequests.Load()
+	errors := m.totalErrors.Load()
+	latency := m.totalLatency.Load()
+
+	avgLatency := int64(0)
+	if total > 0 {
+		avgLatency = latency / total
+	}
+
+	m.mu.RLock()
+	byCode := make(map[int]int64, len(m.requestsByCode))
+	for code, n := range m.requestsByCode {
+		byCode[code] = n
+	}
+	m.mu.RUnlock()
+
+	return map[string]interface{}{
+		"total_requests":   total,
+		"total_errors":     errors,
+		"error_rate":       float64(errors) / float64(total),
+		"avg_latency_ms":   avgLatency,
+		"active_requests":  m.activeRequests.Load(),
+		"requests_by_code": byCode,
+	}
+}
+
+// circuitStates maps breaker states to gateway_circuit_breaker_state values
+var circuitStates = map[string]int{"closed": 0, "half-open": 1, "open": 2}
+
+// MetricsHandler serves the gateway's metrics in the Prometheus text
+// exposition format
+func (ag *APIGateway) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ag.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes every metric, with series sorted so scrapes are
+// stable
+func (ag *APIGateway) WritePrometheus(w io.Writer) {
+	m := ag.metrics
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m.mu.RLock()
+	requests := make([]requestSeries, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.class < b.class
+	})
+	fmt.Fprintln(bw, "# HELP gateway_requests_total Requests handled, by route, method and status class.")
+	fmt.Fprintln(bw, "# TYPE gateway_requests_total counter")
+	for _, key := range requests {
+		fmt.Fprintf(bw, "gateway_requests_total{route=%s,method=%s,status=%s} %d\n",
+			promLabel(key.route), promLabel(key.method), promLabel(key.class), m.requests[key])
+	}
+
+	latencies := make([]latencySeries, 0, len(m.latencies))
+	for key := range m.latencies {
+		latencies = append(latencies, key)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		if latencies[i].route != latencies[j].route {
+			return latencies[i].route < latencies[j].route
+		}
+		return latencies[i].method < latencies[j].method
+	})
+	fmt.Fprintln(bw, "# HELP gateway_request_duration_seconds Request latency, by route and method.")
+	fmt.Fprintln(bw, "# TYPE gateway_request_duration_seconds histogram")
+	for _, key := range latencies {
+		h := m.latencies[key]
+		labels := fmt.Sprintf("route=%s,method=%s", promLabel(key.route), promLabel(key.method))
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "gateway_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "gateway_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(bw, "gateway_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "gateway_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	m.mu.RUnlock()
+
+	fmt.Fprintln(bw, "# HELP gateway_active_requests Requests in flight.")
+	fmt.Fprintln(bw, "# TYPE gateway_active_requests gauge")
+	fmt.Fprintf(bw, "gateway_active_requests %d\n", m.activeRequests.Load())
+
+	ag.mu.RLock()
+	backends := make([]string, 0, len(ag.circuitBreakers))
+	breakers := make(map[string]*CircuitBreaker, len(ag.circuitBreakers))
+	for backend, cb := range ag.circuitBreakers {
+		backends = append(backends, backend)
+		breakers[backend] = cb
+	}
+	ag.mu.RUnlock()
+	sort.Strings(backends)
+
+	fmt.Fprintln(bw, "# HELP gateway_circuit_breaker_state Circuit breaker state per backend: 0 closed, 1 half-open, 2 open.")
+	fmt.Fprintln(bw, "# TYPE gateway_circuit_breaker_state gauge")
+	for _, backend := range backends {
+		fmt.Fprintf(bw, "gateway_circuit_breaker_state{backend=%s} %d\n", promLabel(backend), circuitStates[breakers[backend].State()])
+	}
+}
+
+// promLabel quotes a label value, escaping as the exposition format requires
+func promLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+// Helper functions
+
+func matchPath(pattern, path string) bool {
+	if pattern == "/" {
+		return true
+	}
+	if pattern == path {
+		return true
+	}
+	if len(pattern) > 0 && pattern[len(pattern)-1] == '*' {
+		return len(path) >= len(pattern)-1 && path[:len(pattern)-1] == pattern[:len(pattern)-1]
+	}
+	return false
 }
 
-// generateCacheKey generates a cache key for the request
-func (ag *APIGateway) generateCacheKey(r *http.Request) string {
-	h := sha256.New()
-	h.Write([]byte(r.Method + ":" + r.URL.String()))
-	return fmt.Sprintf("%x", h.Sum(nil))
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(r.Header, "Connection", "upgrade")
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter(perMinute int) *RateLimiter {
-	return &RateLimiter{
-		clientBuckets: make(map[string]*TokenBucket),
-		perMinute:     perMinute,
-	}
+func acceptsEventStream(r *http.Request) bool {
+	return headerHasToken(r.Header, "Accept", "text/event-stream")
 }
 
-// AllowRequest checks if a request is allowed
-func (rl *RateLimiter) AllowRequest(clientID string) bool {
-	if rl.perMinute == 0 {
-		return true
-	}
-
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
 
-	bucket, exists := rl.clientBuckets[clientID]
-	if !exists {
-		bucket = &TokenBucket{
-			maxTokens: int64(rl.perMinute),
+// headerHasToken reports whether a comma-separated header contains token,
+// ignoring case and parameters
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			part, _, _ = strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
 		}
-		bucket.tokens.Store(int64(rl.perMinute))
-		bucket.refillAt.Store(time.Now().Add(time.Minute).UnixNano())
-		rl.clientBuckets[clientID] = bucket
 	}
+	return false
+}
 
-	now := time.Now().UnixNano()
-	refillAt := bucket.refillAt.Load()
-	if now >= refillAt {
-		bucket.tokens.Store(bucket.maxTokens)
-		bucket.refillAt.Store(time.Now().Add(time.Minute).UnixNano())
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
 	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
 
-	tokens := bucket.tokens.Load()
-	if tokens > 0 {
-		bucket.tokens.Add(-1)
+// isIdempotent reports whether a request can safely be sent twice
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
 		return true
 	}
 	return false
 }
 
-// NewAuthenticator creates a new authenticator
-func NewAuthenticator() *Authenticator {
-	return &Authenticator{
-		apiKeys:   make(map[string]bool),
-		jwtSecret: "secret-key",
+func methodAllowed(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method || m == "*" {
+			return true
+		}
 	}
+	return false
 }
 
-// RegisterAPIKey registers an API key
-func (a *Authenticator) RegisterAPIKey(key string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.apiKeys[key] = true
+type responseWriterWrapper struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header // response headers as written
+	body       []byte
+	limit      int64 // capture at most this many bytes; 0 means no limit
+	discard    bool  // capture nothing
+	overflow   bool  // body exceeded limit and was dropped
 }
 
-// ValidateRequest validates the request authentication
-func (a *Authenticator) ValidateRequest(r *http.Request) bool {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
-		return a.apiKeys[apiKey]
+func (rw *responseWriterWrapper) WriteHeader(statusCode int) {
+	// Event streams never end on their own, so never buffer them
+	if isEventStream(rw.Header()) {
+		rw.discard = true
 	}
+	rw.statusCode = statusCode
+	rw.header = rw.Header().Clone()
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
 
-	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
-		// Basic JWT validation (simplified)
-		return len(authHeader) > 7
+func (rw *responseWriterWrapper) Write(data []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
 	}
-
-	return false
+	if !rw.discard && !rw.overflow {
+		if rw.limit > 0 && int64(len(rw.body)+len(data)) > rw.limit {
+			rw.overflow = true
+			rw.body = nil
+		} else {
+			rw.body = append(rw.body, data...)
+		}
+	}
+	return rw.ResponseWriter.Write(data)
 }
 
-// NewResponseCache creates a new response cache
-func NewResponseCache() *ResponseCache {
-	cache := &ResponseCache{
-		entries: make(map[string]*CacheEntry),
+// Flush lets the reverse proxy push streamed chunks to the client
+func (rw *responseWriterWrapper) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
-	go cache.cleanup()
-	return cache
 }
 
-// Get retrieves a cached response
-func (rc *ResponseCache) Get(key string) []byte {
-	rc.mu.RLock()
-	defer rc.mu.RUnlock()
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
 
-	entry, exists := rc.entries[key]
-	if !exists {
-		return nil
-	}
-	if time.Now().After(entry.ExpiresAt) {
-		return nil
-	}
-	return entry.Data
+// cacheable reports whether body holds the complete response
+func (rw *responseWriterWrapper) cacheable() bool {
+	return !rw.discard && !rw.overflow
 }
 
-// Set stores a response in cache
-func (rc *ResponseCache) Set(key string, data []byte, ttl time.Duration) {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
+// bufferedResponse holds a whole backend response so a retry can replace it
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
 
-	rc.entries[key] = &CacheEntry{
-		Data:      data,
-		ExpiresAt: time.Now().Add(ttl),
-	}
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
 }
 
-// Invalidate removes a cache entry
-func (rc *ResponseCache) Invalidate(key string) {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
-	delete(rc.entries, key)
+func newGatewayErrorResponse(status int, message string) *bufferedResponse {
+	resp := newBufferedResponse()
+	resp.status = status
+	resp.header.Set("Content-Type", "application/json")
+	json.NewEncoder(&resp.body).Encode(map[string]string{"error": message})
+	return resp
 }
 
-// cleanup removes expired entries
-func (rc *ResponseCache) cleanup() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+func (br *bufferedResponse) Header() http.Header { return br.header }
 
-	for range ticker.C {
-		rc.mu.Lock()
-		now := time.Now()
-		for key, entry := range rc.entries {
-			if now.After(entry.ExpiresAt) {
-				delete(rc.entries, key)
-			}
-		}
-		rc.mu.Unlock()
+func (br *bufferedResponse) WriteHeader(statusCode int) {
+	if br.status == 0 {
+		br.status = statusCode
 	}
 }
 
-// NewCircuitBreaker creates a new circuit breaker
-func NewCircuitBreaker(failureThreshold, successThreshold int, timeout time.Duration) *CircuitBreaker {
-	cb := &CircuitBreaker{
-		failureThreshold: failureThreshold,
-		successThreshold: successThreshold,
-		timeout:          timeout,
+func (br *bufferedResponse) Write(data []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
 	}
-	cb.state.Store("closed")
-	return cb
+	return br.body.Write(data)
 }
 
-// AllowRequest checks if the circuit breaker allows requests
-func (cb *CircuitBreaker) AllowRequest() bool {
-	state := cb.state.Load().(string)
-	switch state {
-	case "closed":
-		return true
-	case "half-open":
-		return true
-	case "open":
-		if time.Now().After(cb.getLastFailTime().Add(cb.timeout)) {
-			cb.state.Store("half-open")
-			cb.successes.Store(0)
-			return true
-		}
-		return false
+func (br *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range br.header {
+		w.Header()[key] = values
 	}
-	return false
+	w.WriteHeader(br.status)
+	w.Write(br.body.Bytes())
 }
 
-// RecordSuccess records a successful request
-func (cb *CircuitBreaker) RecordSuccess() {
-	state := cb.state.Load().(string)
-	if state == "half-open" {
-		if cb.successes.Add(1) >= int32(cb.successThreshold) {
-			cb.state.Store("closed")
-			cb.failures.Store(0)
+// Transformation pipeline
+
+// RequestChain runs request transformers in order, stopping at the first
+// error
+type RequestChain []RequestTransformer
+
+func (c RequestChain) Transform(req *http.Request) error {
+	for _, t := range c {
+		if err := t.Transform(req); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-// RecordFailure records a failed request
-func (cb *CircuitBreaker) RecordFailure() {
-	state := cb.state.Load().(string)
-	cb.failures.Add(1)
+// ResponseChain runs response transformers in order. An error makes the
+// gateway answer 502.
+type ResponseChain []ResponseTransformer
 
-	if state == "closed" && cb.failures.Load() >= int32(cb.failureThreshold) {
-		cb.state.Store("open")
-		cb.lastFailTime.Store(time.Now())
-	} else if state == "half-open" {
-		cb.state.Store("open")
-		cb.lastFailTime.Store(time.Now())
+func (c ResponseChain) Transform(resp *http.Response) error {
+	for _, t := range c {
+		if err := t.Transform(resp); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (cb *CircuitBreaker) getLastFailTime() time.Time {
-	if t := cb.lastFailTime.Load(); t != nil {
-		return t.(time.Time)
-	}
-	return time.Now()
+// RequestHeaders sets and strips headers before the request is proxied
+type RequestHeaders struct {
+	Set    map[string]string
+	Remove []string
 }
 
-// NewLoadBalancer creates a new load balancer
-func NewLoadBalancer(backends []*Backend, strategy string) *LoadBalancer {
-	return &LoadBalancer{
-		backends: backends,
-		strategy: strategy,
-	}
+func (h *RequestHeaders) Transform(req *http.Request) error {
+	editHeaders(req.Header, h.Set, h.Remove)
+	return nil
 }
 
-// SelectBackend selects a backend for the request
-func (lb *LoadBalancer) SelectBackend() *Backend {
-	if len(lb.backends) == 0 {
-		return nil
-	}
-
-	switch lb.strategy {
-	case "least-connections":
-		return lb.selectLeastConnections()
-	default:
-		return lb.selectRoundRobin()
-	}
+// ResponseHeaders sets and strips headers on the backend's response
+type ResponseHeaders struct {
+	Set    map[string]string
+	Remove []string
 }
 
-// selectRoundRobin selects a backend using round-robin
-func (lb *LoadBalancer) selectRoundRobin() *Backend {
-	idx := lb.roundRobinIdx.Add(1)
-	return lb.backends[int(idx)%len(lb.backends)]
+func (h *ResponseHeaders) Transform(resp *http.Response) error {
+	editHeaders(resp.Header, h.Set, h.Remove)
+	return nil
 }
 
-// selectLeastConnections selects a backend with least connections
-func (lb *LoadBalancer) selectLeastConnections() *Backend {
-	minRequests := lb.backends[0].TotalRequests.Load()
-	selected := lb.backends[0]
-
-	for _, backend := range lb.backends[1:] {
-		reqs := backend.TotalRequests.Load()
-		if reqs < minRequests {
-			minRequests = reqs
-			selected = backend
-		}
+func editHeaders(header http.Header, set map[string]string, remove []string) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	for name, value := range set {
+		header.Set(name, value)
 	}
-	return selected
 }
 
-// NewHealthChecker creates a new health checker
-func NewHealthChecker(interval time.Duration) *HealthChecker {
-	return &HealthChecker{
-		backends:  make([]*Backend, 0),
-		interval:  interval,
-		healthy:   make(map[string]bool),
-		lastCheck: make(map[string]time.Time),
-	}
+// PathRewrite rewrites the request path before proxying. With a Pattern,
+// matches are replaced by Replacement, which may refer to groups as $1;
+// without one the whole path is replaced. {name} in Replacement expands to
+// the route's path parameter of that name.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
 }
 
-// Register registers backends for health checking
-func (hc *HealthChecker) Register(backends []*Backend) {
-	hc.mu.Lock()
-	defer hc.mu.Unlock()
+func (pr *PathRewrite) Transform(req *http.Request) error {
+	replacement := pr.Replacement
+	for name, value := range PathParams(req) {
+		replacement = strings.ReplaceAll(replacement, "{"+name+"}", value)
+	}
 
-	for _, backend := range backends {
-		key := backend.URL.String()
-		hc.backends = append(hc.backends, backend)
-		hc.healthy[key] = true
+	path := replacement
+	if pr.Pattern != nil {
+		path = pr.Pattern.ReplaceAllString(req.URL.Path, replacement)
 	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	return nil
 }
 
-// Check performs a health check
-func (hc *HealthChecker) Check(backend *Backend) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// JSONMask replaces the named fields of JSON responses with Mask ("***" by
+// default). Fields are dot-separated paths such as "user.ssn"; arrays along
+// the way are masked element by element. A gzip-encoded body is decoded
+// first, so compress after masking if the client should get it compressed.
+type JSONMask struct {
+	Fields []string
+	Mask   string
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", backend.HealthURL, nil)
+func (m *JSONMask) Transform(resp *http.Response) error {
+	if !isJSON(resp.Header) {
+		return nil
+	}
+	data, err := readDecodedBody(resp)
 	if err != nil {
-		return false
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		setBody(resp, data)
+		return nil
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		// Fail closed rather than leak the fields we couldn't find
+		return fmt.Errorf("mask json: %w", err)
 	}
-	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusOK
+	mask := m.Mask
+	if mask == "" {
+		mask = "***"
+	}
+	for _, field := range m.Fields {
+		maskPath(doc, strings.Split(field, "."), mask)
+	}
+	masked, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("mask json: %w", err)
+	}
+	setBody(resp, masked)
+	return nil
 }
 
-// IsHealthy returns the health status of a backend
-func (hc *HealthChecker) IsHealthy(backend *Backend) bool {
-	hc.mu.RLock()
-	defer hc.mu.RUnlock()
-	return hc.healthy[backend.URL.String()]
+func maskPath(node interface{}, path []string, mask string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = mask
+			return
+		}
+		maskPath(child, path[1:], mask)
+	case []interface{}:
+		for _, elem := range v {
+			maskPath(elem, path, mask)
+		}
+	}
 }
 
-// NewMetrics creates a new metrics collector
-func NewMetrics() *Metrics {
-	return &Metrics{
-		requestsByCode: make(map[int]atomic.Int64),
+// readDecodedBody reads the whole response body, undoing gzip encoding
+func readDecodedBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode gzip body: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+		resp.Header.Del("Content-Encoding")
+	default:
+		return nil, fmt.Errorf("cannot transform %s encoded body", encoding)
 	}
+	return io.ReadAll(body)
 }
 
-// recordSuccess records a successful request
-func (m *Metrics) recordSuccess(latency time.Duration, code int) {
-	m.totalRequests.Add(1)
-	m.totalLatency.Add(latency.Milliseconds())
+func setBody(resp *http.Response, data []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
 }
 
-// recordError records a failed request
-func (m *Metrics) recordError() {
-	m.totalErrors.Add(1)
-	m.totalRequests.Add(1)
+func isJSON(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
 }
 
-// GetMetrics returns current metrics
-func (m *Metrics) GetMetrics() map[string]interface{} {
-	total := m.totalRequests.Load()
-	errors := m.totalErrors.Load()
-	latency := m.totalLatency.Load()
+// Compress encodes responses with the first of Encodings (gzip by default)
+// the client accepts. Bodies are compressed as they stream, so it also
+// suits streamed routes; event streams and already encoded responses are
+// left alone. Responses with a known length under MinSize are skipped.
+type Compress struct {
+	Encodings []string
+	MinSize   int64
+}
 
-	avgLatency := int64(0)
-	if total > 0 {
-		avgLatency = latency / total
+func (c *Compress) Transform(resp *http.Response) error {
+	if resp.Header.Get("Content-Encoding") != "" || isEventStream(resp.Header) ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
 	}
-
-	return map[string]interface{}{
-		"total_requests":  total,
-		"total_errors":    errors,
-		"error_rate":      float64(errors) / float64(total),
-		"avg_latency_ms":  avgLatency,
-		"active_requests": m.activeRequests.Load(),
+	if resp.ContentLength >= 0 && resp.ContentLength < c.MinSize {
+		return nil
+	}
+	if !headerHasToken(resp.Header, "Vary", "Accept-Encoding") {
+		resp.Header.Add("Vary", "Accept-Encoding")
 	}
-}
-
-// Helper functions
 
-func matchPath(pattern, path string) bool {
-	if pattern == "/" {
-		return true
+	var acceptEncoding string
+	if resp.Request != nil {
+		acceptEncoding = resp.Request.Header.Get("Accept-Encoding")
 	}
-	if pattern == path {
-		return true
+	encodings := c.Encodings
+	if len(encodings) == 0 {
+		encodings = []string{"gzip"}
 	}
-	if len(pattern) > 0 && pattern[len(pattern)-1] == '*' {
-		return len(path) >= len(pattern)-1 && path[:len(pattern)-1] == pattern[:len(pattern)-1]
+	name := negotiateEncoding(acceptEncoding, encodings)
+	if name == "" {
+		return nil
+	}
+	newWriter := lookupEncoding(name)
+	if newWriter == nil {
+		return fmt.Errorf("unknown encoding %q", name)
 	}
-	return false
-}
 
-func methodAllowed(methods []string, method string) bool {
-	for _, m := range methods {
-		if m == method || m == "*" {
-			return true
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw := newWriter(pw)
+		_, err := io.Copy(zw, body)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
 		}
-	}
-	return false
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", name)
+	return nil
 }
 
-func findRouteKey(routes map[string]*Route, target *Route) string {
-	for key, route := range routes {
-		if route == target {
-			return key
+// negotiateEncoding picks the first offered encoding that acceptEncoding
+// allows with a non-zero quality
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+	for _, name := range offered {
+		if ok, listed := accepted[name]; listed {
+			if ok {
+				return name
+			}
+			continue
+		}
+		if accepted["*"] {
+			return name
 		}
 	}
 	return ""
 }
 
-type responseWriterWrapper struct {
-	http.ResponseWriter
-	statusCode int
-	body       []byte
-}
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser {
+			zw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return zw
+		},
+	}
+)
 
-func (rw *responseWriterWrapper) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
-	rw.ResponseWriter.WriteHeader(statusCode)
+// RegisterEncoding makes a content encoding available to Compress. The
+// standard library has no brotli, so register one to offer "br":
+//
+//	RegisterEncoding("br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) })
+func RegisterEncoding(name string, newWriter func(io.Writer) io.WriteCloser) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[name] = newWriter
 }
 
-func (rw *responseWriterWrapper) Write(data []byte) (int, error) {
-	rw.body = append(rw.body, data...)
-	return rw.ResponseWriter.Write(data)
+func lookupEncoding(name string) func(io.Writer) io.WriteCloser {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	return encodings[name]
 }
 
 // SimpleTransformer is a basic transformer for testing
@@ -716,6 +5555,15 @@ func (st *SimpleTransformer) Transform(req *http.Request) error {
 func main() {
 	gateway := NewAPIGateway()
 
+	// A config file replaces the built-in demo routes and is hot reloaded
+	if path := os.Getenv("GATEWAY_CONFIG"); path != "" {
+		if err := gateway.WatchConfig(context.Background(), path); err != nil {
+			log.Fatalf("load config: %v", err)
+		}
+		serve(gateway)
+		return
+	}
+
 	// Register API key
 	gateway.authenticator.RegisterAPIKey("test-key-123")
 
@@ -747,14 +5595,29 @@ func main() {
 	}
 
 	gateway.RegisterRoute("/api/users/*", route)
+	serve(gateway)
+}
 
-	// Start server
+func serve(gateway *APIGateway) {
 	http.Handle("/", gateway)
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/metrics", gateway.MetricsHandler())
+	if token := os.Getenv("GATEWAY_ADMIN_TOKEN"); token != "" {
+		http.Handle("/admin/", gateway.AdminHandler(token))
+	}
+	http.HandleFunc("/metrics.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(gateway.metrics.GetMetrics())
 	})
 
+	if certFile := os.Getenv("GATEWAY_TLS_CERT"); certFile != "" {
+		fmt.Println("API Gateway listening on :8443")
+		err := ListenTLS(":8443", nil, TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      os.Getenv("GATEWAY_TLS_KEY"),
+			ClientCAFile: os.Getenv("GATEWAY_CLIENT_CA"),
+		})
+		log.Fatal(err)
+	}
 	fmt.Println("API Gateway listening on :8080")
 	http.ListenAndServe(":8080", nil)
 }
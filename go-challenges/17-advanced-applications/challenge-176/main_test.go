@@ -1,11 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -51,7 +79,7 @@ func TestRouteRegistration(t *testing.T) {
 	if _, ok := gateway.rateLimiters["/api/test"]; !ok {
 		t.Error("rate limiter not initialized")
 	}
-	if _, ok := gateway.circuitBreakers["/api/test"]; !ok {
+	if _, ok := gateway.circuitBreakers[backends[0].URL.String()]; !ok {
 		t.Error("circuit breaker not initialized")
 	}
 	if _, ok := gateway.loadBalancers["/api/test"]; !ok {
@@ -145,9 +173,169 @@ func TestRateLimiterZeroLimit(t *testing.T) {
 	}
 }
 
+func TestRateLimiterSlidingWindow(t *testing.T) {
+	rl := NewRateLimiter(5)
+	now := time.Unix(1700000000, 0).Truncate(time.Minute)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if !rl.AllowRequest("c") {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	d, _ := rl.Allow(context.Background(), "c")
+	if d.Allowed || d.Scope != "client" {
+		t.Fatalf("6th request should be denied by the client limit: %+v", d)
+	}
+	// Full window plus decay: all 5 hits must slide out far enough for one more
+	if d.RetryAfter < 60*time.Second || d.RetryAfter > 73*time.Second {
+		t.Errorf("unexpected RetryAfter %v", d.RetryAfter)
+	}
+
+	// Halfway through the next window the previous 5 hits count as 2.5,
+	// so only 2 more fit, not a fresh burst of 5
+	now = now.Add(90 * time.Second)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if rl.AllowRequest("c") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected 2 requests allowed half a window later, got %d", allowed)
+	}
+
+	// Two windows later nothing from the first burst is left
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 5; i++ {
+		if !rl.AllowRequest("c") {
+			t.Errorf("request %d should be allowed after the window slides", i+1)
+		}
+	}
+}
+
+func TestRateLimiterRouteLimit(t *testing.T) {
+	rl := NewRateLimiterWithStore(3, 4, NewMemoryRateLimitStore(), "r|")
+
+	for i := 0; i < 3; i++ {
+		if !rl.AllowRequest("a") {
+			t.Fatalf("client a request %d should be allowed", i+1)
+		}
+	}
+	if d, _ := rl.Allow(context.Background(), "a"); d.Allowed || d.Scope != "client" {
+		t.Errorf("client a should hit its own limit: %+v", d)
+	}
+
+	if d, _ := rl.Allow(context.Background(), "b"); !d.Allowed || d.Remaining != 0 || d.Scope != "route" {
+		t.Errorf("client b should take the last route slot: %+v", d)
+	}
+	if d, _ := rl.Allow(context.Background(), "c"); d.Allowed || d.Scope != "route" {
+		t.Errorf("client c should hit the route limit: %+v", d)
+	}
+}
+
+// fakeRedis implements RedisClient in memory, recording expiries
+type fakeRedis struct {
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Duration
+	fail    bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: map[string]int64{}, expires: map[string]time.Duration{}}
+}
+
+func (f *fakeRedis) Get(ctx context.Context, key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return 0, errors.New("redis down")
+	}
+	return f.values[key], nil
+}
+
+func (f *fakeRedis) Incr(ctx context.Context, key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return 0, errors.New("redis down")
+	}
+	f.values[key]++
+	return f.values[key], nil
+}
+
+func (f *fakeRedis) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expires[key] = ttl
+	return nil
+}
+
+func TestRedisRateLimitStoreSharedAcrossGateways(t *testing.T) {
+	redis := newFakeRedis()
+	store := NewRedisRateLimitStore(redis, "gw:")
+
+	// Two gateway instances sharing one store share the limit
+	a := NewRateLimiterWithStore(3, 0, store, "/api|")
+	b := NewRateLimiterWithStore(3, 0, store, "/api|")
+	results := []bool{a.AllowRequest("c"), b.AllowRequest("c"), a.AllowRequest("c"), b.AllowRequest("c")}
+	if results[0] != true || results[1] != true || results[2] != true || results[3] != false {
+		t.Errorf("expected the 4th request across instances to be denied, got %v", results)
+	}
+
+	for key, ttl := range redis.expires {
+		if !strings.HasPrefix(key, "gw:/api|client:c:") || ttl != 2*time.Minute {
+			t.Errorf("unexpected expiry %q %v", key, ttl)
+		}
+	}
+
+	redis.fail = true
+	if !a.AllowRequest("c") {
+		t.Error("store errors should fail open")
+	}
+}
+
+func TestGatewayRateLimitHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api/limited", &Route{
+		Methods:         []string{"GET"},
+		Backends:        []*Backend{{URL: parseURL(backend.URL)}},
+		RateLimitPerMin: 2,
+	})
+
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/limited", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		last = httptest.NewRecorder()
+		gateway.ServeHTTP(last, req)
+		if i == 0 && last.Header().Get("X-RateLimit-Remaining") != "1" {
+			t.Errorf("expected 1 remaining, got %q", last.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+
+	if last.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", last.Code)
+	}
+	retryAfter, err := strconv.Atoi(last.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 {
+		t.Errorf("expected a positive Retry-After, got %q", last.Header().Get("Retry-After"))
+	}
+	if last.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("expected X-RateLimit-Limit 2, got %q", last.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
 func TestAuthenticator(t *testing.T) {
 	auth := NewAuthenticator()
 	auth.RegisterAPIKey("valid-key")
+	auth.ConfigureJWT(JWTConfig{Secret: "test-secret"})
 
 	tests := []struct {
 		name      string
@@ -170,9 +358,21 @@ func TestAuthenticator(t *testing.T) {
 		{
 			name:      "valid jwt",
 			headerKey: "Authorization",
-			value:     "Bearer eyJhbGc...",
+			value:     "Bearer " + signHS256(Claims{"sub": "user-1"}, "test-secret"),
 			expected:  true,
 		},
+		{
+			name:      "jwt with wrong secret",
+			headerKey: "Authorization",
+			value:     "Bearer " + signHS256(Claims{"sub": "user-1"}, "secret-key"),
+			expected:  false,
+		},
+		{
+			name:      "unsigned jwt",
+			headerKey: "Authorization",
+			value:     "Bearer eyJhbGc...",
+			expected:  false,
+		},
 		{
 			name:      "no auth",
 			headerKey: "",
@@ -196,6 +396,171 @@ func TestAuthenticator(t *testing.T) {
 	}
 }
 
+func TestAuthenticatorRequiresConfiguredSecret(t *testing.T) {
+	auth := NewAuthenticator()
+
+	for _, secret := range []string{"", "secret-key"} {
+		if _, err := auth.ValidateToken(context.Background(), signHS256(Claims{"sub": "user-1"}, secret)); err == nil {
+			t.Errorf("expected HS256 token signed with %q to be rejected before ConfigureJWT", secret)
+		}
+	}
+}
+
+func encodeJWTPart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(claims Claims, secret string) string {
+	signed := encodeJWTPart(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeJWTPart(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, claims Claims, key *rsa.PrivateKey, kid string) string {
+	signed := encodeJWTPart(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestValidateTokenHS256(t *testing.T) {
+	auth := NewAuthenticator()
+	auth.ConfigureJWT(JWTConfig{Secret: "s3cret", Issuer: "https://issuer", Audience: "gateway", Leeway: time.Second})
+	now := time.Unix(1700000000, 0)
+	auth.now = func() time.Time { return now }
+
+	valid := Claims{"sub": "u1", "iss": "https://issuer", "aud": []string{"other", "gateway"}, "exp": now.Add(time.Minute).Unix()}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", signHS256(valid, "s3cret"), nil},
+		{"wrong secret", signHS256(valid, "other"), ErrInvalidToken},
+		{"expired", signHS256(Claims{"iss": "https://issuer", "aud": "gateway", "exp": now.Add(-time.Minute).Unix()}, "s3cret"), ErrTokenExpired},
+		{"within leeway", signHS256(Claims{"iss": "https://issuer", "aud": "gateway", "exp": now.Unix()}, "s3cret"), nil},
+		{"not yet valid", signHS256(Claims{"iss": "https://issuer", "aud": "gateway", "nbf": now.Add(time.Minute).Unix()}, "s3cret"), ErrInvalidToken},
+		{"wrong issuer", signHS256(Claims{"iss": "https://evil", "aud": "gateway"}, "s3cret"), ErrInvalidToken},
+		{"wrong audience", signHS256(Claims{"iss": "https://issuer", "aud": "other"}, "s3cret"), ErrInvalidToken},
+		{"alg none", encodeJWTPart(map[string]string{"alg": "none"}) + "." + encodeJWTPart(valid) + ".", ErrInvalidToken},
+		{"malformed", "not-a-jwt", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.ValidateToken(context.Background(), tt.token)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRS256WithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	auth := NewAuthenticator()
+	auth.ConfigureJWT(JWTConfig{JWKSURL: jwks.URL})
+
+	token := signRS256(t, Claims{"sub": "u2", "exp": time.Now().Add(time.Minute).Unix()}, key, "key-1")
+	for i := 0; i < 3; i++ {
+		claims, err := auth.ValidateToken(context.Background(), token)
+		if err != nil {
+			t.Fatalf("RS256 validation failed: %v", err)
+		}
+		if claims["sub"] != "u2" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the key set to be fetched once, got %d", fetches.Load())
+	}
+
+	// Unknown key IDs don't trigger a refetch within the minimum interval
+	if _, err := auth.ValidateToken(context.Background(), signRS256(t, Claims{}, key, "key-2")); err == nil {
+		t.Error("expected unknown kid to be rejected")
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected no refetch for an unknown kid, got %d fetches", fetches.Load())
+	}
+
+	// HS256 is not accepted without a configured secret
+	if _, err := auth.ValidateToken(context.Background(), signHS256(Claims{}, "test-secret")); err == nil {
+		t.Error("expected HS256 to be rejected when only JWKS is configured")
+	}
+}
+
+func TestGatewayForwardsClaims(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Auth-Subject"), r.Header.Get("X-Auth-Scope"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("key")
+	gateway.authenticator.ConfigureJWT(JWTConfig{Secret: "test-secret"})
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/api/me", &Route{
+		Methods:     []string{"GET"},
+		Backends:    []*Backend{{URL: backendURL}},
+		RequireAuth: true,
+	})
+
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signHS256(Claims{"sub": "alice", "scope": "read write"}, "test-secret"))
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Body.String() != "alice|read write" {
+		t.Errorf("expected forwarded claims, got %q", w.Body.String())
+	}
+
+	// Clients can't smuggle their own identity headers past the gateway
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("X-API-Key", "key")
+	req.Header.Set("X-Auth-Subject", "admin")
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Body.String() != "|" {
+		t.Errorf("expected spoofed claim header to be stripped, got %q", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+signHS256(Claims{"sub": "alice"}, "wrong"))
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with WWW-Authenticate, got %d", w.Code)
+	}
+}
+
 func TestResponseCacheBasic(t *testing.T) {
 	cache := NewResponseCache()
 	key := "test-key"
@@ -248,56 +613,327 @@ func TestResponseCacheInvalidation(t *testing.T) {
 	}
 }
 
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewResponseCacheWithLimits(2, 0)
+	cache.Set("a", []byte("a"), time.Minute)
+	cache.Set("b", []byte("b"), time.Minute)
+	cache.Get("a") // b is now least recently used
+	cache.Set("c", []byte("c"), time.Minute)
+
+	if cache.Get("b") != nil {
+		t.Error("expected b to be evicted")
+	}
+	if cache.Get("a") == nil || cache.Get("c") == nil {
+		t.Error("expected a and c to stay cached")
+	}
+
+	bounded := NewResponseCacheWithLimits(0, 10)
+	bounded.Set("x", []byte("123456"), time.Minute)
+	bounded.Set("y", []byte("123456"), time.Minute)
+	if bounded.Get("x") != nil || bounded.Get("y") == nil {
+		t.Error("expected byte limit to evict the older entry")
+	}
+	bounded.Set("z", bytes.Repeat([]byte("z"), 11), time.Minute)
+	if bounded.Get("z") != nil || bounded.Len() != 1 {
+		t.Error("entry larger than the byte limit should not be cached")
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	cache := NewResponseCache()
+	header := http.Header{"Vary": {"Accept-Language"}}
+
+	en := httptest.NewRequest("GET", "/greeting", nil)
+	en.Header.Set("Accept-Language", "en")
+	fr := httptest.NewRequest("GET", "/greeting", nil)
+	fr.Header.Set("Accept-Language", "fr")
+
+	cache.StoreResponse("base", en, []byte("hello"), header, time.Minute, 0)
+	cache.StoreResponse("base", fr, []byte("bonjour"), header, time.Minute, 0)
+
+	if got := cache.Get(cache.VariantKey("base", en)); string(got) != "hello" {
+		t.Errorf("en variant = %q", got)
+	}
+	if got := cache.Get(cache.VariantKey("base", fr)); string(got) != "bonjour" {
+		t.Errorf("fr variant = %q", got)
+	}
+
+	if cache.StoreResponse("star", en, []byte("x"), http.Header{"Vary": {"*"}}, time.Minute, 0) {
+		t.Error("Vary: * should not be cached")
+	}
+	for _, h := range []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Set-Cookie": {"session=1"}},
+	} {
+		if cache.StoreResponse("uncacheable", en, []byte("x"), h, time.Minute, 0) {
+			t.Errorf("response with %v should not be cached", h)
+		}
+	}
+}
+
+func TestGatewayCacheVaryAndHeaders(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("Content-Type", r.Header.Get("Accept"))
+		fmt.Fprint(w, r.Header.Get("Accept"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/doc", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: backendURL}},
+		CacheTTL: time.Minute,
+	})
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/doc", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, req)
+		return w
+	}
+
+	get("text/plain")
+	get("text/csv")
+	w := get("text/csv")
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "text/csv" {
+		t.Errorf("expected cached csv variant, got %q (%s)", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("cached Content-Type = %q, want text/csv", ct)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected one backend hit per variant, got %d", hits.Load())
+	}
+}
+
+func TestGatewayServesStaleWhileRevalidating(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	refreshed := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "v%d", version.Load())
+		if version.Load() > 1 {
+			refreshed <- struct{}{}
+		}
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/data", &Route{
+		Methods:              []string{"GET"},
+		Backends:             []*Backend{{URL: backendURL}},
+		CacheTTL:             50 * time.Millisecond,
+		StaleWhileRevalidate: time.Minute,
+	})
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/data", nil))
+		return w
+	}
+
+	get()
+	version.Store(2)
+	time.Sleep(75 * time.Millisecond)
+
+	w := get()
+	if w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "v1" {
+		t.Fatalf("expected stale v1, got %q (%s)", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background revalidation never reached the backend")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w = get()
+		if w.Body.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache never picked up v2, last body %q", w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected refreshed entry to be fresh, got %s", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestGatewayConditionalRevalidation(t *testing.T) {
+	var full, notModified atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "payload")
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/etag", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: backendURL}},
+		CacheTTL: 50 * time.Millisecond,
+	})
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/etag", nil))
+	time.Sleep(75 * time.Millisecond)
+
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/etag", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Fatalf("expected cached payload after 304, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("X-Cache = %q, want REVALIDATED", w.Header().Get("X-Cache"))
+	}
+	if full.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("expected 1 full and 1 conditional request, got %d and %d", full.Load(), notModified.Load())
+	}
+
+	// A fresh entry answers the client's own If-None-Match
+	req := httptest.NewRequest("GET", "/etag", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 from cache, got %d", w.Code)
+	}
+}
+
+func TestGatewayDoesNotCacheNoStore(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, "secret")
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/private", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: backendURL}},
+		CacheTTL: time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/private", nil))
+	}
+	if hits.Load() != 2 {
+		t.Errorf("no-store response was served from cache, backend hits = %d", hits.Load())
+	}
+}
+
+// fakeClock lets circuit breaker tests move through the rolling window
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(cfg CircuitBreakerConfig) (*CircuitBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	cb := NewCircuitBreaker("http://backend", cfg)
+	cb.now = clock.now
+	return cb, clock
+}
+
 func TestCircuitBreakerBasic(t *testing.T) {
-	cb := NewCircuitBreaker(3, 2, 100*time.Millisecond)
+	cb, clock := newTestBreaker(CircuitBreakerConfig{
+		ErrorPercent:      50,
+		MinRequests:       4,
+		OpenTimeout:       100 * time.Millisecond,
+		HalfOpenSuccesses: 2,
+	})
 
 	// Circuit should start closed
 	if !cb.AllowRequest() {
 		t.Error("circuit should be closed initially")
 	}
 
-	// Record failures
+	// Below the minimum volume even 100% errors keep it closed
 	for i := 0; i < 3; i++ {
 		cb.RecordFailure()
 	}
+	if cb.State() != "closed" {
+		t.Fatal("circuit should stay closed below MinRequests")
+	}
 
-	// Circuit should be open
+	// The fourth failure makes 4 requests at 100%
+	cb.RecordFailure()
 	if cb.AllowRequest() {
 		t.Error("circuit should be open after failures")
 	}
 
 	// Wait for timeout
-	time.Sleep(150 * time.Millisecond)
+	clock.advance(150 * time.Millisecond)
 
-	// Circuit should be half-open
+	// Circuit should be half-open, admitting one probe at a time
 	if !cb.AllowRequest() {
 		t.Error("circuit should be half-open after timeout")
 	}
+	if cb.AllowRequest() {
+		t.Error("half-open circuit should admit a single probe")
+	}
 
 	// Record successes
-	for i := 0; i < 2; i++ {
-		cb.RecordSuccess()
+	cb.RecordSuccess()
+	if !cb.AllowRequest() {
+		t.Error("next probe should be admitted after the first succeeded")
 	}
+	cb.RecordSuccess()
 
 	// Circuit should be closed again
-	if !cb.AllowRequest() {
+	if cb.State() != "closed" || !cb.AllowRequest() {
 		t.Error("circuit should be closed after successes")
 	}
 }
 
 func TestCircuitBreakerHalfOpen(t *testing.T) {
-	cb := NewCircuitBreaker(2, 1, 50*time.Millisecond)
+	cb, clock := newTestBreaker(CircuitBreakerConfig{MinRequests: 2, OpenTimeout: 50 * time.Millisecond, HalfOpenSuccesses: 1})
 
 	// Open the circuit
 	cb.RecordFailure()
 	cb.RecordFailure()
 
 	// Wait for timeout
-	time.Sleep(100 * time.Millisecond)
+	clock.advance(100 * time.Millisecond)
+
+	// A failed probe reopens it
+	if !cb.AllowRequest() {
+		t.Fatal("should allow request in half-open state")
+	}
+	cb.RecordFailure()
+	if cb.State() != "open" || cb.AllowRequest() {
+		t.Fatal("failed probe should reopen the circuit")
+	}
 
-	// Should be half-open
+	// A probe whose result is never recorded frees its slot after the timeout
+	clock.advance(100 * time.Millisecond)
 	if !cb.AllowRequest() {
-		t.Error("should allow request in half-open state")
+		t.Fatal("should allow request in half-open state")
+	}
+	clock.advance(100 * time.Millisecond)
+	if !cb.AllowRequest() {
+		t.Fatal("lost probe should not block the circuit forever")
 	}
 
 	// Single success should close it
@@ -307,8 +943,144 @@ func TestCircuitBreakerHalfOpen(t *testing.T) {
 	}
 }
 
-func TestLoadBalancerRoundRobin(t *testing.T) {
-	backends := []*Backend{
+func TestCircuitBreakerRollingWindow(t *testing.T) {
+	cb, clock := newTestBreaker(CircuitBreakerConfig{
+		Window:       10 * time.Second,
+		Buckets:      10,
+		ErrorPercent: 50,
+		MinRequests:  10,
+	})
+
+	// 4 failures in 10 requests is under 50%
+	for i := 0; i < 6; i++ {
+		cb.RecordSuccess()
+	}
+	for i := 0; i < 4; i++ {
+		cb.RecordFailure()
+	}
+	if cb.State() != "closed" {
+		t.Fatal("40% errors should not open the circuit")
+	}
+
+	// After a full window, old results no longer count
+	clock.advance(11 * time.Second)
+	if requests, failures := cb.Counts(); requests != 0 || failures != 0 {
+		t.Fatalf("window should be empty, has %d requests and %d failures", requests, failures)
+	}
+
+	// Spread over the window, 5 of 10 failing opens it
+	for i := 0; i < 5; i++ {
+		cb.RecordSuccess()
+		clock.advance(time.Second)
+		cb.RecordFailure()
+	}
+	if cb.State() != "open" {
+		requests, failures := cb.Counts()
+		t.Errorf("50%% errors over the window should open the circuit (%d/%d)", failures, requests)
+	}
+}
+
+func TestCircuitBreakerEvents(t *testing.T) {
+	var events []CircuitEvent
+	cb, clock := newTestBreaker(CircuitBreakerConfig{
+		MinRequests:       2,
+		OpenTimeout:       time.Second,
+		HalfOpenSuccesses: 1,
+		OnStateChange:     func(e CircuitEvent) { events = append(events, e) },
+	})
+
+	cb.RecordFailure()
+	cb.RecordFailure()
+	clock.advance(time.Second)
+	cb.AllowRequest()
+	cb.RecordSuccess()
+
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, e := range events {
+		if got := e.From + "->" + e.To; got != want[i] || e.Name != "http://backend" {
+			t.Errorf("event %d = %s (%s), want %s", i, got, e.Name, want[i])
+		}
+	}
+	if events[0].Requests != 2 || events[0].ErrorPercent != 100 {
+		t.Errorf("open event should carry window stats, got %+v", events[0])
+	}
+}
+
+func TestCircuitBreakerTripReset(t *testing.T) {
+	var events []string
+	cb, clock := newTestBreaker(CircuitBreakerConfig{
+		OpenTimeout:   time.Second,
+		OnStateChange: func(e CircuitEvent) { events = append(events, e.From+"->"+e.To) },
+	})
+
+	cb.Trip()
+	clock.advance(time.Hour)
+	if cb.AllowRequest() || cb.Ready() {
+		t.Error("a tripped breaker should stay open past OpenTimeout")
+	}
+	cb.Reset()
+	if cb.State() != "closed" || !cb.AllowRequest() {
+		t.Errorf("expected reset breaker to be closed, got %s", cb.State())
+	}
+	if requests, _ := cb.Counts(); requests != 0 {
+		t.Errorf("reset should clear the window, got %d requests", requests)
+	}
+	if len(events) != 2 || events[0] != "closed->open" || events[1] != "open->closed" {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestGatewayCircuitBreakerPerBackend(t *testing.T) {
+	var badHits, goodHits atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits.Add(1)
+	}))
+	defer good.Close()
+
+	gateway := NewAPIGateway()
+	gateway.healthChecker.SetThresholds(1000, 1) // isolate the breaker
+	var opened atomic.Int32
+	gateway.SetCircuitBreakerConfig(CircuitBreakerConfig{
+		MinRequests: 2,
+		OnStateChange: func(e CircuitEvent) {
+			if e.To == "open" && e.Name == bad.URL {
+				opened.Add(1)
+			}
+		},
+	})
+	// Two routes share the failing backend
+	for _, pattern := range []string{"/a", "/b"} {
+		gateway.RegisterRoute(pattern, &Route{
+			Methods:  []string{"GET"},
+			Backends: []*Backend{{URL: parseURL(bad.URL)}, {URL: parseURL(good.URL)}},
+		})
+	}
+
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", []string{"/a", "/b"}[i%2], nil))
+	}
+	if badHits.Load() != 2 || opened.Load() != 1 {
+		t.Errorf("expected the shared breaker to open after 2 failures, got %d hits and %d opens", badHits.Load(), opened.Load())
+	}
+	if gateway.CircuitBreaker(bad.URL).State() != "open" || gateway.CircuitBreaker(good.URL).State() != "closed" {
+		t.Error("only the failing backend's breaker should open")
+	}
+	if goodHits.Load() != 18 {
+		t.Errorf("expected the healthy backend to take the rest, got %d", goodHits.Load())
+	}
+}
+
+func TestLoadBalancerRoundRobin(t *testing.T) {
+	backends := []*Backend{
 		{URL: parseURL("http://localhost:8081")},
 		{URL: parseURL("http://localhost:8082")},
 		{URL: parseURL("http://localhost:8083")},
@@ -351,6 +1123,181 @@ func TestLoadBalancerLeastConnections(t *testing.T) {
 	}
 }
 
+func TestLoadBalancerWeightedRoundRobin(t *testing.T) {
+	backends := []*Backend{
+		{URL: parseURL("http://localhost:8081"), Weight: 5},
+		{URL: parseURL("http://localhost:8082"), Weight: 1},
+		{URL: parseURL("http://localhost:8083")}, // unset counts as 1
+	}
+	lb := NewLoadBalancer(backends, WeightedRoundRobin)
+
+	selected := make(map[*Backend]int)
+	var run, maxRun int
+	var prev *Backend
+	for i := 0; i < 70; i++ {
+		b := lb.SelectBackend()
+		selected[b]++
+		if b == prev {
+			run++
+		} else {
+			run = 1
+		}
+		prev = b
+		if run > maxRun {
+			maxRun = run
+		}
+	}
+	if selected[backends[0]] != 50 || selected[backends[1]] != 10 || selected[backends[2]] != 10 {
+		t.Errorf("expected 50/10/10 split, got %d/%d/%d", selected[backends[0]], selected[backends[1]], selected[backends[2]])
+	}
+	// Smooth weighting interleaves instead of sending all 5 in a row
+	if maxRun >= 5 {
+		t.Errorf("heaviest backend picked %d times in a row", maxRun)
+	}
+
+	// Unhealthy backends drop out and the rest keep their ratio
+	hc := NewHealthChecker(time.Second)
+	hc.Register(backends)
+	hc.SetThresholds(1, 1)
+	hc.ReportResult(backends[0], http.StatusBadGateway)
+	lb.health = hc
+	selected = make(map[*Backend]int)
+	for i := 0; i < 20; i++ {
+		selected[lb.SelectBackend()]++
+	}
+	if selected[backends[0]] != 0 || selected[backends[1]] != 10 || selected[backends[2]] != 10 {
+		t.Errorf("expected 0/10/10 split with first backend down, got %v", selected)
+	}
+}
+
+func hashBackends(n int) []*Backend {
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = &Backend{URL: parseURL(fmt.Sprintf("http://backend%d:8080", i))}
+	}
+	return backends
+}
+
+func TestLoadBalancerConsistentHashDistribution(t *testing.T) {
+	backends := hashBackends(4)
+	lb := NewLoadBalancer(backends, ConsistentHash)
+
+	counts := make(map[*Backend]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		b := lb.SelectBackendForKey(key)
+		if lb.SelectBackendForKey(key) != b {
+			t.Fatalf("key %s is not sticky", key)
+		}
+		counts[b]++
+	}
+	for _, b := range backends {
+		if share := float64(counts[b]) / 10000; share < 0.18 || share > 0.32 {
+			t.Errorf("%s got %.1f%% of keys, want about 25%%", b.URL, share*100)
+		}
+	}
+
+	// Weight scales a backend's share of the ring
+	backends[0].Weight = 3
+	weighted := NewLoadBalancer(backends, ConsistentHash)
+	heavy := 0
+	for i := 0; i < 10000; i++ {
+		if weighted.SelectBackendForKey(fmt.Sprintf("client-%d", i)) == backends[0] {
+			heavy++
+		}
+	}
+	if share := float64(heavy) / 10000; share < 0.40 || share > 0.60 {
+		t.Errorf("weight 3 backend got %.1f%% of keys, want about 50%%", share*100)
+	}
+}
+
+func TestLoadBalancerConsistentHashStickiness(t *testing.T) {
+	backends := hashBackends(5)
+	before := NewLoadBalancer(backends, ConsistentHash)
+	removed := backends[2]
+	after := NewLoadBalancer(append(append([]*Backend{}, backends[:2]...), backends[3:]...), ConsistentHash)
+
+	moved := 0
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		was, now := before.SelectBackendForKey(key), after.SelectBackendForKey(key)
+		if was != removed && was != now {
+			t.Fatalf("key %s moved from %s to %s although its backend stayed", key, was.URL, now.URL)
+		}
+		if was != now {
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("removing 1 of 5 backends moved %d of 5000 keys", moved)
+	}
+
+	// Adding a backend only pulls keys onto the new one
+	added := &Backend{URL: parseURL("http://backend9:8080")}
+	grown := NewLoadBalancer(append(append([]*Backend{}, backends...), added), ConsistentHash)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if was, now := before.SelectBackendForKey(key), grown.SelectBackendForKey(key); was != now && now != added {
+			t.Fatalf("key %s moved between existing backends", key)
+		}
+	}
+
+	// A backend going down behaves like a removal and recovers its keys
+	hc := NewHealthChecker(time.Second)
+	hc.Register(backends)
+	hc.SetThresholds(1, 1)
+	hc.ReportResult(removed, http.StatusBadGateway)
+	before.health = hc
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		if got := before.SelectBackendForKey(key); got != after.SelectBackendForKey(key) {
+			t.Fatalf("key %s: down backend should route like a removed one", key)
+		}
+	}
+}
+
+func TestGatewayConsistentHashByHeader(t *testing.T) {
+	var hits [2]atomic.Int32
+	var servers []*httptest.Server
+	for i := range hits {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	gateway := NewAPIGateway()
+	err := gateway.RegisterRoute("/session", &Route{
+		Methods:       []string{"GET"},
+		Backends:      []*Backend{{URL: parseURL(servers[0].URL)}, {URL: parseURL(servers[1].URL)}},
+		LoadBalancing: ConsistentHash,
+		HashHeader:    "X-User-ID",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/session", nil)
+		req.Header.Set("X-User-ID", "alice")
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i) // different clients, same user
+		gateway.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if a, b := hits[0].Load(), hits[1].Load(); a != 0 && b != 0 {
+		t.Errorf("requests for one user were split across backends: %d/%d", a, b)
+	}
+
+	if err := gateway.RegisterRoute("/bad", &Route{
+		Methods:       []string{"GET"},
+		Backends:      []*Backend{{URL: parseURL(servers[0].URL)}},
+		LoadBalancing: "random-ish",
+	}); err == nil {
+		t.Error("expected unknown strategy to be rejected")
+	}
+}
+
 func TestHealthChecker(t *testing.T) {
 	hc := NewHealthChecker(1 * time.Second)
 
@@ -373,293 +1320,2724 @@ func TestHealthChecker(t *testing.T) {
 	}
 }
 
-func TestMetricsCollection(t *testing.T) {
-	metrics := NewMetrics()
-
-	// Record some metrics
-	metrics.recordSuccess(100*time.Millisecond, http.StatusOK)
-	metrics.recordSuccess(150*time.Millisecond, http.StatusOK)
-	metrics.recordError()
+func TestLoadBalancerSkipsUnhealthy(t *testing.T) {
+	hc := NewHealthChecker(time.Second)
+	backends := []*Backend{
+		{URL: parseURL("http://backend1:8080")},
+		{URL: parseURL("http://backend2:8080")},
+		{URL: parseURL("http://backend3:8080")},
+	}
+	hc.Register(backends)
+	hc.SetThresholds(1, 1)
+	hc.ReportResult(backends[1], http.StatusBadGateway)
 
-	m := metrics.GetMetrics()
+	for _, strategy := range []string{"round-robin", "least-connections"} {
+		lb := NewLoadBalancer(backends, strategy)
+		lb.health = hc
+		for i := 0; i < 6; i++ {
+			if lb.SelectBackend() == backends[1] {
+				t.Fatalf("%s selected an unhealthy backend", strategy)
+			}
+		}
+	}
 
-	if m["total_requests"] != int64(3) {
-		t.Errorf("expected 3 total requests, got %v", m["total_requests"])
+	hc.ReportResult(backends[0], http.StatusServiceUnavailable)
+	hc.ReportResult(backends[2], http.StatusInternalServerError)
+	lb := NewLoadBalancer(backends, "round-robin")
+	lb.health = hc
+	if backend := lb.SelectBackend(); backend != nil {
+		t.Errorf("expected no backend when all are down, got %s", backend.URL)
 	}
+}
 
-	if m["total_errors"] != int64(1) {
-		t.Errorf("expected 1 error, got %v", m["total_errors"])
+func TestHealthCheckerPassiveAndRecovery(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	hc := NewHealthChecker(time.Second)
+	backend := &Backend{URL: parseURL(server.URL)}
+	hc.Register([]*Backend{backend})
+
+	// 5xx from live traffic, but a success resets the streak
+	hc.ReportResult(backend, http.StatusBadGateway)
+	hc.ReportResult(backend, http.StatusBadGateway)
+	hc.ReportResult(backend, http.StatusOK)
+	hc.ReportResult(backend, http.StatusBadGateway)
+	hc.ReportResult(backend, http.StatusBadGateway)
+	if !hc.IsHealthy(backend) {
+		t.Fatal("backend should stay up until 3 consecutive failures")
+	}
+	hc.ReportResult(backend, http.StatusBadGateway)
+	if hc.IsHealthy(backend) {
+		t.Fatal("backend should be down after 3 consecutive 5xx")
 	}
 
-	errorRate := m["error_rate"].(float64)
-	expected := 1.0 / 3.0
-	if errorRate < expected-0.01 || errorRate > expected+0.01 {
-		t.Errorf("expected error rate ~%.4f, got %.4f", expected, errorRate)
+	// Recovery probes run for down backends even without a HealthURL
+	hc.CheckAll()
+	if hc.IsHealthy(backend) {
+		t.Fatal("failing probe should keep the backend down")
+	}
+	healthy.Store(true)
+	hc.CheckAll()
+	if hc.IsHealthy(backend) {
+		t.Fatal("one passing probe should not be enough to recover")
+	}
+	hc.CheckAll()
+	if !hc.IsHealthy(backend) {
+		t.Fatal("backend should recover after 2 passing probes")
 	}
 }
 
-func TestSimpleTransformer(t *testing.T) {
-	transformer := &SimpleTransformer{addHeader: "test-value"}
-	req := httptest.NewRequest("GET", "/test", nil)
+func TestHealthCheckerLoop(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
 
-	err := transformer.Transform(req)
-	if err != nil {
-		t.Fatalf("Transform failed: %v", err)
+	hc := NewHealthChecker(10 * time.Millisecond)
+	backend := &Backend{URL: parseURL(server.URL), HealthURL: server.URL + "/health"}
+	hc.Register([]*Backend{backend})
+	hc.Start()
+	defer hc.Stop()
+
+	waitFor := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for hc.IsHealthy(backend) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend never became healthy=%v", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
 	}
+	status.Store(http.StatusServiceUnavailable)
+	waitFor(false)
+	status.Store(http.StatusOK)
+	waitFor(true)
+}
 
-	if req.Header.Get("X-Transformed") != "test-value" {
-		t.Error("header not set by transformer")
+func TestGatewayRoutesAroundFailingBackend(t *testing.T) {
+	var badHits atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer good.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/svc", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(bad.URL)}, {URL: parseURL(good.URL)}},
+	})
+
+	for i := 0; i < 20; i++ {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/svc", nil))
+	}
+	if badHits.Load() != defaultFailThreshold {
+		t.Errorf("expected failing backend to be dropped after %d errors, got %d hits", defaultFailThreshold, badHits.Load())
 	}
 }
 
-func TestPathMatching(t *testing.T) {
+func TestGatewayMaxBodyBytes(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if _, err := io.ReadAll(r.Body); err != nil {
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/upload", &Route{
+		Methods:      []string{"POST", "PUT"},
+		Backends:     []*Backend{{URL: parseURL(backend.URL)}},
+		MaxBodyBytes: 8,
+	})
+	gateway.RegisterRoute("/retry", &Route{
+		Methods:      []string{"PUT"},
+		Backends:     []*Backend{{URL: parseURL(backend.URL)}},
+		MaxBodyBytes: 8,
+		Retry:        &RetryPolicy{},
+	})
+
 	tests := []struct {
-		pattern string
-		path    string
-		matches bool
+		name   string
+		method string
+		path   string
+		body   io.Reader
+		want   int
 	}{
-		{"/api/users", "/api/users", true},
-		{"/api/users", "/api/posts", false},
-		{"/api/users/*", "/api/users/123", true},
-		{"/api/users/*", "/api/users/123/profile", true},
-		{"/api/users/*", "/api/posts/123", false},
-		{"/", "/anything", true},
+		{"within limit", "POST", "/upload", strings.NewReader("small"), http.StatusOK},
+		{"content length", "POST", "/upload", strings.NewReader("far too large"), http.StatusRequestEntityTooLarge},
+		{"chunked", "POST", "/upload", io.MultiReader(strings.NewReader("far too large")), http.StatusRequestEntityTooLarge},
+		{"buffered for retry", "PUT", "/retry", io.MultiReader(strings.NewReader("far too large")), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, tt.body)
+			if _, ok := tt.body.(*strings.Reader); !ok {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			gateway.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+	if hits.Load() > 2 {
+		t.Errorf("oversized bodies with a length should never reach the backend, got %d hits", hits.Load())
+	}
+}
+
+func TestGatewayTimeoutBudget(t *testing.T) {
+	remaining := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining <- r.Header.Get(timeoutHeader)
+		if r.URL.Query().Get("slow") != "" {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(backend.URL)}},
+		Timeout:  time.Second,
+	})
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ms, err := strconv.Atoi(<-remaining); err != nil || ms <= 0 || ms > 1000 {
+		t.Errorf("expected remaining budget up to 1000ms, got %d (%v)", ms, err)
+	}
+
+	// A smaller budget from upstream wins
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set(timeoutHeader, "200")
+	gateway.ServeHTTP(httptest.NewRecorder(), req)
+	if ms, err := strconv.Atoi(<-remaining); err != nil || ms > 200 {
+		t.Errorf("expected remaining budget up to 200ms, got %d (%v)", ms, err)
+	}
+
+	req = httptest.NewRequest("GET", "/api?slow=1", nil)
+	req.Header.Set(timeoutHeader, "50")
+	rec = httptest.NewRecorder()
+	started := time.Now()
+	gateway.ServeHTTP(rec, req)
+	<-remaining
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 once the budget runs out, got %d", rec.Code)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("budget should have cut the request short, took %v", elapsed)
+	}
+
+	req = httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set(timeoutHeader, "0")
+	rec = httptest.NewRecorder()
+	gateway.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected an exhausted upstream budget to fail fast, got %d", rec.Code)
+	}
+}
+
+func TestGatewayTimeoutBudgetWithRetry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(backend.URL)}},
+		Timeout:  50 * time.Millisecond,
+		Retry:    &RetryPolicy{HedgeAfter: 10 * time.Millisecond},
+	})
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", rec.Code)
+	}
+}
+
+func TestGatewayRetryCountsEachFailureOnce(t *testing.T) {
+	var hits atomic.Int32
+	bad := countingBackend(http.StatusBadGateway, "down", 0, &hits)
+	defer bad.Close()
+
+	backend := &Backend{URL: parseURL(bad.URL)}
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api/retry", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{backend},
+		Retry:    &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	})
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api/retry", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected final 502, got %d", w.Code)
+	}
+	if errs := backend.Errors.Load(); errs != 3 {
+		t.Errorf("expected 3 errors for 3 attempts, got %d", errs)
+	}
+	if _, failures := backend.breaker.Load().Counts(); failures != 3 {
+		t.Errorf("expected 3 breaker failures for 3 attempts, got %d", failures)
+	}
+}
+
+func TestGatewayTimeoutBudgetNotChargedToBackend(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	backend := &Backend{URL: parseURL(slow.URL)}
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{backend},
+		Timeout:  50 * time.Millisecond,
+		Retry:    &RetryPolicy{MaxAttempts: 2},
+	})
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rec.Code)
+	}
+	if errs := backend.Errors.Load(); errs != 0 {
+		t.Errorf("expected the gateway's own 504 not to count against the backend, got %d errors", errs)
+	}
+	if metrics := gateway.metrics.GetMetrics(); metrics["total_errors"] != int64(1) {
+		t.Errorf("expected the 504 in gateway metrics, got %v", metrics["total_errors"])
+	}
+}
+
+func TestGatewayTimeoutBudgetSpareStreams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/stream", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(backend.URL)}},
+		Stream:   true,
+		Timeout:  50 * time.Millisecond,
+	})
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Errorf("stream should outlive the budget once headers arrive, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("client-key")
+
+	for name, h := range map[string]http.Handler{
+		"no token":       gateway.AdminHandler("admin-secret"),
+		"disabled":       gateway.AdminHandler(""),
+		"client api key": gateway.AdminHandler("admin-secret"),
+	} {
+		req := httptest.NewRequest("GET", "/admin/routes", nil)
+		if name == "client api key" {
+			req.Header.Set("X-API-Key", "client-key")
+			req.Header.Set("Authorization", "Bearer client-key")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, rec.Code)
+		}
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	var hits [2]atomic.Int32
+	var servers [2]*httptest.Server
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+		defer servers[i].Close()
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.pattern+":"+tt.path, func(t *testing.T) {
-			result := matchPath(tt.pattern, tt.path)
-			if result != tt.matches {
-				t.Errorf("expected %v, got %v", tt.matches, result)
-			}
-		})
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api/{id}", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(servers[0].URL)}},
+	})
+	admin := gateway.AdminHandler("admin-secret")
+
+	rec := adminRequest(t, admin, "POST", "/admin/routes/backends", `{"route": "/api/{id}", "url": "`+servers[1].URL+`", "weight": 2}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add backend: expected 201, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/routes/backends", `{"route": "/api/{id}", "url": "`+servers[1].URL+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate backend: expected 409, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/routes/backends", `{"route": "/nope", "url": "http://x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown route: expected 404, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/routes/backends", `{"route": "/api/{id}", "url": "nope"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad url: expected 400, got %d", rec.Code)
+	}
+
+	for i := 0; i < 4; i++ {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/1", nil))
+	}
+	if hits[0].Load() != 2 || hits[1].Load() != 2 {
+		t.Errorf("expected traffic on both backends, got %d/%d", hits[0].Load(), hits[1].Load())
+	}
+
+	rec = adminRequest(t, admin, "GET", "/admin/routes", "")
+	var routes []adminRoute
+	if err := json.NewDecoder(rec.Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || len(routes[0].Backends) != 2 || routes[0].Backends[1].Weight != 2 || routes[0].Backends[1].Breaker != "closed" {
+		t.Errorf("unexpected route listing %+v", routes)
+	}
+
+	if rec := adminRequest(t, admin, "DELETE", "/admin/routes/backends", `{"route": "/api/{id}", "url": "`+servers[0].URL+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("remove backend: expected 204, got %d %s", rec.Code, rec.Body)
+	}
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/1", nil))
+	if hits[0].Load() != 2 || hits[1].Load() != 3 {
+		t.Errorf("removed backend still gets traffic: %d/%d", hits[0].Load(), hits[1].Load())
+	}
+	if rec := adminRequest(t, admin, "DELETE", "/admin/routes/backends", `{"route": "/api/{id}", "url": "`+servers[1].URL+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("last backend: expected 409, got %d", rec.Code)
+	}
+}
+
+func TestAdminKeys(t *testing.T) {
+	gateway := NewAPIGateway()
+	admin := gateway.AdminHandler("admin-secret")
+	validKey := func(key string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", key)
+		return gateway.authenticator.ValidateRequest(req)
+	}
+
+	rec := adminRequest(t, admin, "POST", "/admin/keys", `{}`)
+	var created map[string]string
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec.Code != http.StatusCreated || len(created["key"]) != 64 || !validKey(created["key"]) {
+		t.Fatalf("expected a generated key, got %d %v", rec.Code, created)
+	}
+
+	rec = adminRequest(t, admin, "POST", "/admin/keys/rotate", `{"key": "`+created["key"]+`", "grace": "50ms"}`)
+	var rotated map[string]string
+	json.NewDecoder(rec.Body).Decode(&rotated)
+	if rec.Code != http.StatusOK || !validKey(rotated["key"]) {
+		t.Fatalf("rotate: got %d %v", rec.Code, rotated)
+	}
+	if !validKey(created["key"]) {
+		t.Error("old key should work during the grace period")
+	}
+	deadline := time.Now().Add(time.Second)
+	for validKey(created["key"]) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if validKey(created["key"]) {
+		t.Error("old key should be revoked after the grace period")
+	}
+
+	if rec := adminRequest(t, admin, "DELETE", "/admin/keys", `{"key": "`+rotated["key"]+`"}`); rec.Code != http.StatusNoContent || validKey(rotated["key"]) {
+		t.Errorf("revoke: got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "DELETE", "/admin/keys", `{"key": "missing"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("revoking an unknown key: expected 404, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/keys", `{"kye": "typo"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: expected 400, got %d", rec.Code)
+	}
+}
+
+func TestAdminCacheAndBreakers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/*", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(backend.URL)}},
+		CacheTTL: time.Minute,
+	})
+	admin := gateway.AdminHandler("admin-secret")
+	for _, path := range []string{"/users/1", "/users/2", "/orders/1"} {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := adminRequest(t, admin, "DELETE", "/admin/cache", `{"prefix": "/users/"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"purged":2}` {
+		t.Errorf("purge prefix: got %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, admin, "DELETE", "/admin/cache", ""); strings.TrimSpace(rec.Body.String()) != `{"purged":1}` {
+		t.Errorf("purge all: got %s", rec.Body)
+	}
+
+	rec = adminRequest(t, admin, "POST", "/admin/breakers/trip", `{"backend": "`+backend.URL+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"open"`) {
+		t.Fatalf("trip: got %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("tripped backend should be refused, got %d", rec.Code)
+	}
+	adminRequest(t, admin, "POST", "/admin/breakers/reset", `{"backend": "`+backend.URL+`"}`)
+	rec = httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("reset backend should serve again, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/breakers/trip", `{"backend": "http://unknown"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestGatewayCanarySplit(t *testing.T) {
+	var stableHits, canaryHits atomic.Int32
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stableHits.Add(1)
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canaryHits.Add(1)
+		w.Write([]byte("canary"))
+	}))
+	defer canary.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(stable.URL)}},
+		Canary:   &Canary{Backends: []*Backend{{URL: parseURL(canary.URL)}}, Percent: 5},
+	})
+	pools := func() map[string]string {
+		assigned := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, 1000+i)
+			rec := httptest.NewRecorder()
+			gateway.ServeHTTP(rec, req)
+			assigned[req.RemoteAddr[:strings.LastIndex(req.RemoteAddr, ":")]] = rec.Body.String()
+		}
+		return assigned
+	}
+
+	first := pools()
+	if n := canaryHits.Load(); n < 25 || n > 75 {
+		t.Errorf("expected about 5%% of 1000 clients on the canary, got %d", n)
+	}
+	for client, pool := range pools() {
+		if first[client] != pool {
+			t.Fatalf("client %s moved from %s to %s", client, first[client], pool)
+		}
+	}
+
+	if err := gateway.SetCanaryPercent("/api", 50); err != nil {
+		t.Fatal(err)
+	}
+	for client, pool := range pools() {
+		if first[client] == "canary" && pool != "canary" {
+			t.Fatalf("raising the split moved canary client %s back to stable", client)
+		}
+	}
+	if err := gateway.SetCanaryPercent("/api", 101); err == nil {
+		t.Error("expected an out of range percent to be rejected")
+	}
+	if err := gateway.SetCanaryPercent("/missing", 10); !errors.Is(err, ErrRouteNotFound) {
+		t.Errorf("expected ErrRouteNotFound, got %v", err)
+	}
+}
+
+func TestGatewayCanaryFallsBackToStable(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+
+	gateway := NewAPIGateway()
+	canaryBackend := &Backend{URL: parseURL("http://127.0.0.1:1")}
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL(stable.URL)}},
+		Canary:   &Canary{Backends: []*Backend{canaryBackend}, Percent: 100},
+	})
+	gateway.CircuitBreaker(canaryBackend.URL.String()).Trip()
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("GET", "/api", nil))
+	if rec.Body.String() != "stable" {
+		t.Errorf("expected the stable pool while the canary is down, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestShiftCanary(t *testing.T) {
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL("http://stable")}},
+		Canary:   &Canary{Backends: []*Backend{{URL: parseURL("http://canary")}}},
+	})
+
+	if err := gateway.ShiftCanary(context.Background(), "/api", 25, 10, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if percent, _ := gateway.CanaryPercent("/api"); percent != 25 {
+		t.Errorf("expected 25%%, got %v", percent)
+	}
+	if err := gateway.ShiftCanary(context.Background(), "/api", 0, 10, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if percent, _ := gateway.CanaryPercent("/api"); percent != 0 {
+		t.Errorf("expected the shift back to 0%%, got %v", percent)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := gateway.ShiftCanary(ctx, "/api", 100, 1, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled shift to stop, got %v", err)
+	}
+	if percent, _ := gateway.CanaryPercent("/api"); percent != 1 {
+		t.Errorf("a cancelled shift should stop after its first step, got %v", percent)
+	}
+
+	gateway.RegisterRoute("/plain", &Route{Methods: []string{"GET"}, Backends: []*Backend{{URL: parseURL("http://stable")}}})
+	if err := gateway.ShiftCanary(context.Background(), "/plain", 10, 1, time.Millisecond); !errors.Is(err, ErrNoCanary) {
+		t.Errorf("expected ErrNoCanary, got %v", err)
+	}
+}
+
+func TestAdminCanary(t *testing.T) {
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL("http://stable")}},
+		Canary:   &Canary{Backends: []*Backend{{URL: parseURL("http://canary")}}, Percent: 5},
+	})
+	admin := gateway.AdminHandler("admin-secret")
+
+	if rec := adminRequest(t, admin, "POST", "/admin/routes/canary", `{"route": "/api", "percent": 20}`); rec.Code != http.StatusOK {
+		t.Fatalf("set canary: got %d %s", rec.Code, rec.Body)
+	}
+	if percent, _ := gateway.CanaryPercent("/api"); percent != 20 {
+		t.Errorf("expected 20%%, got %v", percent)
+	}
+
+	rec := adminRequest(t, admin, "POST", "/admin/routes/canary", `{"route": "/api", "percent": 50, "step": 10, "interval": "1ms"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("shift canary: got %d %s", rec.Code, rec.Body)
+	}
+	deadline := time.Now().Add(time.Second)
+	for percent, _ := gateway.CanaryPercent("/api"); percent != 50 && time.Now().Before(deadline); percent, _ = gateway.CanaryPercent("/api") {
+		time.Sleep(time.Millisecond)
+	}
+	if percent, _ := gateway.CanaryPercent("/api"); percent != 50 {
+		t.Errorf("expected the shift to reach 50%%, got %v", percent)
+	}
+
+	rec = adminRequest(t, admin, "GET", "/admin/routes", "")
+	var routes []adminRoute
+	json.NewDecoder(rec.Body).Decode(&routes)
+	if len(routes) != 1 || routes[0].Canary == nil || routes[0].Canary.Percent != 50 || len(routes[0].Canary.Backends) != 1 {
+		t.Errorf("unexpected listing %+v", routes)
+	}
+	if rec := adminRequest(t, admin, "POST", "/admin/routes/canary", `{"route": "/api", "percent": 120}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("out of range: expected 400, got %d", rec.Code)
+	}
+}
+
+// testPKI issues certificates from a throwaway CA
+type testPKI struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testPKI{cert: cert, key: key}
+}
+
+// issue returns PEM encoded certificate and key for name
+func (p *testPKI) issue(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (p *testPKI) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.cert)
+	return pool
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatewayMutualTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Got-Subject", r.Header.Get("X-Client-Cert-Subject"))
+		w.Header().Set("Got-Cert", strconv.FormatBool(r.Header.Get("X-Client-Cert") != ""))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	ca := newTestPKI(t)
+	serverCert, serverKey := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "server.pem"), serverCert)
+	writeFile(t, filepath.Join(dir, "server.key"), serverKey)
+	writeFile(t, filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+
+	tlsConfig, err := NewTLSConfig(TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/open", &Route{Methods: []string{"GET"}, Backends: []*Backend{{URL: parseURL(backend.URL)}}})
+	gateway.RegisterRoute("/secure", &Route{Methods: []string{"GET"}, Backends: []*Backend{{URL: parseURL(backend.URL)}}, RequireClientCert: true})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: gateway, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(tls.NewListener(ln, tlsConfig))
+	defer server.Close()
+	base := "https://" + ln.Addr().String()
+
+	clientFor := func(certPEM, keyPEM []byte) *http.Client {
+		cfg := &tls.Config{RootCAs: ca.pool()}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+	withCert := clientFor(ca.issue(t, "client-1", 3, x509.ExtKeyUsageClientAuth))
+	anonymous := clientFor(nil, nil)
+
+	resp, err := withCert.Get(base + "/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Got-Subject") != "CN=client-1" || resp.Header.Get("Got-Cert") != "true" {
+		t.Errorf("expected the client cert forwarded, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	resp, err = anonymous.Get(base + "/secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without a client cert, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", base+"/open", nil)
+	req.Header.Set("X-Client-Cert-Subject", "CN=admin")
+	resp, err = anonymous.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Got-Subject") != "" {
+		t.Errorf("spoofed cert headers should be stripped, got %d %q", resp.StatusCode, resp.Header.Get("Got-Subject"))
+	}
+
+	rogue := newTestPKI(t)
+	if resp, err := clientFor(rogue.issue(t, "client-1", 4, x509.ExtKeyUsageClientAuth)).Get(base + "/open"); err == nil {
+		resp.Body.Close()
+		t.Error("a certificate from an unknown CA should fail the handshake")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newTestPKI(t)
+	certPEM, keyPEM := ca.issue(t, "first", 10, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	tlsConfig, err := NewTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving := func() string {
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if got := serving(); got != "first" {
+		t.Fatalf("expected first certificate, got %s", got)
+	}
+
+	certPEM, keyPEM = ca.issue(t, "renewed", 11, x509.ExtKeyUsageServerAuth)
+	writeFile(t, keyFile, keyPEM)
+	writeFile(t, certFile, certPEM)
+	if got := serving(); got != "renewed" {
+		t.Errorf("expected the renewed certificate, got %s", got)
+	}
+
+	writeFile(t, certFile, []byte("garbage"))
+	if got := serving(); got != "renewed" {
+		t.Errorf("a broken renewal should keep the current certificate, got %s", got)
+	}
+
+	if _, err := NewTLSConfig(TLSConfig{CertFile: filepath.Join(dir, "missing"), KeyFile: keyFile}); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
+
+func TestGatewayIdempotencyKey(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Order", strconv.Itoa(int(n)))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "order %d for %s", n, body)
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/orders", &Route{
+		Methods:         []string{"POST", "GET"},
+		Backends:        []*Backend{{URL: parseURL(backend.URL)}},
+		IdempotencyTTL:  time.Minute,
+		RateLimitPerMin: 100,
+	})
+	send := func(method, key, body, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/orders", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		req.RemoteAddr = client + ":1234"
+		rec := httptest.NewRecorder()
+		gateway.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := send("POST", "k1", "book", "10.0.0.1")
+	replay := send("POST", "k1", "book", "10.0.0.1")
+	if hits.Load() != 1 {
+		t.Fatalf("duplicate should not reach the backend, got %d hits", hits.Load())
+	}
+	if replay.Code != http.StatusCreated || replay.Body.String() != first.Body.String() || replay.Header().Get("X-Order") != "1" {
+		t.Errorf("expected the first response replayed, got %d %q", replay.Code, replay.Body.String())
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("only replays should be marked")
+	}
+	if replay.Header().Get("X-RateLimit-Remaining") == first.Header().Get("X-RateLimit-Remaining") {
+		t.Error("rate limit headers should be current, not replayed")
+	}
+
+	if rec := send("POST", "k1", "lamp", "10.0.0.1"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing a key for another body: expected 422, got %d", rec.Code)
+	}
+	if rec := send("POST", "k1", "book", "10.0.0.2"); rec.Code != http.StatusCreated || hits.Load() != 2 {
+		t.Errorf("keys are per client: got %d with %d hits", rec.Code, hits.Load())
+	}
+	send("POST", "", "book", "10.0.0.1")
+	send("GET", "k1", "", "10.0.0.1")
+	if hits.Load() != 4 {
+		t.Errorf("requests without a key or with a safe method should pass through, got %d hits", hits.Load())
+	}
+
+	// Server errors are not remembered, so the client can retry
+	send("POST", "k2", "fail", "10.0.0.1")
+	send("POST", "k2", "fail", "10.0.0.1")
+	if hits.Load() != 6 {
+		t.Errorf("5xx responses should not be replayed, got %d hits", hits.Load())
+	}
+}
+
+func TestGatewayIdempotencyKeyInFlight(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/pay", &Route{
+		Methods:        []string{"POST"},
+		Backends:       []*Backend{{URL: parseURL(backend.URL)}},
+		IdempotencyTTL: time.Minute,
+	})
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "/pay", strings.NewReader("100"))
+		req.Header.Set("Idempotency-Key", "pay-1")
+		return req
+	}
+
+	done := make(chan struct{})
+	go func() {
+		gateway.ServeHTTP(httptest.NewRecorder(), newRequest())
+		close(done)
+	}()
+	<-arrived
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, newRequest())
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 409 while the first request runs, got %d", rec.Code)
+	}
+	close(release)
+	<-done
+
+	rec = httptest.NewRecorder()
+	gateway.ServeHTTP(rec, newRequest())
+	if rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Errorf("expected the finished response replayed, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	ctx := context.Background()
+	if _, claimed, _ := store.Begin(ctx, "k", "fp", 20*time.Millisecond); !claimed {
+		t.Fatal("expected a fresh key to be claimed")
+	}
+	store.Complete(ctx, "k", &IdempotencyRecord{Fingerprint: "fp", Status: http.StatusOK})
+	if existing, claimed, _ := store.Begin(ctx, "k", "fp", time.Minute); claimed || !existing.Done {
+		t.Fatalf("expected the completed record, got %+v", existing)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, claimed, _ := store.Begin(ctx, "k", "fp", time.Minute); !claimed {
+		t.Error("expected an expired key to be claimable again")
+	}
+	store.Release(ctx, "k")
+	if _, claimed, _ := store.Begin(ctx, "k", "fp", time.Minute); !claimed {
+		t.Error("expected a released key to be claimable again")
+	}
+}
+
+const testOpenAPISpec = `{
+	"openapi": "3.0.3",
+	"servers": [{"url": "http://users.internal:8080/v1"}],
+	"security": [{"apiKey": []}],
+	"components": {
+		"parameters": {
+			"Trace": {"name": "X-Trace-Id", "in": "header", "required": true}
+		},
+		"requestBodies": {
+			"User": {"required": true, "content": {"application/json": {}, "application/merge-patch+json": {}}}
+		}
+	},
+	"paths": {
+		"/users": {
+			"get": {
+				"security": [],
+				"parameters": [{"name": "limit", "in": "query", "schema": {"type": "integer"}}]
+			},
+			"post": {
+				"parameters": [{"$ref": "#/components/parameters/Trace"}],
+				"requestBody": {"$ref": "#/components/requestBodies/User"}
+			}
+		},
+		"/users/{id}": {
+			"parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": ["integer", "null"]}}],
+			"get": {},
+			"delete": {"security": [{}]}
+		}
+	}
+}`
+
+func TestImportOpenAPI(t *testing.T) {
+	routes, err := ImportOpenAPI([]byte(testOpenAPISpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %v", routes)
+	}
+
+	users := routes["/v1/users"]
+	if users == nil || strings.Join(users.Methods, ",") != "GET,POST" {
+		t.Fatalf("unexpected /v1/users route %+v", users)
+	}
+	if users.requiresAuth("GET") || !users.requiresAuth("POST") {
+		t.Errorf("GET overrides the document's security, POST inherits it: got %v", users.AuthMethods)
+	}
+	if users.Backends[0].URL.String() != "http://users.internal:8080" {
+		t.Errorf("expected the server as backend, got %s", users.Backends[0].URL)
+	}
+	byID := routes["/v1/users/{id}"]
+	if byID == nil || !byID.requiresAuth("GET") || byID.requiresAuth("DELETE") {
+		t.Errorf("an empty requirement makes auth optional: %+v", byID)
+	}
+
+	routes, err = ImportOpenAPI([]byte(testOpenAPISpec), "http://a:1", "http://b:2")
+	if err != nil || len(routes["/v1/users"].Backends) != 2 {
+		t.Errorf("expected the given backends, got %v", err)
+	}
+
+	for name, spec := range map[string]string{
+		"swagger 2":      `{"swagger": "2.0", "paths": {}}`,
+		"no backend":     `{"openapi": "3.1.0", "paths": {"/a": {"get": {}}}}`,
+		"dangling ref":   `{"openapi": "3.1.0", "servers": [{"url": "http://a"}], "paths": {"/a": {"get": {"parameters": [{"$ref": "#/components/parameters/Nope"}]}}}}`,
+		"no operations":  `{"openapi": "3.1.0", "servers": [{"url": "http://a"}], "paths": {"/a": {}}}`,
+		"bad path":       `{"openapi": "3.1.0", "servers": [{"url": "http://a"}], "paths": {"/a/{}": {"get": {}}}}`,
+		"not a document": `[]`,
+	} {
+		if _, err := ImportOpenAPI([]byte(spec)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestGatewayOpenAPIValidation(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("key-1")
+	if err := gateway.ImportOpenAPI([]byte(testOpenAPISpec), backend.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		contentType string
+		trace       bool
+		want        int
+	}{
+		{"public list", "GET", "/v1/users?limit=10", "", "", false, http.StatusOK},
+		{"bad query type", "GET", "/v1/users?limit=ten", "", "", false, http.StatusBadRequest},
+		{"create", "POST", "/v1/users", `{}`, "application/json; charset=utf-8", true, http.StatusOK},
+		{"missing header", "POST", "/v1/users", `{}`, "application/json", false, http.StatusBadRequest},
+		{"missing body", "POST", "/v1/users", "", "application/json", true, http.StatusBadRequest},
+		{"wrong content type", "POST", "/v1/users", `a=b`, "application/x-www-form-urlencoded", true, http.StatusBadRequest},
+		{"bad path type", "GET", "/v1/users/abc", "", "", false, http.StatusBadRequest},
+		{"by id", "GET", "/v1/users/42", "", "", false, http.StatusOK},
+		{"method not in spec", "PUT", "/v1/users/42", "", "", false, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("X-API-Key", "key-1")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.trace {
+				req.Header.Set("X-Trace-Id", "abc")
+			}
+			rec := httptest.NewRecorder()
+			gateway.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+		})
+	}
+	if hits.Load() != 3 {
+		t.Errorf("only valid requests should reach the backend, got %d", hits.Load())
+	}
+
+	rec := httptest.NewRecorder()
+	gateway.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/users", strings.NewReader("{}")))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("secured operation without a key: expected 401, got %d", rec.Code)
+	}
+}
+
+func TestGatewayAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	records := make(ChannelSink, 10)
+	gateway.SetAccessLog(NewAccessLogger(records, 1, false))
+	gateway.RegisterRoute("/items/{id}", &Route{
+		Methods:         []string{"GET"},
+		Backends:        []*Backend{{URL: parseURL(backend.URL)}},
+		RateLimitPerMin: 10,
+		CacheTTL:        time.Minute,
+	})
+
+	for _, path := range []string{"/items/1", "/items/1", "/missing"} {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	miss, hit, notFound := <-records, <-records, <-records
+	if miss.Route != "/items/{id}" || miss.Backend != backend.URL || miss.Status != http.StatusOK {
+		t.Errorf("unexpected first record: %+v", miss)
+	}
+	if miss.Cache != "MISS" || miss.RateLimit != "allowed" || miss.Bytes != 5 || miss.RequestID == 0 {
+		t.Errorf("unexpected first record: %+v", miss)
+	}
+	if hit.Cache != "HIT" || hit.Backend != "" || hit.RequestID == miss.RequestID {
+		t.Errorf("unexpected cached record: %+v", hit)
+	}
+	if notFound.Status != http.StatusNotFound || notFound.Route != "" || notFound.Path != "/missing" {
+		t.Errorf("unexpected 404 record: %+v", notFound)
+	}
+}
+
+func TestGatewayAccessLogRateLimited(t *testing.T) {
+	gateway := NewAPIGateway()
+	records := make(ChannelSink, 10)
+	gateway.SetAccessLog(NewAccessLogger(records, 1, false))
+	gateway.RegisterRoute("/limited", &Route{
+		Methods:         []string{"GET"},
+		Backends:        []*Backend{{URL: parseURL("http://localhost:1")}},
+		RateLimitPerMin: 1,
+	})
+	gateway.rateLimiters["/limited"].Allow(context.Background(), "192.0.2.1:1234")
+
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/limited", nil))
+	if rec := <-records; rec.Status != http.StatusTooManyRequests || rec.RateLimit != "rejected:client" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	records := make(ChannelSink, 2000)
+	logger := NewAccessLogger(records, 0, true)
+	logger.Log(AccessRecord{Status: http.StatusOK})
+	logger.Log(AccessRecord{Status: http.StatusBadGateway})
+	if len(records) != 1 || (<-records).Status != http.StatusBadGateway {
+		t.Fatal("expected only the error to bypass a zero sample rate")
+	}
+
+	logger = NewAccessLogger(records, 0.25, false)
+	for i := 0; i < 2000; i++ {
+		logger.Log(AccessRecord{Status: http.StatusOK})
+	}
+	if n := len(records); n < 400 || n > 600 {
+		t.Errorf("sample rate 0.25 logged %d of 2000", n)
+	}
+}
+
+func TestChannelSinkDropsWhenFull(t *testing.T) {
+	logger := NewAccessLogger(make(ChannelSink, 1), 1, false)
+	logger.Log(AccessRecord{})
+	logger.Log(AccessRecord{})
+	if logger.Failures() != 1 {
+		t.Errorf("expected 1 dropped record, got %d", logger.Failures())
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONSink(&buf)
+	sink.Write(AccessRecord{RequestID: 7, Status: 201, Latency: Duration(1500 * time.Microsecond)})
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["request_id"] != float64(7) || got["status"] != float64(201) || got["latency"] != "1.5ms" {
+		t.Errorf("unexpected JSON record: %s", buf.String())
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	line, _ := json.Marshal(AccessRecord{Path: "/x"})
+	// Room for two records per file
+	sink, err := NewFileSink(path, int64(len(line)+1)*2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(AccessRecord{Path: "/x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !json.Valid([]byte(l)) {
+				t.Errorf("%s holds a broken line %q", name, l)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only 2 backups to be kept")
+	}
+	if err := sink.Write(AccessRecord{}); err == nil {
+		t.Error("expected writes after Close to fail")
+	}
+}
+
+func TestAccessLogConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	cfg, err := parseConfig([]byte(`{
+		"access_log": {"sink": "file", "path": "` + path + `", "sample_rate": 1},
+		"routes": [{"pattern": "/", "methods": ["GET"], "backends": [{"url": "http://localhost:1"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := NewAPIGateway()
+	if err := gateway.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	first := gateway.AccessLog()
+	if err := gateway.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if gateway.AccessLog() != first {
+		t.Error("reloading identical settings should keep the logger")
+	}
+
+	for _, bad := range []AccessLogConfig{{Sink: "syslog"}, {Sink: "file"}, {Sink: "stdout", SampleRate: 2}} {
+		if _, err := bad.NewAccessLogger(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+	first.Close()
+}
+
+func TestMetricsCollection(t *testing.T) {
+	metrics := NewMetrics()
+
+	// Record some metrics
+	metrics.recordSuccess(100*time.Millisecond, http.StatusOK)
+	metrics.recordSuccess(150*time.Millisecond, http.StatusOK)
+	metrics.recordError()
+
+	m := metrics.GetMetrics()
+
+	if m["total_requests"] != int64(3) {
+		t.Errorf("expected 3 total requests, got %v", m["total_requests"])
+	}
+
+	if m["total_errors"] != int64(1) {
+		t.Errorf("expected 1 error, got %v", m["total_errors"])
+	}
+
+	errorRate := m["error_rate"].(float64)
+	expected := 1.0 / 3.0
+	if errorRate < expected-0.01 || errorRate > expected+0.01 {
+		t.Errorf("expected error rate ~%.4f, got %.4f", expected, errorRate)
+	}
+}
+
+func TestGatewayPrometheusMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orders/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/orders/{id}", &Route{
+		Methods:  []string{"GET", "POST"},
+		Backends: []*Backend{{URL: parseURL(backend.URL)}},
+	})
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/orders/1", nil),
+		httptest.NewRequest("GET", "/orders/2", nil),
+		httptest.NewRequest("POST", "/orders/3", nil),
+		httptest.NewRequest("GET", "/orders/fail", nil),
+		httptest.NewRequest("GET", "/nowhere", nil),
+		httptest.NewRequest("BREW", "/nowhere", nil),
+	} {
+		gateway.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	cb := gateway.CircuitBreaker(backend.URL)
+	cb.mu.Lock()
+	cb.state = "open"
+	cb.openedAt = time.Now()
+	cb.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	gateway.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE gateway_requests_total counter",
+		`gateway_requests_total{route="/orders/{id}",method="GET",status="2xx"} 2`,
+		`gateway_requests_total{route="/orders/{id}",method="POST",status="2xx"} 1`,
+		`gateway_requests_total{route="/orders/{id}",method="GET",status="5xx"} 1`,
+		`gateway_requests_total{route="unmatched",method="GET",status="4xx"} 1`,
+		`gateway_requests_total{route="unmatched",method="OTHER",status="4xx"} 1`,
+		"# TYPE gateway_request_duration_seconds histogram",
+		`gateway_request_duration_seconds_bucket{route="/orders/{id}",method="GET",le="+Inf"} 3`,
+		`gateway_request_duration_seconds_count{route="/orders/{id}",method="GET"} 3`,
+		"gateway_active_requests 0",
+		`gateway_circuit_breaker_state{backend="` + backend.URL + `"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+
+	codes := gateway.metrics.GetMetrics()["requests_by_code"].(map[int]int64)
+	if codes[http.StatusOK] != 3 || codes[http.StatusInternalServerError] != 1 || codes[http.StatusNotFound] != 2 {
+		t.Errorf("requests_by_code = %v", codes)
+	}
+}
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	m := NewMetrics()
+	m.observe("/r", "GET", 200, 3*time.Millisecond)
+	m.observe("/r", "GET", 200, 10*time.Millisecond) // bounds are inclusive
+	m.observe("/r", "GET", 200, 20*time.Second)
+
+	h := m.latencies[latencySeries{"/r", "GET"}]
+	if h.counts[0] != 1 || h.counts[1] != 1 || h.counts[len(latencyBuckets)] != 1 || h.count != 3 {
+		t.Errorf("unexpected bucket counts %v", h.counts)
+	}
+}
+
+func TestPromLabel(t *testing.T) {
+	if got := promLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("promLabel = %s", got)
+	}
+}
+
+func TestSimpleTransformer(t *testing.T) {
+	transformer := &SimpleTransformer{addHeader: "test-value"}
+	req := httptest.NewRequest("GET", "/test", nil)
+
+	err := transformer.Transform(req)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	if req.Header.Get("X-Transformed") != "test-value" {
+		t.Error("header not set by transformer")
+	}
+}
+
+func TestPathMatching(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"/api/users", "/api/users", true},
+		{"/api/users", "/api/posts", false},
+		{"/api/users/*", "/api/users/123", true},
+		{"/api/users/*", "/api/users/123/profile", true},
+		{"/api/users/*", "/api/posts/123", false},
+		{"/", "/anything", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+":"+tt.path, func(t *testing.T) {
+			result := matchPath(tt.pattern, tt.path)
+			if result != tt.matches {
+				t.Errorf("expected %v, got %v", tt.matches, result)
+			}
+		})
+	}
+}
+
+func TestRouterLookup(t *testing.T) {
+	rt := newRouter()
+	routes := map[string]*Route{
+		"/api/users":               {Methods: []string{"GET"}},
+		"/api/users/{id}":          {Methods: []string{"GET", "PUT"}},
+		"/api/users/{id}/orders":   {Methods: []string{"GET"}},
+		"/api/users/me":            {Methods: []string{"GET"}},
+		"/api/users/*":             {Methods: []string{"*"}},
+		"/api/orders/{oid}/{item}": {Methods: []string{"GET"}},
+		"/static/app*":             {Methods: []string{"GET"}},
+	}
+	for pattern, route := range routes {
+		if err := rt.Insert(pattern, route); err != nil {
+			t.Fatalf("Insert(%q) failed: %v", pattern, err)
+		}
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"GET", "/api/users", "/api/users", map[string]string{}},
+		{"GET", "/api/users/42", "/api/users/{id}", map[string]string{"id": "42"}},
+		{"PUT", "/api/users/42", "/api/users/{id}", map[string]string{"id": "42"}},
+		{"GET", "/api/users/me", "/api/users/me", map[string]string{}},
+		{"GET", "/api/users/42/orders", "/api/users/{id}/orders", map[string]string{"id": "42"}},
+		{"DELETE", "/api/users/42", "/api/users/*", map[string]string{}},
+		{"GET", "/api/users/42/profile", "/api/users/*", map[string]string{}},
+		{"GET", "/api/orders/7/book", "/api/orders/{oid}/{item}", map[string]string{"oid": "7", "item": "book"}},
+		{"GET", "/static/app.js", "/static/app*", map[string]string{}},
+		{"GET", "/api/orders/7", "", nil},
+		{"POST", "/api/users", "", nil},
+		{"GET", "/static/other.js", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			match := rt.Lookup(tt.method, tt.path)
+			if tt.pattern == "" {
+				if match != nil {
+					t.Fatalf("expected no match, got %q", match.pattern)
+				}
+				return
+			}
+			if match == nil {
+				t.Fatalf("expected %q to match", tt.pattern)
+			}
+			if match.pattern != tt.pattern {
+				t.Errorf("expected pattern %q, got %q", tt.pattern, match.pattern)
+			}
+			if len(match.params) != len(tt.params) {
+				t.Errorf("expected params %v, got %v", tt.params, match.params)
+			}
+			for name, value := range tt.params {
+				if match.params[name] != value {
+					t.Errorf("param %q: expected %q, got %q", name, value, match.params[name])
+				}
+			}
+		})
+	}
+}
+
+func TestRouterRootMatchesEverything(t *testing.T) {
+	rt := newRouter()
+	rt.Insert("/", &Route{Methods: []string{"GET"}})
+
+	for _, path := range []string{"/", "/anything", "/a/b/c"} {
+		if rt.Lookup("GET", path) == nil {
+			t.Errorf("expected / to match %q", path)
+		}
+	}
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"/api/{}", "/api/{id}/{id}", "/api/*/users", "/api/us{er"} {
+		if err := newRouter().Insert(pattern, &Route{Methods: []string{"GET"}}); err == nil {
+			t.Errorf("expected error for %q", pattern)
+		}
+	}
+
+	gateway := NewAPIGateway()
+	err := gateway.RegisterRoute("/api/{}", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: parseURL("http://localhost:8081")}},
+	})
+	if err == nil {
+		t.Error("RegisterRoute should reject invalid patterns")
+	}
+}
+
+type paramTransformer struct{}
+
+func (paramTransformer) Transform(req *http.Request) error {
+	params := PathParams(req)
+	req.Header.Set("X-User-ID", params["id"])
+	return nil
+}
+
+func TestGatewayPathParams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-User-ID") + " " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/api/users/{id}/orders", &Route{
+		Methods:   []string{"GET"},
+		Backends:  []*Backend{{URL: backendURL}},
+		Transform: paramTransformer{},
+	})
+
+	req := httptest.NewRequest("GET", "/api/users/42/orders", nil)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := w.Body.String(); got != "42 /api/users/42/orders" {
+		t.Errorf("unexpected backend response %q", got)
+	}
+}
+
+func TestMethodAllowed(t *testing.T) {
+	tests := []struct {
+		methods  []string
+		method   string
+		expected bool
+	}{
+		{[]string{"GET"}, "GET", true},
+		{[]string{"GET"}, "POST", false},
+		{[]string{"GET", "POST"}, "POST", true},
+		{[]string{"*"}, "DELETE", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			result := methodAllowed(tt.methods, tt.method)
+			if result != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestGatewayWithMockedBackend(t *testing.T) {
+	// Create mock backend server
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer backend.Close()
+
+	// Create gateway
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("test-key")
+
+	backendURL, _ := url.Parse(backend.URL)
+	route := &Route{
+		Pattern:         "/api/test",
+		Methods:         []string{"GET"},
+		Backends:        []*Backend{{URL: backendURL}},
+		RateLimitPerMin: 100,
+		RequireAuth:     true,
+	}
+
+	gateway.RegisterRoute("/api/test", route)
+
+	// Make request
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("X-API-Key", "test-key")
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	body, _ := io.ReadAll(w.Body)
+	if !bytes.Contains(body, []byte("status")) {
+		t.Error("response body not correct")
+	}
+}
+
+func TestGatewayUnauthorized(t *testing.T) {
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("test-key")
+
+	backends := []*Backend{
+		{URL: parseURL("http://localhost:8081")},
+	}
+
+	route := &Route{
+		Pattern:         "/api/protected",
+		Methods:         []string{"GET"},
+		Backends:        backends,
+		RateLimitPerMin: 100,
+		RequireAuth:     true,
+	}
+
+	gateway.RegisterRoute("/api/protected", route)
+
+	// Request without API key
+	req := httptest.NewRequest("GET", "/api/protected", nil)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+}
+
+func TestGatewayRateLimited(t *testing.T) {
+	gateway := NewAPIGateway()
+	gateway.authenticator.RegisterAPIKey("test-key")
+
+	backends := []*Backend{
+		{URL: parseURL("http://localhost:8081")},
+	}
+
+	route := &Route{
+		Pattern:         "/api/limited",
+		Methods:         []string{"GET"},
+		Backends:        backends,
+		RateLimitPerMin: 2,
+	}
+
+	gateway.RegisterRoute("/api/limited", route)
+
+	clientID := "192.168.1.1"
+
+	// Make 3 requests from same client
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/limited", nil)
+		req.RemoteAddr = clientID
+
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, req)
+
+		if i < 2 && w.Code != http.StatusNotFound {
+			// First 2 should get not found (no backend)
+		} else if i == 2 && w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected 429, got %d", w.Code)
+		}
+	}
+}
+
+func TestGatewayNotFound(t *testing.T) {
+	gateway := NewAPIGateway()
+
+	req := httptest.NewRequest("GET", "/api/nonexistent", nil)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestGatewayWithTransformer(t *testing.T) {
+	// Create mock backend
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check if transformer added header
+		if r.Header.Get("X-Transformed") == "" {
+			t.Error("transformer didn't add header")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+
+	transformer := &SimpleTransformer{addHeader: "value"}
+	route := &Route{
+		Pattern:         "/api/test",
+		Methods:         []string{"GET"},
+		Backends:        []*Backend{{URL: backendURL}},
+		RateLimitPerMin: 100,
+		Transform:       transformer,
+	}
+
+	gateway.RegisterRoute("/api/test", route)
+
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestRequestChain(t *testing.T) {
+	chain := RequestChain{
+		&RequestHeaders{Set: map[string]string{"X-Gateway": "1"}, Remove: []string{"Cookie"}},
+		&PathRewrite{Pattern: regexp.MustCompile(`^/api/v1`), Replacement: "/v1"},
+	}
+	req := httptest.NewRequest("GET", "/api/v1/users", nil)
+	req.Header.Set("Cookie", "session=1")
+
+	if err := chain.Transform(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Gateway") != "1" || req.Header.Get("Cookie") != "" {
+		t.Errorf("headers not transformed: %v", req.Header)
+	}
+	if req.URL.Path != "/v1/users" {
+		t.Errorf("path = %q, want /v1/users", req.URL.Path)
+	}
+
+	// Replacements can use path parameters
+	req = httptest.NewRequest("GET", "/users/42", nil)
+	req = req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, map[string]string{"id": "42"}))
+	(&PathRewrite{Replacement: "/internal/accounts/{id}"}).Transform(req)
+	if req.URL.Path != "/internal/accounts/42" {
+		t.Errorf("path = %q, want /internal/accounts/42", req.URL.Path)
+	}
+}
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       httptest.NewRequest("GET", "/", nil),
+	}
+}
+
+func TestJSONMask(t *testing.T) {
+	mask := &JSONMask{Fields: []string{"ssn", "cards.number"}}
+	resp := jsonResponse(`{"name":"ann","ssn":"123-45-6789","cards":[{"number":"4111","exp":"12/30"},{"number":"5500"}],"balance":10.50}`)
+
+	if err := mask.Transform(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	want := `{"balance":10.50,"cards":[{"exp":"12/30","number":"***"},{"number":"***"}],"name":"ann","ssn":"***"}`
+	if string(body) != want {
+		t.Errorf("masked body = %s, want %s", body, want)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(want)) {
+		t.Errorf("Content-Length = %s, want %d", resp.Header.Get("Content-Length"), len(want))
+	}
+
+	// Gzipped bodies are decoded before masking
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"ssn":"123"}`))
+	zw.Close()
+	resp = jsonResponse(buf.String())
+	resp.Header.Set("Content-Encoding", "gzip")
+	if err := mask.Transform(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if string(body) != `{"ssn":"***"}` || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("gzipped body masked to %s (encoding %q)", body, resp.Header.Get("Content-Encoding"))
+	}
+
+	if err := mask.Transform(jsonResponse(`{"ssn":`)); err == nil {
+		t.Error("expected malformed JSON to fail rather than pass through unmasked")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, deflate", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"*", "gzip"},
+		{"*, gzip;q=0", "deflate"},
+		{"identity", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept, []string{"gzip", "deflate"}); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayTransformPipelineFromConfig(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/accounts/7" {
+			t.Errorf("backend got path %q", r.URL.Path)
+		}
+		if r.Header.Get("X-Internal") != "" || r.Header.Get("X-Tenant") != "acme" {
+			t.Errorf("request headers not transformed: %v", r.Header)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "backend/1.0")
+		fmt.Fprint(w, `{"id":7,"password":"hunter2"}`)
+	}))
+	defer backend.Close()
+
+	cfg, err := parseConfig([]byte(`{"routes": [{
+		"pattern": "/users/{id}",
+		"methods": ["GET"],
+		"backends": [{"url": "` + backend.URL + `"}],
+		"transforms": [
+			{"type": "request_headers", "set": {"X-Tenant": "acme"}, "remove": ["X-Internal"]},
+			{"type": "path_rewrite", "replacement": "/accounts/{id}"},
+			{"type": "mask_json", "fields": ["password"]},
+			{"type": "response_headers", "remove": ["Server"]},
+			{"type": "compress", "encodings": ["gzip"]}
+		]
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := NewAPIGateway()
+	if err := gateway.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/users/7", nil)
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Server") != "" {
+		t.Errorf("response headers not transformed: %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != `{"id":7,"password":"***"}` {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestBuildTransformsErrors(t *testing.T) {
+	for _, tc := range []TransformConfig{
+		{Type: "teleport"},
+		{Type: "path_rewrite", Pattern: "("},
+		{Type: "mask_json"},
+		{Type: "compress", Encodings: []string{"br"}},
+	} {
+		if _, _, err := buildTransforms([]TransformConfig{tc}); err == nil {
+			t.Errorf("expected error for %+v", tc)
+		}
+	}
+
+	RegisterEncoding("test-identity", func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} })
+	if _, _, err := buildTransforms([]TransformConfig{{Type: "compress", Encodings: []string{"test-identity"}}}); err != nil {
+		t.Errorf("registered encoding rejected: %v", err)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestCacheKeyGeneration(t *testing.T) {
+	gateway := NewAPIGateway()
+
+	req1 := httptest.NewRequest("GET", "/api/test", nil)
+	req2 := httptest.NewRequest("GET", "/api/test", nil)
+	req3 := httptest.NewRequest("POST", "/api/test", nil)
+
+	key1 := gateway.generateCacheKey(req1)
+	key2 := gateway.generateCacheKey(req2)
+	key3 := gateway.generateCacheKey(req3)
+
+	if key1 != key2 {
+		t.Error("same requests should generate same cache key")
+	}
+
+	if key1 == key3 {
+		t.Error("different methods should generate different cache key")
+	}
+}
+
+func TestGetClientID(t *testing.T) {
+	gateway := NewAPIGateway()
+
+	// Test with API key
+	req1 := httptest.NewRequest("GET", "/test", nil)
+	req1.Header.Set("X-API-Key", "my-key")
+	if gateway.getClientID(req1) != "my-key" {
+		t.Error("should use API key as client ID")
+	}
+
+	// Test with remote address
+	req2 := httptest.NewRequest("GET", "/test", nil)
+	req2.RemoteAddr = "192.168.1.1:5000"
+	if gateway.getClientID(req2) != "192.168.1.1:5000" {
+		t.Error("should use remote address as fallback")
+	}
+}
+
+func TestResponseWriterWrapper(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	wrapped := &responseWriterWrapper{ResponseWriter: recorder}
+
+	wrapped.WriteHeader(http.StatusOK)
+	wrapped.Write([]byte("test"))
+
+	if wrapped.statusCode != http.StatusOK {
+		t.Error("status code not recorded")
+	}
+
+	if !bytes.Equal(wrapped.body, []byte("test")) {
+		t.Error("body not recorded")
+	}
+}
+
+func TestResponseWriterWrapperCaptureLimit(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	wrapped := &responseWriterWrapper{ResponseWriter: recorder, limit: 8}
+
+	wrapped.Write([]byte("12345"))
+	if !wrapped.cacheable() {
+		t.Error("body under the limit should be cacheable")
+	}
+
+	wrapped.Write([]byte("67890"))
+	if wrapped.cacheable() || wrapped.body != nil {
+		t.Error("body over the limit should be dropped from capture")
+	}
+	if recorder.Body.String() != "1234567890" {
+		t.Errorf("client should still get the full body, got %q", recorder.Body.String())
+	}
+
+	discarding := &responseWriterWrapper{ResponseWriter: httptest.NewRecorder(), discard: true}
+	discarding.Write([]byte("data"))
+	if discarding.body != nil || discarding.cacheable() {
+		t.Error("discarding wrapper should not capture")
+	}
+}
+
+func TestGatewayStreamsResponses(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/download", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: backendURL}},
+		CacheTTL: time.Minute,
+		Stream:   true,
+	})
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/download")
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first chunk must arrive while the backend is still writing
+	buf := make([]byte, len("first\n"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || string(buf) != "first\n" {
+			t.Errorf("unexpected first chunk %q: %v", buf, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("first chunk was buffered instead of streamed")
+	}
+	close(release)
+
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != "second\n" {
+		t.Errorf("unexpected remainder %q", rest)
+	}
+
+	if cached := gateway.cache.Get(gateway.generateCacheKey(httptest.NewRequest("GET", "/download", nil))); cached != nil {
+		t.Error("streamed responses should not be cached")
+	}
+}
+
+func TestGatewaySkipsCachingLargeResponses(t *testing.T) {
+	var hits int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write(bytes.Repeat([]byte("x"), 64))
+	}))
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/big", &Route{
+		Methods:           []string{"GET"},
+		Backends:          []*Backend{{URL: backendURL}},
+		CacheTTL:          time.Minute,
+		MaxCacheBodyBytes: 32,
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/big", nil))
+		if w.Body.Len() != 64 {
+			t.Errorf("expected full 64 byte body, got %d", w.Body.Len())
+		}
+		if w.Header().Get("X-Cache") == "HIT" {
+			t.Error("oversized response should not be served from cache")
+		}
+	}
+	if hits != 2 {
+		t.Errorf("expected both requests to reach the backend, got %d", hits)
+	}
+}
+
+// echoWebSocketBackend completes the upgrade handshake and then echoes
+// raw bytes, which is all the gateway sees of WebSocket framing
+func echoWebSocketBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("backend hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+}
+
+func dialWebSocket(t *testing.T, serverURL, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	u, _ := url.Parse(serverURL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", path, u.Host)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestGatewayWebSocketTunnel(t *testing.T) {
+	backend := echoWebSocketBackend(t)
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/ws", &Route{
+		Methods:   []string{"GET"},
+		Backends:  []*Backend{{URL: backendURL}},
+		WebSocket: true,
+	})
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	conn, reader, resp := dialWebSocket(t, server.URL, "/ws")
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected echoed ping, got %q: %v", buf, err)
+	}
+}
+
+func TestGatewayWebSocketDisabled(t *testing.T) {
+	backend := echoWebSocketBackend(t)
+	defer backend.Close()
+
+	gateway := NewAPIGateway()
+	backendURL, _ := url.Parse(backend.URL)
+	gateway.RegisterRoute("/ws", &Route{
+		Methods:  []string{"GET"},
+		Backends: []*Backend{{URL: backendURL}},
+	})
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	conn, _, resp := dialWebSocket(t, server.URL, "/ws")
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for route without WebSocket, got %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayEventStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	newRoute := func(enabled bool) *Route {
+		return &Route{
+			Methods:     []string{"GET"},
+			Backends:    []*Backend{{URL: backendURL}},
+			CacheTTL:    time.Minute,
+			EventStream: enabled,
+		}
+	}
+
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/events", newRoute(true))
+	gateway.RegisterRoute("/plain", newRoute(false))
+
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "data: 2") {
+		t.Errorf("expected all events, got %q", w.Body.String())
+	}
+	if !w.Flushed {
+		t.Error("event stream should be flushed as it arrives")
+	}
+	if gateway.cache.Get(gateway.generateCacheKey(req)) != nil {
+		t.Error("event streams should not be cached")
+	}
+
+	req = httptest.NewRequest("GET", "/plain", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected 406 for route without EventStream, got %d", w.Code)
+	}
+
+	// An event stream the client didn't ask for is still never cached
+	req = httptest.NewRequest("GET", "/plain", nil)
+	gateway.ServeHTTP(httptest.NewRecorder(), req)
+	if gateway.cache.Get(gateway.generateCacheKey(req)) != nil {
+		t.Error("event-stream responses should not be cached")
+	}
+}
+
+func TestHeaderHasToken(t *testing.T) {
+	h := http.Header{}
+	h.Add("Connection", "keep-alive, Upgrade")
+	h.Add("Accept", "text/html;q=0.9, text/event-stream")
+
+	if !headerHasToken(h, "Connection", "upgrade") {
+		t.Error("expected upgrade token")
+	}
+	if !headerHasToken(h, "Accept", "text/event-stream") {
+		t.Error("expected event-stream token")
+	}
+	if headerHasToken(h, "Connection", "close") {
+		t.Error("unexpected close token")
+	}
+}
+
+// countingBackend answers every request with status and body, counting hits
+func countingBackend(status int, body string, delay time.Duration, hits *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func retryGateway(policy *RetryPolicy, servers ...*httptest.Server) *APIGateway {
+	var backends []*Backend
+	for _, server := range servers {
+		u, _ := url.Parse(server.URL)
+		backends = append(backends, &Backend{URL: u})
+	}
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/api/retry", &Route{
+		Methods:  []string{"GET", "POST", "PUT"},
+		Backends: backends,
+		Retry:    policy,
+	})
+	return gateway
+}
+
+func TestGatewayRetriesOnAnotherBackend(t *testing.T) {
+	var badHits, goodHits atomic.Int32
+	bad := countingBackend(http.StatusServiceUnavailable, "down", 0, &badHits)
+	defer bad.Close()
+	good := countingBackend(http.StatusOK, "up", 0, &goodHits)
+	defer good.Close()
+
+	gateway := retryGateway(&RetryPolicy{MaxAttempts: 2}, bad, good)
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api/retry", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "up" {
+			t.Errorf("request %d: expected 200 up, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if goodHits.Load() != 4 {
+		t.Errorf("expected 4 hits on the healthy backend, got %d", goodHits.Load())
+	}
+	// A retry never returns to the backend that just failed
+	if badHits.Load() > 4 {
+		t.Errorf("expected at most one attempt per request on the failing backend, got %d", badHits.Load())
+	}
+}
+
+func TestGatewayRetryGivesUp(t *testing.T) {
+	var hits atomic.Int32
+	bad := countingBackend(http.StatusBadGateway, "down", 0, &hits)
+	defer bad.Close()
+
+	gateway := retryGateway(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, bad)
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api/retry", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected final 502, got %d", w.Code)
+	}
+	if hits.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", hits.Load())
 	}
 }
 
-func TestMethodAllowed(t *testing.T) {
-	tests := []struct {
-		methods  []string
-		method   string
-		expected bool
-	}{
-		{[]string{"GET"}, "GET", true},
-		{[]string{"GET"}, "POST", false},
-		{[]string{"GET", "POST"}, "POST", true},
-		{[]string{"*"}, "DELETE", true},
+func TestGatewayRetrySkipsNonRetryable(t *testing.T) {
+	var hits atomic.Int32
+	backend := countingBackend(http.StatusInternalServerError, "boom", 0, &hits)
+	defer backend.Close()
+
+	gateway := retryGateway(&RetryPolicy{MaxAttempts: 3}, backend)
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api/retry", nil))
+	if w.Code != http.StatusInternalServerError || hits.Load() != 1 {
+		t.Errorf("500 is not retryable by default: got %d after %d attempts", w.Code, hits.Load())
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.method, func(t *testing.T) {
-			result := methodAllowed(tt.methods, tt.method)
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v", tt.expected, result)
-			}
-		})
+	hits.Store(0)
+	unavailable := countingBackend(http.StatusServiceUnavailable, "down", 0, &hits)
+	defer unavailable.Close()
+	gateway = retryGateway(&RetryPolicy{MaxAttempts: 3}, unavailable)
+
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("POST", "/api/retry", nil))
+	if hits.Load() != 1 {
+		t.Errorf("POST should not be retried, got %d attempts", hits.Load())
 	}
 }
 
-func TestGatewayWithMockedBackend(t *testing.T) {
-	// Create mock backend server
+func TestGatewayRetryReplaysBody(t *testing.T) {
+	var calls atomic.Int32
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "ok"}`))
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
 	}))
 	defer backend.Close()
 
-	// Create gateway
-	gateway := NewAPIGateway()
-	gateway.authenticator.RegisterAPIKey("test-key")
+	gateway := retryGateway(&RetryPolicy{MaxAttempts: 2}, backend)
 
-	backendURL, _ := url.Parse(backend.URL)
-	route := &Route{
-		Pattern:         "/api/test",
-		Methods:         []string{"GET"},
-		Backends:        []*Backend{{URL: backendURL}},
-		RateLimitPerMin: 100,
-		RequireAuth:     true,
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest("PUT", "/api/retry", strings.NewReader("payload")))
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("expected replayed body, got %d %q", w.Code, w.Body.String())
 	}
+}
 
-	gateway.RegisterRoute("/api/test", route)
-
-	// Make request
-	req := httptest.NewRequest("GET", "/api/test", nil)
-	req.Header.Set("X-API-Key", "test-key")
+func TestGatewayHedgedRequest(t *testing.T) {
+	var slowHits, fastHits atomic.Int32
+	slow := countingBackend(http.StatusOK, "slow", 2*time.Second, &slowHits)
+	defer slow.Close()
+	fast := countingBackend(http.StatusOK, "fast", 0, &fastHits)
+	defer fast.Close()
 
-	w := httptest.NewRecorder()
-	gateway.ServeHTTP(w, req)
+	gateway := retryGateway(&RetryPolicy{MaxAttempts: 2, HedgeAfter: 20 * time.Millisecond}, slow, fast)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status 200, got %d", w.Code)
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api/retry", nil))
+		if w.Body.String() != "fast" {
+			t.Errorf("expected the fast backend to win, got %q", w.Body.String())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("hedged request took %v", elapsed)
+		}
 	}
+}
 
-	body, _ := io.ReadAll(w.Body)
-	if !bytes.Contains(body, []byte("status")) {
-		t.Error("response body not correct")
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if got := policy.backoff(i + 1); got != w*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+	if (&RetryPolicy{}).backoff(3) != 0 {
+		t.Error("zero Backoff should retry immediately")
 	}
 }
 
-func TestGatewayUnauthorized(t *testing.T) {
-	gateway := NewAPIGateway()
-	gateway.authenticator.RegisterAPIKey("test-key")
-
+func TestSelectBackendExcluding(t *testing.T) {
 	backends := []*Backend{
 		{URL: parseURL("http://localhost:8081")},
+		{URL: parseURL("http://localhost:8082")},
 	}
+	backends[0].TotalRequests.Store(0)
+	backends[1].TotalRequests.Store(10)
 
-	route := &Route{
-		Pattern:         "/api/protected",
-		Methods:         []string{"GET"},
-		Backends:        backends,
-		RateLimitPerMin: 100,
-		RequireAuth:     true,
+	// least-connections would always pick backends[0]
+	lb := NewLoadBalancer(backends, "least-connections")
+	if got := lb.SelectBackendExcluding(map[*Backend]bool{backends[0]: true}); got != backends[1] {
+		t.Error("expected the untried backend")
 	}
+	if got := lb.SelectBackendExcluding(map[*Backend]bool{backends[0]: true, backends[1]: true}); got == nil {
+		t.Error("expected a backend once all have been tried")
+	}
+}
 
-	gateway.RegisterRoute("/api/protected", route)
-
-	// Request without API key
-	req := httptest.NewRequest("GET", "/api/protected", nil)
-	w := httptest.NewRecorder()
-	gateway.ServeHTTP(w, req)
-
-	if w.Code != http.StatusUnauthorized {
-		t.Errorf("expected status 401, got %d", w.Code)
+func writeConfig(t *testing.T, path, backendURL, pattern string) {
+	t.Helper()
+	cfg := fmt.Sprintf(`{
+		"api_keys": ["cfg-key"],
+		"routes": [{
+			"pattern": %q,
+			"methods": ["GET"],
+			"backends": [{"url": %q, "timeout": "2s"}],
+			"rate_limit_per_min": 50,
+			"require_auth": true,
+			"cache_ttl": "30s",
+			"max_body_bytes": 1024,
+			"timeout": "5s",
+			"canary": {"backends": [{"url": "http://users-next:8080"}], "percent": 5},
+			"idempotency_ttl": "1h",
+			"retry": {"max_attempts": 2, "backoff": "10ms"}
+		}]
+	}`, pattern, backendURL)
+	if err := os.WriteFile(path, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestGatewayRateLimited(t *testing.T) {
-	gateway := NewAPIGateway()
-	gateway.authenticator.RegisterAPIKey("test-key")
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	writeConfig(t, path, "http://users:8080", "/api/users/{id}")
 
-	backends := []*Backend{
-		{URL: parseURL("http://localhost:8081")},
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	routes, err := cfg.BuildRoutes()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	route := &Route{
-		Pattern:         "/api/limited",
-		Methods:         []string{"GET"},
-		Backends:        backends,
-		RateLimitPerMin: 2,
+	route := routes["/api/users/{id}"]
+	if route == nil {
+		t.Fatalf("route not built: %v", routes)
+	}
+	if route.CacheTTL != 30*time.Second || route.RateLimitPerMin != 50 || !route.RequireAuth || route.MaxBodyBytes != 1024 || route.Timeout != 5*time.Second || route.IdempotencyTTL != time.Hour {
+		t.Errorf("route fields not loaded: %+v", route)
+	}
+	if route.Backends[0].URL.Host != "users:8080" || route.Backends[0].Timeout != 2*time.Second {
+		t.Errorf("backend not loaded: %+v", route.Backends[0])
 	}
+	if route.Retry == nil || route.Retry.MaxAttempts != 2 || route.Retry.Backoff != 10*time.Millisecond {
+		t.Errorf("retry policy not loaded: %+v", route.Retry)
+	}
+	if route.Canary == nil || route.Canary.Percent != 5 || route.Canary.Backends[0].URL.Host != "users-next:8080" {
+		t.Errorf("canary not loaded: %+v", route.Canary)
+	}
+}
 
-	gateway.RegisterRoute("/api/limited", route)
+func TestLoadConfigYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	yamlConfig := `
+api_keys: [cfg-key]
+routes:
+  - pattern: /api/users/{id}
+    methods: [GET]
+    backends:
+      - url: http://users:8080
+        timeout: 2s
+    rate_limit_per_min: 50
+    cache_ttl: 30s
+    retry:
+      max_attempts: 2
+      backoff: 10ms
+`
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
 
-	clientID := "192.168.1.1"
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	routes, err := cfg.BuildRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Make 3 requests from same client
-	for i := 0; i < 3; i++ {
-		req := httptest.NewRequest("GET", "/api/limited", nil)
-		req.RemoteAddr = clientID
+	route := routes["/api/users/{id}"]
+	if route == nil {
+		t.Fatalf("route not built: %v", routes)
+	}
+	if route.CacheTTL != 30*time.Second || route.RateLimitPerMin != 50 || route.Backends[0].Timeout != 2*time.Second {
+		t.Errorf("route fields not loaded: %+v", route)
+	}
+	if route.Retry == nil || route.Retry.Backoff != 10*time.Millisecond {
+		t.Errorf("retry policy not loaded: %+v", route.Retry)
+	}
 
-		w := httptest.NewRecorder()
-		gateway.ServeHTTP(w, req)
+	// YAML gets the same checks as JSON
+	os.WriteFile(path, []byte("routes: []\nrouets: []\n"), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected error for unknown YAML field")
+	}
+}
 
-		if i < 2 && w.Code != http.StatusNotFound {
-			// First 2 should get not found (no backend)
-		} else if i == 2 && w.Code != http.StatusTooManyRequests {
-			t.Errorf("expected 429, got %d", w.Code)
+func TestApplyConfigKeepsRouteState(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	config := func(limit int) *GatewayConfig {
+		cfg, err := parseConfig([]byte(fmt.Sprintf(`{"routes": [{
+			"pattern": "/api",
+			"methods": ["GET"],
+			"backends": [{"url": %q}],
+			"rate_limit_per_min": %d
+		}]}`, backend.URL, limit)))
+		if err != nil {
+			t.Fatal(err)
 		}
+		return cfg
+	}
+	status := func(gateway *APIGateway) int {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+		return w.Code
 	}
-}
 
-func TestGatewayNotFound(t *testing.T) {
 	gateway := NewAPIGateway()
+	if err := gateway.ApplyConfig(config(2)); err != nil {
+		t.Fatal(err)
+	}
+	status(gateway)
+	status(gateway)
+	gateway.CircuitBreaker(backend.URL).RecordFailure()
 
-	req := httptest.NewRequest("GET", "/api/nonexistent", nil)
-	w := httptest.NewRecorder()
-	gateway.ServeHTTP(w, req)
+	// Reloading the same route keeps its rate limit window and breaker
+	if err := gateway.ApplyConfig(config(2)); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(gateway); code != http.StatusTooManyRequests {
+		t.Errorf("expected the limit to carry over the reload, got %d", code)
+	}
+	if _, failures := gateway.CircuitBreaker(backend.URL).Counts(); failures != 1 {
+		t.Errorf("expected the breaker to carry over the reload, got %d failures", failures)
+	}
 
-	if w.Code != http.StatusNotFound {
-		t.Errorf("expected status 404, got %d", w.Code)
+	// A changed limit starts a fresh limiter
+	if err := gateway.ApplyConfig(config(5)); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(gateway); code != http.StatusOK {
+		t.Errorf("expected a new limit to start fresh, got %d", code)
 	}
 }
 
-func TestGatewayWithTransformer(t *testing.T) {
-	// Create mock backend
+func TestParseConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":     `{"routes": [], "rouets": []}`,
+		"bad duration":      `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": [{"url": "http://a"}], "cache_ttl": 5}]}`,
+		"no backends":       `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": []}]}`,
+		"bad backend url":   `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": [{"url": "not a url"}]}]}`,
+		"empty canary":      `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": [{"url": "http://a"}], "canary": {"backends": [], "percent": 5}}]}`,
+		"canary percent":    `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": [{"url": "http://a"}], "canary": {"backends": [{"url": "http://b"}], "percent": 150}}]}`,
+		"bad pattern":       `{"routes": [{"pattern": "/a/{}", "methods": ["GET"], "backends": [{"url": "http://a"}]}]}`,
+		"duplicate pattern": `{"routes": [{"pattern": "/a", "methods": ["GET"], "backends": [{"url": "http://a"}]}, {"pattern": "/a", "methods": ["GET"], "backends": [{"url": "http://b"}]}]}`,
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseConfig([]byte(data)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestApplyConfigReplacesRoutes(t *testing.T) {
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if transformer added header
-		if r.Header.Get("X-Transformed") == "" {
-			t.Error("transformer didn't add header")
-		}
-		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	}))
 	defer backend.Close()
 
 	gateway := NewAPIGateway()
-	backendURL, _ := url.Parse(backend.URL)
+	gateway.authenticator.RegisterAPIKey("old-key")
+	gateway.RegisterRoute("/old", &Route{Methods: []string{"GET"}, Backends: []*Backend{{URL: parseURL(backend.URL)}}})
 
-	transformer := &SimpleTransformer{addHeader: "value"}
-	route := &Route{
-		Pattern:         "/api/test",
-		Methods:         []string{"GET"},
-		Backends:        []*Backend{{URL: backendURL}},
-		RateLimitPerMin: 100,
-		Transform:       transformer,
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	writeConfig(t, path, backend.URL, "/new")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
 	}
 
-	gateway.RegisterRoute("/api/test", route)
-
-	req := httptest.NewRequest("GET", "/api/test", nil)
 	w := httptest.NewRecorder()
-	gateway.ServeHTTP(w, req)
+	gateway.ServeHTTP(w, httptest.NewRequest("GET", "/old", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("old route should be gone, got %d", w.Code)
+	}
 
+	req := httptest.NewRequest("GET", "/new", nil)
+	req.Header.Set("X-API-Key", "cfg-key")
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
 	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+		t.Errorf("new route with config key: expected 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/new", nil)
+	req.Header.Set("X-API-Key", "old-key")
+	w = httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("config api_keys should replace registered keys, got %d", w.Code)
 	}
 }
 
-func TestCacheKeyGeneration(t *testing.T) {
-	gateway := NewAPIGateway()
+func TestReplaceRoutesKeepsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("finished"))
+	}))
+	defer backend.Close()
 
-	req1 := httptest.NewRequest("GET", "/api/test", nil)
-	req2 := httptest.NewRequest("GET", "/api/test", nil)
-	req3 := httptest.NewRequest("POST", "/api/test", nil)
+	gateway := NewAPIGateway()
+	gateway.RegisterRoute("/slow", &Route{Methods: []string{"GET"}, Backends: []*Backend{{URL: parseURL(backend.URL)}}})
 
-	key1 := gateway.generateCacheKey(req1)
-	key2 := gateway.generateCacheKey(req2)
-	key3 := gateway.generateCacheKey(req3)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		done <- w
+	}()
 
-	if key1 != key2 {
-		t.Error("same requests should generate same cache key")
+	<-started
+	if err := gateway.ReplaceRoutes(map[string]*Route{}); err != nil {
+		t.Fatal(err)
 	}
+	close(release)
 
-	if key1 == key3 {
-		t.Error("different methods should generate different cache key")
+	w := <-done
+	if w.Code != http.StatusOK || w.Body.String() != "finished" {
+		t.Errorf("in-flight request should complete, got %d %q", w.Code, w.Body.String())
 	}
 }
 
-func TestGetClientID(t *testing.T) {
+func TestWatchConfigReloads(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	writeConfig(t, path, backend.URL, "/v1")
 	gateway := NewAPIGateway()
 
-	// Test with API key
-	req1 := httptest.NewRequest("GET", "/test", nil)
-	req1.Header.Set("X-API-Key", "my-key")
-	if gateway.getClientID(req1) != "my-key" {
-		t.Error("should use API key as client ID")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gateway.WatchConfig(ctx, path); err != nil {
+		t.Fatal(err)
 	}
 
-	// Test with remote address
-	req2 := httptest.NewRequest("GET", "/test", nil)
-	req2.RemoteAddr = "192.168.1.1:5000"
-	if gateway.getClientID(req2) != "192.168.1.1:5000" {
-		t.Error("should use remote address as fallback")
+	status := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", "cfg-key")
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, req)
+		return w.Code
+	}
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
 	}
-}
 
-func TestResponseWriterWrapper(t *testing.T) {
-	recorder := httptest.NewRecorder()
-	wrapped := &responseWriterWrapper{ResponseWriter: recorder}
+	if status("/v1") != http.StatusOK {
+		t.Fatal("initial config should be applied")
+	}
 
-	wrapped.WriteHeader(http.StatusOK)
-	wrapped.Write([]byte("test"))
+	writeConfig(t, path, backend.URL, "/v2")
+	if !waitFor(func() bool { return status("/v2") == http.StatusOK }) {
+		t.Fatal("config change was not picked up")
+	}
+	if status("/v1") != http.StatusNotFound {
+		t.Error("old route should be removed after reload")
+	}
 
-	if wrapped.statusCode != http.StatusOK {
-		t.Error("status code not recorded")
+	// A broken file leaves the running routes alone
+	os.WriteFile(path, []byte("{not json"), 0o644)
+	time.Sleep(2 * configReloadDebounce)
+	if status("/v2") != http.StatusOK {
+		t.Error("broken config should not replace working routes")
 	}
 
-	if !bytes.Equal(wrapped.body, []byte("test")) {
-		t.Error("body not recorded")
+	// Saving by rename, as many editors do, is picked up too
+	tmp := path + ".tmp"
+	writeConfig(t, tmp, backend.URL, "/v3")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return status("/v3") == http.StatusOK }) {
+		t.Fatal("renamed config was not picked up")
 	}
 }
 
@@ -674,7 +4052,7 @@ func BenchmarkRateLimiterAllowRequest(b *testing.B) {
 }
 
 func BenchmarkCircuitBreakerAllowRequest(b *testing.B) {
-	cb := NewCircuitBreaker(5, 2, 10*time.Second)
+	cb := NewCircuitBreaker("bench", CircuitBreakerConfig{})
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -696,6 +4074,50 @@ func BenchmarkLoadBalancerSelect(b *testing.B) {
 	}
 }
 
+// benchmarkRoutes builds n unrelated routes plus the catch-all being looked up
+func benchmarkRoutes(n int) map[string]*Route {
+	routes := make(map[string]*Route, n+1)
+	for i := 0; i < n; i++ {
+		routes[fmt.Sprintf("/api/service%d/items", i)] = &Route{Methods: []string{"GET"}}
+	}
+	routes["/api/users/*"] = &Route{Methods: []string{"GET"}}
+	return routes
+}
+
+func BenchmarkRouterLookup(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", n), func(b *testing.B) {
+			rt := newRouter()
+			for pattern, route := range benchmarkRoutes(n) {
+				rt.Insert(pattern, route)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rt.Lookup("GET", "/api/users/42/orders")
+			}
+		})
+	}
+}
+
+// BenchmarkLinearScanLookup is the map scan findRoute used before the router
+func BenchmarkLinearScanLookup(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", n), func(b *testing.B) {
+			routes := benchmarkRoutes(n)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for pattern, route := range routes {
+					if matchPath(pattern, "/api/users/42/orders") && methodAllowed(route.Methods, "GET") {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkCacheGetSet(b *testing.B) {
 	cache := NewResponseCache()
 	key := "bench-key"
@@ -62,6 +62,7 @@ const (
 	StatusRunning   JobStatus = "running"
 	StatusCompleted JobStatus = "completed"
 	StatusFailed    JobStatus = "failed"
+	StatusSkipped   JobStatus = "skipped"
 )
 
 // JobHandler is the function executed by a job
@@ -921,6 +922,341 @@ func (jd *JobDAG) topologicalSort() []string {
 	return result
 }
 
+// PipelineGroupMode controls how a PipelineGroup reacts to a failing pipeline
+type PipelineGroupMode string
+
+const (
+	// FailFast stops the whole group at the first pipeline failure
+	FailFast PipelineGroupMode = "fail_fast"
+	// ContinueOnError keeps running pipelines that do not depend on a failure
+	ContinueOnError PipelineGroupMode = "continue_on_error"
+)
+
+// PipelineGroup wires multiple ETL pipelines into a dependency graph.
+// The loaded output of each upstream pipeline becomes the extracted input
+// of the pipelines that depend on it.
+type PipelineGroup struct {
+	name         string
+	mode         PipelineGroupMode
+	order        []string
+	pipelines    map[string]*ETLPipeline
+	dependencies map[string][]string
+	outputs      map[string][]interface{}
+	status       map[string]JobStatus
+	errors       map[string]error
+	running      atomic.Bool
+	mu           sync.RWMutex
+}
+
+// upstreamExtractor feeds the outputs of upstream pipelines into a pipeline
+type upstreamExtractor struct {
+	items []interface{}
+}
+
+func (ue *upstreamExtractor) Extract(ctx context.Context) ([]interface{}, error) {
+	return ue.items, nil
+}
+
+// capturingLoader records loaded items before forwarding them to the next loader
+type capturingLoader struct {
+	next     DataLoader
+	captured []interface{}
+}
+
+func (cl *capturingLoader) Load(ctx context.Context, items []interface{}) error {
+	if cl.next != nil {
+		if err := cl.next.Load(ctx, items); err != nil {
+			return err
+		}
+	}
+	cl.captured = append(cl.captured, items...)
+	return nil
+}
+
+// NewPipelineGroup creates a new pipeline group
+func NewPipelineGroup(name string, mode PipelineGroupMode) *PipelineGroup {
+	if mode == "" {
+		mode = FailFast
+	}
+
+	return &PipelineGroup{
+		name:         name,
+		mode:         mode,
+		order:        make([]string, 0),
+		pipelines:    make(map[string]*ETLPipeline),
+		dependencies: make(map[string][]string),
+		outputs:      make(map[string][]interface{}),
+		status:       make(map[string]JobStatus),
+		errors:       make(map[string]error),
+	}
+}
+
+// AddPipeline adds a pipeline to the group, keyed by its name
+func (pg *PipelineGroup) AddPipeline(p *ETLPipeline) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if _, exists := pg.pipelines[p.name]; exists {
+		return fmt.Errorf("pipeline %s already registered", p.name)
+	}
+
+	pg.pipelines[p.name] = p
+	pg.order = append(pg.order, p.name)
+	pg.status[p.name] = StatusPending
+
+	return nil
+}
+
+// Connect makes the output of the "from" pipeline feed the extractor of "to"
+func (pg *PipelineGroup) Connect(from, to string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if _, exists := pg.pipelines[from]; !exists {
+		return fmt.Errorf("pipeline %s not found", from)
+	}
+	if _, exists := pg.pipelines[to]; !exists {
+		return fmt.Errorf("pipeline %s not found", to)
+	}
+	if from == to {
+		return errors.New("pipeline cannot depend on itself")
+	}
+
+	pg.dependencies[to] = append(pg.dependencies[to], from)
+	return nil
+}
+
+// Execute runs every pipeline in dependency order. The group lock is only
+// held to snapshot the graph and to record progress, so status and metrics
+// stay readable while pipelines run.
+func (pg *PipelineGroup) Execute(ctx context.Context) error {
+	if !pg.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("pipeline group %s is already running", pg.name)
+	}
+	defer pg.running.Store(false)
+
+	pg.mu.Lock()
+	sorted, err := pg.topologicalSort()
+	if err != nil {
+		pg.mu.Unlock()
+		return err
+	}
+
+	pipelines := make(map[string]*ETLPipeline, len(pg.pipelines))
+	for name, p := range pg.pipelines {
+		pipelines[name] = p
+	}
+	dependencies := make(map[string][]string, len(pg.dependencies))
+	for name, deps := range pg.dependencies {
+		dependencies[name] = append([]string(nil), deps...)
+	}
+	mode := pg.mode
+
+	for _, name := range pg.order {
+		pg.status[name] = StatusPending
+		delete(pg.errors, name)
+		delete(pg.outputs, name)
+	}
+	pg.mu.Unlock()
+
+	var failures []error
+
+	for _, name := range sorted {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if upstream := pg.failedUpstream(dependencies[name]); upstream != "" {
+			pg.setStatus(name, StatusSkipped, fmt.Errorf("skipped: upstream pipeline %s did not complete", upstream))
+			continue
+		}
+
+		pg.setStatus(name, StatusRunning, nil)
+		if err := pg.runPipeline(ctx, name, pipelines[name], dependencies[name]); err != nil {
+			pg.setStatus(name, StatusFailed, err)
+
+			if mode == FailFast {
+				pg.skipRemaining(sorted)
+				return fmt.Errorf("pipeline %s failed: %v", name, err)
+			}
+
+			failures = append(failures, fmt.Errorf("pipeline %s failed: %v", name, err))
+			continue
+		}
+
+		pg.setStatus(name, StatusCompleted, nil)
+	}
+
+	return errors.Join(failures...)
+}
+
+// setStatus records a pipeline's status and, when non-nil, its error
+func (pg *PipelineGroup) setStatus(name string, status JobStatus, err error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.status[name] = status
+	if err != nil {
+		pg.errors[name] = err
+	}
+}
+
+// runPipeline executes a single pipeline, wiring its upstream outputs in
+// as the extractor and capturing whatever it loads for its dependents
+func (pg *PipelineGroup) runPipeline(ctx context.Context, name string, p *ETLPipeline, deps []string) error {
+	var input []interface{}
+	if len(deps) > 0 {
+		input = make([]interface{}, 0)
+		pg.mu.RLock()
+		for _, dep := range deps {
+			input = append(input, pg.outputs[dep]...)
+		}
+		pg.mu.RUnlock()
+	}
+
+	p.mu.Lock()
+	originalExtractor, originalLoader := p.extractor, p.loader
+	if input != nil {
+		p.extractor = &upstreamExtractor{items: input}
+	}
+	capture := &capturingLoader{next: originalLoader}
+	p.loader = capture
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.extractor, p.loader = originalExtractor, originalLoader
+		p.mu.Unlock()
+	}()
+
+	if err := p.Execute(ctx); err != nil {
+		return err
+	}
+
+	pg.mu.Lock()
+	pg.outputs[name] = capture.captured
+	pg.mu.Unlock()
+	return nil
+}
+
+// failedUpstream returns the first dependency that did not complete
+func (pg *PipelineGroup) failedUpstream(deps []string) string {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+
+	for _, dep := range deps {
+		if pg.status[dep] != StatusCompleted {
+			return dep
+		}
+	}
+	return ""
+}
+
+// skipRemaining marks every pipeline that has not run yet as skipped
+func (pg *PipelineGroup) skipRemaining(sorted []string) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for _, name := range sorted {
+		if pg.status[name] == StatusPending {
+			pg.status[name] = StatusSkipped
+		}
+	}
+}
+
+// topologicalSort orders pipelines so dependencies run first, in the same
+// depth-first manner as JobDAG, and rejects cycles
+func (pg *PipelineGroup) topologicalSort() ([]string, error) {
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var result []string
+
+	var visit func(string) error
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle detected at pipeline %s", name)
+		}
+
+		visiting[name] = true
+		for _, dep := range pg.dependencies[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+
+		result = append(result, name)
+		return nil
+	}
+
+	for _, name := range pg.order {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// GetStatus returns the status of a pipeline in the group
+func (pg *PipelineGroup) GetStatus(name string) JobStatus {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+	return pg.status[name]
+}
+
+// GetError returns the error recorded for a pipeline in the group
+func (pg *PipelineGroup) GetError(name string) error {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+	return pg.errors[name]
+}
+
+// GetOutput returns the items a pipeline loaded during the last execution
+func (pg *PipelineGroup) GetOutput(name string) []interface{} {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+
+	result := make([]interface{}, len(pg.outputs[name]))
+	copy(result, pg.outputs[name])
+	return result
+}
+
+// GetMetrics returns metrics aggregated across all pipelines in the group
+func (pg *PipelineGroup) GetMetrics() map[string]interface{} {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+
+	var extracted, transformed, loaded, errCount, duration int64
+	statusCounts := make(map[JobStatus]int)
+
+	for _, name := range pg.order {
+		m := pg.pipelines[name].metrics
+		extracted += m.extractedCount.Load()
+		transformed += m.transformedCount.Load()
+		loaded += m.loadedCount.Load()
+		errCount += m.errorCount.Load()
+		duration += m.totalDuration.Load()
+		statusCounts[pg.status[name]]++
+	}
+
+	return map[string]interface{}{
+		"pipelines":           len(pg.order),
+		"completed_pipelines": statusCounts[StatusCompleted],
+		"failed_pipelines":    statusCounts[StatusFailed],
+		"skipped_pipelines":   statusCounts[StatusSkipped],
+		"extracted_count":     extracted,
+		"transformed_count":   transformed,
+		"loaded_count":        loaded,
+		"error_count":         errCount,
+		"duration_ms":         duration,
+	}
+}
+
 // Simple implementations for testing
 
 // SimpleDataSource implements DataSource
@@ -642,6 +642,191 @@ func TestJobDAGExecutionFailure(t *testing.T) {
 	}
 }
 
+// Pipeline Group Tests
+
+func TestPipelineGroupChainsOutputs(t *testing.T) {
+	group := NewPipelineGroup("group", FailFast)
+
+	source := NewETLPipeline("source")
+	source.SetExtractor(&TestExtractor{data: []interface{}{
+		map[string]interface{}{"name": "John"},
+		map[string]interface{}{"name": "Jane"},
+	}})
+	source.AddTransformer(&SimpleTransformer{})
+
+	sink := NewETLPipeline("sink")
+	loader := &TestLoader{loaded: make([]interface{}, 0)}
+	sink.SetLoader(loader)
+
+	group.AddPipeline(sink)
+	group.AddPipeline(source)
+
+	if err := group.Connect("source", "sink"); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := group.Execute(ctx); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(loader.loaded) != 2 {
+		t.Fatalf("expected 2 items loaded by sink, got %d", len(loader.loaded))
+	}
+
+	item := loader.loaded[0].(map[string]interface{})
+	if item["transformed"] != true {
+		t.Error("sink should receive transformed output of source")
+	}
+
+	if group.GetStatus("source") != StatusCompleted || group.GetStatus("sink") != StatusCompleted {
+		t.Error("expected both pipelines to complete")
+	}
+
+	metrics := group.GetMetrics()
+	if metrics["extracted_count"].(int64) != 4 {
+		t.Errorf("expected 4 extracted items across group, got %v", metrics["extracted_count"])
+	}
+	if metrics["completed_pipelines"].(int) != 2 {
+		t.Errorf("expected 2 completed pipelines, got %v", metrics["completed_pipelines"])
+	}
+}
+
+func TestPipelineGroupFailFast(t *testing.T) {
+	group := NewPipelineGroup("group", FailFast)
+
+	broken := NewETLPipeline("broken")
+	broken.SetExtractor(&FailingExtractor{})
+
+	independent := NewETLPipeline("independent")
+	independent.SetExtractor(&TestExtractor{data: []interface{}{1}})
+	independent.SetLoader(&TestLoader{})
+
+	group.AddPipeline(broken)
+	group.AddPipeline(independent)
+
+	ctx := context.Background()
+	if err := group.Execute(ctx); err == nil {
+		t.Fatal("expected error from failed pipeline")
+	}
+
+	if group.GetStatus("broken") != StatusFailed {
+		t.Errorf("expected broken status failed, got %s", group.GetStatus("broken"))
+	}
+
+	if group.GetStatus("independent") != StatusSkipped {
+		t.Errorf("expected independent status skipped, got %s", group.GetStatus("independent"))
+	}
+}
+
+func TestPipelineGroupContinueOnError(t *testing.T) {
+	group := NewPipelineGroup("group", ContinueOnError)
+
+	broken := NewETLPipeline("broken")
+	broken.SetExtractor(&FailingExtractor{})
+
+	dependent := NewETLPipeline("dependent")
+	dependent.SetLoader(&TestLoader{})
+
+	independent := NewETLPipeline("independent")
+	independent.SetExtractor(&TestExtractor{data: []interface{}{1}})
+	independent.SetLoader(&TestLoader{})
+
+	group.AddPipeline(broken)
+	group.AddPipeline(dependent)
+	group.AddPipeline(independent)
+	group.Connect("broken", "dependent")
+
+	ctx := context.Background()
+	if err := group.Execute(ctx); err == nil {
+		t.Fatal("expected aggregated error")
+	}
+
+	if group.GetStatus("dependent") != StatusSkipped {
+		t.Errorf("expected dependent status skipped, got %s", group.GetStatus("dependent"))
+	}
+
+	if group.GetStatus("independent") != StatusCompleted {
+		t.Errorf("expected independent status completed, got %s", group.GetStatus("independent"))
+	}
+
+	if group.GetError("dependent") == nil {
+		t.Error("expected skip reason for dependent pipeline")
+	}
+}
+
+func TestPipelineGroupCycle(t *testing.T) {
+	group := NewPipelineGroup("group", FailFast)
+
+	a := NewETLPipeline("a")
+	b := NewETLPipeline("b")
+	group.AddPipeline(a)
+	group.AddPipeline(b)
+	group.Connect("a", "b")
+	group.Connect("b", "a")
+
+	ctx := context.Background()
+	if err := group.Execute(ctx); err == nil {
+		t.Error("expected cycle detection error")
+	}
+}
+
+func TestPipelineGroupDuplicateAndUnknown(t *testing.T) {
+	group := NewPipelineGroup("group", FailFast)
+
+	if err := group.AddPipeline(NewETLPipeline("a")); err != nil {
+		t.Fatalf("AddPipeline failed: %v", err)
+	}
+	if err := group.AddPipeline(NewETLPipeline("a")); err == nil {
+		t.Error("expected error for duplicate pipeline")
+	}
+	if err := group.Connect("a", "missing"); err == nil {
+		t.Error("expected error for unknown pipeline")
+	}
+}
+
+func TestPipelineGroupReadableWhileRunning(t *testing.T) {
+	group := NewPipelineGroup("group", FailFast)
+
+	release := make(chan struct{})
+	slow := NewETLPipeline("slow")
+	slow.SetExtractor(&BlockingExtractor{started: make(chan struct{}), release: release})
+	group.AddPipeline(slow)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- group.Execute(context.Background())
+	}()
+	<-slow.extractor.(*BlockingExtractor).started
+
+	read := make(chan JobStatus, 1)
+	go func() {
+		group.GetMetrics()
+		read <- group.GetStatus("slow")
+	}()
+
+	select {
+	case status := <-read:
+		if status != StatusRunning {
+			t.Errorf("expected slow pipeline to be running, got %s", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetStatus blocked while the group was executing")
+	}
+
+	if err := group.Execute(context.Background()); err == nil {
+		t.Error("expected error when executing a group that is already running")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if group.GetStatus("slow") != StatusCompleted {
+		t.Errorf("expected slow pipeline to complete, got %s", group.GetStatus("slow"))
+	}
+}
+
 // Test Helpers
 
 type TestExtractor struct {
@@ -661,6 +846,23 @@ func (tl *TestLoader) Load(ctx context.Context, items []interface{}) error {
 	return nil
 }
 
+type BlockingExtractor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (be *BlockingExtractor) Extract(ctx context.Context) ([]interface{}, error) {
+	close(be.started)
+	<-be.release
+	return []interface{}{"item"}, nil
+}
+
+type FailingExtractor struct{}
+
+func (fe *FailingExtractor) Extract(ctx context.Context) ([]interface{}, error) {
+	return nil, errors.New("extract failed")
+}
+
 type TestTransformer struct {
 	transformCount int
 }